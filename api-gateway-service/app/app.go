@@ -0,0 +1,157 @@
+// Package app wires the api-gateway-service together. It is the service's
+// only importable package, so cmd/server and the end-to-end suite build the
+// service in exactly the same way.
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/iton0/duss/api-gateway-service/internal/api"
+	"github.com/iton0/duss/api-gateway-service/internal/core/services"
+	"github.com/iton0/duss/api-gateway-service/internal/infrastructure/clients"
+	"github.com/iton0/duss/api-gateway-service/internal/infrastructure/storage"
+	"github.com/iton0/duss/api-gateway-service/internal/infrastructure/web"
+	"github.com/iton0/duss/shared/health"
+	"github.com/iton0/duss/shared/httpclient"
+	"github.com/iton0/duss/shared/tracing"
+)
+
+// Config holds the addresses of the internal services the gateway fronts.
+type Config struct {
+	// ShortenerServiceURLs and RedirectServiceURLs list the replicas of the
+	// internal services, as targets of httpclient.NewBalancer: base URLs or
+	// DNS names that are re-resolved every ResolveInterval.
+	ShortenerServiceURLs []string
+	RedirectServiceURLs  []string
+	// Balancer configures how requests are spread across the replicas.
+	Balancer        []httpclient.BalancerOption
+	ResolveInterval time.Duration
+	// RedirectHedgePercentile, if positive, sends redirect lookups that
+	// take longer than this percentile of recent ones to a second replica.
+	RedirectHedgePercentile float64
+	// RedisAddr is the address of the Redis that records responses to
+	// requests sent with an Idempotency-Key. Every replica must share it.
+	// Idempotency keys are ignored when it is empty.
+	RedisAddr     string
+	RedisPassword string
+	RedisDB       int
+	// IdempotencyTTL is how long those responses are replayed for, and
+	// IdempotencyWait how long a duplicate of a request in progress waits
+	// for its response. Zero values use the api package's defaults.
+	IdempotencyTTL  time.Duration
+	IdempotencyWait time.Duration
+	// HTTPClient configures the retries and circuit breakers of the
+	// clients of the internal services.
+	HTTPClient []httpclient.Option
+}
+
+// The names of the internal services, which are also the hosts of the
+// requests the gateway sends them.
+const (
+	shortenerService = "url-shortener-service"
+	redirectService  = "url-redirect-service"
+)
+
+// App is a fully wired api-gateway-service.
+type App struct {
+	Router *gin.Engine
+	// Health reports whether the gateway is ready.
+	Health *health.Checker
+	// Shortener and Redirect spread the requests to the internal services.
+	Shortener *httpclient.Balancer
+	Redirect  *httpclient.Balancer
+	redis     *storage.RedisClient
+	stop      context.CancelFunc
+}
+
+// New resolves the internal services' replicas, connects to Redis, if
+// configured, and builds the gateway's public HTTP router.
+func New(ctx context.Context, cfg Config) (*App, error) {
+	a := &App{}
+	var err error
+	a.Shortener, err = httpclient.NewBalancer(ctx, shortenerService, cfg.ShortenerServiceURLs, cfg.Balancer...)
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve the shortener service: %w", err)
+	}
+	balancerOpts := cfg.Balancer
+	if cfg.RedirectHedgePercentile > 0 {
+		balancerOpts = append(slices.Clip(balancerOpts), httpclient.WithHedging(cfg.RedirectHedgePercentile))
+	}
+	a.Redirect, err = httpclient.NewBalancer(ctx, redirectService, cfg.RedirectServiceURLs, balancerOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve the redirect service: %w", err)
+	}
+
+	// Initialize the clients for the other services. Their requests go to
+	// whichever replica the balancers pick, so the base URLs only name them.
+	shortenerClient, err := clients.NewShortenerClient("http://"+shortenerService,
+		append(slices.Clip(cfg.HTTPClient), httpclient.WithBalancer(a.Shortener))...)
+	if err != nil {
+		return nil, err
+	}
+	redirectClient, err := clients.NewRedirectClient("http://"+redirectService,
+		append(slices.Clip(cfg.HTTPClient), httpclient.WithBalancer(a.Redirect))...)
+	if err != nil {
+		return nil, err
+	}
+
+	watchCtx, stop := context.WithCancel(context.Background())
+	a.stop = stop
+	go a.Shortener.Watch(watchCtx, cfg.ResolveInterval)
+	go a.Redirect.Watch(watchCtx, cfg.ResolveInterval)
+
+	gatewayService := services.NewGatewayService(shortenerClient, redirectClient)
+	gatewayHandler := api.NewGatewayHandler(gatewayService,
+		api.WithInterstitial(clients.NewRedirectProxy("http://"+redirectService, a.Redirect.Transport(tracing.Transport(http.DefaultTransport)))),
+	)
+
+	// The gateway is ready when both services behind it are. Their checks
+	// are neither retried nor counted by the clients' circuit breakers, but
+	// replicas that are not ready are ejected like failing ones.
+	checker := health.New("api-gateway-service")
+	checker.Register(shortenerService, health.Remote(
+		&http.Client{Transport: a.Shortener.Transport(http.DefaultTransport)}, "http://"+shortenerService+"/readyz"))
+	checker.Register(redirectService, health.Remote(
+		&http.Client{Transport: a.Redirect.Transport(http.DefaultTransport)}, "http://"+redirectService+"/readyz"))
+	a.Health = checker
+	opts := []web.RouterOption{web.WithHealth(checker)}
+	if cfg.RedisAddr != "" {
+		redisClient, err := storage.NewRedisClient(ctx, cfg.RedisAddr, cfg.RedisPassword, cfg.RedisDB)
+		if err != nil {
+			a.Close()
+			return nil, fmt.Errorf("could not connect to Redis: %w", err)
+		}
+		a.redis = redisClient
+		checker.Register("redis", redisClient.Ping)
+
+		var idemOpts []api.IdempotencyOption
+		if cfg.IdempotencyTTL > 0 {
+			idemOpts = append(idemOpts, api.WithIdempotencyTTL(cfg.IdempotencyTTL))
+		}
+		if cfg.IdempotencyWait > 0 {
+			idemOpts = append(idemOpts, api.WithIdempotencyWait(cfg.IdempotencyWait))
+		}
+		opts = append(opts, web.WithIdempotency(api.NewIdempotency(redisClient, idemOpts...)))
+	}
+
+	a.Router = web.NewRouter(gatewayHandler, opts...)
+	return a, nil
+}
+
+// Close stops re-resolving the replicas and releases the connections opened
+// by New.
+func (a *App) Close() error {
+	if a.stop != nil {
+		a.stop()
+	}
+	if a.redis == nil {
+		return nil
+	}
+	return a.redis.Close()
+}
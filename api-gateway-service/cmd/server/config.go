@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/iton0/duss/shared/config"
+	"github.com/iton0/duss/shared/httpclient"
+	"github.com/iton0/duss/shared/logging"
+	"github.com/iton0/duss/shared/tracing"
+)
+
+// Config is the api-gateway-service's configuration.
+type Config struct {
+	Server config.Server `config:"server"`
+	// ShortenerServiceURL and RedirectServiceURL list the replicas of the
+	// internal services, separated by commas. Each is a base URL, a
+	// dns://host:port name whose A records are the replicas, or a
+	// dns+srv://name whose SRV records are.
+	ShortenerServiceURL []string `config:"shortener_service_url" env:"SHORTENER_SERVICE_URL" required:"true"`
+	RedirectServiceURL  []string `config:"redirect_service_url" env:"REDIRECT_SERVICE_URL" required:"true"`
+	// Balancer configures how requests are spread across the replicas.
+	Balancer httpclient.BalancerConfig `config:"balancer"`
+	// RedirectHedgePercentile, if positive, sends redirect lookups slower
+	// than this percentile of recent ones to a second replica as well.
+	RedirectHedgePercentile float64 `config:"redirect_hedge_percentile" env:"REDIRECT_HEDGE_PERCENTILE" default:"0"`
+	// Redis records responses to requests sent with an Idempotency-Key.
+	// Setting an empty address ignores the header.
+	Redis config.Redis `config:"redis"`
+	// Idempotency configures how those responses are replayed.
+	Idempotency IdempotencyConfig `config:"idempotency"`
+	// HTTPClient configures the retries and circuit breakers of calls to
+	// the internal services.
+	HTTPClient httpclient.Config `config:"http_client"`
+	// Log configures the service's log level, format and sampling.
+	Log logging.Config `config:"log"`
+	// Tracing configures where the service's spans are exported.
+	Tracing tracing.Config `config:"tracing"`
+}
+
+// IdempotencyConfig holds the settings of Idempotency-Key handling.
+type IdempotencyConfig struct {
+	// TTL is how long a response is replayed for retries.
+	TTL time.Duration `config:"ttl" env:"IDEMPOTENCY_TTL" default:"24h"`
+	// Wait is how long a duplicate of a request still in progress waits
+	// for its response before it is answered 409 Conflict.
+	Wait time.Duration `config:"wait" env:"IDEMPOTENCY_WAIT" default:"5s"`
+}
+
+// Validate implements config.Validator.
+func (c *Config) Validate() error {
+	if c.Idempotency.TTL <= 0 {
+		return errors.New("idempotency.ttl (IDEMPOTENCY_TTL) must be positive")
+	}
+	if c.Idempotency.Wait <= 0 {
+		return errors.New("idempotency.wait (IDEMPOTENCY_WAIT) must be positive")
+	}
+	if _, err := c.HTTPClient.Options(); err != nil {
+		return fmt.Errorf("http_client: %w", err)
+	}
+	if _, err := c.Balancer.Options(); err != nil {
+		return fmt.Errorf("balancer: %w", err)
+	}
+	if c.RedirectHedgePercentile < 0 || c.RedirectHedgePercentile >= 100 {
+		return errors.New("redirect_hedge_percentile (REDIRECT_HEDGE_PERCENTILE) must be between 0 and 100")
+	}
+	if _, err := c.Log.Options(); err != nil {
+		return fmt.Errorf("log: %w", err)
+	}
+	if _, err := c.Tracing.Options(); err != nil {
+		return fmt.Errorf("tracing: %w", err)
+	}
+	return nil
+}
@@ -1,55 +1,83 @@
 package main
 
 import (
-	"fmt"
-	"log"
+	"context"
+	"log/slog"
 	"os"
+	"time"
 
-	"github.com/iton0/duss/api-gateway-service/internal/api"
-	"github.com/iton0/duss/api-gateway-service/internal/core/services"
-	"github.com/iton0/duss/api-gateway-service/internal/infrastructure/clients"
-	"github.com/iton0/duss/api-gateway-service/internal/infrastructure/web"
-	"github.com/joho/godotenv"
+	"github.com/iton0/duss/api-gateway-service/app"
+	"github.com/iton0/duss/shared/config"
+	"github.com/iton0/duss/shared/logging"
+	"github.com/iton0/duss/shared/server"
+	"github.com/iton0/duss/shared/tracing"
 )
 
 func main() {
-	if err := godotenv.Load(); err != nil {
-		log.Fatal("Error loading .env file")
+	// 1. Load configuration from the environment, .env and config file.
+	var cfg Config
+	config.MustLoad("api-gateway-service", &cfg)
+
+	logOpts, err := cfg.Log.Options()
+	if err != nil {
+		logging.Fatal("invalid log settings", "error", err)
 	}
+	slog.SetDefault(logging.New(os.Stderr, logOpts...))
 
-	hostPort := os.Getenv("PUBLIC_GATEWAY_PORT")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 
-	// 1. Get configuration from environment variables.
-	shortenerServiceURL := os.Getenv("SHORTENER_SERVICE_URL")
-	if shortenerServiceURL == "" {
-		log.Fatal("SHORTENER_SERVICE_URL environment variable is not set")
+	tracingOpts, err := cfg.Tracing.Options()
+	if err != nil {
+		logging.Fatal("invalid tracing settings", "error", err)
 	}
-
-	redirectServiceURL := os.Getenv("REDIRECT_SERVICE_URL")
-	if redirectServiceURL == "" {
-		log.Fatal("REDIRECT_SERVICE_URL environment variable is not set")
+	tracer, err := tracing.Start(ctx, "api-gateway-service", tracingOpts...)
+	if err != nil {
+		logging.Fatal("failed to start tracing", "error", err)
 	}
 
-	// 2. Initialize the clients for the other services.
-	// These clients know how to communicate over the network.
-	shortenerClient := clients.NewHTTPShortenerClient(shortenerServiceURL)
-	redirectClient := clients.NewHTTPRedirectClient(redirectServiceURL)
+	httpClient, err := cfg.HTTPClient.Options()
+	if err != nil {
+		logging.Fatal("invalid HTTP client settings", "error", err)
+	}
+	balancer, err := cfg.Balancer.Options()
+	if err != nil {
+		logging.Fatal("invalid balancer settings", "error", err)
+	}
 
-	// 3. Initialize the core gateway service.
-	// This service contains the business logic for routing and delegates tasks to the clients.
-	gatewayService := services.NewGatewayService(shortenerClient, redirectClient)
+	// 2. Wire the clients, gateway service, handlers and router together.
+	application, err := app.New(ctx, app.Config{
+		ShortenerServiceURLs:    cfg.ShortenerServiceURL,
+		RedirectServiceURLs:     cfg.RedirectServiceURL,
+		Balancer:                balancer,
+		ResolveInterval:         cfg.Balancer.ResolveInterval,
+		RedirectHedgePercentile: cfg.RedirectHedgePercentile,
+		RedisAddr:               cfg.Redis.Addr,
+		RedisPassword:           cfg.Redis.Password,
+		RedisDB:                 cfg.Redis.DB,
+		IdempotencyTTL:          cfg.Idempotency.TTL,
+		IdempotencyWait:         cfg.Idempotency.Wait,
+		HTTPClient:              httpClient,
+	})
+	if err != nil {
+		logging.Fatal("failed to initialize gateway", "error", err)
+	}
 
-	// 4. Initialize the API handler.
-	// The handler receives requests and uses the gateway service to fulfill them.
-	gatewayHandler := api.NewGatewayHandler(gatewayService)
+	// 3. Serve until SIGINT or SIGTERM, then drain requests and close the
+	// connections.
+	srv := server.New("api-gateway-service", cfg.Server.Addr(), application.Router,
+		server.WithHealth(application.Health),
+		server.WithDrainDelay(cfg.Server.DrainDelay),
+		server.WithShutdownTimeout(cfg.Server.ShutdownTimeout),
+	)
+	srv.OnShutdown("close connections", func(context.Context) error {
+		return application.Close()
+	})
 
-	// 5. Initialize the router.
-	// The router maps public-facing URL paths to the API handlers.
-	router := web.NewRouter(gatewayHandler)
+	// Spans are flushed last, so those of the shutdown steps are kept too.
+	srv.OnShutdown("flush traces", tracer.Shutdown)
 
-	// 6. Start the server.
-	log.Printf("Starting API Gateway on port %s...\n", hostPort)
-	if err := router.Run(fmt.Sprintf(":%s", hostPort)); err != nil {
-		log.Fatalf("Failed to run server: %v", err)
+	if err := srv.Run(context.Background()); err != nil {
+		logging.Fatal("server did not shut down cleanly", "error", err)
 	}
 }
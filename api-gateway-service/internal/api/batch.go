@@ -0,0 +1,122 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+
+	"github.com/iton0/duss/api-gateway-service/internal/core/services"
+	"github.com/iton0/duss/shared/problem"
+)
+
+// maxJobUploadSize is the largest job upload the gateway passes on.
+const maxJobUploadSize = 64 << 20
+
+// BatchRequest represents the request body for shortening several URLs.
+type BatchRequest struct {
+	Items []ShortenRequest `json:"items" binding:"required"`
+}
+
+// BatchResponse represents the response body of a batch. Created, Existing
+// and Failed count the items that created a link, returned an existing one
+// and failed.
+type BatchResponse struct {
+	Results  []services.BatchResult `json:"results"`
+	Created  int                    `json:"created"`
+	Existing int                    `json:"existing"`
+	Failed   int                    `json:"failed"`
+}
+
+// HandleShortenBatch handles the POST /shorten/batch request. Each item is
+// shortened as by POST /shorten, and its outcome is reported in the results
+// at its index; items that fail do not fail the batch.
+func (h *GatewayHandler) HandleShortenBatch(c *gin.Context) {
+	var req BatchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		problem.Abort(c, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request body: items are required"))
+		return
+	}
+
+	results := make([]services.BatchResult, len(req.Items))
+	var (
+		items   []services.ShortenRequest
+		indexes []int
+	)
+	for i, item := range req.Items {
+		if err := binding.Validator.ValidateStruct(item); err != nil {
+			results[i] = services.BatchResult{Index: i, Status: invalidURL.Status, Code: invalidURL.Code, Error: invalidURL.Detail}
+			continue
+		}
+		items = append(items, item.shortenRequest())
+		indexes = append(indexes, i)
+	}
+
+	if len(items) > 0 {
+		shortened, err := h.gatewayService.ShortenBatch(c.Request.Context(), items, bearerToken(c))
+		if err != nil {
+			writeBackendError(c, err, "Failed to shorten URLs")
+			return
+		}
+		for j, r := range shortened {
+			r.Index = indexes[j]
+			results[indexes[j]] = r
+		}
+	}
+
+	resp := BatchResponse{Results: results}
+	for _, r := range results {
+		switch {
+		case r.Error != "":
+			resp.Failed++
+		case r.Created:
+			resp.Created++
+		default:
+			resp.Existing++
+		}
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// HandleSubmitJob handles the POST /shorten/jobs request. Its body, a CSV
+// (text/csv) or NDJSON (application/x-ndjson) list of URLs, is streamed to
+// the shortener, which shortens them in the background. It answers 202
+// Accepted with the job, whose progress the Location header points at.
+func (h *GatewayHandler) HandleSubmitJob(c *gin.Context) {
+	contentType := c.ContentType()
+	switch contentType {
+	case "text/csv", "application/x-ndjson", "application/jsonl":
+	default:
+		problem.Abort(c, problem.New(http.StatusUnsupportedMediaType, problem.CodeUnsupportedMediaType, "Content-Type must be text/csv or application/x-ndjson"))
+		return
+	}
+
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, maxJobUploadSize)
+	job, err := h.gatewayService.SubmitJob(c.Request.Context(), contentType, body, bearerToken(c))
+	if err != nil {
+		// An upload cut short by the gateway's own limit never reached the
+		// shortener.
+		if maxErr := (*http.MaxBytesError)(nil); errors.As(err, &maxErr) {
+			problem.Abort(c, problem.New(http.StatusRequestEntityTooLarge, problem.CodeTooLarge, "Upload too large"))
+			return
+		}
+		writeBackendError(c, err, "Failed to submit job")
+		return
+	}
+
+	c.Header("Location", "/shorten/jobs/"+job.ID)
+	c.JSON(http.StatusAccepted, job)
+}
+
+// HandleGetJob handles the GET /shorten/jobs/:id request, forwarding the
+// caller's bearer token so the shortener can check who may read the job.
+func (h *GatewayHandler) HandleGetJob(c *gin.Context) {
+	job, err := h.gatewayService.GetJob(c.Request.Context(), c.Param("id"), bearerToken(c))
+	if err != nil {
+		writeBackendError(c, err, "Failed to get job")
+		return
+	}
+
+	c.JSON(http.StatusOK, job)
+}
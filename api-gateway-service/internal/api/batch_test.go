@@ -0,0 +1,194 @@
+package api_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/iton0/duss/api-gateway-service/internal/api"
+	"github.com/iton0/duss/api-gateway-service/internal/core/services"
+	"github.com/iton0/duss/api-gateway-service/internal/infrastructure/clients/mock"
+)
+
+func TestHandleShortenBatch(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	testCases := []struct {
+		name               string
+		body               string
+		mockReturnResults  []services.BatchResult
+		mockReturnErr      error
+		expectedStatusCode int
+		expectedStatuses   []int
+	}{
+		{
+			name: "Mixed Results",
+			body: `{"items":[{"url":"nope"},{"url":"https://example.com/a"},{"url":"https://evil.example"}]}`,
+			mockReturnResults: []services.BatchResult{
+				{Index: 0, ShortURL: "http://localhost:8081/abc", Created: true, Status: http.StatusCreated},
+				{Index: 1, Status: http.StatusForbidden, Error: "URL rejected"},
+			},
+			expectedStatusCode: http.StatusOK,
+			expectedStatuses:   []int{http.StatusBadRequest, http.StatusCreated, http.StatusForbidden},
+		},
+		{
+			name:               "Only Invalid Items",
+			body:               `{"items":[{"url":"nope"}]}`,
+			expectedStatusCode: http.StatusOK,
+			expectedStatuses:   []int{http.StatusBadRequest},
+		},
+		{
+			name:               "Missing Items",
+			body:               `{"urls":[]}`,
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:               "Too Many Items",
+			body:               `{"items":[{"url":"https://example.com/a"}]}`,
+			mockReturnErr:      services.ErrTooLarge,
+			expectedStatusCode: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:               "Backend Error",
+			body:               `{"items":[{"url":"https://example.com/a"}]}`,
+			mockReturnErr:      errors.New("shortener unavailable"),
+			expectedStatusCode: http.StatusBadGateway,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			shortener := &mock.MockShortenerClient{ReturnResults: tc.mockReturnResults, ReturnErr: tc.mockReturnErr}
+			handler := newHandler(shortener, &mock.MockRedirectClient{})
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request, _ = http.NewRequest(http.MethodPost, "/shorten/batch", bytes.NewBufferString(tc.body))
+			c.Request.Header.Set("Content-Type", "application/json")
+
+			handler.HandleShortenBatch(c)
+
+			if w.Code != tc.expectedStatusCode {
+				t.Fatalf("expected status code %d, but got %d: %s", tc.expectedStatusCode, w.Code, w.Body.String())
+			}
+			if tc.expectedStatuses == nil {
+				return
+			}
+
+			var resp api.BatchResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			if len(resp.Results) != len(tc.expectedStatuses) {
+				t.Fatalf("expected %d results, but got %d", len(tc.expectedStatuses), len(resp.Results))
+			}
+			for i, r := range resp.Results {
+				if r.Index != i || r.Status != tc.expectedStatuses[i] {
+					t.Errorf("item %d: expected status %d, but got %+v", i, tc.expectedStatuses[i], r)
+				}
+			}
+			if len(shortener.LastBatch) != len(tc.mockReturnResults) {
+				t.Errorf("expected only valid items to be sent on, but got %d", len(shortener.LastBatch))
+			}
+			if resp.Created+resp.Existing+resp.Failed != len(resp.Results) {
+				t.Errorf("expected counts adding up to %d, but got %+v", len(resp.Results), resp)
+			}
+		})
+	}
+}
+
+func TestHandleSubmitJob(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	testCases := []struct {
+		name               string
+		contentType        string
+		mockReturnErr      error
+		expectedStatusCode int
+	}{
+		{"CSV", "text/csv", nil, http.StatusAccepted},
+		{"NDJSON", "application/x-ndjson; charset=utf-8", nil, http.StatusAccepted},
+		{"Unsupported Content Type", "application/json", nil, http.StatusUnsupportedMediaType},
+		{"Invalid Upload", "text/csv", fmt.Errorf("%w: unknown CSV column", services.ErrInvalidRequest), http.StatusBadRequest},
+		{"Too Many Items", "text/csv", services.ErrTooLarge, http.StatusRequestEntityTooLarge},
+		{"Foreign Owner", "text/csv", services.ErrForbidden, http.StatusForbidden},
+		{"Backend Error", "text/csv", errors.New("shortener unavailable"), http.StatusBadGateway},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			shortener := &mock.MockShortenerClient{ReturnJob: &services.Job{ID: "job1", Status: "running", Total: 1}, ReturnErr: tc.mockReturnErr}
+			handler := newHandler(shortener, &mock.MockRedirectClient{})
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request, _ = http.NewRequest(http.MethodPost, "/shorten/jobs", bytes.NewBufferString("url\nhttps://example.com\n"))
+			c.Request.Header.Set("Content-Type", tc.contentType)
+			c.Request.Header.Set("Authorization", "Bearer a-token")
+
+			handler.HandleSubmitJob(c)
+
+			if w.Code != tc.expectedStatusCode {
+				t.Fatalf("expected status code %d, but got %d: %s", tc.expectedStatusCode, w.Code, w.Body.String())
+			}
+			if w.Code != http.StatusAccepted {
+				return
+			}
+			if location := w.Header().Get("Location"); location != "/shorten/jobs/job1" {
+				t.Errorf("expected the job's location, but got %q", location)
+			}
+			if shortener.LastUpload != "url\nhttps://example.com\n" || shortener.LastContentType != c.ContentType() {
+				t.Errorf("expected the upload to be passed on, but got %q as %q", shortener.LastUpload, shortener.LastContentType)
+			}
+			if shortener.LastToken != "a-token" {
+				t.Errorf("expected the shortener to receive token %q, but got %q", "a-token", shortener.LastToken)
+			}
+		})
+	}
+}
+
+func TestHandleGetJob(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	testCases := []struct {
+		name               string
+		mockReturnErr      error
+		expectedStatusCode int
+	}{
+		{"Success", nil, http.StatusOK},
+		{"Not Found", services.ErrJobNotFound, http.StatusNotFound},
+		{"Forbidden", services.ErrForbidden, http.StatusForbidden},
+		{"Backend Error", errors.New("shortener unavailable"), http.StatusBadGateway},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			shortener := &mock.MockShortenerClient{ReturnJob: &services.Job{ID: "job1", Status: "done"}, ReturnErr: tc.mockReturnErr}
+			handler := newHandler(shortener, &mock.MockRedirectClient{})
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request, _ = http.NewRequest(http.MethodGet, "/shorten/jobs/job1", nil)
+			c.Request.Header.Set("Authorization", "Bearer a-token")
+			c.Params = gin.Params{{Key: "id", Value: "job1"}}
+
+			handler.HandleGetJob(c)
+
+			if w.Code != tc.expectedStatusCode {
+				t.Errorf("expected status code %d, but got %d", tc.expectedStatusCode, w.Code)
+			}
+			if shortener.LastJobID != "job1" {
+				t.Errorf("expected job %q to be requested, but got %q", "job1", shortener.LastJobID)
+			}
+			if shortener.LastToken != "a-token" {
+				t.Errorf("expected the shortener to receive token %q, but got %q", "a-token", shortener.LastToken)
+			}
+		})
+	}
+}
@@ -1,62 +1,247 @@
 package api
 
 import (
+	"errors"
+	"log/slog"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
 	"github.com/iton0/duss/api-gateway-service/internal/core/services"
+	"github.com/iton0/duss/shared/httpclient"
+	"github.com/iton0/duss/shared/problem"
 )
 
 // ShortenRequest represents the request body for shortening a URL.
 type ShortenRequest struct {
 	URL string `json:"url" binding:"required,url"`
+	// Domain optionally selects the short domain to create the link on.
+	Domain string `json:"domain,omitempty"`
+	// Owner identifies who the link is created for. It defaults to the owner
+	// whose token the request carries; only an administrator may name another.
+	Owner string `json:"owner,omitempty"`
+	// Dedupe overrides the shortener's dedupe mode; false forces a new key.
+	Dedupe *bool `json:"dedupe,omitempty"`
+	// Password, when set, must be entered by visitors before they are
+	// redirected.
+	Password string `json:"password,omitempty"`
+	// Signed makes the link only redirect through the signed short URL
+	// returned for it, whose signature expires at SignatureExpiresAt if set.
+	Signed             bool       `json:"signed,omitempty"`
+	SignatureExpiresAt *time.Time `json:"signature_expires_at,omitempty"`
+}
+
+// shortenRequest returns the service request r describes.
+func (r ShortenRequest) shortenRequest() services.ShortenRequest {
+	var expires time.Time
+	if r.SignatureExpiresAt != nil {
+		expires = *r.SignatureExpiresAt
+	}
+	return services.ShortenRequest{
+		URL:                r.URL,
+		Domain:             r.Domain,
+		Owner:              r.Owner,
+		Dedupe:             r.Dedupe,
+		Password:           r.Password,
+		Signed:             r.Signed,
+		SignatureExpiresAt: expires,
+	}
+}
+
+// TrustRequest represents the request body for changing a link's trust.
+type TrustRequest struct {
+	Untrusted *bool `json:"untrusted" binding:"required"`
 }
 
 // GatewayHandler holds the necessary dependencies for the handler.
 type GatewayHandler struct {
 	gatewayService services.GatewayServiceIface
+	interstitial   http.Handler
+}
+
+// HandlerOption configures optional settings of a GatewayHandler.
+type HandlerOption func(*GatewayHandler)
+
+// WithInterstitial sets the handler that serves visits to untrusted and
+// password-protected links, normally a proxy to the redirect service, which
+// shows them a warning page or asks for the password before redirecting.
+func WithInterstitial(h http.Handler) HandlerOption {
+	return func(g *GatewayHandler) {
+		g.interstitial = h
+	}
 }
 
 // NewGatewayHandler creates a new GatewayHandler instance.
-func NewGatewayHandler(gs services.GatewayServiceIface) *GatewayHandler {
-	return &GatewayHandler{gatewayService: gs}
+func NewGatewayHandler(gs services.GatewayServiceIface, opts ...HandlerOption) *GatewayHandler {
+	h := &GatewayHandler{gatewayService: gs}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
 }
 
-// HandleShorten handles the POST /shorten request.
+// HandleShorten handles the POST /shorten request. The Authorization header
+// is passed on to the shortener, which creates the link for the owner whose
+// token it carries.
 func (h *GatewayHandler) HandleShorten(c *gin.Context) {
 	var req ShortenRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body or URL format"})
+		problem.Abort(c, invalidURL)
 		return
 	}
 
-	shortURL, err := h.gatewayService.ShortenURL(c.Request.Context(), req.URL)
+	shortURL, created, err := h.gatewayService.ShortenURL(c.Request.Context(), req.shortenRequest(), bearerToken(c))
 	if err != nil {
-		// Log the error internally and return a generic server error to the client.
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to shorten URL"})
+		writeBackendError(c, err, "Failed to shorten URL")
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"short_url": shortURL})
+	// An existing link returned in dedupe mode is reported with 200 OK.
+	status := http.StatusCreated
+	if !created {
+		status = http.StatusOK
+	}
+	c.JSON(status, gin.H{"short_url": shortURL})
 }
 
-// HandleRedirect handles the GET /:shortKey request.
+// HandleRedirect handles the GET /:shortKey request. The Host the link was
+// requested on selects its short domain.
 func (h *GatewayHandler) HandleRedirect(c *gin.Context) {
 	shortKey := c.Param("shortKey")
 	if shortKey == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Short key is required"})
+		problem.Abort(c, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Short key is required"))
 		return
 	}
 
-	originalURL, err := h.gatewayService.RedirectURL(c.Request.Context(), shortKey)
+	dest, err := h.gatewayService.RedirectURL(c.Request.Context(), c.Request.Host, shortKey)
+	if err != nil {
+		writeBackendError(c, err, "Failed to resolve URL")
+		return
+	}
+
+	// Visitors to untrusted links must confirm the destination first, and
+	// visitors to protected ones enter the password, which is left to the
+	// interstitial. Without one they are never redirected.
+	if dest.Untrusted || dest.Protected {
+		if h.interstitial == nil {
+			problem.Abort(c, problem.New(http.StatusForbidden, problem.CodeForbidden, "URL untrusted or protected"))
+			return
+		}
+		h.interstitial.ServeHTTP(c.Writer, c.Request)
+		return
+	}
+
+	// Perform the HTTP redirect to the original URL. It is temporary and
+	// not cached, so a link banned, disabled or deleted later stops
+	// redirecting and every visit is counted.
+	c.Header("Cache-Control", "no-store")
+	c.Redirect(http.StatusFound, dest.URL)
+}
+
+// HandleUnlock handles the POST /:shortKey request the password form of a
+// protected link is submitted with. It is passed to the interstitial, which
+// checks the password and remembers it for the visitor.
+func (h *GatewayHandler) HandleUnlock(c *gin.Context) {
+	if h.interstitial == nil {
+		problem.Abort(c, problem.New(http.StatusNotFound, problem.CodeNotFound, "URL not found"))
+		return
+	}
+	h.interstitial.ServeHTTP(c.Writer, c.Request)
+}
+
+// HandleStats handles the GET /stats/:shortKey request. The bearer token is
+// passed on to the shortener, which only shows links to administrators and
+// their owners.
+func (h *GatewayHandler) HandleStats(c *gin.Context) {
+	stats, err := h.gatewayService.GetStats(c.Request.Context(), shortDomain(c), c.Param("shortKey"), bearerToken(c))
 	if err != nil {
-		// Differentiate between a "not found" error and a generic server error.
-		// For example, if the error is due to a non-existent key.
-		c.JSON(http.StatusNotFound, gin.H{"error": "URL not found"})
+		writeBackendError(c, err, "Failed to get URL stats")
 		return
 	}
 
-	// Perform the HTTP redirect to the original URL.
-	c.Redirect(http.StatusMovedPermanently, originalURL)
+	c.JSON(http.StatusOK, stats)
+}
+
+// HandleDelete handles the DELETE /:shortKey request. The bearer token is
+// passed on to the shortener, which only lets administrators and owners
+// delete links.
+func (h *GatewayHandler) HandleDelete(c *gin.Context) {
+	err := h.gatewayService.DeleteURL(c.Request.Context(), shortDomain(c), c.Param("shortKey"), bearerToken(c))
+	if err != nil {
+		writeBackendError(c, err, "Failed to delete URL")
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// HandleSetTrust handles the PUT /trust/:shortKey request, which flags a link
+// as untrusted or clears the flag. The Authorization header is passed on to
+// the shortener, which lets administrators change any link and owners their
+// own.
+func (h *GatewayHandler) HandleSetTrust(c *gin.Context) {
+	var req TrustRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		problem.Abort(c, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request body: untrusted is required"))
+		return
+	}
+
+	updated, err := h.gatewayService.SetTrust(c.Request.Context(), services.TrustRequest{
+		Domain:    shortDomain(c),
+		ShortKey:  c.Param("shortKey"),
+		Untrusted: *req.Untrusted,
+	}, bearerToken(c))
+	if err != nil {
+		writeBackendError(c, err, "Failed to update URL")
+		return
+	}
+
+	c.JSON(http.StatusOK, updated)
+}
+
+// invalidURL is the problem of a shorten request without a valid URL.
+var invalidURL = problem.New(http.StatusBadRequest, problem.CodeInvalidURL, "Invalid request body or URL format")
+
+// writeBackendError answers c with the problem a failed call to a backend is
+// reported with. A problem the backend answered with is passed on as it is;
+// a backend that could not be reached or answered nonsense is reported as
+// upstream_unavailable, explained by detail.
+func writeBackendError(c *gin.Context, err error, detail string) {
+	var p *problem.Problem
+	switch {
+	case errors.As(err, &p):
+		problem.Abort(c, p)
+	case errors.Is(err, services.ErrURLNotFound), errors.Is(err, services.ErrJobNotFound):
+		problem.Abort(c, problem.New(http.StatusNotFound, problem.CodeNotFound, err.Error()))
+	case errors.Is(err, services.ErrInvalidRequest):
+		problem.Abort(c, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, err.Error()))
+	case errors.Is(err, services.ErrURLBlocked):
+		problem.Abort(c, problem.New(http.StatusForbidden, problem.CodeBlacklisted, err.Error()))
+	case errors.Is(err, services.ErrForbidden):
+		problem.Abort(c, problem.New(http.StatusForbidden, problem.CodeForbidden, err.Error()))
+	case errors.Is(err, services.ErrURLExpired):
+		problem.Abort(c, problem.New(http.StatusGone, problem.CodeExpired, err.Error()))
+	case errors.Is(err, services.ErrTooLarge):
+		problem.Abort(c, problem.New(http.StatusRequestEntityTooLarge, problem.CodeTooLarge, err.Error()))
+	case errors.Is(err, httpclient.ErrCircuitOpen), errors.Is(err, httpclient.ErrNoEndpoints):
+		problem.Abort(c, problem.New(http.StatusServiceUnavailable, problem.CodeUpstreamUnavailable, detail))
+	default:
+		slog.ErrorContext(c.Request.Context(), detail, "error", err)
+		problem.Abort(c, problem.New(http.StatusBadGateway, problem.CodeUpstreamUnavailable, detail))
+	}
+}
+
+// bearerToken returns the token of c's "Authorization: Bearer" header, or
+// the empty string if there is none.
+func bearerToken(c *gin.Context) string {
+	token, _ := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	return token
+}
+
+// shortDomain returns the short domain a management request refers to: the
+// "domain" query parameter when given, otherwise the Host it was sent to.
+func shortDomain(c *gin.Context) string {
+	return c.DefaultQuery("domain", c.Request.Host)
 }
@@ -1 +1,577 @@
 package api_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/iton0/duss/api-gateway-service/internal/api"
+	"github.com/iton0/duss/api-gateway-service/internal/core/services"
+	"github.com/iton0/duss/api-gateway-service/internal/infrastructure/clients/mock"
+	"github.com/iton0/duss/shared/domain"
+	"github.com/iton0/duss/shared/httpclient"
+	"github.com/iton0/duss/shared/problem"
+)
+
+func newHandler(shortener *mock.MockShortenerClient, redirect *mock.MockRedirectClient) *api.GatewayHandler {
+	return api.NewGatewayHandler(services.NewGatewayService(shortener, redirect))
+}
+
+func TestHandleShorten(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	testCases := []struct {
+		name               string
+		body               string
+		mockReturnShortURL string
+		mockReturnErr      error
+		mockReturnExisting bool
+		expectedStatusCode int
+		expectedCode       problem.Code
+		expectedShortURL   string
+	}{
+		{
+			name:               "Success",
+			body:               `{"url":"https://example.com"}`,
+			mockReturnShortURL: "http://localhost:8081/abc",
+			expectedStatusCode: http.StatusCreated,
+			expectedShortURL:   "http://localhost:8081/abc",
+		},
+		{
+			name:               "Success - Domain",
+			body:               `{"url":"https://example.com","domain":"go.duss.io"}`,
+			mockReturnShortURL: "http://go.duss.io/abc",
+			expectedStatusCode: http.StatusCreated,
+			expectedShortURL:   "http://go.duss.io/abc",
+		},
+		{
+			name:               "Success - Existing Link",
+			body:               `{"url":"https://example.com"}`,
+			mockReturnShortURL: "http://localhost:8081/abc",
+			mockReturnExisting: true,
+			expectedStatusCode: http.StatusOK,
+			expectedShortURL:   "http://localhost:8081/abc",
+		},
+		{
+			name:               "Invalid URL",
+			body:               `{"url":"not a url"}`,
+			expectedStatusCode: http.StatusBadRequest,
+			expectedCode:       problem.CodeInvalidURL,
+		},
+		{
+			name:               "Domain Not Allowed",
+			body:               `{"url":"https://example.com","domain":"evil.example"}`,
+			mockReturnErr:      services.ErrInvalidRequest,
+			expectedStatusCode: http.StatusBadRequest,
+			expectedCode:       problem.CodeInvalidRequest,
+		},
+		{
+			name:               "URL Not Allowed",
+			body:               `{"url":"https://evil.example"}`,
+			mockReturnErr:      services.ErrURLBlocked,
+			expectedStatusCode: http.StatusForbidden,
+			expectedCode:       problem.CodeBlacklisted,
+		},
+		{
+			name:               "Foreign Owner",
+			body:               `{"url":"https://example.com","owner":"team-b"}`,
+			mockReturnErr:      problem.New(http.StatusForbidden, problem.CodeForbidden, "not allowed to create links for this owner"),
+			expectedStatusCode: http.StatusForbidden,
+			expectedCode:       problem.CodeForbidden,
+		},
+		{
+			name:               "Backend Problem",
+			body:               `{"url":"https://example.com","alias":"taken"}`,
+			mockReturnErr:      problem.New(http.StatusConflict, problem.CodeAliasTaken, "URL already taken"),
+			expectedStatusCode: http.StatusConflict,
+			expectedCode:       problem.CodeAliasTaken,
+		},
+		{
+			name:               "Circuit Open",
+			body:               `{"url":"https://example.com"}`,
+			mockReturnErr:      httpclient.ErrCircuitOpen,
+			expectedStatusCode: http.StatusServiceUnavailable,
+			expectedCode:       problem.CodeUpstreamUnavailable,
+		},
+		{
+			name:               "Backend Error",
+			body:               `{"url":"https://example.com"}`,
+			mockReturnErr:      errors.New("shortener unavailable"),
+			expectedStatusCode: http.StatusBadGateway,
+			expectedCode:       problem.CodeUpstreamUnavailable,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			handler := newHandler(&mock.MockShortenerClient{
+				ReturnShortURL: tc.mockReturnShortURL,
+				ReturnErr:      tc.mockReturnErr,
+				ReturnExisting: tc.mockReturnExisting,
+			}, &mock.MockRedirectClient{})
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request, _ = http.NewRequest(http.MethodPost, "/shorten", bytes.NewBufferString(tc.body))
+			c.Request.Header.Set("Content-Type", "application/json")
+
+			handler.HandleShorten(c)
+
+			if w.Code != tc.expectedStatusCode {
+				t.Errorf("expected status code %d, but got %d", tc.expectedStatusCode, w.Code)
+			}
+			if tc.expectedCode != "" {
+				var p problem.Problem
+				if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+					t.Fatalf("failed to decode problem: %v", err)
+				}
+				if p.Code != tc.expectedCode {
+					t.Errorf("expected problem code %q, but got %q", tc.expectedCode, p.Code)
+				}
+			}
+			if tc.expectedShortURL != "" {
+				var resp map[string]string
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+					t.Fatalf("failed to decode response: %v", err)
+				}
+				if resp["short_url"] != tc.expectedShortURL {
+					t.Errorf("expected short URL %q, but got %q", tc.expectedShortURL, resp["short_url"])
+				}
+			}
+		})
+	}
+}
+
+func TestHandleRedirect(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	testCases := []struct {
+		name                string
+		mockReturnURL       string
+		mockUntrusted       bool
+		mockProtected       bool
+		mockReturnErr       error
+		expectedStatusCode  int
+		expectedRedirectURL string
+	}{
+		{
+			name:                "Success",
+			mockReturnURL:       "https://example.com",
+			expectedStatusCode:  http.StatusFound,
+			expectedRedirectURL: "https://example.com",
+		},
+		{
+			name:               "Not Found",
+			mockReturnErr:      services.ErrURLNotFound,
+			expectedStatusCode: http.StatusNotFound,
+		},
+		{
+			name:               "Blocked",
+			mockReturnErr:      services.ErrURLBlocked,
+			expectedStatusCode: http.StatusForbidden,
+		},
+		{
+			name:               "Signature Expired",
+			mockReturnErr:      services.ErrURLExpired,
+			expectedStatusCode: http.StatusGone,
+		},
+		{
+			name:               "Backend Error",
+			mockReturnErr:      errors.New("redirect unavailable"),
+			expectedStatusCode: http.StatusBadGateway,
+		},
+		{
+			name:               "Untrusted",
+			mockReturnURL:      "https://files.example/setup.zip",
+			mockUntrusted:      true,
+			expectedStatusCode: http.StatusTeapot,
+		},
+		{
+			name:               "Protected",
+			mockProtected:      true,
+			expectedStatusCode: http.StatusTeapot,
+		},
+	}
+
+	// interstitial stands in for the redirect service's warning page.
+	interstitial := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("check this link"))
+	})
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			redirect := &mock.MockRedirectClient{
+				ReturnURL:       tc.mockReturnURL,
+				ReturnUntrusted: tc.mockUntrusted,
+				ReturnProtected: tc.mockProtected,
+				ReturnErr:       tc.mockReturnErr,
+			}
+			handler := api.NewGatewayHandler(services.NewGatewayService(&mock.MockShortenerClient{}, redirect), api.WithInterstitial(interstitial))
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request, _ = http.NewRequest(http.MethodGet, "/abc", nil)
+			c.Request.Host = "go.duss.io"
+			c.Params = gin.Params{{Key: "shortKey", Value: "abc"}}
+
+			handler.HandleRedirect(c)
+
+			if w.Code != tc.expectedStatusCode {
+				t.Errorf("expected status code %d, but got %d", tc.expectedStatusCode, w.Code)
+			}
+			if redirect.LastDomain != "go.duss.io" {
+				t.Errorf("expected the request host to select the domain, but got %q", redirect.LastDomain)
+			}
+			if location := w.Header().Get("Location"); location != tc.expectedRedirectURL {
+				t.Errorf("expected Location %q, but got %q", tc.expectedRedirectURL, location)
+			}
+			if tc.expectedStatusCode == http.StatusFound && w.Header().Get("Cache-Control") != "no-store" {
+				t.Errorf("expected an uncached redirect, but got Cache-Control %q", w.Header().Get("Cache-Control"))
+			}
+		})
+	}
+}
+
+func TestHandleRedirectUntrustedWithoutInterstitial(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	redirect := &mock.MockRedirectClient{ReturnURL: "https://files.example/setup.zip", ReturnUntrusted: true}
+	handler := newHandler(&mock.MockShortenerClient{}, redirect)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request, _ = http.NewRequest(http.MethodGet, "/abc", nil)
+	c.Params = gin.Params{{Key: "shortKey", Value: "abc"}}
+
+	handler.HandleRedirect(c)
+
+	if w.Code != http.StatusForbidden || w.Header().Get("Location") != "" {
+		t.Errorf("expected an untrusted link never to be redirected directly, but got %d %q", w.Code, w.Header().Get("Location"))
+	}
+}
+
+func TestHandleShortenPassword(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	shortener := &mock.MockShortenerClient{ReturnShortURL: "http://localhost:8081/abc"}
+	handler := newHandler(shortener, &mock.MockRedirectClient{})
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request, _ = http.NewRequest(http.MethodPost, "/shorten", bytes.NewBufferString(`{"url":"https://example.com","password":"hunter2"}`))
+	c.Request.Header.Set("Content-Type", "application/json")
+
+	handler.HandleShorten(c)
+
+	if w.Code != http.StatusCreated {
+		t.Errorf("expected status code %d, but got %d", http.StatusCreated, w.Code)
+	}
+	if shortener.LastRequest.Password != "hunter2" {
+		t.Errorf("expected the password to be passed on, but got %q", shortener.LastRequest.Password)
+	}
+}
+
+func TestHandleShortenOwnerToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	shortener := &mock.MockShortenerClient{ReturnShortURL: "http://localhost:8081/abc"}
+	handler := newHandler(shortener, &mock.MockRedirectClient{})
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request, _ = http.NewRequest(http.MethodPost, "/shorten", bytes.NewBufferString(`{"url":"https://example.com"}`))
+	c.Request.Header.Set("Content-Type", "application/json")
+	c.Request.Header.Set("Authorization", "Bearer a-token")
+
+	handler.HandleShorten(c)
+
+	if w.Code != http.StatusCreated {
+		t.Errorf("expected status code %d, but got %d", http.StatusCreated, w.Code)
+	}
+	if shortener.LastToken != "a-token" {
+		t.Errorf("expected the shortener to receive token %q, but got %q", "a-token", shortener.LastToken)
+	}
+}
+
+func TestHandleShortenSigned(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	shortener := &mock.MockShortenerClient{ReturnShortURL: "http://localhost:8081/abc.k1.mq1zc0.sum"}
+	handler := newHandler(shortener, &mock.MockRedirectClient{})
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request, _ = http.NewRequest(http.MethodPost, "/shorten", bytes.NewBufferString(`{"url":"https://example.com","signed":true,"signature_expires_at":"2030-01-02T03:04:05Z"}`))
+	c.Request.Header.Set("Content-Type", "application/json")
+
+	handler.HandleShorten(c)
+
+	if w.Code != http.StatusCreated {
+		t.Errorf("expected status code %d, but got %d", http.StatusCreated, w.Code)
+	}
+	expires := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	if got := shortener.LastRequest; !got.Signed || !got.SignatureExpiresAt.Equal(expires) {
+		t.Errorf("expected a signed link expiring at %s to be requested, but got %+v", expires, got)
+	}
+}
+
+func TestHandleUnlock(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var forwarded *http.Request
+	interstitial := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r
+		w.WriteHeader(http.StatusSeeOther)
+		w.Write([]byte("unlocked"))
+	})
+
+	handler := api.NewGatewayHandler(services.NewGatewayService(&mock.MockShortenerClient{}, &mock.MockRedirectClient{}), api.WithInterstitial(interstitial))
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request, _ = http.NewRequest(http.MethodPost, "/locked", bytes.NewBufferString("password=hunter2"))
+
+	handler.HandleUnlock(c)
+
+	if w.Code != http.StatusSeeOther || forwarded == nil {
+		t.Errorf("expected the form to be passed to the interstitial, but got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(w)
+	c.Request, _ = http.NewRequest(http.MethodPost, "/locked", bytes.NewBufferString("password=hunter2"))
+
+	newHandler(&mock.MockShortenerClient{}, &mock.MockRedirectClient{}).HandleUnlock(c)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status code %d without an interstitial, but got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestHandleSetTrust(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	testCases := []struct {
+		name               string
+		body               string
+		token              string
+		mockReturnErr      error
+		expectedStatusCode int
+		expectedTrust      services.TrustRequest
+	}{
+		{
+			name:               "Owner",
+			body:               `{"untrusted":true}`,
+			token:              "a-token",
+			expectedStatusCode: http.StatusOK,
+			expectedTrust:      services.TrustRequest{Domain: "go.duss.io", ShortKey: "abc", Untrusted: true},
+		},
+		{
+			name:               "Admin",
+			body:               `{"untrusted":false}`,
+			token:              "s3cret",
+			expectedStatusCode: http.StatusOK,
+			expectedTrust:      services.TrustRequest{Domain: "go.duss.io", ShortKey: "abc"},
+		},
+		{
+			name:               "Missing Flag",
+			body:               `{}`,
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:               "Forbidden",
+			body:               `{"untrusted":true}`,
+			mockReturnErr:      services.ErrForbidden,
+			expectedStatusCode: http.StatusForbidden,
+			expectedTrust:      services.TrustRequest{Domain: "go.duss.io", ShortKey: "abc", Untrusted: true},
+		},
+		{
+			name:               "Not Found",
+			body:               `{"untrusted":true}`,
+			mockReturnErr:      services.ErrURLNotFound,
+			expectedStatusCode: http.StatusNotFound,
+			expectedTrust:      services.TrustRequest{Domain: "go.duss.io", ShortKey: "abc", Untrusted: true},
+		},
+		{
+			name:               "Backend Error",
+			body:               `{"untrusted":true}`,
+			mockReturnErr:      errors.New("shortener unavailable"),
+			expectedStatusCode: http.StatusBadGateway,
+			expectedTrust:      services.TrustRequest{Domain: "go.duss.io", ShortKey: "abc", Untrusted: true},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			shortener := &mock.MockShortenerClient{
+				ReturnURL: &domain.URL{ShortKey: "abc", LongURL: "https://example.com", Untrusted: true},
+				ReturnErr: tc.mockReturnErr,
+			}
+			handler := newHandler(shortener, &mock.MockRedirectClient{})
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request, _ = http.NewRequest(http.MethodPut, "/trust/abc", bytes.NewBufferString(tc.body))
+			c.Request.Host = "go.duss.io"
+			c.Request.Header.Set("Content-Type", "application/json")
+			if tc.token != "" {
+				c.Request.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			c.Params = gin.Params{{Key: "shortKey", Value: "abc"}}
+
+			handler.HandleSetTrust(c)
+
+			if w.Code != tc.expectedStatusCode {
+				t.Errorf("expected status code %d, but got %d", tc.expectedStatusCode, w.Code)
+			}
+			if shortener.LastTrust != tc.expectedTrust {
+				t.Errorf("expected client to receive %+v, but got %+v", tc.expectedTrust, shortener.LastTrust)
+			}
+			if shortener.LastToken != tc.token {
+				t.Errorf("expected the shortener to receive token %q, but got %q", tc.token, shortener.LastToken)
+			}
+		})
+	}
+}
+
+func TestHandleStats(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	testCases := []struct {
+		name               string
+		mockReturnURL      *domain.URL
+		mockReturnErr      error
+		expectedStatusCode int
+	}{
+		{
+			name:               "Success",
+			mockReturnURL:      &domain.URL{ShortKey: "abc", LongURL: "https://example.com", Redirects: 2},
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:               "Forbidden",
+			mockReturnErr:      services.ErrForbidden,
+			expectedStatusCode: http.StatusForbidden,
+		},
+		{
+			name:               "Not Found",
+			mockReturnErr:      services.ErrURLNotFound,
+			expectedStatusCode: http.StatusNotFound,
+		},
+		{
+			name:               "Backend Error",
+			mockReturnErr:      errors.New("shortener unavailable"),
+			expectedStatusCode: http.StatusBadGateway,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			shortener := &mock.MockShortenerClient{
+				ReturnURL: tc.mockReturnURL,
+				ReturnErr: tc.mockReturnErr,
+			}
+			handler := newHandler(shortener, &mock.MockRedirectClient{})
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request, _ = http.NewRequest(http.MethodGet, "/stats/abc", nil)
+			c.Request.Header.Set("Authorization", "Bearer s3cret")
+			c.Params = gin.Params{{Key: "shortKey", Value: "abc"}}
+
+			handler.HandleStats(c)
+
+			if w.Code != tc.expectedStatusCode {
+				t.Errorf("expected status code %d, but got %d", tc.expectedStatusCode, w.Code)
+			}
+			if shortener.LastToken != "s3cret" {
+				t.Errorf("expected the shortener to receive token %q, but got %q", "s3cret", shortener.LastToken)
+			}
+			if tc.mockReturnURL != nil {
+				var got domain.URL
+				if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+					t.Fatalf("failed to decode response: %v", err)
+				}
+				if got.Redirects != tc.mockReturnURL.Redirects {
+					t.Errorf("expected %d redirects, but got %d", tc.mockReturnURL.Redirects, got.Redirects)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleDelete(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	testCases := []struct {
+		name               string
+		mockReturnErr      error
+		expectedStatusCode int
+	}{
+		{"Success", nil, http.StatusNoContent},
+		{"Forbidden", services.ErrForbidden, http.StatusForbidden},
+		{"Not Found", services.ErrURLNotFound, http.StatusNotFound},
+		{"Backend Error", errors.New("shortener unavailable"), http.StatusBadGateway},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			shortener := &mock.MockShortenerClient{ReturnErr: tc.mockReturnErr}
+			handler := newHandler(shortener, &mock.MockRedirectClient{})
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request, _ = http.NewRequest(http.MethodDelete, "/abc", nil)
+			c.Request.Header.Set("Authorization", "Bearer s3cret")
+			c.Params = gin.Params{{Key: "shortKey", Value: "abc"}}
+
+			handler.HandleDelete(c)
+			c.Writer.WriteHeaderNow()
+
+			if w.Code != tc.expectedStatusCode {
+				t.Errorf("expected status code %d, but got %d", tc.expectedStatusCode, w.Code)
+			}
+			if shortener.LastToken != "s3cret" {
+				t.Errorf("expected the shortener to receive token %q, but got %q", "s3cret", shortener.LastToken)
+			}
+		})
+	}
+}
+
+func TestManagementDomain(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	testCases := []struct {
+		name           string
+		target         string
+		expectedDomain string
+	}{
+		{"Host", "/stats/abc", "duss.io"},
+		{"Query Overrides Host", "/stats/abc?domain=go.duss.io", "go.duss.io"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			shortener := &mock.MockShortenerClient{ReturnURL: &domain.URL{ShortKey: "abc"}}
+			handler := newHandler(shortener, &mock.MockRedirectClient{})
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request, _ = http.NewRequest(http.MethodGet, tc.target, nil)
+			c.Request.Host = "duss.io"
+			c.Params = gin.Params{{Key: "shortKey", Value: "abc"}}
+
+			handler.HandleStats(c)
+
+			if shortener.LastDomain != tc.expectedDomain {
+				t.Errorf("expected domain %q, but got %q", tc.expectedDomain, shortener.LastDomain)
+			}
+		})
+	}
+}
@@ -0,0 +1,227 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/iton0/duss/api-gateway-service/internal/infrastructure/storage"
+	"github.com/iton0/duss/shared/problem"
+)
+
+const (
+	// DefaultIdempotencyTTL is how long a response is replayed for.
+	DefaultIdempotencyTTL = 24 * time.Hour
+	// DefaultIdempotencyWait is how long a duplicate of a request still in
+	// progress waits for its response before it is answered 409 Conflict.
+	DefaultIdempotencyWait = 5 * time.Second
+	// idempotencyLease is how long a request in progress holds its key. It
+	// outlasts the slowest call to the shortener, and bounds how long a key
+	// stays taken when a replica dies while serving it.
+	idempotencyLease = 2 * time.Minute
+	// idempotencyPoll is how often a waiting duplicate checks for the
+	// response.
+	idempotencyPoll = 50 * time.Millisecond
+	// maxIdempotencyKeyLength is the longest Idempotency-Key accepted.
+	maxIdempotencyKeyLength = 255
+)
+
+// replayedHeaders are the response headers recorded with a response.
+var replayedHeaders = []string{"Content-Type", "Location"}
+
+// Idempotency makes requests sent with an Idempotency-Key header safe to
+// retry. The first response to a request is recorded under the client and
+// key, and replayed for every retry with the same body. Records are kept in a
+// storage.IdempotencyStore, so retries may reach any replica.
+type Idempotency struct {
+	store storage.IdempotencyStore
+	ttl   time.Duration
+	wait  time.Duration
+}
+
+// IdempotencyOption configures optional settings of an Idempotency.
+type IdempotencyOption func(*Idempotency)
+
+// WithIdempotencyTTL sets how long responses are replayed for.
+func WithIdempotencyTTL(ttl time.Duration) IdempotencyOption {
+	return func(m *Idempotency) {
+		m.ttl = ttl
+	}
+}
+
+// WithIdempotencyWait sets how long a duplicate of a request in progress
+// waits for its response. Zero answers it 409 Conflict at once.
+func WithIdempotencyWait(wait time.Duration) IdempotencyOption {
+	return func(m *Idempotency) {
+		m.wait = wait
+	}
+}
+
+// NewIdempotency creates an Idempotency that records responses in store.
+func NewIdempotency(store storage.IdempotencyStore, opts ...IdempotencyOption) *Idempotency {
+	m := &Idempotency{
+		store: store,
+		ttl:   DefaultIdempotencyTTL,
+		wait:  DefaultIdempotencyWait,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// Handle is the gin middleware. Requests without an Idempotency-Key pass
+// straight through. A retry whose body differs from the first request's is
+// answered 422 Unprocessable Entity. Server errors are not recorded, so a
+// request that failed with one may be retried under the same key.
+func (m *Idempotency) Handle(c *gin.Context) {
+	key := c.GetHeader("Idempotency-Key")
+	if key == "" {
+		c.Next()
+		return
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		problem.Abort(c, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Idempotency-Key must be at most 255 characters"))
+		return
+	}
+
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		problem.Abort(c, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request body"))
+		return
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+	ctx := c.Request.Context()
+	key = idempotencyScope(c) + ":" + key
+	reservation := &storage.IdempotencyRecord{
+		Fingerprint: fingerprint(c.Request.Method, c.Request.URL.Path, body),
+		Token:       rand.Text(),
+	}
+
+	deadline := time.Now().Add(m.wait)
+	for {
+		rec, reserved, err := m.store.Reserve(ctx, key, reservation, idempotencyLease)
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to reserve idempotency key", "error", err)
+			problem.Abort(c, problem.New(http.StatusServiceUnavailable, problem.CodeUpstreamUnavailable, "Idempotency keys are unavailable"))
+			return
+		}
+		switch {
+		case reserved:
+			m.serve(c, key, reservation)
+			return
+		case rec.Fingerprint != reservation.Fingerprint:
+			problem.Abort(c, problem.New(http.StatusUnprocessableEntity, problem.CodeConflict, "Idempotency-Key was already used for a different request"))
+			return
+		case rec.Done:
+			for _, name := range replayedHeaders {
+				if v := rec.Header.Get(name); v != "" {
+					c.Header(name, v)
+				}
+			}
+			c.Header("Idempotent-Replayed", "true")
+			c.Status(rec.Status)
+			c.Writer.Write(rec.Body)
+			c.Abort()
+			return
+		}
+
+		if !time.Now().Before(deadline) {
+			c.Header("Retry-After", "1")
+			problem.Abort(c, problem.New(http.StatusConflict, problem.CodeConflict, "A request with this Idempotency-Key is in progress"))
+			return
+		}
+		select {
+		case <-ctx.Done():
+			c.Abort()
+			return
+		case <-time.After(idempotencyPoll):
+		}
+	}
+}
+
+// serve runs the rest of the chain for the request that reserved key, and
+// records its response or, after a server error, releases the key.
+func (m *Idempotency) serve(c *gin.Context, key string, reservation *storage.IdempotencyRecord) {
+	w := &recordingWriter{ResponseWriter: c.Writer}
+	c.Writer = w
+	defer func() { c.Writer = w.ResponseWriter }()
+
+	c.Next()
+
+	// The response has been written by now, so the key is settled even if
+	// the client has gone away.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(c.Request.Context()), 5*time.Second)
+	defer cancel()
+
+	status := w.Status()
+	if status >= http.StatusInternalServerError {
+		if err := m.store.Release(ctx, key, reservation.Token); err != nil {
+			slog.WarnContext(ctx, "failed to release idempotency key", "error", err)
+		}
+		return
+	}
+
+	rec := &storage.IdempotencyRecord{
+		Fingerprint: reservation.Fingerprint,
+		Done:        true,
+		Status:      status,
+		Header:      http.Header{},
+		Body:        w.body.Bytes(),
+	}
+	for _, name := range replayedHeaders {
+		if v := w.Header().Get(name); v != "" {
+			rec.Header.Set(name, v)
+		}
+	}
+	if err := m.store.Complete(ctx, key, reservation.Token, rec, m.ttl); err != nil && !errors.Is(err, storage.ErrNotReserved) {
+		slog.WarnContext(ctx, "failed to record idempotent response", "error", err)
+	}
+}
+
+// idempotencyScope identifies the client a key belongs to, so clients
+// cannot see each other's responses: the bearer token it authenticates
+// with, or else its address.
+func idempotencyScope(c *gin.Context) string {
+	client := "ip:" + c.ClientIP()
+	if auth := c.GetHeader("Authorization"); auth != "" {
+		client = "auth:" + auth
+	}
+	sum := sha256.Sum256([]byte(client))
+	return hex.EncodeToString(sum[:])
+}
+
+// fingerprint identifies a request by its method, path and body.
+func fingerprint(method, path string, body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, method+" "+path+"\n")
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// recordingWriter is a gin.ResponseWriter that keeps a copy of the body it
+// writes.
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
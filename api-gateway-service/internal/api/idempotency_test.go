@@ -0,0 +1,153 @@
+package api_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/iton0/duss/api-gateway-service/internal/api"
+	"github.com/iton0/duss/api-gateway-service/internal/infrastructure/storage"
+	"github.com/iton0/duss/shared/testutil/redistest"
+)
+
+// newIdempotentRouter serves POST /shorten behind an Idempotency backed by a
+// fresh Redis. The handler counts its calls, answers with the status in the
+// X-Status request header, if any, and waits for release to be closed when
+// it is not nil.
+func newIdempotentRouter(t *testing.T, release chan struct{}, opts ...api.IdempotencyOption) (*gin.Engine, *int) {
+	t.Helper()
+
+	store, err := storage.NewRedisClient(context.Background(), redistest.Addr(t), "", 0)
+	if err != nil {
+		t.Fatalf("could not create Redis client: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	calls := 0
+	router := gin.New()
+	router.POST("/shorten", api.NewIdempotency(store, opts...).Handle, func(c *gin.Context) {
+		calls++
+		if release != nil {
+			<-release
+		}
+		status := http.StatusCreated
+		if c.GetHeader("X-Status") == "500" {
+			status = http.StatusInternalServerError
+		}
+		c.Header("Location", "/abc")
+		c.JSON(status, gin.H{"short_url": "http://localhost:8081/abc", "call": calls})
+	})
+	return router, &calls
+}
+
+func idempotentRequest(key, body string, header ...string) *http.Request {
+	req, _ := http.NewRequest(http.MethodPost, "/shorten", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	return req
+}
+
+func TestIdempotency(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router, calls := newIdempotentRouter(t, nil)
+
+	testCases := []struct {
+		name               string
+		req                *http.Request
+		expectedStatusCode int
+		expectedCalls      int
+		expectedReplayed   bool
+	}{
+		{"No Key", idempotentRequest("", `{"url":"https://example.com"}`), http.StatusCreated, 1, false},
+		{"No Key Again", idempotentRequest("", `{"url":"https://example.com"}`), http.StatusCreated, 2, false},
+		{"First Request", idempotentRequest("k1", `{"url":"https://example.com"}`), http.StatusCreated, 3, false},
+		{"Retry", idempotentRequest("k1", `{"url":"https://example.com"}`), http.StatusCreated, 3, true},
+		{"Retry With Other Body", idempotentRequest("k1", `{"url":"https://example.org"}`), http.StatusUnprocessableEntity, 3, false},
+		{"Other Client", idempotentRequest("k1", `{"url":"https://example.com"}`, "Authorization", "Bearer other"), http.StatusCreated, 4, false},
+		{"Key Too Long", idempotentRequest(strings.Repeat("k", 256), `{}`), http.StatusBadRequest, 4, false},
+		{"Server Error", idempotentRequest("k2", `{}`, "X-Status", "500"), http.StatusInternalServerError, 5, false},
+		{"Server Error Retried", idempotentRequest("k2", `{}`), http.StatusCreated, 6, false},
+	}
+
+	var first string
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, tc.req)
+
+			if w.Code != tc.expectedStatusCode {
+				t.Errorf("expected status code %d, but got %d: %s", tc.expectedStatusCode, w.Code, w.Body.String())
+			}
+			if *calls != tc.expectedCalls {
+				t.Errorf("expected %d calls, but got %d", tc.expectedCalls, *calls)
+			}
+			if replayed := w.Header().Get("Idempotent-Replayed") == "true"; replayed != tc.expectedReplayed {
+				t.Errorf("expected replayed=%v, but got %v", tc.expectedReplayed, replayed)
+			}
+			if tc.name == "First Request" {
+				first = w.Body.String()
+			}
+			if tc.expectedReplayed && (w.Body.String() != first || w.Header().Get("Location") != "/abc") {
+				t.Errorf("expected the first response %q, but got %q", first, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestIdempotencyConcurrent(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	testCases := []struct {
+		name               string
+		wait               time.Duration
+		expectedStatusCode int
+	}{
+		{"Duplicate Waits", 5 * time.Second, http.StatusCreated},
+		{"Duplicate Conflicts", time.Millisecond, http.StatusConflict},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			release := make(chan struct{})
+			router, calls := newIdempotentRouter(t, release, api.WithIdempotencyWait(tc.wait))
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				router.ServeHTTP(httptest.NewRecorder(), idempotentRequest("k", `{}`))
+			}()
+			// Let the first request reserve the key before the duplicate.
+			time.Sleep(100 * time.Millisecond)
+
+			w := httptest.NewRecorder()
+			duplicate := make(chan struct{})
+			go func() {
+				defer close(duplicate)
+				router.ServeHTTP(w, idempotentRequest("k", `{}`))
+			}()
+			if tc.expectedStatusCode == http.StatusConflict {
+				<-duplicate
+			}
+			close(release)
+			<-done
+			<-duplicate
+
+			if w.Code != tc.expectedStatusCode {
+				t.Errorf("expected status code %d, but got %d: %s", tc.expectedStatusCode, w.Code, w.Body.String())
+			}
+			if *calls != 1 {
+				t.Errorf("expected 1 call, but got %d", *calls)
+			}
+		})
+	}
+}
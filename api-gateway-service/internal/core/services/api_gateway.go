@@ -2,12 +2,62 @@ package services
 
 import (
 	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/iton0/duss/shared/domain"
+	"github.com/iton0/duss/shared/problem"
+)
+
+var (
+	// ErrURLNotFound indicates that a backend service has no URL for the short key.
+	ErrURLNotFound = errors.New("URL not found")
+	// ErrInvalidRequest indicates that a backend service rejected the request,
+	// for example because it names a short domain that is not allowed.
+	ErrInvalidRequest = errors.New("invalid request")
+	// ErrURLBlocked indicates that the URL policy forbids shortening or
+	// redirecting to the URL.
+	ErrURLBlocked = errors.New("URL blocked")
+	// ErrForbidden indicates that the caller may not change the link.
+	ErrForbidden = errors.New("forbidden")
+	// ErrURLExpired indicates that the signature of a signed short URL has
+	// expired.
+	ErrURLExpired = errors.New("URL expired")
+	// ErrTooLarge indicates that a batch or job holds more URLs, or an
+	// upload more bytes, than the shortener accepts.
+	ErrTooLarge = errors.New("too large")
+	// ErrJobNotFound indicates that the shortener has no job with the ID.
+	ErrJobNotFound = errors.New("job not found")
 )
 
 // GatewayServiceIface defines the behavior of the gateway service.
 type GatewayServiceIface interface {
-	ShortenURL(ctx context.Context, originalURL string) (string, error)
-	RedirectURL(ctx context.Context, shortURL string) (string, error)
+	// ShortenURL returns the short URL for req and whether it was newly
+	// created rather than an existing, deduplicated link.
+	ShortenURL(ctx context.Context, req ShortenRequest, token string) (shortURL string, created bool, err error)
+	// RedirectURL looks up where a link leads and counts the redirect,
+	// unless visitors must first pass the redirect service's interstitial
+	// or password form, which count it once they do.
+	RedirectURL(ctx context.Context, shortDomain, shortKey string) (Destination, error)
+	// GetStats and DeleteURL read and delete a link for the caller whose
+	// bearer token is token, which the shortener checks. The other calls
+	// taking a token likewise act for that caller, who may be anonymous
+	// when creating links.
+	GetStats(ctx context.Context, shortDomain, shortKey, token string) (*domain.URL, error)
+	DeleteURL(ctx context.Context, shortDomain, shortKey, token string) error
+	// SetTrust flags a link as untrusted or clears the flag.
+	SetTrust(ctx context.Context, req TrustRequest, token string) (*domain.URL, error)
+	// ShortenBatch shortens each of reqs; items that fail are reported in
+	// their results rather than failing the batch.
+	ShortenBatch(ctx context.Context, reqs []ShortenRequest, token string) ([]BatchResult, error)
+	// SubmitJob starts an asynchronous job shortening the URLs listed in
+	// body, a CSV or NDJSON upload of the given content type.
+	SubmitJob(ctx context.Context, contentType string, body io.Reader, token string) (*Job, error)
+	// GetJob reports the progress of a job, which only its submitter or
+	// an administrator may read if it was submitted with an owner token.
+	GetJob(ctx context.Context, id, token string) (*Job, error)
 }
 
 // Ensure GatewayService explicitly implements GatewayServiceIface.
@@ -20,23 +70,136 @@ type GatewayService struct {
 	redirectClient  RedirectServiceClient
 }
 
-// These are the client interfaces that the gateway depends on.
+// ShortenRequest describes a URL to shorten.
+type ShortenRequest struct {
+	URL string
+	// Domain is the short domain to create the link on; empty selects the
+	// shortener's default.
+	Domain string
+	// Owner identifies who the link is created for. Only an administrator
+	// may name an owner other than the one their token belongs to.
+	Owner string
+	// Dedupe overrides the shortener's dedupe mode when set.
+	Dedupe *bool
+	// Password, when set, protects the link.
+	Password string
+	// Signed makes the link only redirect through its signed short URL,
+	// whose signature expires at SignatureExpiresAt unless it is zero.
+	Signed             bool
+	SignatureExpiresAt time.Time
+}
+
+// TrustRequest describes a change to a link's untrusted flag.
+type TrustRequest struct {
+	Domain    string
+	ShortKey  string
+	Untrusted bool
+}
+
+// BatchResult is the outcome of one item of a batch or job. Status is the
+// code shortening the item alone would have been answered with; a failed
+// item also has the problem code and detail it would have been answered with.
+type BatchResult struct {
+	Index    int          `json:"index"`
+	ShortURL string       `json:"short_url,omitempty"`
+	Created  bool         `json:"created"`
+	Status   int          `json:"status"`
+	Code     problem.Code `json:"code,omitempty"`
+	Error    string       `json:"error,omitempty"`
+}
+
+// Job is an asynchronous batch of URLs being shortened. Its results are
+// listed once its status is "done".
+type Job struct {
+	ID        string        `json:"id"`
+	Status    string        `json:"status"`
+	Total     int           `json:"total"`
+	Processed int           `json:"processed"`
+	Failed    int           `json:"failed"`
+	Results   []BatchResult `json:"results,omitempty"`
+	CreatedAt time.Time     `json:"created_at"`
+	UpdatedAt time.Time     `json:"updated_at"`
+}
+
+// Destination is where a short link leads.
+type Destination struct {
+	URL string
+	// Untrusted is set when visitors must be shown the redirect service's
+	// interstitial instead of being redirected directly.
+	Untrusted bool
+	// Protected is set when visitors must enter the link's password on the
+	// redirect service's form. URL is empty then.
+	Protected bool
+}
+
+// These are the client interfaces that the gateway depends on. A short link
+// is identified by its short domain and key; an empty shortDomain lets the
+// backend pick its default domain.
 type ShortenerServiceClient interface {
-	Shorten(ctx context.Context, originalURL string) (string, error)
+	Shorten(ctx context.Context, req ShortenRequest, token string) (shortURL string, created bool, err error)
+	GetURL(ctx context.Context, shortDomain, shortKey, token string) (*domain.URL, error)
+	Delete(ctx context.Context, shortDomain, shortKey, token string) error
+	SetTrust(ctx context.Context, req TrustRequest, token string) (*domain.URL, error)
+	ShortenBatch(ctx context.Context, reqs []ShortenRequest, token string) ([]BatchResult, error)
+	SubmitJob(ctx context.Context, contentType string, body io.Reader, token string) (*Job, error)
+	GetJob(ctx context.Context, id, token string) (*Job, error)
 }
 
 type RedirectServiceClient interface {
-	GetOriginalURL(ctx context.Context, shortURL string) (string, error)
+	// GetOriginalURL looks a link up without counting the redirect, so it
+	// may be hedged and retried; CountRedirect counts it once.
+	GetOriginalURL(ctx context.Context, shortDomain, shortKey string) (Destination, error)
+	CountRedirect(ctx context.Context, shortDomain, shortKey string) error
 }
 
 // ShortenURL implements the GatewayServiceIface.
-func (s *GatewayService) ShortenURL(ctx context.Context, originalURL string) (string, error) {
-	return s.shortenerClient.Shorten(ctx, originalURL)
+func (s *GatewayService) ShortenURL(ctx context.Context, req ShortenRequest, token string) (string, bool, error) {
+	return s.shortenerClient.Shorten(ctx, req, token)
 }
 
 // RedirectURL implements the GatewayServiceIface.
-func (s *GatewayService) RedirectURL(ctx context.Context, shortURL string) (string, error) {
-	return s.redirectClient.GetOriginalURL(ctx, shortURL)
+func (s *GatewayService) RedirectURL(ctx context.Context, shortDomain, shortKey string) (Destination, error) {
+	dest, err := s.redirectClient.GetOriginalURL(ctx, shortDomain, shortKey)
+	if err != nil {
+		return Destination{}, err
+	}
+	if !dest.Untrusted && !dest.Protected {
+		// A lost count must not fail the redirect itself.
+		if err := s.redirectClient.CountRedirect(ctx, shortDomain, shortKey); err != nil {
+			slog.WarnContext(ctx, "failed to count redirect", "error", err)
+		}
+	}
+	return dest, nil
+}
+
+// GetStats implements the GatewayServiceIface.
+func (s *GatewayService) GetStats(ctx context.Context, shortDomain, shortKey, token string) (*domain.URL, error) {
+	return s.shortenerClient.GetURL(ctx, shortDomain, shortKey, token)
+}
+
+// DeleteURL implements the GatewayServiceIface.
+func (s *GatewayService) DeleteURL(ctx context.Context, shortDomain, shortKey, token string) error {
+	return s.shortenerClient.Delete(ctx, shortDomain, shortKey, token)
+}
+
+// SetTrust implements the GatewayServiceIface.
+func (s *GatewayService) SetTrust(ctx context.Context, req TrustRequest, token string) (*domain.URL, error) {
+	return s.shortenerClient.SetTrust(ctx, req, token)
+}
+
+// ShortenBatch implements the GatewayServiceIface.
+func (s *GatewayService) ShortenBatch(ctx context.Context, reqs []ShortenRequest, token string) ([]BatchResult, error) {
+	return s.shortenerClient.ShortenBatch(ctx, reqs, token)
+}
+
+// SubmitJob implements the GatewayServiceIface.
+func (s *GatewayService) SubmitJob(ctx context.Context, contentType string, body io.Reader, token string) (*Job, error) {
+	return s.shortenerClient.SubmitJob(ctx, contentType, body, token)
+}
+
+// GetJob implements the GatewayServiceIface.
+func (s *GatewayService) GetJob(ctx context.Context, id, token string) (*Job, error) {
+	return s.shortenerClient.GetJob(ctx, id, token)
 }
 
 // NewGatewayService creates a new GatewayService instance with its dependencies.
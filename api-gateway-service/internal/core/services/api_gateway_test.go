@@ -1 +1,181 @@
-package services
+package services_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/iton0/duss/api-gateway-service/internal/core/services"
+	"github.com/iton0/duss/api-gateway-service/internal/infrastructure/clients/mock"
+	"github.com/iton0/duss/shared/domain"
+)
+
+func TestShortenURL(t *testing.T) {
+	shortener := &mock.MockShortenerClient{ReturnShortURL: "http://localhost:8081/abc"}
+	gs := services.NewGatewayService(shortener, &mock.MockRedirectClient{})
+
+	req := services.ShortenRequest{URL: "https://example.com", Domain: "go.duss.io", Owner: "team-a"}
+	got, created, err := gs.ShortenURL(context.Background(), req, "a-token")
+	if err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	if !created {
+		t.Error("expected the link to be reported as created")
+	}
+	if got != "http://localhost:8081/abc" {
+		t.Errorf("expected short URL %q, but got %q", "http://localhost:8081/abc", got)
+	}
+	if shortener.LastRequest != req {
+		t.Errorf("expected client to receive %+v, but got %+v", req, shortener.LastRequest)
+	}
+	if shortener.LastToken != "a-token" {
+		t.Errorf("expected client to receive token %q, but got %q", "a-token", shortener.LastToken)
+	}
+}
+
+func TestRedirectURL(t *testing.T) {
+	testCases := []struct {
+		name            string
+		returnURL       string
+		returnUntrusted bool
+		returnErr       error
+		expectedURL     string
+		expectedErr     error
+		expectedCounted int
+	}{
+		{
+			name:            "Success",
+			returnURL:       "https://example.com",
+			expectedURL:     "https://example.com",
+			expectedCounted: 1,
+		},
+		{
+			// Visitors are only counted once they pass the interstitial.
+			name:            "Untrusted",
+			returnURL:       "https://files.example/setup.zip",
+			returnUntrusted: true,
+			expectedURL:     "https://files.example/setup.zip",
+		},
+		{
+			name:        "Not Found",
+			returnErr:   services.ErrURLNotFound,
+			expectedErr: services.ErrURLNotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			redirect := &mock.MockRedirectClient{ReturnURL: tc.returnURL, ReturnUntrusted: tc.returnUntrusted, ReturnErr: tc.returnErr}
+			gs := services.NewGatewayService(&mock.MockShortenerClient{}, redirect)
+
+			got, err := gs.RedirectURL(context.Background(), "go.duss.io", "abc")
+			if !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("expected error %v, but got %v", tc.expectedErr, err)
+			}
+			if got.URL != tc.expectedURL {
+				t.Errorf("expected URL %q, but got %q", tc.expectedURL, got.URL)
+			}
+			if redirect.LastDomain != "go.duss.io" || redirect.LastShortKey != "abc" {
+				t.Errorf("expected client to receive %q, but got %q", "go.duss.io/abc", redirect.LastDomain+"/"+redirect.LastShortKey)
+			}
+			if len(redirect.Counted) != tc.expectedCounted {
+				t.Errorf("expected %d counted redirects, but got %v", tc.expectedCounted, redirect.Counted)
+			}
+		})
+	}
+}
+
+func TestGetStats(t *testing.T) {
+	want := &domain.URL{ShortKey: "abc", LongURL: "https://example.com", Redirects: 3}
+	shortener := &mock.MockShortenerClient{ReturnURL: want}
+	gs := services.NewGatewayService(shortener, &mock.MockRedirectClient{})
+
+	got, err := gs.GetStats(context.Background(), "duss.io", "abc", "s3cret")
+	if err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	if got != want {
+		t.Errorf("expected %+v, but got %+v", want, got)
+	}
+	if shortener.LastToken != "s3cret" {
+		t.Errorf("expected client to receive token %q, but got %q", "s3cret", shortener.LastToken)
+	}
+}
+
+func TestDeleteURL(t *testing.T) {
+	shortener := &mock.MockShortenerClient{ReturnErr: services.ErrURLNotFound}
+	gs := services.NewGatewayService(shortener, &mock.MockRedirectClient{})
+
+	if err := gs.DeleteURL(context.Background(), "duss.io", "abc", "s3cret"); !errors.Is(err, services.ErrURLNotFound) {
+		t.Fatalf("expected ErrURLNotFound, but got %v", err)
+	}
+	if shortener.LastDomain != "duss.io" || shortener.LastShortKey != "abc" {
+		t.Errorf("expected client to receive %q, but got %q", "duss.io/abc", shortener.LastDomain+"/"+shortener.LastShortKey)
+	}
+	if shortener.LastToken != "s3cret" {
+		t.Errorf("expected client to receive token %q, but got %q", "s3cret", shortener.LastToken)
+	}
+}
+
+func TestSetTrust(t *testing.T) {
+	want := &domain.URL{ShortKey: "abc", LongURL: "https://example.com", Untrusted: true}
+	shortener := &mock.MockShortenerClient{ReturnURL: want}
+	gs := services.NewGatewayService(shortener, &mock.MockRedirectClient{})
+
+	req := services.TrustRequest{Domain: "duss.io", ShortKey: "abc", Untrusted: true}
+	got, err := gs.SetTrust(context.Background(), req, "a-token")
+	if err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	if got != want {
+		t.Errorf("expected %+v, but got %+v", want, got)
+	}
+	if shortener.LastTrust != req {
+		t.Errorf("expected client to receive %+v, but got %+v", req, shortener.LastTrust)
+	}
+	if shortener.LastToken != "a-token" {
+		t.Errorf("expected client to receive token %q, but got %q", "a-token", shortener.LastToken)
+	}
+}
+
+func TestShortenBatch(t *testing.T) {
+	want := []services.BatchResult{{Index: 0, ShortURL: "http://localhost:8081/abc", Created: true, Status: 201}}
+	shortener := &mock.MockShortenerClient{ReturnResults: want}
+	gs := services.NewGatewayService(shortener, &mock.MockRedirectClient{})
+
+	reqs := []services.ShortenRequest{{URL: "https://example.com", Owner: "team-a"}}
+	got, err := gs.ShortenBatch(context.Background(), reqs, "a-token")
+	if err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	if len(got) != 1 || got[0] != want[0] {
+		t.Errorf("expected %+v, but got %+v", want, got)
+	}
+	if len(shortener.LastBatch) != 1 || shortener.LastBatch[0] != reqs[0] {
+		t.Errorf("expected client to receive %+v, but got %+v", reqs, shortener.LastBatch)
+	}
+	if shortener.LastToken != "a-token" {
+		t.Errorf("expected client to receive token %q, but got %q", "a-token", shortener.LastToken)
+	}
+}
+
+func TestSubmitJob(t *testing.T) {
+	want := &services.Job{ID: "job1", Status: "running", Total: 1}
+	shortener := &mock.MockShortenerClient{ReturnJob: want}
+	gs := services.NewGatewayService(shortener, &mock.MockRedirectClient{})
+
+	got, err := gs.SubmitJob(context.Background(), "text/csv", strings.NewReader("url\nhttps://example.com\n"), "a-token")
+	if err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	if got != want {
+		t.Errorf("expected %+v, but got %+v", want, got)
+	}
+	if shortener.LastContentType != "text/csv" || shortener.LastUpload != "url\nhttps://example.com\n" {
+		t.Errorf("expected client to receive the upload, but got %q as %q", shortener.LastUpload, shortener.LastContentType)
+	}
+	if shortener.LastToken != "a-token" {
+		t.Errorf("expected client to receive token %q, but got %q", "a-token", shortener.LastToken)
+	}
+}
@@ -0,0 +1,51 @@
+// Package clients calls the internal services behind the gateway. The
+// shortenerapi and redirectapi packages are generated from the services' API
+// descriptions; the clients here adapt them to the gateway's core services.
+package clients
+
+//go:generate go tool oapi-codegen -config shortenerapi/config.yaml ../../../../url-shortener-service/internal/spec/openapi.yaml
+//go:generate go tool oapi-codegen -config redirectapi/config.yaml ../../../../url-redirect-service/internal/spec/openapi.yaml
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// optional returns a pointer to v, or nil if v is its type's zero value, for
+// the optional fields of the generated request types.
+func optional[T comparable](v T) *T {
+	var zero T
+	if v == zero {
+		return nil
+	}
+	return &v
+}
+
+// optionalTime is like optional for times.
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// value returns the value p points to, or its type's zero value if p is nil.
+func value[T any](p *T) T {
+	if p == nil {
+		var zero T
+		return zero
+	}
+	return *p
+}
+
+// bearer returns a request editor that authenticates the request with token,
+// if it is not empty.
+func bearer(token string) func(context.Context, *http.Request) error {
+	return func(_ context.Context, req *http.Request) error {
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		return nil
+	}
+}
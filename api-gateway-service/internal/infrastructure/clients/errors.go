@@ -0,0 +1,34 @@
+package clients
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/iton0/duss/shared/problem"
+)
+
+// backendError returns the error for a backend response with an unexpected
+// status, whose body the generated client has already read. It carries the
+// problem the backend answered with, which the gateway passes on to its own
+// client, and wraps sentinel, if not nil, so callers can tell the failures
+// apart.
+func backendError(resp *http.Response, body []byte, sentinel error) error {
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	p := problem.FromResponse(resp)
+	if sentinel == nil {
+		return p
+	}
+	return fmt.Errorf("%w: %w", sentinel, p)
+}
+
+// unexpected returns the error for a backend response that is neither a
+// failure the caller expects nor a success described by the backend's API,
+// such as a success without a JSON body.
+func unexpected(resp *http.Response, body []byte) error {
+	if resp.StatusCode < http.StatusBadRequest {
+		return fmt.Errorf("unexpected %d response with Content-Type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	return backendError(resp, body, nil)
+}
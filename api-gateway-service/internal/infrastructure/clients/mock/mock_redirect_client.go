@@ -1 +1,39 @@
 package mock
+
+import (
+	"context"
+
+	"github.com/iton0/duss/api-gateway-service/internal/core/services"
+	"github.com/iton0/duss/shared/domain"
+)
+
+// Ensure MockRedirectClient explicitly implements services.RedirectServiceClient.
+var _ services.RedirectServiceClient = (*MockRedirectClient)(nil)
+
+// MockRedirectClient is a canned services.RedirectServiceClient for tests.
+type MockRedirectClient struct {
+	ReturnURL       string
+	ReturnUntrusted bool
+	ReturnProtected bool
+	ReturnErr       error
+
+	// LastDomain and LastShortKey record the most recent arguments.
+	LastDomain   string
+	LastShortKey string
+	// Counted records the links CountRedirect was called for.
+	Counted []string
+}
+
+func (m *MockRedirectClient) GetOriginalURL(ctx context.Context, shortDomain, shortKey string) (services.Destination, error) {
+	m.LastDomain = shortDomain
+	m.LastShortKey = shortKey
+	if m.ReturnErr != nil {
+		return services.Destination{}, m.ReturnErr
+	}
+	return services.Destination{URL: m.ReturnURL, Untrusted: m.ReturnUntrusted, Protected: m.ReturnProtected}, nil
+}
+
+func (m *MockRedirectClient) CountRedirect(ctx context.Context, shortDomain, shortKey string) error {
+	m.Counted = append(m.Counted, domain.LinkID(shortDomain, shortKey))
+	return nil
+}
@@ -1 +1,89 @@
 package mock
+
+import (
+	"context"
+	"io"
+
+	"github.com/iton0/duss/api-gateway-service/internal/core/services"
+	"github.com/iton0/duss/shared/domain"
+)
+
+// Ensure MockShortenerClient explicitly implements services.ShortenerServiceClient.
+var _ services.ShortenerServiceClient = (*MockShortenerClient)(nil)
+
+// MockShortenerClient is a canned services.ShortenerServiceClient for tests.
+type MockShortenerClient struct {
+	ReturnShortURL string
+	ReturnURL      *domain.URL
+	ReturnErr      error
+	// ReturnExisting makes Shorten report an existing, deduplicated link.
+	ReturnExisting bool
+	// ReturnResults and ReturnJob are returned by the batch and job calls.
+	ReturnResults []services.BatchResult
+	ReturnJob     *services.Job
+
+	// LastRequest, LastTrust, LastDomain, LastShortKey and LastToken record the most recent arguments.
+	LastRequest  services.ShortenRequest
+	LastTrust    services.TrustRequest
+	LastDomain   string
+	LastShortKey string
+	LastToken    string
+	// LastBatch, LastContentType and LastUpload record the most recent
+	// batch and job arguments.
+	LastBatch       []services.ShortenRequest
+	LastContentType string
+	LastUpload      string
+	LastJobID       string
+}
+
+func (m *MockShortenerClient) Shorten(ctx context.Context, req services.ShortenRequest, token string) (string, bool, error) {
+	m.LastRequest = req
+	m.LastToken = token
+	m.LastDomain = req.Domain
+	return m.ReturnShortURL, !m.ReturnExisting, m.ReturnErr
+}
+
+func (m *MockShortenerClient) GetURL(ctx context.Context, shortDomain, shortKey, token string) (*domain.URL, error) {
+	m.LastDomain = shortDomain
+	m.LastShortKey = shortKey
+	m.LastToken = token
+	return m.ReturnURL, m.ReturnErr
+}
+
+func (m *MockShortenerClient) Delete(ctx context.Context, shortDomain, shortKey, token string) error {
+	m.LastDomain = shortDomain
+	m.LastShortKey = shortKey
+	m.LastToken = token
+	return m.ReturnErr
+}
+
+func (m *MockShortenerClient) SetTrust(ctx context.Context, req services.TrustRequest, token string) (*domain.URL, error) {
+	m.LastTrust = req
+	m.LastToken = token
+	m.LastDomain = req.Domain
+	m.LastShortKey = req.ShortKey
+	return m.ReturnURL, m.ReturnErr
+}
+
+func (m *MockShortenerClient) ShortenBatch(ctx context.Context, reqs []services.ShortenRequest, token string) ([]services.BatchResult, error) {
+	m.LastBatch = reqs
+	m.LastToken = token
+	return m.ReturnResults, m.ReturnErr
+}
+
+func (m *MockShortenerClient) SubmitJob(ctx context.Context, contentType string, body io.Reader, token string) (*services.Job, error) {
+	m.LastContentType = contentType
+	m.LastToken = token
+	upload, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	m.LastUpload = string(upload)
+	return m.ReturnJob, m.ReturnErr
+}
+
+func (m *MockShortenerClient) GetJob(ctx context.Context, id, token string) (*services.Job, error) {
+	m.LastJobID = id
+	m.LastToken = token
+	return m.ReturnJob, m.ReturnErr
+}
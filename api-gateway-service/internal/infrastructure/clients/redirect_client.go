@@ -2,54 +2,92 @@ package clients
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"net/http"
-	"time"
+	"net/http/httputil"
+	"net/url"
 
 	"github.com/iton0/duss/api-gateway-service/internal/core/services"
+	"github.com/iton0/duss/api-gateway-service/internal/infrastructure/clients/redirectapi"
+	"github.com/iton0/duss/shared/httpclient"
 )
 
-// HTTPRedirectClient is a concrete implementation of the RedirectServiceClient interface.
-type HTTPRedirectClient struct {
-	client  *http.Client
-	baseURL string
+// RedirectClient is a concrete implementation of the RedirectServiceClient
+// interface. It calls the redirect service through the client generated from
+// the service's API description.
+type RedirectClient struct {
+	api *redirectapi.ClientWithResponses
 }
 
-// NewHTTPRedirectClient creates a new HTTP client for the redirect service.
-func NewHTTPRedirectClient(baseURL string) services.RedirectServiceClient {
-	return &HTTPRedirectClient{
-		client:  &http.Client{Timeout: 5 * time.Second},
-		baseURL: baseURL,
+// NewRedirectClient creates a new HTTP client for the redirect service.
+// Its retries and circuit breaker are configured by opts.
+func NewRedirectClient(baseURL string, opts ...httpclient.Option) (services.RedirectServiceClient, error) {
+	api, err := redirectapi.NewClientWithResponses(baseURL,
+		redirectapi.WithHTTPClient(httpclient.New("url-redirect-service", opts...)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create redirect service client: %w", err)
 	}
-}
-
-// redirectResponse mirrors the expected JSON structure of the redirect service.
-type redirectResponse struct {
-	OriginalURL string `json:"original_url"`
+	return &RedirectClient{api: api}, nil
 }
 
 // GetOriginalURL sends an HTTP GET request to the redirect service.
-func (c *HTTPRedirectClient) GetOriginalURL(ctx context.Context, shortURL string) (string, error) {
-	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/api/v1/redirect?key=%s", c.baseURL, shortURL), nil)
+func (c *RedirectClient) GetOriginalURL(ctx context.Context, shortDomain, shortKey string) (services.Destination, error) {
+	// Lookups do not count the redirect, so a slow one may be hedged to
+	// another replica and a failed one retried.
+	ctx = httpclient.Hedged(ctx)
+	resp, err := c.api.LookupWithResponse(ctx, &redirectapi.LookupParams{Domain: optional(shortDomain), Key: shortKey})
 	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
+		return services.Destination{}, fmt.Errorf("failed to send request to redirect service: %w", err)
 	}
 
-	resp, err := c.client.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("failed to send request to redirect service: %w", err)
+	switch {
+	case resp.JSON200 != nil:
+		return services.Destination{
+			URL:       resp.JSON200.OriginalUrl,
+			Untrusted: value(resp.JSON200.Untrusted),
+			Protected: value(resp.JSON200.Protected),
+		}, nil
+	case resp.StatusCode() == http.StatusNotFound:
+		return services.Destination{}, backendError(resp.HTTPResponse, resp.Body, services.ErrURLNotFound)
+	case resp.StatusCode() == http.StatusForbidden:
+		return services.Destination{}, backendError(resp.HTTPResponse, resp.Body, services.ErrURLBlocked)
+	case resp.StatusCode() == http.StatusGone:
+		return services.Destination{}, backendError(resp.HTTPResponse, resp.Body, services.ErrURLExpired)
+	default:
+		return services.Destination{}, unexpected(resp.HTTPResponse, resp.Body)
 	}
-	defer resp.Body.Close()
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("redirect service returned non-200 status: %d", resp.StatusCode)
+// CountRedirect sends an HTTP POST request counting a redirect to the
+// redirect service. Being a POST, it is neither hedged nor retried, so each
+// redirect is counted at most once.
+func (c *RedirectClient) CountRedirect(ctx context.Context, shortDomain, shortKey string) error {
+	resp, err := c.api.CountRedirectWithResponse(ctx, &redirectapi.CountRedirectParams{Domain: optional(shortDomain), Key: shortKey})
+	if err != nil {
+		return fmt.Errorf("failed to send request to redirect service: %w", err)
 	}
 
-	var responseBody redirectResponse
-	if err := json.NewDecoder(resp.Body).Decode(&responseBody); err != nil {
-		return "", fmt.Errorf("failed to decode redirect service response: %w", err)
+	switch resp.StatusCode() {
+	case http.StatusNoContent:
+		return nil
+	case http.StatusNotFound:
+		return backendError(resp.HTTPResponse, resp.Body, services.ErrURLNotFound)
+	default:
+		return unexpected(resp.HTTPResponse, resp.Body)
 	}
+}
 
-	return responseBody.OriginalURL, nil
+// NewRedirectProxy returns a handler that forwards public redirect requests
+// to the redirect service unchanged, including their Host and cookies. The
+// gateway uses it for untrusted and protected links, whose interstitial page,
+// password form and cookies the redirect service serves. A non-nil transport,
+// such as a Balancer's, sends the requests on.
+func NewRedirectProxy(baseURL string, transport http.RoundTripper) http.Handler {
+	target, err := url.Parse(baseURL)
+	if err != nil {
+		target = &url.URL{}
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = transport
+	return proxy
 }
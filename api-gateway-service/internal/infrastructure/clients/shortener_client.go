@@ -1,67 +1,274 @@
 package clients
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"time"
 
 	"github.com/iton0/duss/api-gateway-service/internal/core/services"
+	"github.com/iton0/duss/api-gateway-service/internal/infrastructure/clients/shortenerapi"
+	"github.com/iton0/duss/shared/domain"
+	"github.com/iton0/duss/shared/httpclient"
+	"github.com/iton0/duss/shared/problem"
 )
 
-// HTTPShortenerClient is a concrete implementation of the ShortenerServiceClient interface.
-type HTTPShortenerClient struct {
-	client  *http.Client
-	baseURL string
+// uploadTimeout bounds job uploads, which may take longer than other
+// requests.
+const uploadTimeout = time.Minute
+
+// ShortenerClient is a concrete implementation of the ShortenerServiceClient
+// interface. It calls the shortener service through the client generated
+// from the service's API description.
+type ShortenerClient struct {
+	api *shortenerapi.ClientWithResponses
 }
 
-// NewHTTPShortenerClient creates a new HTTP client for the shortening service.
-func NewHTTPShortenerClient(baseURL string) services.ShortenerServiceClient {
-	return &HTTPShortenerClient{
-		client:  &http.Client{Timeout: 5 * time.Second},
-		baseURL: baseURL,
+// NewShortenerClient creates a new HTTP client for the shortening service.
+// Its retries and circuit breaker are configured by opts.
+func NewShortenerClient(baseURL string, opts ...httpclient.Option) (services.ShortenerServiceClient, error) {
+	api, err := shortenerapi.NewClientWithResponses(baseURL,
+		shortenerapi.WithHTTPClient(httpclient.New("url-shortener-service", opts...)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create shortener service client: %w", err)
 	}
+	return &ShortenerClient{api: api}, nil
 }
 
-// shortenRequest mirrors the expected JSON structure of the shortener service.
-type shortenRequest struct {
-	URL string `json:"url"`
+// newShortenRequest returns the shortener service's request body for r.
+func newShortenRequest(r services.ShortenRequest) shortenerapi.ShortenRequest {
+	return shortenerapi.ShortenRequest{
+		Url:                r.URL,
+		Domain:             optional(r.Domain),
+		Owner:              optional(r.Owner),
+		Dedupe:             r.Dedupe,
+		Password:           optional(r.Password),
+		Signed:             optional(r.Signed),
+		SignatureExpiresAt: optionalTime(r.SignatureExpiresAt),
+	}
 }
 
-// shortenResponse mirrors the expected JSON structure of the shortener service.
-type shortenResponse struct {
-	ShortURL string `json:"short_url"`
+// Shorten sends an HTTP POST request to the shortening service, authorized
+// by token. It reports whether the link was created (201) or an existing one
+// returned (200).
+func (c *ShortenerClient) Shorten(ctx context.Context, r services.ShortenRequest, token string) (string, bool, error) {
+	resp, err := c.api.ShortenWithResponse(ctx, newShortenRequest(r), bearer(token))
+	if err != nil {
+		return "", false, fmt.Errorf("failed to send request to shortener service: %w", err)
+	}
+
+	switch {
+	case resp.JSON201 != nil:
+		return resp.JSON201.ShortUrl, true, nil
+	case resp.JSON200 != nil:
+		return resp.JSON200.ShortUrl, false, nil
+	case resp.StatusCode() == http.StatusBadRequest:
+		return "", false, backendError(resp.HTTPResponse, resp.Body, services.ErrInvalidRequest)
+	case resp.StatusCode() == http.StatusForbidden:
+		return "", false, backendError(resp.HTTPResponse, resp.Body, services.ErrURLBlocked)
+	default:
+		return "", false, unexpected(resp.HTTPResponse, resp.Body)
+	}
 }
 
-// Shorten sends an HTTP POST request to the shortening service.
-func (c *HTTPShortenerClient) Shorten(ctx context.Context, originalURL string) (string, error) {
-	requestBody, err := json.Marshal(shortenRequest{URL: originalURL})
+// GetURL sends an HTTP GET request for the stored URL to the shortening
+// service, authorized by token.
+func (c *ShortenerClient) GetURL(ctx context.Context, shortDomain, shortKey, token string) (*domain.URL, error) {
+	resp, err := c.api.GetURLWithResponse(ctx, shortKey, &shortenerapi.GetURLParams{Domain: optional(shortDomain)}, bearer(token))
 	if err != nil {
-		return "", fmt.Errorf("failed to marshal request body: %w", err)
+		return nil, fmt.Errorf("failed to send request to shortener service: %w", err)
 	}
 
-	req, err := http.NewRequestWithContext(ctx, "POST", c.baseURL+"/api/v1/shorten", bytes.NewBuffer(requestBody))
+	switch {
+	case resp.JSON200 != nil:
+		return newURL(resp.JSON200), nil
+	case resp.StatusCode() == http.StatusNotFound:
+		return nil, backendError(resp.HTTPResponse, resp.Body, services.ErrURLNotFound)
+	case resp.StatusCode() == http.StatusForbidden:
+		return nil, backendError(resp.HTTPResponse, resp.Body, services.ErrForbidden)
+	default:
+		return nil, unexpected(resp.HTTPResponse, resp.Body)
+	}
+}
+
+// Delete sends an HTTP DELETE request to the shortening service, authorized
+// by token.
+func (c *ShortenerClient) Delete(ctx context.Context, shortDomain, shortKey, token string) error {
+	resp, err := c.api.DeleteURLWithResponse(ctx, shortKey, &shortenerapi.DeleteURLParams{Domain: optional(shortDomain)}, bearer(token))
 	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
+		return fmt.Errorf("failed to send request to shortener service: %w", err)
+	}
+
+	switch resp.StatusCode() {
+	case http.StatusNoContent:
+		return nil
+	case http.StatusNotFound:
+		return backendError(resp.HTTPResponse, resp.Body, services.ErrURLNotFound)
+	case http.StatusForbidden:
+		return backendError(resp.HTTPResponse, resp.Body, services.ErrForbidden)
+	default:
+		return unexpected(resp.HTTPResponse, resp.Body)
 	}
-	req.Header.Set("Content-Type", "application/json")
+}
 
-	resp, err := c.client.Do(req)
+// SetTrust sends an HTTP PUT request for a link's trust to the shortening
+// service, authorized by token.
+func (c *ShortenerClient) SetTrust(ctx context.Context, r services.TrustRequest, token string) (*domain.URL, error) {
+	resp, err := c.api.SetTrustWithResponse(ctx, r.ShortKey,
+		&shortenerapi.SetTrustParams{Domain: optional(r.Domain)},
+		shortenerapi.TrustRequest{Untrusted: r.Untrusted},
+		bearer(token))
 	if err != nil {
-		return "", fmt.Errorf("failed to send request to shortener service: %w", err)
+		return nil, fmt.Errorf("failed to send request to shortener service: %w", err)
+	}
+
+	switch {
+	case resp.JSON200 != nil:
+		return newURL(resp.JSON200), nil
+	case resp.StatusCode() == http.StatusNotFound:
+		return nil, backendError(resp.HTTPResponse, resp.Body, services.ErrURLNotFound)
+	case resp.StatusCode() == http.StatusForbidden:
+		return nil, backendError(resp.HTTPResponse, resp.Body, services.ErrForbidden)
+	case resp.StatusCode() == http.StatusBadRequest:
+		return nil, backendError(resp.HTTPResponse, resp.Body, services.ErrInvalidRequest)
+	default:
+		return nil, unexpected(resp.HTTPResponse, resp.Body)
 	}
-	defer resp.Body.Close()
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("shortener service returned non-200 status: %d", resp.StatusCode)
+// ShortenBatch sends an HTTP POST request for a batch of links to the
+// shortening service, authorized by token.
+func (c *ShortenerClient) ShortenBatch(ctx context.Context, reqs []services.ShortenRequest, token string) ([]services.BatchResult, error) {
+	body := shortenerapi.BatchRequest{Items: make([]shortenerapi.BatchItem, len(reqs))}
+	for i, r := range reqs {
+		item := newShortenRequest(r)
+		body.Items[i] = shortenerapi.BatchItem{
+			Url:                &item.Url,
+			Domain:             item.Domain,
+			Owner:              item.Owner,
+			Dedupe:             item.Dedupe,
+			Password:           item.Password,
+			Signed:             item.Signed,
+			SignatureExpiresAt: item.SignatureExpiresAt,
+		}
 	}
 
-	var responseBody shortenResponse
-	if err := json.NewDecoder(resp.Body).Decode(&responseBody); err != nil {
-		return "", fmt.Errorf("failed to decode shortener service response: %w", err)
+	resp, err := c.api.ShortenBatchWithResponse(ctx, body, bearer(token))
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request to shortener service: %w", err)
 	}
 
-	return responseBody.ShortURL, nil
+	switch {
+	case resp.JSON200 != nil:
+	case resp.StatusCode() == http.StatusBadRequest:
+		return nil, backendError(resp.HTTPResponse, resp.Body, services.ErrInvalidRequest)
+	case resp.StatusCode() == http.StatusRequestEntityTooLarge:
+		return nil, backendError(resp.HTTPResponse, resp.Body, services.ErrTooLarge)
+	default:
+		return nil, unexpected(resp.HTTPResponse, resp.Body)
+	}
+	if len(resp.JSON200.Results) != len(reqs) {
+		return nil, fmt.Errorf("shortener service returned %d results for %d items", len(resp.JSON200.Results), len(reqs))
+	}
+
+	return newBatchResults(resp.JSON200.Results), nil
+}
+
+// SubmitJob streams a job upload to the shortening service, authorized by
+// token.
+func (c *ShortenerClient) SubmitJob(ctx context.Context, contentType string, body io.Reader, token string) (*services.Job, error) {
+	ctx, cancel := context.WithTimeout(ctx, uploadTimeout)
+	defer cancel()
+
+	resp, err := c.api.SubmitJobWithBodyWithResponse(ctx, contentType, body, bearer(token))
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request to shortener service: %w", err)
+	}
+
+	switch {
+	case resp.JSON202 != nil:
+		return newJob(resp.JSON202), nil
+	case resp.StatusCode() == http.StatusBadRequest, resp.StatusCode() == http.StatusUnsupportedMediaType:
+		// The shortener's problem explains what is wrong with the upload.
+		return nil, backendError(resp.HTTPResponse, resp.Body, services.ErrInvalidRequest)
+	case resp.StatusCode() == http.StatusForbidden:
+		return nil, backendError(resp.HTTPResponse, resp.Body, services.ErrForbidden)
+	case resp.StatusCode() == http.StatusRequestEntityTooLarge:
+		return nil, backendError(resp.HTTPResponse, resp.Body, services.ErrTooLarge)
+	default:
+		return nil, unexpected(resp.HTTPResponse, resp.Body)
+	}
+}
+
+// GetJob sends an HTTP GET request for a job to the shortening service,
+// authorized by token.
+func (c *ShortenerClient) GetJob(ctx context.Context, id, token string) (*services.Job, error) {
+	resp, err := c.api.GetJobWithResponse(ctx, id, bearer(token))
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request to shortener service: %w", err)
+	}
+
+	switch {
+	case resp.JSON200 != nil:
+		return newJob(resp.JSON200), nil
+	case resp.StatusCode() == http.StatusForbidden:
+		return nil, backendError(resp.HTTPResponse, resp.Body, services.ErrForbidden)
+	case resp.StatusCode() == http.StatusNotFound:
+		return nil, backendError(resp.HTTPResponse, resp.Body, services.ErrJobNotFound)
+	default:
+		return nil, unexpected(resp.HTTPResponse, resp.Body)
+	}
+}
+
+// newURL returns the link the shortener service described.
+func newURL(l *shortenerapi.Link) *domain.URL {
+	return &domain.URL{
+		Domain:         l.Domain,
+		ShortKey:       l.ShortKey,
+		LongURL:        l.LongUrl,
+		CanonicalURL:   value(l.CanonicalUrl),
+		Owner:          value(l.Owner),
+		CreatedAt:      l.CreatedAt,
+		ExpiresAt:      value(l.ExpiresAt),
+		Redirects:      l.Redirects,
+		DisabledAt:     value(l.DisabledAt),
+		DisabledReason: value(l.DisabledReason),
+		Untrusted:      value(l.Untrusted),
+		Protected:      value(l.Protected),
+		Signed:         value(l.Signed),
+	}
+}
+
+// newJob returns the job the shortener service described.
+func newJob(j *shortenerapi.Job) *services.Job {
+	job := &services.Job{
+		ID:        j.Id,
+		Status:    string(j.Status),
+		Total:     j.Total,
+		Processed: j.Processed,
+		Failed:    j.Failed,
+		CreatedAt: j.CreatedAt,
+		UpdatedAt: j.UpdatedAt,
+	}
+	if j.Results != nil {
+		job.Results = newBatchResults(*j.Results)
+	}
+	return job
+}
+
+// newBatchResults returns the batch results the shortener service described.
+func newBatchResults(results []shortenerapi.BatchItemResult) []services.BatchResult {
+	out := make([]services.BatchResult, len(results))
+	for i, r := range results {
+		out[i] = services.BatchResult{
+			Index:    r.Index,
+			ShortURL: value(r.ShortUrl),
+			Created:  r.Created,
+			Status:   r.Status,
+			Code:     problem.Code(value(r.Code)),
+			Error:    value(r.Error),
+		}
+	}
+	return out
 }
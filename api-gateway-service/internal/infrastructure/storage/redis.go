@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/iton0/duss/shared/metrics"
+	"github.com/iton0/duss/shared/tracing"
+)
+
+// Ensure RedisClient implicitly implements IdempotencyStore.
+// This is a compile-time check to ensure the contract is fulfilled.
+var _ IdempotencyStore = (*RedisClient)(nil)
+
+// RedisClient is an IdempotencyStore backed by Redis. Records are stored as
+// JSON documents under "idempotency:" plus their key.
+type RedisClient struct {
+	client *redis.Client
+}
+
+// NewRedisClient creates and returns a new RedisClient, or an error if the connection fails.
+// It also accepts a context for handling timeouts and cancellations during initialization.
+func NewRedisClient(ctx context.Context, addr string, password string, db int) (*RedisClient, error) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr:     addr,
+		Password: password,
+		DB:       db,
+	})
+	rdb.AddHook(tracing.RedisHook{})
+	rdb.AddHook(metrics.RedisHook{})
+
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
+	}
+
+	return &RedisClient{client: rdb}, nil
+}
+
+// Reserve implements IdempotencyStore. The reservation is made with SET NX,
+// so only one of several replicas racing for a key wins it.
+func (r *RedisClient) Reserve(ctx context.Context, key string, rec *IdempotencyRecord, lease time.Duration) (*IdempotencyRecord, bool, error) {
+	key = "idempotency:" + key
+	value, err := json.Marshal(rec)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to encode idempotency record: %w", err)
+	}
+
+	for {
+		ok, err := r.client.SetNX(ctx, key, value, lease).Result()
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to reserve idempotency key in Redis: %w", err)
+		}
+		if ok {
+			return rec, true, nil
+		}
+
+		existing, err := r.get(ctx, r.client, key)
+		if errors.Is(err, redis.Nil) {
+			// The record expired between the two calls; try again.
+			continue
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		return existing, false, nil
+	}
+}
+
+// Complete implements IdempotencyStore.
+func (r *RedisClient) Complete(ctx context.Context, key, token string, rec *IdempotencyRecord, ttl time.Duration) error {
+	value, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("failed to encode idempotency record: %w", err)
+	}
+	return r.replace(ctx, "idempotency:"+key, token, func(pipe redis.Pipeliner, key string) {
+		pipe.Set(ctx, key, value, ttl)
+	})
+}
+
+// Release implements IdempotencyStore.
+func (r *RedisClient) Release(ctx context.Context, key, token string) error {
+	return r.replace(ctx, "idempotency:"+key, token, func(pipe redis.Pipeliner, key string) {
+		pipe.Del(ctx, key)
+	})
+}
+
+// replace runs update on key in a transaction if key still holds the
+// reservation made with token.
+func (r *RedisClient) replace(ctx context.Context, key, token string, update func(redis.Pipeliner, string)) error {
+	err := r.client.Watch(ctx, func(tx *redis.Tx) error {
+		rec, err := r.get(ctx, tx, key)
+		if errors.Is(err, redis.Nil) {
+			return ErrNotReserved
+		}
+		if err != nil {
+			return err
+		}
+		if rec.Done || rec.Token != token {
+			return ErrNotReserved
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			update(pipe, key)
+			return nil
+		})
+		return err
+	}, key)
+	if errors.Is(err, redis.TxFailedErr) {
+		return ErrNotReserved
+	}
+	if err != nil && !errors.Is(err, ErrNotReserved) {
+		return fmt.Errorf("failed to update idempotency key in Redis: %w", err)
+	}
+	return err
+}
+
+// get reads and decodes the record under key, returning redis.Nil if there
+// is none.
+func (r *RedisClient) get(ctx context.Context, c redis.Cmdable, key string) (*IdempotencyRecord, error) {
+	value, err := c.Get(ctx, key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read idempotency key from Redis: %w", err)
+	}
+	var rec IdempotencyRecord
+	if err := json.Unmarshal(value, &rec); err != nil {
+		return nil, fmt.Errorf("failed to decode idempotency record: %w", err)
+	}
+	return &rec, nil
+}
+
+// Ping checks that Redis is reachable.
+func (r *RedisClient) Ping(ctx context.Context) error {
+	return r.client.Ping(ctx).Err()
+}
+
+// Close closes the underlying Redis connection pool.
+func (r *RedisClient) Close() error {
+	return r.client.Close()
+}
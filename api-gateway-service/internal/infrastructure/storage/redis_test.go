@@ -0,0 +1,77 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/iton0/duss/api-gateway-service/internal/infrastructure/storage"
+	"github.com/iton0/duss/shared/testutil/redistest"
+)
+
+func setupTest(t *testing.T) *storage.RedisClient {
+	client, err := storage.NewRedisClient(context.Background(), redistest.Addr(t), "", 0)
+	if err != nil {
+		t.Fatalf("setup failed: could not create Redis client: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestNewRedisClient(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if _, err := storage.NewRedisClient(ctx, "localhost:1", "", 0); err == nil {
+		t.Error("expected an error for an unreachable server, but got nil")
+	}
+}
+
+func TestIdempotency(t *testing.T) {
+	ctx := context.Background()
+	client := setupTest(t)
+
+	first := &storage.IdempotencyRecord{Fingerprint: "f1", Token: "t1"}
+	rec, reserved, err := client.Reserve(ctx, "k", first, time.Minute)
+	if err != nil || !reserved || rec != first {
+		t.Fatalf("expected the key to be reserved, but got %v, %v", reserved, err)
+	}
+
+	rec, reserved, err = client.Reserve(ctx, "k", &storage.IdempotencyRecord{Fingerprint: "f2", Token: "t2"}, time.Minute)
+	if err != nil || reserved {
+		t.Fatalf("expected the key to be taken, but got %v, %v", reserved, err)
+	}
+	if rec.Fingerprint != "f1" || rec.Done {
+		t.Errorf("expected the first reservation, but got %+v", rec)
+	}
+
+	done := &storage.IdempotencyRecord{Fingerprint: "f1", Done: true, Status: 201, Body: []byte(`{"short_url":"x"}`)}
+	if err := client.Complete(ctx, "k", "t2", done, time.Hour); !errors.Is(err, storage.ErrNotReserved) {
+		t.Errorf("expected ErrNotReserved for another token, but got %v", err)
+	}
+	if err := client.Complete(ctx, "k", "t1", done, time.Hour); err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	if err := client.Release(ctx, "k", "t1"); !errors.Is(err, storage.ErrNotReserved) {
+		t.Errorf("expected ErrNotReserved for a completed key, but got %v", err)
+	}
+
+	rec, reserved, err = client.Reserve(ctx, "k", &storage.IdempotencyRecord{Fingerprint: "f1", Token: "t3"}, time.Minute)
+	if err != nil || reserved {
+		t.Fatalf("expected the key to be taken, but got %v, %v", reserved, err)
+	}
+	if !rec.Done || rec.Status != 201 || string(rec.Body) != `{"short_url":"x"}` {
+		t.Errorf("expected the recorded response, but got %+v", rec)
+	}
+
+	if _, _, err := client.Reserve(ctx, "r", &storage.IdempotencyRecord{Token: "t1"}, time.Minute); err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	if err := client.Release(ctx, "r", "t1"); err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	if _, reserved, err := client.Reserve(ctx, "r", &storage.IdempotencyRecord{Token: "t2"}, time.Minute); err != nil || !reserved {
+		t.Errorf("expected a released key to be reserved again, but got %v, %v", reserved, err)
+	}
+}
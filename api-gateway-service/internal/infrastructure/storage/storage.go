@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// ErrNotReserved is returned when completing or releasing a reservation that
+// is no longer held, because it expired or was taken over.
+var ErrNotReserved = errors.New("idempotency key not reserved")
+
+// IdempotencyRecord is what is remembered about a request sent with an
+// Idempotency-Key: a fingerprint of the request and, once it has been
+// answered, the response to replay.
+type IdempotencyRecord struct {
+	// Fingerprint identifies the request the key was first used with.
+	Fingerprint string `json:"fingerprint"`
+	// Token identifies the reservation of a request still in progress.
+	Token string `json:"token,omitempty"`
+	// Done reports whether the response below has been recorded.
+	Done   bool        `json:"done"`
+	Status int         `json:"status,omitempty"`
+	Header http.Header `json:"header,omitempty"`
+	Body   []byte      `json:"body,omitempty"`
+}
+
+// IdempotencyStore remembers the requests sent with an Idempotency-Key and
+// their responses. It must be shared by every gateway replica.
+type IdempotencyStore interface {
+	// Reserve claims key for a request described by rec for lease. When the
+	// key is already claimed it returns the record stored under it and
+	// false instead.
+	Reserve(ctx context.Context, key string, rec *IdempotencyRecord, lease time.Duration) (*IdempotencyRecord, bool, error)
+	// Complete replaces the reservation of key made with token by rec,
+	// which is kept for ttl.
+	Complete(ctx context.Context, key, token string, rec *IdempotencyRecord, ttl time.Duration) error
+	// Release drops the reservation of key made with token, so the request
+	// may be retried.
+	Release(ctx context.Context, key, token string) error
+}
@@ -4,15 +4,78 @@ import (
 	"github.com/gin-gonic/gin"
 
 	"github.com/iton0/duss/api-gateway-service/internal/api"
+	"github.com/iton0/duss/api-gateway-service/internal/spec"
+	"github.com/iton0/duss/shared/health"
+	"github.com/iton0/duss/shared/logging"
+	"github.com/iton0/duss/shared/metrics"
+	"github.com/iton0/duss/shared/openapi"
+	"github.com/iton0/duss/shared/problem"
+	"github.com/iton0/duss/shared/tracing"
 )
 
+// RouterOption configures optional features of the router.
+type RouterOption func(*routerConfig)
+
+type routerConfig struct {
+	idempotency *api.Idempotency
+	health      *health.Checker
+}
+
+// WithIdempotency honours Idempotency-Key headers on the shortening routes.
+func WithIdempotency(m *api.Idempotency) RouterOption {
+	return func(c *routerConfig) {
+		c.idempotency = m
+	}
+}
+
+// WithHealth serves the gateway's liveness and readiness, and the status of
+// the services behind it, from checker.
+func WithHealth(checker *health.Checker) RouterOption {
+	return func(c *routerConfig) {
+		c.health = checker
+	}
+}
+
 // NewRouter creates a new Gin router and registers all gateway routes.
-func NewRouter(gatewayHandler *api.GatewayHandler) *gin.Engine {
-	router := gin.Default()
+func NewRouter(gatewayHandler *api.GatewayHandler, opts ...RouterOption) *gin.Engine {
+	var cfg routerConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	router := gin.New()
+	// Every request gets an ID, forwarded to the backends it calls; only a
+	// sample of redirects, the hot path, is logged.
+	router.Use(logging.Middleware(logging.SampleRoutes("/:shortKey")), problem.Recovery())
+	router.Use(tracing.Middleware(), metrics.Middleware())
+	// Requests must match the public API's description; responses that do
+	// not are logged.
+	router.Use(spec.Load().Middleware(openapi.WithResponseValidation()))
+	router.NoRoute(problem.NoRoute)
+	router.GET("/metrics", gin.WrapH(metrics.Handler()))
+
+	if cfg.health != nil {
+		router.GET("/healthz", gin.WrapH(cfg.health.LiveHandler()))
+		router.GET("/readyz", gin.WrapH(cfg.health.ReadyHandler()))
+		router.GET("/status", gin.WrapH(cfg.health.SystemHandler()))
+	}
+
+	// Shortening may be retried safely when idempotency keys are enabled.
+	shorten := router.Group("/shorten")
+	if cfg.idempotency != nil {
+		shorten.Use(cfg.idempotency.Handle)
+	}
 
 	// Public API endpoints
-	router.POST("/shorten", gatewayHandler.HandleShorten)
+	shorten.POST("", gatewayHandler.HandleShorten)
+	shorten.POST("/batch", gatewayHandler.HandleShortenBatch)
+	router.POST("/shorten/jobs", gatewayHandler.HandleSubmitJob)
+	router.GET("/shorten/jobs/:id", gatewayHandler.HandleGetJob)
 	router.GET("/:shortKey", gatewayHandler.HandleRedirect)
+	router.POST("/:shortKey", gatewayHandler.HandleUnlock)
+	router.DELETE("/:shortKey", gatewayHandler.HandleDelete)
+	router.GET("/stats/:shortKey", gatewayHandler.HandleStats)
+	router.PUT("/trust/:shortKey", gatewayHandler.HandleSetTrust)
 
 	return router
 }
@@ -1 +1,429 @@
 package web_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/iton0/duss/api-gateway-service/app"
+	"github.com/iton0/duss/api-gateway-service/internal/spec"
+	"github.com/iton0/duss/shared/domain"
+	"github.com/iton0/duss/shared/health"
+	"github.com/iton0/duss/shared/problem"
+	"github.com/iton0/duss/shared/testutil/openapitest"
+	"github.com/iton0/duss/shared/testutil/redistest"
+)
+
+// newBackends starts fake shortener and redirect services that know about a
+// single short link, "abc" on the "duss.io" domain, and allow "go.duss.io" as
+// a second domain. The owner "team-a" has the token "a-token" and the admin
+// token is "s3cret"; only an administrator may shorten for another owner.
+// Shortening for "team-a" reports an existing link, shortening
+// "https://evil.example" is refused by policy, and so is redirecting
+// "banned". The link "flagged" is untrusted, and only its owner "team-a" or
+// an administrator may change its trust. The link "locked" has the password
+// "hunter2". Job uploads are CSV with a single url column, and the only job
+// is "job1". Links are only read and deleted with the admin token.
+func newBackends(t *testing.T) (shortenerURL, redirectURL string) {
+	t.Helper()
+
+	owners := map[string]string{"Bearer a-token": "team-a"}
+	shortener := http.NewServeMux()
+	shortener.HandleFunc("POST /api/v1/shorten", func(w http.ResponseWriter, r *http.Request) {
+		var req struct{ URL, Domain, Owner, Password string }
+		json.NewDecoder(r.Body).Decode(&req)
+		owner := owners[r.Header.Get("Authorization")]
+		if req.Owner != "" && req.Owner != owner && r.Header.Get("Authorization") != "Bearer s3cret" {
+			problem.Write(w, r, problem.New(http.StatusForbidden, problem.CodeForbidden, "not allowed to create links for this owner"))
+			return
+		}
+		if req.Owner != "" {
+			owner = req.Owner
+		}
+		if len(req.Password) > 72 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if req.Domain != "" && req.Domain != "go.duss.io" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if req.URL == "https://evil.example" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if owner == "team-a" {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusCreated)
+		}
+		json.NewEncoder(w).Encode(map[string]string{"short_url": "http://localhost:8081/abc"})
+	})
+	shortener.HandleFunc("POST /api/v1/shorten/batch", func(w http.ResponseWriter, r *http.Request) {
+		var req struct{ Items []struct{ URL string } }
+		json.NewDecoder(r.Body).Decode(&req)
+		results := make([]map[string]any, len(req.Items))
+		for i := range req.Items {
+			results[i] = map[string]any{"index": i, "short_url": "http://localhost:8081/abc", "created": true, "status": http.StatusCreated}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"results": results})
+	})
+	shortener.HandleFunc("POST /api/v1/shorten/jobs", func(w http.ResponseWriter, r *http.Request) {
+		upload, _ := io.ReadAll(r.Body)
+		if r.Header.Get("Content-Type") != "text/csv" || !strings.HasPrefix(string(upload), "url\n") {
+			problem.Write(w, r, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request: unknown CSV column"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]any{"id": "job1", "status": "running", "total": strings.Count(string(upload), "\n") - 1})
+	})
+	shortener.HandleFunc("GET /api/v1/shorten/jobs/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("id") != "job1" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"id": "job1", "status": "done", "total": 1, "processed": 1})
+	})
+	shortener.HandleFunc("GET /api/v1/urls/{key}", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer s3cret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if !known(r.URL.Query().Get("domain"), r.PathValue("key")) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(domain.URL{ShortKey: "abc", LongURL: "https://example.com", Redirects: 4})
+	})
+	shortener.HandleFunc("PUT /api/v1/urls/{key}/trust", func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("key") != "flagged" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if owners[r.Header.Get("Authorization")] != "team-a" && r.Header.Get("Authorization") != "Bearer s3cret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(domain.URL{ShortKey: "flagged", LongURL: "https://files.example/", Untrusted: true})
+	})
+	shortener.HandleFunc("DELETE /api/v1/urls/{key}", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer s3cret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if !known(r.URL.Query().Get("domain"), r.PathValue("key")) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	redirect := http.NewServeMux()
+	redirect.HandleFunc("GET /api/v1/redirect", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("key") == "banned" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.URL.Query().Get("key") == "abc.k1.mq1zc0.sum" {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		if r.URL.Query().Get("key") == "locked" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]any{"original_url": "", "protected": true})
+			return
+		}
+		if r.URL.Query().Get("key") == "flagged" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]any{"original_url": "https://files.example/", "untrusted": true})
+			return
+		}
+		if !known(r.URL.Query().Get("domain"), r.URL.Query().Get("key")) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"original_url": "https://example.com"})
+	})
+	redirect.HandleFunc("POST /api/v1/redirect", func(w http.ResponseWriter, r *http.Request) {
+		if !known(r.URL.Query().Get("domain"), r.URL.Query().Get("key")) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	redirect.HandleFunc("GET /{key}", func(w http.ResponseWriter, r *http.Request) {
+		// The interstitial is reached through the gateway's proxy with the
+		// visitor's Host.
+		switch {
+		case r.Host != "duss.io":
+			w.WriteHeader(http.StatusNotFound)
+		case r.PathValue("key") == "flagged":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte("<p>https://files.example/</p>"))
+		case r.PathValue("key") == "locked":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte(`<form method="post" action="/locked">`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	redirect.HandleFunc("POST /{key}", func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("key") != "locked" || r.Host != "duss.io" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.PostFormValue("password") != "hunter2" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		http.Redirect(w, r, "/locked", http.StatusSeeOther)
+	})
+
+	shortener.Handle("GET /readyz", health.New("url-shortener-service").ReadyHandler())
+	redirect.Handle("GET /readyz", health.New("url-redirect-service").ReadyHandler())
+
+	shortenerServer := httptest.NewServer(shortener)
+	t.Cleanup(shortenerServer.Close)
+	redirectServer := httptest.NewServer(redirect)
+	t.Cleanup(redirectServer.Close)
+
+	return shortenerServer.URL, redirectServer.URL
+}
+
+// known reports whether the fake backends store the link shortDomain/shortKey.
+func known(shortDomain, shortKey string) bool {
+	return shortDomain == "duss.io" && shortKey == "abc"
+}
+
+// recorder is an httptest.ResponseRecorder that is also an
+// http.CloseNotifier, which gin's writer requires of the ResponseWriter it
+// wraps once the reverse proxy to the redirect service asks for it.
+type recorder struct {
+	*httptest.ResponseRecorder
+}
+
+func (recorder) CloseNotify() <-chan bool {
+	return make(chan bool)
+}
+
+// newRouter builds the gateway described by cfg, closing it when the test
+// finishes.
+func newRouter(t *testing.T, cfg app.Config) *gin.Engine {
+	t.Helper()
+
+	application, err := app.New(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("failed to build gateway: %v", err)
+	}
+	t.Cleanup(func() { application.Close() })
+	return application.Router
+}
+
+func TestRouter(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	shortenerURL, redirectURL := newBackends(t)
+	router := newRouter(t, app.Config{
+		ShortenerServiceURLs: []string{shortenerURL},
+		RedirectServiceURLs:  []string{redirectURL},
+		RedisAddr:            redistest.Addr(t),
+	})
+
+	testCases := []struct {
+		name               string
+		method             string
+		path               string
+		body               string
+		token              string
+		expectedStatusCode int
+	}{
+		{"Shorten", http.MethodPost, "/shorten", `{"url":"https://example.com"}`, "", http.StatusCreated},
+		{"Shorten Existing", http.MethodPost, "/shorten", `{"url":"https://example.com"}`, "a-token", http.StatusOK},
+		{"Shorten For Owner", http.MethodPost, "/shorten", `{"url":"https://example.com","owner":"team-a"}`, "s3cret", http.StatusOK},
+		{"Shorten For Foreign Owner", http.MethodPost, "/shorten", `{"url":"https://example.com","owner":"team-a"}`, "", http.StatusForbidden},
+		{"Shorten On Domain", http.MethodPost, "/shorten", `{"url":"https://example.com","domain":"go.duss.io"}`, "", http.StatusCreated},
+		{"Shorten Domain Not Allowed", http.MethodPost, "/shorten", `{"url":"https://example.com","domain":"evil.example"}`, "", http.StatusBadRequest},
+		{"Shorten Blocked URL", http.MethodPost, "/shorten", `{"url":"https://evil.example"}`, "", http.StatusForbidden},
+		{"Shorten With Password", http.MethodPost, "/shorten", `{"url":"https://example.com","password":"hunter2"}`, "", http.StatusCreated},
+		{"Shorten Invalid URL", http.MethodPost, "/shorten", `{"url":"nope"}`, "", http.StatusBadRequest},
+		{"Shorten Batch", http.MethodPost, "/shorten/batch", `{"items":[{"url":"https://example.com"},{"url":"nope"}]}`, "", http.StatusOK},
+		{"Submit Job", http.MethodPost, "/shorten/jobs", "url\nhttps://example.com\n", "", http.StatusAccepted},
+		{"Submit Invalid Job", http.MethodPost, "/shorten/jobs", "url,colour\nhttps://example.com,red\n", "", http.StatusBadRequest},
+		{"Job", http.MethodGet, "/shorten/jobs/job1", "", "", http.StatusOK},
+		{"Job Not Found", http.MethodGet, "/shorten/jobs/missing", "", "", http.StatusNotFound},
+		{"Redirect", http.MethodGet, "/abc", "", "", http.StatusFound},
+		{"Redirect Blocked", http.MethodGet, "/banned", "", "", http.StatusForbidden},
+		{"Redirect Not Found", http.MethodGet, "/missing", "", "", http.StatusNotFound},
+		{"Redirect Signature Expired", http.MethodGet, "/abc.k1.mq1zc0.sum", "", "", http.StatusGone},
+		{"Redirect Untrusted", http.MethodGet, "/flagged", "", "", http.StatusOK},
+		{"Redirect Protected", http.MethodGet, "/locked", "", "", http.StatusOK},
+		{"Unlock", http.MethodPost, "/locked", "password=hunter2", "", http.StatusSeeOther},
+		{"Unlock Wrong Password", http.MethodPost, "/locked", "password=guess", "", http.StatusUnauthorized},
+		{"Trust By Owner", http.MethodPut, "/trust/flagged", `{"untrusted":true}`, "a-token", http.StatusOK},
+		{"Trust By Admin", http.MethodPut, "/trust/flagged", `{"untrusted":false}`, "s3cret", http.StatusOK},
+		{"Trust By Other", http.MethodPut, "/trust/flagged", `{"untrusted":false}`, "guess", http.StatusForbidden},
+		{"Trust Without Token", http.MethodPut, "/trust/flagged", `{"untrusted":false}`, "", http.StatusUnauthorized},
+		{"Trust Not Found", http.MethodPut, "/trust/missing", `{"untrusted":true}`, "a-token", http.StatusNotFound},
+		{"Stats", http.MethodGet, "/stats/abc", "", "s3cret", http.StatusOK},
+		{"Stats On Other Domain", http.MethodGet, "/stats/abc?domain=go.duss.io", "", "s3cret", http.StatusNotFound},
+		{"Stats Not Found", http.MethodGet, "/stats/missing", "", "s3cret", http.StatusNotFound},
+		{"Delete", http.MethodDelete, "/abc", "", "s3cret", http.StatusNoContent},
+		{"Delete Not Found", http.MethodDelete, "/missing", "", "s3cret", http.StatusNotFound},
+		{"Stats Without Token", http.MethodGet, "/stats/abc", "", "", http.StatusUnauthorized},
+		{"Delete With Wrong Token", http.MethodDelete, "/abc", "", "guess", http.StatusForbidden},
+		{"Liveness", http.MethodGet, "/healthz", "", "", http.StatusOK},
+		{"Readiness", http.MethodGet, "/readyz", "", "", http.StatusOK},
+		{"System Status", http.MethodGet, "/status", "", "", http.StatusOK},
+		{"Metrics", http.MethodGet, "/metrics", "", "", http.StatusOK},
+		{"No Route", http.MethodGet, "/a/b/c", "", "", http.StatusNotFound},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := recorder{httptest.NewRecorder()}
+			req, _ := http.NewRequest(tc.method, tc.path, bytes.NewBufferString(tc.body))
+			req.Host = "duss.io"
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			if strings.HasPrefix(tc.body, "{") {
+				req.Header.Set("Content-Type", "application/json")
+			} else if strings.HasPrefix(tc.body, "url") {
+				req.Header.Set("Content-Type", "text/csv")
+			} else if tc.body != "" {
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+
+			router.ServeHTTP(w, req)
+
+			if w.Code != tc.expectedStatusCode {
+				t.Errorf("expected status code %d, but got %d: %s", tc.expectedStatusCode, w.Code, w.Body.String())
+			}
+			openapitest.CheckResponse(t, spec.Load(), req, w.ResponseRecorder)
+		})
+	}
+}
+
+func TestRouterMatchesSpec(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	shortenerURL, redirectURL := newBackends(t)
+	router := newRouter(t, app.Config{
+		ShortenerServiceURLs: []string{shortenerURL},
+		RedirectServiceURLs:  []string{redirectURL},
+	})
+
+	openapitest.CheckRoutes(t, spec.Load(), router.Routes())
+}
+
+func TestRouterReadiness(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	// A redirect service that is up but not ready keeps the gateway from
+	// being ready, but not from being alive.
+	shortenerURL, _ := newBackends(t)
+	redirect := health.New("url-redirect-service")
+	redirect.Register("redis", func(context.Context) error { return errors.New("connection refused") })
+	redirectServer := httptest.NewServer(redirect.ReadyHandler())
+	t.Cleanup(redirectServer.Close)
+	router := newRouter(t, app.Config{
+		ShortenerServiceURLs: []string{shortenerURL},
+		RedirectServiceURLs:  []string{redirectServer.URL},
+	})
+
+	testCases := []struct {
+		name               string
+		path               string
+		expectedStatusCode int
+	}{
+		{"Liveness", "/healthz", http.StatusOK},
+		{"Readiness", "/readyz", http.StatusServiceUnavailable},
+		{"System Status", "/status", http.StatusServiceUnavailable},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := recorder{httptest.NewRecorder()}
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			router.ServeHTTP(w, req)
+
+			if w.Code != tc.expectedStatusCode {
+				t.Errorf("expected status code %d, but got %d: %s", tc.expectedStatusCode, w.Code, w.Body.String())
+			}
+			openapitest.CheckResponse(t, spec.Load(), req, w.ResponseRecorder)
+		})
+	}
+
+	w := recorder{httptest.NewRecorder()}
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/status", nil))
+	var system health.System
+	if err := json.Unmarshal(w.Body.Bytes(), &system); err != nil {
+		t.Fatalf("failed to decode status: %v", err)
+	}
+	if system.Services["url-shortener-service"].Status != health.StatusUp || system.Services["url-redirect-service"].Status != health.StatusDown {
+		t.Errorf("expected the shortener up and the redirect service down, but got %+v", system.Services)
+	}
+}
+
+func TestRouterIdempotency(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	// Two replicas sharing one Redis must answer retries alike.
+	shortenerURL, redirectURL := newBackends(t)
+	cfg := app.Config{
+		ShortenerServiceURLs: []string{shortenerURL},
+		RedirectServiceURLs:  []string{redirectURL},
+		RedisAddr:            redistest.Addr(t),
+	}
+	replicas := []*gin.Engine{newRouter(t, cfg), newRouter(t, cfg)}
+
+	testCases := []struct {
+		name               string
+		replica            int
+		key                string
+		body               string
+		expectedStatusCode int
+		expectedReplayed   bool
+	}{
+		{"First Request", 0, "k1", `{"url":"https://example.com"}`, http.StatusCreated, false},
+		{"Retry On Other Replica", 1, "k1", `{"url":"https://example.com"}`, http.StatusCreated, true},
+		{"Retry With Other Body", 0, "k1", `{"url":"https://example.org"}`, http.StatusUnprocessableEntity, false},
+		{"Other Key", 1, "k2", `{"url":"https://example.com"}`, http.StatusCreated, false},
+		{"Rejected Request", 0, "k3", `{"url":"https://evil.example"}`, http.StatusForbidden, false},
+		{"Rejected Request Retried", 1, "k3", `{"url":"https://evil.example"}`, http.StatusForbidden, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := recorder{httptest.NewRecorder()}
+			req, _ := http.NewRequest(http.MethodPost, "/shorten", bytes.NewBufferString(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Idempotency-Key", tc.key)
+
+			replicas[tc.replica].ServeHTTP(w, req)
+
+			if w.Code != tc.expectedStatusCode {
+				t.Errorf("expected status code %d, but got %d: %s", tc.expectedStatusCode, w.Code, w.Body.String())
+			}
+			if replayed := w.Header().Get("Idempotent-Replayed") == "true"; replayed != tc.expectedReplayed {
+				t.Errorf("expected replayed=%v, but got %v", tc.expectedReplayed, replayed)
+			}
+		})
+	}
+}
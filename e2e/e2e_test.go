@@ -0,0 +1,1092 @@
+// Package e2e exercises duss through its public edge. Every service is built
+// from its app package and served with httptest against hermetic Redis and
+// PostgreSQL stand-ins, so the suite needs no running infrastructure. Set
+// REDIS_ADDR or POSTGRES_DSN to run it against real servers instead.
+package e2e
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"html"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	gateway "github.com/iton0/duss/api-gateway-service/app"
+	keygen "github.com/iton0/duss/key-gen-service/app"
+	"github.com/iton0/duss/shared/domain"
+	"github.com/iton0/duss/shared/linksig"
+	"github.com/iton0/duss/shared/logging"
+	"github.com/iton0/duss/shared/policy"
+	"github.com/iton0/duss/shared/problem"
+	"github.com/iton0/duss/shared/ssrf"
+	"github.com/iton0/duss/shared/testutil/pgtest"
+	"github.com/iton0/duss/shared/testutil/redistest"
+	"github.com/iton0/duss/shared/tracing"
+	redirect "github.com/iton0/duss/url-redirect-service/app"
+	shortener "github.com/iton0/duss/url-shortener-service/app"
+)
+
+const (
+	// brandedDomain is the extra short domain the stack's shortener allows.
+	brandedDomain = "go.duss.test"
+	// bannedDomain is denied by the stack's initial URL policy.
+	bannedDomain = "banned.example"
+	// malwareHost is listed in the stack's initial threat feed.
+	malwareHost = "malware.example"
+	// adminToken is the bearer token of the stack's admin APIs.
+	adminToken = "e2e-admin-token"
+	// teamAToken and teamBToken are the bearer tokens of the owners "team-a"
+	// and "team-b".
+	teamAToken = "e2e-team-a-token"
+	teamBToken = "e2e-team-b-token"
+)
+
+// stack is a running set of duss services.
+type stack struct {
+	// Gateway is the base URL of the public API gateway.
+	Gateway string
+	// Shortener is the base URL of the url-shortener-service, which serves
+	// the policy admin API.
+	Shortener string
+	// ThreatFeed is the threat-feed file the shortener screens links with.
+	ThreatFeed string
+	// LinkSigning holds the keys the stack signs links with.
+	LinkSigning *linksig.Keyring
+	client      *http.Client
+	shortener   *shortener.App
+}
+
+// openPolicy writes the stack's initial rules to a file and returns an engine
+// watching it. The shortener and redirect services each get their own engine
+// on the same file, as they would in a deployment.
+func openPolicy(t *testing.T, path string) *policy.Engine {
+	t.Helper()
+
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if err := os.WriteFile(path, []byte("deny_domains: ["+bannedDomain+"]\n"), 0o600); err != nil {
+			t.Fatalf("failed to write policy file: %v", err)
+		}
+	}
+	engine, err := policy.Open(path)
+	if err != nil {
+		t.Fatalf("failed to load policy: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go engine.Watch(ctx, 10*time.Millisecond)
+	return engine
+}
+
+// newStack boots key-gen, shortener, redirect and the gateway, wired to each
+// other the same way cmd/server wires them, and tears them down when the
+// test finishes.
+func newStack(t *testing.T) *stack {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	db := pgtest.New(t, "")
+	redisAddr := redistest.Addr(t)
+	policyFile := filepath.Join(t.TempDir(), "policy.yaml")
+	threatFeed := filepath.Join(t.TempDir(), "hosts.txt")
+	if err := os.WriteFile(threatFeed, []byte("0.0.0.0 "+malwareHost+"\n"), 0o600); err != nil {
+		t.Fatalf("failed to write threat feed: %v", err)
+	}
+
+	linkSigning, err := linksig.Config{Keys: []string{"e2e:e2e-link-signing-secret"}}.Keyring()
+	if err != nil {
+		t.Fatalf("failed to build link signing keys: %v", err)
+	}
+
+	keygenServer := httptest.NewServer(keygen.New().Router)
+	t.Cleanup(keygenServer.Close)
+
+	// The gateway's address is needed before the shortener is built, since
+	// short URLs point at it, so its listener is opened first.
+	gatewayServer := httptest.NewUnstartedServer(nil)
+	t.Cleanup(gatewayServer.Close)
+	gatewayURL := "http://" + gatewayServer.Listener.Addr().String()
+
+	shortenerApp, err := shortener.New(ctx, shortener.Config{
+		DB:               db,
+		RedisAddr:        redisAddr,
+		KeyGenServiceURL: keygenServer.URL,
+		BaseURL:          gatewayURL,
+		Domains:          []string{brandedDomain},
+		Policy:           openPolicy(t, policyFile),
+		Destinations:     ssrf.New(ssrf.WithResolver(nil)), // Hermetic: only literal addresses are checked
+		AdminToken:       adminToken,
+		OwnerTokens:      map[string]string{teamAToken: "team-a", teamBToken: "team-b"},
+		ThreatFeeds:      []string{threatFeed},
+		LinkSigning:      linkSigning,
+	})
+	if err != nil {
+		t.Fatalf("failed to build url-shortener-service: %v", err)
+	}
+	t.Cleanup(func() { shortenerApp.Close() })
+	shortenerServer := httptest.NewServer(shortenerApp.Router)
+	t.Cleanup(shortenerServer.Close)
+
+	redirectApp, err := redirect.New(ctx, redirect.Config{
+		DB:         db,
+		RedisAddr:  redisAddr,
+		Policy:     openPolicy(t, policyFile),
+		AdminToken: adminToken,
+
+		PasswordMaxAttempts:   3,
+		PasswordAttemptWindow: time.Minute,
+		LinkSigning:           linkSigning,
+	})
+	if err != nil {
+		t.Fatalf("failed to build url-redirect-service: %v", err)
+	}
+	t.Cleanup(func() { redirectApp.Close() })
+	// Two redirect replicas, between which the gateway balances and hedges.
+	redirectServer := httptest.NewServer(redirectApp.Router)
+	t.Cleanup(redirectServer.Close)
+	redirectReplica := httptest.NewServer(redirectApp.Router)
+	t.Cleanup(redirectReplica.Close)
+
+	gatewayApp, err := gateway.New(ctx, gateway.Config{
+		ShortenerServiceURLs:    []string{shortenerServer.URL},
+		RedirectServiceURLs:     []string{redirectServer.URL, redirectReplica.URL},
+		RedirectHedgePercentile: 95,
+		RedisAddr:               redisAddr,
+	})
+	if err != nil {
+		t.Fatalf("failed to build api-gateway-service: %v", err)
+	}
+	t.Cleanup(func() { gatewayApp.Close() })
+	gatewayServer.Config.Handler = gatewayApp.Router
+	gatewayServer.Start()
+
+	return &stack{
+		Gateway:     gatewayServer.URL,
+		Shortener:   shortenerServer.URL,
+		ThreatFeed:  threatFeed,
+		LinkSigning: linkSigning,
+		shortener:   shortenerApp,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+			// Redirects are asserted on, not followed.
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// do sends a request to the gateway and returns the response with its body
+// read into memory.
+func (s *stack) do(t *testing.T, method, path, body string) (*http.Response, []byte) {
+	t.Helper()
+	return s.doHost(t, "", method, path, body)
+}
+
+// doAdmin is like do but authenticates the request with the admin token.
+func (s *stack) doAdmin(t *testing.T, method, path, body string) (*http.Response, []byte) {
+	t.Helper()
+	return s.send(t, "", adminToken, method, path, body)
+}
+
+// doHost is like do but sends the request with the given Host header, the
+// way a browser following a link on a branded short domain would.
+func (s *stack) doHost(t *testing.T, host, method, path, body string) (*http.Response, []byte) {
+	t.Helper()
+	return s.send(t, host, "", method, path, body)
+}
+
+// send sends a request to the gateway with the given Host header and bearer
+// token, either of which may be empty.
+func (s *stack) send(t *testing.T, host, token, method, path, body string) (*http.Response, []byte) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, s.Gateway+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed to build request: %v", err)
+	}
+	if host != "" {
+		req.Host = host
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(resp.Body); err != nil {
+		t.Fatalf("%s %s: failed to read body: %v", method, path, err)
+	}
+	return resp, buf.Bytes()
+}
+
+// expectStatus fails the test if resp does not carry the wanted status code.
+func expectStatus(t *testing.T, resp *http.Response, body []byte, want int) {
+	t.Helper()
+	if resp.StatusCode != want {
+		t.Fatalf("%s %s: expected status code %d, but got %d: %s",
+			resp.Request.Method, resp.Request.URL.Path, want, resp.StatusCode, body)
+	}
+}
+
+// shorten shortens longURL through the gateway and returns the short key.
+func (s *stack) shorten(t *testing.T, longURL string) string {
+	t.Helper()
+
+	resp, body := s.do(t, http.MethodPost, "/shorten", `{"url":"`+longURL+`"}`)
+	expectStatus(t, resp, body, http.StatusCreated)
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Errorf("expected a JSON response, but got Content-Type %q", ct)
+	}
+
+	var got struct {
+		ShortURL string `json:"short_url"`
+	}
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatalf("failed to decode shorten response: %v", err)
+	}
+	if !strings.HasPrefix(got.ShortURL, s.Gateway+"/") {
+		t.Fatalf("expected a short URL under %s, but got %q", s.Gateway, got.ShortURL)
+	}
+	return strings.TrimPrefix(got.ShortURL, s.Gateway+"/")
+}
+
+func TestShortenRedirectStatsDelete(t *testing.T) {
+	s := newStack(t)
+	const longURL = "https://example.com/some/long/path?q=1"
+
+	shortKey := s.shorten(t, longURL)
+
+	// The first redirect is served from PostgreSQL and warms the cache; the
+	// second is served from Redis. Both must count.
+	for range 2 {
+		resp, body := s.do(t, http.MethodGet, "/"+shortKey, "")
+		expectStatus(t, resp, body, http.StatusFound)
+		if location := resp.Header.Get("Location"); location != longURL {
+			t.Errorf("expected Location %q, but got %q", longURL, location)
+		}
+	}
+
+	resp, body := s.doAdmin(t, http.MethodGet, "/stats/"+shortKey, "")
+	expectStatus(t, resp, body, http.StatusOK)
+	var stats domain.URL
+	if err := json.Unmarshal(body, &stats); err != nil {
+		t.Fatalf("failed to decode stats response: %v", err)
+	}
+	if stats.ShortKey != shortKey {
+		t.Errorf("expected short key %q, but got %q", shortKey, stats.ShortKey)
+	}
+	if stats.LongURL != longURL {
+		t.Errorf("expected long URL %q, but got %q", longURL, stats.LongURL)
+	}
+	if stats.CanonicalURL != longURL {
+		t.Errorf("expected canonical URL %q, but got %q", longURL, stats.CanonicalURL)
+	}
+	if stats.Redirects != 2 {
+		t.Errorf("expected 2 redirects, but got %d", stats.Redirects)
+	}
+
+	// Only an administrator may read the stats or delete the link.
+	resp, body = s.do(t, http.MethodGet, "/stats/"+shortKey, "")
+	expectStatus(t, resp, body, http.StatusUnauthorized)
+	resp, body = s.send(t, "", "guess", http.MethodDelete, "/"+shortKey, "")
+	expectStatus(t, resp, body, http.StatusForbidden)
+
+	resp, body = s.doAdmin(t, http.MethodDelete, "/"+shortKey, "")
+	expectStatus(t, resp, body, http.StatusNoContent)
+
+	// The deleted link must be gone from both the database and the cache.
+	resp, body = s.do(t, http.MethodGet, "/"+shortKey, "")
+	expectStatus(t, resp, body, http.StatusNotFound)
+	if location := resp.Header.Get("Location"); location != "" {
+		t.Errorf("expected no Location header, but got %q", location)
+	}
+
+	resp, body = s.doAdmin(t, http.MethodGet, "/stats/"+shortKey, "")
+	expectStatus(t, resp, body, http.StatusNotFound)
+
+	resp, body = s.doAdmin(t, http.MethodDelete, "/"+shortKey, "")
+	expectStatus(t, resp, body, http.StatusNotFound)
+}
+
+func TestShortenDistinctKeys(t *testing.T) {
+	s := newStack(t)
+
+	first := s.shorten(t, "https://example.com/a")
+	second := s.shorten(t, "https://example.com/b")
+	if first == second {
+		t.Fatalf("expected distinct short keys, but both were %q", first)
+	}
+
+	for key, want := range map[string]string{first: "https://example.com/a", second: "https://example.com/b"} {
+		resp, body := s.do(t, http.MethodGet, "/"+key, "")
+		expectStatus(t, resp, body, http.StatusFound)
+		if location := resp.Header.Get("Location"); location != want {
+			t.Errorf("expected Location %q, but got %q", want, location)
+		}
+	}
+}
+
+func TestDedupe(t *testing.T) {
+	s := newStack(t)
+
+	shorten := func(token, body string, wantStatus int) string {
+		t.Helper()
+		resp, respBody := s.send(t, "", token, http.MethodPost, "/shorten", body)
+		expectStatus(t, resp, respBody, wantStatus)
+		var got struct {
+			ShortURL string `json:"short_url"`
+		}
+		if err := json.Unmarshal(respBody, &got); err != nil {
+			t.Fatalf("failed to decode shorten response: %v", err)
+		}
+		return got.ShortURL
+	}
+
+	first := shorten(teamAToken, `{"url":"https://example.com/dedupe","dedupe":true}`, http.StatusCreated)
+	again := shorten(adminToken, `{"url":"HTTPS://EXAMPLE.COM:443/x/../dedupe","owner":"team-a","dedupe":true}`, http.StatusOK)
+	if again != first {
+		t.Errorf("expected the existing link %q, but got %q", first, again)
+	}
+
+	other := shorten(teamBToken, `{"url":"https://example.com/dedupe","dedupe":true}`, http.StatusCreated)
+	forced := shorten(teamAToken, `{"url":"https://example.com/dedupe","dedupe":false}`, http.StatusCreated)
+	if other == first || forced == first {
+		t.Errorf("expected new links, but got %q and %q for %q", other, forced, first)
+	}
+
+	// Owners only create links for themselves.
+	shorten(teamBToken, `{"url":"https://example.com/dedupe","owner":"team-a","dedupe":true}`, http.StatusForbidden)
+}
+
+func TestBrandedDomain(t *testing.T) {
+	s := newStack(t)
+	const longURL = "https://example.com/branded"
+
+	resp, body := s.do(t, http.MethodPost, "/shorten", `{"url":"`+longURL+`","domain":"`+brandedDomain+`"}`)
+	expectStatus(t, resp, body, http.StatusCreated)
+	var got struct {
+		ShortURL string `json:"short_url"`
+	}
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatalf("failed to decode shorten response: %v", err)
+	}
+	prefix := "http://" + brandedDomain + "/"
+	if !strings.HasPrefix(got.ShortURL, prefix) {
+		t.Fatalf("expected a short URL under %s, but got %q", prefix, got.ShortURL)
+	}
+	shortKey := strings.TrimPrefix(got.ShortURL, prefix)
+
+	resp, body = s.doHost(t, brandedDomain, http.MethodGet, "/"+shortKey, "")
+	expectStatus(t, resp, body, http.StatusFound)
+	if location := resp.Header.Get("Location"); location != longURL {
+		t.Errorf("expected Location %q, but got %q", longURL, location)
+	}
+
+	// The link lives on the branded domain only.
+	resp, body = s.do(t, http.MethodGet, "/"+shortKey, "")
+	expectStatus(t, resp, body, http.StatusNotFound)
+
+	resp, body = s.doAdmin(t, http.MethodGet, "/stats/"+shortKey+"?domain="+brandedDomain, "")
+	expectStatus(t, resp, body, http.StatusOK)
+	var stats domain.URL
+	if err := json.Unmarshal(body, &stats); err != nil {
+		t.Fatalf("failed to decode stats response: %v", err)
+	}
+	if stats.Domain != brandedDomain || stats.Redirects != 1 {
+		t.Errorf("expected 1 redirect on %s, but got %d on %q", brandedDomain, stats.Redirects, stats.Domain)
+	}
+
+	resp, body = s.do(t, http.MethodPost, "/shorten", `{"url":"`+longURL+`","domain":"evil.example"}`)
+	expectStatus(t, resp, body, http.StatusBadRequest)
+
+	resp, body = s.send(t, brandedDomain, adminToken, http.MethodDelete, "/"+shortKey, "")
+	expectStatus(t, resp, body, http.StatusNoContent)
+	resp, body = s.doHost(t, brandedDomain, http.MethodGet, "/"+shortKey, "")
+	expectStatus(t, resp, body, http.StatusNotFound)
+}
+
+func TestURLPolicy(t *testing.T) {
+	s := newStack(t)
+
+	resp, body := s.do(t, http.MethodPost, "/shorten", `{"url":"https://www.`+bannedDomain+`/login"}`)
+	expectStatus(t, resp, body, http.StatusForbidden)
+
+	const laterBanned = "later.example"
+	shortKey := s.shorten(t, "https://"+laterBanned+"/page")
+	resp, body = s.do(t, http.MethodGet, "/"+shortKey, "")
+	expectStatus(t, resp, body, http.StatusFound)
+
+	// Banning the domain through the shortener's admin API reaches the
+	// redirect service through the shared rules file.
+	rules := `{"deny_domains":["` + bannedDomain + `","` + laterBanned + `"]}`
+	req, _ := http.NewRequest(http.MethodPut, s.Shortener+"/api/v1/admin/policy", strings.NewReader(rules))
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	adminResp, err := s.client.Do(req)
+	if err != nil {
+		t.Fatalf("PUT policy: %v", err)
+	}
+	adminResp.Body.Close()
+	if adminResp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT policy: expected status code %d, but got %d", http.StatusOK, adminResp.StatusCode)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		resp, body = s.do(t, http.MethodGet, "/"+shortKey, "")
+		if resp.StatusCode == http.StatusForbidden || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	expectStatus(t, resp, body, http.StatusForbidden)
+
+	resp, body = s.do(t, http.MethodPost, "/shorten", `{"url":"https://`+laterBanned+`/other"}`)
+	expectStatus(t, resp, body, http.StatusForbidden)
+}
+
+func TestThreatFeedScreening(t *testing.T) {
+	s := newStack(t)
+
+	resp, body := s.do(t, http.MethodPost, "/shorten", `{"url":"https://cdn.`+malwareHost+`/payload"}`)
+	expectStatus(t, resp, body, http.StatusForbidden)
+
+	const laterListed = "phish.example"
+	shortKey := s.shorten(t, "https://"+laterListed+"/login")
+	resp, body = s.do(t, http.MethodGet, "/"+shortKey, "")
+	expectStatus(t, resp, body, http.StatusFound)
+
+	// A feed update followed by a rescan disables the existing link, even
+	// though the redirect service has it cached.
+	feed := "0.0.0.0 " + malwareHost + "\n0.0.0.0 " + laterListed + "\n"
+	if err := os.WriteFile(s.ThreatFeed, []byte(feed), 0o600); err != nil {
+		t.Fatalf("failed to update threat feed: %v", err)
+	}
+	disabled, err := s.shortener.Rescan(context.Background())
+	if err != nil || disabled != 1 {
+		t.Fatalf("expected the rescan to disable 1 link, but got %d, %v", disabled, err)
+	}
+
+	resp, body = s.do(t, http.MethodGet, "/"+shortKey, "")
+	expectStatus(t, resp, body, http.StatusForbidden)
+
+	resp, body = s.doAdmin(t, http.MethodGet, "/stats/"+shortKey, "")
+	expectStatus(t, resp, body, http.StatusOK)
+	var stats domain.URL
+	if err := json.Unmarshal(body, &stats); err != nil {
+		t.Fatalf("failed to decode stats response: %v", err)
+	}
+	if !stats.IsDisabled() || !strings.Contains(stats.DisabledReason, laterListed) {
+		t.Errorf("expected the link to be disabled by the feed, but got %v %q", stats.DisabledAt, stats.DisabledReason)
+	}
+}
+
+func TestUntrustedInterstitial(t *testing.T) {
+	s := newStack(t)
+	const longURL = "https://downloads.example/setup.zip"
+
+	resp, body := s.send(t, "", teamAToken, http.MethodPost, "/shorten", `{"url":"`+longURL+`"}`)
+	expectStatus(t, resp, body, http.StatusCreated)
+	var created struct {
+		ShortURL string `json:"short_url"`
+	}
+	if err := json.Unmarshal(body, &created); err != nil {
+		t.Fatalf("failed to decode shorten response: %v", err)
+	}
+	shortKey := strings.TrimPrefix(created.ShortURL, s.Gateway+"/")
+
+	// The first redirect is direct and leaves the link in the cache.
+	resp, body = s.do(t, http.MethodGet, "/"+shortKey, "")
+	expectStatus(t, resp, body, http.StatusFound)
+
+	// Only the owner may flag the link, and the owner is not shown to them.
+	resp, body = s.send(t, "", teamBToken, http.MethodPut, "/trust/"+shortKey, `{"untrusted":true}`)
+	expectStatus(t, resp, body, http.StatusForbidden)
+	resp, body = s.send(t, "", teamAToken, http.MethodPut, "/trust/"+shortKey, `{"untrusted":true}`)
+	expectStatus(t, resp, body, http.StatusOK)
+	var flagged domain.URL
+	if err := json.Unmarshal(body, &flagged); err != nil {
+		t.Fatalf("failed to decode trust response: %v", err)
+	}
+	if !flagged.Untrusted || flagged.Owner != "" {
+		t.Errorf("expected the flagged link without its owner, but got %+v", flagged)
+	}
+
+	// A browser now sees the interstitial, continues, and is not asked again.
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatalf("failed to create cookie jar: %v", err)
+	}
+	browser := &http.Client{Jar: jar, Timeout: s.client.Timeout, CheckRedirect: s.client.CheckRedirect}
+	visit := func(path string) (*http.Response, []byte) {
+		t.Helper()
+		resp, err := browser.Get(s.Gateway + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		var buf bytes.Buffer
+		buf.ReadFrom(resp.Body)
+		return resp, buf.Bytes()
+	}
+
+	resp, body = visit("/" + shortKey)
+	expectStatus(t, resp, body, http.StatusOK)
+	if !strings.Contains(string(body), longURL) {
+		t.Fatalf("expected the interstitial to show %s, but got %s", longURL, body)
+	}
+	m := regexp.MustCompile(`href="([^"]*continue=[^"]*)"`).FindSubmatch(body)
+	if m == nil {
+		t.Fatalf("expected a continue link, but got %s", body)
+	}
+
+	for _, path := range []string{html.UnescapeString(string(m[1])), "/" + shortKey} {
+		resp, body = visit(path)
+		expectStatus(t, resp, body, http.StatusFound)
+		if location := resp.Header.Get("Location"); location != longURL {
+			t.Errorf("expected Location %q, but got %q", longURL, location)
+		}
+	}
+
+	// The interstitial itself is not a redirect; the confirmed visits are.
+	resp, body = s.doAdmin(t, http.MethodGet, "/stats/"+shortKey, "")
+	expectStatus(t, resp, body, http.StatusOK)
+	var stats domain.URL
+	if err := json.Unmarshal(body, &stats); err != nil {
+		t.Fatalf("failed to decode stats response: %v", err)
+	}
+	if !stats.Untrusted || stats.Redirects != 3 {
+		t.Errorf("expected an untrusted link with 3 redirects, but got %v with %d", stats.Untrusted, stats.Redirects)
+	}
+
+	// An administrator may clear the flag of any link.
+	req, _ := http.NewRequest(http.MethodPut, s.Gateway+"/trust/"+shortKey, strings.NewReader(`{"untrusted":false}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	adminResp, err := s.client.Do(req)
+	if err != nil {
+		t.Fatalf("PUT trust: %v", err)
+	}
+	adminResp.Body.Close()
+	if adminResp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT trust: expected status code %d, but got %d", http.StatusOK, adminResp.StatusCode)
+	}
+	resp, body = s.do(t, http.MethodGet, "/"+shortKey, "")
+	expectStatus(t, resp, body, http.StatusFound)
+
+	// Domains are marked untrusted through the URL policy.
+	rules := `{"deny_domains":["` + bannedDomain + `"],"untrusted_domains":["downloads.example"]}`
+	req, _ = http.NewRequest(http.MethodPut, s.Shortener+"/api/v1/admin/policy", strings.NewReader(rules))
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	adminResp, err = s.client.Do(req)
+	if err != nil {
+		t.Fatalf("PUT policy: %v", err)
+	}
+	adminResp.Body.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		resp, body = s.do(t, http.MethodGet, "/"+shortKey, "")
+		if resp.StatusCode == http.StatusOK || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	expectStatus(t, resp, body, http.StatusOK)
+}
+
+func TestPasswordProtected(t *testing.T) {
+	s := newStack(t)
+	const longURL = "https://docs.example/internal/roadmap"
+
+	resp, body := s.do(t, http.MethodPost, "/shorten", `{"url":"`+longURL+`","password":"hunter2"}`)
+	expectStatus(t, resp, body, http.StatusCreated)
+	var created struct {
+		ShortURL string `json:"short_url"`
+	}
+	if err := json.Unmarshal(body, &created); err != nil {
+		t.Fatalf("failed to decode shorten response: %v", err)
+	}
+	shortKey := strings.TrimPrefix(created.ShortURL, s.Gateway+"/")
+
+	// Only an administrator's stats reveal the destination, and nothing
+	// reveals the hash.
+	resp, body = s.doAdmin(t, http.MethodGet, "/stats/"+shortKey, "")
+	expectStatus(t, resp, body, http.StatusOK)
+	if !strings.Contains(string(body), "docs.example") || strings.Contains(string(body), "password_hash") {
+		t.Errorf("expected the stats to show the destination but withhold the hash, but got %s", body)
+	}
+	resp, body = s.do(t, http.MethodGet, "/"+shortKey, "")
+	expectStatus(t, resp, body, http.StatusOK)
+	if !strings.Contains(string(body), `action="/`+shortKey+`"`) || strings.Contains(string(body), "docs.example") {
+		t.Fatalf("expected the password form, but got %s", body)
+	}
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatalf("failed to create cookie jar: %v", err)
+	}
+	browser := &http.Client{Jar: jar, Timeout: s.client.Timeout, CheckRedirect: s.client.CheckRedirect}
+	submit := func(password string) (*http.Response, []byte) {
+		t.Helper()
+		resp, err := browser.PostForm(s.Gateway+"/"+shortKey, url.Values{"password": {password}})
+		if err != nil {
+			t.Fatalf("POST /%s: %v", shortKey, err)
+		}
+		defer resp.Body.Close()
+		var buf bytes.Buffer
+		buf.ReadFrom(resp.Body)
+		return resp, buf.Bytes()
+	}
+
+	resp, body = submit("guess")
+	expectStatus(t, resp, body, http.StatusUnauthorized)
+
+	resp, body = submit("hunter2")
+	expectStatus(t, resp, body, http.StatusSeeOther)
+	resp, err = browser.Get(s.Gateway + resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("GET /%s: %v", shortKey, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != longURL {
+		t.Fatalf("expected a redirect to %s after the password, but got %d %q", longURL, resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	// The right password forgot the wrong one before it. After three wrong
+	// ones from one address even the right password is refused until the
+	// window passes.
+	for range 3 {
+		resp, body = submit("guess")
+		expectStatus(t, resp, body, http.StatusUnauthorized)
+	}
+	resp, body = submit("hunter2")
+	expectStatus(t, resp, body, http.StatusTooManyRequests)
+}
+
+func TestSignedLinks(t *testing.T) {
+	s := newStack(t)
+	const longURL = "https://example.com/invite"
+
+	resp, body := s.do(t, http.MethodPost, "/shorten", `{"url":"`+longURL+`","signed":true}`)
+	expectStatus(t, resp, body, http.StatusCreated)
+	var created struct {
+		ShortURL string `json:"short_url"`
+	}
+	if err := json.Unmarshal(body, &created); err != nil {
+		t.Fatalf("failed to decode shorten response: %v", err)
+	}
+	segment := strings.TrimPrefix(created.ShortURL, s.Gateway+"/")
+	shortKey, token, signed := linksig.Split(segment)
+	if !signed {
+		t.Fatalf("expected a signed short URL, but got %q", created.ShortURL)
+	}
+
+	resp, body = s.do(t, http.MethodGet, "/"+segment, "")
+	expectStatus(t, resp, body, http.StatusFound)
+	if resp.Header.Get("Location") != longURL {
+		t.Errorf("expected a redirect to %s, but got %q", longURL, resp.Header.Get("Location"))
+	}
+
+	// The bare key and forged signatures lead nowhere.
+	for _, forged := range []string{shortKey, shortKey + ".e2e.AAAAAAAAAAAAAAAA", shortKey + ".other." + token[len("e2e."):]} {
+		resp, body = s.do(t, http.MethodGet, "/"+forged, "")
+		expectStatus(t, resp, body, http.StatusNotFound)
+	}
+
+	host := strings.TrimPrefix(s.Gateway, "http://")
+	expired, err := s.LinkSigning.Sign(host, shortKey, time.Now().Add(-time.Minute), time.Now())
+	if err != nil {
+		t.Fatalf("failed to sign link: %v", err)
+	}
+	resp, body = s.do(t, http.MethodGet, "/"+linksig.Join(shortKey, expired), "")
+	expectStatus(t, resp, body, http.StatusGone)
+
+	resp, body = s.doAdmin(t, http.MethodGet, "/stats/"+shortKey, "")
+	expectStatus(t, resp, body, http.StatusOK)
+	var stats domain.URL
+	if err := json.Unmarshal(body, &stats); err != nil {
+		t.Fatalf("failed to decode stats: %v", err)
+	}
+	if !stats.Signed || stats.Redirects != 1 {
+		t.Errorf("expected a signed link with 1 redirect, but got signed=%v redirects=%d", stats.Signed, stats.Redirects)
+	}
+}
+
+func TestBatchShorten(t *testing.T) {
+	s := newStack(t)
+
+	resp, body := s.send(t, "", teamAToken, http.MethodPost, "/shorten/batch", `{"items":[
+		{"url":"https://example.com/batch/a"},
+		{"url":"not a url"},
+		{"url":"https://`+bannedDomain+`/x"},
+		{"url":"https://example.com/batch/b","owner":"team-a","dedupe":true},
+		{"url":"https://EXAMPLE.com/batch/b","owner":"team-a","dedupe":true},
+		{"url":"https://example.com/batch/c","signed":true}
+	]}`)
+	expectStatus(t, resp, body, http.StatusOK)
+
+	var got struct {
+		Results []struct {
+			Index    int    `json:"index"`
+			ShortURL string `json:"short_url"`
+			Status   int    `json:"status"`
+		} `json:"results"`
+		Created  int `json:"created"`
+		Existing int `json:"existing"`
+		Failed   int `json:"failed"`
+	}
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatalf("failed to decode batch response: %v", err)
+	}
+	wantStatuses := []int{http.StatusCreated, http.StatusBadRequest, http.StatusForbidden, http.StatusCreated, http.StatusOK, http.StatusCreated}
+	if len(got.Results) != len(wantStatuses) {
+		t.Fatalf("expected %d results, but got %s", len(wantStatuses), body)
+	}
+	for i, r := range got.Results {
+		if r.Index != i || r.Status != wantStatuses[i] {
+			t.Errorf("item %d: expected status %d, but got %d", i, wantStatuses[i], r.Status)
+		}
+	}
+	if got.Created != 3 || got.Existing != 1 || got.Failed != 2 {
+		t.Errorf("expected 3 created, 1 existing and 2 failed, but got %d, %d and %d", got.Created, got.Existing, got.Failed)
+	}
+	if got.Results[4].ShortURL != got.Results[3].ShortURL {
+		t.Errorf("expected the duplicate to return %q, but got %q", got.Results[3].ShortURL, got.Results[4].ShortURL)
+	}
+
+	for i, want := range map[int]string{0: "https://example.com/batch/a", 3: "https://example.com/batch/b", 5: "https://example.com/batch/c"} {
+		resp, body := s.do(t, http.MethodGet, strings.TrimPrefix(got.Results[i].ShortURL, s.Gateway), "")
+		expectStatus(t, resp, body, http.StatusFound)
+		if location := resp.Header.Get("Location"); location != want {
+			t.Errorf("item %d: expected Location %q, but got %q", i, want, location)
+		}
+	}
+	if _, _, signed := linksig.Split(strings.TrimPrefix(got.Results[5].ShortURL, s.Gateway+"/")); !signed {
+		t.Errorf("expected a signed short URL, but got %q", got.Results[5].ShortURL)
+	}
+}
+
+func TestIdempotentShorten(t *testing.T) {
+	s := newStack(t)
+
+	shorten := func(key, longURL string) (*http.Response, []byte) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, s.Gateway+"/shorten", strings.NewReader(`{"url":"`+longURL+`","dedupe":false}`))
+		if err != nil {
+			t.Fatalf("failed to build request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", key)
+		resp, err := s.client.Do(req)
+		if err != nil {
+			t.Fatalf("POST /shorten: %v", err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("POST /shorten: failed to read body: %v", err)
+		}
+		return resp, body
+	}
+
+	// Without dedupe every request would get a new key, so a retry that
+	// returns the same one was answered from the recorded response.
+	resp, first := shorten("retry-1", "https://example.com/idempotent")
+	expectStatus(t, resp, first, http.StatusCreated)
+	resp, retry := shorten("retry-1", "https://example.com/idempotent")
+	expectStatus(t, resp, retry, http.StatusCreated)
+	if string(retry) != string(first) || resp.Header.Get("Idempotent-Replayed") != "true" {
+		t.Errorf("expected the retry to replay %s, but got %s", first, retry)
+	}
+
+	resp, body := shorten("retry-2", "https://example.com/idempotent")
+	expectStatus(t, resp, body, http.StatusCreated)
+	if string(body) == string(first) {
+		t.Errorf("expected a new key under another Idempotency-Key, but got %s", body)
+	}
+
+	resp, body = shorten("retry-1", "https://example.com/other")
+	expectStatus(t, resp, body, http.StatusUnprocessableEntity)
+}
+
+func TestShortenJob(t *testing.T) {
+	s := newStack(t)
+
+	upload := "url,owner\nhttps://example.com/job/a,team-a\nhttps://" + malwareHost + "/x,\nhttps://example.com/job/b,\n"
+	req, err := http.NewRequest(http.MethodPost, s.Gateway+"/shorten/jobs", strings.NewReader(upload))
+	if err != nil {
+		t.Fatalf("failed to build request: %v", err)
+	}
+	req.Header.Set("Content-Type", "text/csv")
+	req.Header.Set("Authorization", "Bearer "+teamAToken)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		t.Fatalf("POST /shorten/jobs: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected status code %d, but got %d", http.StatusAccepted, resp.StatusCode)
+	}
+	location := resp.Header.Get("Location")
+	if !strings.HasPrefix(location, "/shorten/jobs/") {
+		t.Fatalf("expected the job's location, but got %q", location)
+	}
+
+	type job struct {
+		Status    string `json:"status"`
+		Total     int    `json:"total"`
+		Processed int    `json:"processed"`
+		Failed    int    `json:"failed"`
+		Results   []struct {
+			ShortURL string `json:"short_url"`
+			Status   int    `json:"status"`
+		} `json:"results"`
+	}
+	var got job
+	deadline := time.Now().Add(5 * time.Second)
+	for got.Status != "done" {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the job to finish, but it processed %d of %d", got.Processed, got.Total)
+		}
+		time.Sleep(20 * time.Millisecond)
+		resp, body := s.send(t, "", teamAToken, http.MethodGet, location, "")
+		expectStatus(t, resp, body, http.StatusOK)
+		got = job{}
+		if err := json.Unmarshal(body, &got); err != nil {
+			t.Fatalf("failed to decode job: %v", err)
+		}
+	}
+
+	if got.Total != 3 || got.Processed != 3 || got.Failed != 1 || len(got.Results) != 3 {
+		t.Fatalf("expected 3 processed items with 1 failure, but got %+v", got)
+	}
+	if got.Results[1].Status != http.StatusForbidden {
+		t.Errorf("expected the malware link to be rejected, but got status %d", got.Results[1].Status)
+	}
+	resp, body := s.do(t, http.MethodGet, strings.TrimPrefix(got.Results[2].ShortURL, s.Gateway), "")
+	expectStatus(t, resp, body, http.StatusFound)
+	if location := resp.Header.Get("Location"); location != "https://example.com/job/b" {
+		t.Errorf("expected a redirect to https://example.com/job/b, but got %q", location)
+	}
+
+	// The job is team-a's: other owners and anonymous callers may not read
+	// it, while the admin may.
+	resp, body = s.do(t, http.MethodGet, location, "")
+	expectStatus(t, resp, body, http.StatusForbidden)
+	resp, body = s.send(t, "", teamBToken, http.MethodGet, location, "")
+	expectStatus(t, resp, body, http.StatusForbidden)
+	resp, body = s.doAdmin(t, http.MethodGet, location, "")
+	expectStatus(t, resp, body, http.StatusOK)
+
+	resp, body = s.do(t, http.MethodGet, "/shorten/jobs/0123456789abcdef", "")
+	expectStatus(t, resp, body, http.StatusNotFound)
+}
+
+func TestPublicEdgeErrors(t *testing.T) {
+	s := newStack(t)
+
+	testCases := []struct {
+		name               string
+		method             string
+		path               string
+		body               string
+		token              string
+		expectedStatusCode int
+		expectedCode       problem.Code
+	}{
+		{"Shorten Invalid URL", http.MethodPost, "/shorten", `{"url":"not a url"}`, "", http.StatusBadRequest, problem.CodeInvalidURL},
+		{"Shorten Missing URL", http.MethodPost, "/shorten", `{}`, "", http.StatusBadRequest, problem.CodeInvalidURL},
+		{"Shorten Malformed Body", http.MethodPost, "/shorten", `{"url":`, "", http.StatusBadRequest, problem.CodeInvalidURL},
+		{"Shorten Non-HTTP Scheme", http.MethodPost, "/shorten", `{"url":"ftp://example.com/file"}`, "", http.StatusBadRequest, problem.CodeInvalidURL},
+		{"Shorten Metadata Address", http.MethodPost, "/shorten", `{"url":"http://169.254.169.254/latest/meta-data/"}`, "", http.StatusForbidden, problem.CodeBlacklisted},
+		{"Shorten Localhost", http.MethodPost, "/shorten", `{"url":"http://localhost:5432/"}`, "", http.StatusForbidden, problem.CodeBlacklisted},
+		{"Redirect Unknown Key", http.MethodGet, "/doesnotexist", "", "", http.StatusNotFound, problem.CodeNotFound},
+		{"Stats Unknown Key", http.MethodGet, "/stats/doesnotexist", "", adminToken, http.StatusNotFound, problem.CodeNotFound},
+		{"Delete Unknown Key", http.MethodDelete, "/doesnotexist", "", adminToken, http.StatusNotFound, problem.CodeNotFound},
+		{"Stats Without Token", http.MethodGet, "/stats/doesnotexist", "", "", http.StatusUnauthorized, problem.CodeUnauthorized},
+		{"Unknown Route", http.MethodGet, "/a/b/c", "", "", http.StatusNotFound, problem.CodeNotFound},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, body := s.send(t, "", tc.token, tc.method, tc.path, tc.body)
+			expectStatus(t, resp, body, tc.expectedStatusCode)
+			if ct := resp.Header.Get("Content-Type"); ct != problem.ContentType {
+				t.Fatalf("expected a problem document, but got Content-Type %q", ct)
+			}
+			var p problem.Problem
+			if err := json.Unmarshal(body, &p); err != nil {
+				t.Fatalf("failed to decode problem: %v", err)
+			}
+			if p.Code != tc.expectedCode || p.Status != tc.expectedStatusCode || p.Instance != tc.path {
+				t.Errorf("expected a %d %s problem at %s, but got %+v", tc.expectedStatusCode, tc.expectedCode, tc.path, p)
+			}
+			if p.RequestID == "" || p.RequestID != resp.Header.Get(logging.HeaderRequestID) {
+				t.Errorf("expected the problem to carry request ID %q, but got %q", resp.Header.Get(logging.HeaderRequestID), p.RequestID)
+			}
+		})
+	}
+}
+
+func TestSystemStatus(t *testing.T) {
+	s := newStack(t)
+
+	for _, path := range []string{"/healthz", "/readyz"} {
+		resp, body := s.do(t, http.MethodGet, path, "")
+		expectStatus(t, resp, body, http.StatusOK)
+	}
+
+	resp, body := s.do(t, http.MethodGet, "/status", "")
+	expectStatus(t, resp, body, http.StatusOK)
+	var system struct {
+		Status   string
+		Services map[string]struct {
+			Status string
+			Checks map[string]struct{ Status string }
+		}
+	}
+	if err := json.Unmarshal(body, &system); err != nil {
+		t.Fatalf("failed to decode status: %v", err)
+	}
+
+	// Every service reports its own dependencies.
+	expected := map[string][]string{
+		"api-gateway-service":   {"url-shortener-service", "url-redirect-service", "redis"},
+		"url-shortener-service": {"postgres", "redis", "key-gen-service"},
+		"url-redirect-service":  {"postgres", "redis"},
+		"key-gen-service":       nil,
+	}
+	if system.Status != "up" || len(system.Services) != len(expected) {
+		t.Fatalf("expected %d services up, but got %s", len(expected), body)
+	}
+	for name, checks := range expected {
+		service := system.Services[name]
+		if service.Status != "up" || len(service.Checks) != len(checks) {
+			t.Errorf("expected %s up with %d checks, but got %+v", name, len(checks), service)
+		}
+		for _, check := range checks {
+			if service.Checks[check].Status != "up" {
+				t.Errorf("expected %s's %s check to be up, but got %+v", name, check, service.Checks[check])
+			}
+		}
+	}
+}
+
+// keptSpans is an in-memory exporter that keeps its spans when shut down.
+type keptSpans struct {
+	*tracetest.InMemoryExporter
+}
+
+func (keptSpans) Shutdown(context.Context) error { return nil }
+
+func TestTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider, err := tracing.Start(context.Background(), "e2e", tracing.WithExporter(keptSpans{exporter}))
+	if err != nil {
+		t.Fatalf("failed to start tracing: %v", err)
+	}
+	s := newStack(t)
+
+	s.shorten(t, "https://example.com/traced")
+	if err := provider.Shutdown(context.Background()); err != nil {
+		t.Fatalf("failed to flush spans: %v", err)
+	}
+
+	// One trace follows the request from the gateway through the shortener
+	// to the key-gen service.
+	servers := map[string]trace.TraceID{
+		"POST /shorten":             {},
+		"POST /api/v1/shorten":      {},
+		"POST /api/v1/generate-key": {},
+	}
+	for _, span := range exporter.GetSpans() {
+		if _, ok := servers[span.Name]; ok && span.SpanKind == trace.SpanKindServer {
+			servers[span.Name] = span.SpanContext.TraceID()
+		}
+	}
+	gateway := servers["POST /shorten"]
+	for name, traceID := range servers {
+		if !traceID.IsValid() {
+			t.Errorf("expected a %s span, but got none", name)
+		} else if traceID != gateway {
+			t.Errorf("expected %s in trace %s, but got %s", name, gateway, traceID)
+		}
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(logging.New(&buf))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	s := newStack(t)
+
+	const requestID = "e2e-request-1"
+	req, err := http.NewRequest(http.MethodPost, s.Gateway+"/shorten", strings.NewReader(`{"url":"https://example.com/logged"}`))
+	if err != nil {
+		t.Fatalf("failed to build request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(logging.HeaderRequestID, requestID)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get(logging.HeaderRequestID); got != requestID {
+		t.Fatalf("expected the response to echo request ID %q, but got %q", requestID, got)
+	}
+
+	// The gateway, the shortener and the key-gen service each log the
+	// request under the caller's ID.
+	logged := map[string]bool{
+		"/shorten":             false,
+		"/api/v1/shorten":      false,
+		"/api/v1/generate-key": false,
+	}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry struct {
+			Msg       string `json:"msg"`
+			Route     string `json:"route"`
+			RequestID string `json:"request_id"`
+		}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("expected a JSON line, but got %q", line)
+		}
+		if _, ok := logged[entry.Route]; ok && entry.Msg == "request" && entry.RequestID == requestID {
+			logged[entry.Route] = true
+		}
+	}
+	for route, ok := range logged {
+		if !ok {
+			t.Errorf("expected the request to %s to be logged with request ID %q, but it was not", route, requestID)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+// Package app wires the key-gen-service together. It is the service's only
+// importable package, so cmd/server and the end-to-end suite build the
+// service in exactly the same way.
+package app
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"github.com/iton0/duss/key-gen-service/internal/api"
+	"github.com/iton0/duss/key-gen-service/internal/core/services"
+	"github.com/iton0/duss/key-gen-service/internal/infrastructure/web"
+	"github.com/iton0/duss/shared/health"
+)
+
+// App is a fully wired key-gen-service.
+type App struct {
+	Router *gin.Engine
+	// Health reports whether the service is ready.
+	Health *health.Checker
+}
+
+// New builds the service's HTTP router.
+func New() *App {
+	keygenService := services.NewKeygenService()
+	keygenHandler := api.NewKeygenHandler(keygenService)
+	router := web.NewRouter(keygenHandler)
+	// Keys are generated in memory, so there are no dependencies to check.
+	checker := health.New("key-gen-service")
+	web.RegisterHealth(router, checker)
+	return &App{Router: router, Health: checker}
+}
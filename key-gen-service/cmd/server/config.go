@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/iton0/duss/shared/config"
+	"github.com/iton0/duss/shared/logging"
+	"github.com/iton0/duss/shared/tracing"
+)
+
+// Config is the key-gen-service's configuration.
+type Config struct {
+	Server config.Server `config:"server"`
+	// Log configures the service's log level, format and sampling.
+	Log logging.Config `config:"log"`
+	// Tracing configures where the service's spans are exported.
+	Tracing tracing.Config `config:"tracing"`
+}
+
+// Validate implements config.Validator.
+func (c *Config) Validate() error {
+	if _, err := c.Log.Options(); err != nil {
+		return fmt.Errorf("log: %w", err)
+	}
+	if _, err := c.Tracing.Options(); err != nil {
+		return fmt.Errorf("tracing: %w", err)
+	}
+	return nil
+}
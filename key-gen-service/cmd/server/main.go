@@ -1,26 +1,48 @@
 package main
 
 import (
-	"log"
+	"context"
+	"log/slog"
+	"os"
 
-	"github.com/iton0/duss/key-gen-service/internal/api"
-	"github.com/iton0/duss/key-gen-service/internal/core/services"
-	"github.com/iton0/duss/key-gen-service/internal/infrastructure/web"
-	"github.com/joho/godotenv"
+	"github.com/iton0/duss/key-gen-service/app"
+	"github.com/iton0/duss/shared/config"
+	"github.com/iton0/duss/shared/logging"
+	"github.com/iton0/duss/shared/server"
+	"github.com/iton0/duss/shared/tracing"
 )
 
 func main() {
-	if err := godotenv.Load(); err != nil {
-		log.Fatal("Error loading .env file")
+	var cfg Config
+	config.MustLoad("key-gen-service", &cfg)
+
+	logOpts, err := cfg.Log.Options()
+	if err != nil {
+		logging.Fatal("invalid log settings", "error", err)
+	}
+	slog.SetDefault(logging.New(os.Stderr, logOpts...))
+
+	tracingOpts, err := cfg.Tracing.Options()
+	if err != nil {
+		logging.Fatal("invalid tracing settings", "error", err)
+	}
+	tracer, err := tracing.Start(context.Background(), "key-gen-service", tracingOpts...)
+	if err != nil {
+		logging.Fatal("failed to start tracing", "error", err)
 	}
 
-	keygenService := services.NewKeygenService()
-	keygenHandler := api.NewKeygenHandler(keygenService)
-	router := web.NewRouter(keygenHandler)
+	application := app.New()
 
-	log.Println("Starting key generator service on :8080")
+	// Serve until SIGINT or SIGTERM, then drain requests and export the
+	// spans still buffered.
+	srv := server.New("key-gen-service", cfg.Server.Addr(), application.Router,
+		server.WithHealth(application.Health),
+		server.WithDrainDelay(cfg.Server.DrainDelay),
+		server.WithShutdownTimeout(cfg.Server.ShutdownTimeout),
+	)
+	srv.OnShutdown("flush traces", tracer.Shutdown)
 
-	if err := router.Run(":8080"); err != nil {
-		log.Fatalf("server failed to start: %v", err)
+	if err := srv.Run(context.Background()); err != nil {
+		logging.Fatal("server did not shut down cleanly", "error", err)
 	}
 }
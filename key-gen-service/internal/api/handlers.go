@@ -5,11 +5,20 @@ import (
 	"net/http"
 
 	"github.com/gin-gonic/gin"
+
 	"github.com/iton0/duss/key-gen-service/internal/core/services"
+	"github.com/iton0/duss/shared/problem"
 )
 
-// TODO: what errors to put here
-var errFoo = errors.New("")
+// KeygenRequest defines the structure for the JSON request body.
+type KeygenRequest struct {
+	URL string `json:"url"`
+}
+
+// KeygenBatchRequest defines the JSON request body of HandleKeygenBatch.
+type KeygenBatchRequest struct {
+	URLs []string `json:"urls" binding:"required"`
+}
 
 // KeygenHandler handles API requests related to key generation.
 type KeygenHandler struct {
@@ -21,21 +30,57 @@ func NewKeygenHandler(ks services.KeygenServiceIface) *KeygenHandler {
 	return &KeygenHandler{keygenService: ks}
 }
 
-// HandleKeygen handles the GET /api/v1/generate-key endpoint.
-// It calls the key generation service to create a new key and returns it.
+// HandleKeygen handles the POST /api/v1/generate-key endpoint.
+// It calls the key generation service to create a new key for the URL in the
+// request body and returns it.
 func (h *KeygenHandler) HandleKeygen(c *gin.Context) {
-	// Call the keygen service to generate a new short key.
-	// The keygenService interface should have a method like GenerateKey()
-	// that handles the actual key generation logic.
-	shortKey, err := h.keygenService.GenerateKey()
-	if err != nil {
-		// If an error occurs during key generation, return an internal server error.
-		// A common reason for this could be a failure to connect to a database or a random number generator.
-		c.String(http.StatusInternalServerError, "Internal Server Error")
+	var req KeygenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		problem.Abort(c, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request body"))
 		return
 	}
 
+	shortKey, err := h.keygenService.GenerateKey(req.URL)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrInvalidURL):
+			problem.Abort(c, problem.New(http.StatusBadRequest, problem.CodeInvalidURL, err.Error()))
+			return
+		default:
+			// A common reason for this could be a failure of the random number generator.
+			problem.Abort(c, problem.Internal())
+			return
+		}
+	}
+
 	// If successful, return the newly generated short key to the client.
-	// We use c.JSON to return a JSON response with the key.
 	c.JSON(http.StatusOK, gin.H{"short_key": shortKey})
 }
+
+// HandleKeygenBatch handles the POST /api/v1/generate-keys endpoint. It
+// returns a key for each URL in the request body, in the same order, so
+// callers shortening many URLs need a single request.
+func (h *KeygenHandler) HandleKeygenBatch(c *gin.Context) {
+	var req KeygenBatchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		problem.Abort(c, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request body: urls are required"))
+		return
+	}
+
+	shortKeys, err := h.keygenService.GenerateKeys(req.URLs)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrInvalidURL):
+			problem.Abort(c, problem.New(http.StatusBadRequest, problem.CodeInvalidURL, err.Error()))
+			return
+		case errors.Is(err, services.ErrTooManyKeys):
+			problem.Abort(c, problem.New(http.StatusRequestEntityTooLarge, problem.CodeTooLarge, err.Error()))
+			return
+		default:
+			problem.Abort(c, problem.Internal())
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"short_keys": shortKeys})
+}
@@ -1 +1,188 @@
 package api_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/iton0/duss/key-gen-service/internal/api"
+	"github.com/iton0/duss/key-gen-service/internal/core/services"
+	"github.com/iton0/duss/shared/problem"
+)
+
+type MockKeygenService struct {
+	ReturnKey string
+	ReturnErr error
+}
+
+func (m *MockKeygenService) GenerateKey(url string) (string, error) {
+	return m.ReturnKey, m.ReturnErr
+}
+
+func (m *MockKeygenService) GenerateKeys(urls []string) ([]string, error) {
+	if m.ReturnErr != nil {
+		return nil, m.ReturnErr
+	}
+	keys := make([]string, len(urls))
+	for i := range urls {
+		keys[i] = m.ReturnKey + strconv.Itoa(i)
+	}
+	return keys, nil
+}
+
+func TestHandleKeygen(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	testCases := []struct {
+		name               string
+		body               string
+		mockReturnKey      string
+		mockReturnErr      error
+		expectedStatusCode int
+		expectedKey        string
+		expectedCode       problem.Code
+	}{
+		{
+			name:               "Success - Key Generated",
+			body:               `{"url":"https://example.com"}`,
+			mockReturnKey:      "abc123",
+			expectedStatusCode: http.StatusOK,
+			expectedKey:        "abc123",
+		},
+		{
+			name:               "Malformed Body",
+			body:               `{`,
+			expectedStatusCode: http.StatusBadRequest,
+			expectedCode:       problem.CodeInvalidRequest,
+		},
+		{
+			name:               "Invalid URL Error",
+			body:               `{"url":""}`,
+			mockReturnErr:      services.ErrInvalidURL,
+			expectedStatusCode: http.StatusBadRequest,
+			expectedCode:       problem.CodeInvalidURL,
+		},
+		{
+			name:               "Internal Server Error",
+			body:               `{"url":"https://example.com"}`,
+			mockReturnErr:      errors.New("entropy exhausted"),
+			expectedStatusCode: http.StatusInternalServerError,
+			expectedCode:       problem.CodeInternal,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockService := &MockKeygenService{
+				ReturnKey: tc.mockReturnKey,
+				ReturnErr: tc.mockReturnErr,
+			}
+
+			keygenHandler := api.NewKeygenHandler(mockService)
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodPost, "/api/v1/generate-key", strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+
+			c, _ := gin.CreateTestContext(w)
+			c.Request = req
+
+			keygenHandler.HandleKeygen(c)
+
+			if w.Code != tc.expectedStatusCode {
+				t.Errorf("expected status code %d, but got %d", tc.expectedStatusCode, w.Code)
+			}
+
+			if tc.expectedCode != "" {
+				var p problem.Problem
+				if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil || w.Header().Get("Content-Type") != problem.ContentType {
+					t.Fatalf("expected a problem document, but got %q: %s", w.Header().Get("Content-Type"), w.Body.String())
+				}
+				if p.Code != tc.expectedCode {
+					t.Errorf("expected problem code %s, but got %s", tc.expectedCode, p.Code)
+				}
+			}
+
+			if tc.expectedStatusCode == http.StatusOK {
+				var resp map[string]string
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+					t.Fatalf("could not decode response: %v", err)
+				}
+				if resp["short_key"] != tc.expectedKey {
+					t.Errorf("expected key %s, but got %s", tc.expectedKey, resp["short_key"])
+				}
+			}
+		})
+	}
+}
+
+func TestHandleKeygenBatch(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	testCases := []struct {
+		name               string
+		body               string
+		mockReturnErr      error
+		expectedStatusCode int
+		expectedKeys       []string
+	}{
+		{
+			name:               "Success - Keys Generated",
+			body:               `{"urls":["https://example.com","https://example.org"]}`,
+			expectedStatusCode: http.StatusOK,
+			expectedKeys:       []string{"abc0", "abc1"},
+		},
+		{
+			name:               "Missing URLs",
+			body:               `{}`,
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:               "Too Many Keys",
+			body:               `{"urls":["https://example.com"]}`,
+			mockReturnErr:      services.ErrTooManyKeys,
+			expectedStatusCode: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:               "Internal Server Error",
+			body:               `{"urls":["https://example.com"]}`,
+			mockReturnErr:      errors.New("entropy exhausted"),
+			expectedStatusCode: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			keygenHandler := api.NewKeygenHandler(&MockKeygenService{ReturnKey: "abc", ReturnErr: tc.mockReturnErr})
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request, _ = http.NewRequest(http.MethodPost, "/api/v1/generate-keys", strings.NewReader(tc.body))
+			c.Request.Header.Set("Content-Type", "application/json")
+
+			keygenHandler.HandleKeygenBatch(c)
+
+			if w.Code != tc.expectedStatusCode {
+				t.Fatalf("expected status code %d, but got %d", tc.expectedStatusCode, w.Code)
+			}
+			if tc.expectedStatusCode != http.StatusOK {
+				return
+			}
+			var resp struct {
+				ShortKeys []string `json:"short_keys"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("could not decode response: %v", err)
+			}
+			if strings.Join(resp.ShortKeys, ",") != strings.Join(tc.expectedKeys, ",") {
+				t.Errorf("expected keys %v, but got %v", tc.expectedKeys, resp.ShortKeys)
+			}
+		})
+	}
+}
@@ -9,12 +9,24 @@ import (
 	"time"
 
 	"github.com/btcsuite/btcd/btcutil/base58"
+
+	"github.com/iton0/duss/shared/metrics"
+)
+
+var (
+	ErrInvalidURL = errors.New("url cannot be empty")
+	// ErrTooManyKeys is returned when more than MaxBatchSize keys are
+	// requested at once.
+	ErrTooManyKeys = errors.New("too many keys requested")
 )
 
-var ErrInvalidURL = errors.New("url cannot be empty")
+// MaxBatchSize is the most keys GenerateKeys creates in one call.
+const MaxBatchSize = 1000
 
 type KeygenServiceIface interface {
 	GenerateKey(url string) (string, error)
+	// GenerateKeys creates a key for each of urls, in order.
+	GenerateKeys(urls []string) ([]string, error)
 }
 
 // This is a compile-time check to ensure the contract is fulfilled.
@@ -49,6 +61,33 @@ func (s *KeygenService) GenerateKey(url string) (string, error) {
 
 	// make it more compact and URL-safe
 	encodedKey := base58.Encode(truncatedHash)
+	metrics.KeysGenerated.Inc()
 
 	return encodedKey, nil
 }
+
+// GenerateKeys creates a short key for each of urls. Keys are distinct within
+// the batch; like GenerateKey, it does not check them against stored links.
+func (s *KeygenService) GenerateKeys(urls []string) ([]string, error) {
+	if len(urls) > MaxBatchSize {
+		return nil, ErrTooManyKeys
+	}
+
+	keys := make([]string, len(urls))
+	seen := make(map[string]bool, len(urls))
+	for i, url := range urls {
+		for {
+			key, err := s.GenerateKey(url)
+			if err != nil {
+				return nil, err
+			}
+			if !seen[key] {
+				seen[key] = true
+				keys[i] = key
+				break
+			}
+			metrics.KeyCollisions.WithLabelValues(metrics.StageBatch).Inc()
+		}
+	}
+	return keys, nil
+}
@@ -1 +1,69 @@
 package services
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestGenerateKey(t *testing.T) {
+	keygenService := NewKeygenService()
+
+	t.Run("Success - Key Generated", func(t *testing.T) {
+		key, err := keygenService.GenerateKey("https://example.com")
+		if err != nil {
+			t.Fatalf("expected no error, but got %v", err)
+		}
+		if key == "" {
+			t.Fatal("expected a non-empty key")
+		}
+	})
+
+	t.Run("Success - Keys Differ For The Same URL", func(t *testing.T) {
+		first, _ := keygenService.GenerateKey("https://example.com")
+		second, _ := keygenService.GenerateKey("https://example.com")
+		if first == second {
+			t.Errorf("expected distinct keys, but got %s twice", first)
+		}
+	})
+
+	t.Run("Error - Empty URL", func(t *testing.T) {
+		_, err := keygenService.GenerateKey("")
+		if !errors.Is(err, ErrInvalidURL) {
+			t.Fatalf("expected ErrInvalidURL, but got %v", err)
+		}
+	})
+}
+
+func TestGenerateKeys(t *testing.T) {
+	keygenService := NewKeygenService()
+
+	t.Run("Success - Distinct Keys In Order", func(t *testing.T) {
+		urls := []string{"https://example.com", "https://example.com", "https://example.org"}
+		keys, err := keygenService.GenerateKeys(urls)
+		if err != nil {
+			t.Fatalf("expected no error, but got %v", err)
+		}
+		if len(keys) != len(urls) {
+			t.Fatalf("expected %d keys, but got %d", len(urls), len(keys))
+		}
+		seen := map[string]bool{}
+		for _, key := range keys {
+			if key == "" || seen[key] {
+				t.Errorf("expected distinct non-empty keys, but got %v", keys)
+			}
+			seen[key] = true
+		}
+	})
+
+	t.Run("Error - Empty URL", func(t *testing.T) {
+		if _, err := keygenService.GenerateKeys([]string{"https://example.com", ""}); !errors.Is(err, ErrInvalidURL) {
+			t.Fatalf("expected ErrInvalidURL, but got %v", err)
+		}
+	})
+
+	t.Run("Error - Too Many Keys", func(t *testing.T) {
+		if _, err := keygenService.GenerateKeys(make([]string, MaxBatchSize+1)); !errors.Is(err, ErrTooManyKeys) {
+			t.Fatalf("expected ErrTooManyKeys, but got %v", err)
+		}
+	})
+}
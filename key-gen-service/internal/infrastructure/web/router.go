@@ -2,13 +2,35 @@ package web
 
 import (
 	"github.com/gin-gonic/gin"
+
 	"github.com/iton0/duss/key-gen-service/internal/api"
+	"github.com/iton0/duss/key-gen-service/internal/spec"
+	"github.com/iton0/duss/shared/health"
+	"github.com/iton0/duss/shared/logging"
+	"github.com/iton0/duss/shared/metrics"
+	"github.com/iton0/duss/shared/openapi"
+	"github.com/iton0/duss/shared/problem"
+	"github.com/iton0/duss/shared/tracing"
 )
 
 // NewRouter creates a new Gin router and registers all key generator routes.
 func NewRouter(keygenHandler *api.KeygenHandler) *gin.Engine {
-	router := gin.Default()
+	router := gin.New()
+	router.Use(logging.Middleware(), problem.Recovery(), tracing.Middleware(), metrics.Middleware())
+	// Requests must match the API description; responses that do not are
+	// logged.
+	router.Use(spec.Load().Middleware(openapi.WithResponseValidation()))
+	router.NoRoute(problem.NoRoute)
 	router.POST("/api/v1/generate-key", keygenHandler.HandleKeygen)
+	router.POST("/api/v1/generate-keys", keygenHandler.HandleKeygenBatch)
+	router.GET("/metrics", gin.WrapH(metrics.Handler()))
 
 	return router
 }
+
+// RegisterHealth registers the liveness and readiness endpoints served by
+// checker on router.
+func RegisterHealth(router *gin.Engine, checker *health.Checker) {
+	router.GET("/healthz", gin.WrapH(checker.LiveHandler()))
+	router.GET("/readyz", gin.WrapH(checker.ReadyHandler()))
+}
@@ -1 +1,107 @@
 package web_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/iton0/duss/key-gen-service/internal/api"
+	"github.com/iton0/duss/key-gen-service/internal/core/services"
+	"github.com/iton0/duss/key-gen-service/internal/infrastructure/web"
+	"github.com/iton0/duss/key-gen-service/internal/spec"
+	"github.com/iton0/duss/shared/health"
+	"github.com/iton0/duss/shared/testutil/openapitest"
+)
+
+func TestRouter(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	keygenHandler := api.NewKeygenHandler(services.NewKeygenService())
+	router := web.NewRouter(keygenHandler)
+	web.RegisterHealth(router, health.New("key-gen-service"))
+
+	testCases := []struct {
+		name               string
+		method             string
+		path               string
+		body               string
+		expectedStatusCode int
+	}{
+		{
+			name:               "Valid POST Request",
+			method:             http.MethodPost,
+			path:               "/api/v1/generate-key",
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:               "Valid Batch Request",
+			method:             http.MethodPost,
+			path:               "/api/v1/generate-keys",
+			body:               `{"urls":["https://example.com","https://example.org"]}`,
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:               "GET on POST Endpoint",
+			method:             http.MethodGet,
+			path:               "/api/v1/generate-key",
+			expectedStatusCode: http.StatusNotFound,
+		},
+		{
+			name:               "Invalid Path",
+			method:             http.MethodPost,
+			path:               "/api/v1/unknown",
+			expectedStatusCode: http.StatusNotFound,
+		},
+		{
+			name:               "Liveness",
+			method:             http.MethodGet,
+			path:               "/healthz",
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:               "Readiness",
+			method:             http.MethodGet,
+			path:               "/readyz",
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:               "Metrics",
+			method:             http.MethodGet,
+			path:               "/metrics",
+			expectedStatusCode: http.StatusOK,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			body := tc.body
+			if body == "" {
+				body = `{"url":"https://example.com"}`
+			}
+			req, _ := http.NewRequest(tc.method, tc.path, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+
+			router.ServeHTTP(w, req)
+
+			if w.Code != tc.expectedStatusCode {
+				t.Errorf("for %s %s, expected status code %d, but got %d", tc.method, tc.path, tc.expectedStatusCode, w.Code)
+			}
+			openapitest.CheckResponse(t, spec.Load(), req, w)
+		})
+	}
+}
+
+// TestRouterMatchesSpec fails when a route is added or removed without
+// updating the API description, or the other way around.
+func TestRouterMatchesSpec(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := web.NewRouter(api.NewKeygenHandler(services.NewKeygenService()))
+	web.RegisterHealth(router, health.New("key-gen-service"))
+
+	openapitest.CheckRoutes(t, spec.Load(), router.Routes())
+}
@@ -0,0 +1,18 @@
+// Package spec holds the OpenAPI description of the key-gen-service's API.
+package spec
+
+import (
+	_ "embed"
+	"sync"
+
+	"github.com/iton0/duss/shared/openapi"
+)
+
+//go:embed openapi.yaml
+var document []byte
+
+// Load returns the service's API description. The description is embedded
+// in the binary, and the router's tests check that it is valid.
+var Load = sync.OnceValue(func() *openapi.Spec {
+	return openapi.MustLoad(document)
+})
@@ -0,0 +1,473 @@
+// Package config loads typed service configuration.
+//
+// A service describes its configuration as a struct whose fields carry tags:
+//
+//	type Config struct {
+//		Server    config.Server `config:"server"`
+//		Redis     config.Redis  `config:"redis"`
+//		KeyGenURL string        `config:"keygen_url" env:"KEY_GEN_SERVICE_URL" required:"true"`
+//	}
+//
+// The tags are:
+//
+//   - config names the key in a YAML or TOML config file. Nested structs
+//     become nested tables.
+//   - env names the environment variable that sets the field.
+//   - default is the value used when no other source sets the field.
+//   - required rejects a zero value once every source has been applied. On a
+//     nested struct it requires each of the struct's fields.
+//   - secret redacts the value when the configuration is printed.
+//
+// Sources are applied in increasing order of precedence: defaults, the
+// config file, a .env file in the working directory, and finally the process
+// environment. Both the config file and the .env file are optional.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// FileEnv names the environment variable that may point at a config file
+// when --config is not given.
+const FileEnv = "CONFIG_FILE"
+
+// DotEnvFile is the optional dotenv file read from the working directory.
+const DotEnvFile = ".env"
+
+// redacted replaces the value of secret fields in Print.
+const redacted = "[REDACTED]"
+
+// ErrInvalidConfig is returned when a loaded configuration fails validation.
+var ErrInvalidConfig = errors.New("invalid configuration")
+
+// Validator is implemented by configuration structs that need checks beyond
+// required fields, such as rules spanning several fields. Validate is called
+// after every source has been applied.
+type Validator interface {
+	Validate() error
+}
+
+// Server holds the settings shared by every service's HTTP server.
+type Server struct {
+	Port int `config:"port" env:"SERVER_PORT" default:"8080" required:"true"`
+	// DrainDelay is how long a stopping server keeps serving, while
+	// reporting it is not ready, so load balancers stop sending it requests.
+	DrainDelay time.Duration `config:"drain_delay" env:"SHUTDOWN_DRAIN_DELAY" default:"5s"`
+	// ShutdownTimeout bounds how long in-flight requests and background
+	// work may take to finish once it stops accepting requests.
+	ShutdownTimeout time.Duration `config:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT" default:"20s"`
+}
+
+// Addr returns the address the server listens on.
+func (s Server) Addr() string {
+	return fmt.Sprintf(":%d", s.Port)
+}
+
+// Postgres holds the PostgreSQL connection settings. The DSN has no default,
+// so a deployment that forgets it fails at startup rather than dialling a
+// made-up server; services that need PostgreSQL mark the section required.
+type Postgres struct {
+	DSN string `config:"dsn" env:"POSTGRES_DSN" secret:"true"`
+}
+
+// Redis holds the Redis connection settings.
+type Redis struct {
+	Addr     string `config:"addr" env:"REDIS_ADDR" default:"localhost:6379"`
+	Password string `config:"password" env:"REDIS_PASSWORD" secret:"true"`
+	DB       int    `config:"db" env:"REDIS_DB"`
+}
+
+// Flags are the command-line flags understood by every service.
+type Flags struct {
+	// File is the path of a YAML (.yaml, .yml) or TOML (.toml) config file.
+	File string
+	// Print requests that the loaded configuration be printed and the
+	// process exit.
+	Print bool
+}
+
+// ParseFlags parses --config and --print-config from args, which should not
+// include the program name.
+func ParseFlags(name string, args []string) (Flags, error) {
+	var f Flags
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&f.File, "config", os.Getenv(FileEnv), "path to a YAML or TOML config file")
+	fs.BoolVar(&f.Print, "print-config", false, "print the loaded configuration with secrets redacted and exit")
+	if err := fs.Parse(args); err != nil {
+		return Flags{}, err
+	}
+	return f, nil
+}
+
+// MustLoad is the entry point used by each service's main function. It parses
+// the command line, loads cfg, and, when --print-config is given, prints cfg
+// to stdout and exits, failing if it is invalid. Any error is fatal.
+func MustLoad(name string, cfg any) {
+	flags, err := ParseFlags(name, os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		os.Exit(2)
+	}
+
+	if flags.Print {
+		if err := LoadAndPrint(os.Stdout, cfg, flags.File); err != nil {
+			log.Fatalf("failed to load configuration: %v", err)
+		}
+		os.Exit(0)
+	}
+
+	if err := Load(cfg, flags.File); err != nil {
+		log.Fatalf("failed to load configuration: %v", err)
+	}
+}
+
+// Load populates cfg, a pointer to a struct, from defaults, the config file
+// at path (if non-empty), the .env file (if present) and the environment,
+// then validates it.
+func Load(cfg any, path string) error {
+	if err := populate(cfg, path); err != nil {
+		return err
+	}
+	return validate(cfg, reflect.ValueOf(cfg).Elem())
+}
+
+// LoadAndPrint populates cfg like Load and writes it to w with Print before
+// validating it, so that a configuration that fails validation can still be
+// inspected. It returns the validation error, if any, once cfg is printed.
+func LoadAndPrint(w io.Writer, cfg any, path string) error {
+	if err := populate(cfg, path); err != nil {
+		return err
+	}
+	if err := Print(w, cfg); err != nil {
+		return err
+	}
+	return validate(cfg, reflect.ValueOf(cfg).Elem())
+}
+
+// populate applies every source to cfg without validating it.
+func populate(cfg any, path string) error {
+	v := reflect.ValueOf(cfg)
+	if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("config: expected a pointer to a struct, but got %T", cfg)
+	}
+	root := v.Elem()
+
+	if err := applyDefaults(root); err != nil {
+		return err
+	}
+
+	if path != "" {
+		values, err := readFile(path)
+		if err != nil {
+			return err
+		}
+		if err := applyFile(root, values, ""); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	// godotenv never overrides variables that are already set, so the real
+	// environment keeps precedence over .env.
+	if err := godotenv.Load(DotEnvFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read %s: %w", DotEnvFile, err)
+	}
+
+	return applyEnv(root)
+}
+
+// Print writes cfg as YAML with secret fields redacted.
+func Print(w io.Writer, cfg any) error {
+	v := reflect.Indirect(reflect.ValueOf(cfg))
+	if v.Kind() != reflect.Struct {
+		return fmt.Errorf("config: expected a struct, but got %T", cfg)
+	}
+	return printStruct(w, v, 0)
+}
+
+// fields calls fn for every exported field of the struct v.
+func fields(v reflect.Value, fn func(f reflect.StructField, fv reflect.Value) error) error {
+	t := v.Type()
+	for i := range t.NumField() {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		if err := fn(f, v.Field(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isSection reports whether a field is a nested configuration struct rather
+// than a single value.
+func isSection(fv reflect.Value) bool {
+	return fv.Kind() == reflect.Struct && fv.Type() != reflect.TypeFor[time.Time]()
+}
+
+func applyDefaults(v reflect.Value) error {
+	return fields(v, func(f reflect.StructField, fv reflect.Value) error {
+		if isSection(fv) {
+			return applyDefaults(fv)
+		}
+		def, ok := f.Tag.Lookup("default")
+		if !ok || !fv.IsZero() {
+			return nil
+		}
+		if err := setString(fv, def); err != nil {
+			return fmt.Errorf("config: bad default for %s: %w", f.Name, err)
+		}
+		return nil
+	})
+}
+
+func applyEnv(v reflect.Value) error {
+	return fields(v, func(f reflect.StructField, fv reflect.Value) error {
+		if isSection(fv) {
+			return applyEnv(fv)
+		}
+		name := f.Tag.Get("env")
+		if name == "" {
+			return nil
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return nil
+		}
+		if err := setString(fv, value); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		return nil
+	})
+}
+
+// readFile decodes a YAML or TOML file, chosen by extension, into a generic
+// tree.
+func readFile(path string) (map[string]any, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	values := map[string]any{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &values)
+	case ".toml":
+		err = toml.Unmarshal(data, &values)
+	default:
+		return nil, fmt.Errorf("unsupported config file type %q: use .yaml, .yml or .toml", ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	return values, nil
+}
+
+// applyFile copies values onto the struct v. Keys that do not name a field
+// are rejected so that typos do not silently fall back to defaults.
+func applyFile(v reflect.Value, values map[string]any, prefix string) error {
+	known := map[string]bool{}
+	err := fields(v, func(f reflect.StructField, fv reflect.Value) error {
+		key := f.Tag.Get("config")
+		if key == "" {
+			return nil
+		}
+		known[key] = true
+		raw, ok := values[key]
+		if !ok {
+			return nil
+		}
+
+		if isSection(fv) {
+			nested, ok := raw.(map[string]any)
+			if !ok {
+				return fmt.Errorf("%s%s: expected a table, but got %T", prefix, key, raw)
+			}
+			return applyFile(fv, nested, prefix+key+".")
+		}
+
+		if err := setString(fv, fileString(raw)); err != nil {
+			return fmt.Errorf("%s%s: %w", prefix, key, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for key := range values {
+		if !known[key] {
+			return fmt.Errorf("unknown key %s%s", prefix, key)
+		}
+	}
+	return nil
+}
+
+// fileString renders a decoded file value in the same textual form an
+// environment variable would use.
+func fileString(raw any) string {
+	switch r := raw.(type) {
+	case string:
+		return r
+	case []any:
+		parts := make([]string, len(r))
+		for i, p := range r {
+			parts[i] = fmt.Sprint(p)
+		}
+		return strings.Join(parts, ",")
+	default:
+		return fmt.Sprint(r)
+	}
+}
+
+// setString parses s into fv according to fv's type.
+func setString(fv reflect.Value, s string) error {
+	if fv.Type() == reflect.TypeFor[time.Duration]() {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		fv.SetInt(int64(d))
+		return nil
+	}
+
+	switch fv.Kind() {
+	case reflect.String:
+		fv.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		fv.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, fv.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, fv.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(s, fv.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetFloat(n)
+	case reflect.Slice:
+		if fv.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported field type %s", fv.Type())
+		}
+		var parts []string
+		for p := range strings.SplitSeq(s, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				parts = append(parts, p)
+			}
+		}
+		fv.Set(reflect.ValueOf(parts))
+	default:
+		return fmt.Errorf("unsupported field type %s", fv.Type())
+	}
+	return nil
+}
+
+// validate checks required fields and then the struct's own Validate method,
+// reporting every missing field at once.
+func validate(cfg any, root reflect.Value) error {
+	var missing []string
+	var walk func(v reflect.Value, prefix string, required bool)
+	walk = func(v reflect.Value, prefix string, required bool) {
+		_ = fields(v, func(f reflect.StructField, fv reflect.Value) error {
+			key := f.Tag.Get("config")
+			if isSection(fv) {
+				walk(fv, prefix+key+".", required || f.Tag.Get("required") == "true")
+				return nil
+			}
+			if (required || f.Tag.Get("required") == "true") && fv.IsZero() {
+				name := prefix + key
+				if env := f.Tag.Get("env"); env != "" {
+					name += " (" + env + ")"
+				}
+				missing = append(missing, name)
+			}
+			return nil
+		})
+	}
+	walk(root, "", false)
+
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: missing required %s", ErrInvalidConfig, strings.Join(missing, ", "))
+	}
+
+	if v, ok := cfg.(Validator); ok {
+		if err := v.Validate(); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+		}
+	}
+	return nil
+}
+
+func printStruct(w io.Writer, v reflect.Value, depth int) error {
+	indent := strings.Repeat("  ", depth)
+	return fields(v, func(f reflect.StructField, fv reflect.Value) error {
+		key := f.Tag.Get("config")
+		if key == "" {
+			return nil
+		}
+
+		if isSection(fv) {
+			if _, err := fmt.Fprintf(w, "%s%s:\n", indent, key); err != nil {
+				return err
+			}
+			return printStruct(w, fv, depth+1)
+		}
+
+		_, err := fmt.Fprintf(w, "%s%s: %s\n", indent, key, formatValue(f, fv))
+		return err
+	})
+}
+
+// formatValue renders a single field as a YAML scalar or flow sequence.
+func formatValue(f reflect.StructField, fv reflect.Value) string {
+	if f.Tag.Get("secret") == "true" && !fv.IsZero() {
+		return strconv.Quote(redacted)
+	}
+
+	if d, ok := fv.Interface().(time.Duration); ok {
+		return d.String()
+	}
+
+	switch fv.Kind() {
+	case reflect.String:
+		return strconv.Quote(fv.String())
+	case reflect.Slice:
+		parts := make([]string, fv.Len())
+		for i := range fv.Len() {
+			parts[i] = strconv.Quote(fv.Index(i).String())
+		}
+		return "[" + strings.Join(parts, ", ") + "]"
+	default:
+		return fmt.Sprint(fv.Interface())
+	}
+}
@@ -0,0 +1,357 @@
+package config_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iton0/duss/shared/config"
+)
+
+type testConfig struct {
+	Server   config.Server   `config:"server"`
+	Postgres config.Postgres `config:"postgres"`
+	Redis    config.Redis    `config:"redis"`
+	KeyGen   string          `config:"keygen_url" env:"TEST_KEYGEN_URL" required:"true"`
+	Timeout  time.Duration   `config:"timeout" env:"TEST_TIMEOUT" default:"5s"`
+	Domains  []string        `config:"domains" env:"TEST_DOMAINS"`
+}
+
+type validatedConfig struct {
+	Min int `config:"min" env:"TEST_MIN" default:"1"`
+	Max int `config:"max" env:"TEST_MAX" default:"2"`
+}
+
+func (c *validatedConfig) Validate() error {
+	if c.Min > c.Max {
+		return errors.New("min must not exceed max")
+	}
+	return nil
+}
+
+// isolate runs the test in an empty directory, so no stray .env is read, and
+// clears the variables the tests use.
+func isolate(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	t.Chdir(dir)
+	for _, name := range []string{
+		"SERVER_PORT", "POSTGRES_DSN", "REDIS_ADDR", "REDIS_PASSWORD", "REDIS_DB",
+		"TEST_KEYGEN_URL", "TEST_TIMEOUT", "TEST_DOMAINS", "TEST_MIN", "TEST_MAX",
+	} {
+		if value, ok := os.LookupEnv(name); ok {
+			os.Unsetenv(name)
+			t.Cleanup(func() { os.Setenv(name, value) })
+		}
+	}
+	return dir
+}
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write %s: %v", name, err)
+	}
+	return path
+}
+
+func TestLoadDefaultsAndEnv(t *testing.T) {
+	isolate(t)
+	t.Setenv("TEST_KEYGEN_URL", "http://keygen:8080")
+	t.Setenv("REDIS_DB", "3")
+	t.Setenv("TEST_DOMAINS", "a.test, b.test")
+
+	var cfg testConfig
+	if err := config.Load(&cfg, ""); err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+
+	if cfg.Server.Port != 8080 {
+		t.Errorf("expected default port 8080, but got %d", cfg.Server.Port)
+	}
+	if cfg.Redis.Addr != "localhost:6379" {
+		t.Errorf("expected default Redis address, but got %q", cfg.Redis.Addr)
+	}
+	if cfg.Redis.DB != 3 {
+		t.Errorf("expected Redis DB 3, but got %d", cfg.Redis.DB)
+	}
+	if cfg.Timeout != 5*time.Second {
+		t.Errorf("expected default timeout 5s, but got %v", cfg.Timeout)
+	}
+	if cfg.KeyGen != "http://keygen:8080" {
+		t.Errorf("expected key-gen URL from the environment, but got %q", cfg.KeyGen)
+	}
+	if len(cfg.Domains) != 2 || cfg.Domains[0] != "a.test" || cfg.Domains[1] != "b.test" {
+		t.Errorf("expected domains [a.test b.test], but got %v", cfg.Domains)
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	testCases := []struct {
+		name    string
+		file    string
+		content string
+	}{
+		{
+			name: "YAML",
+			file: "config.yaml",
+			content: `
+server:
+  port: 9090
+redis:
+  addr: redis:6379
+keygen_url: http://keygen:8080
+timeout: 250ms
+domains: [a.test, b.test]
+`,
+		},
+		{
+			name: "TOML",
+			file: "config.toml",
+			content: `
+keygen_url = "http://keygen:8080"
+timeout = "250ms"
+domains = ["a.test", "b.test"]
+
+[server]
+port = 9090
+
+[redis]
+addr = "redis:6379"
+`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := isolate(t)
+			path := writeFile(t, dir, tc.file, tc.content)
+
+			var cfg testConfig
+			if err := config.Load(&cfg, path); err != nil {
+				t.Fatalf("expected no error, but got %v", err)
+			}
+
+			if cfg.Server.Port != 9090 {
+				t.Errorf("expected port 9090, but got %d", cfg.Server.Port)
+			}
+			if cfg.Redis.Addr != "redis:6379" {
+				t.Errorf("expected Redis address from file, but got %q", cfg.Redis.Addr)
+			}
+			if cfg.Timeout != 250*time.Millisecond {
+				t.Errorf("expected timeout 250ms, but got %v", cfg.Timeout)
+			}
+			if len(cfg.Domains) != 2 {
+				t.Errorf("expected two domains, but got %v", cfg.Domains)
+			}
+			if cfg.Postgres.DSN != "" {
+				t.Errorf("expected no default DSN, but got %q", cfg.Postgres.DSN)
+			}
+		})
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	dir := isolate(t)
+	path := writeFile(t, dir, "config.yaml", "server:\n  port: 9090\nkeygen_url: http://from-file\n")
+	writeFile(t, dir, config.DotEnvFile, "SERVER_PORT=9191\nTEST_KEYGEN_URL=http://from-dotenv\n")
+	t.Setenv("TEST_KEYGEN_URL", "http://from-env")
+
+	var cfg testConfig
+	if err := config.Load(&cfg, path); err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+
+	if cfg.Server.Port != 9191 {
+		t.Errorf("expected .env to override the file, but got port %d", cfg.Server.Port)
+	}
+	if cfg.KeyGen != "http://from-env" {
+		t.Errorf("expected the environment to override .env, but got %q", cfg.KeyGen)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	testCases := []struct {
+		name        string
+		file        string
+		content     string
+		env         map[string]string
+		cfg         any
+		expectedErr error
+	}{
+		{
+			name:        "Missing Required",
+			cfg:         &testConfig{},
+			expectedErr: config.ErrInvalidConfig,
+		},
+		{
+			name: "Bad Integer",
+			env:  map[string]string{"TEST_KEYGEN_URL": "http://k", "SERVER_PORT": "eighty"},
+			cfg:  &testConfig{},
+		},
+		{
+			name:    "Unknown Key",
+			file:    "config.yaml",
+			content: "keygen_url: http://k\nsevrer:\n  port: 1\n",
+			cfg:     &testConfig{},
+		},
+		{
+			name:    "Unsupported Extension",
+			file:    "config.json",
+			content: "{}",
+			cfg:     &testConfig{},
+		},
+		{
+			name:        "Validator",
+			env:         map[string]string{"TEST_MIN": "5"},
+			cfg:         &validatedConfig{},
+			expectedErr: config.ErrInvalidConfig,
+		},
+		{
+			name: "Not A Pointer",
+			cfg:  testConfig{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := isolate(t)
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+			var path string
+			if tc.file != "" {
+				path = writeFile(t, dir, tc.file, tc.content)
+			}
+
+			err := config.Load(tc.cfg, path)
+			if err == nil {
+				t.Fatal("expected an error, but got nil")
+			}
+			if tc.expectedErr != nil && !errors.Is(err, tc.expectedErr) {
+				t.Errorf("expected error %v, but got %v", tc.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestMissingRequiredNamesVariable(t *testing.T) {
+	isolate(t)
+
+	err := config.Load(&testConfig{}, "")
+	if err == nil || !strings.Contains(err.Error(), "TEST_KEYGEN_URL") {
+		t.Errorf("expected the error to name TEST_KEYGEN_URL, but got %v", err)
+	}
+}
+
+func TestRequiredSection(t *testing.T) {
+	isolate(t)
+
+	var cfg struct {
+		Postgres config.Postgres `config:"postgres" required:"true"`
+	}
+	err := config.Load(&cfg, "")
+	if !errors.Is(err, config.ErrInvalidConfig) || !strings.Contains(err.Error(), "postgres.dsn (POSTGRES_DSN)") {
+		t.Errorf("expected the error to name postgres.dsn (POSTGRES_DSN), but got %v", err)
+	}
+
+	t.Setenv("POSTGRES_DSN", "postgres://db/duss")
+	if err := config.Load(&cfg, ""); err != nil {
+		t.Errorf("expected no error, but got %v", err)
+	}
+}
+
+func TestPrintRedactsSecrets(t *testing.T) {
+	cfg := testConfig{
+		Server:   config.Server{Port: 8080},
+		Postgres: config.Postgres{DSN: "postgres://user:hunter2@db/duss"},
+		Redis:    config.Redis{Addr: "redis:6379", Password: "s3cret"},
+		KeyGen:   "http://keygen:8080",
+		Timeout:  time.Second,
+	}
+
+	var out strings.Builder
+	if err := config.Print(&out, &cfg); err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	got := out.String()
+
+	for _, secret := range []string{"hunter2", "s3cret"} {
+		if strings.Contains(got, secret) {
+			t.Errorf("expected %q to be redacted, but got:\n%s", secret, got)
+		}
+	}
+	for _, want := range []string{"port: 8080", `addr: "redis:6379"`, `keygen_url: "http://keygen:8080"`, "timeout: 1s", "[REDACTED]"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected output to contain %q, but got:\n%s", want, got)
+		}
+	}
+}
+
+func TestLoadAndPrintInvalid(t *testing.T) {
+	isolate(t)
+	t.Setenv("SERVER_PORT", "9090")
+
+	var cfg testConfig
+	var out strings.Builder
+	err := config.LoadAndPrint(&out, &cfg, "")
+	if !errors.Is(err, config.ErrInvalidConfig) {
+		t.Errorf("expected ErrInvalidConfig, but got %v", err)
+	}
+	if !strings.Contains(out.String(), "port: 9090") {
+		t.Errorf("expected the invalid configuration to be printed, but got:\n%s", out.String())
+	}
+}
+
+func TestPrintRoundTrips(t *testing.T) {
+	dir := isolate(t)
+	t.Setenv("TEST_KEYGEN_URL", "http://keygen:8080")
+	t.Setenv("TEST_DOMAINS", "a.test,b.test")
+
+	var cfg testConfig
+	if err := config.Load(&cfg, ""); err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	cfg.Postgres.DSN = ""
+
+	var out strings.Builder
+	if err := config.Print(&out, &cfg); err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+
+	path := writeFile(t, dir, "printed.yaml", out.String())
+	var reloaded testConfig
+	if err := config.Load(&reloaded, path); err != nil {
+		t.Fatalf("expected printed config to load, but got %v", err)
+	}
+	if reloaded.KeyGen != cfg.KeyGen || reloaded.Timeout != cfg.Timeout || len(reloaded.Domains) != 2 {
+		t.Errorf("expected %+v, but got %+v", cfg, reloaded)
+	}
+}
+
+func TestParseFlags(t *testing.T) {
+	t.Setenv(config.FileEnv, "/etc/duss/from-env.yaml")
+
+	flags, err := config.ParseFlags("test", []string{"--print-config"})
+	if err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	if !flags.Print {
+		t.Error("expected Print to be set")
+	}
+	if flags.File != "/etc/duss/from-env.yaml" {
+		t.Errorf("expected file from %s, but got %q", config.FileEnv, flags.File)
+	}
+
+	flags, err = config.ParseFlags("test", []string{"--config", "local.toml"})
+	if err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	if flags.File != "local.toml" || flags.Print {
+		t.Errorf("expected File %q and Print false, but got %+v", "local.toml", flags)
+	}
+}
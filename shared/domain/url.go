@@ -4,9 +4,88 @@ import "time"
 
 // URL represents a shortened URL entity.
 // This is a shared domain model used by multiple services.
+//
+// A short key is unique within its short domain, so the same key may exist
+// on several domains. LongURL is the URL exactly as it was submitted and is
+// where the link redirects to; CanonicalURL is its normalized form, under
+// which equivalent URLs compare equal. A disabled link is kept, with the
+// reason it was disabled, but no longer redirects. An untrusted link shows
+// visitors a warning with its destination instead of redirecting directly,
+// a protected link asks them for its password, and a signed link only
+// redirects through a short URL carrying its signature.
 type URL struct {
-	ShortKey  string    `json:"short_key"`
-	LongURL   string    `json:"long_url"`
-	CreatedAt time.Time `json:"created_at"`
-	Redirects int       `json:"redirects"`
+	Domain       string    `json:"domain"`
+	ShortKey     string    `json:"short_key"`
+	LongURL      string    `json:"long_url"`
+	CanonicalURL string    `json:"canonical_url,omitempty"`
+	Owner        string    `json:"owner,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	ExpiresAt    time.Time `json:"expires_at,omitzero"`
+	Redirects    int       `json:"redirects"`
+
+	DisabledAt     time.Time `json:"disabled_at,omitzero"`
+	DisabledReason string    `json:"disabled_reason,omitempty"`
+	Untrusted      bool      `json:"untrusted,omitempty"`
+
+	// PasswordHash is the bcrypt hash of the password of a protected link.
+	// It travels between the services that store and cache links; APIs
+	// return links through Redacted, which drops it.
+	PasswordHash string `json:"password_hash,omitempty"`
+	// Protected tells API clients that the link has a password.
+	Protected bool `json:"protected,omitempty"`
+	// Signed links only redirect through short URLs carrying a valid
+	// signature, so their bare key cannot be guessed or enumerated.
+	Signed bool `json:"signed,omitempty"`
+
+	// DedupeKey identifies the owner and canonical URL of a link created in
+	// dedupe mode. At most one link per domain carries a given DedupeKey;
+	// it is empty for links that were not deduplicated.
+	DedupeKey string `json:"-"`
+}
+
+// IsExpired reports whether the URL has an expiry set that lies at or before now.
+// A zero ExpiresAt means the URL never expires.
+func (u *URL) IsExpired(now time.Time) bool {
+	return !u.ExpiresAt.IsZero() && !now.Before(u.ExpiresAt)
+}
+
+// IsDisabled reports whether the link has been disabled.
+func (u *URL) IsDisabled() bool {
+	return !u.DisabledAt.IsZero()
+}
+
+// IsProtected reports whether visitors must enter a password to follow the
+// link.
+func (u *URL) IsProtected() bool {
+	return u.PasswordHash != ""
+}
+
+// Redacted returns a copy of the URL fit for API responses: its password
+// hash is dropped and Protected set instead. Unless the response is for an
+// administrator, the owner is dropped too, and so is a protected link's
+// destination, since knowing it would let a visitor skip the password.
+func (u *URL) Redacted(admin bool) *URL {
+	r := *u
+	if !admin {
+		r.Owner = ""
+	}
+	if r.IsProtected() {
+		r.Protected = true
+		r.PasswordHash = ""
+		if !admin {
+			r.LongURL, r.CanonicalURL = "", ""
+		}
+	}
+	return &r
+}
+
+// ID returns the identifier of the URL across all short domains.
+func (u *URL) ID() string {
+	return LinkID(u.Domain, u.ShortKey)
+}
+
+// LinkID returns the identifier of shortKey on shortDomain, for use by
+// stores, such as Redis, that key entries by a single string.
+func LinkID(shortDomain, shortKey string) string {
+	return shortDomain + "/" + shortKey
 }
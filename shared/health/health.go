@@ -0,0 +1,296 @@
+// Package health reports whether a service is alive and ready to serve.
+//
+// A Checker holds the checks of a service's dependencies, such as pinging its
+// database or asking another service whether it is ready. Its LiveHandler
+// answers /healthz as soon as the process serves HTTP; its ReadyHandler
+// answers /readyz by running every check and reporting each one's outcome
+// and latency, with 503 Service Unavailable if any failed or the service is
+// draining before it shuts down.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultTimeout bounds each check.
+const DefaultTimeout = 2 * time.Second
+
+// The statuses of a Report and of its checks.
+const (
+	StatusUp   = "up"
+	StatusDown = "down"
+)
+
+// ErrNotReady is returned by the checks of remote services that are not
+// ready.
+var ErrNotReady = errors.New("not ready")
+
+// Check reports whether a dependency is usable, returning an error if not.
+type Check func(ctx context.Context) error
+
+// Result is the outcome of one check.
+type Result struct {
+	Status string `json:"status"`
+	// LatencyMS is how long the check took, in milliseconds.
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+	// Report is the readiness of a remote service, for checks made with
+	// Remote.
+	Report *Report `json:"report,omitempty"`
+}
+
+// Report is the readiness of a service: StatusUp if every check passed.
+type Report struct {
+	Service string            `json:"service"`
+	Status  string            `json:"status"`
+	Checks  map[string]Result `json:"checks,omitempty"`
+}
+
+// Up reports whether the service is ready.
+func (r Report) Up() bool {
+	return r.Status == StatusUp
+}
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Checker runs the readiness checks of a service. It is safe for concurrent
+// use.
+type Checker struct {
+	service string
+	timeout time.Duration
+
+	mu     sync.RWMutex
+	checks []namedCheck
+
+	draining atomic.Bool
+}
+
+// Option configures optional settings of a Checker.
+type Option func(*Checker)
+
+// WithTimeout sets how long each check may take before it fails. The
+// default is DefaultTimeout.
+func WithTimeout(d time.Duration) Option {
+	return func(c *Checker) {
+		c.timeout = d
+	}
+}
+
+// New creates a Checker for the named service with no checks.
+func New(service string, opts ...Option) *Checker {
+	c := &Checker{service: service, timeout: DefaultTimeout}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Register adds a check of the named dependency.
+func (c *Checker) Register(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks = append(c.checks, namedCheck{name: name, check: check})
+}
+
+// Drain makes the service report it is not ready from now on, so that it
+// stops being sent requests before it shuts down.
+func (c *Checker) Drain() {
+	c.draining.Store(true)
+}
+
+// Check runs every check concurrently and reports their outcomes. Once the
+// Checker is draining it reports the service down without running them.
+func (c *Checker) Check(ctx context.Context) Report {
+	if c.draining.Load() {
+		return Report{Service: c.service, Status: StatusDown, Checks: map[string]Result{
+			"shutdown": {Status: StatusDown, Error: "shutting down"},
+		}}
+	}
+
+	c.mu.RLock()
+	checks := slices.Clone(c.checks)
+	c.mu.RUnlock()
+
+	report := Report{Service: c.service, Status: StatusUp}
+	if len(checks) == 0 {
+		return report
+	}
+
+	results := make([]Result, len(checks))
+	var wg sync.WaitGroup
+	for i, nc := range checks {
+		wg.Go(func() {
+			results[i] = c.run(ctx, nc.check)
+		})
+	}
+	wg.Wait()
+
+	report.Checks = make(map[string]Result, len(checks))
+	for i, nc := range checks {
+		report.Checks[nc.name] = results[i]
+		if results[i].Status != StatusUp {
+			report.Status = StatusDown
+		}
+	}
+	return report
+}
+
+// remoteKey carries the Report a Remote check fetched back to run.
+type remoteKey struct{}
+
+// run runs check within the Checker's timeout.
+func (c *Checker) run(ctx context.Context, check Check) Result {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	var remote *Report
+	ctx = context.WithValue(ctx, remoteKey{}, &remote)
+
+	start := time.Now()
+	err := check(ctx)
+	result := Result{
+		Status:    StatusUp,
+		LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+		Report:    remote,
+	}
+	if err != nil {
+		result.Status = StatusDown
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// LiveHandler returns a handler that answers 200 OK to show the process is
+// up. It checks nothing, so a failing dependency never gets the service
+// restarted.
+func (c *Checker) LiveHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, Report{Service: c.service, Status: StatusUp})
+	})
+}
+
+// ReadyHandler returns a handler that runs the checks and answers 200 OK
+// with their Report if all passed, and 503 Service Unavailable otherwise.
+func (c *Checker) ReadyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := c.Check(r.Context())
+		status := http.StatusOK
+		if !report.Up() {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, report)
+	})
+}
+
+// Doer sends HTTP requests. *http.Client and *httpclient.Client implement
+// it.
+type Doer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// Fetch asks the service whose readiness endpoint is url for its Report.
+func Fetch(ctx context.Context, client Doer, url string) (Report, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return Report{}, fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return Report{}, err
+	}
+	defer resp.Body.Close()
+
+	var report Report
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return Report{}, err
+	}
+	if err := json.Unmarshal(body, &report); err != nil || report.Status == "" {
+		return Report{}, fmt.Errorf("unexpected readiness response with status %d", resp.StatusCode)
+	}
+	return report, nil
+}
+
+// Remote returns a Check that passes if the service whose readiness
+// endpoint is url reports it is ready. The check's Result includes the
+// service's Report.
+func Remote(client Doer, url string) Check {
+	return func(ctx context.Context) error {
+		report, err := Fetch(ctx, client, url)
+		if err != nil {
+			return err
+		}
+		if remote, ok := ctx.Value(remoteKey{}).(**Report); ok {
+			*remote = &report
+		}
+		if !report.Up() {
+			return fmt.Errorf("%s is %w", report.Service, ErrNotReady)
+		}
+		return nil
+	}
+}
+
+// System is the readiness of every service of a deployment.
+type System struct {
+	Status   string            `json:"status"`
+	Services map[string]Report `json:"services"`
+}
+
+// SystemHandler returns a handler that reports the readiness of the
+// Checker's service and, through the Reports its Remote checks fetched, of
+// the services behind it, answering 503 Service Unavailable unless all are
+// ready.
+func (c *Checker) SystemHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := c.Check(r.Context())
+		system := System{Status: StatusUp, Services: map[string]Report{}}
+		collect(system.Services, report)
+		for _, s := range system.Services {
+			if !s.Up() {
+				system.Status = StatusDown
+			}
+		}
+
+		status := http.StatusOK
+		if system.Status != StatusUp {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, system)
+	})
+}
+
+// collect adds report and the remote Reports within it to services, each
+// listed once rather than nested in the checks that fetched them.
+func collect(services map[string]Report, report Report) {
+	checks := maps.Clone(report.Checks)
+	for _, name := range slices.Sorted(maps.Keys(checks)) {
+		result := checks[name]
+		if result.Report != nil {
+			collect(services, *result.Report)
+			result.Report = nil
+			checks[name] = result
+		}
+	}
+	report.Checks = checks
+	services[report.Service] = report
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
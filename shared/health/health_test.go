@@ -0,0 +1,160 @@
+package health_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/iton0/duss/shared/health"
+)
+
+func TestReadyHandler(t *testing.T) {
+	testCases := []struct {
+		name           string
+		checks         map[string]health.Check
+		expectedStatus int
+		expectedDown   []string
+	}{
+		{"No Checks", nil, http.StatusOK, nil},
+		{"All Up", map[string]health.Check{
+			"postgres": func(context.Context) error { return nil },
+			"redis":    func(context.Context) error { return nil },
+		}, http.StatusOK, nil},
+		{"One Down", map[string]health.Check{
+			"postgres": func(context.Context) error { return nil },
+			"redis":    func(context.Context) error { return errors.New("connection refused") },
+		}, http.StatusServiceUnavailable, []string{"redis"}},
+		{"Timed Out", map[string]health.Check{
+			"postgres": func(ctx context.Context) error {
+				<-ctx.Done()
+				return ctx.Err()
+			},
+		}, http.StatusServiceUnavailable, []string{"postgres"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			checker := health.New("svc", health.WithTimeout(20*time.Millisecond))
+			for name, check := range tc.checks {
+				checker.Register(name, check)
+			}
+
+			w := httptest.NewRecorder()
+			checker.ReadyHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+			if w.Code != tc.expectedStatus {
+				t.Fatalf("expected status %d, but got %d", tc.expectedStatus, w.Code)
+			}
+			var report health.Report
+			if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+				t.Fatalf("could not decode report: %v", err)
+			}
+			if report.Service != "svc" || len(report.Checks) != len(tc.checks) {
+				t.Fatalf("expected a report of svc with %d checks, but got %+v", len(tc.checks), report)
+			}
+			down := 0
+			for _, name := range tc.expectedDown {
+				if result := report.Checks[name]; result.Status != health.StatusDown || result.Error == "" {
+					t.Errorf("expected %s to be down with an error, but got %+v", name, result)
+				}
+				down++
+			}
+			for name, result := range report.Checks {
+				if result.Status == health.StatusDown {
+					down--
+				}
+				if result.LatencyMS < 0 {
+					t.Errorf("expected %s to have a latency, but got %v", name, result.LatencyMS)
+				}
+			}
+			if down != 0 {
+				t.Errorf("expected only %v to be down, but got %+v", tc.expectedDown, report.Checks)
+			}
+		})
+	}
+}
+
+func TestLiveHandler(t *testing.T) {
+	checker := health.New("svc")
+	checker.Register("postgres", func(context.Context) error { return errors.New("down") })
+
+	w := httptest.NewRecorder()
+	checker.LiveHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected liveness to ignore dependencies, but got status %d", w.Code)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	checker := health.New("svc")
+	checker.Register("postgres", func(context.Context) error { return nil })
+
+	checker.Drain()
+	w := httptest.NewRecorder()
+	checker.ReadyHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected a draining service not to be ready, but got status %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	checker.LiveHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected a draining service to be alive, but got status %d", w.Code)
+	}
+}
+
+func TestSystemHandler(t *testing.T) {
+	keygen := health.New("key-gen-service")
+	keygenServer := httptest.NewServer(keygen.ReadyHandler())
+	t.Cleanup(keygenServer.Close)
+
+	shortener := health.New("url-shortener-service")
+	shortener.Register("key-gen-service", health.Remote(http.DefaultClient, keygenServer.URL))
+	shortenerServer := httptest.NewServer(shortener.ReadyHandler())
+	t.Cleanup(shortenerServer.Close)
+
+	redirect := health.New("url-redirect-service")
+	redirect.Register("postgres", func(context.Context) error { return errors.New("connection refused") })
+	redirectServer := httptest.NewServer(redirect.ReadyHandler())
+	t.Cleanup(redirectServer.Close)
+
+	gateway := health.New("api-gateway-service")
+	gateway.Register("url-shortener-service", health.Remote(http.DefaultClient, shortenerServer.URL))
+	gateway.Register("url-redirect-service", health.Remote(http.DefaultClient, redirectServer.URL))
+	gateway.Register("unreachable", health.Remote(http.DefaultClient, "http://127.0.0.1:1"))
+
+	w := httptest.NewRecorder()
+	gateway.SystemHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/status", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status %d, but got %d", http.StatusServiceUnavailable, w.Code)
+	}
+
+	var system health.System
+	if err := json.Unmarshal(w.Body.Bytes(), &system); err != nil {
+		t.Fatalf("could not decode status: %v", err)
+	}
+	expected := map[string]string{
+		"api-gateway-service":   health.StatusDown,
+		"url-shortener-service": health.StatusUp,
+		"key-gen-service":       health.StatusUp,
+		"url-redirect-service":  health.StatusDown,
+	}
+	if len(system.Services) != len(expected) {
+		t.Fatalf("expected %d services, but got %+v", len(expected), system.Services)
+	}
+	for name, status := range expected {
+		if got := system.Services[name].Status; got != status {
+			t.Errorf("expected %s to be %s, but got %q", name, status, got)
+		}
+	}
+	if result := system.Services["api-gateway-service"].Checks["url-shortener-service"]; result.Report != nil {
+		t.Errorf("expected remote reports to be listed once, but got %+v", result)
+	}
+	if result := system.Services["api-gateway-service"].Checks["unreachable"]; result.Status != health.StatusDown || result.Error == "" {
+		t.Errorf("expected the unreachable service to be down, but got %+v", result)
+	}
+}
@@ -0,0 +1,622 @@
+package httpclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNoEndpoints is returned when an upstream has no endpoints to send a
+// request to.
+var ErrNoEndpoints = errors.New("no endpoints")
+
+// Policy decides which endpoint of an upstream a request is sent to.
+type Policy string
+
+const (
+	// PolicyLeastOutstanding picks the endpoint with the fewest requests
+	// in flight.
+	PolicyLeastOutstanding Policy = "least-outstanding"
+	// PolicyP2CEWMA picks the better of two random endpoints, weighing
+	// each one's moving average latency by its requests in flight.
+	PolicyP2CEWMA Policy = "p2c-ewma"
+)
+
+const (
+	// DefaultEjectAfter is how many requests to an endpoint must fail in a
+	// row for it to be ejected.
+	DefaultEjectAfter = 3
+	// DefaultEjectFor is how long an ejected endpoint is left out.
+	DefaultEjectFor = 30 * time.Second
+	// DefaultMinHedgeDelay is the least a hedged request waits before it
+	// is sent to a second endpoint.
+	DefaultMinHedgeDelay = 5 * time.Millisecond
+	// ewmaDecay is the time constant of the endpoints' latency averages.
+	ewmaDecay = 10 * time.Second
+	// latencyWindow is how many recent latencies the hedge delay is taken
+	// from, and hedgeRefresh how often it is recomputed.
+	latencyWindow = 1024
+	hedgeRefresh  = 64
+)
+
+// BalancerConfig holds the settings services build their Balancers from.
+type BalancerConfig struct {
+	// Policy decides which endpoint each request is sent to.
+	Policy Policy `config:"policy" env:"LB_POLICY" default:"p2c-ewma"`
+	// ResolveInterval is how often DNS targets are re-resolved.
+	ResolveInterval time.Duration `config:"resolve_interval" env:"LB_RESOLVE_INTERVAL" default:"30s"`
+	// EjectAfter is how many requests to an endpoint must fail in a row for
+	// it to be ejected, and EjectFor how long it then is.
+	EjectAfter int           `config:"eject_after" env:"LB_EJECT_AFTER" default:"3"`
+	EjectFor   time.Duration `config:"eject_for" env:"LB_EJECT_FOR" default:"30s"`
+}
+
+// Options returns the BalancerOptions described by c, or an error if a
+// setting is out of range.
+func (c BalancerConfig) Options() ([]BalancerOption, error) {
+	switch {
+	case c.Policy != PolicyLeastOutstanding && c.Policy != PolicyP2CEWMA:
+		return nil, fmt.Errorf("policy must be %q or %q, got %q", PolicyLeastOutstanding, PolicyP2CEWMA, c.Policy)
+	case c.ResolveInterval <= 0:
+		return nil, errors.New("resolve_interval must be positive")
+	case c.EjectAfter <= 0:
+		return nil, errors.New("eject_after must be positive")
+	case c.EjectFor <= 0:
+		return nil, errors.New("eject_for must be positive")
+	}
+	return []BalancerOption{
+		WithPolicy(c.Policy),
+		WithEjection(c.EjectAfter, c.EjectFor),
+	}, nil
+}
+
+// Lookup resolves the DNS records of targets. *net.Resolver implements it.
+type Lookup interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+var _ Lookup = (*net.Resolver)(nil)
+
+// endpoint is one replica of an upstream.
+type endpoint struct {
+	url         *url.URL
+	outstanding atomic.Int64
+
+	mu           sync.Mutex
+	ewma         float64 // moving average latency, in nanoseconds
+	measuredAt   time.Time
+	failures     int // consecutive failures
+	ejectedUntil time.Time
+}
+
+// observe records the outcome of a request that took rtt.
+func (e *endpoint) observe(rtt time.Duration, failed bool, ejectAfter int, ejectFor time.Duration) (ejected bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := time.Now()
+	if e.measuredAt.IsZero() {
+		e.ewma = float64(rtt)
+	} else {
+		w := math.Exp(-float64(now.Sub(e.measuredAt)) / float64(ewmaDecay))
+		e.ewma = e.ewma*w + float64(rtt)*(1-w)
+	}
+	e.measuredAt = now
+
+	if !failed {
+		e.failures = 0
+		return false
+	}
+	e.failures++
+	if e.failures >= ejectAfter && !now.Before(e.ejectedUntil) {
+		e.ejectedUntil = now.Add(ejectFor)
+		e.failures = 0
+		return true
+	}
+	return false
+}
+
+// cost is what P2C-EWMA minimises: the expected latency of one more request.
+func (e *endpoint) cost() float64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return (e.ewma + 1) * float64(e.outstanding.Load()+1)
+}
+
+func (e *endpoint) ejected(now time.Time) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return now.Before(e.ejectedUntil)
+}
+
+// Balancer spreads the requests to an upstream across its endpoints. The
+// endpoints are listed as targets, each of which is a base URL such as
+// http://10.0.0.5:8080, dns://redirect:8080, whose A and AAAA records are
+// the endpoints at that port, or dns+srv://_http._tcp.redirect, whose SRV
+// records are. DNS targets are re-resolved by Watch.
+//
+// Endpoints whose requests keep failing are ejected for a while. When every
+// endpoint is ejected, requests are spread across all of them regardless.
+// It is safe for concurrent use.
+type Balancer struct {
+	name       string
+	targets    []string
+	lookup     Lookup
+	policy     Policy
+	ejectAfter int
+	ejectFor   time.Duration
+	hedgeAt    float64 // latency percentile hedging waits for; 0 disables it
+	minHedge   time.Duration
+
+	mu        sync.RWMutex
+	endpoints []*endpoint
+
+	latencyMu  sync.Mutex
+	latencies  []time.Duration // ring of recent latencies
+	next       int
+	samples    int
+	hedgeDelay atomic.Int64
+
+	hedges    atomic.Uint64
+	ejections atomic.Uint64
+}
+
+// BalancerOption configures optional settings of a Balancer.
+type BalancerOption func(*Balancer)
+
+// WithPolicy sets how endpoints are picked. The default is PolicyP2CEWMA.
+func WithPolicy(p Policy) BalancerOption {
+	return func(b *Balancer) {
+		b.policy = p
+	}
+}
+
+// WithEjection sets how many requests to an endpoint must fail in a row for
+// it to be ejected, and for how long.
+func WithEjection(failures int, d time.Duration) BalancerOption {
+	return func(b *Balancer) {
+		b.ejectAfter = failures
+		b.ejectFor = d
+	}
+}
+
+// WithHedging sends requests marked with Hedged to a second endpoint when
+// the first has not answered within the given percentile (0 to 100) of
+// recent latencies, and uses whichever answers first.
+func WithHedging(percentile float64) BalancerOption {
+	return func(b *Balancer) {
+		b.hedgeAt = percentile
+	}
+}
+
+// WithLookup sets the resolver DNS targets are looked up with.
+func WithLookup(l Lookup) BalancerOption {
+	return func(b *Balancer) {
+		b.lookup = l
+	}
+}
+
+// NewBalancer creates a Balancer for the upstream called name and resolves
+// its targets. It fails if a target is malformed or none yields an endpoint.
+func NewBalancer(ctx context.Context, name string, targets []string, opts ...BalancerOption) (*Balancer, error) {
+	b := &Balancer{
+		name:       name,
+		targets:    targets,
+		lookup:     net.DefaultResolver,
+		policy:     PolicyP2CEWMA,
+		ejectAfter: DefaultEjectAfter,
+		ejectFor:   DefaultEjectFor,
+		minHedge:   DefaultMinHedgeDelay,
+		latencies:  make([]time.Duration, latencyWindow),
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	switch b.policy {
+	case PolicyLeastOutstanding, PolicyP2CEWMA:
+	default:
+		return nil, fmt.Errorf("unknown balancing policy %q", b.policy)
+	}
+	if b.hedgeAt < 0 || b.hedgeAt >= 100 {
+		return nil, fmt.Errorf("hedging percentile must be between 0 and 100, got %g", b.hedgeAt)
+	}
+
+	if err := b.Resolve(ctx); err != nil {
+		return nil, err
+	}
+	exported.balancer(b)
+	return b, nil
+}
+
+// Resolve looks up the Balancer's targets again and replaces its endpoints
+// with the result. Endpoints that remain keep their statistics. The
+// endpoints are left alone if the lookup fails or yields none.
+func (b *Balancer) Resolve(ctx context.Context) error {
+	var urls []*url.URL
+	for _, target := range b.targets {
+		resolved, err := b.resolve(ctx, strings.TrimSpace(target))
+		if err != nil {
+			return fmt.Errorf("%s: %w", target, err)
+		}
+		urls = append(urls, resolved...)
+	}
+	if len(urls) == 0 {
+		return fmt.Errorf("%s: %w", b.name, ErrNoEndpoints)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	old := make(map[string]*endpoint, len(b.endpoints))
+	for _, e := range b.endpoints {
+		old[e.url.String()] = e
+	}
+	endpoints := make([]*endpoint, 0, len(urls))
+	seen := make(map[string]bool, len(urls))
+	for _, u := range urls {
+		key := u.String()
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if e, ok := old[key]; ok {
+			endpoints = append(endpoints, e)
+		} else {
+			endpoints = append(endpoints, &endpoint{url: u})
+		}
+	}
+	b.endpoints = endpoints
+	return nil
+}
+
+// resolve returns the endpoints target stands for.
+func (b *Balancer) resolve(ctx context.Context, target string) ([]*url.URL, error) {
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid target %q", target)
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return []*url.URL{{Scheme: u.Scheme, Host: u.Host}}, nil
+	case "dns":
+		host, port, err := net.SplitHostPort(u.Host)
+		if err != nil {
+			return nil, fmt.Errorf("dns target %q needs a port", target)
+		}
+		addrs, err := b.lookup.LookupHost(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		urls := make([]*url.URL, len(addrs))
+		for i, addr := range addrs {
+			urls[i] = &url.URL{Scheme: "http", Host: net.JoinHostPort(addr, port)}
+		}
+		return urls, nil
+	case "dns+srv":
+		_, records, err := b.lookup.LookupSRV(ctx, "", "", u.Host)
+		if err != nil {
+			return nil, err
+		}
+		urls := make([]*url.URL, len(records))
+		for i, r := range records {
+			host := strings.TrimSuffix(r.Target, ".")
+			urls[i] = &url.URL{Scheme: "http", Host: net.JoinHostPort(host, strconv.Itoa(int(r.Port)))}
+		}
+		return urls, nil
+	default:
+		return nil, fmt.Errorf("unsupported target scheme %q", u.Scheme)
+	}
+}
+
+// Watch re-resolves the targets every interval until ctx is done. Failed
+// lookups are logged and the previous endpoints kept. Without DNS targets,
+// or with a non-positive interval, it returns at once.
+func (b *Balancer) Watch(ctx context.Context, interval time.Duration) {
+	dynamic := slices.ContainsFunc(b.targets, func(t string) bool {
+		return strings.HasPrefix(strings.TrimSpace(t), "dns")
+	})
+	if !dynamic || interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := b.Resolve(ctx); err != nil {
+				slog.Warn("httpclient: failed to resolve upstream", "upstream", b.name, "error", err)
+			}
+		}
+	}
+}
+
+// pick chooses the endpoint for a request, avoiding skip if it can.
+func (b *Balancer) pick(skip *endpoint) (*endpoint, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	now := time.Now()
+	candidates := make([]*endpoint, 0, len(b.endpoints))
+	for _, e := range b.endpoints {
+		if e != skip && !e.ejected(now) {
+			candidates = append(candidates, e)
+		}
+	}
+	if len(candidates) == 0 {
+		// Panic mode: better an endpoint that may have recovered than none.
+		for _, e := range b.endpoints {
+			if e != skip {
+				candidates = append(candidates, e)
+			}
+		}
+	}
+	switch len(candidates) {
+	case 0:
+		return nil, fmt.Errorf("%s: %w", b.name, ErrNoEndpoints)
+	case 1:
+		return candidates[0], nil
+	}
+
+	if b.policy == PolicyLeastOutstanding {
+		// Start at a random endpoint so ties are spread out.
+		offset := rand.N(len(candidates))
+		best := candidates[offset]
+		for i := 1; i < len(candidates); i++ {
+			e := candidates[(offset+i)%len(candidates)]
+			if e.outstanding.Load() < best.outstanding.Load() {
+				best = e
+			}
+		}
+		return best, nil
+	}
+
+	i := rand.N(len(candidates))
+	j := rand.N(len(candidates) - 1)
+	if j >= i {
+		j++
+	}
+	if a, c := candidates[i], candidates[j]; c.cost() < a.cost() {
+		return c, nil
+	}
+	return candidates[i], nil
+}
+
+// recordLatency adds a successful request's latency to the window the
+// hedge delay is computed from.
+func (b *Balancer) recordLatency(d time.Duration) {
+	if b.hedgeAt == 0 {
+		return
+	}
+
+	b.latencyMu.Lock()
+	defer b.latencyMu.Unlock()
+	b.latencies[b.next] = d
+	b.next = (b.next + 1) % len(b.latencies)
+	b.samples++
+	if b.samples%hedgeRefresh != 0 && b.samples > hedgeRefresh {
+		return
+	}
+
+	window := slices.Clone(b.latencies[:min(b.samples, len(b.latencies))])
+	slices.Sort(window)
+	idx := int(math.Ceil(b.hedgeAt/100*float64(len(window)))) - 1
+	b.hedgeDelay.Store(int64(max(window[max(idx, 0)], b.minHedge)))
+}
+
+type hedgedKey struct{}
+
+// Hedged marks requests made with the returned context as safe to send to a
+// second endpoint if the first is slow. Only GET and HEAD requests are
+// hedged, and only by Balancers configured WithHedging.
+func Hedged(ctx context.Context) context.Context {
+	return context.WithValue(ctx, hedgedKey{}, true)
+}
+
+// Transport returns a RoundTripper that sends each request through next to
+// the endpoint the Balancer picks. Requests keep their path, query and any
+// Host header set explicitly; only their scheme and address are replaced.
+func (b *Balancer) Transport(next http.RoundTripper) http.RoundTripper {
+	return &balancedTransport{balancer: b, next: next}
+}
+
+type balancedTransport struct {
+	balancer *Balancer
+	next     http.RoundTripper
+}
+
+func (t *balancedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	b := t.balancer
+	hedged, _ := req.Context().Value(hedgedKey{}).(bool)
+	if !hedged || b.hedgeAt == 0 || (req.Method != http.MethodGet && req.Method != http.MethodHead) || (req.Body != nil && req.Body != http.NoBody) {
+		e, err := b.pick(nil)
+		if err != nil {
+			return nil, err
+		}
+		return t.send(req, e)
+	}
+	return t.hedge(req)
+}
+
+// send sends req to e and records the outcome.
+func (t *balancedTransport) send(req *http.Request, e *endpoint) (*http.Response, error) {
+	b := t.balancer
+	out := req.Clone(req.Context())
+	out.URL.Scheme = e.url.Scheme
+	out.URL.Host = e.url.Host
+	if req.Host == req.URL.Host {
+		// The Host was derived from the URL, so it must follow it.
+		out.Host = ""
+	}
+
+	e.outstanding.Add(1)
+	start := time.Now()
+	resp, err := t.next.RoundTrip(out)
+	e.outstanding.Add(-1)
+	rtt := time.Since(start)
+
+	if err != nil && req.Context().Err() != nil {
+		// Abandoned by the caller; that says nothing about the endpoint.
+		return nil, err
+	}
+	failed := err != nil || resp.StatusCode >= http.StatusInternalServerError
+	if e.observe(rtt, failed, b.ejectAfter, b.ejectFor) {
+		b.ejections.Add(1)
+		slog.Warn("httpclient: ejected endpoint", "upstream", b.name, "endpoint", e.url, "for", b.ejectFor.String())
+	}
+	if !failed {
+		b.recordLatency(rtt)
+	}
+	return resp, err
+}
+
+type hedgeResult struct {
+	resp   *http.Response
+	err    error
+	cancel context.CancelFunc
+}
+
+// discard releases an attempt that lost or was superseded.
+func (r hedgeResult) discard() {
+	if r.resp != nil {
+		io.Copy(io.Discard, r.resp.Body)
+		r.resp.Body.Close()
+	}
+	r.cancel()
+}
+
+// hedge sends req to one endpoint and, if it has not answered within the
+// hedge delay, to a second one, returning the first good response.
+func (t *balancedTransport) hedge(req *http.Request) (*http.Response, error) {
+	b := t.balancer
+	first, err := b.pick(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make(chan hedgeResult, 2)
+	launch := func(e *endpoint) {
+		ctx, cancel := context.WithCancel(req.Context())
+		go func() {
+			resp, err := t.send(req.WithContext(ctx), e)
+			results <- hedgeResult{resp: resp, err: err, cancel: cancel}
+		}()
+	}
+	launch(first)
+	inFlight := 1
+
+	var hedgeC <-chan time.Time
+	if delay := b.hedgeDelay.Load(); delay > 0 {
+		// Until latencies have been seen there is no delay to wait for.
+		timer := time.NewTimer(time.Duration(delay))
+		defer timer.Stop()
+		hedgeC = timer.C
+	}
+
+	var last *hedgeResult
+	for inFlight > 0 {
+		select {
+		case <-hedgeC:
+			if second, err := b.pick(first); err == nil {
+				b.hedges.Add(1)
+				launch(second)
+				inFlight++
+			}
+		case r := <-results:
+			inFlight--
+			if last != nil {
+				last.discard()
+			}
+			last = &r
+			if r.err != nil || r.resp.StatusCode >= http.StatusInternalServerError {
+				// Wait for the hedge, if one is out; otherwise the
+				// client's retries take it from here.
+				continue
+			}
+			if inFlight > 0 {
+				go func() {
+					(<-results).discard()
+				}()
+			}
+			inFlight = 0
+		}
+	}
+	if last.resp == nil {
+		last.cancel()
+		return nil, last.err
+	}
+	last.resp.Body = &cancelBody{ReadCloser: last.resp.Body, cancel: last.cancel}
+	return last.resp, nil
+}
+
+// EndpointStats describes one endpoint of a Balancer.
+type EndpointStats struct {
+	URL         string
+	Outstanding int64
+	// Latency is the endpoint's moving average latency.
+	Latency time.Duration
+	Ejected bool
+}
+
+// BalancerStats is a snapshot of a Balancer's endpoints and hedging.
+type BalancerStats struct {
+	Name      string
+	Endpoints []EndpointStats
+	// Ejections counts how often an endpoint was ejected.
+	Ejections uint64
+	// HedgeDelay is how long hedged requests currently wait before going
+	// to a second endpoint, and Hedges how many have.
+	HedgeDelay time.Duration
+	Hedges     uint64
+}
+
+// Stats returns a snapshot of the Balancer's state.
+func (b *Balancer) Stats() BalancerStats {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	now := time.Now()
+	stats := BalancerStats{
+		Name:       b.name,
+		HedgeDelay: time.Duration(b.hedgeDelay.Load()),
+		Hedges:     b.hedges.Load(),
+		Ejections:  b.ejections.Load(),
+	}
+	for _, e := range b.endpoints {
+		e.mu.Lock()
+		latency := time.Duration(e.ewma)
+		e.mu.Unlock()
+		stats.Endpoints = append(stats.Endpoints, EndpointStats{
+			URL:         e.url.String(),
+			Outstanding: e.outstanding.Load(),
+			Latency:     latency,
+			Ejected:     e.ejected(now),
+		})
+	}
+	return stats
+}
+
+// WithBalancer sends the Client's requests through b, to the endpoint it
+// picks for each attempt, so retries may go to another replica. Request
+// URLs only need the right path; their scheme and host are replaced.
+func WithBalancer(b *Balancer) Option {
+	return func(c *Client) {
+		c.client.Transport = b.Transport(c.client.Transport)
+	}
+}
@@ -0,0 +1,258 @@
+package httpclient_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/iton0/duss/shared/httpclient"
+)
+
+// fakeLookup resolves names from maps instead of DNS.
+type fakeLookup struct {
+	hosts map[string][]string
+	srv   map[string][]*net.SRV
+}
+
+func (l *fakeLookup) LookupHost(_ context.Context, host string) ([]string, error) {
+	if addrs, ok := l.hosts[host]; ok {
+		return addrs, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+func (l *fakeLookup) LookupSRV(_ context.Context, _, _, name string) (string, []*net.SRV, error) {
+	if records, ok := l.srv[name]; ok {
+		return name, records, nil
+	}
+	return "", nil, errors.New("no such host")
+}
+
+// newReplica starts a server that answers with status after delay and
+// counts the requests it gets.
+func newReplica(t *testing.T, status int, delay time.Duration) (*httptest.Server, *atomic.Int64) {
+	t.Helper()
+
+	var calls atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+		w.WriteHeader(status)
+		fmt.Fprint(w, r.Host)
+	}))
+	t.Cleanup(server.Close)
+	return server, &calls
+}
+
+func TestBalancerResolve(t *testing.T) {
+	lookup := &fakeLookup{
+		hosts: map[string][]string{"redirect": {"10.0.0.1", "10.0.0.2"}},
+		srv: map[string][]*net.SRV{"_http._tcp.shortener": {
+			{Target: "shortener-1.", Port: 8080},
+			{Target: "shortener-2.", Port: 8080},
+		}},
+	}
+
+	testCases := []struct {
+		name              string
+		targets           []string
+		expectedEndpoints []string
+		expectErr         bool
+	}{
+		{"Static", []string{"http://a:8080", "http://b:8080", "http://a:8080"}, []string{"http://a:8080", "http://b:8080"}, false},
+		{"DNS", []string{"dns://redirect:8081"}, []string{"http://10.0.0.1:8081", "http://10.0.0.2:8081"}, false},
+		{"DNS SRV", []string{"dns+srv://_http._tcp.shortener"}, []string{"http://shortener-1:8080", "http://shortener-2:8080"}, false},
+		{"DNS Without Port", []string{"dns://redirect"}, nil, true},
+		{"Unknown Host", []string{"dns://missing:8081"}, nil, true},
+		{"Unsupported Scheme", []string{"ftp://a:21"}, nil, true},
+		{"No Targets", nil, nil, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := httpclient.NewBalancer(context.Background(), "upstream", tc.targets, httpclient.WithLookup(lookup))
+			if tc.expectErr {
+				if err == nil {
+					t.Fatal("expected an error, but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, but got %v", err)
+			}
+
+			endpoints := b.Stats().Endpoints
+			if len(endpoints) != len(tc.expectedEndpoints) {
+				t.Fatalf("expected endpoints %v, but got %+v", tc.expectedEndpoints, endpoints)
+			}
+			for i, e := range endpoints {
+				if e.URL != tc.expectedEndpoints[i] {
+					t.Errorf("expected endpoint %q, but got %q", tc.expectedEndpoints[i], e.URL)
+				}
+			}
+		})
+	}
+
+	b, err := httpclient.NewBalancer(context.Background(), "upstream", []string{"dns://redirect:8081"}, httpclient.WithLookup(lookup))
+	if err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	lookup.hosts["redirect"] = []string{"10.0.0.2", "10.0.0.3"}
+	if err := b.Resolve(context.Background()); err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	if endpoints := b.Stats().Endpoints; len(endpoints) != 2 || endpoints[1].URL != "http://10.0.0.3:8081" {
+		t.Errorf("expected the new records, but got %+v", endpoints)
+	}
+	delete(lookup.hosts, "redirect")
+	if err := b.Resolve(context.Background()); err == nil || len(b.Stats().Endpoints) != 2 {
+		t.Errorf("expected a failed lookup to keep the endpoints, but got %v", err)
+	}
+}
+
+func TestBalancerPolicies(t *testing.T) {
+	for _, policy := range []httpclient.Policy{httpclient.PolicyLeastOutstanding, httpclient.PolicyP2CEWMA} {
+		t.Run(string(policy), func(t *testing.T) {
+			fast, fastCalls := newReplica(t, http.StatusOK, 0)
+			slow, slowCalls := newReplica(t, http.StatusOK, 20*time.Millisecond)
+
+			b, err := httpclient.NewBalancer(context.Background(), "upstream", []string{fast.URL, slow.URL}, httpclient.WithPolicy(policy))
+			if err != nil {
+				t.Fatalf("expected no error, but got %v", err)
+			}
+			client := httpclient.New("upstream", httpclient.WithBalancer(b))
+
+			done := make(chan struct{})
+			for range 4 {
+				go func() {
+					for range 25 {
+						req, _ := http.NewRequest(http.MethodGet, "http://upstream/path", nil)
+						if resp, err := client.Do(req); err == nil {
+							resp.Body.Close()
+						}
+					}
+					done <- struct{}{}
+				}()
+			}
+			for range 4 {
+				<-done
+			}
+
+			if fastCalls.Load() <= slowCalls.Load() {
+				t.Errorf("expected the faster replica to get more requests, but got %d and %d", fastCalls.Load(), slowCalls.Load())
+			}
+		})
+	}
+
+	if _, err := httpclient.NewBalancer(context.Background(), "upstream", []string{"http://a:8080"}, httpclient.WithPolicy("random")); err == nil {
+		t.Error("expected an unknown policy to be rejected")
+	}
+}
+
+func TestBalancerEjection(t *testing.T) {
+	healthy, healthyCalls := newReplica(t, http.StatusOK, 0)
+	broken, brokenCalls := newReplica(t, http.StatusInternalServerError, 0)
+
+	b, err := httpclient.NewBalancer(context.Background(), "upstream", []string{healthy.URL, broken.URL},
+		httpclient.WithPolicy(httpclient.PolicyLeastOutstanding), httpclient.WithEjection(2, time.Minute))
+	if err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	client := httpclient.New("upstream", httpclient.WithBalancer(b), httpclient.WithBreaker(1000, time.Minute, 1))
+
+	for range 50 {
+		req, _ := http.NewRequest(http.MethodGet, "http://upstream/", nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("expected no error, but got %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	if brokenCalls.Load() != 2 || healthyCalls.Load() != 48 {
+		t.Errorf("expected the broken replica to be ejected after 2 failures, but it got %d requests", brokenCalls.Load())
+	}
+	for _, e := range b.Stats().Endpoints {
+		if e.Ejected != (e.URL == broken.URL) {
+			t.Errorf("expected only %s to be ejected, but got %+v", broken.URL, e)
+		}
+	}
+}
+
+func TestBalancerHedging(t *testing.T) {
+	fast, _ := newReplica(t, http.StatusOK, 0)
+	stalled, _ := newReplica(t, http.StatusOK, time.Minute)
+	srv := func(servers ...*httptest.Server) []*net.SRV {
+		var records []*net.SRV
+		for _, server := range servers {
+			addr := server.Listener.Addr().(*net.TCPAddr)
+			records = append(records, &net.SRV{Target: addr.IP.String() + ".", Port: uint16(addr.Port)})
+		}
+		return records
+	}
+	lookup := &fakeLookup{srv: map[string][]*net.SRV{"_http._tcp.upstream": srv(fast)}}
+
+	b, err := httpclient.NewBalancer(context.Background(), "upstream", []string{"dns+srv://_http._tcp.upstream"},
+		httpclient.WithLookup(lookup), httpclient.WithHedging(90), httpclient.WithPolicy(httpclient.PolicyLeastOutstanding))
+	if err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	client := httpclient.New("upstream", httpclient.WithBalancer(b), httpclient.WithTimeout(10*time.Second))
+	get := func(ctx context.Context) error {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://upstream/", nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+
+	for range 10 {
+		if err := get(httpclient.Hedged(context.Background())); err != nil {
+			t.Fatalf("expected no error, but got %v", err)
+		}
+	}
+	if stats := b.Stats(); stats.HedgeDelay <= 0 || stats.Hedges != 0 {
+		t.Fatalf("expected a hedge delay and no hedges, but got %+v", stats)
+	}
+
+	// Add a stalled replica: hedged requests sent to it are answered by
+	// the fast one instead.
+	lookup.srv["_http._tcp.upstream"] = srv(stalled, fast)
+	if err := b.Resolve(context.Background()); err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	for range 20 {
+		start := time.Now()
+		if err := get(httpclient.Hedged(context.Background())); err != nil {
+			t.Fatalf("expected no error, but got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Fatalf("expected the hedge to answer, but waited %s", elapsed)
+		}
+	}
+	if b.Stats().Hedges == 0 {
+		t.Error("expected requests to be hedged")
+	}
+
+	// Requests that are not marked are never hedged.
+	before := b.Stats().Hedges
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	for range 4 {
+		get(ctx)
+	}
+	if b.Stats().Hedges != before {
+		t.Error("expected unmarked requests not to be hedged")
+	}
+}
@@ -0,0 +1,127 @@
+package httpclient
+
+import (
+	"sync"
+	"time"
+)
+
+// State is the state of a circuit breaker.
+type State int
+
+const (
+	// StateClosed lets every call through.
+	StateClosed State = iota
+	// StateOpen fails calls at once, without reaching the upstream.
+	StateOpen
+	// StateHalfOpen lets a few probe calls through to find out whether
+	// the upstream has recovered.
+	StateHalfOpen
+)
+
+// States lists every State, in order.
+var States = []State{StateClosed, StateOpen, StateHalfOpen}
+
+func (s State) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// breaker is a circuit breaker that opens after a run of consecutive
+// failures, stays open for a cool-down and then lets probes through, closing
+// again once one of them succeeds.
+type breaker struct {
+	threshold int
+	coolDown  time.Duration
+	probes    int
+	now       func() time.Time
+	onChange  func(from, to State)
+
+	mu       sync.Mutex
+	state    State
+	failures int       // consecutive failures while closed
+	openedAt time.Time // when the breaker last opened
+	inFlight int       // probes in flight while half-open
+	entered  [3]uint64 // how often each state was entered
+}
+
+// allow reports whether a call may go ahead. Every allowed call must be
+// followed by a call to done.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == StateOpen {
+		if b.now().Sub(b.openedAt) < b.coolDown {
+			return false
+		}
+		b.setState(StateHalfOpen)
+	}
+	if b.state == StateHalfOpen {
+		if b.inFlight >= b.probes {
+			return false
+		}
+		b.inFlight++
+	}
+	return true
+}
+
+// done records the outcome of a call allow let through.
+func (b *breaker) done(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case StateHalfOpen:
+		b.inFlight = max(b.inFlight-1, 0)
+		if success {
+			b.setState(StateClosed)
+		} else {
+			b.setState(StateOpen)
+		}
+	case StateClosed:
+		if success {
+			b.failures = 0
+			return
+		}
+		b.failures++
+		if b.failures >= b.threshold {
+			b.setState(StateOpen)
+		}
+	}
+}
+
+// cancel records that a call allow let through was abandoned by its caller,
+// which says nothing about the upstream.
+func (b *breaker) cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == StateHalfOpen {
+		b.inFlight = max(b.inFlight-1, 0)
+	}
+}
+
+// setState moves the breaker to state. b.mu must be held.
+func (b *breaker) setState(state State) {
+	from := b.state
+	b.state = state
+	b.entered[state]++
+	switch state {
+	case StateOpen:
+		b.openedAt = b.now()
+		b.inFlight = 0
+	case StateClosed:
+		b.failures = 0
+	}
+	if b.onChange != nil {
+		b.onChange(from, state)
+	}
+}
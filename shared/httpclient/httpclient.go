@@ -0,0 +1,378 @@
+// Package httpclient is the HTTP client services use to call each other. A
+// Client talks to a single upstream and makes those calls resilient:
+//
+//   - Connections are pooled and reused across calls.
+//   - Each attempt is bounded by the caller's context deadline or, when it
+//     has none, by the Client's timeout.
+//   - Idempotent calls are retried after transport errors and 502, 503 and
+//     504 responses, with jittered exponential backoff.
+//   - A circuit breaker stops calls to an upstream that keeps failing, and
+//     lets probes through after a cool-down to find out when it recovers.
+//
+// Stats reports what each Client has done, per breaker state, and is
+// exported as Prometheus metrics along with the Stats of each Balancer.
+package httpclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/iton0/duss/shared/logging"
+	"github.com/iton0/duss/shared/tracing"
+)
+
+// ErrCircuitOpen is returned for calls made while an upstream's circuit
+// breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+const (
+	// DefaultTimeout bounds each attempt of a call whose context has no
+	// deadline.
+	DefaultTimeout = 5 * time.Second
+	// DefaultMaxRetries is how often an idempotent call is retried.
+	DefaultMaxRetries = 2
+	// DefaultBaseBackoff and DefaultMaxBackoff bound the delay before a
+	// retry, which doubles with each one.
+	DefaultBaseBackoff = 50 * time.Millisecond
+	DefaultMaxBackoff  = time.Second
+	// DefaultFailureThreshold is how many calls in a row must fail for the
+	// circuit breaker to open.
+	DefaultFailureThreshold = 5
+	// DefaultCoolDown is how long the breaker stays open before it lets a
+	// probe through.
+	DefaultCoolDown = 10 * time.Second
+	// DefaultProbes is how many probes may be in flight while half-open.
+	DefaultProbes = 1
+)
+
+// Config holds the settings services build their Clients from.
+type Config struct {
+	// Timeout bounds each attempt of a call whose context has no deadline.
+	Timeout time.Duration `config:"timeout" env:"HTTP_CLIENT_TIMEOUT" default:"5s"`
+	// MaxRetries is how often an idempotent call is retried.
+	MaxRetries int `config:"max_retries" env:"HTTP_CLIENT_MAX_RETRIES" default:"2"`
+	// BreakerThreshold is how many calls in a row must fail for an
+	// upstream's circuit breaker to open, and BreakerCoolDown how long it
+	// then stays open.
+	BreakerThreshold int           `config:"breaker_threshold" env:"HTTP_CLIENT_BREAKER_THRESHOLD" default:"5"`
+	BreakerCoolDown  time.Duration `config:"breaker_cool_down" env:"HTTP_CLIENT_BREAKER_COOL_DOWN" default:"10s"`
+}
+
+// Options returns the Options described by c, or an error if a setting is
+// out of range.
+func (c Config) Options() ([]Option, error) {
+	switch {
+	case c.Timeout <= 0:
+		return nil, errors.New("timeout must be positive")
+	case c.MaxRetries < 0:
+		return nil, errors.New("max_retries must not be negative")
+	case c.BreakerThreshold <= 0:
+		return nil, errors.New("breaker_threshold must be positive")
+	case c.BreakerCoolDown <= 0:
+		return nil, errors.New("breaker_cool_down must be positive")
+	}
+	return []Option{
+		WithTimeout(c.Timeout),
+		WithRetries(c.MaxRetries, DefaultBaseBackoff, DefaultMaxBackoff),
+		WithBreaker(c.BreakerThreshold, c.BreakerCoolDown, DefaultProbes),
+	}, nil
+}
+
+// sharedTransport pools connections for every Client. Unlike
+// http.DefaultTransport it keeps enough idle connections per host for the
+// steady traffic between services.
+var sharedTransport = func() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConns = 512
+	t.MaxIdleConnsPerHost = 64
+	t.IdleConnTimeout = 90 * time.Second
+	return t
+}()
+
+// Client sends requests to one upstream service. It is safe for concurrent
+// use.
+type Client struct {
+	name        string
+	client      *http.Client
+	timeout     time.Duration
+	maxRetries  int
+	baseBackoff time.Duration
+	maxBackoff  time.Duration
+	breaker     *breaker
+
+	requests atomic.Uint64
+	attempts atomic.Uint64
+	retries  atomic.Uint64
+	failures atomic.Uint64
+	rejected atomic.Uint64
+}
+
+// Option configures optional settings of a Client.
+type Option func(*Client)
+
+// WithTimeout sets how long each attempt of a call whose context has no
+// deadline may take.
+func WithTimeout(d time.Duration) Option {
+	return func(c *Client) {
+		c.timeout = d
+	}
+}
+
+// WithRetries sets how often an idempotent call is retried, and the delay
+// before the first retry, which doubles with each one up to maxBackoff. A
+// random jitter of up to the delay itself is added, so clients retrying
+// together spread out.
+func WithRetries(max int, baseBackoff, maxBackoff time.Duration) Option {
+	return func(c *Client) {
+		c.maxRetries = max
+		c.baseBackoff = baseBackoff
+		c.maxBackoff = maxBackoff
+	}
+}
+
+// WithBreaker sets how many calls in a row must fail for the circuit
+// breaker to open, how long it stays open, and how many probes it lets
+// through at a time once half-open.
+func WithBreaker(threshold int, coolDown time.Duration, probes int) Option {
+	return func(c *Client) {
+		c.breaker.threshold = threshold
+		c.breaker.coolDown = coolDown
+		c.breaker.probes = probes
+	}
+}
+
+// WithTransport sets the transport requests are sent with. It is mostly
+// useful in tests.
+func WithTransport(rt http.RoundTripper) Option {
+	return func(c *Client) {
+		c.client.Transport = rt
+	}
+}
+
+// New creates a Client for the upstream called name, which names it in logs,
+// Stats and metrics.
+func New(name string, opts ...Option) *Client {
+	c := &Client{
+		name:        name,
+		client:      &http.Client{Transport: tracing.Transport(logging.Transport(sharedTransport))},
+		timeout:     DefaultTimeout,
+		maxRetries:  DefaultMaxRetries,
+		baseBackoff: DefaultBaseBackoff,
+		maxBackoff:  DefaultMaxBackoff,
+		breaker: &breaker{
+			threshold: DefaultFailureThreshold,
+			coolDown:  DefaultCoolDown,
+			probes:    DefaultProbes,
+			now:       time.Now,
+		},
+	}
+	c.breaker.onChange = func(from, to State) {
+		slog.Warn("httpclient: circuit breaker changed state", "upstream", name, "from", from.String(), "to", to.String())
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	exported.client(c)
+	return c
+}
+
+// Name returns the name of the Client's upstream.
+func (c *Client) Name() string {
+	return c.name
+}
+
+type idempotentKey struct{}
+
+// Idempotent marks calls made with the returned context as idempotent, so
+// they are retried even if their method, such as POST, is not.
+func Idempotent(ctx context.Context) context.Context {
+	return context.WithValue(ctx, idempotentKey{}, true)
+}
+
+// isIdempotent reports whether req may be sent more than once.
+func isIdempotent(req *http.Request) bool {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		// The body cannot be sent again.
+		return false
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	marked, _ := req.Context().Value(idempotentKey{}).(bool)
+	return marked || req.Header.Get("Idempotency-Key") != ""
+}
+
+// retryable reports whether an attempt that ended with resp or err may be
+// retried. Server errors other than gateway failures are not, since the
+// upstream did receive the request.
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Do sends req, retrying it if it is idempotent, and returns the response of
+// the last attempt. As with http.Client, a response with an error status is
+// not an error, and the caller must close the response body.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	c.requests.Add(1)
+	ctx := req.Context()
+	attempts := 1
+	if isIdempotent(req) {
+		attempts += c.maxRetries
+	}
+
+	var lastErr error
+	for attempt := range attempts {
+		if attempt > 0 {
+			if err := c.sleep(ctx, attempt); err != nil {
+				return nil, lastErr
+			}
+			if req.GetBody != nil {
+				body, err := req.GetBody()
+				if err != nil {
+					return nil, fmt.Errorf("httpclient: failed to rewind request body: %w", err)
+				}
+				req.Body = body
+			}
+			c.retries.Add(1)
+		}
+
+		if !c.breaker.allow() {
+			c.rejected.Add(1)
+			return nil, fmt.Errorf("%s: %w", c.name, ErrCircuitOpen)
+		}
+		resp, err := c.attempt(req)
+		// Calls cancelled by their caller say nothing about the upstream.
+		if ctx.Err() != nil && err != nil {
+			c.breaker.cancel()
+			return nil, err
+		}
+		failed := err != nil || resp.StatusCode >= http.StatusInternalServerError
+		c.breaker.done(!failed)
+		if failed {
+			c.failures.Add(1)
+		}
+
+		if attempt == attempts-1 || !retryable(resp, err) {
+			return resp, err
+		}
+		if resp != nil {
+			// Drain the body so the connection can be reused.
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+			lastErr = fmt.Errorf("%s returned status %d", c.name, resp.StatusCode)
+		} else {
+			lastErr = err
+		}
+	}
+	return nil, lastErr
+}
+
+// attempt sends req once, bounded by the Client's timeout unless its
+// context has a deadline of its own.
+func (c *Client) attempt(req *http.Request) (*http.Response, error) {
+	c.attempts.Add(1)
+	ctx := req.Context()
+	if _, ok := ctx.Deadline(); ok || c.timeout <= 0 {
+		return c.client.Do(req)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return nil, fmt.Errorf("%s did not answer within %s: %w", c.name, c.timeout, err)
+		}
+		return nil, err
+	}
+	// The timeout covers reading the body too; it is released on Close.
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// sleep waits before the given retry, returning early with the context's
+// error if it is done first.
+func (c *Client) sleep(ctx context.Context, retry int) error {
+	delay := c.baseBackoff << (retry - 1)
+	if delay > c.maxBackoff || delay <= 0 {
+		delay = c.maxBackoff
+	}
+	if delay > 0 {
+		delay += rand.N(delay)
+	}
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// cancelBody cancels an attempt's context once its body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// Stats is a snapshot of what a Client has done.
+type Stats struct {
+	// Name is the name of the upstream.
+	Name string
+	// State is the circuit breaker's current state, and Entered counts how
+	// often it entered each state, indexed by State.
+	State   State
+	Entered [3]uint64
+	// Requests counts calls to Do, Attempts the requests sent upstream,
+	// Retries the attempts after the first, Failures the attempts that
+	// failed or got a server error, and Rejected the calls the open
+	// breaker refused.
+	Requests uint64
+	Attempts uint64
+	Retries  uint64
+	Failures uint64
+	Rejected uint64
+}
+
+// Stats returns a snapshot of the Client's counters.
+func (c *Client) Stats() Stats {
+	c.breaker.mu.Lock()
+	state, entered := c.breaker.state, c.breaker.entered
+	c.breaker.mu.Unlock()
+
+	return Stats{
+		Name:     c.name,
+		State:    state,
+		Entered:  entered,
+		Requests: c.requests.Load(),
+		Attempts: c.attempts.Load(),
+		Retries:  c.retries.Load(),
+		Failures: c.failures.Load(),
+		Rejected: c.rejected.Load(),
+	}
+}
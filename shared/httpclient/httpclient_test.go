@@ -0,0 +1,184 @@
+package httpclient_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/iton0/duss/shared/httpclient"
+)
+
+// newUpstream starts a server that answers with the statuses in order,
+// repeating the last one, and counts the requests it gets and the bodies it
+// was sent.
+func newUpstream(t *testing.T, statuses ...int) (*httptest.Server, *atomic.Int64, *[]string) {
+	t.Helper()
+
+	var calls atomic.Int64
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(calls.Add(1))
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		w.WriteHeader(statuses[min(n, len(statuses))-1])
+	}))
+	t.Cleanup(server.Close)
+	return server, &calls, &bodies
+}
+
+func TestDoRetries(t *testing.T) {
+	testCases := []struct {
+		name           string
+		method         string
+		idempotent     bool
+		statuses       []int
+		expectedStatus int
+		expectedCalls  int64
+	}{
+		{"Success", http.MethodGet, false, []int{http.StatusOK}, http.StatusOK, 1},
+		{"GET Retried Until Success", http.MethodGet, false, []int{http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusOK}, http.StatusOK, 3},
+		{"GET Gives Up", http.MethodGet, false, []int{http.StatusServiceUnavailable}, http.StatusServiceUnavailable, 3},
+		{"Internal Error Not Retried", http.MethodGet, false, []int{http.StatusInternalServerError, http.StatusOK}, http.StatusInternalServerError, 1},
+		{"Client Error Not Retried", http.MethodDelete, false, []int{http.StatusNotFound, http.StatusOK}, http.StatusNotFound, 1},
+		{"POST Not Retried", http.MethodPost, false, []int{http.StatusServiceUnavailable, http.StatusOK}, http.StatusServiceUnavailable, 1},
+		{"Idempotent POST Retried", http.MethodPost, true, []int{http.StatusServiceUnavailable, http.StatusOK}, http.StatusOK, 2},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server, calls, bodies := newUpstream(t, tc.statuses...)
+			client := httpclient.New("upstream", httpclient.WithRetries(2, time.Millisecond, 5*time.Millisecond))
+
+			ctx := context.Background()
+			if tc.idempotent {
+				ctx = httpclient.Idempotent(ctx)
+			}
+			req, _ := http.NewRequestWithContext(ctx, tc.method, server.URL, strings.NewReader("payload"))
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("expected no error, but got %v", err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tc.expectedStatus {
+				t.Errorf("expected status %d, but got %d", tc.expectedStatus, resp.StatusCode)
+			}
+			if calls.Load() != tc.expectedCalls {
+				t.Errorf("expected %d calls, but got %d", tc.expectedCalls, calls.Load())
+			}
+			for i, body := range *bodies {
+				if body != "payload" {
+					t.Errorf("attempt %d: expected the body to be resent, but got %q", i, body)
+				}
+			}
+			if stats := client.Stats(); stats.Retries != uint64(tc.expectedCalls-1) || stats.Requests != 1 {
+				t.Errorf("expected 1 request with %d retries, but got %+v", tc.expectedCalls-1, stats)
+			}
+		})
+	}
+}
+
+func TestDoTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { close(release) })
+
+	client := httpclient.New("slow", httpclient.WithTimeout(20*time.Millisecond), httpclient.WithRetries(0, 0, 0))
+
+	// Without a deadline of its own a call is bounded by the timeout...
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	start := time.Now()
+	if _, err := client.Do(req); err == nil {
+		t.Fatal("expected a timeout, but got nil")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the call to time out after 20ms, but it took %s", elapsed)
+	}
+
+	// ...and with one, by its context.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, _ = http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	start = time.Now()
+	if _, err := client.Do(req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, but got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("expected the context's deadline to apply, but the call took %s", elapsed)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var healthy atomic.Bool
+	var calls atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	const coolDown = 50 * time.Millisecond
+	client := httpclient.New("flaky", httpclient.WithBreaker(3, coolDown, 1))
+	call := func() error {
+		req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	for range 3 {
+		if err := call(); err != nil {
+			t.Fatalf("expected the failing upstream to be called, but got %v", err)
+		}
+	}
+	if state := client.Stats().State; state != httpclient.StateOpen {
+		t.Fatalf("expected the breaker to open, but it is %s", state)
+	}
+	if err := call(); !errors.Is(err, httpclient.ErrCircuitOpen) {
+		t.Errorf("expected ErrCircuitOpen, but got %v", err)
+	}
+	if calls.Load() != 3 {
+		t.Errorf("expected the open breaker to spare the upstream, but it got %d calls", calls.Load())
+	}
+
+	// A failed probe opens the breaker again.
+	time.Sleep(coolDown)
+	if err := call(); err != nil {
+		t.Fatalf("expected a probe, but got %v", err)
+	}
+	if state := client.Stats().State; state != httpclient.StateOpen {
+		t.Fatalf("expected the failed probe to reopen the breaker, but it is %s", state)
+	}
+
+	// A successful one closes it.
+	healthy.Store(true)
+	time.Sleep(coolDown)
+	if err := call(); err != nil {
+		t.Fatalf("expected a probe, but got %v", err)
+	}
+
+	stats := client.Stats()
+	if stats.State != httpclient.StateClosed {
+		t.Errorf("expected the breaker to close, but it is %s", stats.State)
+	}
+	expected := [3]uint64{httpclient.StateClosed: 1, httpclient.StateOpen: 2, httpclient.StateHalfOpen: 2}
+	if stats.Entered != expected || stats.Rejected != 1 || stats.Failures != 4 {
+		t.Errorf("expected the transitions %v with 1 rejection and 4 failures, but got %+v", expected, stats)
+	}
+}
@@ -0,0 +1,121 @@
+package httpclient
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/iton0/duss/shared/metrics"
+)
+
+// exported is the collector the Stats of every Client and Balancer are
+// exported through, registered with the default Prometheus registry.
+var exported = &collector{
+	clients:   map[string]*Client{},
+	balancers: map[string]*Balancer{},
+}
+
+func init() {
+	prometheus.MustRegister(exported)
+}
+
+// collector reads the Stats of the latest Client and Balancer for each
+// upstream when metrics are gathered. A newer one for the same upstream
+// replaces the older, so each upstream is only exported once.
+type collector struct {
+	mu        sync.Mutex
+	clients   map[string]*Client
+	balancers map[string]*Balancer
+}
+
+func (c *collector) client(cl *Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clients[cl.name] = cl
+}
+
+func (c *collector) balancer(b *Balancer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.balancers[b.name] = b
+}
+
+func desc(name, help string, labels ...string) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(metrics.Namespace, "http_client", name), help, labels, nil)
+}
+
+var (
+	requestsDesc    = desc("requests_total", "Calls made to an upstream.", "upstream")
+	attemptsDesc    = desc("attempts_total", "Requests sent to an upstream, including retries.", "upstream")
+	retriesDesc     = desc("retries_total", "Requests retried after a failed attempt.", "upstream")
+	failuresDesc    = desc("failures_total", "Attempts that failed or got a server error.", "upstream")
+	rejectedDesc    = desc("rejected_total", "Calls refused by an open circuit breaker.", "upstream")
+	stateDesc       = desc("breaker_state", "1 for the circuit breaker's current state, 0 for the others.", "upstream", "state")
+	transitionsDesc = desc("breaker_transitions_total", "Times the circuit breaker entered each state.", "upstream", "state")
+
+	endpointsDesc   = desc("endpoints", "Endpoints an upstream's requests are balanced across.", "upstream")
+	outstandingDesc = desc("endpoint_outstanding_requests", "Requests in flight to an endpoint.", "upstream", "endpoint")
+	latencyDesc     = desc("endpoint_latency_seconds", "Moving average latency of an endpoint.", "upstream", "endpoint")
+	ejectedDesc     = desc("endpoint_ejected", "1 if the endpoint is ejected, 0 otherwise.", "upstream", "endpoint")
+	ejectionsDesc   = desc("ejections_total", "Times an endpoint was ejected.", "upstream")
+	hedgesDesc      = desc("hedges_total", "Requests hedged to a second endpoint.", "upstream")
+	hedgeDelayDesc  = desc("hedge_delay_seconds", "How long hedged requests wait before going to a second endpoint.", "upstream")
+)
+
+// Describe implements prometheus.Collector.
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{
+		requestsDesc, attemptsDesc, retriesDesc, failuresDesc, rejectedDesc, stateDesc, transitionsDesc,
+		endpointsDesc, outstandingDesc, latencyDesc, ejectedDesc, ejectionsDesc, hedgesDesc, hedgeDelayDesc,
+	} {
+		ch <- d
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	clients := make([]*Client, 0, len(c.clients))
+	for _, cl := range c.clients {
+		clients = append(clients, cl)
+	}
+	balancers := make([]*Balancer, 0, len(c.balancers))
+	for _, b := range c.balancers {
+		balancers = append(balancers, b)
+	}
+	c.mu.Unlock()
+
+	for _, cl := range clients {
+		s := cl.Stats()
+		ch <- prometheus.MustNewConstMetric(requestsDesc, prometheus.CounterValue, float64(s.Requests), s.Name)
+		ch <- prometheus.MustNewConstMetric(attemptsDesc, prometheus.CounterValue, float64(s.Attempts), s.Name)
+		ch <- prometheus.MustNewConstMetric(retriesDesc, prometheus.CounterValue, float64(s.Retries), s.Name)
+		ch <- prometheus.MustNewConstMetric(failuresDesc, prometheus.CounterValue, float64(s.Failures), s.Name)
+		ch <- prometheus.MustNewConstMetric(rejectedDesc, prometheus.CounterValue, float64(s.Rejected), s.Name)
+		for _, state := range States {
+			current := 0.0
+			if state == s.State {
+				current = 1
+			}
+			ch <- prometheus.MustNewConstMetric(stateDesc, prometheus.GaugeValue, current, s.Name, state.String())
+			ch <- prometheus.MustNewConstMetric(transitionsDesc, prometheus.CounterValue, float64(s.Entered[state]), s.Name, state.String())
+		}
+	}
+
+	for _, b := range balancers {
+		s := b.Stats()
+		ch <- prometheus.MustNewConstMetric(endpointsDesc, prometheus.GaugeValue, float64(len(s.Endpoints)), s.Name)
+		for _, e := range s.Endpoints {
+			ejected := 0.0
+			if e.Ejected {
+				ejected = 1
+			}
+			ch <- prometheus.MustNewConstMetric(outstandingDesc, prometheus.GaugeValue, float64(e.Outstanding), s.Name, e.URL)
+			ch <- prometheus.MustNewConstMetric(latencyDesc, prometheus.GaugeValue, e.Latency.Seconds(), s.Name, e.URL)
+			ch <- prometheus.MustNewConstMetric(ejectedDesc, prometheus.GaugeValue, ejected, s.Name, e.URL)
+		}
+		ch <- prometheus.MustNewConstMetric(ejectionsDesc, prometheus.CounterValue, float64(s.Ejections), s.Name)
+		ch <- prometheus.MustNewConstMetric(hedgesDesc, prometheus.CounterValue, float64(s.Hedges), s.Name)
+		ch <- prometheus.MustNewConstMetric(hedgeDelayDesc, prometheus.GaugeValue, s.HedgeDelay.Seconds(), s.Name)
+	}
+}
@@ -0,0 +1,105 @@
+package httpclient_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/iton0/duss/shared/httpclient"
+)
+
+// gathered returns the value of the metric called name whose labels include
+// labels, from the default Prometheus registry.
+func gathered(t *testing.T, name string, labels map[string]string) float64 {
+	t.Helper()
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %v", err)
+	}
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, m := range f.GetMetric() {
+			got := map[string]string{}
+			for _, l := range m.GetLabel() {
+				got[l.GetName()] = l.GetValue()
+			}
+			for k, v := range labels {
+				if got[k] != v {
+					continue metrics
+				}
+			}
+			switch {
+			case m.GetCounter() != nil:
+				return m.GetCounter().GetValue()
+			case m.GetGauge() != nil:
+				return m.GetGauge().GetValue()
+			}
+		}
+	}
+	t.Fatalf("expected metric %s%v, but found none", name, labels)
+	return 0
+}
+
+func TestMetrics(t *testing.T) {
+	healthy, _ := newReplica(t, http.StatusOK, 0)
+	broken, brokenCalls := newReplica(t, http.StatusInternalServerError, 0)
+
+	b, err := httpclient.NewBalancer(context.Background(), "metrics", []string{healthy.URL, broken.URL},
+		httpclient.WithPolicy(httpclient.PolicyLeastOutstanding), httpclient.WithEjection(1, time.Minute))
+	if err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	client := httpclient.New("metrics", httpclient.WithBalancer(b), httpclient.WithBreaker(1000, time.Minute, 1))
+
+	const calls = 20
+	for range calls {
+		req, _ := http.NewRequest(http.MethodGet, "http://metrics/", nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("expected no error, but got %v", err)
+		}
+		resp.Body.Close()
+	}
+	if brokenCalls.Load() != 1 {
+		t.Fatalf("expected the broken replica to be ejected after 1 failure, but it got %d requests", brokenCalls.Load())
+	}
+
+	upstream := map[string]string{"upstream": "metrics"}
+	testCases := []struct {
+		name     string
+		labels   map[string]string
+		expected float64
+	}{
+		{"duss_http_client_requests_total", upstream, calls},
+		{"duss_http_client_attempts_total", upstream, calls},
+		{"duss_http_client_retries_total", upstream, 0},
+		{"duss_http_client_failures_total", upstream, 1},
+		{"duss_http_client_rejected_total", upstream, 0},
+		{"duss_http_client_breaker_state", map[string]string{"upstream": "metrics", "state": "closed"}, 1},
+		{"duss_http_client_breaker_state", map[string]string{"upstream": "metrics", "state": "open"}, 0},
+		{"duss_http_client_breaker_transitions_total", map[string]string{"upstream": "metrics", "state": "open"}, 0},
+		{"duss_http_client_endpoints", upstream, 2},
+		{"duss_http_client_endpoint_ejected", map[string]string{"upstream": "metrics", "endpoint": broken.URL}, 1},
+		{"duss_http_client_endpoint_ejected", map[string]string{"upstream": "metrics", "endpoint": healthy.URL}, 0},
+		{"duss_http_client_ejections_total", upstream, 1},
+		{"duss_http_client_hedges_total", upstream, 0},
+	}
+	for _, tc := range testCases {
+		if got := gathered(t, tc.name, tc.labels); got != tc.expected {
+			t.Errorf("%s%v: expected %g, but got %g", tc.name, tc.labels, tc.expected, got)
+		}
+	}
+
+	// A newer client for the same upstream replaces the older one.
+	httpclient.New("metrics")
+	if got := gathered(t, "duss_http_client_requests_total", upstream); got != 0 {
+		t.Errorf("expected the newer client's requests, but got %g", got)
+	}
+}
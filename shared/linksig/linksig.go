@@ -0,0 +1,262 @@
+// Package linksig signs short links so they cannot be guessed or forged. A
+// signed short URL carries, after its key, a token made of the signing key's
+// ID, an optional expiry and a truncated HMAC of the short domain, key and
+// expiry:
+//
+//	https://duss.io/3mJr7AoUXx1.k2.mq1zc0.5Pxw0qZ3s1nU6m3v
+//
+// Signing keys are rotated by adding a new key with a start time while the
+// old one is still configured: every replica accepts the new key before it
+// starts signing, and the old key is accepted until its end time, so links
+// signed with it keep working through the overlap.
+package linksig
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrMalformed is returned for tokens that cannot be parsed.
+	ErrMalformed = errors.New("malformed link signature")
+	// ErrUnknownKey is returned for tokens signed with a key that is not
+	// configured or no longer accepted.
+	ErrUnknownKey = errors.New("unknown link signing key")
+	// ErrInvalid is returned for tokens whose MAC does not match.
+	ErrInvalid = errors.New("invalid link signature")
+	// ErrExpired is returned for valid tokens past their expiry.
+	ErrExpired = errors.New("link signature expired")
+	// ErrNoActiveKey is returned by Sign when no key may sign at the time.
+	ErrNoActiveKey = errors.New("no active link signing key")
+)
+
+const (
+	// MACSize is the number of bytes of the HMAC-SHA256 a token keeps.
+	MACSize = 12
+	// MinSecretSize is the shortest secret a Key may have.
+	MinSecretSize = 16
+
+	// separator sits between a short key and its token, and between the
+	// token's fields. Short keys are base58 and never contain it.
+	separator = "."
+)
+
+// Key is a secret links are signed with.
+type Key struct {
+	// ID names the key in tokens. It may only use letters, digits, '-' and
+	// '_'.
+	ID     string
+	Secret []byte
+	// NotBefore is when the key starts signing. It is accepted before then,
+	// so replicas can learn it ahead of the first links signed with it.
+	NotBefore time.Time
+	// NotAfter, when set, is when the key stops being accepted, and links
+	// signed with it stop working.
+	NotAfter time.Time
+}
+
+// Config holds the signing keys services build a Keyring from.
+type Config struct {
+	// Keys are "<id>:<secret>" entries, optionally followed by
+	// " from=<RFC 3339 time>" and " until=<RFC 3339 time>". Signed links are
+	// disabled without any.
+	Keys []string `config:"keys" env:"LINK_SIGNING_KEYS" secret:"true"`
+}
+
+// Keyring returns the Keyring described by c, or nil if c has no keys.
+func (c Config) Keyring() (*Keyring, error) {
+	if len(c.Keys) == 0 {
+		return nil, nil
+	}
+	var keys []Key
+	for _, spec := range c.Keys {
+		key, err := ParseKey(spec)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return NewKeyring(keys...)
+}
+
+// ParseKey parses a key in the format of Config.Keys.
+func ParseKey(spec string) (Key, error) {
+	fields := strings.Fields(spec)
+	if len(fields) == 0 {
+		return Key{}, errors.New("empty signing key")
+	}
+	id, secret, ok := strings.Cut(fields[0], ":")
+	if !ok {
+		return Key{}, fmt.Errorf("signing key %q: expected <id>:<secret>", id)
+	}
+	key := Key{ID: id, Secret: []byte(secret)}
+	for _, field := range fields[1:] {
+		name, value, _ := strings.Cut(field, "=")
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return Key{}, fmt.Errorf("signing key %q: %s: %w", id, name, err)
+		}
+		switch name {
+		case "from":
+			key.NotBefore = t
+		case "until":
+			key.NotAfter = t
+		default:
+			return Key{}, fmt.Errorf("signing key %q: unknown field %q", id, name)
+		}
+	}
+	return key, nil
+}
+
+// Keyring signs and verifies link tokens with a set of keys. It is safe for
+// concurrent use.
+type Keyring struct {
+	keys map[string]Key
+	// order lists the key IDs as configured, which breaks ties between
+	// keys that start signing at the same time.
+	order []string
+}
+
+// NewKeyring returns a Keyring holding keys. IDs must be unique and secrets
+// at least MinSecretSize bytes long.
+func NewKeyring(keys ...Key) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no signing keys")
+	}
+	k := &Keyring{keys: map[string]Key{}}
+	for _, key := range keys {
+		if !validID(key.ID) {
+			return nil, fmt.Errorf("signing key ID %q: only letters, digits, '-' and '_' are allowed", key.ID)
+		}
+		if _, ok := k.keys[key.ID]; ok {
+			return nil, fmt.Errorf("signing key ID %q is used twice", key.ID)
+		}
+		if len(key.Secret) < MinSecretSize {
+			return nil, fmt.Errorf("signing key %q: secret must be at least %d bytes", key.ID, MinSecretSize)
+		}
+		if !key.NotAfter.IsZero() && !key.NotAfter.After(key.NotBefore) {
+			return nil, fmt.Errorf("signing key %q: until must be after from", key.ID)
+		}
+		k.keys[key.ID] = key
+		k.order = append(k.order, key.ID)
+	}
+	return k, nil
+}
+
+// Sign returns the token for shortKey on shortDomain, signed with the key
+// that started signing most recently before now. A zero expires makes a
+// token that does not expire, although it still stops working when its key
+// is retired.
+func (k *Keyring) Sign(shortDomain, shortKey string, expires, now time.Time) (string, error) {
+	key, ok := k.active(now)
+	if !ok {
+		return "", ErrNoActiveKey
+	}
+	exp := ""
+	if !expires.IsZero() {
+		exp = strconv.FormatInt(expires.Unix(), 36)
+	}
+	fields := []string{key.ID}
+	if exp != "" {
+		fields = append(fields, exp)
+	}
+	fields = append(fields, mac(key.Secret, shortDomain, shortKey, exp))
+	return strings.Join(fields, separator), nil
+}
+
+// Verify checks token for shortKey on shortDomain at time now. It returns
+// ErrMalformed, ErrUnknownKey, ErrInvalid or ErrExpired for tokens it
+// rejects; only tokens with a valid MAC are reported as expired.
+func (k *Keyring) Verify(shortDomain, shortKey, token string, now time.Time) error {
+	fields := strings.Split(token, separator)
+	var id, exp, sum string
+	switch len(fields) {
+	case 2:
+		id, sum = fields[0], fields[1]
+	case 3:
+		id, exp, sum = fields[0], fields[1], fields[2]
+		if exp == "" {
+			return ErrMalformed
+		}
+	default:
+		return ErrMalformed
+	}
+
+	key, ok := k.keys[id]
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrUnknownKey, id)
+	}
+	if !key.NotAfter.IsZero() && !now.Before(key.NotAfter) {
+		return fmt.Errorf("%w: %q was retired at %s", ErrUnknownKey, id, key.NotAfter.Format(time.RFC3339))
+	}
+	if !hmac.Equal([]byte(sum), []byte(mac(key.Secret, shortDomain, shortKey, exp))) {
+		return ErrInvalid
+	}
+	if exp != "" {
+		unix, err := strconv.ParseInt(exp, 36, 64)
+		if err != nil {
+			return ErrMalformed
+		}
+		if !now.Before(time.Unix(unix, 0)) {
+			return ErrExpired
+		}
+	}
+	return nil
+}
+
+// active returns the key that signs at time now.
+func (k *Keyring) active(now time.Time) (Key, bool) {
+	var (
+		best  Key
+		found bool
+	)
+	for _, id := range k.order {
+		key := k.keys[id]
+		if now.Before(key.NotBefore) || !key.NotAfter.IsZero() && !now.Before(key.NotAfter) {
+			continue
+		}
+		if !found || key.NotBefore.After(best.NotBefore) {
+			best, found = key, true
+		}
+	}
+	return best, found
+}
+
+// Join returns the path segment of a signed short URL.
+func Join(shortKey, token string) string {
+	return shortKey + separator + token
+}
+
+// Split separates the path segment of a short URL into its short key and,
+// for signed links, its token.
+func Split(segment string) (shortKey, token string, signed bool) {
+	return strings.Cut(segment, separator)
+}
+
+// mac returns the truncated, base64url-encoded HMAC of a link. The domain is
+// lowercased, since hosts are case-insensitive.
+func mac(secret []byte, shortDomain, shortKey, exp string) string {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(strings.Join([]string{"duss-link-v1", strings.ToLower(shortDomain), shortKey, exp}, "\x00")))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil)[:MACSize])
+}
+
+func validID(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
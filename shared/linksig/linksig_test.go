@@ -0,0 +1,167 @@
+package linksig_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iton0/duss/shared/linksig"
+)
+
+var (
+	now     = time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	oldKey  = linksig.Key{ID: "k1", Secret: []byte("old-secret-0123456789"), NotAfter: now.Add(24 * time.Hour)}
+	newKey  = linksig.Key{ID: "k2", Secret: []byte("new-secret-0123456789"), NotBefore: now.Add(time.Hour)}
+	keyring = mustKeyring(oldKey, newKey)
+)
+
+func mustKeyring(keys ...linksig.Key) *linksig.Keyring {
+	k, err := linksig.NewKeyring(keys...)
+	if err != nil {
+		panic(err)
+	}
+	return k
+}
+
+func TestSignVerify(t *testing.T) {
+	token, err := keyring.Sign("duss.io", "3mJr7AoUXx1", time.Time{}, now)
+	if err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	if !strings.HasPrefix(token, "k1.") {
+		t.Errorf("expected the old key to sign before the new one starts, but got %q", token)
+	}
+	if err := keyring.Verify("Duss.IO", "3mJr7AoUXx1", token, now); err != nil {
+		t.Errorf("expected the token to verify, but got %v", err)
+	}
+
+	expiring, err := keyring.Sign("duss.io", "3mJr7AoUXx1", now.Add(time.Minute), now)
+	if err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	if err := keyring.Verify("duss.io", "3mJr7AoUXx1", expiring, now.Add(59*time.Second)); err != nil {
+		t.Errorf("expected the token to verify before it expires, but got %v", err)
+	}
+}
+
+func TestVerifyRejections(t *testing.T) {
+	valid, _ := keyring.Sign("duss.io", "abc", time.Time{}, now)
+	expiring, _ := keyring.Sign("duss.io", "abc", now.Add(time.Minute), now)
+	id, exp, sum := splitToken(expiring)
+	forgedExpiry := strings.Join([]string{id, "zzzzzz", sum}, ".")
+	other := mustKeyring(linksig.Key{ID: "k1", Secret: []byte("someone-elses-secret")})
+	foreign, _ := other.Sign("duss.io", "abc", time.Time{}, now)
+
+	testCases := []struct {
+		name        string
+		domain      string
+		key         string
+		token       string
+		at          time.Time
+		expectedErr error
+	}{
+		{"Empty", "duss.io", "abc", "", now, linksig.ErrMalformed},
+		{"One Field", "duss.io", "abc", "k1", now, linksig.ErrMalformed},
+		{"Too Many Fields", "duss.io", "abc", "k1.a.b.c", now, linksig.ErrMalformed},
+		{"Empty Expiry", "duss.io", "abc", "k1.." + sum, now, linksig.ErrMalformed},
+		{"Unknown Key ID", "duss.io", "abc", "k9." + sum, now, linksig.ErrUnknownKey},
+		{"Retired Key", "duss.io", "abc", valid, oldKey.NotAfter, linksig.ErrUnknownKey},
+		{"Other Key", "duss.io", "abc", "k2." + strings.SplitN(valid, ".", 2)[1], now, linksig.ErrInvalid},
+		{"Other Secret", "duss.io", "abc", foreign, now, linksig.ErrInvalid},
+		{"Other Short Key", "duss.io", "abd", valid, now, linksig.ErrInvalid},
+		{"Other Domain", "go.duss.io", "abc", valid, now, linksig.ErrInvalid},
+		{"Truncated MAC", "duss.io", "abc", valid[:len(valid)-1], now, linksig.ErrInvalid},
+		{"Expiry Removed", "duss.io", "abc", id + "." + sum, now, linksig.ErrInvalid},
+		{"Expiry Extended", "duss.io", "abc", forgedExpiry, now, linksig.ErrInvalid},
+		{"Expired", "duss.io", "abc", expiring, now.Add(time.Minute), linksig.ErrExpired},
+		{"Expired Long Ago", "duss.io", "abc", id + "." + exp + "." + sum, now.Add(time.Hour), linksig.ErrExpired},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := keyring.Verify(tc.domain, tc.key, tc.token, tc.at); !errors.Is(err, tc.expectedErr) {
+				t.Errorf("expected error %v, but got %v", tc.expectedErr, err)
+			}
+		})
+	}
+}
+
+func splitToken(token string) (id, exp, sum string) {
+	fields := strings.Split(token, ".")
+	return fields[0], fields[1], fields[2]
+}
+
+func TestRotation(t *testing.T) {
+	// Before the new key starts, tokens signed with it are already accepted.
+	early := mustKeyring(newKey)
+	token, err := early.Sign("duss.io", "abc", time.Time{}, newKey.NotBefore)
+	if err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	if err := keyring.Verify("duss.io", "abc", token, now); err != nil {
+		t.Errorf("expected the new key to be accepted before it signs, but got %v", err)
+	}
+
+	// Once it starts, it signs, and the old key's tokens keep working until
+	// the old key is retired.
+	old, _ := keyring.Sign("duss.io", "abc", time.Time{}, now)
+	overlap := newKey.NotBefore.Add(time.Minute)
+	if token, _ := keyring.Sign("duss.io", "abc", time.Time{}, overlap); !strings.HasPrefix(token, "k2.") {
+		t.Errorf("expected the new key to sign once it starts, but got %q", token)
+	}
+	if err := keyring.Verify("duss.io", "abc", old, overlap); err != nil {
+		t.Errorf("expected the old key to be accepted during the overlap, but got %v", err)
+	}
+	if err := keyring.Verify("duss.io", "abc", old, oldKey.NotAfter.Add(time.Second)); !errors.Is(err, linksig.ErrUnknownKey) {
+		t.Errorf("expected the old key to be refused once retired, but got %v", err)
+	}
+
+	if _, err := mustKeyring(newKey).Sign("duss.io", "abc", time.Time{}, now); !errors.Is(err, linksig.ErrNoActiveKey) {
+		t.Errorf("expected ErrNoActiveKey before any key starts, but got %v", err)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	k, err := linksig.Config{Keys: []string{
+		"k1:old-secret-0123456789 until=2026-10-02T12:00:00Z",
+		"k2:new-secret-0123456789 from=2026-10-01T13:00:00Z",
+	}}.Keyring()
+	if err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	token, _ := keyring.Sign("duss.io", "abc", time.Time{}, now)
+	if err := k.Verify("duss.io", "abc", token, now); err != nil {
+		t.Errorf("expected the parsed keys to match, but got %v", err)
+	}
+
+	if k, err := (linksig.Config{}).Keyring(); k != nil || err != nil {
+		t.Errorf("expected no keyring without keys, but got %v, %v", k, err)
+	}
+
+	invalid := []string{
+		"no-secret",
+		"k1:short",
+		"k.1:old-secret-0123456789",
+		"k1:old-secret-0123456789 from=yesterday",
+		"k1:old-secret-0123456789 when=2026-10-01T13:00:00Z",
+		"k1:old-secret-0123456789 from=2026-10-02T00:00:00Z until=2026-10-01T00:00:00Z",
+	}
+	for _, spec := range invalid {
+		if _, err := (linksig.Config{Keys: []string{spec}}).Keyring(); err == nil {
+			t.Errorf("expected %q to be rejected", spec)
+		}
+	}
+	if _, err := (linksig.Config{Keys: []string{"k1:old-secret-0123456789", "k1:new-secret-0123456789"}}).Keyring(); err == nil {
+		t.Error("expected a repeated key ID to be rejected")
+	}
+}
+
+func TestSplitJoin(t *testing.T) {
+	if key, token, signed := linksig.Split("3mJr7AoUXx1"); key != "3mJr7AoUXx1" || token != "" || signed {
+		t.Errorf("expected an unsigned key, but got %q %q %v", key, token, signed)
+	}
+	if key, token, signed := linksig.Split(linksig.Join("abc", "k1.mq1zc0.sum")); key != "abc" || token != "k1.mq1zc0.sum" || !signed {
+		t.Errorf("expected a signed key, but got %q %q %v", key, token, signed)
+	}
+}
@@ -0,0 +1,290 @@
+// Package logging sets up structured logging with log/slog and ties each log
+// line to the request that caused it.
+//
+// Every request carries a request ID in its X-Request-ID header. The gin
+// Middleware accepts the ID a caller sent or generates one, and Transport
+// forwards it to the services called while handling the request, so the
+// gateway's log lines and those of the backend calls they caused share it.
+// Loggers built by New add it to every line logged with the request's
+// context, as request_id.
+package logging
+
+import (
+	"context"
+	cryptorand "crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HeaderRequestID is the header request IDs travel in.
+const HeaderRequestID = "X-Request-ID"
+
+// Formats, the values of Config.Format.
+const (
+	FormatJSON = "json"
+	FormatText = "text"
+)
+
+// maxRequestIDLength bounds the request IDs accepted from callers.
+const maxRequestIDLength = 128
+
+// Config configures a service's logging. Services embed it in their
+// configuration.
+type Config struct {
+	// Level is the least severe level logged: debug, info, warn or error.
+	Level string `config:"level" env:"LOG_LEVEL" default:"info"`
+	// Format is json, or text for reading logs in a terminal.
+	Format string `config:"format" env:"LOG_FORMAT" default:"json"`
+	// SampleRate is the fraction of requests to sampled routes, such as
+	// redirects, whose info and debug lines are logged. Warnings and errors
+	// are always logged.
+	SampleRate float64 `config:"sample_rate" env:"LOG_SAMPLE_RATE" default:"1"`
+}
+
+// Options returns the Options described by c, or an error if a setting is
+// invalid.
+func (c Config) Options() ([]Option, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Level)); err != nil {
+		return nil, fmt.Errorf("unknown level %q", c.Level)
+	}
+	if c.SampleRate < 0 || c.SampleRate > 1 {
+		return nil, errors.New("sample_rate must be between 0 and 1")
+	}
+	opts := []Option{WithLevel(level), WithSampleRate(c.SampleRate)}
+	switch c.Format {
+	case FormatJSON:
+	case FormatText:
+		opts = append(opts, WithText())
+	default:
+		return nil, fmt.Errorf("unknown format %q", c.Format)
+	}
+	return opts, nil
+}
+
+// Option configures the Logger created by New.
+type Option func(*options)
+
+type options struct {
+	level      slog.Leveler
+	text       bool
+	sampleRate float64
+}
+
+// WithLevel logs lines at level and above.
+func WithLevel(level slog.Leveler) Option {
+	return func(o *options) {
+		o.level = level
+	}
+}
+
+// WithText logs in slog's key=value text format instead of JSON.
+func WithText() Option {
+	return func(o *options) {
+		o.text = true
+	}
+}
+
+// WithSampleRate logs the info and debug lines of rate of the requests to
+// sampled routes.
+func WithSampleRate(rate float64) Option {
+	return func(o *options) {
+		o.sampleRate = rate
+	}
+}
+
+// New creates a Logger that writes JSON lines to w, adding the request ID of
+// the context each line is logged with. Services install it with
+// slog.SetDefault.
+func New(w io.Writer, opts ...Option) *slog.Logger {
+	o := options{level: slog.LevelInfo, sampleRate: 1}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	handlerOpts := &slog.HandlerOptions{Level: o.level}
+	var h slog.Handler = slog.NewJSONHandler(w, handlerOpts)
+	if o.text {
+		h = slog.NewTextHandler(w, handlerOpts)
+	}
+	return slog.New(&handler{Handler: h, sampleRate: o.sampleRate})
+}
+
+// handler adds request IDs to the lines of the Handler it wraps and drops
+// those of requests sampled out.
+type handler struct {
+	slog.Handler
+	sampleRate float64
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	if s, ok := ctx.Value(sampleKey{}).(*sample); ok && r.Level < slog.LevelWarn && !s.keep(h.sampleRate) {
+		return nil
+	}
+	if id := RequestID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &handler{Handler: h.Handler.WithAttrs(attrs), sampleRate: h.sampleRate}
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return &handler{Handler: h.Handler.WithGroup(name), sampleRate: h.sampleRate}
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx that carries the request ID id.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID ctx carries, or "" if it has none.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+type sampleKey struct{}
+
+// sample decides once whether the lines of a request are logged, so a
+// request is logged in full or not at all.
+type sample struct {
+	once sync.Once
+	kept bool
+}
+
+func (s *sample) keep(rate float64) bool {
+	s.once.Do(func() {
+		s.kept = rand.Float64() < rate
+	})
+	return s.kept
+}
+
+// Sampled returns a copy of ctx whose info and debug lines are logged only
+// for the configured sample rate of requests.
+func Sampled(ctx context.Context) context.Context {
+	return context.WithValue(ctx, sampleKey{}, &sample{})
+}
+
+// newRequestID returns a random 128-bit request ID.
+func newRequestID() string {
+	var b [16]byte
+	_, _ = cryptorand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// validRequestID reports whether a request ID sent by a caller may be used.
+// It must be short and printable, so it cannot forge log lines.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	return !strings.ContainsFunc(id, func(r rune) bool { return r <= ' ' || r > '~' })
+}
+
+// MiddlewareOption configures the Middleware.
+type MiddlewareOption func(*middleware)
+
+type middleware struct {
+	sampled map[string]bool
+}
+
+// SampleRoutes samples the lines of requests to the given route templates,
+// such as /:shortKey, at the Logger's sample rate.
+func SampleRoutes(routes ...string) MiddlewareOption {
+	return func(m *middleware) {
+		for _, route := range routes {
+			m.sampled[route] = true
+		}
+	}
+}
+
+// Middleware gives each request to a gin router a request ID, accepting a
+// valid X-Request-ID from the caller or generating one, echoes it in the
+// response and logs the request once it has been served. It must be
+// installed before the routes are registered, ahead of other middleware.
+func Middleware(opts ...MiddlewareOption) gin.HandlerFunc {
+	m := &middleware{sampled: make(map[string]bool)}
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	return func(c *gin.Context) {
+		id := c.GetHeader(HeaderRequestID)
+		if !validRequestID(id) {
+			id = newRequestID()
+			// Proxied requests pass the ID on with the other headers.
+			c.Request.Header.Set(HeaderRequestID, id)
+		}
+		c.Header(HeaderRequestID, id)
+
+		ctx := WithRequestID(c.Request.Context(), id)
+		if m.sampled[c.FullPath()] {
+			ctx = Sampled(ctx)
+		}
+		c.Request = c.Request.WithContext(ctx)
+
+		start := time.Now()
+		c.Next()
+
+		status := c.Writer.Status()
+		level := slog.LevelInfo
+		if status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		slog.LogAttrs(ctx, level, "request",
+			slog.String("method", c.Request.Method),
+			slog.String("route", c.FullPath()),
+			slog.String("path", c.Request.URL.Path),
+			slog.Int("status", status),
+			slog.Int("bytes", c.Writer.Size()),
+			slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.String("client_ip", c.ClientIP()),
+		)
+	}
+}
+
+// Transport returns a RoundTripper that sends requests through next with the
+// request ID of their context in the X-Request-ID header, unless they have
+// one already.
+func Transport(next http.RoundTripper) http.RoundTripper {
+	return &transport{next: next}
+}
+
+type transport struct {
+	next http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	id := RequestID(req.Context())
+	if id == "" || req.Header.Get(HeaderRequestID) != "" {
+		return t.next.RoundTrip(req)
+	}
+
+	// A RoundTripper must not modify the caller's request.
+	out := req.Clone(req.Context())
+	out.Header.Set(HeaderRequestID, id)
+	return t.next.RoundTrip(out)
+}
+
+// Fatal logs msg and args at the error level and exits, for errors a service
+// cannot start after.
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
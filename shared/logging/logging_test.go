@@ -0,0 +1,211 @@
+package logging_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/iton0/duss/shared/logging"
+)
+
+// capture makes the default logger write JSON lines, built with opts, to the
+// returned buffer for the rest of the test.
+func capture(t *testing.T, opts ...logging.Option) *bytes.Buffer {
+	t.Helper()
+
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(logging.New(&buf, opts...))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return &buf
+}
+
+// lines decodes the JSON lines logged to buf.
+func lines(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+
+	var decoded []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var m map[string]any
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			t.Fatalf("expected a JSON line, but got %q", line)
+		}
+		decoded = append(decoded, m)
+	}
+	return decoded
+}
+
+func TestConfigOptions(t *testing.T) {
+	testCases := []struct {
+		name        string
+		config      logging.Config
+		expectedErr bool
+	}{
+		{"JSON", logging.Config{Level: "info", Format: logging.FormatJSON, SampleRate: 1}, false},
+		{"Text", logging.Config{Level: "DEBUG", Format: logging.FormatText, SampleRate: 0.1}, false},
+		{"Unknown Level", logging.Config{Level: "verbose", Format: logging.FormatJSON, SampleRate: 1}, true},
+		{"Unknown Format", logging.Config{Level: "info", Format: "xml", SampleRate: 1}, true},
+		{"Sample Rate Out Of Range", logging.Config{Level: "info", Format: logging.FormatJSON, SampleRate: -0.5}, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := tc.config.Options()
+			if (err != nil) != tc.expectedErr {
+				t.Fatalf("expected error %v, but got %v", tc.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	generated := regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+	testCases := []struct {
+		name       string
+		requestID  string
+		expectedID string // empty if the ID must be generated
+	}{
+		{"Generated", "", ""},
+		{"Accepted", "gateway-1234", "gateway-1234"},
+		{"Invalid Replaced", "forged\nline", ""},
+		{"Too Long Replaced", strings.Repeat("a", 200), ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			buf := capture(t)
+
+			var seen string
+			router := gin.New()
+			router.Use(logging.Middleware())
+			router.GET("/:shortKey", func(c *gin.Context) {
+				seen = logging.RequestID(c.Request.Context())
+				slog.InfoContext(c.Request.Context(), "handled")
+				c.Status(http.StatusFound)
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/abc", nil)
+			if tc.requestID != "" {
+				req.Header.Set(logging.HeaderRequestID, tc.requestID)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			id := w.Header().Get(logging.HeaderRequestID)
+			if tc.expectedID != "" && id != tc.expectedID {
+				t.Fatalf("expected request ID %q, but got %q", tc.expectedID, id)
+			}
+			if tc.expectedID == "" && !generated.MatchString(id) {
+				t.Fatalf("expected a generated request ID, but got %q", id)
+			}
+			if seen != id {
+				t.Errorf("expected the handler to see request ID %q, but got %q", id, seen)
+			}
+
+			logged := lines(t, buf)
+			if len(logged) != 2 {
+				t.Fatalf("expected the handler's line and the request's, but got %d lines", len(logged))
+			}
+			for _, line := range logged {
+				if line["request_id"] != id {
+					t.Errorf("expected %q to be logged with request ID %q, but got %v", line["msg"], id, line["request_id"])
+				}
+			}
+			if request := logged[1]; request["route"] != "/:shortKey" || request["status"] != float64(http.StatusFound) {
+				t.Errorf("expected the request to /:shortKey to be logged with status 302, but got %v", request)
+			}
+		})
+	}
+}
+
+func TestSampling(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	testCases := []struct {
+		name          string
+		path          string
+		status        int
+		expectedLines int
+	}{
+		{"Sampled Route", "/abc", http.StatusFound, 0},
+		{"Sampled Route Error", "/abc", http.StatusInternalServerError, 1},
+		{"Other Route", "/api/v1/shorten", http.StatusCreated, 1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Nothing is kept at a sample rate of 0, except errors.
+			buf := capture(t, logging.WithSampleRate(0))
+
+			router := gin.New()
+			router.Use(logging.Middleware(logging.SampleRoutes("/:shortKey")))
+			router.GET("/:shortKey", func(c *gin.Context) { c.Status(tc.status) })
+			router.GET("/api/v1/shorten", func(c *gin.Context) { c.Status(tc.status) })
+
+			router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, tc.path, nil))
+
+			if got := len(lines(t, buf)); got != tc.expectedLines {
+				t.Fatalf("expected %d lines, but got %d", tc.expectedLines, got)
+			}
+		})
+	}
+}
+
+func TestTransport(t *testing.T) {
+	var received string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Get(logging.HeaderRequestID)
+	}))
+	t.Cleanup(server.Close)
+	client := &http.Client{Transport: logging.Transport(http.DefaultTransport)}
+
+	testCases := []struct {
+		name     string
+		ctxID    string
+		headerID string
+		expected string
+	}{
+		{"Forwarded", "req-1", "", "req-1"},
+		{"Explicit Header Kept", "req-1", "req-2", "req-2"},
+		{"No Request ID", "", "", ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tc.ctxID != "" {
+				ctx = logging.WithRequestID(ctx, tc.ctxID)
+			}
+			req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+			if tc.headerID != "" {
+				req.Header.Set(logging.HeaderRequestID, tc.headerID)
+			}
+
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			resp.Body.Close()
+
+			if received != tc.expected {
+				t.Fatalf("expected request ID %q, but got %q", tc.expected, received)
+			}
+			if tc.headerID == "" && req.Header.Get(logging.HeaderRequestID) != "" {
+				t.Errorf("expected the caller's request to be left alone, but it got a request ID")
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+// Package metrics defines the Prometheus metrics exported by every service,
+// and the middleware and hooks that record them.
+//
+// All metrics live in the duss_ namespace and are registered with the default
+// Prometheus registry, which also exports the Go runtime (go_*) and process
+// (process_*) metrics. Prometheus tells services apart by their scrape job, so
+// the metrics themselves carry no service label:
+//
+//	duss_http_requests_total{method,route,status}          requests served
+//	duss_http_request_duration_seconds{method,route}        request latency
+//	duss_http_requests_in_flight                            requests being served
+//	duss_storage_operation_duration_seconds{store,operation,outcome}
+//	                                                        PostgreSQL and Redis latency
+//	duss_cache_lookups_total{result}                        redirect cache hits and misses
+//	duss_keygen_keys_generated_total                        short keys generated
+//	duss_key_collisions_total{stage}                        generated keys that were taken
+//
+// The httpclient package exports the Stats of every Client and Balancer under
+// duss_http_client_, one series per upstream:
+//
+//	duss_http_client_requests_total{upstream}               calls made
+//	duss_http_client_attempts_total{upstream}               requests sent, including retries
+//	duss_http_client_retries_total{upstream}                requests retried
+//	duss_http_client_failures_total{upstream}               attempts that failed or got a 5xx
+//	duss_http_client_rejected_total{upstream}               calls refused by an open breaker
+//	duss_http_client_breaker_state{upstream,state}          1 for the breaker's current state
+//	duss_http_client_breaker_transitions_total{upstream,state}
+//	                                                        times the breaker entered a state
+//	duss_http_client_endpoints{upstream}                    endpoints balanced across
+//	duss_http_client_endpoint_outstanding_requests{upstream,endpoint}
+//	                                                        requests in flight to an endpoint
+//	duss_http_client_endpoint_latency_seconds{upstream,endpoint}
+//	                                                        moving average endpoint latency
+//	duss_http_client_endpoint_ejected{upstream,endpoint}    1 while an endpoint is ejected
+//	duss_http_client_ejections_total{upstream}              times an endpoint was ejected
+//	duss_http_client_hedges_total{upstream}                 requests hedged to a second endpoint
+//	duss_http_client_hedge_delay_seconds{upstream}          wait before hedging
+//
+// Routes are labelled with their template, such as /:shortKey, never with the
+// raw path, so the number of series stays bounded.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Namespace prefixes the name of every metric defined here.
+const Namespace = "duss"
+
+// Storage names, the values of the store label.
+const (
+	StorePostgres = "postgres"
+	StoreRedis    = "redis"
+)
+
+// Outcomes of a storage operation, the values of the outcome label.
+const (
+	OutcomeOK    = "ok"
+	OutcomeError = "error"
+)
+
+// Cache lookup results, the values of the result label.
+const (
+	CacheHit  = "hit"
+	CacheMiss = "miss"
+)
+
+// Stages at which a generated key can collide, the values of the stage label.
+const (
+	// StageBatch counts keys generated twice within one batch.
+	StageBatch = "batch"
+	// StageStorage counts keys already taken when the link was saved.
+	StageStorage = "storage"
+)
+
+// unmatchedRoute labels requests that matched no route, such as 404s.
+const unmatchedRoute = "unmatched"
+
+var (
+	// HTTPRequests counts the requests served, by route and status code.
+	HTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "HTTP requests served, by method, route template and status code.",
+	}, []string{"method", "route", "status"})
+
+	// HTTPDuration observes how long requests take to serve.
+	HTTPDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Time taken to serve HTTP requests, by method and route template.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	// HTTPInFlight is the number of requests being served.
+	HTTPInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Subsystem: "http",
+		Name:      "requests_in_flight",
+		Help:      "HTTP requests currently being served.",
+	})
+
+	// StorageDuration observes the latency of PostgreSQL queries and Redis
+	// commands.
+	StorageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Subsystem: "storage",
+		Name:      "operation_duration_seconds",
+		Help:      "Latency of storage operations, by store, operation and outcome.",
+		// 0.5ms to about 1s: storage calls are much faster than requests.
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 12),
+	}, []string{"store", "operation", "outcome"})
+
+	// CacheLookups counts redirect cache hits and misses.
+	CacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: "cache",
+		Name:      "lookups_total",
+		Help:      "Redirect cache lookups, by result.",
+	}, []string{"result"})
+
+	// KeysGenerated counts the short keys created by the key generator.
+	KeysGenerated = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: "keygen",
+		Name:      "keys_generated_total",
+		Help:      "Short keys generated.",
+	})
+
+	// KeyCollisions counts generated keys that turned out to be taken.
+	KeyCollisions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "key_collisions_total",
+		Help:      "Generated short keys that collided, by the stage that found the collision.",
+	}, []string{"stage"})
+)
+
+// Handler serves the metrics in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Middleware records the rate, errors and duration of the requests served by
+// a gin router. It must be installed before the routes are registered.
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		HTTPInFlight.Inc()
+		defer HTTPInFlight.Dec()
+
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = unmatchedRoute
+		}
+		method := c.Request.Method
+		HTTPRequests.WithLabelValues(method, route, strconv.Itoa(c.Writer.Status())).Inc()
+		HTTPDuration.WithLabelValues(method, route).Observe(time.Since(start).Seconds())
+	}
+}
+
+// ObserveStorage records a storage operation on store that started at start
+// and ended with err.
+func ObserveStorage(store, operation string, start time.Time, err error) {
+	outcome := OutcomeOK
+	if err != nil {
+		outcome = OutcomeError
+	}
+	StorageDuration.WithLabelValues(store, operation, outcome).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,144 @@
+package metrics_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/iton0/duss/shared/metrics"
+	"github.com/iton0/duss/shared/testutil/redistest"
+)
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(metrics.Middleware())
+	router.GET("/:shortKey", func(c *gin.Context) { c.Status(http.StatusFound) })
+	router.GET("/metrics", gin.WrapH(metrics.Handler()))
+
+	testCases := []struct {
+		name           string
+		paths          []string
+		expectedRoute  string
+		expectedStatus string
+	}{
+		{"Route Template", []string{"/abc", "/def", "/ghi"}, "/:shortKey", "302"},
+		{"Unmatched Route", []string{"/a/b"}, "unmatched", "404"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			counter := metrics.HTTPRequests.WithLabelValues(http.MethodGet, tc.expectedRoute, tc.expectedStatus)
+			before := testutil.ToFloat64(counter)
+
+			for _, path := range tc.paths {
+				router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+			}
+
+			if got := testutil.ToFloat64(counter) - before; got != float64(len(tc.paths)) {
+				t.Fatalf("expected %d requests on %s, but got %v", len(tc.paths), tc.expectedRoute, got)
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, name := range []string{"duss_http_requests_total", "duss_http_request_duration_seconds", "go_goroutines"} {
+		if !strings.Contains(w.Body.String(), name) {
+			t.Errorf("expected /metrics to export %s, but it did not", name)
+		}
+	}
+	if strings.Contains(w.Body.String(), `route="/abc"`) {
+		t.Errorf("expected raw paths to be left out of the route label, but got %s", `route="/abc"`)
+	}
+}
+
+func TestStatement(t *testing.T) {
+	testCases := []struct {
+		sql      string
+		expected string
+	}{
+		{"SELECT 1", "select"},
+		{"\n\t\tINSERT INTO urls VALUES ($1)", "insert"},
+		{"update urls SET redirects = redirects + 1", "update"},
+		{"-- ping", "other"},
+		{"", "other"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.expected, func(t *testing.T) {
+			if got := metrics.Statement(tc.sql); got != tc.expected {
+				t.Fatalf("expected %q, but got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestRedisHook(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{Addr: redistest.New(t).Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	rdb.AddHook(metrics.RedisHook{})
+	ctx := context.Background()
+
+	testCases := []struct {
+		name      string
+		operation string
+		run       func() error
+		outcome   string
+	}{
+		{"Command", "set", func() error { return rdb.Set(ctx, "k", "v", 0).Err() }, metrics.OutcomeOK},
+		// A missing key is not a failed command.
+		{"Missing Key", "get", func() error { return rdb.Get(ctx, "missing").Err() }, metrics.OutcomeOK},
+		{"Failed Command", "incr", func() error { return rdb.Incr(ctx, "k").Err() }, metrics.OutcomeError},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			before := observations(t, metrics.StoreRedis, tc.operation, tc.outcome)
+
+			err := tc.run()
+			if failed := err != nil && !errors.Is(err, redis.Nil); failed != (tc.outcome == metrics.OutcomeError) {
+				t.Fatalf("expected outcome %s, but got error %v", tc.outcome, err)
+			}
+
+			if got := observations(t, metrics.StoreRedis, tc.operation, tc.outcome) - before; got != 1 {
+				t.Fatalf("expected one %s %s observation, but got %d", tc.operation, tc.outcome, got)
+			}
+		})
+	}
+}
+
+// observations returns how many storage operations have been recorded with
+// the given labels.
+func observations(t *testing.T, store, operation, outcome string) uint64 {
+	t.Helper()
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("could not gather metrics: %v", err)
+	}
+	want := map[string]string{"store": store, "operation": operation, "outcome": outcome}
+	for _, family := range families {
+		if family.GetName() != "duss_storage_operation_duration_seconds" {
+			continue
+		}
+	metrics:
+		for _, m := range family.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if want[label.GetName()] != label.GetValue() {
+					continue metrics
+				}
+			}
+			return m.GetHistogram().GetSampleCount()
+		}
+	}
+	return 0
+}
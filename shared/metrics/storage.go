@@ -0,0 +1,100 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/redis/go-redis/v9"
+)
+
+// Ensure the hooks fulfil the client contracts.
+var (
+	_ pgx.QueryTracer = (*QueryTracer)(nil)
+	_ redis.Hook      = (*RedisHook)(nil)
+)
+
+// QueryTracer records the latency of the PostgreSQL queries of a pgx
+// connection, labelled by their statement type, such as select or insert. Set
+// it as the Tracer of a pgx.ConnConfig.
+type QueryTracer struct{}
+
+type queryStartKey struct{}
+
+type queryStart struct {
+	operation string
+	at        time.Time
+}
+
+// TraceQueryStart implements pgx.QueryTracer.
+func (QueryTracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	return context.WithValue(ctx, queryStartKey{}, queryStart{operation: Statement(data.SQL), at: time.Now()})
+}
+
+// TraceQueryEnd implements pgx.QueryTracer.
+func (QueryTracer) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
+	if start, ok := ctx.Value(queryStartKey{}).(queryStart); ok {
+		ObserveStorage(StorePostgres, start.operation, start.at, data.Err)
+	}
+}
+
+// Statement returns the lower-cased leading keyword of sql, such as select,
+// or "other" if it does not start with one.
+func Statement(sql string) string {
+	sql = strings.TrimSpace(sql)
+	end := strings.IndexFunc(sql, func(r rune) bool { return !unicode.IsLetter(r) })
+	if end < 0 {
+		end = len(sql)
+	}
+	if end == 0 {
+		return "other"
+	}
+	return strings.ToLower(sql[:end])
+}
+
+// RedisHook records the latency of the commands a go-redis client runs,
+// labelled by command name. Add it to a client with AddHook. Pipelines are
+// recorded as a single pipeline operation.
+type RedisHook struct{}
+
+// DialHook implements redis.Hook.
+func (RedisHook) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		start := time.Now()
+		conn, err := next(ctx, network, addr)
+		ObserveStorage(StoreRedis, "dial", start, err)
+		return conn, err
+	}
+}
+
+// ProcessHook implements redis.Hook.
+func (RedisHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmd)
+		ObserveStorage(StoreRedis, cmd.Name(), start, redisErr(err))
+		return err
+	}
+}
+
+// ProcessPipelineHook implements redis.Hook.
+func (RedisHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmds)
+		ObserveStorage(StoreRedis, "pipeline", start, redisErr(err))
+		return err
+	}
+}
+
+// redisErr drops redis.Nil, which reports a missing key rather than a failure.
+func redisErr(err error) error {
+	if errors.Is(err, redis.Nil) {
+		return nil
+	}
+	return err
+}
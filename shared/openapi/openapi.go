@@ -0,0 +1,333 @@
+// Package openapi checks HTTP requests and responses against the OpenAPI 3
+// description of a service's API.
+//
+// Every service embeds the description of its API and installs Middleware
+// on its router, so requests that do not match it are rejected with a
+// problem before they reach a handler. A request body the description
+// rejects is reported with the code in the operation's x-problem-code
+// extension, invalid_request by default:
+//
+//	post:
+//	  operationId: shorten
+//	  x-problem-code: invalid_url
+//
+// Only JSON and form bodies are checked; uploads such as CSV files are
+// streamed to their handler as they are, and HTML pages are only checked for
+// their status and Content-Type.
+package openapi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+	"github.com/gin-gonic/gin"
+
+	"github.com/iton0/duss/shared/problem"
+)
+
+// problemCodeExtension names the operation extension holding the problem
+// code of requests the description rejects.
+const problemCodeExtension = "x-problem-code"
+
+// maxResponseSize bounds the responses Middleware keeps to check; larger
+// ones are only checked for their status.
+const maxResponseSize = 1 << 20
+
+// Spec is a loaded API description.
+type Spec struct {
+	doc    *openapi3.T
+	router routers.Router
+}
+
+// Operation is a method and path template, such as GET /{shortKey}, that a
+// Spec describes.
+type Operation struct {
+	Method string
+	Path   string
+}
+
+// String returns o as "METHOD /path".
+func (o Operation) String() string {
+	return o.Method + " " + o.Path
+}
+
+// Load parses and validates the OpenAPI 3 document in data, in YAML or
+// JSON.
+func Load(data []byte) (*Spec, error) {
+	doc, err := openapi3.NewLoader().LoadFromData(data)
+	if err != nil {
+		return nil, fmt.Errorf("openapi: could not parse description: %w", err)
+	}
+	if err := doc.Validate(context.Background()); err != nil {
+		return nil, fmt.Errorf("openapi: invalid description: %w", err)
+	}
+	// Requests are matched whatever host they were sent to, since every
+	// replica and test server answers under its own.
+	routed := *doc
+	routed.Servers = openapi3.Servers{{URL: "/"}}
+	router, err := gorillamux.NewRouter(&routed)
+	if err != nil {
+		return nil, fmt.Errorf("openapi: could not route description: %w", err)
+	}
+	return &Spec{doc: doc, router: router}, nil
+}
+
+// MustLoad is like Load but panics if data is not a valid description. It
+// is meant for descriptions embedded in a service.
+func MustLoad(data []byte) *Spec {
+	s, err := Load(data)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// Document returns the parsed description.
+func (s *Spec) Document() *openapi3.T {
+	return s.doc
+}
+
+// Operations returns the operations s describes, sorted by path and method.
+func (s *Spec) Operations() []Operation {
+	var ops []Operation
+	for path, item := range s.doc.Paths.Map() {
+		for method := range item.Operations() {
+			ops = append(ops, Operation{Method: method, Path: path})
+		}
+	}
+	slices.SortFunc(ops, func(a, b Operation) int {
+		return strings.Compare(a.Path+" "+a.Method, b.Path+" "+b.Method)
+	})
+	return ops
+}
+
+// ValidateRequest checks r against the operation it is for, returning a
+// *problem.Problem if it does not match. A body of a content type the
+// operation does not accept is answered 415 Unsupported Media Type. Requests for operations s does not
+// describe are left to the router and pass. The body of r, if read, is
+// replaced so handlers can read it again.
+func (s *Spec) ValidateRequest(r *http.Request) error {
+	input, ok := s.input(r)
+	if !ok {
+		return nil
+	}
+	err := openapi3filter.ValidateRequest(r.Context(), input)
+	if err == nil {
+		return nil
+	}
+	var secErr *openapi3filter.SecurityRequirementsError
+	if errors.As(err, &secErr) {
+		return problem.New(http.StatusUnauthorized, problem.CodeUnauthorized, "missing credentials")
+	}
+	var reqErr *openapi3filter.RequestError
+	if errors.As(err, &reqErr) && reqErr.RequestBody != nil && reqErr.RequestBody.Content.Get(r.Header.Get("Content-Type")) == nil {
+		return problem.New(http.StatusUnsupportedMediaType, problem.CodeUnsupportedMediaType,
+			fmt.Sprintf("Content-Type must be one of %s", strings.Join(slices.Sorted(maps.Keys(reqErr.RequestBody.Content)), ", ")))
+	}
+	code := problem.CodeInvalidRequest
+	if v, ok := input.Route.Operation.Extensions[problemCodeExtension].(string); ok {
+		code = problem.Code(v)
+	}
+	return problem.New(http.StatusBadRequest, code, describe(err))
+}
+
+// ValidateResponse checks a response to r with status, header and body
+// against the operation r is for. Responses to requests for operations s
+// does not describe pass.
+func (s *Spec) ValidateResponse(r *http.Request, status int, header http.Header, body []byte) error {
+	input, ok := s.input(r)
+	if !ok {
+		return nil
+	}
+	opts := &openapi3filter.Options{
+		IncludeResponseStatus: true,
+		ExcludeResponseBody:   !checksBody(header.Get("Content-Type")),
+	}
+	opts.WithCustomSchemaErrorFunc(schemaErrorReason)
+	return openapi3filter.ValidateResponse(r.Context(), &openapi3filter.ResponseValidationInput{
+		RequestValidationInput: input,
+		Status:                 status,
+		Header:                 header,
+		Body:                   io.NopCloser(bytes.NewReader(body)),
+		Options:                opts,
+	})
+}
+
+// input returns the validation input of r, or false if s does not describe
+// the operation r is for.
+func (s *Spec) input(r *http.Request) (*openapi3filter.RequestValidationInput, bool) {
+	route, params, err := s.router.FindRoute(r)
+	if err != nil {
+		return nil, false
+	}
+	opts := &openapi3filter.Options{
+		ExcludeRequestBody: !checksBody(r.Header.Get("Content-Type")),
+		// Credentials are checked by the handlers; the description only
+		// requires them to be present.
+		AuthenticationFunc: authenticate,
+	}
+	opts.WithCustomSchemaErrorFunc(schemaErrorReason)
+	return &openapi3filter.RequestValidationInput{
+		Request:    r,
+		PathParams: params,
+		Route:      route,
+		Options:    opts,
+	}, true
+}
+
+// Option configures Middleware.
+type Option func(*middlewareConfig)
+
+type middlewareConfig struct {
+	responses bool
+}
+
+// WithResponseValidation also checks the responses of the handlers, logging
+// an error for each one that does not match the description. The responses
+// are sent unchanged.
+func WithResponseValidation() Option {
+	return func(c *middlewareConfig) {
+		c.responses = true
+	}
+}
+
+// Middleware returns gin middleware that answers requests that do not match
+// s with their problem. It must be installed after logging.Middleware, so
+// the problems carry the request's ID.
+func (s *Spec) Middleware(opts ...Option) gin.HandlerFunc {
+	var cfg middlewareConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	return func(c *gin.Context) {
+		if err := s.ValidateRequest(c.Request); err != nil {
+			var p *problem.Problem
+			if !errors.As(err, &p) {
+				p = problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, err.Error())
+			}
+			problem.Abort(c, p)
+			return
+		}
+		if !cfg.responses {
+			c.Next()
+			return
+		}
+
+		w := &recordingWriter{ResponseWriter: c.Writer}
+		c.Writer = w
+		c.Next()
+
+		body := w.body.Bytes()
+		if w.truncated {
+			// The status and headers are still worth checking.
+			body = nil
+		}
+		if err := s.ValidateResponse(c.Request, w.Status(), w.Header(), body); err != nil {
+			slog.ErrorContext(c.Request.Context(), "openapi: response does not match the API description",
+				"route", c.FullPath(), "status", w.Status(), "error", err)
+		}
+	}
+}
+
+// recordingWriter keeps a copy of the start of the response it writes.
+type recordingWriter struct {
+	gin.ResponseWriter
+	body      bytes.Buffer
+	truncated bool
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.record(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.record([]byte(s))
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *recordingWriter) record(b []byte) {
+	if w.truncated || w.body.Len()+len(b) > maxResponseSize {
+		w.truncated = true
+		return
+	}
+	w.body.Write(b)
+}
+
+// checksBody reports whether bodies of contentType are checked: JSON and
+// form bodies are, uploads and pages are not.
+func checksBody(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") ||
+		mediaType == "application/x-www-form-urlencoded"
+}
+
+// authenticate accepts requests that carry the credentials input asks for,
+// whether or not they are valid.
+func authenticate(_ context.Context, input *openapi3filter.AuthenticationInput) error {
+	scheme := input.SecurityScheme
+	if scheme.Type == "http" && strings.EqualFold(scheme.Scheme, "bearer") {
+		token, ok := strings.CutPrefix(input.RequestValidationInput.Request.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			return errors.New("missing bearer token")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported security scheme %q", input.SecuritySchemeName)
+}
+
+// schemaErrorReason describes a value that does not match its schema
+// without dumping the schema.
+func schemaErrorReason(err *openapi3.SchemaError) string {
+	// The reason for a missing property already names it.
+	if pointer := err.JSONPointer(); len(pointer) > 0 && err.SchemaField != "required" {
+		return fmt.Sprintf("%s: %s", strings.Join(pointer, "."), err.Reason)
+	}
+	return err.Reason
+}
+
+// describe returns the detail of a request error.
+func describe(err error) string {
+	var reqErr *openapi3filter.RequestError
+	if !errors.As(err, &reqErr) {
+		return err.Error()
+	}
+	switch {
+	case reqErr.Parameter != nil:
+		return fmt.Sprintf("invalid %s parameter %q: %s", reqErr.Parameter.In, reqErr.Parameter.Name, reason(reqErr))
+	case reqErr.RequestBody != nil:
+		return "invalid request body: " + reason(reqErr)
+	default:
+		return reason(reqErr)
+	}
+}
+
+// reason returns why a request was rejected.
+func reason(err *openapi3filter.RequestError) string {
+	var schemaErr *openapi3.SchemaError
+	switch {
+	case errors.As(err.Err, &schemaErr):
+		return schemaErrorReason(schemaErr)
+	case err.Err != nil:
+		return err.Err.Error()
+	default:
+		return err.Reason
+	}
+}
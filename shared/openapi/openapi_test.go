@@ -0,0 +1,200 @@
+package openapi_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/iton0/duss/shared/logging"
+	"github.com/iton0/duss/shared/openapi"
+	"github.com/iton0/duss/shared/problem"
+)
+
+const description = `
+openapi: 3.0.3
+info:
+  title: links
+  version: "1"
+paths:
+  /links:
+    post:
+      operationId: createLink
+      x-problem-code: invalid_url
+      requestBody:
+        required: true
+        content:
+          application/json:
+            schema:
+              type: object
+              required: [url]
+              properties:
+                url:
+                  type: string
+                dedupe:
+                  type: boolean
+      responses:
+        "201":
+          description: The link.
+          content:
+            application/json:
+              schema:
+                type: object
+                required: [short_url]
+                properties:
+                  short_url:
+                    type: string
+  /links/{key}:
+    parameters:
+      - name: key
+        in: path
+        required: true
+        schema:
+          type: string
+    put:
+      operationId: updateLink
+      security:
+        - adminToken: []
+      parameters:
+        - name: limit
+          in: query
+          schema:
+            type: integer
+      responses:
+        "204":
+          description: Updated.
+components:
+  securitySchemes:
+    adminToken:
+      type: http
+      scheme: bearer
+`
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	spec, err := openapi.Load([]byte(description))
+	if err != nil {
+		t.Fatalf("failed to load description: %v", err)
+	}
+
+	var logs bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(logging.New(&logs))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+
+	router := gin.New()
+	router.Use(logging.Middleware(), spec.Middleware(openapi.WithResponseValidation()))
+	router.POST("/links", func(c *gin.Context) {
+		var body map[string]any
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		if body["url"] == "drift" {
+			c.JSON(http.StatusCreated, gin.H{"url": body["url"]})
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{"short_url": "http://duss.io/abc"})
+	})
+	router.PUT("/links/:key", func(c *gin.Context) { c.Status(http.StatusNoContent) })
+	router.GET("/undocumented", func(c *gin.Context) { c.Status(http.StatusTeapot) })
+
+	testCases := []struct {
+		name           string
+		method         string
+		path           string
+		body           string
+		contentType    string
+		authorization  string
+		expectedStatus int
+		expectedCode   problem.Code
+		expectedDetail string
+		expectedLog    bool
+	}{
+		{"Valid", http.MethodPost, "/links", `{"url":"https://example.com"}`, "", "", http.StatusCreated, "", "", false},
+		{"Missing Property", http.MethodPost, "/links", `{}`, "", "", http.StatusBadRequest, problem.CodeInvalidURL, `invalid request body: property "url" is missing`, false},
+		{"Wrong Type", http.MethodPost, "/links", `{"url":"https://example.com","dedupe":"yes"}`, "", "", http.StatusBadRequest, problem.CodeInvalidURL, "invalid request body: dedupe: value must be a boolean", false},
+		{"Malformed Body", http.MethodPost, "/links", `{"url":`, "", "", http.StatusBadRequest, problem.CodeInvalidURL, "", false},
+		{"Unsupported Media Type", http.MethodPost, "/links", "url=https://example.com", "application/x-www-form-urlencoded", "", http.StatusUnsupportedMediaType, problem.CodeUnsupportedMediaType, "Content-Type must be one of application/json", false},
+		{"Response Drift", http.MethodPost, "/links", `{"url":"drift"}`, "", "", http.StatusCreated, "", "", true},
+		{"Authorized", http.MethodPut, "/links/abc?limit=3", "", "", "Bearer token", http.StatusNoContent, "", "", false},
+		{"Missing Credentials", http.MethodPut, "/links/abc", "", "", "", http.StatusUnauthorized, problem.CodeUnauthorized, "missing credentials", false},
+		{"Invalid Parameter", http.MethodPut, "/links/abc?limit=many", "", "", "Bearer token", http.StatusBadRequest, problem.CodeInvalidRequest, "", false},
+		{"Undocumented Route", http.MethodGet, "/undocumented", "", "", "", http.StatusTeapot, "", "", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			logs.Reset()
+			req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+			if tc.body != "" {
+				contentType := tc.contentType
+				if contentType == "" {
+					contentType = "application/json"
+				}
+				req.Header.Set("Content-Type", contentType)
+			}
+			if tc.authorization != "" {
+				req.Header.Set("Authorization", tc.authorization)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != tc.expectedStatus {
+				t.Fatalf("expected status %d, but got %d: %s", tc.expectedStatus, w.Code, w.Body.String())
+			}
+			if tc.expectedCode != "" {
+				var p problem.Problem
+				if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+					t.Fatalf("could not decode problem: %v", err)
+				}
+				if p.Code != tc.expectedCode {
+					t.Errorf("expected problem code %q, but got %q", tc.expectedCode, p.Code)
+				}
+				if tc.expectedDetail != "" && p.Detail != tc.expectedDetail {
+					t.Errorf("expected detail %q, but got %q", tc.expectedDetail, p.Detail)
+				}
+			}
+			logged := strings.Contains(logs.String(), "does not match the API description")
+			if logged != tc.expectedLog {
+				t.Errorf("expected a logged mismatch to be %v, but got %v: %s", tc.expectedLog, logged, logs.String())
+			}
+		})
+	}
+}
+
+func TestOperations(t *testing.T) {
+	spec := openapi.MustLoad([]byte(description))
+
+	var got []string
+	for _, op := range spec.Operations() {
+		got = append(got, op.String())
+	}
+	expected := []string{"POST /links", "PUT /links/{key}"}
+	if strings.Join(got, ", ") != strings.Join(expected, ", ") {
+		t.Errorf("expected operations %v, but got %v", expected, got)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	testCases := []struct {
+		name string
+		data string
+	}{
+		{"Not YAML", "{"},
+		{"Missing Responses", "openapi: 3.0.3\ninfo: {title: t, version: \"1\"}\npaths:\n  /a:\n    get: {}\n"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := openapi.Load([]byte(tc.data)); err == nil {
+				t.Errorf("expected an error, but got none")
+			}
+		})
+	}
+}
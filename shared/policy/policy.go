@@ -0,0 +1,458 @@
+// Package policy decides which destination URLs duss is willing to shorten
+// and redirect to.
+//
+// Rules are kept in a YAML (or JSON) file:
+//
+//	mode: denylist          # or allowlist
+//	deny_domains: [evil.example, phish.test]
+//	deny_patterns: ['(?i)\.exe$']
+//	allow_domains: [example.com]
+//	untrusted_domains: [files.example]
+//	protected_domains: [paypal.com]
+//	lookalikes: untrusted   # or deny, off
+//
+// A domain rule matches the domain itself and every subdomain of it. A
+// pattern is a regular expression matched against the whole URL. Deny rules
+// always win; in allowlist mode a URL must also match an allow_domains entry.
+// URLs on untrusted_domains are allowed, but visitors are warned before being
+// redirected to them.
+//
+// The shortener also looks for hosts built to be mistaken for a
+// protected_domains entry or mixing scripts, and marks their links untrusted
+// or rejects them as lookalikes directs. Evaluate does not apply these rules.
+//
+// An Engine evaluates URLs against the current rules. Its rules can be hot
+// reloaded from the file with Watch and replaced at runtime through the admin
+// API served by Handler, which writes them back to the file so that other
+// services watching it pick them up.
+package policy
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/iton0/duss/shared/problem"
+)
+
+// ErrInvalidRules is returned when rules cannot be loaded or compiled.
+var ErrInvalidRules = errors.New("invalid policy rules")
+
+// Mode selects how URLs that match no rule are treated.
+type Mode string
+
+const (
+	// Denylist allows every URL that no deny rule matches.
+	Denylist Mode = "denylist"
+	// Allowlist only allows URLs whose host matches an allow_domains entry.
+	Allowlist Mode = "allowlist"
+)
+
+// Rules is the serialized form of a policy, as kept in the rules file and
+// exchanged through the admin API.
+type Rules struct {
+	Mode         Mode     `yaml:"mode,omitempty" json:"mode,omitempty"`
+	DenyDomains  []string `yaml:"deny_domains,omitempty" json:"deny_domains,omitempty"`
+	DenyPatterns []string `yaml:"deny_patterns,omitempty" json:"deny_patterns,omitempty"`
+	AllowDomains []string `yaml:"allow_domains,omitempty" json:"allow_domains,omitempty"`
+	// UntrustedDomains are allowed, but redirects to them go through a
+	// warning page.
+	UntrustedDomains []string `yaml:"untrusted_domains,omitempty" json:"untrusted_domains,omitempty"`
+	// ProtectedDomains are brand domains that other hosts must not imitate.
+	ProtectedDomains []string `yaml:"protected_domains,omitempty" json:"protected_domains,omitempty"`
+	// Lookalikes is what the shortener does with URLs on lookalike hosts.
+	// It defaults to LookalikesUntrusted.
+	Lookalikes LookalikeAction `yaml:"lookalikes,omitempty" json:"lookalikes,omitempty"`
+}
+
+// LookalikeAction selects how URLs on lookalike hosts are treated.
+type LookalikeAction string
+
+const (
+	// LookalikesUntrusted shortens them, marking the link untrusted.
+	LookalikesUntrusted LookalikeAction = "untrusted"
+	// LookalikesDeny refuses to shorten them.
+	LookalikesDeny LookalikeAction = "deny"
+	// LookalikesOff disables lookalike detection.
+	LookalikesOff LookalikeAction = "off"
+)
+
+// Config holds the settings services load an Engine from.
+type Config struct {
+	// File is the rules file, shared by every replica of the shortener and
+	// redirect services so that rules set through any one's admin API
+	// reach them all. Without one every URL is allowed until rules are set
+	// through the admin API, and only the service that received them
+	// applies them.
+	File string `config:"file" env:"POLICY_FILE"`
+	// ReloadInterval is how often File is checked for changes.
+	ReloadInterval time.Duration `config:"reload_interval" env:"POLICY_RELOAD_INTERVAL" default:"10s"`
+}
+
+// Decision is the outcome of evaluating a URL.
+type Decision struct {
+	Allowed bool
+	// Untrusted is set for allowed URLs that visitors should be warned about.
+	Untrusted bool
+	// Rule describes the rule that rejected the URL, such as
+	// "deny_domains: evil.example", or that marked it untrusted. It is empty
+	// for other allowed URLs.
+	Rule string
+}
+
+// Engine evaluates URLs against a set of rules that may be replaced at any
+// time. It is safe for concurrent use.
+type Engine struct {
+	rules atomic.Pointer[compiled]
+	path  string
+
+	// mu serialises updates so that the file and the in-memory rules agree.
+	mu sync.Mutex
+	// stamp identifies the version of the file the rules were read from.
+	stamp fileStamp
+}
+
+// fileStamp identifies a version of a file well enough to notice edits.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func stampOf(info os.FileInfo) fileStamp {
+	return fileStamp{modTime: info.ModTime(), size: info.Size()}
+}
+
+// New returns an Engine with rules and no backing file.
+func New(rules Rules) (*Engine, error) {
+	c, err := compile(rules)
+	if err != nil {
+		return nil, err
+	}
+	e := &Engine{}
+	e.rules.Store(c)
+	return e, nil
+}
+
+// Open returns an Engine loaded from path. Updates made through the admin API
+// are written back to path. A missing file is created empty, so services
+// sharing a fresh volume start out allowing every URL and all pick up the
+// first update. An empty path returns an Engine that allows every URL and
+// keeps updates in memory.
+func Open(path string) (*Engine, error) {
+	if path == "" {
+		return New(Rules{})
+	}
+
+	// O_EXCL leaves a file another service created in the meantime alone.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	switch {
+	case err == nil:
+		f.Close()
+	case !errors.Is(err, os.ErrExist):
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRules, err)
+	}
+
+	e := &Engine{path: path}
+	if err := e.reload(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Evaluate decides whether rawURL may be shortened or redirected to.
+func (e *Engine) Evaluate(rawURL string) Decision {
+	return e.rules.Load().evaluate(rawURL)
+}
+
+// Rules returns the rules currently in force.
+func (e *Engine) Rules() Rules {
+	return e.rules.Load().source
+}
+
+// Update replaces the rules in force and, when the Engine was opened from a
+// file, saves them to it. Invalid rules are rejected and the previous ones
+// kept.
+func (e *Engine) Update(rules Rules) error {
+	c, err := compile(rules)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.path != "" {
+		if err := writeFile(e.path, rules); err != nil {
+			return err
+		}
+		if info, err := os.Stat(e.path); err == nil {
+			e.stamp = stampOf(info)
+		}
+	}
+	e.rules.Store(c)
+	slog.Info("policy: rules updated", "rules", c.summary())
+	return nil
+}
+
+// Watch reloads the rules file whenever it changes, checking every interval
+// until ctx is done. A file that fails to load is logged and the rules in
+// force are kept. Watch returns at once for an Engine without a file.
+func (e *Engine) Watch(ctx context.Context, interval time.Duration) {
+	if e.path == "" || interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := e.reload(); err != nil {
+				slog.Warn("policy: keeping current rules", "error", err)
+			}
+		}
+	}
+}
+
+// reload loads the rules file if it changed since it was last read.
+func (e *Engine) reload() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	info, err := os.Stat(e.path)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidRules, err)
+	}
+	if e.rules.Load() != nil && stampOf(info) == e.stamp {
+		return nil
+	}
+
+	rules, err := Load(e.path)
+	if err != nil {
+		return err
+	}
+	c, err := compile(rules)
+	if err != nil {
+		return err
+	}
+
+	e.stamp = stampOf(info)
+	e.rules.Store(c)
+	slog.Info("policy: loaded", "file", e.path, "rules", c.summary())
+	return nil
+}
+
+// Load reads rules from a YAML or JSON file.
+func Load(path string) (Rules, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Rules{}, fmt.Errorf("%w: %v", ErrInvalidRules, err)
+	}
+
+	var rules Rules
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&rules); err != nil && !errors.Is(err, io.EOF) {
+		return Rules{}, fmt.Errorf("%w: %s: %v", ErrInvalidRules, path, err)
+	}
+	return rules, nil
+}
+
+// writeFile saves rules to path atomically, so a concurrent reader never sees
+// a partial file.
+func writeFile(path string, rules Rules) error {
+	data, err := yaml.Marshal(rules)
+	if err != nil {
+		return fmt.Errorf("failed to encode rules: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".policy-*")
+	if err != nil {
+		return fmt.Errorf("failed to save rules: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save rules: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save rules: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to save rules: %w", err)
+	}
+	return nil
+}
+
+// Handler serves the admin API for the Engine's rules: GET returns them and
+// PUT replaces them. Requests must carry "Authorization: Bearer <token>".
+func (e *Engine) Handler(token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, token) {
+			problem.Write(w, r, problem.New(http.StatusUnauthorized, problem.CodeUnauthorized, "missing or invalid admin token"))
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, e.Rules())
+		case http.MethodPut:
+			var rules Rules
+			dec := json.NewDecoder(r.Body)
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(&rules); err != nil {
+				problem.Write(w, r, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "invalid request body"))
+				return
+			}
+			if err := e.Update(rules); err != nil {
+				if errors.Is(err, ErrInvalidRules) {
+					problem.Write(w, r, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, err.Error()))
+					return
+				}
+				slog.ErrorContext(r.Context(), "policy: failed to update rules", "error", err)
+				problem.Write(w, r, problem.Internal())
+				return
+			}
+			writeJSON(w, http.StatusOK, e.Rules())
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			problem.Write(w, r, problem.New(http.StatusMethodNotAllowed, problem.CodeMethodNotAllowed, "use GET or PUT"))
+		}
+	})
+}
+
+func authorized(r *http.Request, token string) bool {
+	if token == "" {
+		return false
+	}
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// compiled is a validated, ready-to-evaluate form of Rules.
+type compiled struct {
+	source       Rules
+	allowlist    bool
+	denyDomains  []string
+	denyPatterns []*regexp.Regexp
+	allowDomains []string
+	untrusted    []string
+}
+
+func compile(rules Rules) (*compiled, error) {
+	c := &compiled{source: rules}
+
+	switch rules.Mode {
+	case "", Denylist:
+	case Allowlist:
+		c.allowlist = true
+	default:
+		return nil, fmt.Errorf("%w: unknown mode %q", ErrInvalidRules, rules.Mode)
+	}
+	switch rules.Lookalikes {
+	case "", LookalikesUntrusted, LookalikesDeny, LookalikesOff:
+	default:
+		return nil, fmt.Errorf("%w: unknown lookalikes action %q", ErrInvalidRules, rules.Lookalikes)
+	}
+
+	for _, d := range rules.DenyDomains {
+		if d = normalizeDomain(d); d != "" {
+			c.denyDomains = append(c.denyDomains, d)
+		}
+	}
+	for _, d := range rules.AllowDomains {
+		if d = normalizeDomain(d); d != "" {
+			c.allowDomains = append(c.allowDomains, d)
+		}
+	}
+	for _, d := range rules.UntrustedDomains {
+		if d = normalizeDomain(d); d != "" {
+			c.untrusted = append(c.untrusted, d)
+		}
+	}
+	for _, p := range rules.DenyPatterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("%w: deny_patterns: %v", ErrInvalidRules, err)
+		}
+		c.denyPatterns = append(c.denyPatterns, re)
+	}
+
+	return c, nil
+}
+
+func (c *compiled) evaluate(rawURL string) Decision {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Hostname() == "" {
+		return Decision{Rule: "unparseable URL"}
+	}
+	host := normalizeDomain(u.Hostname())
+
+	for _, d := range c.denyDomains {
+		if matchDomain(host, d) {
+			return Decision{Rule: "deny_domains: " + d}
+		}
+	}
+	for _, re := range c.denyPatterns {
+		if re.MatchString(rawURL) {
+			return Decision{Rule: "deny_patterns: " + re.String()}
+		}
+	}
+	if c.allowlist && !slices.ContainsFunc(c.allowDomains, func(d string) bool { return matchDomain(host, d) }) {
+		return Decision{Rule: "mode: allowlist"}
+	}
+	for _, d := range c.untrusted {
+		if matchDomain(host, d) {
+			return Decision{Allowed: true, Untrusted: true, Rule: "untrusted_domains: " + d}
+		}
+	}
+	return Decision{Allowed: true}
+}
+
+func (c *compiled) summary() string {
+	mode := Denylist
+	if c.allowlist {
+		mode = Allowlist
+	}
+	return fmt.Sprintf("mode %s, %d denied domains, %d denied patterns, %d allowed domains, %d untrusted domains, %d protected domains",
+		mode, len(c.denyDomains), len(c.denyPatterns), len(c.allowDomains), len(c.untrusted), len(c.source.ProtectedDomains))
+}
+
+// matchDomain reports whether host is domain or one of its subdomains.
+func matchDomain(host, domain string) bool {
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// normalizeDomain lowercases a domain rule or host and strips a leading "*."
+// wildcard and any leading or trailing dots.
+func normalizeDomain(d string) string {
+	d = strings.ToLower(strings.TrimSpace(d))
+	d = strings.TrimPrefix(d, "*.")
+	return strings.Trim(d, ".")
+}
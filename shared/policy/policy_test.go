@@ -0,0 +1,267 @@
+package policy_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iton0/duss/shared/policy"
+)
+
+func TestEvaluate(t *testing.T) {
+	denylist := policy.Rules{
+		DenyDomains:  []string{"Evil.Example", "*.phish.test"},
+		DenyPatterns: []string{`(?i)\.exe$`},
+	}
+	allowlist := policy.Rules{
+		Mode:             policy.Allowlist,
+		AllowDomains:     []string{"example.com"},
+		DenyDomains:      []string{"bad.example.com"},
+		UntrustedDomains: []string{"files.example.com", "other.test"},
+	}
+
+	untrusted := policy.Rules{
+		DenyDomains:      []string{"evil.example"},
+		UntrustedDomains: []string{"*.files.test", "evil.example"},
+	}
+
+	testCases := []struct {
+		name         string
+		rules        policy.Rules
+		url          string
+		expectedRule string
+	}{
+		{"No Rules", policy.Rules{}, "https://anything.test/", ""},
+		{"Denied Domain", denylist, "https://evil.example/login", "deny_domains: evil.example"},
+		{"Denied Domain Case", denylist, "https://EVIL.example/", "deny_domains: evil.example"},
+		{"Denied Subdomain", denylist, "https://www.evil.example/", "deny_domains: evil.example"},
+		{"Wildcard Rule", denylist, "https://a.b.phish.test/", "deny_domains: phish.test"},
+		{"Lookalike Suffix Allowed", denylist, "https://notevil.example/", ""},
+		{"Denied Pattern", denylist, "https://files.test/setup.EXE", `deny_patterns: (?i)\.exe$`},
+		{"Pattern Not Matched", denylist, "https://files.test/setup.exe.txt", ""},
+		{"Allowlisted Domain", allowlist, "https://example.com/a", ""},
+		{"Allowlisted Subdomain", allowlist, "https://docs.example.com/a", ""},
+		{"Not Allowlisted", allowlist, "https://other.test/", "mode: allowlist"},
+		{"Deny Beats Allow", allowlist, "https://bad.example.com/", "deny_domains: bad.example.com"},
+		{"Unparseable URL", denylist, "://nope", "unparseable URL"},
+		{"Untrusted Domain", untrusted, "https://cdn.files.test/x", "untrusted_domains: files.test"},
+		{"Untrusted Not Matched", untrusted, "https://example.com/", ""},
+		{"Deny Beats Untrusted", untrusted, "https://evil.example/", "deny_domains: evil.example"},
+		{"Untrusted Allowlisted", allowlist, "https://files.example.com/", "untrusted_domains: files.example.com"},
+		{"Allowlist Beats Untrusted", allowlist, "https://other.test/", "mode: allowlist"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			e, err := policy.New(tc.rules)
+			if err != nil {
+				t.Fatalf("expected no error, but got %v", err)
+			}
+
+			d := e.Evaluate(tc.url)
+			untrusted := strings.HasPrefix(tc.expectedRule, "untrusted_domains:")
+			if d.Allowed != (tc.expectedRule == "" || untrusted) {
+				t.Errorf("expected allowed=%v, but got %v", tc.expectedRule == "" || untrusted, d.Allowed)
+			}
+			if d.Untrusted != untrusted {
+				t.Errorf("expected untrusted=%v, but got %v", untrusted, d.Untrusted)
+			}
+			if d.Rule != tc.expectedRule {
+				t.Errorf("expected rule %q, but got %q", tc.expectedRule, d.Rule)
+			}
+		})
+	}
+}
+
+func TestInvalidRules(t *testing.T) {
+	testCases := []struct {
+		name  string
+		rules policy.Rules
+	}{
+		{"Unknown Mode", policy.Rules{Mode: "maybe"}},
+		{"Bad Pattern", policy.Rules{DenyPatterns: []string{"("}}},
+		{"Unknown Lookalikes Action", policy.Rules{Lookalikes: "block"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := policy.New(tc.rules); !errors.Is(err, policy.ErrInvalidRules) {
+				t.Errorf("expected ErrInvalidRules, but got %v", err)
+			}
+		})
+	}
+
+	e, _ := policy.New(policy.Rules{DenyDomains: []string{"evil.example"}})
+	if err := e.Update(policy.Rules{DenyPatterns: []string{"("}}); !errors.Is(err, policy.ErrInvalidRules) {
+		t.Fatalf("expected ErrInvalidRules, but got %v", err)
+	}
+	if e.Evaluate("https://evil.example/").Allowed {
+		t.Error("expected a rejected update to keep the previous rules")
+	}
+}
+
+func writeRules(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write rules: %v", err)
+	}
+}
+
+func TestOpenAndWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	writeRules(t, path, "deny_domains: [evil.example]\n")
+
+	e, err := policy.Open(path)
+	if err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	if e.Evaluate("https://evil.example/").Allowed {
+		t.Fatal("expected evil.example to be denied")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go e.Watch(ctx, 10*time.Millisecond)
+
+	// A broken edit is ignored and the current rules kept.
+	writeRules(t, path, "deny_domainz: [oops]\n")
+	time.Sleep(50 * time.Millisecond)
+	if e.Evaluate("https://evil.example/").Allowed {
+		t.Fatal("expected the broken file to be ignored")
+	}
+
+	writeRules(t, path, "deny_domains: [evil.example, banned-later.test]\n")
+	waitFor(t, func() bool { return !e.Evaluate("https://banned-later.test/").Allowed })
+}
+
+func TestOpenMissingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+
+	e, err := policy.Open(path)
+	if err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	if !e.Evaluate("https://evil.example/").Allowed {
+		t.Fatal("expected a new rules file to allow every URL")
+	}
+
+	// Another service opening the file it created shares its updates.
+	other, err := policy.Open(path)
+	if err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go other.Watch(ctx, 10*time.Millisecond)
+
+	if err := e.Update(policy.Rules{DenyDomains: []string{"evil.example"}}); err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	waitFor(t, func() bool { return !other.Evaluate("https://evil.example/").Allowed })
+}
+
+func TestOpenErrors(t *testing.T) {
+	dir := t.TempDir()
+	bad := filepath.Join(dir, "bad.yaml")
+	writeRules(t, bad, "deny_patterns: ['(']\n")
+
+	for _, path := range []string{filepath.Join(dir, "missing", "policy.yaml"), bad} {
+		if _, err := policy.Open(path); !errors.Is(err, policy.ErrInvalidRules) {
+			t.Errorf("Open(%s): expected ErrInvalidRules, but got %v", filepath.Base(path), err)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	writeRules(t, path, "")
+
+	e, err := policy.Open(path)
+	if err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	handler := e.Handler("s3cret")
+
+	testCases := []struct {
+		name               string
+		method             string
+		token              string
+		body               string
+		expectedStatusCode int
+	}{
+		{"No Token", http.MethodGet, "", "", http.StatusUnauthorized},
+		{"Wrong Token", http.MethodGet, "guess", "", http.StatusUnauthorized},
+		{"Get", http.MethodGet, "s3cret", "", http.StatusOK},
+		{"Put", http.MethodPut, "s3cret", `{"deny_domains":["evil.example"]}`, http.StatusOK},
+		{"Put Invalid Pattern", http.MethodPut, "s3cret", `{"deny_patterns":["("]}`, http.StatusBadRequest},
+		{"Put Unknown Field", http.MethodPut, "s3cret", `{"deny":["evil.example"]}`, http.StatusBadRequest},
+		{"Wrong Method", http.MethodDelete, "s3cret", "", http.StatusMethodNotAllowed},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, "/api/v1/admin/policy", strings.NewReader(tc.body))
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tc.expectedStatusCode {
+				t.Errorf("expected status code %d, but got %d: %s", tc.expectedStatusCode, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	if e.Evaluate("https://evil.example/").Allowed {
+		t.Error("expected the PUT rules to be in force")
+	}
+	saved, err := policy.Load(path)
+	if err != nil {
+		t.Fatalf("expected the rules file to load, but got %v", err)
+	}
+	if len(saved.DenyDomains) != 1 || saved.DenyDomains[0] != "evil.example" {
+		t.Errorf("expected the PUT rules to be saved, but got %+v", saved)
+	}
+
+	// A second engine watching the same file sees the update.
+	other, err := policy.Open(path)
+	if err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	if other.Evaluate("https://evil.example/").Allowed {
+		t.Error("expected another engine to load the saved rules")
+	}
+}
+
+func TestHandlerDisabledWithoutToken(t *testing.T) {
+	e, _ := policy.New(policy.Rules{})
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/admin/policy", nil)
+	req.Header.Set("Authorization", "Bearer ")
+	w := httptest.NewRecorder()
+
+	e.Handler("").ServeHTTP(w, req)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status code %d, but got %d", http.StatusUnauthorized, w.Code)
+	}
+}
+
+// waitFor polls cond until it holds or a second has passed.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,217 @@
+// Package problem reports errors as RFC 7807 problem details.
+//
+// Every service answers a failed request with an application/problem+json
+// document whose code is one of the stable, machine-readable Codes below, so
+// clients can tell failures apart without parsing messages:
+//
+//	{
+//	  "type": "urn:duss:problem:not_found",
+//	  "title": "Not Found",
+//	  "status": 404,
+//	  "detail": "URL not found",
+//	  "instance": "/abc123",
+//	  "code": "not_found",
+//	  "request_id": "4bf92f3577b34da6a3ce929d0e0e4736"
+//	}
+//
+// FromResponse reads the problem a service answered with, so a caller such as
+// the gateway can pass it on to its own client unchanged.
+package problem
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/iton0/duss/shared/logging"
+)
+
+// ContentType is the media type of problem documents.
+const ContentType = "application/problem+json"
+
+// typePrefix is prefixed to a Code to form a problem's type URI.
+const typePrefix = "urn:duss:problem:"
+
+// maxBodySize bounds the problem documents FromResponse reads.
+const maxBodySize = 64 << 10
+
+// Code identifies the kind of a problem. Codes are stable: clients may rely
+// on them, so they are never renamed.
+type Code string
+
+const (
+	// CodeInvalidURL: the URL to shorten is missing or not valid.
+	CodeInvalidURL Code = "invalid_url"
+	// CodeBlacklisted: the URL is rejected or blocked by policy.
+	CodeBlacklisted Code = "blacklisted"
+	// CodeAliasTaken: the short key is already taken.
+	CodeAliasTaken Code = "alias_taken"
+	// CodeNotFound: the link, job or route does not exist.
+	CodeNotFound Code = "not_found"
+	// CodeExpired: the link has expired.
+	CodeExpired Code = "expired"
+	// CodeRateLimited: too many requests; try again later.
+	CodeRateLimited Code = "rate_limited"
+	// CodeUpstreamUnavailable: a service the request depends on failed or
+	// could not be reached.
+	CodeUpstreamUnavailable Code = "upstream_unavailable"
+	// CodeInvalidRequest: the request is malformed or has invalid options.
+	CodeInvalidRequest Code = "invalid_request"
+	// CodeUnauthorized: the request lacks valid credentials.
+	CodeUnauthorized Code = "unauthorized"
+	// CodeForbidden: the caller may not do this.
+	CodeForbidden Code = "forbidden"
+	// CodeConflict: the request conflicts with another in progress or made
+	// before.
+	CodeConflict Code = "conflict"
+	// CodeTooLarge: the request has too many items or too large a body.
+	CodeTooLarge Code = "too_large"
+	// CodeUnsupportedMediaType: the request body's Content-Type is not
+	// accepted.
+	CodeUnsupportedMediaType Code = "unsupported_media_type"
+	// CodeMethodNotAllowed: the route does not accept the request method.
+	CodeMethodNotAllowed Code = "method_not_allowed"
+	// CodeNotImplemented: the feature is not enabled.
+	CodeNotImplemented Code = "not_implemented"
+	// CodeInternal: the service failed unexpectedly.
+	CodeInternal Code = "internal_error"
+)
+
+// statusCodes are the codes of responses that are not problem documents,
+// by status.
+var statusCodes = map[int]Code{
+	http.StatusBadRequest:            CodeInvalidRequest,
+	http.StatusUnauthorized:          CodeUnauthorized,
+	http.StatusForbidden:             CodeForbidden,
+	http.StatusNotFound:              CodeNotFound,
+	http.StatusMethodNotAllowed:      CodeMethodNotAllowed,
+	http.StatusConflict:              CodeConflict,
+	http.StatusGone:                  CodeExpired,
+	http.StatusRequestEntityTooLarge: CodeTooLarge,
+	http.StatusUnsupportedMediaType:  CodeUnsupportedMediaType,
+	http.StatusTooManyRequests:       CodeRateLimited,
+	http.StatusInternalServerError:   CodeInternal,
+	http.StatusNotImplemented:        CodeNotImplemented,
+	http.StatusBadGateway:            CodeUpstreamUnavailable,
+	http.StatusServiceUnavailable:    CodeUpstreamUnavailable,
+	http.StatusGatewayTimeout:        CodeUpstreamUnavailable,
+}
+
+// Problem is an RFC 7807 problem details document. It is also an error, so
+// it can be returned by clients that read it from a response.
+type Problem struct {
+	// Type is a URI naming the kind of problem, derived from Code.
+	Type string `json:"type"`
+	// Title is a short summary of the kind of problem.
+	Title string `json:"title"`
+	// Status is the HTTP status code of the response.
+	Status int `json:"status"`
+	// Detail explains this occurrence of the problem.
+	Detail string `json:"detail,omitempty"`
+	// Instance is the path of the request that failed.
+	Instance string `json:"instance,omitempty"`
+	// Code identifies the kind of problem.
+	Code Code `json:"code"`
+	// RequestID is the ID the failed request was logged with.
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// New returns the problem of a response with status, identified by code and
+// explained by detail.
+func New(status int, code Code, detail string) *Problem {
+	return &Problem{
+		Type:   typePrefix + string(code),
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Code:   code,
+	}
+}
+
+// Internal returns the problem of a request that failed unexpectedly. The
+// cause is left out, since it is only of use in the service's logs.
+func Internal() *Problem {
+	return New(http.StatusInternalServerError, CodeInternal, "internal server error")
+}
+
+// Error implements error.
+func (p *Problem) Error() string {
+	if p.Detail == "" {
+		return fmt.Sprintf("%d %s", p.Status, p.Code)
+	}
+	return fmt.Sprintf("%d %s: %s", p.Status, p.Code, p.Detail)
+}
+
+// Write answers r with p. The problem's instance and request ID are those
+// of r.
+func Write(w http.ResponseWriter, r *http.Request, p *Problem) {
+	out := *p
+	out.Instance = r.URL.Path
+	out.RequestID = logging.RequestID(r.Context())
+
+	w.Header().Set("Content-Type", ContentType)
+	w.WriteHeader(out.Status)
+	json.NewEncoder(w).Encode(out)
+}
+
+// Abort answers the request of c with p and stops its remaining handlers.
+func Abort(c *gin.Context, p *Problem) {
+	Write(c.Writer, c.Request, p)
+	c.Abort()
+}
+
+// NoRoute answers requests to paths a gin router has no route for. Install it
+// with the router's NoRoute method.
+func NoRoute(c *gin.Context) {
+	Abort(c, New(http.StatusNotFound, CodeNotFound, "no route for "+c.Request.URL.Path))
+}
+
+// Recovery answers requests whose handler panicked with an internal_error
+// problem and logs the panic with its stack trace.
+func Recovery() gin.HandlerFunc {
+	return gin.CustomRecoveryWithWriter(io.Discard, func(c *gin.Context, err any) {
+		slog.ErrorContext(c.Request.Context(), "panic serving request",
+			"error", err,
+			"stack", string(debug.Stack()),
+		)
+		Abort(c, Internal())
+	})
+}
+
+// FromResponse returns the problem resp reports. A response that is not a
+// problem document, such as one from a proxy, is described by its status.
+// It reads resp's body but does not close it.
+func FromResponse(resp *http.Response) *Problem {
+	code, ok := statusCodes[resp.StatusCode]
+	if !ok {
+		code = CodeInternal
+		if resp.StatusCode < http.StatusInternalServerError {
+			code = CodeInvalidRequest
+		}
+	}
+	fallback := New(resp.StatusCode, code, "")
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != ContentType {
+		return fallback
+	}
+	var p Problem
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxBodySize)).Decode(&p); err != nil || p.Code == "" {
+		return fallback
+	}
+	// The status of the response is the one that counts.
+	p.Status = resp.StatusCode
+	if p.Type == "" {
+		p.Type = typePrefix + string(p.Code)
+	}
+	if p.Title == "" {
+		p.Title = http.StatusText(p.Status)
+	}
+	return &p
+}
@@ -0,0 +1,132 @@
+package problem_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/iton0/duss/shared/logging"
+	"github.com/iton0/duss/shared/problem"
+)
+
+func TestAbort(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	router.Use(logging.Middleware())
+	router.GET("/:shortKey", func(c *gin.Context) {
+		problem.Abort(c, problem.New(http.StatusNotFound, problem.CodeNotFound, "URL not found"))
+	})
+	router.NoRoute(problem.NoRoute)
+
+	testCases := []struct {
+		name           string
+		path           string
+		expectedDetail string
+	}{
+		{"Handler", "/abc", "URL not found"},
+		{"No Route", "/a/b/c", "no route for /a/b/c"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			req.Header.Set(logging.HeaderRequestID, "req-1")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != http.StatusNotFound {
+				t.Fatalf("expected status %d, but got %d", http.StatusNotFound, w.Code)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != problem.ContentType {
+				t.Fatalf("expected Content-Type %q, but got %q", problem.ContentType, ct)
+			}
+			var p problem.Problem
+			if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+				t.Fatalf("could not decode problem: %v", err)
+			}
+			expected := problem.Problem{
+				Type:      "urn:duss:problem:not_found",
+				Title:     "Not Found",
+				Status:    http.StatusNotFound,
+				Detail:    tc.expectedDetail,
+				Instance:  tc.path,
+				Code:      problem.CodeNotFound,
+				RequestID: "req-1",
+			}
+			if p != expected {
+				t.Errorf("expected %+v, but got %+v", expected, p)
+			}
+		})
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	router.Use(logging.Middleware(), problem.Recovery())
+	router.GET("/panic", func(c *gin.Context) {
+		panic("boom")
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/panic", nil)
+	req.Header.Set(logging.HeaderRequestID, "req-1")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected status %d, but got %d", http.StatusInternalServerError, w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != problem.ContentType {
+		t.Fatalf("expected Content-Type %q, but got %q", problem.ContentType, ct)
+	}
+	var p problem.Problem
+	if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+		t.Fatalf("could not decode problem: %v", err)
+	}
+	if p.Code != problem.CodeInternal || p.Instance != "/panic" || p.RequestID != "req-1" {
+		t.Errorf("expected an internal_error problem for the request, but got %+v", p)
+	}
+}
+
+func TestFromResponse(t *testing.T) {
+	testCases := []struct {
+		name           string
+		status         int
+		contentType    string
+		body           string
+		expectedCode   problem.Code
+		expectedDetail string
+	}{
+		{"Problem", http.StatusConflict, problem.ContentType, `{"status":409,"code":"alias_taken","detail":"URL already taken"}`, problem.CodeAliasTaken, "URL already taken"},
+		{"Problem With Charset", http.StatusForbidden, problem.ContentType + "; charset=utf-8", `{"code":"blacklisted"}`, problem.CodeBlacklisted, ""},
+		{"Plain Text", http.StatusServiceUnavailable, "text/plain", "no healthy upstream", problem.CodeUpstreamUnavailable, ""},
+		{"Malformed", http.StatusNotFound, problem.ContentType, "{", problem.CodeNotFound, ""},
+		{"Without Code", http.StatusGone, problem.ContentType, `{"detail":"gone"}`, problem.CodeExpired, ""},
+		{"Unknown Status", http.StatusTeapot, "", "", problem.CodeInvalidRequest, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := &http.Response{
+				StatusCode: tc.status,
+				Header:     http.Header{"Content-Type": {tc.contentType}},
+				Body:       io.NopCloser(strings.NewReader(tc.body)),
+			}
+
+			p := problem.FromResponse(resp)
+			if p.Status != tc.status || p.Code != tc.expectedCode || p.Detail != tc.expectedDetail {
+				t.Fatalf("expected a %d %s problem with detail %q, but got %+v", tc.status, tc.expectedCode, tc.expectedDetail, p)
+			}
+			if p.Type != "urn:duss:problem:"+string(tc.expectedCode) || p.Title != http.StatusText(tc.status) {
+				t.Errorf("expected the type and title of a %d %s problem, but got %q and %q", tc.status, tc.expectedCode, p.Type, p.Title)
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+// Package server runs a service's HTTP server and shuts it down gracefully.
+//
+// On SIGINT or SIGTERM, or when its context is done, a Server first reports
+// that it is not ready, through the health.Checker it was given, and keeps
+// serving for a drain delay so that load balancers stop sending it requests.
+// It then stops accepting connections, waits for in-flight requests to
+// finish and runs its shutdown functions, which stop background work and
+// close storage clients, all within the shutdown timeout.
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/iton0/duss/shared/health"
+)
+
+const (
+	// DefaultDrainDelay is how long a stopping Server keeps serving while
+	// it reports it is not ready.
+	DefaultDrainDelay = 5 * time.Second
+	// DefaultShutdownTimeout bounds how long in-flight requests and
+	// shutdown functions may take.
+	DefaultShutdownTimeout = 20 * time.Second
+)
+
+type shutdownFunc struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// Server serves an HTTP handler until it is told to stop, then drains it.
+type Server struct {
+	name            string
+	srv             *http.Server
+	health          *health.Checker
+	drainDelay      time.Duration
+	shutdownTimeout time.Duration
+	signals         []os.Signal
+	onShutdown      []shutdownFunc
+}
+
+// Option configures optional settings of a Server.
+type Option func(*Server)
+
+// WithHealth makes the Server report it is not ready, through c, as soon as
+// it starts shutting down.
+func WithHealth(c *health.Checker) Option {
+	return func(s *Server) {
+		s.health = c
+	}
+}
+
+// WithDrainDelay sets how long the Server keeps serving after it starts
+// shutting down. The default is DefaultDrainDelay.
+func WithDrainDelay(d time.Duration) Option {
+	return func(s *Server) {
+		s.drainDelay = d
+	}
+}
+
+// WithShutdownTimeout sets how long in-flight requests and shutdown
+// functions may take once the Server stops accepting requests. The default
+// is DefaultShutdownTimeout.
+func WithShutdownTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.shutdownTimeout = d
+	}
+}
+
+// WithSignals sets the signals that shut the Server down. The default is
+// SIGINT and SIGTERM.
+func WithSignals(signals ...os.Signal) Option {
+	return func(s *Server) {
+		s.signals = signals
+	}
+}
+
+// New creates a Server for the named service that serves handler on addr.
+func New(name, addr string, handler http.Handler, opts ...Option) *Server {
+	s := &Server{
+		name:            name,
+		srv:             &http.Server{Addr: addr, Handler: handler, ReadHeaderTimeout: 10 * time.Second},
+		drainDelay:      DefaultDrainDelay,
+		shutdownTimeout: DefaultShutdownTimeout,
+		signals:         []os.Signal{syscall.SIGINT, syscall.SIGTERM},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// OnShutdown registers fn to run once in-flight requests have finished.
+// Functions run in the order they were registered, with a context that is
+// done when the shutdown timeout expires; a failing one does not stop the
+// rest.
+func (s *Server) OnShutdown(name string, fn func(ctx context.Context) error) {
+	s.onShutdown = append(s.onShutdown, shutdownFunc{name: name, fn: fn})
+}
+
+// Run listens on the Server's address and serves until ctx is done or a
+// shutdown signal arrives, then shuts down. It returns nil if everything
+// stopped cleanly.
+func (s *Server) Run(ctx context.Context) error {
+	ln, err := net.Listen("tcp", s.srv.Addr)
+	if err != nil {
+		return errors.Join(fmt.Errorf("listen: %w", err), s.runShutdown(ctx))
+	}
+	return s.Serve(ctx, ln)
+}
+
+// Serve is like Run but accepts connections on ln.
+func (s *Server) Serve(ctx context.Context, ln net.Listener) error {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, s.signals...)
+	defer signal.Stop(stop)
+
+	served := make(chan error, 1)
+	go func() {
+		served <- s.srv.Serve(ln)
+	}()
+	slog.Info("serving", "service", s.name, "addr", ln.Addr().String())
+
+	select {
+	case err := <-served:
+		// The server failed before it was asked to stop.
+		return errors.Join(fmt.Errorf("serve: %w", err), s.runShutdown(context.Background()))
+	case sig := <-stop:
+		slog.Info("shutting down", "service", s.name, "signal", sig.String())
+	case <-ctx.Done():
+		slog.Info("shutting down", "service", s.name)
+	}
+
+	if s.health != nil {
+		s.health.Drain()
+	}
+
+	// A second signal skips what is left of the drain.
+	forced, force := context.WithCancel(context.Background())
+	defer force()
+	go func() {
+		select {
+		case sig := <-stop:
+			slog.Warn("shutting down now", "service", s.name, "signal", sig.String())
+			force()
+		case <-forced.Done():
+		}
+	}()
+
+	select {
+	case <-time.After(s.drainDelay):
+	case <-forced.Done():
+	}
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(forced, s.shutdownTimeout)
+	defer cancelShutdown()
+
+	var errs []error
+	if err := s.srv.Shutdown(shutdownCtx); err != nil {
+		errs = append(errs, fmt.Errorf("drain requests: %w", err))
+		s.srv.Close()
+	}
+	if err := <-served; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		errs = append(errs, fmt.Errorf("serve: %w", err))
+	}
+	errs = append(errs, s.runShutdown(shutdownCtx))
+
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	slog.Info("stopped", "service", s.name)
+	return nil
+}
+
+// runShutdown runs the shutdown functions in order.
+func (s *Server) runShutdown(ctx context.Context) error {
+	var errs []error
+	for _, f := range s.onShutdown {
+		if err := f.fn(ctx); err != nil {
+			slog.Error("shutdown step failed", "service", s.name, "step", f.name, "error", err)
+			errs = append(errs, fmt.Errorf("%s: %w", f.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
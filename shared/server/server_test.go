@@ -0,0 +1,177 @@
+package server_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/iton0/duss/shared/health"
+	"github.com/iton0/duss/shared/server"
+)
+
+// start serves handler on a local port, returning its base URL and a
+// channel that receives what Serve returns.
+func start(t *testing.T, ctx context.Context, s *server.Server) (string, <-chan error) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Serve(ctx, ln)
+	}()
+	return "http://" + ln.Addr().String(), done
+}
+
+func TestServeDrainsOnSignal(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		events []string
+	)
+	record := func(event string) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	}
+
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	checker := health.New("svc")
+	mux := http.NewServeMux()
+	mux.Handle("GET /readyz", checker.ReadyHandler())
+	mux.HandleFunc("GET /slow", func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-release
+		w.Write([]byte("done"))
+		record("request")
+	})
+
+	s := server.New("svc", "", mux, server.WithHealth(checker), server.WithDrainDelay(200*time.Millisecond), server.WithShutdownTimeout(5*time.Second))
+	s.OnShutdown("stop workers", func(context.Context) error {
+		record("stop workers")
+		return nil
+	})
+	s.OnShutdown("close storage", func(context.Context) error {
+		record("close storage")
+		return nil
+	})
+	base, done := start(t, context.Background(), s)
+
+	requested := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(base + "/slow")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				err = errors.New(resp.Status)
+			}
+		}
+		requested <- err
+	}()
+	<-entered
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatalf("failed to send SIGTERM: %v", err)
+	}
+
+	// During the drain delay the server still serves, but is not ready.
+	deadline := time.Now().Add(time.Second)
+	for {
+		resp, err := http.Get(base + "/readyz")
+		if err != nil {
+			t.Fatalf("expected the server to serve while draining, but got %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusServiceUnavailable {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected readiness to fail after SIGTERM, but got status %d", resp.StatusCode)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	close(release)
+	if err := <-requested; err != nil {
+		t.Fatalf("expected the in-flight request to complete, but got %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("expected a clean shutdown, but got %v", err)
+	}
+
+	expected := []string{"request", "stop workers", "close storage"}
+	if len(events) != len(expected) {
+		t.Fatalf("expected %v, but got %v", expected, events)
+	}
+	for i := range expected {
+		if events[i] != expected[i] {
+			t.Errorf("expected %v, but got %v", expected, events)
+			break
+		}
+	}
+	if _, err := http.Get(base + "/readyz"); err == nil {
+		t.Error("expected the server to stop accepting connections")
+	}
+}
+
+func TestServeShutdownTimeout(t *testing.T) {
+	entered := make(chan struct{})
+	s := server.New("svc", "", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-r.Context().Done()
+	}), server.WithDrainDelay(0), server.WithShutdownTimeout(50*time.Millisecond))
+
+	closed := false
+	s.OnShutdown("close storage", func(ctx context.Context) error {
+		closed = true
+		return nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	base, done := start(t, ctx, s)
+
+	go http.Get(base)
+	<-entered
+	cancel()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected the drain to time out, but got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the server to give up on the stuck request")
+	}
+	if !closed {
+		t.Error("expected shutdown functions to run after a timed out drain")
+	}
+}
+
+func TestShutdownFunctionErrors(t *testing.T) {
+	s := server.New("svc", "", http.NotFoundHandler(), server.WithDrainDelay(0))
+	failed := errors.New("close failed")
+	s.OnShutdown("close redis", func(context.Context) error { return failed })
+	ran := false
+	s.OnShutdown("close postgres", func(context.Context) error {
+		ran = true
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	_, done := start(t, ctx, s)
+	cancel()
+
+	if err := <-done; !errors.Is(err, failed) {
+		t.Errorf("expected %v, but got %v", failed, err)
+	}
+	if !ran {
+		t.Error("expected a failing shutdown function not to stop the rest")
+	}
+}
@@ -0,0 +1,300 @@
+// Package ssrf keeps duss from being used to reach addresses it should not:
+// loopback and private networks, link-local ranges such as the cloud
+// metadata endpoint at 169.254.169.254, and schemes other than http and
+// https.
+//
+// A Validator checks destination URLs before they are accepted, resolving
+// their hosts to see where they lead. Because a host may resolve elsewhere
+// by the time it is fetched, code that fetches destinations should also use
+// the Validator's Client, which checks every address it connects to.
+package ssrf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	// ErrInvalidURL is returned for URLs that cannot be parsed or have no host.
+	ErrInvalidURL = errors.New("invalid URL")
+	// ErrSchemeNotAllowed is returned for schemes other than http and https,
+	// such as javascript:, data: and file:.
+	ErrSchemeNotAllowed = errors.New("URL scheme not allowed")
+	// ErrURLTooLong is returned for URLs longer than the Validator's limit.
+	ErrURLTooLong = errors.New("URL too long")
+	// ErrForbiddenAddress is returned for URLs whose host is, or resolves
+	// to, a blocked address.
+	ErrForbiddenAddress = errors.New("URL points at a forbidden address")
+)
+
+// DefaultMaxLength is the longest URL a Validator accepts unless configured
+// otherwise. Browsers and proxies commonly refuse longer ones.
+const DefaultMaxLength = 2048
+
+// DefaultBlockedRanges are the networks a Validator rejects unless
+// configured otherwise: addresses that are not on the public internet.
+var DefaultBlockedRanges = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),          // "This" network
+	netip.MustParsePrefix("10.0.0.0/8"),         // Private
+	netip.MustParsePrefix("100.64.0.0/10"),      // Carrier-grade NAT, including Alibaba Cloud metadata
+	netip.MustParsePrefix("127.0.0.0/8"),        // Loopback
+	netip.MustParsePrefix("169.254.0.0/16"),     // Link-local, including cloud metadata
+	netip.MustParsePrefix("172.16.0.0/12"),      // Private
+	netip.MustParsePrefix("192.0.0.0/24"),       // IETF protocol assignments
+	netip.MustParsePrefix("192.168.0.0/16"),     // Private
+	netip.MustParsePrefix("198.18.0.0/15"),      // Benchmarking
+	netip.MustParsePrefix("224.0.0.0/4"),        // Multicast
+	netip.MustParsePrefix("240.0.0.0/4"),        // Reserved and broadcast
+	netip.MustParsePrefix("::/128"),             // Unspecified
+	netip.MustParsePrefix("::1/128"),            // Loopback
+	netip.MustParsePrefix("64:ff9b::/96"),       // NAT64, which can reach IPv4 ranges above
+	netip.MustParsePrefix("fc00::/7"),           // Unique local, including AWS IPv6 metadata
+	netip.MustParsePrefix("fe80::/10"),          // Link-local
+	netip.MustParsePrefix("ff00::/8"),           // Multicast
+	netip.MustParsePrefix("2001:db8::/32"),      // Documentation
+	netip.MustParsePrefix("2002::/16"),          // 6to4, which can embed any IPv4 address
+	netip.MustParsePrefix("100::/64"),           // Discard
+	netip.MustParsePrefix("2001::/32"),          // Teredo, which can embed any IPv4 address
+	netip.MustParsePrefix("::ffff:0:0/96"),      // IPv4-mapped, checked as IPv4 too
+	netip.MustParsePrefix("255.255.255.255/32"), // Broadcast
+}
+
+// Resolver looks up the addresses of a host. *net.Resolver implements it.
+type Resolver interface {
+	LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
+}
+
+var _ Resolver = (*net.Resolver)(nil)
+
+// Config holds the settings services build a Validator from.
+type Config struct {
+	// BlockedRanges replaces DefaultBlockedRanges when set. Entries are
+	// CIDR prefixes or single addresses.
+	BlockedRanges []string `config:"blocked_ranges" env:"DESTINATION_BLOCKED_RANGES"`
+	// AllowedRanges are exceptions to the blocked ranges, such as an
+	// intranet that links may point into.
+	AllowedRanges []string `config:"allowed_ranges" env:"DESTINATION_ALLOWED_RANGES"`
+	// MaxURLLength is the longest URL accepted.
+	MaxURLLength int `config:"max_url_length" env:"MAX_URL_LENGTH" default:"2048"`
+	// Resolve looks up host names and rejects those that lead to blocked
+	// addresses. Without it only literal addresses are checked.
+	Resolve bool `config:"resolve" env:"DESTINATION_RESOLVE" default:"true"`
+}
+
+// Validator decides whether URLs are safe destinations. It is safe for
+// concurrent use.
+type Validator struct {
+	resolver  Resolver
+	blocked   []netip.Prefix
+	allowed   []netip.Prefix
+	maxLength int
+	timeout   time.Duration
+}
+
+// Option configures a Validator.
+type Option func(*Validator)
+
+// WithResolver sets the resolver host names are looked up with, or disables
+// lookups when r is nil.
+func WithResolver(r Resolver) Option {
+	return func(v *Validator) {
+		v.resolver = r
+	}
+}
+
+// WithBlockedRanges replaces DefaultBlockedRanges.
+func WithBlockedRanges(prefixes ...netip.Prefix) Option {
+	return func(v *Validator) {
+		v.blocked = prefixes
+	}
+}
+
+// WithAllowedRanges exempts prefixes from the blocked ranges.
+func WithAllowedRanges(prefixes ...netip.Prefix) Option {
+	return func(v *Validator) {
+		v.allowed = prefixes
+	}
+}
+
+// WithMaxLength sets the longest URL accepted. Zero or less removes the
+// limit.
+func WithMaxLength(n int) Option {
+	return func(v *Validator) {
+		v.maxLength = n
+	}
+}
+
+// New returns a Validator that blocks DefaultBlockedRanges, accepts URLs up
+// to DefaultMaxLength and resolves host names with net.DefaultResolver.
+func New(opts ...Option) *Validator {
+	v := &Validator{
+		resolver:  net.DefaultResolver,
+		blocked:   DefaultBlockedRanges,
+		maxLength: DefaultMaxLength,
+		timeout:   2 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
+}
+
+// Validator returns the Validator described by c.
+func (c Config) Validator() (*Validator, error) {
+	opts := []Option{WithMaxLength(c.MaxURLLength)}
+	if len(c.BlockedRanges) > 0 {
+		blocked, err := ParsePrefixes(c.BlockedRanges)
+		if err != nil {
+			return nil, fmt.Errorf("blocked_ranges: %w", err)
+		}
+		opts = append(opts, WithBlockedRanges(blocked...))
+	}
+	allowed, err := ParsePrefixes(c.AllowedRanges)
+	if err != nil {
+		return nil, fmt.Errorf("allowed_ranges: %w", err)
+	}
+	opts = append(opts, WithAllowedRanges(allowed...))
+	if !c.Resolve {
+		opts = append(opts, WithResolver(nil))
+	}
+	return New(opts...), nil
+}
+
+// ParsePrefixes parses CIDR prefixes, accepting single addresses as
+// prefixes of their full length.
+func ParsePrefixes(values []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range values {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// Validate checks that rawURL is an http or https URL within the length
+// limit whose host is not a blocked address and, when lookups are enabled,
+// does not resolve to one. A host that does not resolve at all is accepted:
+// it leads nowhere yet, and fetchers check again when they connect.
+func (v *Validator) Validate(ctx context.Context, rawURL string) error {
+	u, err := v.checkURL(rawURL)
+	if err != nil {
+		return err
+	}
+
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return v.checkAddr(addr)
+	}
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		// Reserved for loopback by RFC 6761, whatever the resolver says.
+		return fmt.Errorf("%w: %s", ErrForbiddenAddress, host)
+	}
+	if v.resolver == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, v.timeout)
+	defer cancel()
+	addrs, err := v.resolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		if err := v.checkAddr(addr); err != nil {
+			return fmt.Errorf("%w (resolved from %s)", err, host)
+		}
+	}
+	return nil
+}
+
+// checkURL parses rawURL and checks its length and scheme.
+func (v *Validator) checkURL(rawURL string) (*url.URL, error) {
+	if v.maxLength > 0 && len(rawURL) > v.maxLength {
+		return nil, fmt.Errorf("%w: %d bytes, limit %d", ErrURLTooLong, len(rawURL), v.maxLength)
+	}
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		return nil, ErrInvalidURL
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https":
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrSchemeNotAllowed, u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, ErrInvalidURL
+	}
+	return u, nil
+}
+
+// checkAddr returns ErrForbiddenAddress if addr is in a blocked range and not
+// in an allowed one. IPv4-mapped IPv6 addresses are checked as IPv4.
+func (v *Validator) checkAddr(addr netip.Addr) error {
+	addr = addr.Unmap().WithZone("")
+	for _, p := range v.allowed {
+		if p.Contains(addr) {
+			return nil
+		}
+	}
+	for _, p := range v.blocked {
+		if p.Contains(addr) {
+			return fmt.Errorf("%w: %s is in %s", ErrForbiddenAddress, addr, p)
+		}
+	}
+	return nil
+}
+
+// Client returns an HTTP client for fetching destinations. Every connection
+// it makes, including those for redirects, is checked against the blocked
+// ranges after the host has been resolved, so a host cannot pass validation
+// and then resolve to a blocked address. Redirects to other schemes or to
+// over-long URLs are refused.
+func (v *Validator) Client(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return fmt.Errorf("%w: %s", ErrForbiddenAddress, address)
+			}
+			return v.checkAddr(addrPort.Addr())
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil // A proxy would connect on our behalf unchecked.
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			_, err := v.checkURL(req.URL.String())
+			return err
+		},
+	}
+}
@@ -0,0 +1,189 @@
+package ssrf_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iton0/duss/shared/ssrf"
+)
+
+// fakeResolver answers lookups from a fixed table and fails for other hosts.
+type fakeResolver map[string][]string
+
+func (f fakeResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	addrs, ok := f[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	var out []netip.Addr
+	for _, a := range addrs {
+		out = append(out, netip.MustParseAddr(a))
+	}
+	return out, nil
+}
+
+var resolver = fakeResolver{
+	"example.com":              {"93.184.215.14", "2606:2800:21f:cb07:6820:80da:af6b:8b2c"},
+	"metadata.google.internal": {"169.254.169.254"},
+	"rebind.example":           {"93.184.215.14", "10.0.0.5"},
+	"intranet.corp":            {"10.1.2.3"},
+	"v6-local.example":         {"fd00:ec2::254"},
+	"mapped.example":           {"::ffff:127.0.0.1"},
+}
+
+func TestValidate(t *testing.T) {
+	v := ssrf.New(ssrf.WithResolver(resolver))
+
+	testCases := []struct {
+		name        string
+		url         string
+		expectedErr error
+	}{
+		{"Public Host", "https://example.com/path", nil},
+		{"Public HTTP", "http://example.com/", nil},
+		{"Uppercase Scheme", "HTTPS://example.com/", nil},
+		{"Unresolvable Host", "https://does-not-exist.example/", nil},
+		{"Public IPv4", "http://93.184.215.14/", nil},
+		{"Public IPv6", "http://[2606:2800:21f:cb07:6820:80da:af6b:8b2c]/", nil},
+		{"Metadata IP", "http://169.254.169.254/latest/meta-data/", ssrf.ErrForbiddenAddress},
+		{"Metadata Host", "http://metadata.google.internal/computeMetadata/v1/", ssrf.ErrForbiddenAddress},
+		{"Loopback", "http://127.0.0.1:5432/", ssrf.ErrForbiddenAddress},
+		{"Loopback Elsewhere In Range", "http://127.8.9.10/", ssrf.ErrForbiddenAddress},
+		{"Localhost", "http://localhost:5432/", ssrf.ErrForbiddenAddress},
+		{"Localhost Subdomain", "http://db.localhost/", ssrf.ErrForbiddenAddress},
+		{"Localhost Trailing Dot", "http://LOCALHOST./", ssrf.ErrForbiddenAddress},
+		{"Private 10", "http://10.0.0.1/", ssrf.ErrForbiddenAddress},
+		{"Private 172", "http://172.16.5.4/", ssrf.ErrForbiddenAddress},
+		{"Private 192", "http://192.168.1.1/", ssrf.ErrForbiddenAddress},
+		{"Carrier-Grade NAT", "http://100.100.100.200/", ssrf.ErrForbiddenAddress},
+		{"Unspecified", "http://0.0.0.0/", ssrf.ErrForbiddenAddress},
+		{"IPv6 Loopback", "http://[::1]/", ssrf.ErrForbiddenAddress},
+		{"IPv6 Link-Local With Zone", "http://[fe80::1%25eth0]/", ssrf.ErrForbiddenAddress},
+		{"IPv6 Unique Local Host", "http://v6-local.example/", ssrf.ErrForbiddenAddress},
+		{"IPv4-Mapped Loopback", "http://[::ffff:127.0.0.1]/", ssrf.ErrForbiddenAddress},
+		{"IPv4-Mapped Host", "http://mapped.example/", ssrf.ErrForbiddenAddress},
+		{"Any Resolved Address Blocked", "http://rebind.example/", ssrf.ErrForbiddenAddress},
+		{"JavaScript", "javascript:alert(1)", ssrf.ErrSchemeNotAllowed},
+		{"Data", "data:text/html,<script>alert(1)</script>", ssrf.ErrSchemeNotAllowed},
+		{"File", "file:///etc/passwd", ssrf.ErrSchemeNotAllowed},
+		{"Gopher", "gopher://127.0.0.1:6379/_INFO", ssrf.ErrSchemeNotAllowed},
+		{"No Scheme", "example.com/path", ssrf.ErrSchemeNotAllowed},
+		{"No Host", "http:///path", ssrf.ErrInvalidURL},
+		{"Too Long", "https://example.com/" + strings.Repeat("a", ssrf.DefaultMaxLength), ssrf.ErrURLTooLong},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := v.Validate(context.Background(), tc.url); !errors.Is(err, tc.expectedErr) {
+				t.Errorf("expected error %v, but got %v", tc.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestValidateOptions(t *testing.T) {
+	ctx := context.Background()
+
+	allowIntranet := ssrf.New(ssrf.WithResolver(resolver), ssrf.WithAllowedRanges(netip.MustParsePrefix("10.1.0.0/16")))
+	if err := allowIntranet.Validate(ctx, "http://intranet.corp/wiki"); err != nil {
+		t.Errorf("expected the allowed range to be accepted, but got %v", err)
+	}
+	if err := allowIntranet.Validate(ctx, "http://10.2.0.1/"); !errors.Is(err, ssrf.ErrForbiddenAddress) {
+		t.Errorf("expected the rest of 10.0.0.0/8 to stay blocked, but got %v", err)
+	}
+
+	onlyMetadata := ssrf.New(ssrf.WithResolver(resolver), ssrf.WithBlockedRanges(netip.MustParsePrefix("169.254.169.254/32")))
+	if err := onlyMetadata.Validate(ctx, "http://10.0.0.1/"); err != nil {
+		t.Errorf("expected replaced ranges to allow 10.0.0.1, but got %v", err)
+	}
+	if err := onlyMetadata.Validate(ctx, "http://169.254.169.254/"); !errors.Is(err, ssrf.ErrForbiddenAddress) {
+		t.Errorf("expected the metadata address to be blocked, but got %v", err)
+	}
+
+	noLookups := ssrf.New(ssrf.WithResolver(nil))
+	if err := noLookups.Validate(ctx, "http://metadata.google.internal/"); err != nil {
+		t.Errorf("expected host names to pass without lookups, but got %v", err)
+	}
+	if err := noLookups.Validate(ctx, "http://127.0.0.1/"); !errors.Is(err, ssrf.ErrForbiddenAddress) {
+		t.Errorf("expected literal addresses to be checked without lookups, but got %v", err)
+	}
+
+	short := ssrf.New(ssrf.WithResolver(resolver), ssrf.WithMaxLength(30))
+	if err := short.Validate(ctx, "https://example.com/a-rather-long-path"); !errors.Is(err, ssrf.ErrURLTooLong) {
+		t.Errorf("expected ErrURLTooLong, but got %v", err)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	v, err := ssrf.Config{
+		BlockedRanges: []string{"203.0.113.0/24", "198.51.100.7"},
+		AllowedRanges: []string{"203.0.113.9"},
+		MaxURLLength:  100,
+	}.Validator()
+	if err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+
+	ctx := context.Background()
+	testCases := []struct {
+		url         string
+		expectedErr error
+	}{
+		{"http://203.0.113.1/", ssrf.ErrForbiddenAddress},
+		{"http://203.0.113.9/", nil},
+		{"http://198.51.100.7/", ssrf.ErrForbiddenAddress},
+		{"http://198.51.100.8/", nil},
+		{"http://127.0.0.1/", nil},
+		{"http://a.example/" + strings.Repeat("a", 100), ssrf.ErrURLTooLong},
+	}
+	for _, tc := range testCases {
+		if err := v.Validate(ctx, tc.url); !errors.Is(err, tc.expectedErr) {
+			t.Errorf("Validate(%q): expected %v, but got %v", tc.url, tc.expectedErr, err)
+		}
+	}
+
+	if _, err := (ssrf.Config{BlockedRanges: []string{"not-a-range"}}).Validator(); err == nil {
+		t.Error("expected an invalid range to be rejected")
+	}
+}
+
+func TestClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/to-metadata" {
+			http.Redirect(w, r, "http://169.254.169.254/latest/meta-data/", http.StatusFound)
+			return
+		}
+		if r.URL.Path == "/to-file" {
+			http.Redirect(w, r, "file:///etc/passwd", http.StatusFound)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	// The test server listens on loopback, which is blocked by default.
+	if _, err := ssrf.New().Client(time.Second).Get(srv.URL); !errors.Is(err, ssrf.ErrForbiddenAddress) {
+		t.Fatalf("expected the loopback connection to be refused, but got %v", err)
+	}
+
+	client := ssrf.New(ssrf.WithAllowedRanges(netip.MustParsePrefix("127.0.0.0/8"))).Client(time.Second)
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("expected the allowed connection to succeed, but got %v", err)
+	}
+	resp.Body.Close()
+
+	if _, err := client.Get(srv.URL + "/to-metadata"); !errors.Is(err, ssrf.ErrForbiddenAddress) {
+		t.Errorf("expected the redirect to the metadata address to be refused, but got %v", err)
+	}
+	if _, err := client.Get(srv.URL + "/to-file"); !errors.Is(err, ssrf.ErrSchemeNotAllowed) {
+		t.Errorf("expected the redirect to file: to be refused, but got %v", err)
+	}
+}
@@ -0,0 +1,32 @@
+package storage
+
+import (
+	"context"
+	"errors"
+
+	"github.com/iton0/duss/shared/domain"
+)
+
+var (
+	// ErrNotFound is returned when a short key does not exist or has expired.
+	ErrNotFound = errors.New("short key not found")
+	// ErrDuplicatedKey is returned when saving a short key that is already
+	// stored on the same short domain.
+	ErrDuplicatedKey = errors.New("short key already taken")
+)
+
+// Store is the contract every URL storage backend must fulfil, whether it is
+// PostgreSQL, Redis or an in-memory mock. Services depend on narrower interfaces
+// of their own, but every implementation is checked against this one by the
+// storagetest conformance suite.
+type Store interface {
+	// Save persists url, returning ErrDuplicatedKey if its short key is taken
+	// on its domain.
+	Save(ctx context.Context, url *domain.URL) error
+	// Get returns the URL stored under shortKey on shortDomain, or
+	// ErrNotFound if it is missing or expired.
+	Get(ctx context.Context, shortDomain, shortKey string) (*domain.URL, error)
+	// Delete removes the URL stored under shortKey on shortDomain, returning
+	// ErrNotFound if there is none.
+	Delete(ctx context.Context, shortDomain, shortKey string) error
+}
@@ -0,0 +1,312 @@
+// Package storagetest provides a conformance suite that every storage.Store
+// implementation in duss must pass.
+//
+// A backend's test file runs the suite by handing it a constructor:
+//
+//	func TestConformance(t *testing.T) {
+//		storagetest.Run(t, func(t *testing.T) storage.Store {
+//			return mock.NewMockStorage(nil)
+//		})
+//	}
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/iton0/duss/shared/domain"
+	"github.com/iton0/duss/shared/storage"
+)
+
+// ExpiryWindow is how far in the future the expiry tests place ExpiresAt.
+// Backends must stop returning a URL once this window has elapsed.
+const ExpiryWindow = 200 * time.Millisecond
+
+// concurrency is the number of goroutines used by the concurrency tests.
+const concurrency = 32
+
+// testDomain and otherDomain are the short domains URLs are saved under.
+const (
+	testDomain  = "duss.test"
+	otherDomain = "go.duss.test"
+)
+
+// Run executes the conformance suite against stores built by newStore.
+// newStore is called once per subtest and should return an empty store, or
+// at least one that does not contain keys generated by a previous call.
+func Run(t *testing.T, newStore func(t *testing.T) storage.Store) {
+	t.Helper()
+
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s storage.Store)
+	}{
+		{"SaveGetRoundTrip", testSaveGetRoundTrip},
+		{"NotFound", testNotFound},
+		{"DuplicatedKey", testDuplicatedKey},
+		{"Delete", testDelete},
+		{"SameKeyDifferentDomains", testSameKeyDifferentDomains},
+		{"ConcurrentSaves", testConcurrentSaves},
+		{"ConcurrentDuplicateSaves", testConcurrentDuplicateSaves},
+		{"NoExpiry", testNoExpiry},
+		{"Expiry", testExpiry},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.fn(t, newStore(t))
+		})
+	}
+}
+
+var keySeq atomic.Uint64
+
+// uniqueKey returns a short key that will not collide with keys from earlier
+// runs against a persistent backend.
+func uniqueKey(prefix string) string {
+	return fmt.Sprintf("%s-%d-%d", prefix, time.Now().UnixNano(), keySeq.Add(1))
+}
+
+// newURL builds a URL with timestamps truncated to millisecond precision so
+// that backends which store coarser timestamps still round-trip exactly.
+func newURL(shortKey string) *domain.URL {
+	return &domain.URL{
+		Domain:       testDomain,
+		ShortKey:     shortKey,
+		LongURL:      "HTTPS://Example.com/" + shortKey,
+		CanonicalURL: "https://example.com/" + shortKey,
+		CreatedAt:    time.Now().UTC().Truncate(time.Millisecond),
+		Redirects:    0,
+	}
+}
+
+func testSaveGetRoundTrip(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+	want := newURL(uniqueKey("roundtrip"))
+	want.Redirects = 7
+
+	if err := s.Save(ctx, want); err != nil {
+		t.Fatalf("Save: expected no error, but got %v", err)
+	}
+
+	got, err := s.Get(ctx, want.Domain, want.ShortKey)
+	if err != nil {
+		t.Fatalf("Get: expected no error, but got %v", err)
+	}
+	if got == nil {
+		t.Fatal("Get: expected a URL, but got nil")
+	}
+	if got.Domain != want.Domain {
+		t.Errorf("expected domain %q, but got %q", want.Domain, got.Domain)
+	}
+	if got.ShortKey != want.ShortKey {
+		t.Errorf("expected short key %q, but got %q", want.ShortKey, got.ShortKey)
+	}
+	if got.LongURL != want.LongURL {
+		t.Errorf("expected long URL %q, but got %q", want.LongURL, got.LongURL)
+	}
+	if got.CanonicalURL != want.CanonicalURL {
+		t.Errorf("expected canonical URL %q, but got %q", want.CanonicalURL, got.CanonicalURL)
+	}
+	if !got.CreatedAt.Equal(want.CreatedAt) {
+		t.Errorf("expected created_at %v, but got %v", want.CreatedAt, got.CreatedAt)
+	}
+	if got.Redirects != want.Redirects {
+		t.Errorf("expected %d redirects, but got %d", want.Redirects, got.Redirects)
+	}
+}
+
+func testNotFound(t *testing.T, s storage.Store) {
+	got, err := s.Get(context.Background(), testDomain, uniqueKey("missing"))
+	if !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("expected storage.ErrNotFound, but got %v", err)
+	}
+	if got != nil {
+		t.Errorf("expected a nil URL, but got %+v", got)
+	}
+}
+
+func testDuplicatedKey(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+	first := newURL(uniqueKey("dup"))
+
+	if err := s.Save(ctx, first); err != nil {
+		t.Fatalf("first Save: expected no error, but got %v", err)
+	}
+
+	second := newURL(first.ShortKey)
+	second.LongURL = "https://example.org/other"
+	if err := s.Save(ctx, second); !errors.Is(err, storage.ErrDuplicatedKey) {
+		t.Fatalf("second Save: expected storage.ErrDuplicatedKey, but got %v", err)
+	}
+
+	got, err := s.Get(ctx, first.Domain, first.ShortKey)
+	if err != nil {
+		t.Fatalf("Get: expected no error, but got %v", err)
+	}
+	if got.LongURL != first.LongURL {
+		t.Errorf("duplicate save overwrote the original: expected %q, but got %q", first.LongURL, got.LongURL)
+	}
+}
+
+func testDelete(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+	url := newURL(uniqueKey("delete"))
+
+	if err := s.Save(ctx, url); err != nil {
+		t.Fatalf("Save: expected no error, but got %v", err)
+	}
+	if err := s.Delete(ctx, url.Domain, url.ShortKey); err != nil {
+		t.Fatalf("Delete: expected no error, but got %v", err)
+	}
+	if _, err := s.Get(ctx, url.Domain, url.ShortKey); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("Get after Delete: expected storage.ErrNotFound, but got %v", err)
+	}
+	if err := s.Delete(ctx, url.Domain, url.ShortKey); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("second Delete: expected storage.ErrNotFound, but got %v", err)
+	}
+	if err := s.Save(ctx, url); err != nil {
+		t.Fatalf("Save after Delete: expected the key to be reusable, but got %v", err)
+	}
+}
+
+func testSameKeyDifferentDomains(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+	first := newURL(uniqueKey("shared"))
+	second := newURL(first.ShortKey)
+	second.Domain = otherDomain
+	second.LongURL = "https://example.org/other"
+
+	if err := s.Save(ctx, first); err != nil {
+		t.Fatalf("Save on %s: expected no error, but got %v", first.Domain, err)
+	}
+	if err := s.Save(ctx, second); err != nil {
+		t.Fatalf("Save on %s: expected the key to be free, but got %v", second.Domain, err)
+	}
+
+	for _, want := range []*domain.URL{first, second} {
+		got, err := s.Get(ctx, want.Domain, want.ShortKey)
+		if err != nil {
+			t.Fatalf("Get on %s: expected no error, but got %v", want.Domain, err)
+		}
+		if got.LongURL != want.LongURL {
+			t.Errorf("Get on %s: expected long URL %q, but got %q", want.Domain, want.LongURL, got.LongURL)
+		}
+	}
+
+	if err := s.Delete(ctx, second.Domain, second.ShortKey); err != nil {
+		t.Fatalf("Delete on %s: expected no error, but got %v", second.Domain, err)
+	}
+	if _, err := s.Get(ctx, first.Domain, first.ShortKey); err != nil {
+		t.Errorf("Get on %s after deleting from %s: expected no error, but got %v", first.Domain, second.Domain, err)
+	}
+}
+
+func testConcurrentSaves(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+	prefix := uniqueKey("concurrent")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, concurrency)
+	for i := range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.Save(ctx, newURL(fmt.Sprintf("%s-%d", prefix, i))); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("concurrent Save: expected no error, but got %v", err)
+	}
+
+	for i := range concurrency {
+		key := fmt.Sprintf("%s-%d", prefix, i)
+		if _, err := s.Get(ctx, testDomain, key); err != nil {
+			t.Errorf("Get(%q): expected no error, but got %v", key, err)
+		}
+	}
+}
+
+func testConcurrentDuplicateSaves(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+	shortKey := uniqueKey("race")
+
+	var (
+		wg        sync.WaitGroup
+		succeeded atomic.Int32
+	)
+	errs := make(chan error, concurrency)
+	for range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := s.Save(ctx, newURL(shortKey))
+			switch {
+			case err == nil:
+				succeeded.Add(1)
+			case !errors.Is(err, storage.ErrDuplicatedKey):
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("racing Save: expected nil or storage.ErrDuplicatedKey, but got %v", err)
+	}
+	if n := succeeded.Load(); n != 1 {
+		t.Errorf("expected exactly one racing Save to succeed, but %d did", n)
+	}
+}
+
+func testNoExpiry(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+	url := newURL(uniqueKey("forever"))
+
+	if err := s.Save(ctx, url); err != nil {
+		t.Fatalf("Save: expected no error, but got %v", err)
+	}
+
+	got, err := s.Get(ctx, url.Domain, url.ShortKey)
+	if err != nil {
+		t.Fatalf("Get: expected no error, but got %v", err)
+	}
+	if !got.ExpiresAt.IsZero() {
+		t.Errorf("expected no expiry, but got %v", got.ExpiresAt)
+	}
+}
+
+func testExpiry(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+	url := newURL(uniqueKey("expiring"))
+	url.ExpiresAt = time.Now().UTC().Add(ExpiryWindow).Truncate(time.Millisecond)
+
+	if err := s.Save(ctx, url); err != nil {
+		t.Fatalf("Save: expected no error, but got %v", err)
+	}
+
+	got, err := s.Get(ctx, url.Domain, url.ShortKey)
+	if err != nil {
+		t.Fatalf("Get before expiry: expected no error, but got %v", err)
+	}
+	if !got.ExpiresAt.Equal(url.ExpiresAt) {
+		t.Errorf("expected expires_at %v, but got %v", url.ExpiresAt, got.ExpiresAt)
+	}
+
+	time.Sleep(ExpiryWindow + 50*time.Millisecond)
+
+	if _, err := s.Get(ctx, url.Domain, url.ShortKey); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("Get after expiry: expected storage.ErrNotFound, but got %v", err)
+	}
+}
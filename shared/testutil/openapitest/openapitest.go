@@ -0,0 +1,50 @@
+// Package openapitest checks that a service's router and the OpenAPI
+// description of its API have not drifted apart.
+package openapitest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/iton0/duss/shared/openapi"
+)
+
+// ginParam matches the :name and *name segments of a gin route.
+var ginParam = regexp.MustCompile(`[:*]([^/]+)`)
+
+// CheckRoutes fails t unless every route of routes is described by spec and
+// every operation spec describes is routed.
+func CheckRoutes(t testing.TB, spec *openapi.Spec, routes gin.RoutesInfo) {
+	t.Helper()
+
+	routed := make([]openapi.Operation, 0, len(routes))
+	for _, r := range routes {
+		routed = append(routed, openapi.Operation{Method: r.Method, Path: ginParam.ReplaceAllString(r.Path, "{$1}")})
+	}
+	described := spec.Operations()
+	for _, op := range routed {
+		if !slices.Contains(described, op) {
+			t.Errorf("route %s is not described by the API description", op)
+		}
+	}
+	for _, op := range described {
+		if !slices.Contains(routed, op) {
+			t.Errorf("operation %s of the API description is not routed", op)
+		}
+	}
+}
+
+// CheckResponse fails t if the response w recorded for req does not match
+// spec.
+func CheckResponse(t testing.TB, spec *openapi.Spec, req *http.Request, w *httptest.ResponseRecorder) {
+	t.Helper()
+
+	if err := spec.ValidateResponse(req, w.Code, w.Header(), w.Body.Bytes()); err != nil {
+		t.Errorf("%s %s: response does not match the API description: %v", req.Method, req.URL.Path, err)
+	}
+}
@@ -0,0 +1,398 @@
+// Package pgtest provides a hermetic stand-in for PostgreSQL in tests.
+//
+// New returns a DB backed by an in-memory SQLite database speaking the same
+// pgx-shaped API as *pgxpool.Pool, so storage clients that accept a DB can be
+// exercised without a running server. Setting POSTGRES_DSN switches New to a
+// real PostgreSQL connection instead, which keeps the same tests usable as
+// integration tests.
+//
+// The stand-in understands the portable subset of SQL that duss storage
+// clients use: positional $N parameters, INSERT ... ON CONFLICT, RETURNING
+// and row-value comparisons. PostgreSQL-only column types in schemas, and in DDL run through
+// Exec such as a storage client's own migrations, are translated to their
+// SQLite equivalents, and a missing table is reported with PostgreSQL's
+// SQLSTATE. So are the ALTER TABLE forms migrations use that SQLite lacks:
+// ADD COLUMN IF NOT EXISTS, ALTER COLUMN ... DROP DEFAULT, and replacing a
+// primary key with DROP CONSTRAINT and ADD PRIMARY KEY.
+package pgtest
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	_ "modernc.org/sqlite"
+)
+
+// DB is the subset of *pgxpool.Pool used by duss storage clients.
+type DB interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	Ping(ctx context.Context) error
+	Close()
+}
+
+// Ensure both the stand-in and a real pool satisfy DB.
+var (
+	_ DB = (*SQLiteDB)(nil)
+	_ DB = (*pgxpool.Pool)(nil)
+)
+
+// typeReplacer maps PostgreSQL column types onto types SQLite's driver
+// round-trips with the same Go values.
+var typeReplacer = strings.NewReplacer(
+	"TIMESTAMPTZ", "TIMESTAMP",
+	"BIGSERIAL", "INTEGER",
+	"BYTEA", "BLOB",
+)
+
+// New returns a fresh database with schema applied. The database is closed
+// when the test finishes.
+func New(t testing.TB, schema string) DB {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if dsn := os.Getenv("POSTGRES_DSN"); dsn != "" {
+		pool, err := pgxpool.New(ctx, dsn)
+		if err != nil {
+			t.Fatalf("pgtest: could not connect to POSTGRES_DSN: %v", err)
+		}
+		t.Cleanup(pool.Close)
+		if _, err := pool.Exec(ctx, schema); err != nil {
+			t.Fatalf("pgtest: could not apply schema: %v", err)
+		}
+		return pool
+	}
+
+	db, err := NewSQLite(ctx, schema)
+	if err != nil {
+		t.Fatalf("pgtest: %v", err)
+	}
+	t.Cleanup(db.Close)
+	return db
+}
+
+// NewPostgres returns a connection to a new, empty schema of the PostgreSQL
+// database POSTGRES_DSN names, for tests of DDL the stand-in does not speak.
+// It skips the test when POSTGRES_DSN is unset. The
+// schema is dropped when the test finishes.
+func NewPostgres(t testing.TB) DB {
+	t.Helper()
+
+	dsn := os.Getenv("POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("pgtest: POSTGRES_DSN is not set")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	admin, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		t.Fatalf("pgtest: could not connect to POSTGRES_DSN: %v", err)
+	}
+	t.Cleanup(admin.Close)
+
+	schema := pgx.Identifier{Unique("pgtest")}.Sanitize()
+	if _, err := admin.Exec(ctx, "CREATE SCHEMA "+schema); err != nil {
+		t.Fatalf("pgtest: could not create schema: %v", err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.Exec(context.Background(), "DROP SCHEMA "+schema+" CASCADE"); err != nil {
+			t.Errorf("pgtest: could not drop schema: %v", err)
+		}
+	})
+
+	config, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		t.Fatalf("pgtest: could not parse POSTGRES_DSN: %v", err)
+	}
+	config.ConnConfig.RuntimeParams["search_path"] = schema
+	pool, err := pgxpool.NewWithConfig(ctx, config)
+	if err != nil {
+		t.Fatalf("pgtest: could not connect to POSTGRES_DSN: %v", err)
+	}
+	t.Cleanup(pool.Close)
+	return pool
+}
+
+var uniqueSeq atomic.Uint64
+
+// Unique returns prefix followed by a suffix no other call returns, in this
+// run or an earlier one. Tests name the domains, keys and IDs of the rows
+// they insert with it, so they do not collide with rows an earlier run left
+// in the real database POSTGRES_DSN names.
+func Unique(prefix string) string {
+	return fmt.Sprintf("%s-%d-%d", prefix, time.Now().UnixNano(), uniqueSeq.Add(1))
+}
+
+// SQLiteDB adapts an in-memory SQLite database to the DB interface.
+type SQLiteDB struct {
+	db *sql.DB
+}
+
+// NewSQLite opens an in-memory SQLite database and applies schema to it.
+func NewSQLite(ctx context.Context, schema string) (*SQLiteDB, error) {
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open SQLite: %w", err)
+	}
+	// Every connection to ":memory:" is a separate database, so all callers
+	// share a single connection. This also serialises writers the way row
+	// locks would in PostgreSQL.
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.ExecContext(ctx, typeReplacer.Replace(schema)); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to apply schema: %w", err)
+	}
+
+	return &SQLiteDB{db: db}, nil
+}
+
+// Exec runs a statement and reports the affected rows in a pgconn.CommandTag.
+func (s *SQLiteDB) Exec(ctx context.Context, query string, args ...any) (pgconn.CommandTag, error) {
+	verb, _, _ := strings.Cut(strings.TrimSpace(query), " ")
+	verb = strings.ToUpper(verb)
+	if verb == "CREATE" || verb == "ALTER" {
+		query = typeReplacer.Replace(query)
+	}
+	if verb == "ALTER" {
+		if ok, err := s.alter(ctx, query); ok {
+			if err != nil {
+				return pgconn.CommandTag{}, err
+			}
+			return pgconn.NewCommandTag("ALTER TABLE"), nil
+		}
+	}
+
+	res, err := s.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return pgconn.CommandTag{}, pgError(err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return pgconn.CommandTag{}, err
+	}
+
+	if verb == "INSERT" {
+		return pgconn.NewCommandTag(fmt.Sprintf("INSERT 0 %d", n)), nil
+	}
+	return pgconn.NewCommandTag(fmt.Sprintf("%s %d", verb, n)), nil
+}
+
+// The ALTER TABLE forms alter translates.
+var (
+	addColumnIfNotExists = regexp.MustCompile(`(?is)^\s*ALTER TABLE (\w+) ADD COLUMN IF NOT EXISTS (\w+)(.*)$`)
+	dropDefault          = regexp.MustCompile(`(?is)^\s*ALTER TABLE \w+ ALTER COLUMN \w+ DROP DEFAULT\s*$`)
+	dropConstraint       = regexp.MustCompile(`(?is)^\s*ALTER TABLE \w+ DROP CONSTRAINT (IF EXISTS )?\w+_pkey\s*$`)
+	addPrimaryKey        = regexp.MustCompile(`(?is)^\s*ALTER TABLE (\w+) ADD PRIMARY KEY \(([^)]*)\)\s*$`)
+)
+
+// alter runs the ALTER TABLE statements SQLite does not speak, reporting
+// whether query was one of them. Column defaults only matter to inserts
+// that leave the column out, so dropping one is ignored, as is dropping a
+// primary key: SQLite cannot, and ADD PRIMARY KEY replaces it.
+func (s *SQLiteDB) alter(ctx context.Context, query string) (bool, error) {
+	if m := addColumnIfNotExists.FindStringSubmatch(query); m != nil {
+		var n int
+		if err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, m[1], m[2]).Scan(&n); err != nil {
+			return true, err
+		}
+		if n > 0 {
+			return true, nil
+		}
+		_, err := s.db.ExecContext(ctx, "ALTER TABLE "+m[1]+" ADD COLUMN "+m[2]+m[3])
+		return true, err
+	}
+	if dropDefault.MatchString(query) || dropConstraint.MatchString(query) {
+		return true, nil
+	}
+	if m := addPrimaryKey.FindStringSubmatch(query); m != nil {
+		return true, s.rebuild(ctx, m[1], m[2])
+	}
+	return false, nil
+}
+
+// rebuild recreates table with primaryKey, keeping its columns, rows and
+// indexes, since SQLite cannot change the primary key of a table in place.
+func (s *SQLiteDB) rebuild(ctx context.Context, table, primaryKey string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `SELECT name, type, "notnull", dflt_value FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return err
+	}
+	var columns, names []string
+	for rows.Next() {
+		var name, typ string
+		var notNull bool
+		var dflt sql.NullString
+		if err := rows.Scan(&name, &typ, &notNull, &dflt); err != nil {
+			rows.Close()
+			return err
+		}
+		column := name + " " + typ
+		if notNull {
+			column += " NOT NULL"
+		}
+		if dflt.Valid {
+			column += " DEFAULT " + dflt.String
+		}
+		columns = append(columns, column)
+		names = append(names, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = tx.QueryContext(ctx, `SELECT sql FROM sqlite_master WHERE type = 'index' AND tbl_name = ? AND sql IS NOT NULL`, table)
+	if err != nil {
+		return err
+	}
+	var indexes []string
+	for rows.Next() {
+		var index string
+		if err := rows.Scan(&index); err != nil {
+			rows.Close()
+			return err
+		}
+		indexes = append(indexes, index)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	list := strings.Join(names, ", ")
+	statements := append([]string{
+		"CREATE TABLE pgtest_rebuild (" + strings.Join(columns, ", ") + ", PRIMARY KEY (" + primaryKey + "))",
+		"INSERT INTO pgtest_rebuild (" + list + ") SELECT " + list + " FROM " + table,
+		"DROP TABLE " + table,
+		"ALTER TABLE pgtest_rebuild RENAME TO " + table,
+	}, indexes...)
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return fmt.Errorf("failed to rebuild %s: %w", table, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// QueryRow runs a query that returns at most one row.
+func (s *SQLiteDB) QueryRow(ctx context.Context, query string, args ...any) pgx.Row {
+	return row{s.db.QueryRowContext(ctx, query, args...)}
+}
+
+// Query runs a query that returns any number of rows. As the stand-in has a
+// single connection, the rows must be closed before the DB is used again.
+func (s *SQLiteDB) Query(ctx context.Context, query string, args ...any) (pgx.Rows, error) {
+	r, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, pgError(err)
+	}
+	return &rows{Rows: r}, nil
+}
+
+// Ping verifies the database is reachable.
+func (s *SQLiteDB) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// Close closes the database.
+func (s *SQLiteDB) Close() {
+	s.db.Close()
+}
+
+// row translates database/sql errors into their pgx equivalents.
+type row struct {
+	*sql.Row
+}
+
+func (r row) Scan(dest ...any) error {
+	err := r.Row.Scan(dest...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return pgx.ErrNoRows
+	}
+	return pgError(err)
+}
+
+// pgError reports a query against a missing table as the *pgconn.PgError
+// PostgreSQL would return, so callers can tell an empty database apart.
+// Other errors are returned unchanged.
+func pgError(err error) error {
+	if err != nil && strings.Contains(err.Error(), "no such table") {
+		return &pgconn.PgError{Severity: "ERROR", Code: "42P01", Message: err.Error()}
+	}
+	return err
+}
+
+// rows adapts *sql.Rows to pgx.Rows. Only the methods storage clients use
+// are backed by the result; the pgx wire-level ones return zero values.
+type rows struct {
+	*sql.Rows
+	n int64
+}
+
+func (r *rows) Close() {
+	r.Rows.Close()
+}
+
+func (r *rows) Next() bool {
+	if !r.Rows.Next() {
+		return false
+	}
+	r.n++
+	return true
+}
+
+func (r *rows) CommandTag() pgconn.CommandTag {
+	return pgconn.NewCommandTag(fmt.Sprintf("SELECT %d", r.n))
+}
+
+func (r *rows) FieldDescriptions() []pgconn.FieldDescription {
+	return nil
+}
+
+func (r *rows) Values() ([]any, error) {
+	cols, err := r.Rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	values := make([]any, len(cols))
+	dest := make([]any, len(cols))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err := r.Rows.Scan(dest...); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+func (r *rows) RawValues() [][]byte {
+	return nil
+}
+
+func (r *rows) Conn() *pgx.Conn {
+	return nil
+}
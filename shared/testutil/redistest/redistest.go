@@ -0,0 +1,31 @@
+// Package redistest provides a hermetic Redis-compatible server for tests.
+package redistest
+
+import (
+	"os"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// Server is an embedded, in-process Redis-compatible server.
+type Server = miniredis.Miniredis
+
+// New starts an embedded Redis-compatible server that is shut down when the
+// test finishes.
+func New(t testing.TB) *Server {
+	t.Helper()
+	return miniredis.RunT(t)
+}
+
+// Addr returns the address of a Redis server for t to use. It returns
+// REDIS_ADDR when set, so the same tests can run against a real server, and
+// otherwise the address of a freshly started embedded server.
+func Addr(t testing.TB) string {
+	t.Helper()
+
+	if addr := os.Getenv("REDIS_ADDR"); addr != "" {
+		return addr
+	}
+	return New(t).Addr()
+}
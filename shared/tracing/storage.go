@@ -0,0 +1,102 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/iton0/duss/shared/metrics"
+)
+
+// Ensure the hooks fulfil the client contracts.
+var (
+	_ pgx.QueryTracer = (*QueryTracer)(nil)
+	_ redis.Hook      = (*RedisHook)(nil)
+)
+
+// QueryTracer wraps each PostgreSQL query of a pgx connection in a span. Set
+// it as the Tracer of a pgx.ConnConfig, combined with other tracers through
+// pgx's multitracer.
+type QueryTracer struct{}
+
+type querySpanKey struct{}
+
+// TraceQueryStart implements pgx.QueryTracer.
+func (QueryTracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	operation := metrics.Statement(data.SQL)
+	ctx, span := tracer().Start(ctx, "postgres "+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system.name", "postgresql"),
+			attribute.String("db.operation.name", operation),
+			attribute.String("db.query.text", data.SQL),
+		),
+	)
+	return context.WithValue(ctx, querySpanKey{}, span)
+}
+
+// TraceQueryEnd implements pgx.QueryTracer.
+func (QueryTracer) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
+	span, ok := ctx.Value(querySpanKey{}).(trace.Span)
+	if !ok {
+		return
+	}
+	end(span, data.Err)
+}
+
+// RedisHook wraps each command a go-redis client runs in a span. Add it to a
+// client with AddHook. Pipelines get a single span.
+type RedisHook struct{}
+
+// DialHook implements redis.Hook.
+func (RedisHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+// ProcessHook implements redis.Hook.
+func (RedisHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		ctx, span := tracer().Start(ctx, "redis "+cmd.Name(),
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				attribute.String("db.system.name", "redis"),
+				attribute.String("db.operation.name", cmd.Name()),
+			),
+		)
+		err := next(ctx, cmd)
+		end(span, err)
+		return err
+	}
+}
+
+// ProcessPipelineHook implements redis.Hook.
+func (RedisHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		ctx, span := tracer().Start(ctx, "redis pipeline",
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				attribute.String("db.system.name", "redis"),
+				attribute.String("db.operation.name", "pipeline"),
+				attribute.Int("db.operation.batch.size", len(cmds)),
+			),
+		)
+		err := next(ctx, cmds)
+		end(span, err)
+		return err
+	}
+}
+
+// end ends span, marking it failed if err is set. redis.Nil reports a missing
+// key rather than a failure.
+func end(span trace.Span, err error) {
+	if err != nil && !errors.Is(err, redis.Nil) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
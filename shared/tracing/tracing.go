@@ -0,0 +1,242 @@
+// Package tracing sets up OpenTelemetry tracing for a service and provides
+// the middleware, transport and hooks that create its spans.
+//
+// Trace context travels between services in W3C traceparent headers: the gin
+// Middleware continues the trace of an incoming request and Transport passes
+// it on to the next service. Spans are exported over OTLP/HTTP to a collector,
+// written to stdout, or dropped, while context still propagates.
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Exporters, the values of Config.Exporter.
+const (
+	// ExporterNone drops spans but still propagates trace context.
+	ExporterNone = "none"
+	// ExporterOTLP sends spans to an OpenTelemetry collector over OTLP/HTTP.
+	ExporterOTLP = "otlp"
+	// ExporterStdout writes spans to stdout as JSON.
+	ExporterStdout = "stdout"
+)
+
+// instrumentation names the tracer of every span created here.
+const instrumentation = "github.com/iton0/duss/shared/tracing"
+
+// Config configures tracing. Services embed it in their configuration.
+type Config struct {
+	// Exporter is where spans go: none, otlp or stdout.
+	Exporter string `config:"exporter" env:"TRACING_EXPORTER" default:"none"`
+	// Endpoint is the URL of the collector's OTLP/HTTP receiver.
+	Endpoint string `config:"endpoint" env:"TRACING_OTLP_ENDPOINT" default:"http://localhost:4318"`
+	// SampleRatio is the fraction of new traces that are recorded. Traces
+	// continued from another service follow that service's decision.
+	SampleRatio float64 `config:"sample_ratio" env:"TRACING_SAMPLE_RATIO" default:"1"`
+}
+
+// Options returns the Options described by c, or an error if a setting is
+// invalid.
+func (c Config) Options() ([]Option, error) {
+	if c.SampleRatio < 0 || c.SampleRatio > 1 {
+		return nil, errors.New("sample_ratio must be between 0 and 1")
+	}
+	opts := []Option{WithSampleRatio(c.SampleRatio)}
+	switch c.Exporter {
+	case ExporterNone:
+	case ExporterOTLP:
+		if c.Endpoint == "" {
+			return nil, errors.New("endpoint is required by the otlp exporter")
+		}
+		opts = append(opts, WithOTLP(c.Endpoint))
+	case ExporterStdout:
+		opts = append(opts, WithWriter(os.Stdout))
+	default:
+		return nil, fmt.Errorf("unknown exporter %q", c.Exporter)
+	}
+	return opts, nil
+}
+
+// Option configures the Provider started by Start.
+type Option func(*options)
+
+type options struct {
+	exporter    sdktrace.SpanExporter
+	endpoint    string
+	writer      io.Writer
+	sampleRatio float64
+}
+
+// WithExporter sends spans to exporter.
+func WithExporter(exporter sdktrace.SpanExporter) Option {
+	return func(o *options) {
+		o.exporter = exporter
+	}
+}
+
+// WithOTLP sends spans to the OTLP/HTTP receiver at endpoint, such as
+// http://otel-collector:4318.
+func WithOTLP(endpoint string) Option {
+	return func(o *options) {
+		o.endpoint = endpoint
+	}
+}
+
+// WithWriter writes spans to w as JSON.
+func WithWriter(w io.Writer) Option {
+	return func(o *options) {
+		o.writer = w
+	}
+}
+
+// WithSampleRatio records ratio of the new traces.
+func WithSampleRatio(ratio float64) Option {
+	return func(o *options) {
+		o.sampleRatio = ratio
+	}
+}
+
+// Provider exports the spans of one service.
+type Provider struct {
+	tp *sdktrace.TracerProvider
+}
+
+// Start installs the global tracer provider and W3C trace context propagator
+// for service. Without an exporter, spans are dropped but trace context is
+// still propagated. Shutdown flushes the spans that are left.
+func Start(ctx context.Context, service string, opts ...Option) (*Provider, error) {
+	o := options{sampleRatio: 1}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	exporter := o.exporter
+	var err error
+	switch {
+	case exporter != nil:
+	case o.endpoint != "":
+		exporter, err = otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(o.endpoint))
+	case o.writer != nil:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(o.writer))
+	default:
+		return &Provider{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create span exporter: %w", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", service)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe service: %w", err)
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(o.sampleRatio))),
+	)
+	otel.SetTracerProvider(tp)
+	return &Provider{tp: tp}, nil
+}
+
+// Shutdown exports the spans that are left and stops the Provider.
+func (p *Provider) Shutdown(ctx context.Context) error {
+	if p.tp == nil {
+		return nil
+	}
+	return p.tp.Shutdown(ctx)
+}
+
+// tracer returns the tracer of the global provider, so spans go wherever the
+// last call to Start sent them.
+func tracer() trace.Tracer {
+	return otel.Tracer(instrumentation)
+}
+
+// Middleware continues the trace of each request served by a gin router, or
+// starts a new one, in a span named after the route template. It must be
+// installed before the routes are registered.
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+
+		name := c.Request.Method
+		if route := c.FullPath(); route != "" {
+			name += " " + route
+		}
+		ctx, span := tracer().Start(ctx, name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", c.Request.Method),
+				attribute.String("http.route", c.FullPath()),
+				attribute.String("url.path", c.Request.URL.Path),
+			),
+		)
+		defer span.End()
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	}
+}
+
+// Transport returns a RoundTripper that sends each request through next in a
+// client span, passing the trace on in the request's traceparent header. The
+// span ends when the response headers arrive.
+func Transport(next http.RoundTripper) http.RoundTripper {
+	return &transport{next: next}
+}
+
+type transport struct {
+	next http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := tracer().Start(req.Context(), req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", req.Method),
+			attribute.String("server.address", req.URL.Host),
+			attribute.String("url.path", req.URL.Path),
+		),
+	)
+	defer span.End()
+
+	// A RoundTripper must not modify the caller's request.
+	out := req.Clone(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(out.Header))
+
+	resp, err := t.next.RoundTrip(out)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	if resp.StatusCode >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(resp.StatusCode))
+	}
+	return resp, nil
+}
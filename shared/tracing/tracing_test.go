@@ -0,0 +1,159 @@
+package tracing_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/iton0/duss/shared/testutil/redistest"
+	"github.com/iton0/duss/shared/tracing"
+)
+
+// keptSpans is an in-memory exporter that keeps its spans when shut down.
+type keptSpans struct {
+	*tracetest.InMemoryExporter
+}
+
+func (keptSpans) Shutdown(context.Context) error { return nil }
+
+// start records the spans of the test, which the returned function flushes
+// and returns.
+func start(t *testing.T) func() tracetest.SpanStubs {
+	t.Helper()
+
+	exporter := tracetest.NewInMemoryExporter()
+	provider, err := tracing.Start(context.Background(), "test", tracing.WithExporter(keptSpans{exporter}))
+	if err != nil {
+		t.Fatalf("failed to start tracing: %v", err)
+	}
+	return func() tracetest.SpanStubs {
+		if err := provider.Shutdown(context.Background()); err != nil {
+			t.Fatalf("failed to flush spans: %v", err)
+		}
+		return exporter.GetSpans()
+	}
+}
+
+func TestConfigOptions(t *testing.T) {
+	testCases := []struct {
+		name        string
+		config      tracing.Config
+		expectedErr bool
+	}{
+		{"None", tracing.Config{Exporter: tracing.ExporterNone, SampleRatio: 1}, false},
+		{"OTLP", tracing.Config{Exporter: tracing.ExporterOTLP, Endpoint: "http://collector:4318", SampleRatio: 0.5}, false},
+		{"Stdout", tracing.Config{Exporter: tracing.ExporterStdout, SampleRatio: 1}, false},
+		{"OTLP Without Endpoint", tracing.Config{Exporter: tracing.ExporterOTLP, SampleRatio: 1}, true},
+		{"Unknown Exporter", tracing.Config{Exporter: "jaeger", SampleRatio: 1}, true},
+		{"Sample Ratio Out Of Range", tracing.Config{Exporter: tracing.ExporterNone, SampleRatio: 1.5}, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := tc.config.Options()
+			if (err != nil) != tc.expectedErr {
+				t.Fatalf("expected error %v, but got %v", tc.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestPropagation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	flush := start(t)
+
+	// The backend is reached through Transport by the frontend.
+	backend := gin.New()
+	backend.Use(tracing.Middleware())
+	backend.GET("/keys/:id", func(c *gin.Context) { c.Status(http.StatusOK) })
+	backendServer := httptest.NewServer(backend)
+	t.Cleanup(backendServer.Close)
+
+	client := &http.Client{Transport: tracing.Transport(http.DefaultTransport)}
+	frontend := gin.New()
+	frontend.Use(tracing.Middleware())
+	frontend.GET("/:shortKey", func(c *gin.Context) {
+		req, _ := http.NewRequestWithContext(c.Request.Context(), http.MethodGet, backendServer.URL+"/keys/abc", nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			c.Status(http.StatusBadGateway)
+			return
+		}
+		resp.Body.Close()
+		c.Status(http.StatusInternalServerError)
+	})
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest(http.MethodGet, "/abc", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	frontend.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := flush()
+	byName := make(map[string]tracetest.SpanStub, len(spans))
+	for _, span := range spans {
+		byName[span.Name] = span
+	}
+	server, outgoing, backendSpan := byName["GET /:shortKey"], byName["GET"], byName["GET /keys/:id"]
+	if len(spans) != 3 || !server.SpanContext.IsValid() || !outgoing.SpanContext.IsValid() || !backendSpan.SpanContext.IsValid() {
+		t.Fatalf("expected a frontend, client and backend span, but got %d spans", len(spans))
+	}
+
+	// The three spans continue the incoming trace, one inside the other.
+	for _, span := range spans {
+		if span.SpanContext.TraceID().String() != traceID {
+			t.Errorf("expected %s to be in trace %s, but got %s", span.Name, traceID, span.SpanContext.TraceID())
+		}
+	}
+	if server.Parent.SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("expected the frontend span to continue the caller's, but got parent %s", server.Parent.SpanID())
+	}
+	if outgoing.Parent.SpanID() != server.SpanContext.SpanID() {
+		t.Errorf("expected the client span inside the frontend span, but got parent %s", outgoing.Parent.SpanID())
+	}
+	if backendSpan.Parent.SpanID() != outgoing.SpanContext.SpanID() {
+		t.Errorf("expected the backend span inside the client span, but got parent %s", backendSpan.Parent.SpanID())
+	}
+	if server.Status.Code != codes.Error || backendSpan.Status.Code == codes.Error {
+		t.Errorf("expected only the failed frontend request to be an error, but got %v and %v", server.Status.Code, backendSpan.Status.Code)
+	}
+}
+
+func TestRedisHook(t *testing.T) {
+	flush := start(t)
+
+	rdb := redis.NewClient(&redis.Options{Addr: redistest.New(t).Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	rdb.AddHook(tracing.RedisHook{})
+
+	ctx := context.Background()
+	rdb.Set(ctx, "k", "v", 0)
+	rdb.Get(ctx, "missing")
+	rdb.Incr(ctx, "k")
+
+	expected := map[string]codes.Code{
+		"redis set":  codes.Unset,
+		"redis get":  codes.Unset, // A missing key is not a failed command.
+		"redis incr": codes.Error,
+	}
+	// Connecting runs commands of its own, such as hello.
+	found := 0
+	for _, span := range flush() {
+		code, ok := expected[span.Name]
+		if !ok {
+			continue
+		}
+		found++
+		if span.Status.Code != code {
+			t.Errorf("expected span %s with status %v, but got %v", span.Name, code, span.Status.Code)
+		}
+	}
+	if found != len(expected) {
+		t.Fatalf("expected %d command spans, but got %d", len(expected), found)
+	}
+}
@@ -0,0 +1,131 @@
+// Package app wires the url-redirect-service together. It is the service's
+// only importable package, so cmd/server and the end-to-end suite build the
+// service in exactly the same way.
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/iton0/duss/shared/health"
+	"github.com/iton0/duss/shared/linksig"
+	"github.com/iton0/duss/shared/policy"
+	"github.com/iton0/duss/url-redirect-service/internal/api"
+	"github.com/iton0/duss/url-redirect-service/internal/core/services"
+	"github.com/iton0/duss/url-redirect-service/internal/infrastructure/storage"
+	"github.com/iton0/duss/url-redirect-service/internal/infrastructure/web"
+)
+
+// Config holds the connections and settings the service is built from.
+type Config struct {
+	// DB is the PostgreSQL pool owned by the url-shortener-service, read on
+	// cache misses and used to count redirects. When nil the service serves
+	// from Redis alone. Tests may pass a hermetic stand-in such as the one
+	// from shared/testutil/pgtest.
+	DB storage.DB
+	// RedisAddr is the address of the Redis cache.
+	RedisAddr     string
+	RedisPassword string
+	RedisDB       int
+	// Policy, when set, blocks redirects to URLs it rejects.
+	Policy *policy.Engine
+	// AdminToken is the bearer token of the policy admin API, which is only
+	// served when it is set.
+	AdminToken string
+	// TrustCookieSecret signs the cookies that remember a visitor's choice
+	// to continue to an untrusted link. Replicas must share it; when empty a
+	// random one is used.
+	TrustCookieSecret string
+	// TrustCookieTTL is how long that choice is remembered.
+	TrustCookieTTL time.Duration
+	// UnlockCookieTTL is how long a visitor who entered a protected link's
+	// password may follow it without entering it again. The cookie is
+	// signed with TrustCookieSecret.
+	UnlockCookieTTL time.Duration
+	// PasswordMaxAttempts is how many passwords a visitor may enter for a
+	// protected link per PasswordAttemptWindow. Attempts are counted in
+	// Redis per link and client address.
+	PasswordMaxAttempts   int
+	PasswordAttemptWindow time.Duration
+	// TrustedProxies are the proxies, such as the API gateway, whose
+	// X-Forwarded-For entries name the client address password attempts
+	// are counted under. Requests from anywhere else are counted under their
+	// own address.
+	TrustedProxies []netip.Prefix
+	// LinkSigning verifies the signatures of signed short URLs. Signed
+	// links do not redirect when it is nil.
+	LinkSigning *linksig.Keyring
+}
+
+// App is a fully wired url-redirect-service.
+type App struct {
+	Router *gin.Engine
+	// Health reports whether the service is ready.
+	Health *health.Checker
+	redis  *storage.RedisClient
+}
+
+// New connects to Redis and builds the router.
+func New(ctx context.Context, cfg Config) (*App, error) {
+	redisClient, err := storage.NewRedisClient(ctx, cfg.RedisAddr, cfg.RedisPassword, cfg.RedisDB)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to Redis: %w", err)
+	}
+
+	var opts []services.Option
+	if cfg.PasswordMaxAttempts > 0 {
+		opts = append(opts, services.WithAttemptLimit(redisClient, cfg.PasswordMaxAttempts, cfg.PasswordAttemptWindow))
+	}
+	if cfg.Policy != nil {
+		opts = append(opts, services.WithPolicy(cfg.Policy))
+	}
+	if cfg.LinkSigning != nil {
+		opts = append(opts, services.WithLinkSigning(cfg.LinkSigning))
+	}
+
+	var redirectService *services.RedirectService
+	if cfg.DB != nil {
+		pgStore := storage.NewPostgresClientFromDB(cfg.DB)
+		opts = append(opts,
+			services.WithCache(redisClient),
+			services.WithRedirectCounter(pgStore),
+		)
+		redirectService = services.NewRedirectService(pgStore, opts...)
+	} else {
+		redirectService = services.NewRedirectService(redisClient, opts...)
+	}
+
+	redirectHandler := api.NewRedirectHandler(redirectService,
+		api.WithTrustCookieKey([]byte(cfg.TrustCookieSecret)),
+		api.WithTrustCookieTTL(cfg.TrustCookieTTL),
+		api.WithUnlockCookieTTL(cfg.UnlockCookieTTL),
+		api.WithTrustedProxies(cfg.TrustedProxies),
+	)
+	router := web.NewRouter(redirectHandler)
+	if cfg.Policy != nil && cfg.AdminToken != "" {
+		web.RegisterAdmin(router, cfg.Policy.Handler(cfg.AdminToken))
+	}
+
+	checker := health.New("url-redirect-service")
+	checker.Register("redis", redisClient.Ping)
+	if cfg.DB != nil {
+		checker.Register("postgres", cfg.DB.Ping)
+	}
+	web.RegisterHealth(router, checker)
+
+	return &App{
+		Router: router,
+		Health: checker,
+		redis:  redisClient,
+	}, nil
+}
+
+// Close releases the connections opened by New. The DB passed in Config is
+// owned by the caller and left open.
+func (a *App) Close() error {
+	return a.redis.Close()
+}
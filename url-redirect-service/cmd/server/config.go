@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/iton0/duss/shared/config"
+	"github.com/iton0/duss/shared/linksig"
+	"github.com/iton0/duss/shared/logging"
+	"github.com/iton0/duss/shared/policy"
+	"github.com/iton0/duss/shared/ssrf"
+	"github.com/iton0/duss/shared/tracing"
+)
+
+// Config is the url-redirect-service's configuration.
+type Config struct {
+	Server config.Server `config:"server"`
+	// Postgres is read on cache misses. Setting an empty DSN serves
+	// redirects from Redis alone.
+	Postgres config.Postgres `config:"postgres"`
+	Redis    config.Redis    `config:"redis"`
+	// Policy is the URL policy redirects are checked against. It is usually
+	// the same rules file the url-shortener-service uses.
+	Policy policy.Config `config:"policy"`
+	// AdminToken enables the policy admin API and is the bearer token it
+	// requires.
+	AdminToken string `config:"admin_token" env:"ADMIN_TOKEN" secret:"true"`
+	// Interstitial configures the warning page shown for untrusted links.
+	Interstitial InterstitialConfig `config:"interstitial"`
+	// Password configures the form shown for password-protected links.
+	Password PasswordConfig `config:"password"`
+	// LinkSigning holds the keys signed links are verified with. It must
+	// match the url-shortener-service's.
+	LinkSigning linksig.Config `config:"link_signing"`
+	// Log configures the service's log level, format and sampling.
+	Log logging.Config `config:"log"`
+	// Tracing configures where the service's spans are exported.
+	Tracing tracing.Config `config:"tracing"`
+}
+
+// InterstitialConfig holds the settings of the untrusted-link interstitial.
+type InterstitialConfig struct {
+	// Secret signs the cookie remembering a visitor's choice to continue.
+	// Every replica must use the same one; when unset, choices are
+	// forgotten on restart.
+	Secret string `config:"secret" env:"INTERSTITIAL_SECRET" secret:"true"`
+	// TrustTTL is how long that choice is remembered.
+	TrustTTL time.Duration `config:"trust_ttl" env:"INTERSTITIAL_TRUST_TTL" default:"720h"`
+}
+
+// PasswordConfig holds the settings of the password form. Its cookie is
+// signed with the interstitial's secret.
+type PasswordConfig struct {
+	// CookieTTL is how long an entered password is remembered.
+	CookieTTL time.Duration `config:"cookie_ttl" env:"PASSWORD_COOKIE_TTL" default:"10m"`
+	// MaxAttempts is how many passwords a visitor may enter for a link per
+	// AttemptWindow. Zero disables the limit.
+	MaxAttempts   int           `config:"max_attempts" env:"PASSWORD_MAX_ATTEMPTS" default:"5"`
+	AttemptWindow time.Duration `config:"attempt_window" env:"PASSWORD_ATTEMPT_WINDOW" default:"15m"`
+	// TrustedProxies lists the CIDR prefixes or addresses of the proxies,
+	// such as the API gateway, whose X-Forwarded-For entries name the
+	// client attempts are counted for. When empty, attempts are counted
+	// per address the requests came from.
+	TrustedProxies []string `config:"trusted_proxies" env:"TRUSTED_PROXIES"`
+}
+
+// Validate implements config.Validator.
+func (c *Config) Validate() error {
+	if c.Redis.Addr == "" {
+		return errors.New("redis.addr (REDIS_ADDR) is required")
+	}
+	if c.Password.MaxAttempts > 0 && c.Password.AttemptWindow <= 0 {
+		return errors.New("password.attempt_window (PASSWORD_ATTEMPT_WINDOW) must be positive")
+	}
+	if _, err := ssrf.ParsePrefixes(c.Password.TrustedProxies); err != nil {
+		return fmt.Errorf("password.trusted_proxies (TRUSTED_PROXIES): %w", err)
+	}
+	if _, err := c.LinkSigning.Keyring(); err != nil {
+		return fmt.Errorf("link_signing.keys (LINK_SIGNING_KEYS): %w", err)
+	}
+	if _, err := c.Log.Options(); err != nil {
+		return fmt.Errorf("log: %w", err)
+	}
+	if _, err := c.Tracing.Options(); err != nil {
+		return fmt.Errorf("tracing: %w", err)
+	}
+	return nil
+}
@@ -2,36 +2,117 @@ package main
 
 import (
 	"context"
-	"log"
+	"log/slog"
+	"os"
 	"time"
 
-	"github.com/iton0/duss/url-redirect-service/internal/api"
-	"github.com/iton0/duss/url-redirect-service/internal/core/services"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/iton0/duss/shared/config"
+	"github.com/iton0/duss/shared/logging"
+	"github.com/iton0/duss/shared/policy"
+	"github.com/iton0/duss/shared/server"
+	"github.com/iton0/duss/shared/ssrf"
+	"github.com/iton0/duss/shared/tracing"
+	"github.com/iton0/duss/url-redirect-service/app"
 	"github.com/iton0/duss/url-redirect-service/internal/infrastructure/storage"
-	"github.com/iton0/duss/url-redirect-service/internal/infrastructure/web"
-	"github.com/joho/godotenv"
 )
 
 func main() {
-	if err := godotenv.Load(); err != nil {
-		log.Fatal("Error loading .env file")
+	var cfg Config
+	config.MustLoad("url-redirect-service", &cfg)
+
+	logOpts, err := cfg.Log.Options()
+	if err != nil {
+		logging.Fatal("invalid log settings", "error", err)
 	}
+	slog.SetDefault(logging.New(os.Stderr, logOpts...))
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	// TODO: update this to the actual redis implementation
-	redisClient, err := storage.NewRedisClient(ctx, "localhost:6379", "", 0)
+	tracingOpts, err := cfg.Tracing.Options()
+	if err != nil {
+		logging.Fatal("invalid tracing settings", "error", err)
+	}
+	tracer, err := tracing.Start(ctx, "url-redirect-service", tracingOpts...)
+	if err != nil {
+		logging.Fatal("failed to start tracing", "error", err)
+	}
+
+	engine, err := policy.Open(cfg.Policy.File)
+	if err != nil {
+		logging.Fatal("failed to load URL policy", "error", err)
+	}
+	watchCtx, stopWatching := context.WithCancel(context.Background())
+	defer stopWatching()
+	go engine.Watch(watchCtx, cfg.Policy.ReloadInterval)
+
+	linkSigning, err := cfg.LinkSigning.Keyring()
+	if err != nil {
+		logging.Fatal("invalid link signing keys", "error", err)
+	}
+
+	trustedProxies, err := ssrf.ParsePrefixes(cfg.Password.TrustedProxies)
+	if err != nil {
+		logging.Fatal("invalid trusted proxies", "error", err)
+	}
+
+	appCfg := app.Config{
+		RedisAddr:         cfg.Redis.Addr,
+		RedisPassword:     cfg.Redis.Password,
+		RedisDB:           cfg.Redis.DB,
+		Policy:            engine,
+		AdminToken:        cfg.AdminToken,
+		TrustCookieSecret: cfg.Interstitial.Secret,
+		TrustCookieTTL:    cfg.Interstitial.TrustTTL,
+
+		UnlockCookieTTL:       cfg.Password.CookieTTL,
+		PasswordMaxAttempts:   cfg.Password.MaxAttempts,
+		PasswordAttemptWindow: cfg.Password.AttemptWindow,
+		TrustedProxies:        trustedProxies,
+		LinkSigning:           linkSigning,
+	}
+
+	var pool *pgxpool.Pool
+	if cfg.Postgres.DSN != "" {
+		pool, err = storage.NewPostgresPool(ctx, cfg.Postgres.DSN)
+		if err != nil {
+			logging.Fatal("could not connect to PostgreSQL", "error", err)
+		}
+		appCfg.DB = pool
+	}
+
+	application, err := app.New(ctx, appCfg)
 	if err != nil {
-		log.Fatalf("could not connect to Redis: %v", err)
+		logging.Fatal("failed to initialize service", "error", err)
+	}
+
+	// Serve until SIGINT or SIGTERM, then drain requests and close the
+	// connections.
+	srv := server.New("url-redirect-service", cfg.Server.Addr(), application.Router,
+		server.WithHealth(application.Health),
+		server.WithDrainDelay(cfg.Server.DrainDelay),
+		server.WithShutdownTimeout(cfg.Server.ShutdownTimeout),
+	)
+	srv.OnShutdown("stop background work", func(context.Context) error {
+		stopWatching()
+		return nil
+	})
+	srv.OnShutdown("close Redis", func(context.Context) error {
+		return application.Close()
+	})
+	if pool != nil {
+		srv.OnShutdown("close PostgreSQL", func(context.Context) error {
+			pool.Close()
+			return nil
+		})
 	}
 
-	redirectService := services.NewRedirectService(redisClient)
-	redirectHandler := api.NewRedirectHandler(redirectService)
-	router := web.NewRouter(redirectHandler)
+	// Spans are flushed last, so those of the shutdown steps are kept too.
+	srv.OnShutdown("flush traces", tracer.Shutdown)
 
-	log.Println("Starting redirect service on :8080")
-	if err := router.Run(":8080"); err != nil {
-		log.Fatalf("server failed to start: %v", err)
+	if err := srv.Run(context.Background()); err != nil {
+		logging.Fatal("server did not shut down cleanly", "error", err)
 	}
 }
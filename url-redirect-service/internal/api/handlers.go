@@ -3,9 +3,12 @@ package api
 import (
 	"errors"
 	"net/http"
+	"net/netip"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
+	"github.com/iton0/duss/shared/problem"
 	"github.com/iton0/duss/url-redirect-service/internal/core/services"
 )
 
@@ -13,34 +16,135 @@ import (
 type RedirectHandler struct {
 	// Now depends on the RedirectServiceIface interface
 	redirectService services.RedirectServiceIface
+	// cookieKey signs the cookies of the untrusted-link interstitial and
+	// the password form.
+	cookieKey []byte
+	// trustTTL is how long a choice to continue to an untrusted link lasts.
+	trustTTL time.Duration
+	// unlockTTL is how long an entered password is remembered.
+	unlockTTL time.Duration
+	// trustedProxies are the proxies whose X-Forwarded-For entries are
+	// believed when counting password attempts.
+	trustedProxies []netip.Prefix
 }
 
 // NewRedirectHandler creates a new RedirectHandler instance.
 // The constructor now accepts the new interface type.
-func NewRedirectHandler(rs services.RedirectServiceIface) *RedirectHandler {
-	return &RedirectHandler{redirectService: rs}
+func NewRedirectHandler(rs services.RedirectServiceIface, opts ...HandlerOption) *RedirectHandler {
+	h := &RedirectHandler{
+		redirectService: rs,
+		cookieKey:       randomKey(),
+		trustTTL:        defaultTrustTTL,
+		unlockTTL:       defaultUnlockTTL,
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
 }
 
 // HandleRedirect handles the GET /:shortKey request using Gin's context.
+// The request's Host selects the short domain the key is looked up on.
+// Protected destinations ask for their password and untrusted ones get an
+// interstitial page instead of a redirect.
 func (h *RedirectHandler) HandleRedirect(c *gin.Context) {
 	shortKey := c.Param("shortKey")
 
 	if shortKey == "" {
-		c.String(http.StatusNotFound, "Not Found")
+		problem.Abort(c, problem.New(http.StatusNotFound, problem.CodeNotFound, services.ErrURLNotFound.Error()))
+		return
+	}
+
+	dest, err := h.redirectService.GetOriginalURL(c.Request.Context(), c.Request.Host, shortKey)
+	if err != nil {
+		writeRedirectError(c, err)
+		return
+	}
+
+	if dest.Protected {
+		h.handleProtected(c, shortKey, dest)
+		return
+	}
+	if dest.Untrusted {
+		h.handleUntrusted(c, shortKey, dest)
+		return
+	}
+	// The redirect is temporary and not cached, so a link banned, disabled
+	// or deleted later stops redirecting and every visit is counted.
+	c.Header("Cache-Control", "no-store")
+	c.Redirect(http.StatusFound, dest.URL)
+}
+
+// writeRedirectError answers c with the problem a failed redirect or lookup
+// is reported with.
+func writeRedirectError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrURLNotFound):
+		problem.Abort(c, problem.New(http.StatusNotFound, problem.CodeNotFound, err.Error()))
+	case errors.Is(err, services.ErrURLBlocked):
+		problem.Abort(c, problem.New(http.StatusForbidden, problem.CodeBlacklisted, err.Error()))
+	case errors.Is(err, services.ErrLinkExpired):
+		problem.Abort(c, problem.New(http.StatusGone, problem.CodeExpired, err.Error()))
+	default:
+		problem.Abort(c, problem.Internal())
+	}
+}
+
+// LookupResponse defines the structure for the JSON response body of HandleLookup.
+type LookupResponse struct {
+	// OriginalURL is empty for protected links.
+	OriginalURL string `json:"original_url"`
+	// Untrusted tells the caller to send visitors through the interstitial
+	// served by GET /:shortKey rather than redirecting them itself.
+	Untrusted bool `json:"untrusted,omitempty"`
+	// Protected tells the caller to send visitors through the password form
+	// served by GET /:shortKey, which also accepts the form's POST.
+	Protected bool `json:"protected,omitempty"`
+}
+
+// HandleLookup handles the internal GET /api/v1/redirect?domain=:host&key=:shortKey
+// request. It returns the original URL as JSON so the API gateway can issue
+// the redirect itself. For signed links, key is the signed path segment.
+// Lookups do not count the redirect, so the gateway may hedge and retry
+// them; it counts the redirects it issues through HandleCountRedirect.
+func (h *RedirectHandler) HandleLookup(c *gin.Context) {
+	shortKey := c.Query("key")
+
+	if shortKey == "" {
+		problem.Abort(c, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "key is required"))
 		return
 	}
 
-	longURL, err := h.redirectService.GetOriginalURL(c.Request.Context(), shortKey)
+	dest, err := h.redirectService.Lookup(c.Request.Context(), c.Query("domain"), shortKey)
 	if err != nil {
-		switch {
-		case errors.Is(err, services.ErrURLNotFound):
-			c.String(http.StatusNotFound, "Not Found")
-			return
-		default:
-			c.String(http.StatusInternalServerError, "Internal Server Error")
-			return
-		}
+		writeRedirectError(c, err)
+		return
 	}
 
-	c.Redirect(http.StatusMovedPermanently, longURL)
+	if dest.Protected {
+		// The destination is only revealed to visitors with the password.
+		c.JSON(http.StatusOK, LookupResponse{Untrusted: dest.Untrusted, Protected: true})
+		return
+	}
+	c.JSON(http.StatusOK, LookupResponse{OriginalURL: dest.URL, Untrusted: dest.Untrusted})
+}
+
+// HandleCountRedirect handles the internal POST
+// /api/v1/redirect?domain=:host&key=:shortKey request, which counts a redirect
+// the API gateway issued after looking the link up. Like GET /:shortKey, it
+// does not count redirects to untrusted or protected destinations, which are
+// counted once the visitor continues to them.
+func (h *RedirectHandler) HandleCountRedirect(c *gin.Context) {
+	shortKey := c.Query("key")
+
+	if shortKey == "" {
+		problem.Abort(c, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "key is required"))
+		return
+	}
+
+	if _, err := h.redirectService.GetOriginalURL(c.Request.Context(), c.Query("domain"), shortKey); err != nil {
+		writeRedirectError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
 }
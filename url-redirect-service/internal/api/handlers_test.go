@@ -2,6 +2,7 @@ package api_test
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"net/http"
 	"net/http/httptest"
@@ -9,17 +10,56 @@ import (
 
 	"github.com/gin-gonic/gin"
 
+	"github.com/iton0/duss/shared/problem"
 	"github.com/iton0/duss/url-redirect-service/internal/api"
 	"github.com/iton0/duss/url-redirect-service/internal/core/services"
 )
 
 type MockRedirectService struct {
-	ReturnURL string
-	ReturnErr error
+	ReturnURL       string
+	ReturnUntrusted bool
+	ReturnProtected bool
+	ReturnErr       error
+	LastDomain      string
+	// Counted and Confirmed count the GetOriginalURL and ConfirmRedirect
+	// calls, the ones that count redirects.
+	Counted   int
+	Confirmed int
+
+	// Password is the password Unlock accepts, unless UnlockErr is set.
+	Password  string
+	UnlockErr error
+	// LastClientIP records the client address of the most recent Unlock.
+	LastClientIP string
+}
+
+func (m *MockRedirectService) GetOriginalURL(ctx context.Context, shortDomain, shortKey string) (services.Destination, error) {
+	m.LastDomain = shortDomain
+	m.Counted++
+	return services.Destination{URL: m.ReturnURL, Untrusted: m.ReturnUntrusted, Protected: m.ReturnProtected}, m.ReturnErr
+}
+
+func (m *MockRedirectService) Lookup(ctx context.Context, shortDomain, shortKey string) (services.Destination, error) {
+	m.LastDomain = shortDomain
+	return services.Destination{URL: m.ReturnURL, Untrusted: m.ReturnUntrusted, Protected: m.ReturnProtected}, m.ReturnErr
+}
+
+func (m *MockRedirectService) ConfirmRedirect(ctx context.Context, shortDomain, shortKey string) (services.Destination, error) {
+	m.LastDomain = shortDomain
+	m.Confirmed++
+	return services.Destination{URL: m.ReturnURL, Untrusted: m.ReturnUntrusted, Protected: m.ReturnProtected}, m.ReturnErr
 }
 
-func (m *MockRedirectService) GetOriginalURL(ctx context.Context, shortKey string) (string, error) {
-	return m.ReturnURL, m.ReturnErr
+func (m *MockRedirectService) Unlock(ctx context.Context, shortDomain, shortKey, password, clientIP string) error {
+	m.LastDomain = shortDomain
+	m.LastClientIP = clientIP
+	if m.UnlockErr != nil {
+		return m.UnlockErr
+	}
+	if password != m.Password {
+		return services.ErrWrongPassword
+	}
+	return nil
 }
 
 func TestHandleRedirect(t *testing.T) {
@@ -32,13 +72,14 @@ func TestHandleRedirect(t *testing.T) {
 		mockReturnErr       error
 		expectedStatusCode  int
 		expectedRedirectURL string
+		expectedCode        problem.Code
 	}{
 		{
 			name:                "Success - Valid Redirect",
 			shortKey:            "testkey",
 			mockReturnURL:       "https://example.com/long/url",
 			mockReturnErr:       nil,
-			expectedStatusCode:  http.StatusMovedPermanently,
+			expectedStatusCode:  http.StatusFound,
 			expectedRedirectURL: "https://example.com/long/url",
 		},
 		{
@@ -48,6 +89,23 @@ func TestHandleRedirect(t *testing.T) {
 			mockReturnErr:       services.ErrURLNotFound,
 			expectedStatusCode:  http.StatusNotFound,
 			expectedRedirectURL: "",
+			expectedCode:        problem.CodeNotFound,
+		},
+		{
+			name:                "Blocked By Policy",
+			shortKey:            "banned",
+			mockReturnErr:       services.ErrURLBlocked,
+			expectedStatusCode:  http.StatusForbidden,
+			expectedRedirectURL: "",
+			expectedCode:        problem.CodeBlacklisted,
+		},
+		{
+			name:                "Expired Signature",
+			shortKey:            "abc.k1.mq1zc0.sum",
+			mockReturnErr:       services.ErrLinkExpired,
+			expectedStatusCode:  http.StatusGone,
+			expectedRedirectURL: "",
+			expectedCode:        problem.CodeExpired,
 		},
 		{
 			name:                "Internal Server Error",
@@ -56,6 +114,7 @@ func TestHandleRedirect(t *testing.T) {
 			mockReturnErr:       errors.New("database connection failed"),
 			expectedStatusCode:  http.StatusInternalServerError,
 			expectedRedirectURL: "",
+			expectedCode:        problem.CodeInternal,
 		},
 	}
 
@@ -70,6 +129,7 @@ func TestHandleRedirect(t *testing.T) {
 
 			w := httptest.NewRecorder()
 			req, _ := http.NewRequest(http.MethodGet, "/"+tc.shortKey, nil)
+			req.Host = "go.duss.io"
 
 			c, _ := gin.CreateTestContext(w)
 			c.Request = req
@@ -83,12 +143,178 @@ func TestHandleRedirect(t *testing.T) {
 			if w.Code != tc.expectedStatusCode {
 				t.Errorf("expected status code %d, but got %d", tc.expectedStatusCode, w.Code)
 			}
+			if mockService.LastDomain != "go.duss.io" {
+				t.Errorf("expected the request host to select the domain, but got %q", mockService.LastDomain)
+			}
 
-			if tc.expectedStatusCode == http.StatusMovedPermanently {
+			if tc.expectedCode != "" {
+				var p problem.Problem
+				if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil || w.Header().Get("Content-Type") != problem.ContentType {
+					t.Fatalf("expected a problem document, but got %q: %s", w.Header().Get("Content-Type"), w.Body.String())
+				}
+				if p.Code != tc.expectedCode || p.Instance != "/"+tc.shortKey {
+					t.Errorf("expected a %s problem for /%s, but got %s for %s", tc.expectedCode, tc.shortKey, p.Code, p.Instance)
+				}
+			}
+
+			if tc.expectedStatusCode == http.StatusFound {
 				locationHeader := w.Header().Get("Location")
 				if locationHeader != tc.expectedRedirectURL {
 					t.Errorf("expected redirect URL %s, but got %s", tc.expectedRedirectURL, locationHeader)
 				}
+				if cacheControl := w.Header().Get("Cache-Control"); cacheControl != "no-store" {
+					t.Errorf("expected an uncached redirect, but got Cache-Control %q", cacheControl)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleLookup(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	testCases := []struct {
+		name               string
+		query              string
+		mockReturnURL      string
+		mockUntrusted      bool
+		mockProtected      bool
+		mockReturnErr      error
+		expectedStatusCode int
+		expectedURL        string
+	}{
+		{
+			name:               "Success - Found",
+			query:              "?domain=go.duss.io&key=testkey",
+			mockReturnURL:      "https://example.com/long/url",
+			expectedStatusCode: http.StatusOK,
+			expectedURL:        "https://example.com/long/url",
+		},
+		{
+			name:               "Success - Untrusted",
+			query:              "?domain=go.duss.io&key=flagged",
+			mockReturnURL:      "https://files.example/setup.zip",
+			mockUntrusted:      true,
+			expectedStatusCode: http.StatusOK,
+			expectedURL:        "https://files.example/setup.zip",
+		},
+		{
+			name:               "Success - Protected",
+			query:              "?domain=go.duss.io&key=locked",
+			mockReturnURL:      "https://docs.example/internal",
+			mockProtected:      true,
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:               "Missing Key",
+			query:              "",
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:               "Not Found Error",
+			query:              "?key=nonexistent",
+			mockReturnErr:      services.ErrURLNotFound,
+			expectedStatusCode: http.StatusNotFound,
+		},
+		{
+			name:               "Blocked By Policy",
+			query:              "?key=banned",
+			mockReturnErr:      services.ErrURLBlocked,
+			expectedStatusCode: http.StatusForbidden,
+		},
+		{
+			name:               "Expired Signature",
+			query:              "?key=abc.k1.mq1zc0.sum",
+			mockReturnErr:      services.ErrLinkExpired,
+			expectedStatusCode: http.StatusGone,
+		},
+		{
+			name:               "Internal Server Error",
+			query:              "?key=badkey",
+			mockReturnErr:      errors.New("database connection failed"),
+			expectedStatusCode: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockService := &MockRedirectService{
+				ReturnURL:       tc.mockReturnURL,
+				ReturnUntrusted: tc.mockUntrusted,
+				ReturnProtected: tc.mockProtected,
+				ReturnErr:       tc.mockReturnErr,
+			}
+
+			redirectHandler := api.NewRedirectHandler(mockService)
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request, _ = http.NewRequest(http.MethodGet, "/api/v1/redirect"+tc.query, nil)
+
+			redirectHandler.HandleLookup(c)
+
+			if w.Code != tc.expectedStatusCode {
+				t.Errorf("expected status code %d, but got %d", tc.expectedStatusCode, w.Code)
+			}
+
+			if tc.expectedStatusCode == http.StatusOK {
+				var resp api.LookupResponse
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+					t.Fatalf("could not decode response: %v", err)
+				}
+				if resp.OriginalURL != tc.expectedURL {
+					t.Errorf("expected URL %s, but got %s", tc.expectedURL, resp.OriginalURL)
+				}
+				if resp.Untrusted != tc.mockUntrusted {
+					t.Errorf("expected untrusted=%v, but got %v", tc.mockUntrusted, resp.Untrusted)
+				}
+				if resp.Protected != tc.mockProtected {
+					t.Errorf("expected protected=%v, but got %v", tc.mockProtected, resp.Protected)
+				}
+				if mockService.LastDomain != "go.duss.io" {
+					t.Errorf("expected domain go.duss.io, but got %q", mockService.LastDomain)
+				}
+			}
+			if mockService.Counted != 0 {
+				t.Errorf("expected the lookup not to be counted, but got %d counts", mockService.Counted)
+			}
+		})
+	}
+}
+
+func TestHandleCountRedirect(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	testCases := []struct {
+		name               string
+		query              string
+		mockReturnErr      error
+		expectedStatusCode int
+		expectedCounted    int
+	}{
+		{"Counted", "?domain=go.duss.io&key=testkey", nil, http.StatusNoContent, 1},
+		{"Missing Key", "?domain=go.duss.io", nil, http.StatusBadRequest, 0},
+		{"Not Found", "?domain=go.duss.io&key=nonexistent", services.ErrURLNotFound, http.StatusNotFound, 1},
+		{"Blocked By Policy", "?domain=go.duss.io&key=banned", services.ErrURLBlocked, http.StatusForbidden, 1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockService := &MockRedirectService{ReturnURL: "https://example.com", ReturnErr: tc.mockReturnErr}
+			redirectHandler := api.NewRedirectHandler(mockService)
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request, _ = http.NewRequest(http.MethodPost, "/api/v1/redirect"+tc.query, nil)
+
+			redirectHandler.HandleCountRedirect(c)
+			c.Writer.WriteHeaderNow()
+
+			if w.Code != tc.expectedStatusCode {
+				t.Errorf("expected status code %d, but got %d", tc.expectedStatusCode, w.Code)
+			}
+			if mockService.Counted != tc.expectedCounted {
+				t.Errorf("expected %d counts, but got %d", tc.expectedCounted, mockService.Counted)
 			}
 		})
 	}
@@ -0,0 +1,207 @@
+package api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/iton0/duss/shared/domain"
+	"github.com/iton0/duss/shared/problem"
+	"github.com/iton0/duss/url-redirect-service/internal/core/services"
+)
+
+const (
+	// trustCookie remembers that a visitor chose to continue to an untrusted
+	// link. It is scoped to the link's path, so each link has its own.
+	trustCookie = "duss_trust"
+	// nonceCookie ties the interstitial's continue link to the visitor it
+	// was shown to, so a continue link shared by someone else is refused.
+	nonceCookie = "duss_nonce"
+	// nonceTTL is how long a visitor has to act on the interstitial.
+	nonceTTL = time.Hour
+	// defaultTrustTTL is how long a visitor's choice is remembered.
+	defaultTrustTTL = 30 * 24 * time.Hour
+)
+
+// HandlerOption configures optional settings of a RedirectHandler.
+type HandlerOption func(*RedirectHandler)
+
+// WithTrustCookieKey sets the key the interstitial's and the password form's
+// cookies are signed with. Every replica serving the same domains must share
+// it; without one a random key is used and choices and entered passwords are
+// forgotten when the service restarts.
+func WithTrustCookieKey(key []byte) HandlerOption {
+	return func(h *RedirectHandler) {
+		if len(key) > 0 {
+			h.cookieKey = key
+		}
+	}
+}
+
+// WithTrustCookieTTL sets how long a visitor's choice to continue to an
+// untrusted link is remembered.
+func WithTrustCookieTTL(ttl time.Duration) HandlerOption {
+	return func(h *RedirectHandler) {
+		if ttl > 0 {
+			h.trustTTL = ttl
+		}
+	}
+}
+
+// randomKey returns a key for signing cookies when none is configured.
+func randomKey() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}
+
+// handleUntrusted serves the interstitial for an untrusted destination, or
+// redirects the visitor if they already chose to continue to it.
+func (h *RedirectHandler) handleUntrusted(c *gin.Context, shortKey string, dest services.Destination) {
+	linkID := domain.LinkID(strings.ToLower(c.Request.Host), shortKey)
+	path := "/" + shortKey
+
+	if h.validCookie(c, trustCookie, "trust", linkID) {
+		h.confirm(c, shortKey)
+		return
+	}
+
+	nonce, _ := c.Cookie(nonceCookie)
+	if token := c.Query("continue"); token != "" && nonce != "" && hmac.Equal([]byte(token), []byte(h.sign("continue", linkID, nonce))) {
+		expires := time.Now().Add(h.trustTTL).Unix()
+		value := strconv.FormatInt(expires, 10) + "." + h.sign("trust", linkID, strconv.FormatInt(expires, 10))
+		h.setCookie(c, trustCookie, value, path, int(h.trustTTL.Seconds()))
+		h.setCookie(c, nonceCookie, "", path, -1)
+		h.confirm(c, shortKey)
+		return
+	}
+
+	page := interstitialPage{Destination: dest.URL}
+	if u, err := url.Parse(dest.URL); err == nil {
+		page.Host = u.Host
+	}
+	if c.Query("cancel") != "" {
+		page.Cancelled = true
+	} else {
+		if nonce == "" {
+			nonce = newNonce()
+			h.setCookie(c, nonceCookie, nonce, path, int(nonceTTL.Seconds()))
+		}
+		escaped := "/" + url.PathEscape(shortKey)
+		page.ContinueURL = escaped + "?continue=" + url.QueryEscape(h.sign("continue", linkID, nonce))
+		page.CancelURL = escaped + "?cancel=1"
+	}
+
+	var body bytes.Buffer
+	if err := interstitialTemplate.Execute(&body, page); err != nil {
+		slog.ErrorContext(c.Request.Context(), "failed to render interstitial", "error", err)
+		problem.Abort(c, problem.Internal())
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.Header("Referrer-Policy", "no-referrer")
+	c.Header("X-Frame-Options", "DENY")
+	c.Header("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'")
+	c.Data(http.StatusOK, "text/html; charset=utf-8", body.Bytes())
+}
+
+// confirm redirects a visitor who chose to continue to an untrusted link or
+// entered a protected link's password.
+// The redirect is temporary so the browser asks again once the choice is
+// forgotten.
+func (h *RedirectHandler) confirm(c *gin.Context, shortKey string) {
+	dest, err := h.redirectService.ConfirmRedirect(c.Request.Context(), c.Request.Host, shortKey)
+	if err != nil {
+		writeRedirectError(c, err)
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.Redirect(http.StatusFound, dest.URL)
+}
+
+// validCookie reports whether the request carries a valid, unexpired cookie
+// name signed for purpose and linkID.
+func (h *RedirectHandler) validCookie(c *gin.Context, name, purpose, linkID string) bool {
+	value, err := c.Cookie(name)
+	if err != nil {
+		return false
+	}
+	expires, mac, ok := strings.Cut(value, ".")
+	if !ok {
+		return false
+	}
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() >= unix {
+		return false
+	}
+	return hmac.Equal([]byte(mac), []byte(h.sign(purpose, linkID, expires)))
+}
+
+// sign returns a truncated HMAC of parts under the handler's cookie key.
+func (h *RedirectHandler) sign(parts ...string) string {
+	mac := hmac.New(sha256.New, h.cookieKey)
+	mac.Write([]byte(strings.Join(parts, "\x00")))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+func (h *RedirectHandler) setCookie(c *gin.Context, name, value, path string, maxAge int) {
+	secure := c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https"
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(name, value, maxAge, path, "", secure, true)
+}
+
+func newNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// interstitialPage is the data interstitialTemplate is rendered with.
+type interstitialPage struct {
+	Destination string
+	Host        string
+	ContinueURL string
+	CancelURL   string
+	Cancelled   bool
+}
+
+var interstitialTemplate = template.Must(template.New("interstitial").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>{{if .Cancelled}}Redirect cancelled{{else}}Check this link before you continue{{end}}</title>
+<style>
+body { font-family: system-ui, sans-serif; max-width: 36rem; margin: 4rem auto; padding: 0 1rem; line-height: 1.5; }
+code { display: block; padding: .75rem; background: #f4f4f4; word-break: break-all; }
+.actions a { display: inline-block; margin-right: 1rem; }
+</style>
+</head>
+<body>
+{{- if .Cancelled}}
+<h1>Redirect cancelled</h1>
+<p>You were not sent to:</p>
+<code>{{.Destination}}</code>
+<p>You can close this page.</p>
+{{- else}}
+<h1>Check this link before you continue</h1>
+<p>This short link is marked as untrusted. It leads to{{with .Host}} <strong>{{.}}</strong>{{end}}:</p>
+<code>{{.Destination}}</code>
+<p>Only continue if you recognize this address and expected to be sent there.</p>
+<p class="actions"><a href="{{.ContinueURL}}">Continue</a> <a href="{{.CancelURL}}">Cancel</a></p>
+{{- end}}
+</body>
+</html>
+`))
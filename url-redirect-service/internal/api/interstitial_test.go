@@ -0,0 +1,134 @@
+package api_test
+
+import (
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/iton0/duss/url-redirect-service/internal/api"
+)
+
+const untrustedURL = "https://files.example/setup.zip"
+
+// newInterstitialRouter serves an untrusted link through a handler signing
+// its cookies with key.
+func newInterstitialRouter(mockService *MockRedirectService, key string) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/:shortKey", api.NewRedirectHandler(mockService, api.WithTrustCookieKey([]byte(key))).HandleRedirect)
+	return router
+}
+
+func get(router http.Handler, path string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Host = "go.duss.io"
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func cookie(w *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+var continueLink = regexp.MustCompile(`href="([^"]*continue=[^"]*)"`)
+
+func TestInterstitial(t *testing.T) {
+	mockService := &MockRedirectService{ReturnURL: untrustedURL, ReturnUntrusted: true}
+	router := newInterstitialRouter(mockService, "s3cret")
+
+	// A first visit shows the destination instead of redirecting.
+	w := get(router, "/flagged")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, but got %d", http.StatusOK, w.Code)
+	}
+	if !strings.Contains(w.Body.String(), untrustedURL) {
+		t.Errorf("expected the page to show %s, but got %s", untrustedURL, w.Body.String())
+	}
+	if w.Header().Get("Location") != "" || w.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("expected an uncached page without a redirect, but got headers %v", w.Header())
+	}
+	nonce := cookie(w, "duss_nonce")
+	if nonce == nil || nonce.Path != "/flagged" || !nonce.HttpOnly {
+		t.Fatalf("expected an HttpOnly nonce cookie scoped to /flagged, but got %v", nonce)
+	}
+	m := continueLink.FindStringSubmatch(w.Body.String())
+	if m == nil {
+		t.Fatalf("expected a continue link, but got %s", w.Body.String())
+	}
+	continueURL := html.UnescapeString(m[1])
+
+	// The continue link only works for the visitor it was shown to.
+	if w := get(router, continueURL); w.Code != http.StatusOK || mockService.Confirmed != 0 {
+		t.Fatalf("expected the page again without the nonce, but got %d after %d confirmations", w.Code, mockService.Confirmed)
+	}
+	forged := &http.Cookie{Name: "duss_nonce", Value: "forged"}
+	if w := get(router, continueURL, forged); w.Code != http.StatusOK || mockService.Confirmed != 0 {
+		t.Fatalf("expected the page again with another nonce, but got %d after %d confirmations", w.Code, mockService.Confirmed)
+	}
+
+	w = get(router, continueURL, nonce)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != untrustedURL {
+		t.Fatalf("expected a temporary redirect to %s, but got %d %q", untrustedURL, w.Code, w.Header().Get("Location"))
+	}
+	if mockService.Confirmed != 1 {
+		t.Errorf("expected the redirect to be confirmed once, but got %d", mockService.Confirmed)
+	}
+	trust := cookie(w, "duss_trust")
+	if trust == nil || trust.Path != "/flagged" || trust.MaxAge <= 0 {
+		t.Fatalf("expected a persistent trust cookie scoped to /flagged, but got %v", trust)
+	}
+
+	// The remembered choice skips the page on later visits.
+	if w := get(router, "/flagged", trust); w.Code != http.StatusFound || w.Header().Get("Location") != untrustedURL {
+		t.Errorf("expected the trust cookie to redirect, but got %d", w.Code)
+	}
+	if w := get(router, "/other", trust); w.Code != http.StatusOK {
+		t.Errorf("expected the trust cookie not to cover another link, but got %d", w.Code)
+	}
+	if w := get(newInterstitialRouter(mockService, "other"), "/flagged", trust); w.Code != http.StatusOK {
+		t.Errorf("expected a cookie signed with another key to be refused, but got %d", w.Code)
+	}
+	tampered := &http.Cookie{Name: "duss_trust", Value: "99999999999." + strings.SplitN(trust.Value, ".", 2)[1]}
+	if w := get(router, "/flagged", tampered); w.Code != http.StatusOK {
+		t.Errorf("expected a tampered expiry to be refused, but got %d", w.Code)
+	}
+}
+
+func TestInterstitialCancel(t *testing.T) {
+	mockService := &MockRedirectService{ReturnURL: untrustedURL, ReturnUntrusted: true}
+	router := newInterstitialRouter(mockService, "s3cret")
+
+	w := get(router, "/flagged?cancel=1")
+
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Redirect cancelled") {
+		t.Errorf("expected the cancelled page, but got %d: %s", w.Code, w.Body.String())
+	}
+	if cookie(w, "duss_trust") != nil || mockService.Confirmed != 0 {
+		t.Error("expected cancelling not to trust the link")
+	}
+}
+
+func TestInterstitialEscapesDestination(t *testing.T) {
+	mockService := &MockRedirectService{ReturnURL: `https://files.example/"><script>alert(1)</script>`, ReturnUntrusted: true}
+	router := newInterstitialRouter(mockService, "s3cret")
+
+	w := get(router, "/flagged")
+
+	if strings.Contains(w.Body.String(), "<script>") {
+		t.Errorf("expected the destination to be escaped, but got %s", w.Body.String())
+	}
+}
@@ -0,0 +1,172 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"html/template"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/iton0/duss/shared/domain"
+	"github.com/iton0/duss/shared/problem"
+	"github.com/iton0/duss/url-redirect-service/internal/core/services"
+)
+
+const (
+	// unlockCookie remembers that a visitor entered a protected link's
+	// password. It is scoped to the link's path, so each link has its own.
+	unlockCookie = "duss_unlock"
+	// defaultUnlockTTL is how long an entered password is remembered.
+	defaultUnlockTTL = 10 * time.Minute
+)
+
+// WithUnlockCookieTTL sets how long a visitor who entered a protected link's
+// password may follow it without entering it again.
+func WithUnlockCookieTTL(ttl time.Duration) HandlerOption {
+	return func(h *RedirectHandler) {
+		if ttl > 0 {
+			h.unlockTTL = ttl
+		}
+	}
+}
+
+// WithTrustedProxies sets the proxies, such as the API gateway, whose
+// X-Forwarded-For entries are believed. Without it, password attempts are
+// counted under the address each request came from.
+func WithTrustedProxies(prefixes []netip.Prefix) HandlerOption {
+	return func(h *RedirectHandler) {
+		h.trustedProxies = prefixes
+	}
+}
+
+// HandleUnlock handles the POST /:shortKey request the password form is
+// submitted with. A correct password sets the unlock cookie and sends the
+// visitor back to the link, which then redirects them.
+func (h *RedirectHandler) HandleUnlock(c *gin.Context) {
+	shortKey := c.Param("shortKey")
+	linkID := domain.LinkID(strings.ToLower(c.Request.Host), shortKey)
+
+	err := h.redirectService.Unlock(c.Request.Context(), c.Request.Host, shortKey, c.PostForm("password"), h.clientIP(c))
+	switch {
+	case err == nil:
+		expires := strconv.FormatInt(time.Now().Add(h.unlockTTL).Unix(), 10)
+		h.setCookie(c, unlockCookie, expires+"."+h.sign("unlock", linkID, expires), "/"+shortKey, int(h.unlockTTL.Seconds()))
+		c.Header("Cache-Control", "no-store")
+		c.Redirect(http.StatusSeeOther, "/"+url.PathEscape(shortKey))
+	case errors.Is(err, services.ErrWrongPassword):
+		h.servePasswordForm(c, http.StatusUnauthorized, shortKey, "That password is not correct.")
+	case errors.Is(err, services.ErrTooManyAttempts):
+		h.servePasswordForm(c, http.StatusTooManyRequests, shortKey, "Too many wrong passwords. Try again later.")
+	default:
+		writeRedirectError(c, err)
+	}
+}
+
+// handleProtected serves the password form for a protected destination, or
+// sends the visitor on if they already entered the password.
+func (h *RedirectHandler) handleProtected(c *gin.Context, shortKey string, dest services.Destination) {
+	linkID := domain.LinkID(strings.ToLower(c.Request.Host), shortKey)
+	if !h.validCookie(c, unlockCookie, "unlock", linkID) {
+		h.servePasswordForm(c, http.StatusOK, shortKey, "")
+		return
+	}
+	if dest.Untrusted {
+		h.handleUntrusted(c, shortKey, dest)
+		return
+	}
+	h.confirm(c, shortKey)
+}
+
+// servePasswordForm renders the password form with status and, after a
+// failed attempt, its error message.
+func (h *RedirectHandler) servePasswordForm(c *gin.Context, status int, shortKey, message string) {
+	page := passwordPage{Action: "/" + url.PathEscape(shortKey), Error: message}
+
+	var body bytes.Buffer
+	if err := passwordTemplate.Execute(&body, page); err != nil {
+		slog.ErrorContext(c.Request.Context(), "failed to render password form", "error", err)
+		problem.Abort(c, problem.Internal())
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.Header("Referrer-Policy", "no-referrer")
+	c.Header("X-Frame-Options", "DENY")
+	c.Header("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; form-action 'self'")
+	c.Data(status, "text/html; charset=utf-8", body.Bytes())
+}
+
+// clientIP returns the address password attempts are counted under: the
+// address the request came from or, when that is a trusted proxy, the
+// X-Forwarded-For entry it appended. Entries are followed from the right
+// only while they are trusted proxies too, since a visitor can forge any
+// entry they send themselves.
+func (h *RedirectHandler) clientIP(c *gin.Context) string {
+	ip, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+	if err != nil {
+		ip = c.Request.RemoteAddr
+	}
+	entries := strings.Split(c.GetHeader("X-Forwarded-For"), ",")
+	for i := len(entries) - 1; i >= 0 && h.trustedProxy(ip); i-- {
+		entry := strings.TrimSpace(entries[i])
+		if entry == "" {
+			break
+		}
+		ip = entry
+	}
+	return ip
+}
+
+// trustedProxy reports whether ip is one of the trusted proxies.
+func (h *RedirectHandler) trustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range h.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// passwordPage is the data passwordTemplate is rendered with.
+type passwordPage struct {
+	Action string
+	Error  string
+}
+
+var passwordTemplate = template.Must(template.New("password").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>Enter the password for this link</title>
+<style>
+body { font-family: system-ui, sans-serif; max-width: 36rem; margin: 4rem auto; padding: 0 1rem; line-height: 1.5; }
+.error { color: #b00020; }
+</style>
+</head>
+<body>
+<h1>Enter the password for this link</h1>
+<p>This short link is protected. Enter its password to continue.</p>
+{{- with .Error}}
+<p class="error" role="alert">{{.}}</p>
+{{- end}}
+<form method="post" action="{{.Action}}">
+<input type="password" name="password" aria-label="Password" autocomplete="current-password" required autofocus>
+<button type="submit">Continue</button>
+</form>
+</body>
+</html>
+`))
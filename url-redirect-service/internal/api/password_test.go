@@ -0,0 +1,170 @@
+package api_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/iton0/duss/url-redirect-service/internal/api"
+	"github.com/iton0/duss/url-redirect-service/internal/core/services"
+)
+
+const protectedURL = "https://docs.example/internal/roadmap"
+
+// newPasswordRouter serves a protected link through a handler signing its
+// cookies with key.
+func newPasswordRouter(mockService *MockRedirectService, key string, opts ...api.HandlerOption) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	handler := api.NewRedirectHandler(mockService, append([]api.HandlerOption{api.WithTrustCookieKey([]byte(key))}, opts...)...)
+	router.GET("/:shortKey", handler.HandleRedirect)
+	router.POST("/:shortKey", handler.HandleUnlock)
+	return router
+}
+
+func post(router http.Handler, path, password string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(url.Values{"password": {password}}.Encode()))
+	req.Host = "go.duss.io"
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Forwarded-For", "203.0.113.7, 198.51.100.2")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestPasswordForm(t *testing.T) {
+	mockService := &MockRedirectService{ReturnURL: protectedURL, ReturnProtected: true, Password: "hunter2"}
+	router := newPasswordRouter(mockService, "s3cret", api.WithTrustedProxies([]netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}))
+
+	// A first visit asks for the password without revealing the destination.
+	w := get(router, "/locked")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `action="/locked"`) {
+		t.Fatalf("expected the password form, but got %d: %s", w.Code, w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), "docs.example") || w.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("expected an uncached page without the destination, but got %s", w.Body.String())
+	}
+
+	w = post(router, "/locked", "guess")
+	if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "not correct") {
+		t.Errorf("expected the form again for a wrong password, but got %d: %s", w.Code, w.Body.String())
+	}
+	if cookie(w, "duss_unlock") != nil {
+		t.Error("expected no unlock cookie for a wrong password")
+	}
+	if mockService.LastClientIP != "198.51.100.2" {
+		t.Errorf("expected attempts to be counted for the gateway's client, but got %q", mockService.LastClientIP)
+	}
+
+	w = post(router, "/locked", "hunter2")
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/locked" {
+		t.Fatalf("expected to be sent back to /locked, but got %d %q", w.Code, w.Header().Get("Location"))
+	}
+	unlock := cookie(w, "duss_unlock")
+	if unlock == nil || unlock.Path != "/locked" || !unlock.HttpOnly || unlock.MaxAge <= 0 || unlock.MaxAge > 3600 {
+		t.Fatalf("expected a short-lived HttpOnly unlock cookie scoped to /locked, but got %v", unlock)
+	}
+
+	w = get(router, "/locked", unlock)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != protectedURL {
+		t.Fatalf("expected a temporary redirect to %s, but got %d %q", protectedURL, w.Code, w.Header().Get("Location"))
+	}
+	if mockService.Confirmed != 1 {
+		t.Errorf("expected the redirect to be confirmed once, but got %d", mockService.Confirmed)
+	}
+
+	if w := get(router, "/other", unlock); w.Code != http.StatusOK {
+		t.Errorf("expected the unlock cookie not to cover another link, but got %d", w.Code)
+	}
+	if w := get(newPasswordRouter(mockService, "other"), "/locked", unlock); w.Code != http.StatusOK {
+		t.Errorf("expected a cookie signed with another key to be refused, but got %d", w.Code)
+	}
+	trust := &http.Cookie{Name: "duss_trust", Value: unlock.Value}
+	if w := get(router, "/locked", trust); w.Code != http.StatusOK {
+		t.Errorf("expected an unlock value in the trust cookie to be refused, but got %d", w.Code)
+	}
+}
+
+func TestPasswordFormThenInterstitial(t *testing.T) {
+	mockService := &MockRedirectService{ReturnURL: protectedURL, ReturnProtected: true, ReturnUntrusted: true, Password: "hunter2"}
+	router := newPasswordRouter(mockService, "s3cret")
+
+	unlock := cookie(post(router, "/locked", "hunter2"), "duss_unlock")
+	if unlock == nil {
+		t.Fatal("expected an unlock cookie")
+	}
+
+	w := get(router, "/locked", unlock)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), protectedURL) || mockService.Confirmed != 0 {
+		t.Errorf("expected the interstitial after the password, but got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestUnlockClientIP(t *testing.T) {
+	gateway := netip.MustParsePrefix("192.0.2.0/24")
+	testCases := []struct {
+		name           string
+		trustedProxies []netip.Prefix
+		remoteAddr     string
+		forwardedFor   string
+		expectedIP     string
+	}{
+		{"No Trusted Proxies", nil, "192.0.2.1:1234", "203.0.113.7", "192.0.2.1"},
+		{"Untrusted Sender", []netip.Prefix{gateway}, "198.51.100.9:1234", "203.0.113.7", "198.51.100.9"},
+		{"Trusted Proxy", []netip.Prefix{gateway}, "192.0.2.1:1234", "203.0.113.7, 198.51.100.2", "198.51.100.2"},
+		{"Chain Of Trusted Proxies", []netip.Prefix{gateway}, "192.0.2.1:1234", "203.0.113.7, 198.51.100.2, 192.0.2.5", "198.51.100.2"},
+		{"Trusted Proxy Without Header", []netip.Prefix{gateway}, "192.0.2.1:1234", "", "192.0.2.1"},
+		{"IPv4-Mapped Proxy", []netip.Prefix{gateway}, "[::ffff:192.0.2.1]:1234", "198.51.100.2", "198.51.100.2"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockService := &MockRedirectService{ReturnURL: protectedURL, ReturnProtected: true, Password: "hunter2"}
+			router := newPasswordRouter(mockService, "s3cret", api.WithTrustedProxies(tc.trustedProxies))
+
+			req := httptest.NewRequest(http.MethodPost, "/locked", strings.NewReader(url.Values{"password": {"guess"}}.Encode()))
+			req.RemoteAddr = tc.remoteAddr
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tc.forwardedFor != "" {
+				req.Header.Set("X-Forwarded-For", tc.forwardedFor)
+			}
+			router.ServeHTTP(httptest.NewRecorder(), req)
+
+			if mockService.LastClientIP != tc.expectedIP {
+				t.Errorf("expected attempts to be counted for %q, but got %q", tc.expectedIP, mockService.LastClientIP)
+			}
+		})
+	}
+}
+
+func TestHandleUnlockErrors(t *testing.T) {
+	testCases := []struct {
+		name               string
+		unlockErr          error
+		expectedStatusCode int
+	}{
+		{"Too Many Attempts", services.ErrTooManyAttempts, http.StatusTooManyRequests},
+		{"Not Found", services.ErrURLNotFound, http.StatusNotFound},
+		{"Blocked", services.ErrURLBlocked, http.StatusForbidden},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			router := newPasswordRouter(&MockRedirectService{UnlockErr: tc.unlockErr}, "s3cret")
+
+			w := post(router, "/locked", "hunter2")
+
+			if w.Code != tc.expectedStatusCode {
+				t.Errorf("expected status code %d, but got %d", tc.expectedStatusCode, w.Code)
+			}
+			if cookie(w, "duss_unlock") != nil {
+				t.Error("expected no unlock cookie")
+			}
+		})
+	}
+}
@@ -3,17 +3,68 @@ package services
 import (
 	"context"
 	"errors"
-	"log"
+	"log/slog"
+	"strings"
+	"time"
 
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/iton0/duss/shared/domain"
+	"github.com/iton0/duss/shared/linksig"
+	"github.com/iton0/duss/shared/metrics"
+	"github.com/iton0/duss/shared/policy"
 	"github.com/iton0/duss/url-redirect-service/internal/infrastructure/storage"
 )
 
-// ErrURLNotFound indicates that the short key was not found.
-var ErrURLNotFound = errors.New("URL not found")
+var (
+	// ErrURLNotFound indicates that the short key was not found.
+	ErrURLNotFound = errors.New("URL not found")
+	// ErrURLBlocked indicates that the link was disabled or that the URL
+	// policy forbids its target.
+	ErrURLBlocked = errors.New("URL blocked")
+	// ErrWrongPassword indicates that the password entered for a protected
+	// link does not match.
+	ErrWrongPassword = errors.New("wrong password")
+	// ErrTooManyAttempts indicates that a visitor entered too many wrong
+	// passwords for a link and must wait before trying again.
+	ErrTooManyAttempts = errors.New("too many password attempts")
+	// ErrLinkExpired indicates that the signature of a signed short URL is
+	// valid but has expired.
+	ErrLinkExpired = errors.New("link expired")
+)
 
-// RedirectServiceIface defines the behavior of the redirect service.
+// RedirectServiceIface defines the behavior of the redirect service. Its
+// shortKey arguments are the path segment of the short URL, which for signed
+// links carries the link's signature after its key.
 type RedirectServiceIface interface {
-	GetOriginalURL(ctx context.Context, shortKey string) (string, error)
+	// GetOriginalURL looks up where a link leads. The redirect is counted
+	// unless the destination is untrusted or protected, in which case it is
+	// only counted once the visitor confirms it through ConfirmRedirect.
+	GetOriginalURL(ctx context.Context, shortDomain, shortKey string) (Destination, error)
+	// Lookup looks up where a link leads like GetOriginalURL, but without
+	// counting the redirect. It is read-only, so callers may repeat it and
+	// count the redirect they issue once through GetOriginalURL.
+	Lookup(ctx context.Context, shortDomain, shortKey string) (Destination, error)
+	// ConfirmRedirect looks up an untrusted or protected link again after
+	// the visitor chose to continue to it or entered its password, and
+	// counts the redirect.
+	ConfirmRedirect(ctx context.Context, shortDomain, shortKey string) (Destination, error)
+	// Unlock checks the password a visitor at clientIP entered for a
+	// protected link. It returns ErrWrongPassword if it does not match and
+	// ErrTooManyAttempts once the visitor has entered too many wrong ones.
+	Unlock(ctx context.Context, shortDomain, shortKey, password, clientIP string) error
+}
+
+// Destination is where a short link leads.
+type Destination struct {
+	URL string
+	// Untrusted is set when the link, or the domain it leads to, is flagged
+	// as untrusted. Visitors are then shown the destination and asked to
+	// confirm instead of being redirected directly.
+	Untrusted bool
+	// Protected is set when the link has a password, which visitors must
+	// enter through Unlock before they are redirected.
+	Protected bool
 }
 
 // Ensure RedirectService explicitly implements RedirectServiceIface.
@@ -24,24 +75,244 @@ var _ RedirectServiceIface = (*RedirectService)(nil)
 // This struct now implicitly implements the RedirectServiceIface.
 type RedirectService struct {
 	storage storage.Storage
+	cache   storage.Cache
+	counter storage.RedirectCounter
+	policy  *policy.Engine
+	signing *linksig.Keyring
+
+	attempts      storage.AttemptCounter
+	maxAttempts   int64
+	attemptWindow time.Duration
+}
+
+// Option configures optional collaborators of a RedirectService.
+type Option func(*RedirectService)
+
+// WithCache puts c in front of the service's storage. Lookups try the cache
+// first and populate it on a miss.
+func WithCache(c storage.Cache) Option {
+	return func(s *RedirectService) {
+		s.cache = c
+	}
+}
+
+// WithRedirectCounter makes the service record every successful lookup in c.
+func WithRedirectCounter(c storage.RedirectCounter) Option {
+	return func(s *RedirectService) {
+		s.counter = c
+	}
+}
+
+// WithPolicy makes the service refuse to redirect to URLs that p rejects, so
+// links created before a domain was banned stop working too.
+func WithPolicy(p *policy.Engine) Option {
+	return func(s *RedirectService) {
+		s.policy = p
+	}
+}
+
+// WithAttemptLimit allows a visitor max wrong passwords for a protected link
+// per window, counting their attempts in c. Without it attempts are not
+// limited.
+func WithAttemptLimit(c storage.AttemptCounter, max int, window time.Duration) Option {
+	return func(s *RedirectService) {
+		s.attempts = c
+		s.maxAttempts = int64(max)
+		s.attemptWindow = window
+	}
+}
+
+// WithLinkSigning makes the service follow signed short URLs, verifying
+// their signatures with keys. Without it, signed links never redirect.
+func WithLinkSigning(keys *linksig.Keyring) Option {
+	return func(s *RedirectService) {
+		s.signing = keys
+	}
 }
 
 // NewRedirectService creates a new RedirectService instance.
-func NewRedirectService(s storage.Storage) *RedirectService {
-	return &RedirectService{storage: s}
+func NewRedirectService(s storage.Storage, opts ...Option) *RedirectService {
+	rs := &RedirectService{storage: s}
+	for _, opt := range opts {
+		opt(rs)
+	}
+	return rs
+}
+
+// GetOriginalURL retrieves the destination of a given short key on
+// shortDomain.
+func (s *RedirectService) GetOriginalURL(ctx context.Context, shortDomain, shortKey string) (Destination, error) {
+	url, dest, err := s.resolve(ctx, shortDomain, shortKey)
+	if err != nil {
+		return Destination{}, err
+	}
+	if !dest.Untrusted && !dest.Protected {
+		s.count(ctx, url)
+	}
+	return dest, nil
+}
+
+// Lookup implements RedirectServiceIface.
+func (s *RedirectService) Lookup(ctx context.Context, shortDomain, shortKey string) (Destination, error) {
+	_, dest, err := s.resolve(ctx, shortDomain, shortKey)
+	return dest, err
+}
+
+// ConfirmRedirect implements RedirectServiceIface.
+func (s *RedirectService) ConfirmRedirect(ctx context.Context, shortDomain, shortKey string) (Destination, error) {
+	url, dest, err := s.resolve(ctx, shortDomain, shortKey)
+	if err != nil {
+		return Destination{}, err
+	}
+	s.count(ctx, url)
+	return dest, nil
+}
+
+// Unlock implements RedirectServiceIface. Attempts are counted per link and
+// client address, and only once the link is known to be protected. They are
+// counted before the password is compared, so guesses sent in parallel cannot
+// slip past the limit, and forgotten once the right one is entered, so only
+// wrong passwords add up.
+func (s *RedirectService) Unlock(ctx context.Context, shortDomain, shortKey, password, clientIP string) error {
+	shortDomain = strings.ToLower(shortDomain)
+	url, err := s.find(ctx, shortDomain, shortKey)
+	if err != nil {
+		return err
+	}
+	if !url.IsProtected() {
+		return nil
+	}
+
+	key := "unlock:" + url.ID() + ":" + clientIP
+	if s.attempts != nil {
+		n, err := s.attempts.CountAttempt(ctx, key, s.attemptWindow)
+		if err != nil {
+			// Without a count the limit cannot be enforced, so the
+			// attempt is refused rather than let through.
+			slog.WarnContext(ctx, "failed to count password attempt", "error", err)
+			return err
+		}
+		if n > s.maxAttempts {
+			slog.WarnContext(ctx, "too many password attempts", "link", url.ID(), "client_ip", clientIP)
+			return ErrTooManyAttempts
+		}
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(url.PasswordHash), []byte(password)); err != nil {
+		return ErrWrongPassword
+	}
+	if s.attempts != nil {
+		if err := s.attempts.ResetAttempts(ctx, key); err != nil {
+			// The visitor is let in all the same; at worst their earlier
+			// wrong passwords still count until the window passes.
+			slog.WarnContext(ctx, "failed to reset password attempts", "error", err)
+		}
+	}
+	return nil
 }
 
-// GetOriginalURL retrieves the long URL for a given short key.
-func (s *RedirectService) GetOriginalURL(ctx context.Context, shortKey string) (string, error) {
-	longURL, err := s.storage.Get(ctx, shortKey)
+// resolve looks up a link and checks that it may be followed, returning the
+// link and where it leads.
+func (s *RedirectService) resolve(ctx context.Context, shortDomain, shortKey string) (*domain.URL, Destination, error) {
+	shortDomain = strings.ToLower(shortDomain)
+	url, err := s.find(ctx, shortDomain, shortKey)
+	if err != nil {
+		return nil, Destination{}, err
+	}
+
+	dest := Destination{URL: url.LongURL, Untrusted: url.Untrusted, Protected: url.IsProtected()}
+	if s.policy != nil {
+		target := url.CanonicalURL
+		if target == "" {
+			target = url.LongURL
+		}
+		d := s.policy.Evaluate(target)
+		if !d.Allowed {
+			slog.InfoContext(ctx, "policy: blocked redirect", "link", url.ID(), "url", url.LongURL, "rule", d.Rule)
+			return nil, Destination{}, ErrURLBlocked
+		}
+		dest.Untrusted = dest.Untrusted || d.Untrusted
+	}
+
+	return url, dest, nil
+}
+
+// count records a redirect to url. A lost count must not fail the redirect
+// itself, so errors are only logged.
+func (s *RedirectService) count(ctx context.Context, url *domain.URL) {
+	if s.counter == nil {
+		return
+	}
+	if err := s.counter.IncrementRedirects(ctx, url.Domain, url.ShortKey); err != nil {
+		slog.WarnContext(ctx, "failed to record redirect", "error", err)
+	}
+}
+
+// find looks up a link that may be followed, returning ErrURLNotFound if it
+// does not exist and ErrURLBlocked if it was disabled. segment is the path
+// segment of the short URL. Its signature, if any, is checked before the
+// link is looked up, so forged and guessed signed URLs never reach the
+// cache or storage; a signed link is not found without one.
+func (s *RedirectService) find(ctx context.Context, shortDomain, segment string) (*domain.URL, error) {
+	shortKey, token, signed := linksig.Split(segment)
+	if signed {
+		if s.signing == nil {
+			return nil, ErrURLNotFound
+		}
+		if err := s.signing.Verify(shortDomain, shortKey, token, time.Now()); err != nil {
+			if errors.Is(err, linksig.ErrExpired) {
+				return nil, ErrLinkExpired
+			}
+			slog.InfoContext(ctx, "rejected signed link", "link", domain.LinkID(shortDomain, shortKey), "error", err)
+			return nil, ErrURLNotFound
+		}
+	}
+
+	url, err := s.lookup(ctx, shortDomain, shortKey)
 	if err != nil {
 		switch {
 		case errors.Is(err, storage.ErrNotFound):
-			return "", ErrURLNotFound
+			return nil, ErrURLNotFound
 		default:
-			log.Printf("unexpected server error: %v", err)
-			return "", err
+			slog.ErrorContext(ctx, "unexpected server error", "error", err)
+			return nil, err
 		}
 	}
-	return longURL, nil
+
+	if url.Signed && !signed {
+		return nil, ErrURLNotFound
+	}
+	if url.IsDisabled() {
+		slog.InfoContext(ctx, "blocked redirect to disabled link", "link", domain.LinkID(shortDomain, shortKey), "url", url.LongURL, "reason", url.DisabledReason)
+		return nil, ErrURLBlocked
+	}
+	return url, nil
+}
+
+// lookup reads shortKey through the cache, if any, falling back to storage.
+func (s *RedirectService) lookup(ctx context.Context, shortDomain, shortKey string) (*domain.URL, error) {
+	if s.cache != nil {
+		url, err := s.cache.Get(ctx, shortDomain, shortKey)
+		if err == nil {
+			metrics.CacheLookups.WithLabelValues(metrics.CacheHit).Inc()
+			return url, nil
+		}
+		metrics.CacheLookups.WithLabelValues(metrics.CacheMiss).Inc()
+		if !errors.Is(err, storage.ErrNotFound) {
+			slog.WarnContext(ctx, "cache lookup failed, falling back to storage", "error", err)
+		}
+	}
+
+	url, err := s.storage.Get(ctx, shortDomain, shortKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.cache != nil {
+		if err := s.cache.Save(ctx, url); err != nil && !errors.Is(err, storage.ErrDuplicatedKey) {
+			slog.WarnContext(ctx, "failed to populate cache", "error", err)
+		}
+	}
+
+	return url, nil
 }
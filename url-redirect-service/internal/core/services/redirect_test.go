@@ -3,10 +3,20 @@ package services
 import (
 	"context"
 	"errors"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/iton0/duss/shared/domain"
+	"github.com/iton0/duss/shared/linksig"
+	"github.com/iton0/duss/shared/metrics"
+	"github.com/iton0/duss/shared/policy"
 	"github.com/iton0/duss/url-redirect-service/internal/infrastructure/storage"
+	"github.com/iton0/duss/url-redirect-service/internal/infrastructure/storage/mock"
 )
 
 // MockStorage is a mock implementation of the Storage interface.
@@ -15,8 +25,11 @@ type MockStorage struct {
 	ReturnErr error
 }
 
-func (m *MockStorage) Get(ctx context.Context, key string) (string, error) {
-	return m.ReturnURL, m.ReturnErr
+func (m *MockStorage) Get(ctx context.Context, shortDomain, key string) (*domain.URL, error) {
+	if m.ReturnErr != nil {
+		return nil, m.ReturnErr
+	}
+	return &domain.URL{Domain: shortDomain, ShortKey: key, LongURL: m.ReturnURL}, nil
 }
 
 func (m *MockStorage) Set(ctx context.Context, key string, value string, expiration time.Duration) error {
@@ -34,12 +47,12 @@ func TestGetOriginalURL(t *testing.T) {
 		mockStorage := &MockStorage{ReturnURL: "http://example.com/long-url", ReturnErr: nil}
 		redirectService := NewRedirectService(mockStorage)
 
-		longURL, err := redirectService.GetOriginalURL(ctx, "short-key")
+		dest, err := redirectService.GetOriginalURL(ctx, "duss.io", "short-key")
 		if err != nil {
 			t.Errorf("expected no error, but got %v", err)
 		}
-		if longURL != "http://example.com/long-url" {
-			t.Errorf("expected 'http://example.com/long-url', but got %s", longURL)
+		if dest.URL != "http://example.com/long-url" {
+			t.Errorf("expected 'http://example.com/long-url', but got %s", dest.URL)
 		}
 	})
 
@@ -47,7 +60,7 @@ func TestGetOriginalURL(t *testing.T) {
 		mockStorage := &MockStorage{ReturnURL: "", ReturnErr: storage.ErrNotFound}
 		redirectService := NewRedirectService(mockStorage)
 
-		_, err := redirectService.GetOriginalURL(ctx, "nonexistent-key")
+		_, err := redirectService.GetOriginalURL(ctx, "duss.io", "nonexistent-key")
 		if !errors.Is(err, ErrURLNotFound) {
 			t.Errorf("expected ErrURLNotFound, but got %v", err)
 		}
@@ -58,7 +71,7 @@ func TestGetOriginalURL(t *testing.T) {
 		mockStorage := &MockStorage{ReturnURL: "", ReturnErr: expectedErr}
 		redirectService := NewRedirectService(mockStorage)
 
-		_, err := redirectService.GetOriginalURL(ctx, "any-key")
+		_, err := redirectService.GetOriginalURL(ctx, "duss.io", "any-key")
 		if err == nil {
 			t.Errorf("expected an error, but got nil")
 		}
@@ -67,3 +80,414 @@ func TestGetOriginalURL(t *testing.T) {
 		}
 	})
 }
+
+// MockCounter records the keys it was asked to count.
+type MockCounter struct {
+	Counted []string
+}
+
+func (m *MockCounter) IncrementRedirects(ctx context.Context, shortDomain, shortKey string) error {
+	m.Counted = append(m.Counted, domain.LinkID(shortDomain, shortKey))
+	return nil
+}
+
+func TestGetOriginalURLWithCache(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Cache Miss - Populates Cache", func(t *testing.T) {
+		durable := mock.NewMockStorage("duss.io", map[string]string{"short-key": "http://example.com/long-url"})
+		cache := mock.NewMockStorage("duss.io", nil)
+		counter := &MockCounter{}
+		redirectService := NewRedirectService(durable, WithCache(cache), WithRedirectCounter(counter))
+		misses := testutil.ToFloat64(metrics.CacheLookups.WithLabelValues(metrics.CacheMiss))
+
+		dest, err := redirectService.GetOriginalURL(ctx, "duss.io", "short-key")
+		if err != nil {
+			t.Fatalf("expected no error, but got %v", err)
+		}
+		if got := testutil.ToFloat64(metrics.CacheLookups.WithLabelValues(metrics.CacheMiss)) - misses; got != 1 {
+			t.Errorf("expected one cache miss to be recorded, but got %v", got)
+		}
+		if dest.URL != "http://example.com/long-url" {
+			t.Errorf("expected 'http://example.com/long-url', but got %s", dest.URL)
+		}
+		if _, err := cache.Get(ctx, "duss.io", "short-key"); err != nil {
+			t.Errorf("expected the cache to be populated, but got %v", err)
+		}
+		if len(counter.Counted) != 1 {
+			t.Errorf("expected one redirect to be counted, but got %d", len(counter.Counted))
+		}
+	})
+
+	t.Run("Cache Hit - Skips Storage", func(t *testing.T) {
+		durable := &MockStorage{ReturnErr: errors.New("storage should not be read")}
+		cache := mock.NewMockStorage("duss.io", map[string]string{"short-key": "http://example.com/cached"})
+		redirectService := NewRedirectService(durable, WithCache(cache))
+		hits := testutil.ToFloat64(metrics.CacheLookups.WithLabelValues(metrics.CacheHit))
+
+		dest, err := redirectService.GetOriginalURL(ctx, "duss.io", "short-key")
+		if err != nil {
+			t.Fatalf("expected no error, but got %v", err)
+		}
+		if got := testutil.ToFloat64(metrics.CacheLookups.WithLabelValues(metrics.CacheHit)) - hits; got != 1 {
+			t.Errorf("expected one cache hit to be recorded, but got %v", got)
+		}
+		if dest.URL != "http://example.com/cached" {
+			t.Errorf("expected 'http://example.com/cached', but got %s", dest.URL)
+		}
+	})
+
+	t.Run("Domains - Same Key", func(t *testing.T) {
+		durable := mock.NewMockStorage("duss.io", map[string]string{"short-key": "http://example.com/default"})
+		durable.Save(ctx, &domain.URL{Domain: "go.duss.io", ShortKey: "short-key", LongURL: "http://example.com/branded"})
+		counter := &MockCounter{}
+		redirectService := NewRedirectService(durable, WithCache(mock.NewMockStorage("", nil)), WithRedirectCounter(counter))
+
+		for shortDomain, want := range map[string]string{
+			"duss.io":    "http://example.com/default",
+			"GO.DUSS.IO": "http://example.com/branded",
+		} {
+			dest, err := redirectService.GetOriginalURL(ctx, shortDomain, "short-key")
+			if err != nil {
+				t.Fatalf("GetOriginalURL(%q): expected no error, but got %v", shortDomain, err)
+			}
+			if dest.URL != want {
+				t.Errorf("GetOriginalURL(%q): expected %s, but got %s", shortDomain, want, dest.URL)
+			}
+		}
+
+		if _, err := redirectService.GetOriginalURL(ctx, "other.example", "short-key"); !errors.Is(err, ErrURLNotFound) {
+			t.Errorf("expected ErrURLNotFound on an unknown domain, but got %v", err)
+		}
+		if len(counter.Counted) != 2 || !slices.Contains(counter.Counted, domain.LinkID("go.duss.io", "short-key")) {
+			t.Errorf("expected redirects to be counted per domain, but got %v", counter.Counted)
+		}
+	})
+
+	t.Run("Not Found - Neither Cache Nor Storage", func(t *testing.T) {
+		counter := &MockCounter{}
+		redirectService := NewRedirectService(mock.NewMockStorage("duss.io", nil), WithCache(mock.NewMockStorage("duss.io", nil)), WithRedirectCounter(counter))
+
+		_, err := redirectService.GetOriginalURL(ctx, "duss.io", "missing")
+		if !errors.Is(err, ErrURLNotFound) {
+			t.Errorf("expected ErrURLNotFound, but got %v", err)
+		}
+		if len(counter.Counted) != 0 {
+			t.Errorf("expected no redirects to be counted, but got %d", len(counter.Counted))
+		}
+	})
+}
+
+func TestGetOriginalURLWithPolicy(t *testing.T) {
+	ctx := context.Background()
+
+	durable := mock.NewMockStorage("duss.io", map[string]string{"legacy": "https://Evil.example/old"})
+	durable.Save(ctx, &domain.URL{Domain: "duss.io", ShortKey: "canonical", LongURL: "HTTPS://EVIL.EXAMPLE/", CanonicalURL: "https://evil.example/"})
+	durable.Save(ctx, &domain.URL{Domain: "duss.io", ShortKey: "fine", LongURL: "https://example.com/"})
+
+	engine, err := policy.New(policy.Rules{})
+	if err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	counter := &MockCounter{}
+	redirectService := NewRedirectService(durable, WithPolicy(engine), WithRedirectCounter(counter))
+
+	if _, err := redirectService.GetOriginalURL(ctx, "duss.io", "canonical"); err != nil {
+		t.Fatalf("expected no error before the ban, but got %v", err)
+	}
+
+	// Banning a domain after links to it were created stops them redirecting.
+	if err := engine.Update(policy.Rules{DenyDomains: []string{"evil.example"}}); err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+
+	testCases := []struct {
+		shortKey    string
+		expectedErr error
+	}{
+		{"canonical", ErrURLBlocked},
+		{"legacy", ErrURLBlocked},
+		{"fine", nil},
+	}
+	for _, tc := range testCases {
+		if _, err := redirectService.GetOriginalURL(ctx, "duss.io", tc.shortKey); !errors.Is(err, tc.expectedErr) {
+			t.Errorf("GetOriginalURL(%q): expected %v, but got %v", tc.shortKey, tc.expectedErr, err)
+		}
+	}
+	if len(counter.Counted) != 2 {
+		t.Errorf("expected blocked redirects not to be counted, but got %v", counter.Counted)
+	}
+}
+
+func TestGetOriginalURLDisabled(t *testing.T) {
+	ctx := context.Background()
+
+	durable := mock.NewMockStorage("duss.io", nil)
+	durable.Save(ctx, &domain.URL{Domain: "duss.io", ShortKey: "off", LongURL: "https://phish.example/", DisabledAt: time.Now(), DisabledReason: "threat feed"})
+	counter := &MockCounter{}
+	redirectService := NewRedirectService(durable, WithRedirectCounter(counter))
+
+	if _, err := redirectService.GetOriginalURL(ctx, "duss.io", "off"); !errors.Is(err, ErrURLBlocked) {
+		t.Errorf("expected ErrURLBlocked, but got %v", err)
+	}
+	if len(counter.Counted) != 0 {
+		t.Errorf("expected no redirects to be counted, but got %v", counter.Counted)
+	}
+}
+
+// CountingStorage counts the lookups that reach a MockStorage.
+type CountingStorage struct {
+	*mock.MockStorage
+	Gets int
+}
+
+func (c *CountingStorage) Get(ctx context.Context, shortDomain, shortKey string) (*domain.URL, error) {
+	c.Gets++
+	return c.MockStorage.Get(ctx, shortDomain, shortKey)
+}
+
+func TestGetOriginalURLSigned(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	keys, err := linksig.NewKeyring(
+		linksig.Key{ID: "k1", Secret: []byte("0123456789abcdef"), NotAfter: now.Add(time.Hour)},
+		linksig.Key{ID: "k2", Secret: []byte("fedcba9876543210"), NotBefore: now.Add(time.Hour)},
+	)
+	if err != nil {
+		t.Fatalf("could not create keyring: %v", err)
+	}
+	sign := func(shortKey string, expires time.Time) string {
+		token, err := keys.Sign("duss.io", shortKey, expires, now)
+		if err != nil {
+			t.Fatalf("could not sign %s: %v", shortKey, err)
+		}
+		return linksig.Join(shortKey, token)
+	}
+	valid := sign("signed", time.Time{})
+
+	testCases := []struct {
+		name          string
+		keys          *linksig.Keyring
+		segment       string
+		expectedErr   error
+		expectedGets  int
+		expectedCount bool
+	}{
+		{"Valid Signature", keys, valid, nil, 1, true},
+		{"Domain Case Ignored", keys, valid, nil, 1, true},
+		{"Unsigned Link Through Signed URL", keys, sign("open", time.Time{}), nil, 1, true},
+		{"Signed Link Without Signature", keys, "signed", ErrURLNotFound, 1, false},
+		{"Signing Disabled", nil, valid, ErrURLNotFound, 0, false},
+		{"Malformed", keys, "signed.k1", ErrURLNotFound, 0, false},
+		{"Unknown Key", keys, "signed.k9." + valid[len(valid)-16:], ErrURLNotFound, 0, false},
+		{"Forged MAC", keys, valid[:len(valid)-2] + "AA", ErrURLNotFound, 0, false},
+		{"Other Link's Signature", keys, "open" + valid[len("signed"):], ErrURLNotFound, 0, false},
+		{"Expired", keys, sign("signed", now.Add(-time.Second)), ErrLinkExpired, 0, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			durable := &CountingStorage{MockStorage: mock.NewMockStorage("duss.io", map[string]string{"open": "https://example.com/open"})}
+			durable.Save(ctx, &domain.URL{Domain: "duss.io", ShortKey: "signed", LongURL: "https://example.com/signed", Signed: true})
+			cache := &CountingStorage{MockStorage: mock.NewMockStorage("duss.io", nil)}
+			counter := &MockCounter{}
+			redirectService := NewRedirectService(durable, WithCache(cache), WithRedirectCounter(counter), WithLinkSigning(tc.keys))
+
+			shortDomain := "duss.io"
+			if tc.name == "Domain Case Ignored" {
+				shortDomain = "Duss.IO"
+			}
+			_, err := redirectService.GetOriginalURL(ctx, shortDomain, tc.segment)
+			if !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("expected error %v, but got %v", tc.expectedErr, err)
+			}
+			if gets := durable.Gets + cache.Gets; gets != tc.expectedGets*2 {
+				t.Errorf("expected %d cache and storage lookups, but got %d", tc.expectedGets*2, gets)
+			}
+			if counted := len(counter.Counted) == 1; counted != tc.expectedCount {
+				t.Errorf("expected counted=%v, but got %v", tc.expectedCount, counter.Counted)
+			}
+			if tc.expectedCount && !strings.HasSuffix(counter.Counted[0], "/signed") && !strings.HasSuffix(counter.Counted[0], "/open") {
+				t.Errorf("expected the redirect to be counted under the bare key, but got %v", counter.Counted)
+			}
+		})
+	}
+}
+
+func TestGetOriginalURLUntrusted(t *testing.T) {
+	ctx := context.Background()
+
+	durable := mock.NewMockStorage("duss.io", map[string]string{
+		"fine":     "https://example.com/",
+		"uploaded": "https://cdn.files.example/setup.zip",
+	})
+	durable.Save(ctx, &domain.URL{Domain: "duss.io", ShortKey: "flagged", LongURL: "https://example.com/flagged", Untrusted: true})
+
+	engine, err := policy.New(policy.Rules{UntrustedDomains: []string{"files.example"}})
+	if err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	counter := &MockCounter{}
+	redirectService := NewRedirectService(durable, WithPolicy(engine), WithRedirectCounter(counter))
+
+	testCases := []struct {
+		shortKey          string
+		expectedUntrusted bool
+	}{
+		{"fine", false},
+		{"flagged", true},
+		{"uploaded", true},
+	}
+	for _, tc := range testCases {
+		dest, err := redirectService.GetOriginalURL(ctx, "duss.io", tc.shortKey)
+		if err != nil {
+			t.Fatalf("GetOriginalURL(%q): expected no error, but got %v", tc.shortKey, err)
+		}
+		if dest.Untrusted != tc.expectedUntrusted {
+			t.Errorf("GetOriginalURL(%q): expected untrusted=%v, but got %v", tc.shortKey, tc.expectedUntrusted, dest.Untrusted)
+		}
+	}
+	if len(counter.Counted) != 1 {
+		t.Errorf("expected only the trusted redirect to be counted, but got %v", counter.Counted)
+	}
+
+	// Untrusted redirects count once the visitor confirms them.
+	dest, err := redirectService.ConfirmRedirect(ctx, "duss.io", "flagged")
+	if err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	if dest.URL != "https://example.com/flagged" || !dest.Untrusted {
+		t.Errorf("expected the untrusted destination, but got %+v", dest)
+	}
+	if len(counter.Counted) != 2 || counter.Counted[1] != domain.LinkID("duss.io", "flagged") {
+		t.Errorf("expected the confirmed redirect to be counted, but got %v", counter.Counted)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	ctx := context.Background()
+
+	durable := mock.NewMockStorage("duss.io", map[string]string{"fine": "https://example.com/"})
+	counter := &MockCounter{}
+	redirectService := NewRedirectService(durable, WithRedirectCounter(counter))
+
+	// Repeated lookups, as hedged or retried by a caller, are never counted.
+	for range 2 {
+		dest, err := redirectService.Lookup(ctx, "DUSS.io", "fine")
+		if err != nil {
+			t.Fatalf("expected no error, but got %v", err)
+		}
+		if dest.URL != "https://example.com/" {
+			t.Errorf("expected %q, but got %q", "https://example.com/", dest.URL)
+		}
+	}
+	if len(counter.Counted) != 0 {
+		t.Errorf("expected no redirects to be counted, but got %v", counter.Counted)
+	}
+
+	if _, err := redirectService.Lookup(ctx, "duss.io", "missing"); !errors.Is(err, ErrURLNotFound) {
+		t.Errorf("expected ErrURLNotFound, but got %v", err)
+	}
+
+	if _, err := redirectService.GetOriginalURL(ctx, "DUSS.io", "fine"); err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	if len(counter.Counted) != 1 || counter.Counted[0] != domain.LinkID("duss.io", "fine") {
+		t.Errorf("expected the redirect to be counted once, but got %v", counter.Counted)
+	}
+}
+
+// MockAttempts counts attempts in memory, ignoring the window.
+type MockAttempts struct {
+	Counts    map[string]int64
+	ReturnErr error
+}
+
+func (m *MockAttempts) CountAttempt(ctx context.Context, key string, window time.Duration) (int64, error) {
+	if m.ReturnErr != nil {
+		return 0, m.ReturnErr
+	}
+	m.Counts[key]++
+	return m.Counts[key], nil
+}
+
+func (m *MockAttempts) ResetAttempts(ctx context.Context, key string) error {
+	if m.ReturnErr != nil {
+		return m.ReturnErr
+	}
+	delete(m.Counts, key)
+	return nil
+}
+
+func TestUnlock(t *testing.T) {
+	ctx := context.Background()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("could not hash password: %v", err)
+	}
+	durable := mock.NewMockStorage("duss.io", map[string]string{"open": "https://example.com/"})
+	durable.Save(ctx, &domain.URL{Domain: "duss.io", ShortKey: "locked", LongURL: "https://docs.example/", PasswordHash: string(hash)})
+
+	attempts := &MockAttempts{Counts: map[string]int64{}}
+	counter := &MockCounter{}
+	redirectService := NewRedirectService(durable, WithRedirectCounter(counter), WithAttemptLimit(attempts, 3, time.Minute))
+
+	dest, err := redirectService.GetOriginalURL(ctx, "duss.io", "locked")
+	if err != nil || !dest.Protected {
+		t.Fatalf("expected a protected destination, but got %+v, %v", dest, err)
+	}
+	if len(counter.Counted) != 0 {
+		t.Errorf("expected the protected redirect not to be counted before unlocking, but got %v", counter.Counted)
+	}
+
+	if err := redirectService.Unlock(ctx, "duss.io", "open", "", "192.0.2.1"); err != nil {
+		t.Errorf("expected an unprotected link to need no password, but got %v", err)
+	}
+	if err := redirectService.Unlock(ctx, "duss.io", "missing", "hunter2", "192.0.2.1"); !errors.Is(err, ErrURLNotFound) {
+		t.Errorf("expected ErrURLNotFound, but got %v", err)
+	}
+	for range 2 {
+		if err := redirectService.Unlock(ctx, "duss.io", "locked", "guess", "192.0.2.1"); !errors.Is(err, ErrWrongPassword) {
+			t.Errorf("expected ErrWrongPassword, but got %v", err)
+		}
+	}
+	if err := redirectService.Unlock(ctx, "Duss.io", "locked", "hunter2", "192.0.2.1"); err != nil {
+		t.Errorf("expected the right password to unlock, but got %v", err)
+	}
+	// The right password forgets the wrong ones before it, so visitors who
+	// come back are not locked out by their own successes.
+	if n, ok := attempts.Counts["unlock:duss.io/locked:192.0.2.1"]; ok {
+		t.Errorf("expected the attempts to be reset after unlocking, but got %d", n)
+	}
+	for range 3 {
+		if err := redirectService.Unlock(ctx, "duss.io", "locked", "guess", "192.0.2.1"); !errors.Is(err, ErrWrongPassword) {
+			t.Errorf("expected ErrWrongPassword, but got %v", err)
+		}
+	}
+
+	// The fourth attempt after three wrong ones from the same address is
+	// refused, even with the right password, while other addresses may
+	// still try.
+	if err := redirectService.Unlock(ctx, "duss.io", "locked", "hunter2", "192.0.2.1"); !errors.Is(err, ErrTooManyAttempts) {
+		t.Errorf("expected ErrTooManyAttempts, but got %v", err)
+	}
+	if err := redirectService.Unlock(ctx, "duss.io", "locked", "hunter2", "192.0.2.2"); err != nil {
+		t.Errorf("expected another address to be unaffected, but got %v", err)
+	}
+	if n := attempts.Counts["unlock:duss.io/locked:192.0.2.1"]; n != 4 {
+		t.Errorf("expected 4 attempts counted for the link and address, but got %d", n)
+	}
+
+	attempts.ReturnErr = errors.New("connection refused")
+	if err := redirectService.Unlock(ctx, "duss.io", "locked", "hunter2", "192.0.2.3"); err == nil {
+		t.Error("expected attempts to be refused when they cannot be counted")
+	}
+
+	if _, err := redirectService.ConfirmRedirect(ctx, "duss.io", "locked"); err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	if len(counter.Counted) != 1 {
+		t.Errorf("expected the unlocked redirect to be counted, but got %v", counter.Counted)
+	}
+}
@@ -3,38 +3,91 @@ package mock
 import (
 	"context"
 	"errors"
+	"sync"
+	"time"
+
+	"github.com/iton0/duss/shared/domain"
+	sharedstorage "github.com/iton0/duss/shared/storage"
+	"github.com/iton0/duss/url-redirect-service/internal/infrastructure/storage"
 )
 
-// ErrNotFound is a sentinel error for when a key is not found,
-// matching the expected error from a real storage implementation.
-var ErrNotFound = errors.New("key not found")
+// Ensure MockStorage fulfils both the service and the shared storage contracts.
+var (
+	_ storage.Storage     = (*MockStorage)(nil)
+	_ sharedstorage.Store = (*MockStorage)(nil)
+)
 
 // MockStorage is a mock implementation of the Storage interface.
 type MockStorage struct {
-	data          map[string]string
+	mu            sync.RWMutex
+	data          map[string]*domain.URL
 	simulateError bool
 }
 
-// NewMockStorage creates a new MockStorage instance.
-func NewMockStorage(initialData map[string]string) *MockStorage {
-	if initialData == nil {
-		initialData = make(map[string]string)
+// NewMockStorage creates a new MockStorage instance seeded with
+// initialData, a map of short keys to long URLs on shortDomain.
+func NewMockStorage(shortDomain string, initialData map[string]string) *MockStorage {
+	data := make(map[string]*domain.URL, len(initialData))
+	for shortKey, longURL := range initialData {
+		url := &domain.URL{Domain: shortDomain, ShortKey: shortKey, LongURL: longURL, CreatedAt: time.Now()}
+		data[url.ID()] = url
 	}
 	return &MockStorage{
-		data: initialData,
+		data: data,
+	}
+}
+
+// Save simulates storing a URL in the "database".
+func (m *MockStorage) Save(ctx context.Context, url *domain.URL) error {
+	if m.simulateError {
+		return errors.New("mock storage connection error")
 	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.data[url.ID()]; ok {
+		return storage.ErrDuplicatedKey
+	}
+
+	saved := *url
+	m.data[url.ID()] = &saved
+	return nil
 }
 
 // Get simulates retrieving a value from the "database".
-func (m *MockStorage) Get(ctx context.Context, shortKey string) (string, error) {
+func (m *MockStorage) Get(ctx context.Context, shortDomain, shortKey string) (*domain.URL, error) {
 	if m.simulateError {
-		return "", errors.New("mock storage connection error")
+		return nil, errors.New("mock storage connection error")
 	}
 
-	longURL, ok := m.data[shortKey]
-	if !ok {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	url, ok := m.data[domain.LinkID(shortDomain, shortKey)]
+	if !ok || url.IsExpired(time.Now()) {
 		// Return the specific error your service expects.
-		return "", ErrNotFound
+		return nil, storage.ErrNotFound
+	}
+
+	found := *url
+	return &found, nil
+}
+
+// Delete simulates removing a value from the "database".
+func (m *MockStorage) Delete(ctx context.Context, shortDomain, shortKey string) error {
+	if m.simulateError {
+		return errors.New("mock storage connection error")
 	}
-	return longURL, nil
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id := domain.LinkID(shortDomain, shortKey)
+	if _, ok := m.data[id]; !ok {
+		return storage.ErrNotFound
+	}
+
+	delete(m.data, id)
+	return nil
 }
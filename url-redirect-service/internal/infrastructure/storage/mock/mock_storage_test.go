@@ -0,0 +1,15 @@
+package mock_test
+
+import (
+	"testing"
+
+	sharedstorage "github.com/iton0/duss/shared/storage"
+	"github.com/iton0/duss/shared/storage/storagetest"
+	"github.com/iton0/duss/url-redirect-service/internal/infrastructure/storage/mock"
+)
+
+func TestMockStorageConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) sharedstorage.Store {
+		return mock.NewMockStorage("", nil)
+	})
+}
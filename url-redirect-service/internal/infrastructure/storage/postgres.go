@@ -1 +1,107 @@
 package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/multitracer"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/iton0/duss/shared/domain"
+	"github.com/iton0/duss/shared/metrics"
+	"github.com/iton0/duss/shared/tracing"
+)
+
+// Ensure PostgresClient implicitly implements Storage and RedirectCounter.
+var (
+	_ Storage         = (*PostgresClient)(nil)
+	_ RedirectCounter = (*PostgresClient)(nil)
+)
+
+// DB is the subset of *pgxpool.Pool used by PostgresClient. It allows tests to
+// substitute a hermetic database for a real server.
+type DB interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+	Ping(ctx context.Context) error
+	Close()
+}
+
+// PostgresClient reads URLs from the PostgreSQL database owned by the
+// url-shortener-service. It is the source of truth behind the Redis cache.
+type PostgresClient struct {
+	pool DB
+}
+
+// NewPostgresPool connects to the database at dsn and verifies the connection.
+func NewPostgresPool(ctx context.Context, dsn string) (*pgxpool.Pool, error) {
+	config, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse DSN: %w", err)
+	}
+	config.ConnConfig.Tracer = multitracer.New(tracing.QueryTracer{}, metrics.QueryTracer{})
+
+	pool, err := pgxpool.NewWithConfig(ctx, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create connection pool: %w", err)
+	}
+
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("failed to ping database: %w", err)
+	}
+
+	return pool, nil
+}
+
+// NewPostgresClientFromDB creates a PostgresClient on top of an existing DB.
+func NewPostgresClientFromDB(db DB) *PostgresClient {
+	return &PostgresClient{pool: db}
+}
+
+// Get retrieves the URL stored under shortKey on shortDomain.
+// It returns ErrNotFound if the key does not exist or has expired.
+func (p *PostgresClient) Get(ctx context.Context, shortDomain, shortKey string) (*domain.URL, error) {
+	query := `
+		SELECT domain, short_key, long_url, canonical_url, created_at, expires_at, redirects, disabled_at, disabled_reason, untrusted, password_hash, signed
+		FROM urls
+		WHERE domain = $1 AND short_key = $2
+	`
+	var (
+		url        domain.URL
+		expiresAt  *time.Time
+		disabledAt *time.Time
+	)
+	err := p.pool.QueryRow(ctx, query, shortDomain, shortKey).Scan(&url.Domain, &url.ShortKey, &url.LongURL, &url.CanonicalURL, &url.CreatedAt, &expiresAt, &url.Redirects, &disabledAt, &url.DisabledReason, &url.Untrusted, &url.PasswordHash, &url.Signed)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get URL: %w", err)
+	}
+
+	if expiresAt != nil {
+		url.ExpiresAt = *expiresAt
+	}
+	if disabledAt != nil {
+		url.DisabledAt = *disabledAt
+	}
+	if url.IsExpired(time.Now()) {
+		return nil, ErrNotFound
+	}
+
+	return &url, nil
+}
+
+// IncrementRedirects increments the redirects count for a given short key.
+func (p *PostgresClient) IncrementRedirects(ctx context.Context, shortDomain, shortKey string) error {
+	query := `UPDATE urls SET redirects = redirects + 1 WHERE domain = $1 AND short_key = $2`
+	_, err := p.pool.Exec(ctx, query, shortDomain, shortKey)
+	if err != nil {
+		return fmt.Errorf("failed to increment redirects: %w", err)
+	}
+	return nil
+}
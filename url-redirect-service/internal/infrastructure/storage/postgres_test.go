@@ -1 +1,150 @@
 package storage_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/iton0/duss/shared/testutil/pgtest"
+	"github.com/iton0/duss/url-redirect-service/internal/infrastructure/storage"
+)
+
+// schema mirrors the urls table owned by the url-shortener-service.
+const schema = `
+CREATE TABLE IF NOT EXISTS urls (
+    domain          TEXT        NOT NULL,
+    short_key       TEXT        NOT NULL,
+    long_url        TEXT        NOT NULL,
+    canonical_url   TEXT        NOT NULL DEFAULT '',
+    created_at      TIMESTAMPTZ NOT NULL,
+    expires_at      TIMESTAMPTZ,
+    redirects       INTEGER     NOT NULL DEFAULT 0,
+    disabled_at     TIMESTAMPTZ,
+    disabled_reason TEXT        NOT NULL DEFAULT '',
+    untrusted       BOOLEAN     NOT NULL DEFAULT FALSE,
+    password_hash   TEXT        NOT NULL DEFAULT '',
+    signed          BOOLEAN     NOT NULL DEFAULT FALSE,
+    PRIMARY KEY (domain, short_key)
+);
+`
+
+func setupPostgres(t *testing.T) (*storage.PostgresClient, pgtest.DB) {
+	t.Helper()
+
+	db := pgtest.New(t, schema)
+	return storage.NewPostgresClientFromDB(db), db
+}
+
+func insertURL(t *testing.T, db pgtest.DB, shortDomain, shortKey, longURL string, expiresAt *time.Time) {
+	t.Helper()
+
+	_, err := db.Exec(context.Background(),
+		`INSERT INTO urls (domain, short_key, long_url, created_at, expires_at, redirects) VALUES ($1, $2, $3, $4, $5, 0)`,
+		shortDomain, shortKey, longURL, time.Now(), expiresAt)
+	if err != nil {
+		t.Fatalf("could not insert URL for test: %v", err)
+	}
+}
+
+func TestPostgresGet(t *testing.T) {
+	client, db := setupPostgres(t)
+	ctx := context.Background()
+	testDomain := pgtest.Unique("duss.test")
+
+	past := time.Now().Add(-time.Minute)
+	insertURL(t, db, testDomain, "live", "https://example.com/live", nil)
+	insertURL(t, db, testDomain, "stale", "https://example.com/stale", &past)
+
+	t.Run("Success - Key Exists", func(t *testing.T) {
+		url, err := client.Get(ctx, testDomain, "live")
+		if err != nil {
+			t.Fatalf("expected no error, but got: %v", err)
+		}
+		if url.LongURL != "https://example.com/live" {
+			t.Fatalf("expected URL https://example.com/live, but got %s", url.LongURL)
+		}
+		if url.Untrusted {
+			t.Error("expected the URL to be trusted")
+		}
+	})
+
+	t.Run("Success - Untrusted", func(t *testing.T) {
+		if _, err := db.Exec(ctx, `UPDATE urls SET untrusted = TRUE WHERE domain = $1 AND short_key = $2`, testDomain, "live"); err != nil {
+			t.Fatalf("could not flag URL for test: %v", err)
+		}
+		url, err := client.Get(ctx, testDomain, "live")
+		if err != nil {
+			t.Fatalf("expected no error, but got: %v", err)
+		}
+		if !url.Untrusted {
+			t.Error("expected the URL to be untrusted")
+		}
+	})
+
+	t.Run("Success - Protected", func(t *testing.T) {
+		if _, err := db.Exec(ctx, `UPDATE urls SET password_hash = $1 WHERE domain = $2 AND short_key = $3`, "$2a$10$hash", testDomain, "live"); err != nil {
+			t.Fatalf("could not protect URL for test: %v", err)
+		}
+		url, err := client.Get(ctx, testDomain, "live")
+		if err != nil {
+			t.Fatalf("expected no error, but got: %v", err)
+		}
+		if url.PasswordHash != "$2a$10$hash" {
+			t.Errorf("expected the password hash to be read, but got %q", url.PasswordHash)
+		}
+	})
+
+	t.Run("Success - Signed", func(t *testing.T) {
+		if _, err := db.Exec(ctx, `UPDATE urls SET signed = TRUE WHERE domain = $1 AND short_key = $2`, testDomain, "live"); err != nil {
+			t.Fatalf("could not sign URL for test: %v", err)
+		}
+		url, err := client.Get(ctx, testDomain, "live")
+		if err != nil {
+			t.Fatalf("expected no error, but got: %v", err)
+		}
+		if !url.Signed {
+			t.Error("expected the URL to be signed")
+		}
+	})
+
+	t.Run("Not Found - Other Domain", func(t *testing.T) {
+		if _, err := client.Get(ctx, "other.test", "live"); !errors.Is(err, storage.ErrNotFound) {
+			t.Fatalf("expected ErrNotFound, but got: %v", err)
+		}
+	})
+
+	t.Run("Not Found - Key Does Not Exist", func(t *testing.T) {
+		if _, err := client.Get(ctx, testDomain, "missing"); !errors.Is(err, storage.ErrNotFound) {
+			t.Fatalf("expected ErrNotFound, but got: %v", err)
+		}
+	})
+
+	t.Run("Not Found - Key Expired", func(t *testing.T) {
+		if _, err := client.Get(ctx, testDomain, "stale"); !errors.Is(err, storage.ErrNotFound) {
+			t.Fatalf("expected ErrNotFound, but got: %v", err)
+		}
+	})
+}
+
+func TestPostgresIncrementRedirects(t *testing.T) {
+	client, db := setupPostgres(t)
+	ctx := context.Background()
+	testDomain := pgtest.Unique("duss.test")
+
+	insertURL(t, db, testDomain, "counted", "https://example.com", nil)
+
+	for range 2 {
+		if err := client.IncrementRedirects(ctx, testDomain, "counted"); err != nil {
+			t.Fatalf("expected no error, but got: %v", err)
+		}
+	}
+
+	url, err := client.Get(ctx, testDomain, "counted")
+	if err != nil {
+		t.Fatalf("expected no error, but got: %v", err)
+	}
+	if url.Redirects != 2 {
+		t.Errorf("expected 2 redirects, but got %d", url.Redirects)
+	}
+}
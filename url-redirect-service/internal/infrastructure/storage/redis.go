@@ -2,20 +2,30 @@ package storage
 
 import (
 	"context"
-	"errors"
+	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/redis/go-redis/v9"
-)
 
-// ErrNotFound is returned when the key is not found in Redis.
-var ErrNotFound = errors.New("short key not found")
+	"github.com/iton0/duss/shared/domain"
+	"github.com/iton0/duss/shared/metrics"
+	sharedstorage "github.com/iton0/duss/shared/storage"
+	"github.com/iton0/duss/shared/tracing"
+)
 
-// Ensure RedisClient implicitly implements Storage.
+// Ensure RedisClient implicitly implements Cache and AttemptCounter.
 // This is a compile-time check to ensure the contract is fulfilled.
-var _ Storage = (*RedisClient)(nil)
+var (
+	_ Cache          = (*RedisClient)(nil)
+	_ AttemptCounter = (*RedisClient)(nil)
+)
+
+// Ensure RedisClient fulfils the shared storage contract.
+var _ sharedstorage.Store = (*RedisClient)(nil)
 
 // RedisClient is a concrete implementation of the Storage interface using Redis.
+// URLs are stored as JSON documents keyed by domain.LinkID.
 type RedisClient struct {
 	client *redis.Client
 }
@@ -28,6 +38,8 @@ func NewRedisClient(ctx context.Context, addr string, password string, db int) (
 		Password: password,
 		DB:       db,
 	})
+	rdb.AddHook(tracing.RedisHook{})
+	rdb.AddHook(metrics.RedisHook{})
 
 	// Use Ping to verify the connection. This is a crucial step.
 	// We use the provided context to ensure the ping doesn't hang indefinitely.
@@ -38,13 +50,92 @@ func NewRedisClient(ctx context.Context, addr string, password string, db int) (
 	return &RedisClient{client: rdb}, nil
 }
 
-// Get retrieves the long URL from Redis.
-func (r *RedisClient) Get(ctx context.Context, shortKey string) (string, error) {
-	longURL, err := r.client.Get(ctx, shortKey).Result()
+// Save stores the URL under its short key, returning ErrDuplicatedKey if the key is taken.
+// URLs with an expiry are given a matching Redis TTL.
+func (r *RedisClient) Save(ctx context.Context, url *domain.URL) error {
+	value, err := json.Marshal(url)
+	if err != nil {
+		return fmt.Errorf("failed to encode URL: %w", err)
+	}
+
+	var ttl time.Duration
+	if !url.ExpiresAt.IsZero() {
+		// Redis rejects non-positive TTLs, so an already expired URL gets the
+		// shortest one possible; Get filters it out either way.
+		ttl = max(time.Until(url.ExpiresAt), time.Millisecond)
+	}
+
+	ok, err := r.client.SetNX(ctx, url.ID(), value, ttl).Result()
+	if err != nil {
+		return fmt.Errorf("failed to set key in Redis: %w", err)
+	}
+	if !ok {
+		return ErrDuplicatedKey
+	}
+	return nil
+}
+
+// Get retrieves the URL stored under shortKey on shortDomain from Redis.
+func (r *RedisClient) Get(ctx context.Context, shortDomain, shortKey string) (*domain.URL, error) {
+	value, err := r.client.Get(ctx, domain.LinkID(shortDomain, shortKey)).Bytes()
 	if err == redis.Nil {
-		return "", ErrNotFound
+		return nil, ErrNotFound
 	} else if err != nil {
-		return "", fmt.Errorf("failed to get key from Redis: %w", err)
+		return nil, fmt.Errorf("failed to get key from Redis: %w", err)
+	}
+
+	var url domain.URL
+	if err := json.Unmarshal(value, &url); err != nil {
+		return nil, fmt.Errorf("failed to decode URL from Redis: %w", err)
+	}
+	if url.IsExpired(time.Now()) {
+		return nil, ErrNotFound
 	}
-	return longURL, nil
+	return &url, nil
+}
+
+// Delete removes the URL stored under shortKey on shortDomain from Redis.
+func (r *RedisClient) Delete(ctx context.Context, shortDomain, shortKey string) error {
+	n, err := r.client.Del(ctx, domain.LinkID(shortDomain, shortKey)).Result()
+	if err != nil {
+		return fmt.Errorf("failed to delete key from Redis: %w", err)
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// CountAttempt increments the counter under "attempts:" plus key. The first
+// attempt starts the window, after which the counter expires.
+func (r *RedisClient) CountAttempt(ctx context.Context, key string, window time.Duration) (int64, error) {
+	key = "attempts:" + key
+	var incr *redis.IntCmd
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		incr = pipe.Incr(ctx, key)
+		pipe.ExpireNX(ctx, key, window)
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to count attempt in Redis: %w", err)
+	}
+	return incr.Val(), nil
+}
+
+// ResetAttempts deletes the counter CountAttempt keeps under key.
+func (r *RedisClient) ResetAttempts(ctx context.Context, key string) error {
+	if err := r.client.Del(ctx, "attempts:"+key).Err(); err != nil {
+		return fmt.Errorf("failed to reset attempts in Redis: %w", err)
+	}
+	return nil
+}
+
+// Ping checks that Redis is reachable.
+func (r *RedisClient) Ping(ctx context.Context) error {
+	return r.client.Ping(ctx).Err()
+}
+
+// Close closes the underlying Redis connection pool.
+func (r *RedisClient) Close() error {
+	return r.client.Close()
 }
@@ -3,39 +3,26 @@ package storage_test
 import (
 	"context"
 	"errors"
-	"os"
 	"testing"
 	"time"
 
+	"github.com/iton0/duss/shared/domain"
+	sharedstorage "github.com/iton0/duss/shared/storage"
+	"github.com/iton0/duss/shared/storage/storagetest"
+	"github.com/iton0/duss/shared/testutil/redistest"
 	"github.com/iton0/duss/url-redirect-service/internal/infrastructure/storage"
 	"github.com/redis/go-redis/v9"
 )
 
-const redisAddr = "localhost:6379"
-
-func TestMain(m *testing.M) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	rdb := redis.NewClient(&redis.Options{Addr: redisAddr})
-	defer rdb.Close()
-
-	if err := rdb.Ping(ctx).Err(); err != nil {
-		os.Stderr.WriteString("Skipping Redis integration tests: could not connect to Redis at " + redisAddr + "\n")
-		os.Exit(0)
-	}
-
-	code := m.Run()
-	os.Exit(code)
-}
-
 func setupTest(t *testing.T) *storage.RedisClient {
 	ctx := context.Background()
+	redisAddr := redistest.Addr(t)
 
 	client, err := storage.NewRedisClient(ctx, redisAddr, "", 0)
 	if err != nil {
 		t.Fatalf("setup failed: could not create Redis client: %v", err)
 	}
+	t.Cleanup(func() { client.Close() })
 
 	rdb := redis.NewClient(&redis.Options{Addr: redisAddr})
 	defer rdb.Close()
@@ -52,7 +39,7 @@ func TestNewRedisClient(t *testing.T) {
 		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 		defer cancel()
 
-		client, err := storage.NewRedisClient(ctx, redisAddr, "", 0)
+		client, err := storage.NewRedisClient(ctx, redistest.Addr(t), "", 0)
 		if err != nil {
 			t.Fatalf("expected no error, but got: %v", err)
 		}
@@ -84,20 +71,17 @@ func TestGet(t *testing.T) {
 		shortKey := "test_key"
 		longURL := "http://example.com/test_url"
 
-		rdb := redis.NewClient(&redis.Options{Addr: redisAddr})
-		defer rdb.Close()
-
-		err := rdb.Set(ctx, shortKey, longURL, 0).Err()
+		err := client.Save(ctx, &domain.URL{Domain: "duss.test", ShortKey: shortKey, LongURL: longURL, CreatedAt: time.Now()})
 		if err != nil {
 			t.Fatalf("could not set key for test: %v", err)
 		}
 
-		retrievedURL, err := client.Get(ctx, shortKey)
+		retrievedURL, err := client.Get(ctx, "duss.test", shortKey)
 		if err != nil {
 			t.Fatalf("expected no error, but got: %v", err)
 		}
-		if retrievedURL != longURL {
-			t.Fatalf("expected URL %s, but got %s", longURL, retrievedURL)
+		if retrievedURL.LongURL != longURL {
+			t.Fatalf("expected URL %s, but got %s", longURL, retrievedURL.LongURL)
 		}
 	})
 
@@ -105,12 +89,54 @@ func TestGet(t *testing.T) {
 		ctx := context.Background()
 		shortKey := "non_existent_key"
 
-		retrievedURL, err := client.Get(ctx, shortKey)
+		retrievedURL, err := client.Get(ctx, "duss.test", shortKey)
 		if !errors.Is(err, storage.ErrNotFound) {
 			t.Fatalf("expected ErrNotFound, but got: %v", err)
 		}
-		if retrievedURL != "" {
-			t.Fatalf("expected empty URL, but got: %s", retrievedURL)
+		if retrievedURL != nil {
+			t.Fatalf("expected nil URL, but got: %+v", retrievedURL)
 		}
 	})
 }
+
+func TestRedisConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) sharedstorage.Store {
+		return setupTest(t)
+	})
+}
+
+func TestCountAttempt(t *testing.T) {
+	ctx := context.Background()
+	server := redistest.New(t)
+	client, err := storage.NewRedisClient(ctx, server.Addr(), "", 0)
+	if err != nil {
+		t.Fatalf("setup failed: could not create Redis client: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	for want := int64(1); want <= 3; want++ {
+		n, err := client.CountAttempt(ctx, "unlock:duss.test/abc:192.0.2.1", time.Minute)
+		if err != nil {
+			t.Fatalf("expected no error, but got: %v", err)
+		}
+		if n != want {
+			t.Errorf("expected attempt %d, but got %d", want, n)
+		}
+	}
+	if n, _ := client.CountAttempt(ctx, "unlock:duss.test/abc:192.0.2.2", time.Minute); n != 1 {
+		t.Errorf("expected another client to be counted separately, but got %d", n)
+	}
+
+	if err := client.ResetAttempts(ctx, "unlock:duss.test/abc:192.0.2.2"); err != nil {
+		t.Fatalf("expected no error, but got: %v", err)
+	}
+	if n, _ := client.CountAttempt(ctx, "unlock:duss.test/abc:192.0.2.2", time.Minute); n != 1 {
+		t.Errorf("expected the count to restart after a reset, but got %d", n)
+	}
+
+	// Later attempts do not extend the window the first one started.
+	server.FastForward(time.Minute)
+	if n, _ := client.CountAttempt(ctx, "unlock:duss.test/abc:192.0.2.1", time.Minute); n != 1 {
+		t.Errorf("expected the count to restart after the window, but got %d", n)
+	}
+}
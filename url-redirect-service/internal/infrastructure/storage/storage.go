@@ -1,7 +1,42 @@
 package storage
 
-import "context"
+import (
+	"context"
+	"time"
+
+	"github.com/iton0/duss/shared/domain"
+	sharedstorage "github.com/iton0/duss/shared/storage"
+)
+
+var (
+	// ErrNotFound is returned when a short key does not exist or has expired.
+	ErrNotFound = sharedstorage.ErrNotFound
+	// ErrDuplicatedKey is returned when a short key is already stored.
+	ErrDuplicatedKey = sharedstorage.ErrDuplicatedKey
+)
 
 type Storage interface {
-	Get(ctx context.Context, shortKey string) (string, error)
+	Get(ctx context.Context, shortDomain, shortKey string) (*domain.URL, error)
+}
+
+// Cache is a Storage that can also be populated, such as Redis in front of
+// PostgreSQL.
+type Cache interface {
+	Storage
+	Save(ctx context.Context, url *domain.URL) error
+}
+
+// RedirectCounter records that a short key has been followed.
+type RedirectCounter interface {
+	IncrementRedirects(ctx context.Context, shortDomain, shortKey string) error
+}
+
+// AttemptCounter counts attempts at something that must not be tried too
+// often, such as entering a link's password.
+type AttemptCounter interface {
+	// CountAttempt records an attempt under key and returns how many have
+	// been made since the first one, within window, started the count.
+	CountAttempt(ctx context.Context, key string, window time.Duration) (int64, error)
+	// ResetAttempts forgets the attempts recorded under key.
+	ResetAttempts(ctx context.Context, key string) error
 }
@@ -1,17 +1,57 @@
 package web
 
 import (
+	"net/http"
+
 	"github.com/gin-gonic/gin"
+
+	"github.com/iton0/duss/shared/health"
+	"github.com/iton0/duss/shared/logging"
+	"github.com/iton0/duss/shared/metrics"
+	"github.com/iton0/duss/shared/openapi"
+	"github.com/iton0/duss/shared/problem"
+	"github.com/iton0/duss/shared/tracing"
 	"github.com/iton0/duss/url-redirect-service/internal/api"
+	"github.com/iton0/duss/url-redirect-service/internal/spec"
 )
 
 // NewRouter creates a new Gin router and registers all routes.
 func NewRouter(redirectHandler *api.RedirectHandler) *gin.Engine {
-	// gin.Default() provides middleware for logging and recovery from panics
-	router := gin.Default()
+	router := gin.New()
+	// Redirects are the hot path, so only a sample of them is logged
+	router.Use(logging.Middleware(logging.SampleRoutes("/:shortKey", "/api/v1/redirect")), problem.Recovery())
+	// Requests are counted and timed per route template, not per short key
+	router.Use(tracing.Middleware(), metrics.Middleware())
+	// Requests must match the API description; responses that do not are
+	// logged.
+	router.Use(spec.Load().Middleware(openapi.WithResponseValidation()))
+	router.NoRoute(problem.NoRoute)
 
 	// Register the GET /:shortKey endpoint to the appropriate handler
 	router.GET("/:shortKey", redirectHandler.HandleRedirect)
+	// The password form of protected links is submitted to the link itself
+	router.POST("/:shortKey", redirectHandler.HandleUnlock)
+
+	// Internal endpoints used by the API gateway's redirect client, which
+	// looks links up and then counts the redirects it issues
+	router.GET("/api/v1/redirect", redirectHandler.HandleLookup)
+	router.POST("/api/v1/redirect", redirectHandler.HandleCountRedirect)
+
+	// Prometheus metrics
+	router.GET("/metrics", gin.WrapH(metrics.Handler()))
 
 	return router
 }
+
+// RegisterAdmin registers the admin API for the URL policy on router.
+func RegisterAdmin(router *gin.Engine, policyHandler http.Handler) {
+	router.GET("/api/v1/admin/policy", gin.WrapH(policyHandler))
+	router.PUT("/api/v1/admin/policy", gin.WrapH(policyHandler))
+}
+
+// RegisterHealth registers the liveness and readiness endpoints served by
+// checker on router.
+func RegisterHealth(router *gin.Engine, checker *health.Checker) {
+	router.GET("/healthz", gin.WrapH(checker.LiveHandler()))
+	router.GET("/readyz", gin.WrapH(checker.ReadyHandler()))
+}
@@ -5,16 +5,39 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/iton0/duss/shared/domain"
+	"github.com/iton0/duss/shared/health"
+	"github.com/iton0/duss/shared/policy"
+	"github.com/iton0/duss/shared/testutil/openapitest"
+	"github.com/iton0/duss/shared/testutil/redistest"
 	"github.com/iton0/duss/url-redirect-service/internal/api"
+	"github.com/iton0/duss/url-redirect-service/internal/core/services"
+	"github.com/iton0/duss/url-redirect-service/internal/infrastructure/storage"
 	"github.com/iton0/duss/url-redirect-service/internal/infrastructure/web"
+	"github.com/iton0/duss/url-redirect-service/internal/spec"
 )
 
 type MockRedirectService struct{}
 
-func (m *MockRedirectService) GetOriginalURL(ctx context.Context, shortKey string) (string, error) {
-	return "", nil
+func (m *MockRedirectService) GetOriginalURL(ctx context.Context, shortDomain, shortKey string) (services.Destination, error) {
+	return services.Destination{}, nil
+}
+
+func (m *MockRedirectService) Lookup(ctx context.Context, shortDomain, shortKey string) (services.Destination, error) {
+	return services.Destination{}, nil
+}
+
+func (m *MockRedirectService) ConfirmRedirect(ctx context.Context, shortDomain, shortKey string) (services.Destination, error) {
+	return services.Destination{}, nil
+}
+
+func (m *MockRedirectService) Unlock(ctx context.Context, shortDomain, shortKey, password, clientIP string) error {
+	return nil
 }
 
 func TestRouter(t *testing.T) {
@@ -24,6 +47,7 @@ func TestRouter(t *testing.T) {
 	redirectHandler := api.NewRedirectHandler(mockService)
 
 	router := web.NewRouter(redirectHandler)
+	web.RegisterHealth(router, health.New("url-redirect-service"))
 
 	testCases := []struct {
 		name               string
@@ -35,12 +59,18 @@ func TestRouter(t *testing.T) {
 			name:               "Valid GET Request",
 			method:             http.MethodGet,
 			path:               "/abc1234",
-			expectedStatusCode: http.StatusMovedPermanently,
+			expectedStatusCode: http.StatusFound,
 		},
 		{
-			name:               "POST on GET Endpoint",
+			name:               "Valid POST Request",
 			method:             http.MethodPost,
 			path:               "/abc1234",
+			expectedStatusCode: http.StatusSeeOther,
+		},
+		{
+			name:               "PUT on GET Endpoint",
+			method:             http.MethodPut,
+			path:               "/abc1234",
 			expectedStatusCode: http.StatusNotFound, // Corrected from 405
 		},
 		{
@@ -49,6 +79,36 @@ func TestRouter(t *testing.T) {
 			path:               "/invalid/path",
 			expectedStatusCode: http.StatusNotFound,
 		},
+		{
+			name:               "Lookup",
+			method:             http.MethodGet,
+			path:               "/api/v1/redirect?key=abc1234",
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:               "Count Redirect",
+			method:             http.MethodPost,
+			path:               "/api/v1/redirect?key=abc1234",
+			expectedStatusCode: http.StatusNoContent,
+		},
+		{
+			name:               "Liveness",
+			method:             http.MethodGet,
+			path:               "/healthz",
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:               "Readiness",
+			method:             http.MethodGet,
+			path:               "/readyz",
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:               "Metrics",
+			method:             http.MethodGet,
+			path:               "/metrics",
+			expectedStatusCode: http.StatusOK,
+		},
 	}
 
 	for _, tc := range testCases {
@@ -61,6 +121,113 @@ func TestRouter(t *testing.T) {
 			if w.Code != tc.expectedStatusCode {
 				t.Errorf("for path %s, expected status code %d, but got %d", tc.path, tc.expectedStatusCode, w.Code)
 			}
+			openapitest.CheckResponse(t, spec.Load(), req, w)
+		})
+	}
+}
+
+func TestRouterWithRedis(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+
+	redisClient, err := storage.NewRedisClient(ctx, redistest.Addr(t), "", 0)
+	if err != nil {
+		t.Fatalf("setup failed: could not create Redis client: %v", err)
+	}
+	defer redisClient.Close()
+
+	err = redisClient.Save(ctx, &domain.URL{Domain: "duss.io", ShortKey: "abc1234", LongURL: "https://example.com/long/url", CreatedAt: time.Now()})
+	if err != nil {
+		t.Fatalf("setup failed: could not save URL: %v", err)
+	}
+	err = redisClient.Save(ctx, &domain.URL{Domain: "duss.io", ShortKey: "flagged", LongURL: "https://example.com/flagged", CreatedAt: time.Now(), Untrusted: true})
+	if err != nil {
+		t.Fatalf("setup failed: could not save URL: %v", err)
+	}
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	err = redisClient.Save(ctx, &domain.URL{Domain: "duss.io", ShortKey: "locked", LongURL: "https://example.com/locked", CreatedAt: time.Now(), PasswordHash: string(hash)})
+	if err != nil {
+		t.Fatalf("setup failed: could not save URL: %v", err)
+	}
+
+	redirectService := services.NewRedirectService(redisClient, services.WithAttemptLimit(redisClient, 5, time.Minute))
+	router := web.NewRouter(api.NewRedirectHandler(redirectService))
+
+	testCases := []struct {
+		name               string
+		host               string
+		path               string
+		expectedStatusCode int
+		expectedLocation   string
+	}{
+		{
+			name:               "Known Key",
+			host:               "duss.io",
+			path:               "/abc1234",
+			expectedStatusCode: http.StatusFound,
+			expectedLocation:   "https://example.com/long/url",
+		},
+		{
+			name:               "Known Key On Other Domain",
+			host:               "go.duss.io",
+			path:               "/abc1234",
+			expectedStatusCode: http.StatusNotFound,
+		},
+		{
+			name:               "Untrusted Key",
+			host:               "duss.io",
+			path:               "/flagged",
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:               "Protected Key",
+			host:               "duss.io",
+			path:               "/locked",
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:               "Lookup",
+			path:               "/api/v1/redirect?domain=duss.io&key=abc1234",
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:               "Unknown Key",
+			host:               "duss.io",
+			path:               "/missing",
+			expectedStatusCode: http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodGet, tc.path, nil)
+			req.Host = tc.host
+
+			router.ServeHTTP(w, req)
+
+			if w.Code != tc.expectedStatusCode {
+				t.Errorf("for path %s, expected status code %d, but got %d", tc.path, tc.expectedStatusCode, w.Code)
+			}
+			openapitest.CheckResponse(t, spec.Load(), req, w)
+			if location := w.Header().Get("Location"); location != tc.expectedLocation {
+				t.Errorf("for path %s, expected Location %q, but got %q", tc.path, tc.expectedLocation, location)
+			}
 		})
 	}
 }
+
+func TestRouterMatchesSpec(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := web.NewRouter(api.NewRedirectHandler(&MockRedirectService{}))
+	engine, err := policy.New(policy.Rules{})
+	if err != nil {
+		t.Fatalf("failed to create policy engine: %v", err)
+	}
+	web.RegisterAdmin(router, engine.Handler("secret"))
+	web.RegisterHealth(router, health.New("url-redirect-service"))
+
+	openapitest.CheckRoutes(t, spec.Load(), router.Routes())
+}
@@ -0,0 +1,230 @@
+// Package app wires the url-shortener-service together. It is the service's
+// only importable package, so cmd/server and the end-to-end suite build the
+// service in exactly the same way.
+package app
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/iton0/duss/shared/health"
+	"github.com/iton0/duss/shared/httpclient"
+	"github.com/iton0/duss/shared/linksig"
+	"github.com/iton0/duss/shared/policy"
+	"github.com/iton0/duss/shared/ssrf"
+	"github.com/iton0/duss/url-shortener-service/internal/api"
+	"github.com/iton0/duss/url-shortener-service/internal/core/services"
+	"github.com/iton0/duss/url-shortener-service/internal/infrastructure/storage"
+	"github.com/iton0/duss/url-shortener-service/internal/infrastructure/threatfeed"
+	"github.com/iton0/duss/url-shortener-service/internal/infrastructure/web"
+)
+
+// Config holds the connections and settings the service is built from.
+type Config struct {
+	// DB is the PostgreSQL pool URLs are persisted to. Tests may pass a
+	// hermetic stand-in such as the one from shared/testutil/pgtest.
+	DB storage.DB
+	// RedisAddr is the address of the redirect service's Redis cache, which
+	// deleted URLs are evicted from. Eviction is disabled when it is empty.
+	RedisAddr     string
+	RedisPassword string
+	RedisDB       int
+	// KeyGenServiceURL is the base URL of the key-gen-service.
+	KeyGenServiceURL string
+	// BaseURL is the public URL short keys are appended to. Its host is the
+	// default short domain.
+	BaseURL string
+	// Domains are additional short domains links may be created on.
+	Domains []string
+	// StripTrackingParams drops tracking query parameters from canonical URLs.
+	StripTrackingParams bool
+	// Dedupe returns existing links when an owner shortens the same URL again.
+	Dedupe bool
+	// Policy, when set, rejects URLs it does not allow.
+	Policy *policy.Engine
+	// Destinations, when set, rejects URLs that point at internal addresses
+	// or use schemes other than http and https.
+	Destinations *ssrf.Validator
+	// AdminToken is the bearer token of the policy admin API, which is only
+	// served when it is set. It also lets callers read, change and delete
+	// any link, and create links for any owner.
+	AdminToken string
+	// OwnerTokens maps bearer tokens to the owners they authenticate. An
+	// owner may read, change and delete its own links.
+	OwnerTokens map[string]string
+	// ThreatFeeds are threat-feed dump files new links are screened
+	// against. Screening is disabled when there are none.
+	ThreatFeeds []string
+	// LinkSigning signs the short URLs of signed links. Requests for signed
+	// links are refused when it is nil.
+	LinkSigning *linksig.Keyring
+	// MaxBatchItems and MaxJobItems limit how many URLs a batch request and
+	// an asynchronous job may hold. Zero keeps the service's defaults.
+	MaxBatchItems int
+	MaxJobItems   int
+	// JobStaleAfter is how long a running job may go without an update
+	// before it is failed. Zero keeps the service's default.
+	JobStaleAfter time.Duration
+	// HTTPClient configures the client the key-gen-service is called with.
+	HTTPClient []httpclient.Option
+}
+
+// App is a fully wired url-shortener-service.
+type App struct {
+	Router *gin.Engine
+	// Health reports whether the service is ready.
+	Health    *health.Checker
+	redis     *storage.RedisClient
+	shortener *services.ShortenerService
+	threats   *threatfeed.Feed
+}
+
+// New migrates the database schema, connects to Redis and builds the router.
+func New(ctx context.Context, cfg Config) (*App, error) {
+	// Links are created on the base URL's host unless they name a domain.
+	var defaultDomain string
+	if cfg.BaseURL != "" {
+		base, err := url.Parse(cfg.BaseURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid base URL: %w", err)
+		}
+		defaultDomain = strings.ToLower(base.Host)
+	}
+
+	pgStore := storage.NewPostgresClientFromDB(cfg.DB)
+	if err := pgStore.Migrate(ctx, defaultDomain); err != nil {
+		return nil, err
+	}
+
+	var (
+		opts = []services.Option{
+			services.WithJobStore(pgStore),
+			services.WithBatchLimits(cfg.MaxBatchItems, cfg.MaxJobItems),
+			services.WithJobStaleAfter(cfg.JobStaleAfter),
+			services.WithKeyGenClient(httpclient.New("key-gen-service", cfg.HTTPClient...)),
+		}
+		redisClient *storage.RedisClient
+	)
+	if cfg.BaseURL != "" {
+		opts = append(opts, services.WithDomains(defaultDomain, cfg.Domains...))
+	}
+	if cfg.StripTrackingParams {
+		opts = append(opts, services.WithTrackingParamStripping())
+	}
+	if cfg.Dedupe {
+		opts = append(opts, services.WithDedupe())
+	}
+	if cfg.Policy != nil {
+		opts = append(opts, services.WithPolicy(cfg.Policy))
+	}
+	if cfg.Destinations != nil {
+		opts = append(opts, services.WithDestinationValidator(cfg.Destinations))
+	}
+	if cfg.LinkSigning != nil {
+		opts = append(opts, services.WithSignedLinks())
+	}
+	var threats *threatfeed.Feed
+	if len(cfg.ThreatFeeds) > 0 {
+		var err error
+		threats, err = threatfeed.Open(cfg.ThreatFeeds...)
+		if err != nil {
+			return nil, fmt.Errorf("could not load threat feeds: %w", err)
+		}
+		opts = append(opts, services.WithThreatFeed(threats))
+	}
+	if cfg.RedisAddr != "" {
+		var err error
+		redisClient, err = storage.NewRedisClient(ctx, cfg.RedisAddr, cfg.RedisPassword, cfg.RedisDB)
+		if err != nil {
+			return nil, fmt.Errorf("could not connect to Redis: %w", err)
+		}
+		opts = append(opts, services.WithCache(redisClient))
+	}
+
+	shortenerService := services.NewShortenerService(pgStore, cfg.KeyGenServiceURL, opts...)
+	// Jobs left running by replicas that stopped will never finish.
+	if _, err := shortenerService.FailStaleJobs(ctx); err != nil {
+		return nil, fmt.Errorf("could not fail stale jobs: %w", err)
+	}
+	shortenerHandler := api.NewShortenerHandler(shortenerService, cfg.BaseURL,
+		api.WithAdminToken(cfg.AdminToken), api.WithOwnerTokens(cfg.OwnerTokens), api.WithLinkSigner(cfg.LinkSigning))
+
+	router := web.NewRouter(shortenerHandler)
+	if cfg.Policy != nil && cfg.AdminToken != "" {
+		web.RegisterAdmin(router, cfg.Policy.Handler(cfg.AdminToken))
+	}
+
+	// The service is ready when it can store links and get keys for them.
+	checker := health.New("url-shortener-service")
+	checker.Register("postgres", cfg.DB.Ping)
+	if redisClient != nil {
+		checker.Register("redis", redisClient.Ping)
+	}
+	checker.Register("key-gen-service", health.Remote(http.DefaultClient, cfg.KeyGenServiceURL+"/readyz"))
+	web.RegisterHealth(router, checker)
+
+	return &App{
+		Router:    router,
+		Health:    checker,
+		redis:     redisClient,
+		shortener: shortenerService,
+		threats:   threats,
+	}, nil
+}
+
+// Rescan reloads the threat feeds and disables existing links that they now
+// match. It returns the number of links disabled.
+func (a *App) Rescan(ctx context.Context) (int, error) {
+	if a.threats == nil {
+		return 0, nil
+	}
+	if err := a.threats.Reload(); err != nil {
+		slog.WarnContext(ctx, "screening: keeping current threat feeds", "error", err)
+	}
+	return a.shortener.Rescan(ctx)
+}
+
+// RunScreening calls Rescan every interval until ctx is done. It returns at
+// once when no threat feeds are configured.
+func (a *App) RunScreening(ctx context.Context, interval time.Duration) {
+	if a.threats == nil || interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if n, err := a.Rescan(ctx); err != nil {
+				slog.ErrorContext(ctx, "screening: rescan failed", "disabled", n, "error", err)
+			} else {
+				slog.InfoContext(ctx, "screening: rescan finished", "disabled", n)
+			}
+		}
+	}
+}
+
+// Wait waits for the shorten jobs still being processed to finish, or for
+// ctx to be done.
+func (a *App) Wait(ctx context.Context) error {
+	return a.shortener.Wait(ctx)
+}
+
+// Close releases the connections opened by New. The DB passed in Config is
+// owned by the caller and left open.
+func (a *App) Close() error {
+	if a.redis != nil {
+		return a.redis.Close()
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/iton0/duss/shared/config"
+	"github.com/iton0/duss/shared/httpclient"
+	"github.com/iton0/duss/shared/linksig"
+	"github.com/iton0/duss/shared/logging"
+	"github.com/iton0/duss/shared/policy"
+	"github.com/iton0/duss/shared/ssrf"
+	"github.com/iton0/duss/shared/tracing"
+)
+
+// Config is the url-shortener-service's configuration.
+type Config struct {
+	Server   config.Server   `config:"server"`
+	Postgres config.Postgres `config:"postgres" required:"true"`
+	// Redis is the redirect service's cache, which deleted URLs are evicted
+	// from.
+	Redis config.Redis `config:"redis"`
+	// KeyGenServiceURL is the base URL of the key-gen-service.
+	KeyGenServiceURL string `config:"key_gen_service_url" env:"KEY_GEN_SERVICE_URL" default:"http://localhost:8082" required:"true"`
+	// BaseURL is the public URL short keys are appended to. Its host is the
+	// default short domain.
+	BaseURL string `config:"base_url" env:"PUBLIC_BASE_URL" default:"http://localhost:8081" required:"true"`
+	// Domains are additional branded short domains the shorten API accepts.
+	Domains []string `config:"domains" env:"SHORT_DOMAINS"`
+	// StripTrackingParams drops utm_*, fbclid and gclid query parameters from
+	// the canonical form of shortened URLs.
+	StripTrackingParams bool `config:"strip_tracking_params" env:"STRIP_TRACKING_PARAMS"`
+	// Dedupe makes shortening a URL its owner already shortened on the same
+	// domain return the existing link. Requests may opt out with "dedupe".
+	Dedupe bool `config:"dedupe" env:"DEDUPE_SHORTEN"`
+	// Policy is the URL policy shortened URLs are checked against.
+	Policy policy.Config `config:"policy"`
+	// Destinations keeps shortened URLs from pointing at internal addresses.
+	Destinations ssrf.Config `config:"destinations"`
+	// AdminToken enables the policy admin API and is the bearer token it
+	// requires.
+	AdminToken string `config:"admin_token" env:"ADMIN_TOKEN" secret:"true"`
+	// OwnerTokens are "<owner>:<token>" entries. A request whose bearer
+	// token is an owner's acts as that owner: its links are created for the
+	// owner, and it may read, change and delete the owner's links.
+	OwnerTokens []string `config:"owner_tokens" env:"OWNER_TOKENS" secret:"true"`
+	// ThreatFeed screens links against offline malware and phishing feeds.
+	ThreatFeed ThreatFeedConfig `config:"threat_feed"`
+	// LinkSigning holds the keys signed links are signed with. It must match
+	// the redirect service's.
+	LinkSigning linksig.Config `config:"link_signing"`
+	// Batch limits the batch shorten API and asynchronous shorten jobs.
+	Batch BatchConfig `config:"batch"`
+	// HTTPClient configures the retries and circuit breaker of calls to the
+	// key-gen-service.
+	HTTPClient httpclient.Config `config:"http_client"`
+	// Log configures the service's log level, format and sampling.
+	Log logging.Config `config:"log"`
+	// Tracing configures where the service's spans are exported.
+	Tracing tracing.Config `config:"tracing"`
+}
+
+// BatchConfig holds the limits of batch shortening.
+type BatchConfig struct {
+	// MaxItems is how many URLs POST /api/v1/shorten/batch accepts, and
+	// how many a job shortens at a time.
+	MaxItems int `config:"max_items" env:"BATCH_MAX_ITEMS" default:"1000"`
+	// MaxJobItems is how many URLs an uploaded job may hold.
+	MaxJobItems int `config:"max_job_items" env:"BATCH_JOB_MAX_ITEMS" default:"100000"`
+	// JobStaleAfter is how long a running job may go without an update
+	// before it is failed as abandoned by its replica.
+	JobStaleAfter time.Duration `config:"job_stale_after" env:"BATCH_JOB_STALE_AFTER" default:"2m"`
+}
+
+// ThreatFeedConfig holds the threat-feed screening settings.
+type ThreatFeedConfig struct {
+	// Files are URLhaus or PhishTank CSV dumps and plain host lists. New
+	// links are checked against them, and screening is off without any.
+	Files []string `config:"files" env:"THREAT_FEED_FILES"`
+	// RescanInterval is how often the files are reloaded and existing links
+	// rescanned, disabling those that match.
+	RescanInterval time.Duration `config:"rescan_interval" env:"THREAT_FEED_RESCAN_INTERVAL" default:"1h"`
+}
+
+// Validate implements config.Validator.
+func (c *Config) Validate() error {
+	if u, err := url.Parse(c.BaseURL); err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("base_url (PUBLIC_BASE_URL) must be an absolute URL, got %q", c.BaseURL)
+	}
+	if c.Batch.MaxItems <= 0 || c.Batch.MaxJobItems <= 0 {
+		return errors.New("batch.max_items (BATCH_MAX_ITEMS) and batch.max_job_items (BATCH_JOB_MAX_ITEMS) must be positive")
+	}
+	if _, err := c.ownerTokens(); err != nil {
+		return fmt.Errorf("owner_tokens (OWNER_TOKENS): %w", err)
+	}
+	if _, err := c.LinkSigning.Keyring(); err != nil {
+		return fmt.Errorf("link_signing.keys (LINK_SIGNING_KEYS): %w", err)
+	}
+	if _, err := c.HTTPClient.Options(); err != nil {
+		return fmt.Errorf("http_client: %w", err)
+	}
+	if _, err := c.Log.Options(); err != nil {
+		return fmt.Errorf("log: %w", err)
+	}
+	if _, err := c.Tracing.Options(); err != nil {
+		return fmt.Errorf("tracing: %w", err)
+	}
+	return nil
+}
+
+// ownerTokens returns the owner each of OwnerTokens authenticates, keyed by
+// token.
+func (c *Config) ownerTokens() (map[string]string, error) {
+	owners := make(map[string]string, len(c.OwnerTokens))
+	for i, entry := range c.OwnerTokens {
+		owner, token, ok := strings.Cut(entry, ":")
+		if !ok || owner == "" || token == "" {
+			return nil, fmt.Errorf("entry %d: expected <owner>:<token>", i+1)
+		}
+		if _, taken := owners[token]; taken || token == c.AdminToken {
+			return nil, fmt.Errorf("entry %d: token is already in use", i+1)
+		}
+		owners[token] = owner
+	}
+	return owners, nil
+}
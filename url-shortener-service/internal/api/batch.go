@@ -0,0 +1,351 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+
+	"github.com/iton0/duss/shared/domain"
+	"github.com/iton0/duss/shared/problem"
+	"github.com/iton0/duss/url-shortener-service/internal/core/services"
+	"github.com/iton0/duss/url-shortener-service/internal/infrastructure/storage"
+)
+
+// maxJobUploadSize is the largest CSV or NDJSON upload HandleSubmitJob reads.
+const maxJobUploadSize = 64 << 20
+
+// BatchRequest defines the JSON request body of HandleShortenBatch.
+type BatchRequest struct {
+	Items []ShortenRequest `json:"items" binding:"required"`
+}
+
+// BatchItemResult is the outcome of one item of a batch or job. Status is
+// the code POST /api/v1/shorten would have answered the item with; a failed
+// item also has the problem code and detail it would have answered with.
+type BatchItemResult struct {
+	Index    int          `json:"index"`
+	ShortURL string       `json:"short_url,omitempty"`
+	Created  bool         `json:"created"`
+	Status   int          `json:"status"`
+	Code     problem.Code `json:"code,omitempty"`
+	Error    string       `json:"error,omitempty"`
+}
+
+// BatchResponse defines the JSON response body of HandleShortenBatch.
+type BatchResponse struct {
+	Results []BatchItemResult `json:"results"`
+	// Created, Existing and Failed count the items that created a link,
+	// returned an existing one and failed.
+	Created  int `json:"created"`
+	Existing int `json:"existing"`
+	Failed   int `json:"failed"`
+}
+
+// JobResponse defines the JSON response body of the job endpoints. Results
+// are only listed once the job is done.
+type JobResponse struct {
+	ID        string            `json:"id"`
+	Status    string            `json:"status"`
+	Total     int               `json:"total"`
+	Processed int               `json:"processed"`
+	Failed    int               `json:"failed"`
+	Results   []BatchItemResult `json:"results,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+	UpdatedAt time.Time         `json:"updated_at"`
+}
+
+// HandleShortenBatch handles the POST /api/v1/shorten/batch request. Items
+// are shortened as by HandleShortener, and each item's outcome is reported
+// in the results; the batch as a whole succeeds even if some items fail.
+func (h *ShortenerHandler) HandleShortenBatch(c *gin.Context) {
+	var req BatchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		problem.Abort(c, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request: items are required"))
+		return
+	}
+
+	results := make([]BatchItemResult, len(req.Items))
+	var (
+		params  []services.ShortenParams
+		indexes []int
+	)
+	actor := h.actor(c)
+	for i, item := range req.Items {
+		if err := binding.Validator.ValidateStruct(item); err != nil {
+			results[i] = BatchItemResult{Index: i, Status: invalidURL.Status, Code: invalidURL.Code, Error: invalidURL.Detail}
+			continue
+		}
+		p, err := item.params(actor)
+		if err != nil {
+			results[i] = h.itemResult(c.Request.Context(), i, nil, false, err, time.Time{})
+			continue
+		}
+		params = append(params, p)
+		indexes = append(indexes, i)
+	}
+
+	batch, err := h.shortenerService.ShortenBatch(c.Request.Context(), params)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrBatchTooLarge):
+			problem.Abort(c, problem.New(http.StatusRequestEntityTooLarge, problem.CodeTooLarge, err.Error()))
+			return
+		default:
+			problem.Abort(c, problem.Internal())
+			return
+		}
+	}
+	for j, r := range batch {
+		i := indexes[j]
+		results[i] = h.itemResult(c.Request.Context(), i, r.URL, r.Created, r.Err, params[j].SignatureExpiresAt)
+	}
+
+	resp := BatchResponse{Results: results}
+	for _, r := range results {
+		switch {
+		case r.Error != "":
+			resp.Failed++
+		case r.Created:
+			resp.Created++
+		default:
+			resp.Existing++
+		}
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// HandleSubmitJob handles the POST /api/v1/shorten/jobs request, whose body
+// lists URLs to shorten in the background as CSV (text/csv) or
+// newline-delimited JSON (application/x-ndjson). It answers 202 Accepted with
+// the new job, whose progress the Location header points at.
+func (h *ShortenerHandler) HandleSubmitJob(c *gin.Context) {
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, maxJobUploadSize)
+
+	var (
+		items []ShortenRequest
+		err   error
+	)
+	switch c.ContentType() {
+	case "text/csv":
+		items, err = parseCSVItems(body)
+	case "application/x-ndjson", "application/jsonl":
+		items, err = parseNDJSONItems(body)
+	default:
+		problem.Abort(c, problem.New(http.StatusUnsupportedMediaType, problem.CodeUnsupportedMediaType, "Content-Type must be text/csv or application/x-ndjson"))
+		return
+	}
+	if err != nil {
+		if maxErr := (*http.MaxBytesError)(nil); errors.As(err, &maxErr) {
+			problem.Abort(c, problem.New(http.StatusRequestEntityTooLarge, problem.CodeTooLarge, "upload too large"))
+			return
+		}
+		problem.Abort(c, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request: "+err.Error()))
+		return
+	}
+
+	actor := h.actor(c)
+	params := make([]services.ShortenParams, len(items))
+	for i, item := range items {
+		if params[i], err = item.params(actor); err != nil {
+			problem.Abort(c, problem.New(http.StatusForbidden, problem.CodeForbidden, fmt.Sprintf("item %d: %v", i, err)))
+			return
+		}
+	}
+	job, err := h.shortenerService.SubmitJob(c.Request.Context(), params, actor)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrBatchTooLarge):
+			problem.Abort(c, problem.New(http.StatusRequestEntityTooLarge, problem.CodeTooLarge, err.Error()))
+			return
+		case errors.Is(err, services.ErrJobsDisabled):
+			problem.Abort(c, problem.New(http.StatusNotImplemented, problem.CodeNotImplemented, err.Error()))
+			return
+		default:
+			problem.Abort(c, problem.Internal())
+			return
+		}
+	}
+
+	c.Header("Location", "/api/v1/shorten/jobs/"+job.ID)
+	c.JSON(http.StatusAccepted, h.jobResponse(c.Request.Context(), job))
+}
+
+// HandleGetJob handles the GET /api/v1/shorten/jobs/:id request. A job
+// submitted with an owner token may only be read with the same token or
+// the admin token.
+func (h *ShortenerHandler) HandleGetJob(c *gin.Context) {
+	job, err := h.shortenerService.GetJob(c.Request.Context(), c.Param("id"), h.actor(c))
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrJobNotFound), errors.Is(err, services.ErrJobsDisabled):
+			problem.Abort(c, problem.New(http.StatusNotFound, problem.CodeNotFound, services.ErrJobNotFound.Error()))
+			return
+		case errors.Is(err, services.ErrJobForbidden):
+			problem.Abort(c, problem.New(http.StatusForbidden, problem.CodeForbidden, err.Error()))
+			return
+		default:
+			problem.Abort(c, problem.Internal())
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, h.jobResponse(c.Request.Context(), job))
+}
+
+// jobResponse builds the response describing job. The short URLs of signed
+// links are signed as the results are read.
+func (h *ShortenerHandler) jobResponse(ctx context.Context, job *storage.Job) JobResponse {
+	resp := JobResponse{
+		ID:        job.ID,
+		Status:    job.Status,
+		Total:     job.Total,
+		Processed: job.Processed,
+		Failed:    job.Failed,
+		CreatedAt: job.CreatedAt,
+		UpdatedAt: job.UpdatedAt,
+	}
+	for _, r := range job.Results {
+		var u *domain.URL
+		if r.ShortKey != "" {
+			u = &domain.URL{Domain: r.Domain, ShortKey: r.ShortKey, Signed: r.Signed}
+		}
+		resp.Results = append(resp.Results, h.itemResult(ctx, r.Index, u, r.Created, services.ResultError(r), r.SignatureExpiresAt))
+	}
+	return resp
+}
+
+// itemResult reports the outcome of shortening the item at index: the link
+// u and whether it was created, or err.
+func (h *ShortenerHandler) itemResult(ctx context.Context, index int, u *domain.URL, created bool, err error, expires time.Time) BatchItemResult {
+	if err != nil {
+		p := shortenProblem(err)
+		return BatchItemResult{Index: index, Status: p.Status, Code: p.Code, Error: p.Detail}
+	}
+
+	shortURL, err := h.shortURL(u, expires)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to sign short URL", "link", u.ID(), "error", err)
+		p := problem.Internal()
+		return BatchItemResult{Index: index, Status: p.Status, Code: p.Code, Error: p.Detail}
+	}
+	status := http.StatusCreated
+	if !created {
+		status = http.StatusOK
+	}
+	return BatchItemResult{Index: index, ShortURL: shortURL, Created: created, Status: status}
+}
+
+// parseCSVItems reads items from CSV with a header row naming its columns:
+// url, and optionally domain, owner, dedupe, password, signed and
+// signature_expires_at, which take the values of the JSON fields of the same
+// names. Empty cells leave a field unset.
+func parseCSVItems(r io.Reader) ([]ShortenRequest, error) {
+	cr := csv.NewReader(r)
+	cr.ReuseRecord = true
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, errors.New("CSV has no header row")
+	}
+	if err != nil {
+		return nil, err
+	}
+	columns := make([]string, len(header))
+	hasURL := false
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		switch name {
+		case "url":
+			hasURL = true
+		case "domain", "owner", "dedupe", "password", "signed", "signature_expires_at":
+		default:
+			return nil, fmt.Errorf("unknown CSV column %q", name)
+		}
+		columns[i] = name
+	}
+	if !hasURL {
+		return nil, errors.New("CSV has no url column")
+	}
+
+	var items []ShortenRequest
+	for row := 2; ; row++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return items, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var item ShortenRequest
+		for i, value := range record {
+			value = strings.TrimSpace(value)
+			if value == "" {
+				continue
+			}
+			switch columns[i] {
+			case "url":
+				item.URL = value
+			case "domain":
+				item.Domain = value
+			case "owner":
+				item.Owner = value
+			case "password":
+				item.Password = value
+			case "dedupe":
+				dedupe, err := strconv.ParseBool(value)
+				if err != nil {
+					return nil, fmt.Errorf("row %d: dedupe must be true or false", row)
+				}
+				item.Dedupe = &dedupe
+			case "signed":
+				signed, err := strconv.ParseBool(value)
+				if err != nil {
+					return nil, fmt.Errorf("row %d: signed must be true or false", row)
+				}
+				item.Signed = signed
+			case "signature_expires_at":
+				expires, err := time.Parse(time.RFC3339, value)
+				if err != nil {
+					return nil, fmt.Errorf("row %d: signature_expires_at must be an RFC 3339 time", row)
+				}
+				item.SignatureExpiresAt = &expires
+			}
+		}
+		items = append(items, item)
+	}
+}
+
+// parseNDJSONItems reads items from newline-delimited JSON, one
+// POST /api/v1/shorten request body per line. Blank lines are skipped.
+func parseNDJSONItems(r io.Reader) ([]ShortenRequest, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64<<10), 1<<20)
+
+	var items []ShortenRequest
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var item ShortenRequest
+		if err := json.Unmarshal([]byte(text), &item); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		items = append(items, item)
+	}
+	return items, scanner.Err()
+}
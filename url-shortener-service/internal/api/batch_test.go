@@ -0,0 +1,308 @@
+package api_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/iton0/duss/shared/linksig"
+	"github.com/iton0/duss/shared/problem"
+	"github.com/iton0/duss/url-shortener-service/internal/api"
+	"github.com/iton0/duss/url-shortener-service/internal/core/services"
+	"github.com/iton0/duss/url-shortener-service/internal/infrastructure/storage"
+)
+
+func TestHandleShortenBatch(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	testCases := []struct {
+		name               string
+		body               string
+		mockReturnErr      error
+		mockReturnExisting bool
+		expectedStatusCode int
+		expectedStatuses   []int
+	}{
+		{
+			name:               "Mixed Results",
+			body:               `{"items":[{"url":"https://example.com/a"},{"domain":"duss.io"},{"url":"https://phish.example"},{"url":"https://taken.example"},{"url":"https://example.com/b","owner":"team-a"}]}`,
+			expectedStatusCode: http.StatusOK,
+			expectedStatuses:   []int{http.StatusCreated, http.StatusBadRequest, http.StatusForbidden, http.StatusConflict, http.StatusForbidden},
+		},
+		{
+			name:               "Existing Links",
+			body:               `{"items":[{"url":"https://example.com/a"}]}`,
+			mockReturnExisting: true,
+			expectedStatusCode: http.StatusOK,
+			expectedStatuses:   []int{http.StatusOK},
+		},
+		{
+			name:               "Missing Items",
+			body:               `{}`,
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:               "Too Many Items",
+			body:               `{"items":[{"url":"https://example.com/a"}]}`,
+			mockReturnErr:      services.ErrBatchTooLarge,
+			expectedStatusCode: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:               "Internal Server Error",
+			body:               `{"items":[{"url":"https://example.com/a"}]}`,
+			mockReturnErr:      errors.New("database connection failed"),
+			expectedStatusCode: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockService := &MockShortenerService{
+				ReturnKey:      "abc",
+				ReturnErr:      tc.mockReturnErr,
+				ReturnExisting: tc.mockReturnExisting,
+				ItemErrs: map[string]error{
+					"https://phish.example": services.ErrBlacklistedURL,
+					"https://taken.example": services.ErrDuplicatedKey,
+				},
+			}
+			shortenerHandler := api.NewShortenerHandler(mockService, "http://localhost:8081")
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request, _ = http.NewRequest(http.MethodPost, "/api/v1/shorten/batch", strings.NewReader(tc.body))
+			c.Request.Header.Set("Content-Type", "application/json")
+
+			shortenerHandler.HandleShortenBatch(c)
+
+			if w.Code != tc.expectedStatusCode {
+				t.Fatalf("expected status code %d, but got %d: %s", tc.expectedStatusCode, w.Code, w.Body.String())
+			}
+			if tc.expectedStatuses == nil {
+				return
+			}
+
+			var resp api.BatchResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("could not decode response: %v", err)
+			}
+			if len(resp.Results) != len(tc.expectedStatuses) {
+				t.Fatalf("expected %d results, but got %d", len(tc.expectedStatuses), len(resp.Results))
+			}
+			failed := 0
+			for i, r := range resp.Results {
+				if r.Index != i || r.Status != tc.expectedStatuses[i] {
+					t.Errorf("item %d: expected status %d, but got %+v", i, tc.expectedStatuses[i], r)
+				}
+				if r.Status >= http.StatusBadRequest {
+					failed++
+					if r.Error == "" || r.ShortURL != "" {
+						t.Errorf("item %d: expected an error and no short URL, but got %+v", i, r)
+					}
+				} else if !strings.HasPrefix(r.ShortURL, "http://localhost:8081/abc") {
+					t.Errorf("item %d: expected a short URL, but got %q", i, r.ShortURL)
+				}
+			}
+			if resp.Failed != failed || resp.Created+resp.Existing+resp.Failed != len(resp.Results) {
+				t.Errorf("expected counts adding up to %d with %d failed, but got %+v", len(resp.Results), failed, resp)
+			}
+			for _, item := range mockService.LastItems {
+				if item.LongURL == "" {
+					t.Error("expected items without a URL not to reach the service")
+				}
+			}
+		})
+	}
+}
+
+func TestHandleSubmitJob(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	testCases := []struct {
+		name               string
+		contentType        string
+		body               string
+		mockReturnErr      error
+		expectedStatusCode int
+		expectedItems      int
+	}{
+		{
+			name:               "CSV",
+			contentType:        "text/csv",
+			body:               "url,owner,dedupe,signed,signature_expires_at\nhttps://example.com/a,team-a,false,,\n\"https://example.com/b?x=1,2\",,,true,2030-01-02T03:04:05Z\n",
+			expectedStatusCode: http.StatusAccepted,
+			expectedItems:      2,
+		},
+		{
+			name:               "NDJSON",
+			contentType:        "application/x-ndjson",
+			body:               "{\"url\":\"https://example.com/a\",\"owner\":\"team-a\",\"dedupe\":false}\n\n{\"url\":\"https://example.com/b?x=1,2\",\"signed\":true,\"signature_expires_at\":\"2030-01-02T03:04:05Z\"}\n",
+			expectedStatusCode: http.StatusAccepted,
+			expectedItems:      2,
+		},
+		{
+			name:               "Foreign Owner",
+			contentType:        "text/csv",
+			body:               "url,owner\nhttps://example.com/a,\nhttps://example.com/b,team-b\n",
+			expectedStatusCode: http.StatusForbidden,
+		},
+		{
+			name:               "Unsupported Content Type",
+			contentType:        "application/json",
+			body:               `{"items":[]}`,
+			expectedStatusCode: http.StatusUnsupportedMediaType,
+		},
+		{
+			name:               "CSV Without URL Column",
+			contentType:        "text/csv",
+			body:               "owner\nteam-a\n",
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:               "CSV Unknown Column",
+			contentType:        "text/csv",
+			body:               "url,colour\nhttps://example.com,red\n",
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:               "CSV Invalid Boolean",
+			contentType:        "text/csv",
+			body:               "url,signed\nhttps://example.com,maybe\n",
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:               "NDJSON Invalid Line",
+			contentType:        "application/x-ndjson",
+			body:               "{\"url\":\"https://example.com\"}\n{\"url\":\n",
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:               "Too Many Items",
+			contentType:        "text/csv",
+			body:               "url\nhttps://example.com\n",
+			mockReturnErr:      services.ErrBatchTooLarge,
+			expectedStatusCode: http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockService := &MockShortenerService{
+				ReturnErr: tc.mockReturnErr,
+				ReturnJob: &storage.Job{ID: "job1", Status: storage.JobRunning, Total: tc.expectedItems},
+			}
+			shortenerHandler := api.NewShortenerHandler(mockService, "http://localhost:8081",
+				api.WithOwnerTokens(map[string]string{"a-token": "team-a"}))
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request, _ = http.NewRequest(http.MethodPost, "/api/v1/shorten/jobs", strings.NewReader(tc.body))
+			c.Request.Header.Set("Content-Type", tc.contentType)
+			c.Request.Header.Set("Authorization", "Bearer a-token")
+
+			shortenerHandler.HandleSubmitJob(c)
+
+			if w.Code != tc.expectedStatusCode {
+				t.Fatalf("expected status code %d, but got %d: %s", tc.expectedStatusCode, w.Code, w.Body.String())
+			}
+			if w.Code != http.StatusAccepted {
+				return
+			}
+			if location := w.Header().Get("Location"); location != "/api/v1/shorten/jobs/job1" {
+				t.Errorf("expected the job's location, but got %q", location)
+			}
+			if mockService.LastActor.Owner != "team-a" {
+				t.Errorf("expected the job to be submitted by team-a, but got %+v", mockService.LastActor)
+			}
+
+			items := mockService.LastItems
+			if len(items) != tc.expectedItems {
+				t.Fatalf("expected %d items, but got %d", tc.expectedItems, len(items))
+			}
+			expires := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+			if items[0].Owner != "team-a" || items[0].Dedupe == nil || *items[0].Dedupe || items[0].Signed {
+				t.Errorf("expected the first item to be parsed, but got %+v", items[0])
+			}
+			if items[1].LongURL != "https://example.com/b?x=1,2" || items[1].Dedupe != nil || !items[1].Signed || !items[1].SignatureExpiresAt.Equal(expires) {
+				t.Errorf("expected the second item to be parsed, but got %+v", items[1])
+			}
+		})
+	}
+}
+
+func TestHandleGetJob(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	keys, err := linksig.NewKeyring(linksig.Key{ID: "k1", Secret: []byte("0123456789abcdef")})
+	if err != nil {
+		t.Fatalf("could not create keyring: %v", err)
+	}
+
+	testCases := []struct {
+		name               string
+		mockReturnErr      error
+		expectedStatusCode int
+	}{
+		{"Success", nil, http.StatusOK},
+		{"Not Found", services.ErrJobNotFound, http.StatusNotFound},
+		{"Forbidden", services.ErrJobForbidden, http.StatusForbidden},
+		{"Internal Server Error", errors.New("database connection failed"), http.StatusInternalServerError},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockService := &MockShortenerService{
+				ReturnErr: tc.mockReturnErr,
+				ReturnJob: &storage.Job{ID: "job1", Status: storage.JobDone, Total: 3, Processed: 3, Failed: 1, Results: []storage.JobResult{
+					{Index: 0, Domain: "duss.io", ShortKey: "abc", Created: true},
+					{Index: 1, Error: services.ErrBlacklistedURL.Error()},
+					{Index: 2, Domain: "duss.io", ShortKey: "def", Created: true, Signed: true},
+				}},
+			}
+			shortenerHandler := api.NewShortenerHandler(mockService, "http://localhost:8081", api.WithLinkSigner(keys),
+				api.WithOwnerTokens(map[string]string{"a-token": "team-a"}))
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request, _ = http.NewRequest(http.MethodGet, "/api/v1/shorten/jobs/job1", nil)
+			c.Request.Header.Set("Authorization", "Bearer a-token")
+			c.Params = gin.Params{{Key: "id", Value: "job1"}}
+
+			shortenerHandler.HandleGetJob(c)
+
+			if w.Code != tc.expectedStatusCode {
+				t.Fatalf("expected status code %d, but got %d: %s", tc.expectedStatusCode, w.Code, w.Body.String())
+			}
+			if mockService.LastActor.Owner != "team-a" {
+				t.Errorf("expected the job to be read by team-a, but got %+v", mockService.LastActor)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var resp api.JobResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("could not decode response: %v", err)
+			}
+			if resp.Status != storage.JobDone || len(resp.Results) != 3 {
+				t.Fatalf("expected a finished job with 3 results, but got %+v", resp)
+			}
+			if r := resp.Results[0]; r.ShortURL != "http://duss.io/abc" || r.Status != http.StatusCreated {
+				t.Errorf("expected a new link on duss.io, but got %+v", r)
+			}
+			if r := resp.Results[1]; r.Status != http.StatusForbidden || r.Code != problem.CodeBlacklisted || r.Error != services.ErrBlacklistedURL.Error() {
+				t.Errorf("expected a rejected URL, but got %+v", r)
+			}
+			segment, _ := strings.CutPrefix(resp.Results[2].ShortURL, "http://duss.io/")
+			key, token, _ := linksig.Split(segment)
+			if err := keys.Verify("duss.io", key, token, time.Now()); key != "def" || err != nil {
+				t.Errorf("expected a signed short URL for def, but got %q (%v)", resp.Results[2].ShortURL, err)
+			}
+		})
+	}
+}
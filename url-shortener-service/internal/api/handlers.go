@@ -1,17 +1,67 @@
 package api
 
 import (
+	"crypto/subtle"
 	"errors"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
+	"github.com/iton0/duss/shared/domain"
+	"github.com/iton0/duss/shared/linksig"
+	"github.com/iton0/duss/shared/problem"
 	"github.com/iton0/duss/url-shortener-service/internal/core/services"
 )
 
 // RequestBody defines the structure for the JSON request body.
 type ShortenRequest struct {
 	URL string `json:"url" binding:"required,url"`
+	// Domain is the short domain to create the link on. It must be on the
+	// service's allowlist; empty selects the default domain.
+	Domain string `json:"domain"`
+	// Owner identifies who the link is created for. It defaults to the
+	// owner the request authenticates as, and only an administrator may name
+	// another.
+	Owner string `json:"owner"`
+	// Dedupe overrides the service's dedupe mode for this request.
+	Dedupe *bool `json:"dedupe"`
+	// Password, when set, protects the link: visitors must enter it before
+	// they are redirected.
+	Password string `json:"password"`
+	// Signed makes the link only redirect through the signed short URL
+	// returned for it, whose signature expires at SignatureExpiresAt if set.
+	Signed             bool       `json:"signed"`
+	SignatureExpiresAt *time.Time `json:"signature_expires_at"`
+}
+
+// params returns the service parameters r describes when actor sends it.
+func (r ShortenRequest) params(actor services.Actor) (services.ShortenParams, error) {
+	owner, err := actor.OwnerFor(r.Owner)
+	if err != nil {
+		return services.ShortenParams{}, err
+	}
+	return services.ShortenParams{
+		LongURL:            r.URL,
+		Domain:             r.Domain,
+		Owner:              owner,
+		Dedupe:             r.Dedupe,
+		Password:           r.Password,
+		Signed:             r.Signed,
+		SignatureExpiresAt: r.signatureExpiresAt(),
+	}, nil
+}
+
+// signatureExpiresAt returns the requested signature expiry, or the zero
+// time if there is none.
+func (r ShortenRequest) signatureExpiresAt() time.Time {
+	if r.SignatureExpiresAt == nil {
+		return time.Time{}
+	}
+	return *r.SignatureExpiresAt
 }
 
 // ResponseBody defines the structure for the JSON response body.
@@ -19,46 +69,232 @@ type ShortenResponse struct {
 	ShortURL string `json:"short_url"`
 }
 
+// TrustRequest defines the JSON request body of HandleSetTrust.
+type TrustRequest struct {
+	Untrusted *bool `json:"untrusted" binding:"required"`
+}
+
 type ShortenerHandler struct {
 	shortenerService services.ShortenerServiceIface
+	baseURL          *url.URL
+	adminToken       string
+	ownerTokens      map[string]string // Owner by bearer token
+	signer           *linksig.Keyring
+}
+
+// HandlerOption configures optional settings of a ShortenerHandler.
+type HandlerOption func(*ShortenerHandler)
+
+// WithAdminToken lets requests carrying "Authorization: Bearer <token>" act
+// as an administrator.
+func WithAdminToken(token string) HandlerOption {
+	return func(h *ShortenerHandler) {
+		h.adminToken = token
+	}
+}
+
+// WithOwnerTokens lets requests carrying "Authorization: Bearer <token>"
+// act as the owner tokens maps the token to.
+func WithOwnerTokens(tokens map[string]string) HandlerOption {
+	return func(h *ShortenerHandler) {
+		h.ownerTokens = tokens
+	}
+}
+
+// WithLinkSigner lets requests create signed links, whose short URLs are
+// signed with keys.
+func WithLinkSigner(keys *linksig.Keyring) HandlerOption {
+	return func(h *ShortenerHandler) {
+		h.signer = keys
+	}
 }
 
-// NewShortenerHandler creates a new ShortenerHandler instance.
-func NewShortenerHandler(ss services.ShortenerServiceIface) *ShortenerHandler {
-	return &ShortenerHandler{shortenerService: ss}
+// NewShortenerHandler creates a new ShortenerHandler instance. baseURL is the
+// public address of the gateway on the default short domain; short URLs on
+// other domains keep its scheme and path and swap in their own host.
+func NewShortenerHandler(ss services.ShortenerServiceIface, baseURL string, opts ...HandlerOption) *ShortenerHandler {
+	base, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil {
+		base = &url.URL{}
+	}
+	h := &ShortenerHandler{
+		shortenerService: ss,
+		baseURL:          base,
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+// actor returns who c's bearer token authenticates: an administrator, an
+// owner, or nobody.
+func (h *ShortenerHandler) actor(c *gin.Context) services.Actor {
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return services.Actor{}
+	}
+	if h.adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(h.adminToken)) == 1 {
+		return services.Actor{Admin: true}
+	}
+	var actor services.Actor
+	for t, owner := range h.ownerTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			actor.Owner = owner
+		}
+	}
+	return actor
+}
+
+// shortURL builds the public short URL for u. The short URL of a signed
+// link carries a signature, which expires at expires unless it is zero.
+func (h *ShortenerHandler) shortURL(u *domain.URL, expires time.Time) (string, error) {
+	short := *h.baseURL
+	if u.Domain != "" {
+		short.Host = u.Domain
+	}
+	segment := u.ShortKey
+	if u.Signed {
+		if h.signer == nil {
+			return "", linksig.ErrNoActiveKey
+		}
+		token, err := h.signer.Sign(short.Host, u.ShortKey, expires, time.Now())
+		if err != nil {
+			return "", err
+		}
+		segment = linksig.Join(u.ShortKey, token)
+	}
+	return short.JoinPath(segment).String(), nil
 }
 
 // HandleShortener handles the POST /api/v1/shorten request.
 func (h *ShortenerHandler) HandleShortener(c *gin.Context) {
 	var req ShortenRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: URL is required and must be a valid format"})
+		problem.Abort(c, invalidURL)
+		return
+	}
+
+	params, err := req.params(h.actor(c))
+	if err != nil {
+		problem.Abort(c, shortenProblem(err))
+		return
+	}
+	shortenedURL, created, err := h.shortenerService.Shorten(c.Request.Context(), params)
+	if err != nil {
+		problem.Abort(c, shortenProblem(err))
 		return
 	}
 
-	shortenedURL, err := h.shortenerService.Shorten(c.Request.Context(), req.URL)
+	// An existing link returned in dedupe mode is reported with 200 OK.
+	status := http.StatusCreated
+	if !created {
+		status = http.StatusOK
+	}
+	shortURL, err := h.shortURL(shortenedURL, req.signatureExpiresAt())
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "failed to sign short URL", "link", shortenedURL.ID(), "error", err)
+		problem.Abort(c, problem.Internal())
+		return
+	}
+	c.JSON(status, ShortenResponse{ShortURL: shortURL})
+}
+
+// invalidURL is the problem of a shorten request without a valid URL.
+var invalidURL = problem.New(http.StatusBadRequest, problem.CodeInvalidURL, "Invalid request: URL is required and must be a valid format")
+
+// shortenProblem returns the problem a failure to shorten a URL is reported
+// with.
+func shortenProblem(err error) *problem.Problem {
+	switch {
+	case errors.Is(err, services.ErrInvalidURL):
+		return problem.New(http.StatusBadRequest, problem.CodeInvalidURL, err.Error())
+	case errors.Is(err, services.ErrDomainNotAllowed), errors.Is(err, services.ErrInvalidPassword),
+		errors.Is(err, services.ErrSigningDisabled), errors.Is(err, services.ErrInvalidSignature):
+		return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, err.Error())
+	case errors.Is(err, services.ErrBlacklistedURL):
+		return problem.New(http.StatusForbidden, problem.CodeBlacklisted, err.Error())
+	case errors.Is(err, services.ErrForeignOwner):
+		return problem.New(http.StatusForbidden, problem.CodeForbidden, err.Error())
+	case errors.Is(err, services.ErrDuplicatedKey):
+		return problem.New(http.StatusConflict, problem.CodeAliasTaken, err.Error())
+	case errors.Is(err, services.ErrKeyGenUnavailable):
+		return problem.New(http.StatusServiceUnavailable, problem.CodeUpstreamUnavailable, services.ErrKeyGenUnavailable.Error())
+	default:
+		return problem.Internal()
+	}
+}
+
+// HandleGetURL handles the GET /api/v1/urls/:shortKey?domain= request.
+// It returns the stored URL together with its redirect count to an
+// administrator or the link's owner.
+func (h *ShortenerHandler) HandleGetURL(c *gin.Context) {
+	actor := h.actor(c)
+	stored, err := h.shortenerService.GetURL(c.Request.Context(), c.Query("domain"), c.Param("shortKey"), actor)
 	if err != nil {
 		switch {
-		case errors.Is(err, services.ErrInvalidURL):
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, services.ErrURLNotFound):
+			problem.Abort(c, problem.New(http.StatusNotFound, problem.CodeNotFound, err.Error()))
+			return
+		case errors.Is(err, services.ErrForbidden):
+			problem.Abort(c, problem.New(http.StatusForbidden, problem.CodeForbidden, err.Error()))
 			return
-		case errors.Is(err, services.ErrBlacklistedURL):
-			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		default:
+			problem.Abort(c, problem.Internal())
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, stored.Redacted(actor.Admin))
+}
+
+// HandleDelete handles the DELETE /api/v1/urls/:shortKey?domain= request,
+// which only an administrator or the link's owner may send.
+func (h *ShortenerHandler) HandleDelete(c *gin.Context) {
+	actor := h.actor(c)
+	err := h.shortenerService.Delete(c.Request.Context(), c.Query("domain"), c.Param("shortKey"), actor)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrURLNotFound):
+			problem.Abort(c, problem.New(http.StatusNotFound, problem.CodeNotFound, err.Error()))
 			return
-		case errors.Is(err, services.ErrDuplicatedKey):
-			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		case errors.Is(err, services.ErrForbidden):
+			problem.Abort(c, problem.New(http.StatusForbidden, problem.CodeForbidden, err.Error()))
 			return
 		default:
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+			problem.Abort(c, problem.Internal())
 			return
 		}
 	}
 
-	// Assuming a base URL for the shortened link, e.g., "http://localhost:8080/"
-	// The base URL would be a configuration value in a real application.
-	// For this example, let's assume it's hardcoded.
-	baseURL := "http://localhost:8081/"
-	fullShortURL := baseURL + shortenedURL.ShortKey
+	c.Status(http.StatusNoContent)
+}
+
+// HandleSetTrust handles the PUT /api/v1/urls/:shortKey/trust?domain=
+// request, which flags a link as untrusted or clears the flag. It returns
+// the updated link.
+func (h *ShortenerHandler) HandleSetTrust(c *gin.Context) {
+	var req TrustRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		problem.Abort(c, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request: untrusted is required"))
+		return
+	}
+
+	actor := h.actor(c)
+	updated, err := h.shortenerService.SetUntrusted(c.Request.Context(), c.Query("domain"), c.Param("shortKey"), *req.Untrusted, actor)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrURLNotFound):
+			problem.Abort(c, problem.New(http.StatusNotFound, problem.CodeNotFound, err.Error()))
+			return
+		case errors.Is(err, services.ErrForbidden):
+			problem.Abort(c, problem.New(http.StatusForbidden, problem.CodeForbidden, err.Error()))
+			return
+		default:
+			problem.Abort(c, problem.Internal())
+			return
+		}
+	}
 
-	c.JSON(http.StatusCreated, ShortenResponse{ShortURL: fullShortURL})
+	c.JSON(http.StatusOK, updated.Redacted(actor.Admin))
 }
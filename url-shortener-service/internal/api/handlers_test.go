@@ -1 +1,591 @@
 package api_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/iton0/duss/shared/domain"
+	"github.com/iton0/duss/shared/linksig"
+	"github.com/iton0/duss/shared/problem"
+	"github.com/iton0/duss/url-shortener-service/internal/api"
+	"github.com/iton0/duss/url-shortener-service/internal/core/services"
+	"github.com/iton0/duss/url-shortener-service/internal/infrastructure/storage"
+)
+
+type MockShortenerService struct {
+	ReturnKey string
+	ReturnErr error
+	// ReturnExisting makes Shorten report an existing, deduplicated link.
+	ReturnExisting bool
+	// ReturnPasswordHash is the password hash of the link GetURL returns.
+	ReturnPasswordHash string
+
+	// LastDomain records the short domain of the most recent call.
+	LastDomain string
+	// LastParams records the parameters of the most recent Shorten call.
+	LastParams services.ShortenParams
+	// LastActor records the actor of the most recent GetURL, Delete,
+	// SetUntrusted, SubmitJob or GetJob call.
+	LastActor services.Actor
+	// ItemErrs are the errors ShortenBatch reports for the items with the
+	// same long URLs.
+	ItemErrs map[string]error
+	// LastItems records the items of the most recent ShortenBatch or
+	// SubmitJob call.
+	LastItems []services.ShortenParams
+	// ReturnJob is the job SubmitJob and GetJob return.
+	ReturnJob *storage.Job
+}
+
+func (m *MockShortenerService) GetURL(ctx context.Context, shortDomain, shortKey string, actor services.Actor) (*domain.URL, error) {
+	m.LastDomain = shortDomain
+	m.LastActor = actor
+	if m.ReturnErr != nil {
+		return nil, m.ReturnErr
+	}
+	return &domain.URL{Domain: shortDomain, ShortKey: shortKey, LongURL: "https://example.com", Owner: "team-a", Redirects: 3, PasswordHash: m.ReturnPasswordHash}, nil
+}
+
+func (m *MockShortenerService) Delete(ctx context.Context, shortDomain, shortKey string, actor services.Actor) error {
+	m.LastDomain = shortDomain
+	m.LastActor = actor
+	return m.ReturnErr
+}
+
+func (m *MockShortenerService) SetUntrusted(ctx context.Context, shortDomain, shortKey string, untrusted bool, actor services.Actor) (*domain.URL, error) {
+	m.LastDomain = shortDomain
+	m.LastActor = actor
+	if m.ReturnErr != nil {
+		return nil, m.ReturnErr
+	}
+	return &domain.URL{Domain: shortDomain, ShortKey: shortKey, LongURL: "https://example.com", Owner: "team-a", Untrusted: untrusted, PasswordHash: m.ReturnPasswordHash}, nil
+}
+
+func (m *MockShortenerService) Shorten(ctx context.Context, params services.ShortenParams) (*domain.URL, bool, error) {
+	m.LastDomain = params.Domain
+	m.LastParams = params
+	if m.ReturnErr != nil {
+		return nil, false, m.ReturnErr
+	}
+	return &domain.URL{Domain: params.Domain, ShortKey: m.ReturnKey, LongURL: params.LongURL, Signed: params.Signed}, !m.ReturnExisting, nil
+}
+
+func (m *MockShortenerService) ShortenBatch(ctx context.Context, items []services.ShortenParams) ([]services.BatchResult, error) {
+	m.LastItems = items
+	if m.ReturnErr != nil {
+		return nil, m.ReturnErr
+	}
+	results := make([]services.BatchResult, len(items))
+	for i, params := range items {
+		if err := m.ItemErrs[params.LongURL]; err != nil {
+			results[i].Err = err
+			continue
+		}
+		results[i].URL = &domain.URL{Domain: params.Domain, ShortKey: fmt.Sprintf("%s%d", m.ReturnKey, i), LongURL: params.LongURL, Signed: params.Signed}
+		results[i].Created = !m.ReturnExisting
+	}
+	return results, nil
+}
+
+func (m *MockShortenerService) SubmitJob(ctx context.Context, items []services.ShortenParams, actor services.Actor) (*storage.Job, error) {
+	m.LastItems = items
+	m.LastActor = actor
+	if m.ReturnErr != nil {
+		return nil, m.ReturnErr
+	}
+	return m.ReturnJob, nil
+}
+
+func (m *MockShortenerService) GetJob(ctx context.Context, id string, actor services.Actor) (*storage.Job, error) {
+	m.LastActor = actor
+	if m.ReturnErr != nil {
+		return nil, m.ReturnErr
+	}
+	return m.ReturnJob, nil
+}
+
+func TestHandleShortener(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	testCases := []struct {
+		name               string
+		body               string
+		mockReturnKey      string
+		mockReturnErr      error
+		mockReturnExisting bool
+		expectedStatusCode int
+		expectedShortURL   string
+		expectedCode       problem.Code
+	}{
+		{
+			name:               "Success - URL Shortened",
+			body:               `{"url":"https://example.com/long/url"}`,
+			mockReturnKey:      "abc123",
+			expectedStatusCode: http.StatusCreated,
+			expectedShortURL:   "http://localhost:8081/abc123",
+		},
+		{
+			name:               "Success - Branded Domain",
+			body:               `{"url":"https://example.com/long/url","domain":"go.duss.io"}`,
+			mockReturnKey:      "abc123",
+			expectedStatusCode: http.StatusCreated,
+			expectedShortURL:   "http://go.duss.io/abc123",
+		},
+		{
+			name:               "Success - Existing Link",
+			body:               `{"url":"https://example.com/long/url"}`,
+			mockReturnKey:      "abc123",
+			mockReturnExisting: true,
+			expectedStatusCode: http.StatusOK,
+			expectedShortURL:   "http://localhost:8081/abc123",
+		},
+		{
+			name:               "Domain Not Allowed",
+			body:               `{"url":"https://example.com/long/url","domain":"evil.example"}`,
+			mockReturnErr:      services.ErrDomainNotAllowed,
+			expectedStatusCode: http.StatusBadRequest,
+			expectedCode:       problem.CodeInvalidRequest,
+		},
+		{
+			name:               "Foreign Owner",
+			body:               `{"url":"https://example.com/long/url","owner":"team-a"}`,
+			expectedStatusCode: http.StatusForbidden,
+			expectedCode:       problem.CodeForbidden,
+		},
+		{
+			name:               "Missing URL",
+			body:               `{}`,
+			expectedStatusCode: http.StatusBadRequest,
+			expectedCode:       problem.CodeInvalidURL,
+		},
+		{
+			name:               "Malformed URL",
+			body:               `{"url":"not a url"}`,
+			expectedStatusCode: http.StatusBadRequest,
+			expectedCode:       problem.CodeInvalidURL,
+		},
+		{
+			name:               "Invalid URL Error",
+			body:               `{"url":"https://example.com"}`,
+			mockReturnErr:      services.ErrInvalidURL,
+			expectedStatusCode: http.StatusBadRequest,
+			expectedCode:       problem.CodeInvalidURL,
+		},
+		{
+			name:               "Blacklisted URL Error",
+			body:               `{"url":"https://example.com"}`,
+			mockReturnErr:      services.ErrBlacklistedURL,
+			expectedStatusCode: http.StatusForbidden,
+			expectedCode:       problem.CodeBlacklisted,
+		},
+		{
+			name:               "Invalid Password Error",
+			body:               `{"url":"https://example.com","password":"x"}`,
+			mockReturnErr:      services.ErrInvalidPassword,
+			expectedStatusCode: http.StatusBadRequest,
+			expectedCode:       problem.CodeInvalidRequest,
+		},
+		{
+			name:               "Duplicated Key Error",
+			body:               `{"url":"https://example.com"}`,
+			mockReturnErr:      services.ErrDuplicatedKey,
+			expectedStatusCode: http.StatusConflict,
+			expectedCode:       problem.CodeAliasTaken,
+		},
+		{
+			name:               "Key-Gen Unavailable",
+			body:               `{"url":"https://example.com"}`,
+			mockReturnErr:      fmt.Errorf("failed to get unique key: %w", services.ErrKeyGenUnavailable),
+			expectedStatusCode: http.StatusServiceUnavailable,
+			expectedCode:       problem.CodeUpstreamUnavailable,
+		},
+		{
+			name:               "Internal Server Error",
+			body:               `{"url":"https://example.com"}`,
+			mockReturnErr:      errors.New("database connection failed"),
+			expectedStatusCode: http.StatusInternalServerError,
+			expectedCode:       problem.CodeInternal,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockService := &MockShortenerService{
+				ReturnKey:      tc.mockReturnKey,
+				ReturnErr:      tc.mockReturnErr,
+				ReturnExisting: tc.mockReturnExisting,
+			}
+
+			shortenerHandler := api.NewShortenerHandler(mockService, "http://localhost:8081")
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodPost, "/api/v1/shorten", strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+
+			c, _ := gin.CreateTestContext(w)
+			c.Request = req
+
+			shortenerHandler.HandleShortener(c)
+
+			if w.Code != tc.expectedStatusCode {
+				t.Errorf("expected status code %d, but got %d", tc.expectedStatusCode, w.Code)
+			}
+
+			if tc.expectedCode != "" {
+				var p problem.Problem
+				if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil || w.Header().Get("Content-Type") != problem.ContentType {
+					t.Fatalf("expected a problem document, but got %q: %s", w.Header().Get("Content-Type"), w.Body.String())
+				}
+				if p.Code != tc.expectedCode || p.Status != tc.expectedStatusCode {
+					t.Errorf("expected a %d %s problem, but got %d %s", tc.expectedStatusCode, tc.expectedCode, p.Status, p.Code)
+				}
+			}
+
+			if tc.expectedShortURL != "" {
+				var resp api.ShortenResponse
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+					t.Fatalf("could not decode response: %v", err)
+				}
+				if resp.ShortURL != tc.expectedShortURL {
+					t.Errorf("expected short URL %s, but got %s", tc.expectedShortURL, resp.ShortURL)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleShortenerDedupeParams(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	testCases := []struct {
+		name             string
+		body             string
+		token            string
+		expectedOwner    string
+		expectedDedupe   *bool
+		expectedPassword string
+	}{
+		{"Service Default", `{"url":"https://example.com","owner":"team-a"}`, "a-token", "team-a", nil, ""},
+		{"Owner From Token", `{"url":"https://example.com"}`, "a-token", "team-a", nil, ""},
+		{"Admin Naming Owner", `{"url":"https://example.com","owner":"team-b"}`, "s3cret", "team-b", nil, ""},
+		{"Force New Key", `{"url":"https://example.com","owner":"team-a","dedupe":false}`, "a-token", "team-a", new(bool), ""},
+		{"Password", `{"url":"https://example.com","password":"hunter2"}`, "", "", nil, "hunter2"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockService := &MockShortenerService{ReturnKey: "abc123"}
+			shortenerHandler := api.NewShortenerHandler(mockService, "http://localhost:8081",
+				api.WithAdminToken("s3cret"), api.WithOwnerTokens(map[string]string{"a-token": "team-a"}))
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request, _ = http.NewRequest(http.MethodPost, "/api/v1/shorten", strings.NewReader(tc.body))
+			c.Request.Header.Set("Content-Type", "application/json")
+			if tc.token != "" {
+				c.Request.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+
+			shortenerHandler.HandleShortener(c)
+
+			got := mockService.LastParams
+			if got.Owner != tc.expectedOwner {
+				t.Errorf("expected owner %q, but got %q", tc.expectedOwner, got.Owner)
+			}
+			if (got.Dedupe == nil) != (tc.expectedDedupe == nil) || got.Dedupe != nil && *got.Dedupe != *tc.expectedDedupe {
+				t.Errorf("expected dedupe %v, but got %v", tc.expectedDedupe, got.Dedupe)
+			}
+			if got.Password != tc.expectedPassword {
+				t.Errorf("expected password %q, but got %q", tc.expectedPassword, got.Password)
+			}
+		})
+	}
+}
+
+func TestHandleShortenerSigned(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	keys, err := linksig.NewKeyring(linksig.Key{ID: "k1", Secret: []byte("0123456789abcdef")})
+	if err != nil {
+		t.Fatalf("could not create keyring: %v", err)
+	}
+	future := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	past := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+
+	testCases := []struct {
+		name               string
+		keys               *linksig.Keyring
+		body               string
+		mockReturnErr      error
+		expectedStatusCode int
+		expectedExpiry     bool
+	}{
+		{"Signed", keys, `{"url":"https://example.com","signed":true}`, nil, http.StatusCreated, false},
+		{"Signed With Expiry", keys, `{"url":"https://example.com","signed":true,"signature_expires_at":"` + future + `"}`, nil, http.StatusCreated, true},
+		{"Expiry In The Past", keys, `{"url":"https://example.com","signed":true,"signature_expires_at":"` + past + `"}`, services.ErrInvalidSignature, http.StatusBadRequest, false},
+		{"Expiry Without Signed", keys, `{"url":"https://example.com","signature_expires_at":"` + future + `"}`, services.ErrInvalidSignature, http.StatusBadRequest, false},
+		{"Signing Not Enabled", nil, `{"url":"https://example.com","signed":true}`, services.ErrSigningDisabled, http.StatusBadRequest, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockService := &MockShortenerService{ReturnKey: "abc123", ReturnErr: tc.mockReturnErr}
+			shortenerHandler := api.NewShortenerHandler(mockService, "http://localhost:8081", api.WithLinkSigner(tc.keys))
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request, _ = http.NewRequest(http.MethodPost, "/api/v1/shorten", strings.NewReader(tc.body))
+			c.Request.Header.Set("Content-Type", "application/json")
+
+			shortenerHandler.HandleShortener(c)
+
+			if w.Code != tc.expectedStatusCode {
+				t.Fatalf("expected status code %d, but got %d: %s", tc.expectedStatusCode, w.Code, w.Body.String())
+			}
+			if w.Code != http.StatusCreated {
+				return
+			}
+			if !mockService.LastParams.Signed {
+				t.Error("expected the service to be asked for a signed link")
+			}
+			if got := !mockService.LastParams.SignatureExpiresAt.IsZero(); got != tc.expectedExpiry {
+				t.Errorf("expected the service to be passed an expiry: %v, but got %v", tc.expectedExpiry, got)
+			}
+
+			var resp api.ShortenResponse
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			segment, ok := strings.CutPrefix(resp.ShortURL, "http://localhost:8081/")
+			if !ok {
+				t.Fatalf("expected a short URL on localhost:8081, but got %q", resp.ShortURL)
+			}
+			key, token, signed := linksig.Split(segment)
+			if key != "abc123" || !signed {
+				t.Fatalf("expected a signed short URL for abc123, but got %q", resp.ShortURL)
+			}
+			if err := keys.Verify("localhost:8081", key, token, time.Now()); err != nil {
+				t.Errorf("expected a valid signature, but got %v", err)
+			}
+			if expiring := strings.Count(token, ".") == 2; expiring != tc.expectedExpiry {
+				t.Errorf("expected expiring=%v, but got token %q", tc.expectedExpiry, token)
+			}
+		})
+	}
+}
+
+func TestHandleGetURL(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	testCases := []struct {
+		name               string
+		token              string
+		mockReturnErr      error
+		expectedStatusCode int
+		expectedActor      services.Actor
+	}{
+		{name: "Success - Found", token: "s3cret", expectedStatusCode: http.StatusOK, expectedActor: services.Actor{Admin: true}},
+		{name: "Owner", token: "a-token", expectedStatusCode: http.StatusOK, expectedActor: services.Actor{Owner: "team-a"}},
+		{name: "Forbidden", token: "guess", mockReturnErr: services.ErrForbidden, expectedStatusCode: http.StatusForbidden},
+		{name: "Not Found Error", token: "s3cret", mockReturnErr: services.ErrURLNotFound, expectedStatusCode: http.StatusNotFound, expectedActor: services.Actor{Admin: true}},
+		{name: "Internal Server Error", token: "s3cret", mockReturnErr: errors.New("database connection failed"), expectedStatusCode: http.StatusInternalServerError, expectedActor: services.Actor{Admin: true}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockService := &MockShortenerService{ReturnErr: tc.mockReturnErr}
+			shortenerHandler := api.NewShortenerHandler(mockService, "http://localhost:8081",
+				api.WithAdminToken("s3cret"), api.WithOwnerTokens(map[string]string{"a-token": "team-a"}))
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request, _ = http.NewRequest(http.MethodGet, "/api/v1/urls/abc123?domain=go.duss.io", nil)
+			c.Request.Header.Set("Authorization", "Bearer "+tc.token)
+			c.Params = gin.Params{{Key: "shortKey", Value: "abc123"}}
+
+			shortenerHandler.HandleGetURL(c)
+
+			if w.Code != tc.expectedStatusCode {
+				t.Errorf("expected status code %d, but got %d", tc.expectedStatusCode, w.Code)
+			}
+			if mockService.LastActor != tc.expectedActor {
+				t.Errorf("expected actor %+v, but got %+v", tc.expectedActor, mockService.LastActor)
+			}
+
+			if tc.expectedStatusCode == http.StatusOK {
+				var url domain.URL
+				if err := json.Unmarshal(w.Body.Bytes(), &url); err != nil {
+					t.Fatalf("could not decode response: %v", err)
+				}
+				if url.Domain != "go.duss.io" || url.ShortKey != "abc123" || url.Redirects != 3 {
+					t.Errorf("expected go.duss.io/abc123 with 3 redirects, but got %+v", url)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleGetURLProtected(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	handlers := []struct {
+		name   string
+		method string
+		body   string
+		handle func(*api.ShortenerHandler, *gin.Context)
+	}{
+		{"Get", http.MethodGet, "", (*api.ShortenerHandler).HandleGetURL},
+		{"Set Trust", http.MethodPut, `{"untrusted":true}`, (*api.ShortenerHandler).HandleSetTrust},
+	}
+	testCases := []struct {
+		name            string
+		token           string
+		expectedLongURL string
+		expectedOwner   string
+	}{
+		{"Visitor", "", "", ""},
+		{"Wrong Token", "guess", "", ""},
+		{"Owner", "a-token", "", ""},
+		{"Admin", "s3cret", "https://example.com", "team-a"},
+	}
+
+	for _, handler := range handlers {
+		for _, tc := range testCases {
+			t.Run(handler.name+" "+tc.name, func(t *testing.T) {
+				mockService := &MockShortenerService{ReturnPasswordHash: "$2a$10$hash"}
+				shortenerHandler := api.NewShortenerHandler(mockService, "http://localhost:8081",
+					api.WithAdminToken("s3cret"), api.WithOwnerTokens(map[string]string{"a-token": "team-a"}))
+
+				w := httptest.NewRecorder()
+				c, _ := gin.CreateTestContext(w)
+				c.Request, _ = http.NewRequest(handler.method, "/api/v1/urls/abc123", strings.NewReader(handler.body))
+				c.Request.Header.Set("Content-Type", "application/json")
+				if tc.token != "" {
+					c.Request.Header.Set("Authorization", "Bearer "+tc.token)
+				}
+				c.Params = gin.Params{{Key: "shortKey", Value: "abc123"}}
+
+				handler.handle(shortenerHandler, c)
+
+				if strings.Contains(w.Body.String(), "hash") {
+					t.Errorf("expected the password hash to be withheld, but got %s", w.Body.String())
+				}
+				var url domain.URL
+				if err := json.Unmarshal(w.Body.Bytes(), &url); err != nil {
+					t.Fatalf("could not decode response: %v", err)
+				}
+				if !url.Protected || url.LongURL != tc.expectedLongURL || url.Owner != tc.expectedOwner {
+					t.Errorf("expected a protected link to %q owned by %q, but got %+v", tc.expectedLongURL, tc.expectedOwner, url)
+				}
+			})
+		}
+	}
+}
+
+func TestHandleDelete(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	testCases := []struct {
+		name               string
+		token              string
+		mockReturnErr      error
+		expectedStatusCode int
+		expectedActor      services.Actor
+	}{
+		{name: "Success - Deleted", token: "s3cret", expectedStatusCode: http.StatusNoContent, expectedActor: services.Actor{Admin: true}},
+		{name: "Owner", token: "a-token", expectedStatusCode: http.StatusNoContent, expectedActor: services.Actor{Owner: "team-a"}},
+		{name: "Forbidden", token: "guess", mockReturnErr: services.ErrForbidden, expectedStatusCode: http.StatusForbidden},
+		{name: "Not Found Error", token: "s3cret", mockReturnErr: services.ErrURLNotFound, expectedStatusCode: http.StatusNotFound, expectedActor: services.Actor{Admin: true}},
+		{name: "Internal Server Error", token: "s3cret", mockReturnErr: errors.New("database connection failed"), expectedStatusCode: http.StatusInternalServerError, expectedActor: services.Actor{Admin: true}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockService := &MockShortenerService{ReturnErr: tc.mockReturnErr}
+			shortenerHandler := api.NewShortenerHandler(mockService, "http://localhost:8081",
+				api.WithAdminToken("s3cret"), api.WithOwnerTokens(map[string]string{"a-token": "team-a"}))
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request, _ = http.NewRequest(http.MethodDelete, "/api/v1/urls/abc123?domain=go.duss.io", nil)
+			c.Request.Header.Set("Authorization", "Bearer "+tc.token)
+			c.Params = gin.Params{{Key: "shortKey", Value: "abc123"}}
+
+			shortenerHandler.HandleDelete(c)
+			c.Writer.WriteHeaderNow()
+
+			if w.Code != tc.expectedStatusCode {
+				t.Errorf("expected status code %d, but got %d", tc.expectedStatusCode, w.Code)
+			}
+			if mockService.LastDomain != "go.duss.io" {
+				t.Errorf("expected domain go.duss.io, but got %q", mockService.LastDomain)
+			}
+			if mockService.LastActor != tc.expectedActor {
+				t.Errorf("expected actor %+v, but got %+v", tc.expectedActor, mockService.LastActor)
+			}
+		})
+	}
+}
+
+func TestHandleSetTrust(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	testCases := []struct {
+		name               string
+		body               string
+		token              string
+		mockReturnErr      error
+		expectedStatusCode int
+		expectedActor      services.Actor
+	}{
+		{name: "Owner", body: `{"untrusted":true}`, token: "a-token", expectedStatusCode: http.StatusOK, expectedActor: services.Actor{Owner: "team-a"}},
+		{name: "Claimed Owner", body: `{"untrusted":true,"owner":"team-a"}`, mockReturnErr: services.ErrForbidden, expectedStatusCode: http.StatusForbidden},
+		{name: "Admin", body: `{"untrusted":false}`, token: "s3cret", expectedStatusCode: http.StatusOK, expectedActor: services.Actor{Admin: true}},
+		{name: "Wrong Token", body: `{"untrusted":true}`, token: "guess", mockReturnErr: services.ErrForbidden, expectedStatusCode: http.StatusForbidden},
+		{name: "Missing Flag", body: `{}`, token: "a-token", expectedStatusCode: http.StatusBadRequest},
+		{name: "Not Found Error", body: `{"untrusted":true}`, token: "s3cret", mockReturnErr: services.ErrURLNotFound, expectedStatusCode: http.StatusNotFound, expectedActor: services.Actor{Admin: true}},
+		{name: "Internal Server Error", body: `{"untrusted":true}`, token: "s3cret", mockReturnErr: errors.New("database connection failed"), expectedStatusCode: http.StatusInternalServerError, expectedActor: services.Actor{Admin: true}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockService := &MockShortenerService{ReturnErr: tc.mockReturnErr}
+			shortenerHandler := api.NewShortenerHandler(mockService, "http://localhost:8081",
+				api.WithAdminToken("s3cret"), api.WithOwnerTokens(map[string]string{"a-token": "team-a"}))
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request, _ = http.NewRequest(http.MethodPut, "/api/v1/urls/abc123/trust?domain=go.duss.io", strings.NewReader(tc.body))
+			c.Request.Header.Set("Content-Type", "application/json")
+			if tc.token != "" {
+				c.Request.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			c.Params = gin.Params{{Key: "shortKey", Value: "abc123"}}
+
+			shortenerHandler.HandleSetTrust(c)
+
+			if w.Code != tc.expectedStatusCode {
+				t.Errorf("expected status code %d, but got %d", tc.expectedStatusCode, w.Code)
+			}
+			if mockService.LastActor != tc.expectedActor {
+				t.Errorf("expected actor %+v, but got %+v", tc.expectedActor, mockService.LastActor)
+			}
+
+			if tc.expectedStatusCode == http.StatusOK {
+				var resp domain.URL
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+					t.Fatalf("could not decode response: %v", err)
+				}
+				if resp.Domain != "go.duss.io" {
+					t.Errorf("expected domain go.duss.io, but got %q", resp.Domain)
+				}
+			}
+		})
+	}
+}
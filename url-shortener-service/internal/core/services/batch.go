@@ -0,0 +1,443 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/iton0/duss/shared/domain"
+	"github.com/iton0/duss/shared/httpclient"
+	"github.com/iton0/duss/shared/problem"
+	"github.com/iton0/duss/url-shortener-service/internal/infrastructure/storage"
+)
+
+var (
+	ErrBatchTooLarge = errors.New("too many URLs")
+	ErrJobNotFound   = errors.New("job not found")
+	ErrJobsDisabled  = errors.New("shorten jobs not enabled")
+	ErrJobForbidden  = errors.New("not allowed to read this job")
+)
+
+const (
+	// DefaultMaxBatchItems is how many URLs ShortenBatch accepts at once
+	// unless WithBatchLimits says otherwise.
+	DefaultMaxBatchItems = 1000
+	// DefaultMaxJobItems is how many URLs SubmitJob accepts at once unless
+	// WithBatchLimits says otherwise.
+	DefaultMaxJobItems = 100000
+	// DefaultJobStaleAfter is how long a running job may go without an
+	// update before it is taken for abandoned, unless WithJobStaleAfter
+	// says otherwise.
+	DefaultJobStaleAfter = 2 * time.Minute
+
+	// keyGenBatchSize is the most keys the key-gen-service hands out per
+	// request.
+	keyGenBatchSize = 1000
+	// prepareWorkers bounds how many items of a batch are validated at once.
+	// Validation may resolve hosts, so it is worth overlapping.
+	prepareWorkers = 8
+)
+
+// itemErrors are the errors a BatchResult or JobResult may carry.
+var itemErrors = []error{
+	ErrInvalidURL,
+	ErrBlacklistedURL,
+	ErrDuplicatedKey,
+	ErrDomainNotAllowed,
+	ErrInvalidPassword,
+	ErrSigningDisabled,
+	ErrInvalidSignature,
+	ErrServiceError,
+	ErrKeyGenUnavailable,
+}
+
+// BatchResult is the outcome of one item of ShortenBatch: the link and
+// whether it was created, as Shorten returns them, or the item's error.
+type BatchResult struct {
+	URL     *domain.URL
+	Created bool
+	Err     error
+}
+
+// KeyGenBatchRequest is the request body of the key-gen-service's bulk
+// endpoint.
+type KeyGenBatchRequest struct {
+	URLs []string `json:"urls"`
+}
+
+// KeyGenBatchResponse is the response body of the key-gen-service's bulk
+// endpoint.
+type KeyGenBatchResponse struct {
+	ShortKeys []string `json:"short_keys"`
+}
+
+// WithBatchLimits sets how many URLs ShortenBatch and SubmitJob accept.
+// Values that are not positive keep the defaults.
+func WithBatchLimits(maxBatchItems, maxJobItems int) Option {
+	return func(s *ShortenerService) {
+		if maxBatchItems > 0 {
+			s.maxBatchItems = maxBatchItems
+		}
+		if maxJobItems > 0 {
+			s.maxJobItems = maxJobItems
+		}
+	}
+}
+
+// WithJobStore enables SubmitJob and GetJob, keeping jobs in js.
+func WithJobStore(js storage.JobStore) Option {
+	return func(s *ShortenerService) {
+		s.jobs = js
+	}
+}
+
+// WithJobStaleAfter sets how long a running job may go without an update
+// before it is taken for abandoned and failed. Its replica renews the job
+// four times as often. Values that are not positive keep the default.
+func WithJobStaleAfter(d time.Duration) Option {
+	return func(s *ShortenerService) {
+		if d > 0 {
+			s.jobStaleAfter = d
+		}
+	}
+}
+
+// ShortenBatch shortens each of items as Shorten would, with one request to
+// the key-gen-service and one insert for the whole batch. An item that fails
+// does not fail the others: its error is reported in its result, which has
+// the same index as the item. It returns ErrBatchTooLarge for batches over
+// the limit.
+func (s *ShortenerService) ShortenBatch(ctx context.Context, items []ShortenParams) ([]BatchResult, error) {
+	if len(items) > s.maxBatchItems {
+		return nil, ErrBatchTooLarge
+	}
+	return s.shortenBatch(ctx, items), nil
+}
+
+func (s *ShortenerService) shortenBatch(ctx context.Context, items []ShortenParams) []BatchResult {
+	results := make([]BatchResult, len(items))
+	prepared := make([]*domain.URL, len(items))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, prepareWorkers)
+	for i, params := range items {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			newURL, existing, err := s.prepare(ctx, params)
+			switch {
+			case err != nil:
+				results[i].Err = itemError(ctx, err)
+			case existing != nil:
+				results[i].URL = existing
+			default:
+				prepared[i] = newURL
+			}
+		}()
+	}
+	wg.Wait()
+
+	var (
+		pending []int
+		urls    []string
+	)
+	for i, newURL := range prepared {
+		if newURL != nil {
+			pending = append(pending, i)
+			urls = append(urls, newURL.CanonicalURL)
+		}
+	}
+	if len(pending) == 0 {
+		return results
+	}
+	fail := func(err error) []BatchResult {
+		slog.ErrorContext(ctx, "unexpected server error", "error", err)
+		reported := ErrServiceError
+		if errors.Is(err, ErrKeyGenUnavailable) {
+			reported = ErrKeyGenUnavailable
+		}
+		for _, i := range pending {
+			results[i].Err = reported
+		}
+		return results
+	}
+
+	keys, err := s.getUniqueKeys(ctx, urls)
+	if err != nil {
+		return fail(fmt.Errorf("failed to get unique keys: %w", err))
+	}
+	batch := make([]*domain.URL, len(pending))
+	for j, i := range pending {
+		prepared[i].ShortKey = keys[j]
+		batch[j] = prepared[i]
+	}
+	errs, err := s.storage.SaveBatch(ctx, batch)
+	if err != nil {
+		return fail(err)
+	}
+	for j, i := range pending {
+		// An item whose dedupe key an earlier item took resolves to that
+		// item's link, just as a concurrent Shorten would.
+		url, created, err := s.saved(ctx, batch[j], errs[j])
+		results[i] = BatchResult{URL: url, Created: created, Err: err}
+	}
+	return results
+}
+
+// itemError reduces err to the one of itemErrors it wraps.
+func itemError(ctx context.Context, err error) error {
+	for _, sentinel := range itemErrors {
+		if errors.Is(err, sentinel) {
+			return sentinel
+		}
+	}
+	slog.ErrorContext(ctx, "unexpected server error", "error", err)
+	return ErrServiceError
+}
+
+// ResultError returns the error a JobResult records, as one of the errors
+// ShortenBatch reports, or nil if the item succeeded.
+func ResultError(result storage.JobResult) error {
+	if result.Error == "" {
+		return nil
+	}
+	for _, sentinel := range itemErrors {
+		if result.Error == sentinel.Error() {
+			return sentinel
+		}
+	}
+	return ErrServiceError
+}
+
+// SubmitJob starts shortening items in the background for actor and returns
+// the job tracking them, whose progress GetJob reports. Items are shortened
+// in batches of the ShortenBatch limit, outliving ctx. A job whose replica
+// stops before it is done fails once it goes stale; its items may be
+// submitted again.
+func (s *ShortenerService) SubmitJob(ctx context.Context, items []ShortenParams, actor Actor) (*storage.Job, error) {
+	if s.jobs == nil {
+		return nil, ErrJobsDisabled
+	}
+	if len(items) > s.maxJobItems {
+		return nil, ErrBatchTooLarge
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		slog.ErrorContext(ctx, "failed to generate job ID", "error", err)
+		return nil, ErrServiceError
+	}
+	now := time.Now()
+	job := &storage.Job{
+		ID:        hex.EncodeToString(id),
+		Status:    storage.JobRunning,
+		Owner:     actor.Owner,
+		Total:     len(items),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := s.jobs.CreateJob(ctx, job); err != nil {
+		slog.ErrorContext(ctx, "unexpected server error", "error", err)
+		return nil, ErrServiceError
+	}
+
+	submitted := *job
+	s.running.Go(func() {
+		s.runJob(context.WithoutCancel(ctx), job, items)
+	})
+	return &submitted, nil
+}
+
+// Wait waits for the jobs being processed to finish, returning ctx's error
+// if it is done first. Jobs still running then fail once they go stale, as
+// when their replica stops.
+func (s *ShortenerService) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// runJob shortens the items of job, saving its progress after each batch
+// and its results once it is done. It gives up if the job was failed as
+// stale meanwhile.
+func (s *ShortenerService) runJob(ctx context.Context, job *storage.Job, items []ShortenParams) {
+	stop := s.keepAlive(ctx, job.ID)
+	defer stop()
+
+	results := make([]storage.JobResult, 0, len(items))
+	for start := 0; start < len(items); start += s.maxBatchItems {
+		chunk := items[start:min(start+s.maxBatchItems, len(items))]
+		for i, r := range s.shortenBatch(ctx, chunk) {
+			result := storage.JobResult{Index: start + i}
+			if r.Err != nil {
+				result.Error = r.Err.Error()
+				job.Failed++
+			} else {
+				result.Domain = r.URL.Domain
+				result.ShortKey = r.URL.ShortKey
+				result.Created = r.Created
+				result.Signed = r.URL.Signed
+				if r.URL.Signed {
+					result.SignatureExpiresAt = chunk[i].SignatureExpiresAt
+				}
+			}
+			results = append(results, result)
+		}
+
+		job.Processed = len(results)
+		if job.Processed == job.Total {
+			break
+		}
+		job.UpdatedAt = time.Now()
+		if err := s.jobs.UpdateJob(ctx, job); errors.Is(err, storage.ErrNotFound) {
+			slog.WarnContext(ctx, "job: abandoned after it went stale", "job", job.ID)
+			return
+		} else if err != nil {
+			slog.WarnContext(ctx, "job: failed to save progress", "job", job.ID, "error", err)
+		}
+	}
+
+	job.Status = storage.JobDone
+	job.Results = results
+	job.UpdatedAt = time.Now()
+	if err := s.jobs.UpdateJob(ctx, job); err != nil {
+		slog.ErrorContext(ctx, "job: failed to save results", "job", job.ID, "error", err)
+		return
+	}
+	slog.InfoContext(ctx, "job: finished", "job", job.ID, "shortened", job.Total-job.Failed, "failed", job.Failed)
+}
+
+// keepAlive renews the lease of the job with id until the returned stop is
+// called, so that a slow batch does not make the job look abandoned.
+func (s *ShortenerService) keepAlive(ctx context.Context, id string) (stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(s.jobStaleAfter / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				if err := s.jobs.TouchJob(ctx, id, now); err != nil && ctx.Err() == nil {
+					slog.WarnContext(ctx, "job: failed to renew lease", "job", id, "error", err)
+				}
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// FailStaleJobs fails the running jobs that have gone stale, whose replica
+// stopped before they were done. It returns how many it failed.
+func (s *ShortenerService) FailStaleJobs(ctx context.Context) (int64, error) {
+	if s.jobs == nil {
+		return 0, nil
+	}
+	n, err := s.jobs.FailStaleJobs(ctx, time.Now().Add(-s.jobStaleAfter))
+	if err != nil {
+		slog.ErrorContext(ctx, "unexpected server error", "error", err)
+		return 0, ErrServiceError
+	}
+	if n > 0 {
+		slog.InfoContext(ctx, "job: failed stale jobs", "count", n)
+	}
+	return n, nil
+}
+
+// GetJob returns the job with id as SubmitJob started it, with its progress
+// so far. A running job that has gone stale is reported as failed. Only an
+// administrator or the job's owner may read an owned job; anyone holding
+// its ID may read an anonymous one, or it returns ErrJobForbidden.
+func (s *ShortenerService) GetJob(ctx context.Context, id string, actor Actor) (*storage.Job, error) {
+	if s.jobs == nil {
+		return nil, ErrJobsDisabled
+	}
+	job, err := s.jobs.GetJob(ctx, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			return nil, ErrJobNotFound
+		default:
+			slog.ErrorContext(ctx, "unexpected server error", "error", err)
+			return nil, ErrServiceError
+		}
+	}
+	if !actor.Admin && job.Owner != "" && job.Owner != actor.Owner {
+		return nil, ErrJobForbidden
+	}
+	if job.Status == storage.JobRunning && time.Since(job.UpdatedAt) > s.jobStaleAfter {
+		job.Status = storage.JobFailed
+	}
+	return job, nil
+}
+
+// getUniqueKeys obtains a unique key for each of urls from the
+// key-gen-service, in as few requests as its batch limit allows.
+func (s *ShortenerService) getUniqueKeys(ctx context.Context, urls []string) ([]string, error) {
+	keys := make([]string, 0, len(urls))
+	for start := 0; start < len(urls); start += keyGenBatchSize {
+		chunk := urls[start:min(start+keyGenBatchSize, len(urls))]
+
+		body, err := json.Marshal(KeyGenBatchRequest{URLs: chunk})
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal request body: %w", err)
+		}
+		req, err := http.NewRequestWithContext(httpclient.Idempotent(ctx), http.MethodPost, s.keyGenService+"/api/v1/generate-keys", bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := s.keyGen.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrKeyGenUnavailable, err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			err := fmt.Errorf("%w: %w", ErrKeyGenUnavailable, problem.FromResponse(resp))
+			resp.Body.Close()
+			return nil, err
+		}
+		var keyResp KeyGenBatchResponse
+		err = json.NewDecoder(resp.Body).Decode(&keyResp)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode key-gen-service response: %w", err)
+		}
+		if len(keyResp.ShortKeys) != len(chunk) {
+			return nil, fmt.Errorf("key-gen-service returned %d keys for %d URLs", len(keyResp.ShortKeys), len(chunk))
+		}
+		for _, key := range keyResp.ShortKeys {
+			if key == "" {
+				return nil, errors.New("key-gen-service returned an empty key")
+			}
+		}
+		keys = append(keys, keyResp.ShortKeys...)
+	}
+	return keys, nil
+}
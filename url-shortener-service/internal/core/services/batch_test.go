@@ -0,0 +1,248 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/iton0/duss/url-shortener-service/internal/infrastructure/storage"
+	"github.com/iton0/duss/url-shortener-service/internal/infrastructure/storage/mock"
+)
+
+func TestShortenBatch(t *testing.T) {
+	ctx := context.Background()
+	keyGen := newSequentialKeyGenServer(t)
+	store := mock.NewMockPostgresStorage()
+	shortenerService := NewShortenerService(store, keyGen.URL, WithDedupe(), WithDomains("duss.io"), WithBatchLimits(5, 0))
+
+	existing, _, err := shortenerService.Shorten(ctx, ShortenParams{LongURL: "https://example.com/old"})
+	if err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+
+	results, err := shortenerService.ShortenBatch(ctx, []ShortenParams{
+		{LongURL: "https://example.com/a"},
+		{LongURL: "not a url"},
+		{LongURL: "https://example.com/old"},
+		{LongURL: "https://example.com/b", Domain: "other.io"},
+		{LongURL: "https://EXAMPLE.com/a"},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+
+	testCases := []struct {
+		name            string
+		expectedErr     error
+		expectedCreated bool
+		expectedKey     string
+	}{
+		{"New Link", nil, true, ""},
+		{"Invalid URL", ErrInvalidURL, false, ""},
+		{"Existing Link", nil, false, existing.ShortKey},
+		{"Domain Not Allowed", ErrDomainNotAllowed, false, ""},
+		{"Duplicate Within Batch", nil, false, results[0].URL.ShortKey},
+	}
+	for i, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := results[i]
+			if !errors.Is(got.Err, tc.expectedErr) {
+				t.Fatalf("expected %v, but got %v", tc.expectedErr, got.Err)
+			}
+			if got.Err != nil {
+				return
+			}
+			if got.Created != tc.expectedCreated {
+				t.Errorf("expected created=%v, but got %v", tc.expectedCreated, got.Created)
+			}
+			if tc.expectedKey != "" && got.URL.ShortKey != tc.expectedKey {
+				t.Errorf("expected key %q, but got %q", tc.expectedKey, got.URL.ShortKey)
+			}
+		})
+	}
+	if store.Batches != 1 {
+		t.Errorf("expected the batch to be saved at once, but got %d calls", store.Batches)
+	}
+
+	if _, err := shortenerService.ShortenBatch(ctx, make([]ShortenParams, 6)); !errors.Is(err, ErrBatchTooLarge) {
+		t.Errorf("expected ErrBatchTooLarge, but got %v", err)
+	}
+}
+
+func TestShortenBatchKeyGenFailure(t *testing.T) {
+	keyGen := newKeyGenServer(t, http.StatusInternalServerError, "")
+	shortenerService := NewShortenerService(mock.NewMockPostgresStorage(), keyGen.URL)
+
+	results, err := shortenerService.ShortenBatch(context.Background(), []ShortenParams{
+		{LongURL: "https://example.com/a"},
+		{LongURL: "not a url"},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	if !errors.Is(results[0].Err, ErrKeyGenUnavailable) || !errors.Is(results[1].Err, ErrInvalidURL) {
+		t.Errorf("expected ErrKeyGenUnavailable and ErrInvalidURL, but got %v and %v", results[0].Err, results[1].Err)
+	}
+}
+
+func TestSubmitJob(t *testing.T) {
+	ctx := context.Background()
+	keyGen := newSequentialKeyGenServer(t)
+	store := mock.NewMockPostgresStorage()
+	shortenerService := NewShortenerService(store, keyGen.URL, WithJobStore(store), WithBatchLimits(2, 5), WithSignedLinks())
+
+	expires := time.Now().Add(time.Hour).UTC()
+	owner := Actor{Owner: "team-a"}
+	job, err := shortenerService.SubmitJob(ctx, []ShortenParams{
+		{LongURL: "https://example.com/a"},
+		{LongURL: "not a url"},
+		{LongURL: "https://example.com/c", Signed: true, SignatureExpiresAt: expires},
+	}, owner)
+	if err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	if job.Status != storage.JobRunning || job.Total != 3 || job.Owner != "team-a" {
+		t.Errorf("expected a running job of 3 items for team-a, but got %+v", job)
+	}
+
+	// Waiting for the running jobs lets them finish.
+	waitCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := shortenerService.Wait(waitCtx); err != nil {
+		t.Fatalf("expected the job to finish, but got %v", err)
+	}
+	if job, err = shortenerService.GetJob(ctx, job.ID, owner); err != nil || job.Status != storage.JobDone {
+		t.Fatalf("expected a finished job, but got %+v (%v)", job, err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for job.Status != storage.JobDone {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the job to finish, but it processed %d of %d", job.Processed, job.Total)
+		}
+		time.Sleep(10 * time.Millisecond)
+		if job, err = shortenerService.GetJob(ctx, job.ID, owner); err != nil {
+			t.Fatalf("expected no error, but got %v", err)
+		}
+	}
+
+	if job.Processed != 3 || job.Failed != 1 || len(job.Results) != 3 {
+		t.Fatalf("expected 3 results with 1 failure, but got %+v", job)
+	}
+	if r := job.Results[0]; r.ShortKey == "" || !r.Created || ResultError(r) != nil {
+		t.Errorf("expected a new link, but got %+v", r)
+	}
+	if r := job.Results[1]; r.Index != 1 || ResultError(r) != ErrInvalidURL {
+		t.Errorf("expected ErrInvalidURL, but got %+v", r)
+	}
+	if r := job.Results[2]; r.Index != 2 || !r.Signed || !r.SignatureExpiresAt.Equal(expires) {
+		t.Errorf("expected a signed link expiring at %s, but got %+v", expires, r)
+	}
+
+	if _, err := shortenerService.SubmitJob(ctx, make([]ShortenParams, 6), owner); !errors.Is(err, ErrBatchTooLarge) {
+		t.Errorf("expected ErrBatchTooLarge, but got %v", err)
+	}
+	if _, err := shortenerService.GetJob(ctx, "missing", owner); !errors.Is(err, ErrJobNotFound) {
+		t.Errorf("expected ErrJobNotFound, but got %v", err)
+	}
+	if _, err := NewShortenerService(store, keyGen.URL).SubmitJob(ctx, nil, owner); !errors.Is(err, ErrJobsDisabled) {
+		t.Errorf("expected ErrJobsDisabled, but got %v", err)
+	}
+}
+
+func TestGetJobAccess(t *testing.T) {
+	ctx := context.Background()
+	store := mock.NewMockPostgresStorage()
+	shortenerService := NewShortenerService(store, "", WithJobStore(store))
+
+	now := time.Now()
+	for _, job := range []*storage.Job{
+		{ID: "owned", Status: storage.JobDone, Owner: "team-a", CreatedAt: now, UpdatedAt: now},
+		{ID: "anonymous", Status: storage.JobDone, CreatedAt: now, UpdatedAt: now},
+	} {
+		if err := store.CreateJob(ctx, job); err != nil {
+			t.Fatalf("could not create job: %v", err)
+		}
+	}
+
+	testCases := []struct {
+		name        string
+		id          string
+		actor       Actor
+		expectedErr error
+	}{
+		{"Owner", "owned", Actor{Owner: "team-a"}, nil},
+		{"Admin", "owned", Actor{Admin: true}, nil},
+		{"Other Owner", "owned", Actor{Owner: "team-b"}, ErrJobForbidden},
+		{"Anonymous Reading Owned", "owned", Actor{}, ErrJobForbidden},
+		{"Anonymous Job", "anonymous", Actor{}, nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := shortenerService.GetJob(ctx, tc.id, tc.actor); !errors.Is(err, tc.expectedErr) {
+				t.Errorf("expected %v, but got %v", tc.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestStaleJobs(t *testing.T) {
+	ctx := context.Background()
+	store := mock.NewMockPostgresStorage()
+	shortenerService := NewShortenerService(store, "", WithJobStore(store), WithJobStaleAfter(time.Minute))
+
+	now := time.Now()
+	for _, job := range []*storage.Job{
+		{ID: "stale", Status: storage.JobRunning, CreatedAt: now.Add(-time.Hour), UpdatedAt: now.Add(-2 * time.Minute)},
+		{ID: "live", Status: storage.JobRunning, CreatedAt: now.Add(-time.Hour), UpdatedAt: now},
+	} {
+		if err := store.CreateJob(ctx, job); err != nil {
+			t.Fatalf("could not create job: %v", err)
+		}
+	}
+
+	// A stale job is reported as failed even before it is swept.
+	if job, err := shortenerService.GetJob(ctx, "stale", Actor{}); err != nil || job.Status != storage.JobFailed {
+		t.Errorf("expected the stale job to be failed, but got %+v (%v)", job, err)
+	}
+	if job, err := shortenerService.GetJob(ctx, "live", Actor{}); err != nil || job.Status != storage.JobRunning {
+		t.Errorf("expected the live job to be running, but got %+v (%v)", job, err)
+	}
+
+	if n, err := shortenerService.FailStaleJobs(ctx); err != nil || n != 1 {
+		t.Fatalf("expected 1 stale job to be failed, but got %d (%v)", n, err)
+	}
+	if job, _ := store.GetJob(ctx, "stale"); job.Status != storage.JobFailed {
+		t.Errorf("expected the stale job to be stored as failed, but got %s", job.Status)
+	}
+	// Its replica, should it come back, can no longer update it.
+	if err := store.UpdateJob(ctx, &storage.Job{ID: "stale", Status: storage.JobDone}); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("expected ErrNotFound, but got %v", err)
+	}
+}
+
+func TestJobLease(t *testing.T) {
+	ctx := context.Background()
+	store := mock.NewMockPostgresStorage()
+	shortenerService := NewShortenerService(store, "", WithJobStore(store), WithJobStaleAfter(40*time.Millisecond))
+
+	created := time.Now()
+	if err := store.CreateJob(ctx, &storage.Job{ID: "job1", Status: storage.JobRunning, CreatedAt: created, UpdatedAt: created}); err != nil {
+		t.Fatalf("could not create job: %v", err)
+	}
+
+	stop := shortenerService.keepAlive(ctx, "job1")
+	time.Sleep(100 * time.Millisecond)
+	stop()
+
+	job, err := store.GetJob(ctx, "job1")
+	if err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	if job.Status != storage.JobRunning || !job.UpdatedAt.After(created) {
+		t.Errorf("expected the job's lease to be renewed, but got %+v", job)
+	}
+}
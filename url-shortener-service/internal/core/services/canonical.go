@@ -0,0 +1,231 @@
+package services
+
+import (
+	"net"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// defaultPorts are the ports dropped from a canonical URL's host because they
+// are implied by its scheme.
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+// trackingParams are query parameters that only identify where a click came
+// from and never change the resource a URL points at.
+var trackingParams = map[string]bool{
+	"fbclid": true,
+	"gclid":  true,
+}
+
+// idnaProfile maps internationalized host names to punycode. Hosts that are
+// not valid DNS names, such as ones containing underscores, are left to the
+// resolver rather than rejected here.
+var idnaProfile = idna.New(idna.MapForLookup(), idna.StrictDomainName(false))
+
+// Canonicalize returns the canonical form of rawURL, so that URLs which point
+// at the same resource compare equal. It lowercases the scheme and host,
+// converts internationalized hosts to punycode, drops the scheme's default
+// port, resolves "." and ".." path segments, normalizes percent-encoding and
+// drops an empty query or fragment. When stripTracking is set, utm_*, fbclid
+// and gclid query parameters are removed too.
+//
+// It returns ErrInvalidURL if rawURL is not an absolute URL with a host.
+func Canonicalize(rawURL string, stripTracking bool) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil || u.Scheme == "" || u.Host == "" || u.Opaque != "" {
+		return "", ErrInvalidURL
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	host, err := canonicalHost(scheme, u.Hostname(), u.Port())
+	if err != nil {
+		return "", ErrInvalidURL
+	}
+
+	var b strings.Builder
+	b.WriteString(scheme)
+	b.WriteString("://")
+	if u.User != nil {
+		b.WriteString(u.User.String())
+		b.WriteByte('@')
+	}
+	b.WriteString(host)
+
+	path := removeDotSegments(normalizeEscapes(u.EscapedPath()))
+	if path == "" {
+		path = "/"
+	}
+	b.WriteString(path)
+
+	query := u.RawQuery
+	if stripTracking {
+		query = stripTrackingParams(query)
+	}
+	if query = normalizeEscapes(query); query != "" {
+		b.WriteByte('?')
+		b.WriteString(query)
+	}
+
+	if fragment := normalizeEscapes(u.EscapedFragment()); fragment != "" {
+		b.WriteByte('#')
+		b.WriteString(fragment)
+	}
+
+	return b.String(), nil
+}
+
+// canonicalHost lowercases hostname, converts it to punycode when it is
+// internationalized and appends port unless it is the scheme's default.
+func canonicalHost(scheme, hostname, port string) (string, error) {
+	hostname = strings.TrimSuffix(strings.ToLower(hostname), ".")
+	if hostname == "" {
+		return "", ErrInvalidURL
+	}
+
+	if !isASCII(hostname) {
+		ascii, err := idnaProfile.ToASCII(hostname)
+		if err != nil {
+			return "", err
+		}
+		hostname = ascii
+	}
+
+	switch {
+	case port != "" && port != defaultPorts[scheme]:
+		return net.JoinHostPort(hostname, port), nil
+	case strings.Contains(hostname, ":"):
+		// IPv6 literals keep their brackets.
+		return "[" + hostname + "]", nil
+	default:
+		return hostname, nil
+	}
+}
+
+// stripTrackingParams removes tracking parameters from a raw query string,
+// leaving the order and encoding of the others untouched.
+func stripTrackingParams(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+
+	kept := make([]string, 0, strings.Count(rawQuery, "&")+1)
+	for _, param := range strings.Split(rawQuery, "&") {
+		name, _, _ := strings.Cut(param, "=")
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "utm_") || trackingParams[name] {
+			continue
+		}
+		kept = append(kept, param)
+	}
+	return strings.Join(kept, "&")
+}
+
+// normalizeEscapes rewrites s so that unreserved characters are never
+// percent-encoded, every other escape uses upper-case hex, and bytes that may
+// not appear literally in a URL are escaped.
+func normalizeEscapes(s string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '%' && i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2]):
+			decoded := unhex(s[i+1])<<4 | unhex(s[i+2])
+			if isUnreserved(decoded) {
+				b.WriteByte(decoded)
+			} else {
+				writeEscape(&b, decoded)
+			}
+			i += 2
+		case c == '%' || !isAllowed(c):
+			writeEscape(&b, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// removeDotSegments resolves "." and ".." segments in an absolute path as
+// described in RFC 3986, section 5.2.4. Unlike path.Clean, it preserves empty
+// segments and trailing slashes, which servers may treat as significant.
+func removeDotSegments(path string) string {
+	if !strings.Contains(path, ".") {
+		return path
+	}
+
+	var out []string
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		last := i == len(segments)-1
+		switch segment {
+		case ".":
+			if last {
+				out = append(out, "")
+			}
+		case "..":
+			if len(out) > 1 {
+				out = out[:len(out)-1]
+			}
+			if last {
+				out = append(out, "")
+			}
+		default:
+			out = append(out, segment)
+		}
+	}
+	return strings.Join(out, "/")
+}
+
+const upperHex = "0123456789ABCDEF"
+
+func writeEscape(b *strings.Builder, c byte) {
+	b.WriteByte('%')
+	b.WriteByte(upperHex[c>>4])
+	b.WriteByte(upperHex[c&0x0f])
+}
+
+// isUnreserved reports whether c is an RFC 3986 unreserved character.
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+// isAllowed reports whether c may appear unescaped in a URL path, query or
+// fragment.
+func isAllowed(c byte) bool {
+	return isUnreserved(c) || strings.IndexByte("!$&'()*+,;=:@/?", c) >= 0
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
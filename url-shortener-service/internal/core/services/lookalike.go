@@ -0,0 +1,312 @@
+package services
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/net/publicsuffix"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Lookalike explains why a host was judged to imitate another.
+type Lookalike struct {
+	// Label is the flagged label of the host, in Unicode.
+	Label string
+	// Protected is the protected domain the label imitates. It is empty when
+	// the label was flagged for mixing scripts.
+	Protected string
+	// Reason is "mixed scripts", "confusable" or "edit distance N".
+	Reason string
+}
+
+func (l Lookalike) String() string {
+	if l.Protected == "" {
+		return fmt.Sprintf("%q: %s", l.Label, l.Reason)
+	}
+	return fmt.Sprintf("%q imitates %s: %s", l.Label, l.Protected, l.Reason)
+}
+
+// LookalikeDetector flags hosts that are built to be mistaken for another:
+// labels mixing scripts, such as a Cyrillic "а" among Latin letters, and
+// labels that read like a protected brand domain without being it.
+type LookalikeDetector struct {
+	protected []protectedDomain
+}
+
+// protectedDomain is a brand domain prepared for comparison.
+type protectedDomain struct {
+	domain   string // Registrable domain, such as "paypal.com"
+	name     string // Its label before the public suffix, such as "paypal"
+	skeleton string
+}
+
+// NewLookalikeDetector returns a detector protecting domains. Each entry is
+// reduced to its registrable domain, so "login.paypal.com" protects
+// "paypal.com" and all of its subdomains.
+func NewLookalikeDetector(domains ...string) *LookalikeDetector {
+	d := &LookalikeDetector{}
+	for _, domain := range domains {
+		ascii, ok := toASCIIHost(domain)
+		if !ok {
+			continue
+		}
+		registrable := registrableDomain(ascii)
+		name, _, _ := strings.Cut(registrable, ".")
+		name = toUnicodeLabel(name)
+		d.protected = append(d.protected, protectedDomain{
+			domain:   registrable,
+			name:     name,
+			skeleton: Skeleton(name),
+		})
+	}
+	return d
+}
+
+// Check reports whether host looks like a protected domain it is not, or has
+// a label that mixes scripts. Hosts on a protected domain and IP addresses
+// are never flagged.
+func (d *LookalikeDetector) Check(host string) (Lookalike, bool) {
+	ascii, ok := toASCIIHost(host)
+	if !ok || net.ParseIP(strings.Trim(ascii, "[]")) != nil {
+		return Lookalike{}, false
+	}
+	for _, p := range d.protected {
+		if ascii == p.domain || strings.HasSuffix(ascii, "."+p.domain) {
+			return Lookalike{}, false
+		}
+	}
+
+	registrable := registrableDomain(ascii)
+	name, _, _ := strings.Cut(registrable, ".")
+	name = toUnicodeLabel(name)
+
+	// The registrable name is what a reader takes the site to be, so it is
+	// compared with each brand most closely.
+	skeleton := Skeleton(name)
+	for _, p := range d.protected {
+		if name == p.name {
+			continue // The brand's name under another suffix.
+		}
+		if skeleton == p.skeleton {
+			return Lookalike{Label: name, Protected: p.domain, Reason: "confusable"}, true
+		}
+		if limit := maxEditDistance(p.name); limit > 0 {
+			// Typos are counted on the name as written, and look-alike
+			// characters on the skeleton.
+			if n := min(editDistance(name, p.name), editDistance(skeleton, p.skeleton)); n <= limit {
+				return Lookalike{Label: name, Protected: p.domain, Reason: fmt.Sprintf("edit distance %d", n)}, true
+			}
+		}
+	}
+
+	// Subdomains such as "paypal.com.account-check.example" put the brand in
+	// front of the real site.
+	var labels []string
+	if subdomains := strings.TrimSuffix(strings.TrimSuffix(ascii, registrable), "."); subdomains != "" {
+		for _, label := range strings.Split(subdomains, ".") {
+			labels = append(labels, toUnicodeLabel(label))
+		}
+	}
+	for _, label := range labels {
+		skeleton := Skeleton(label)
+		for _, p := range d.protected {
+			if skeleton == p.skeleton {
+				return Lookalike{Label: label, Protected: p.domain, Reason: "confusable"}, true
+			}
+		}
+	}
+
+	for _, label := range append(labels, name) {
+		if mixesScripts(label) {
+			return Lookalike{Label: label, Reason: "mixed scripts"}, true
+		}
+	}
+	return Lookalike{}, false
+}
+
+// maxEditDistance is how many edits a label may be from a brand name and
+// still be taken for it. Short names are only compared by skeleton, since
+// nearly every short word is a single edit from another.
+func maxEditDistance(name string) int {
+	switch n := utf8.RuneCountInString(name); {
+	case n < 5:
+		return 0
+	case n < 10:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// Skeleton returns the form of s that Unicode TR39 uses to decide whether two
+// strings are confusable: two strings with the same skeleton look alike. It
+// differs from TR39 in folding to lower-case Latin prototypes and dropping
+// combining marks, which rarely change how a host name reads, and in mapping
+// only the characters that can appear in one.
+func Skeleton(s string) string {
+	var b strings.Builder
+	for _, r := range norm.NFD.String(s) {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		if proto, ok := confusables[r]; ok {
+			b.WriteString(proto)
+		} else {
+			b.WriteRune(unicode.ToLower(r))
+		}
+	}
+	return norm.NFD.String(b.String())
+}
+
+// confusables maps characters to the lower-case Latin prototype they are
+// mistaken for. It is drawn from Unicode's confusables.txt, limited to
+// characters that IDNA permits in host names.
+var confusables = map[rune]string{
+	// ASCII sequences that read as a single letter.
+	'0': "o", '1': "l", 'm': "rn", 'w': "vv", 'd': "cl",
+
+	// Latin.
+	'ı': "i", 'ȷ': "j", 'ɑ': "a", 'ɡ': "g", 'ɩ': "i", 'ꜱ': "s", 'ᴠ': "v",
+	'ᴡ': "vv", 'ᴢ': "z",
+
+	// Cyrillic.
+	'а': "a", 'с': "c", 'ԁ': "cl", 'е': "e", 'һ': "h", 'і': "i", 'ј': "j",
+	'ӏ': "l", 'о': "o", 'р': "p", 'ԛ': "q", 'ѕ': "s", 'ѵ': "v", 'ԝ': "vv",
+	'х': "x", 'у': "y",
+
+	// Greek.
+	'α': "a", 'ι': "i", 'ο': "o", 'ρ': "p", 'ν': "v", 'χ': "x", 'γ': "y",
+
+	// Armenian.
+	'ց': "g", 'հ': "h", 'ո': "n", 'օ': "o", 'զ': "q", 'ս': "u",
+}
+
+// allowedScriptSets are the combinations of scripts a single label may use
+// under TR39's "highly restrictive" level, besides any one script alone.
+var allowedScriptSets = [][]string{
+	{"Latin", "Han", "Hiragana", "Katakana"},
+	{"Latin", "Han", "Bopomofo"},
+	{"Latin", "Han", "Hangul"},
+}
+
+// mixesScripts reports whether label uses several scripts outside the
+// combinations that are normal for its languages. Digits, hyphens and
+// combining marks belong to every script.
+func mixesScripts(label string) bool {
+	scripts := map[string]bool{}
+	for _, r := range label {
+		if s := scriptOf(r); s != "" {
+			scripts[s] = true
+		}
+	}
+	if len(scripts) <= 1 {
+		return false
+	}
+	for _, set := range allowedScriptSets {
+		if containsAll(set, scripts) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsAll(set []string, scripts map[string]bool) bool {
+	for s := range scripts {
+		if !slices.Contains(set, s) {
+			return false
+		}
+	}
+	return true
+}
+
+// commonScripts are checked first, since nearly every host is written in one
+// of them.
+var commonScripts = []string{"Latin", "Cyrillic", "Greek", "Han", "Hiragana", "Katakana", "Hangul", "Arabic", "Hebrew", "Armenian"}
+
+// scriptOf returns the name of the script r belongs to, or "" for the Common
+// and Inherited scripts shared by all of them.
+func scriptOf(r rune) string {
+	if r < utf8.RuneSelf && !unicode.IsLetter(r) {
+		return ""
+	}
+	for _, name := range commonScripts {
+		if unicode.Is(unicode.Scripts[name], r) {
+			return name
+		}
+	}
+	for name, table := range unicode.Scripts {
+		if name != "Common" && name != "Inherited" && unicode.Is(table, r) {
+			return name
+		}
+	}
+	return ""
+}
+
+// editDistance returns the optimal string alignment distance between a and
+// b: the number of insertions, deletions, substitutions and transpositions
+// of adjacent runes that turn one into the other.
+func editDistance(a, b string) int {
+	x, y := []rune(a), []rune(b)
+	prev2 := make([]int, len(y)+1)
+	prev := make([]int, len(y)+1)
+	cur := make([]int, len(y)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(x); i++ {
+		cur[0] = i
+		for j := 1; j <= len(y); j++ {
+			cost := 1
+			if x[i-1] == y[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && x[i-1] == y[j-2] && x[i-2] == y[j-1] {
+				cur[j] = min(cur[j], prev2[j-2]+1)
+			}
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(y)]
+}
+
+// lookupProfile converts hosts to the ASCII form they are resolved by.
+var lookupProfile = idna.New(idna.MapForLookup(), idna.StrictDomainName(false))
+
+// toASCIIHost lowercases host and converts it to punycode.
+func toASCIIHost(host string) (string, bool) {
+	host = strings.Trim(strings.ToLower(strings.TrimSpace(host)), ".")
+	if host == "" {
+		return "", false
+	}
+	if isASCII(host) {
+		return host, true
+	}
+	ascii, err := lookupProfile.ToASCII(host)
+	if err != nil {
+		return "", false
+	}
+	return ascii, true
+}
+
+// toUnicodeLabel decodes a punycode label, returning other labels unchanged.
+func toUnicodeLabel(label string) string {
+	if u, err := idna.Punycode.ToUnicode(label); err == nil {
+		return u
+	}
+	return label
+}
+
+// registrableDomain returns the public suffix of host plus one label, or
+// host itself when it is a public suffix or has none.
+func registrableDomain(host string) string {
+	if d, err := publicsuffix.EffectiveTLDPlusOne(host); err == nil {
+		return d
+	}
+	return host
+}
@@ -0,0 +1,143 @@
+package services
+
+import "testing"
+
+// protectedBrands are the brand domains the lookalike corpus is checked
+// against.
+var protectedBrands = []string{
+	"paypal.com", "apple.com", "google.com", "microsoft.com", "amazon.com",
+	"facebook.com", "netflix.com", "www.coinbase.com", "wellsfargo.com", "hp.com",
+}
+
+func TestLookalikeDetector(t *testing.T) {
+	detector := NewLookalikeDetector(protectedBrands...)
+
+	// Hosts seen in phishing and typosquatting campaigns, and hosts that
+	// merely resemble them.
+	testCases := []struct {
+		name              string
+		host              string
+		expectedFlagged   bool
+		expectedProtected string
+		expectedReason    string
+	}{
+		{"Digit One For L", "paypa1.com", true, "paypal.com", "confusable"},
+		{"Digit Zeros For O", "g00gle.com", true, "google.com", "confusable"},
+		{"Digit Zero In Name", "micros0ft.com", true, "microsoft.com", "confusable"},
+		{"RN For M", "rnicrosoft.com", true, "microsoft.com", "confusable"},
+		{"RN For M Again", "arnazon.com", true, "amazon.com", "confusable"},
+		{"VV For W", "vvww.example", false, "", ""},
+		{"Cyrillic A", "pаypal.com", true, "paypal.com", "confusable"},
+		{"Cyrillic Apple Punycode", "xn--80ak6aa92e.com", true, "apple.com", "confusable"},
+		{"Cyrillic Apple Unicode", "аррӏе.com", true, "apple.com", "confusable"},
+		{"Greek Omicrons", "gοοgle.com", true, "google.com", "confusable"},
+		{"Cyrillic O In Facebook", "faceboоk.com", true, "facebook.com", "confusable"},
+		{"Accented Letter", "páypal.com", true, "paypal.com", "confusable"},
+		{"Doubled Letter", "gooogle.com", true, "google.com", "edit distance 1"},
+		{"Swapped Letters", "paypla.com", true, "paypal.com", "edit distance 1"},
+		{"Wrong Letter", "amazom.com", true, "amazon.com", "edit distance 1"},
+		{"Hyphen Inserted", "pay-pal.com", true, "paypal.com", "edit distance 1"},
+		{"Extra Letter", "netfliix.com", true, "netflix.com", "edit distance 1"},
+		{"Two Typos In Long Name", "welsfargoo.com", true, "wellsfargo.com", "edit distance 2"},
+		{"Two Typos In Shorter Name", "micorsotf.com", false, "", ""},
+		{"Brand In Subdomain", "paypal.com.account-verify.example", true, "paypal.com", "confusable"},
+		{"Lookalike In Subdomain", "www.g00gle.login-check.example", true, "google.com", "confusable"},
+		{"Uppercase Lookalike", "PAYPA1.COM", true, "paypal.com", "confusable"},
+		{"Trailing Dot Lookalike", "paypa1.com.", true, "paypal.com", "confusable"},
+		{"Lookalike Of Protected Subdomain", "c0inbase.com", true, "coinbase.com", "confusable"},
+		{"Mixed Latin And Cyrillic", "exаmple.com", true, "", "mixed scripts"},
+		{"Mixed Latin And Greek Subdomain", "lοgin.example.com", true, "", "mixed scripts"},
+		{"Cyrillic Subdomain Punycode", "xn--pple-43d.example.org", true, "apple.com", "confusable"},
+		{"Mixed Punycode", "xn--exmple-4nf.org", true, "", "mixed scripts"},
+
+		{"Brand Itself", "paypal.com", false, "", ""},
+		{"Brand Subdomain", "mail.google.com", false, "", ""},
+		{"Subdomain Of Protected Subdomain", "api.coinbase.com", false, "", ""},
+		{"Brand Under Another Suffix", "google.de", false, "", ""},
+		{"Longer Word", "applebees.com", false, "", ""},
+		{"Unrelated", "example.com", false, "", ""},
+		{"Short Brand Typo Ignored", "hq.com", false, "", ""},
+		{"Short Brand Under Another Suffix", "hp.co.uk", false, "", ""},
+		{"Latin With Diacritics", "bücher.de", false, "", ""},
+		{"Punycode Latin", "xn--bcher-kva.example", false, "", ""},
+		{"All Cyrillic", "пример.рф", false, "", ""},
+		{"All Greek", "παράδειγμα.gr", false, "", ""},
+		{"Japanese Mix", "例えばtest.jp", false, "", ""},
+		{"Korean Mix", "한국abc.kr", false, "", ""},
+		{"Digits Only", "123.example", false, "", ""},
+		{"IPv4", "192.0.2.1", false, "", ""},
+		{"IPv6", "[2001:db8::1]", false, "", ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, flagged := detector.Check(tc.host)
+			if flagged != tc.expectedFlagged {
+				t.Fatalf("expected flagged %v, but got %v (%s)", tc.expectedFlagged, flagged, got)
+			}
+			if got.Protected != tc.expectedProtected || got.Reason != tc.expectedReason {
+				t.Errorf("expected %q: %q, but got %q: %q", tc.expectedProtected, tc.expectedReason, got.Protected, got.Reason)
+			}
+		})
+	}
+}
+
+func TestLookalikeDetectorWithoutProtectedDomains(t *testing.T) {
+	detector := NewLookalikeDetector()
+
+	if got, flagged := detector.Check("paypa1.com"); flagged {
+		t.Errorf("expected no flag without protected domains, but got %s", got)
+	}
+	if _, flagged := detector.Check("pаypal.com"); !flagged {
+		t.Error("expected a mixed-script host to be flagged")
+	}
+}
+
+func TestSkeleton(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected string
+	}{
+		{"paypal", "paypal"},
+		{"paypa1", "paypal"},
+		{"PayPal", "paypal"},
+		{"аррӏе", "apple"},
+		{"g00gle", "google"},
+		{"microsoft", "rnicrosoft"},
+		{"rnicrosoft", "rnicrosoft"},
+		{"ԝеb", "vveb"},
+		{"Café", "cafe"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			if got := Skeleton(tc.input); got != tc.expected {
+				t.Errorf("expected %q, but got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	testCases := []struct {
+		a, b     string
+		expected int
+	}{
+		{"", "", 0},
+		{"abc", "", 3},
+		{"paypal", "paypal", 0},
+		{"paypal", "paypla", 1},
+		{"google", "gooogle", 1},
+		{"amazon", "amazom", 1},
+		{"microsoft", "micorsotf", 2},
+		{"kitten", "sitting", 3},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.a+"/"+tc.b, func(t *testing.T) {
+			if got := editDistance(tc.a, tc.b); got != tc.expected {
+				t.Errorf("expected %d, but got %d", tc.expected, got)
+			}
+		})
+	}
+}
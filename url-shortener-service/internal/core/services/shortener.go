@@ -1,42 +1,257 @@
 package services
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"golang.org/x/crypto/bcrypt"
+
 	"github.com/iton0/duss/shared/domain"
+	"github.com/iton0/duss/shared/httpclient"
+	"github.com/iton0/duss/shared/metrics"
+	"github.com/iton0/duss/shared/policy"
+	"github.com/iton0/duss/shared/problem"
+	"github.com/iton0/duss/shared/ssrf"
 	"github.com/iton0/duss/url-shortener-service/internal/infrastructure/storage"
+	"github.com/iton0/duss/url-shortener-service/internal/infrastructure/threatfeed"
 )
 
 var (
-	ErrInvalidURL     = errors.New("URL not valid")
-	ErrBlacklistedURL = errors.New("URL rejected")
-	ErrDuplicatedKey  = errors.New("URL already taken")
-	ErrServiceError   = errors.New("service error")
+	ErrInvalidURL       = errors.New("URL not valid")
+	ErrBlacklistedURL   = errors.New("URL rejected")
+	ErrDuplicatedKey    = errors.New("URL already taken")
+	ErrURLNotFound      = errors.New("URL not found")
+	ErrDomainNotAllowed = errors.New("short domain not allowed")
+	ErrForbidden        = errors.New("not allowed to manage this link")
+	ErrForeignOwner     = errors.New("not allowed to create links for this owner")
+	ErrInvalidPassword  = errors.New("password not valid")
+	ErrSigningDisabled  = errors.New("signed links not enabled")
+	ErrInvalidSignature = errors.New("signature expiry not valid")
+	ErrServiceError     = errors.New("service error")
+	// ErrKeyGenUnavailable indicates that no key could be had from the
+	// key-gen-service.
+	ErrKeyGenUnavailable = errors.New("key-gen-service unavailable")
 )
 
 // ShortenerService encapsulates the business logic.
 type ShortenerServiceIface interface {
-	Shorten(ctx context.Context, longURL string) (*domain.URL, error)
+	// Shorten returns the link for params and whether it was newly created.
+	// In dedupe mode an existing link may be returned instead.
+	Shorten(ctx context.Context, params ShortenParams) (url *domain.URL, created bool, err error)
+	// GetURL and Delete read and delete the link on behalf of actor.
+	GetURL(ctx context.Context, shortDomain, shortKey string, actor Actor) (*domain.URL, error)
+	Delete(ctx context.Context, shortDomain, shortKey string, actor Actor) error
+	// SetUntrusted flags or clears the link's untrusted flag on behalf of
+	// actor and returns the updated link.
+	SetUntrusted(ctx context.Context, shortDomain, shortKey string, untrusted bool, actor Actor) (*domain.URL, error)
+	// ShortenBatch shortens each of items, reporting per-item errors in
+	// its results rather than failing the batch.
+	ShortenBatch(ctx context.Context, items []ShortenParams) ([]BatchResult, error)
+	// SubmitJob shortens items in the background; GetJob reports on it.
+	SubmitJob(ctx context.Context, items []ShortenParams, actor Actor) (*storage.Job, error)
+	GetJob(ctx context.Context, id string, actor Actor) (*storage.Job, error)
+}
+
+// Actor identifies who is creating or managing a link: an administrator, or
+// an owner whose credentials the caller checked. The zero Actor is anonymous.
+type Actor struct {
+	Owner string
+	Admin bool
+}
+
+// mayManage reports whether a may read, change or delete url.
+func (a Actor) mayManage(url *domain.URL) bool {
+	return a.Admin || a.Owner != "" && a.Owner == url.Owner
+}
+
+// OwnerFor returns who a link a asks to create for owner belongs to. An
+// owner's links are its own unless it names another owner, which only an
+// administrator may; anyone else gets ErrForeignOwner.
+func (a Actor) OwnerFor(owner string) (string, error) {
+	switch {
+	case owner == "":
+		return a.Owner, nil
+	case a.Admin || owner == a.Owner:
+		return owner, nil
+	default:
+		return "", ErrForeignOwner
+	}
+}
+
+// ThreatFeed matches URLs against known malware and phishing links.
+type ThreatFeed interface {
+	Match(rawURL string) (threatfeed.Match, bool)
+}
+
+var _ ThreatFeed = (*threatfeed.Feed)(nil)
+
+// DestinationValidator rejects URLs that links must not point at, such as
+// internal addresses.
+type DestinationValidator interface {
+	Validate(ctx context.Context, rawURL string) error
+}
+
+var _ DestinationValidator = (*ssrf.Validator)(nil)
+
+// ShortenParams describes a URL to shorten.
+type ShortenParams struct {
+	LongURL string
+	// Domain is the short domain to create the link on. Empty selects the
+	// service's default domain.
+	Domain string
+	// Owner identifies who the link is created for. Deduplication never
+	// returns another owner's link.
+	Owner string
+	// Dedupe overrides the service's dedupe mode for this request when set.
+	Dedupe *bool
+	// Password, when set, must be entered by visitors before they are
+	// redirected. Protected links are never deduplicated.
+	Password string
+	// Signed makes the link only work through a signed short URL. Signed
+	// links are never deduplicated.
+	Signed bool
+	// SignatureExpiresAt, when set, is when the signature of a signed link
+	// expires. It must lie in the future. The service only checks it; the
+	// short URL is signed by its caller.
+	SignatureExpiresAt time.Time
 }
 
 var _ ShortenerServiceIface = (*ShortenerService)(nil)
 
 type ShortenerService struct {
 	storage       storage.Storage
+	cache         storage.Cache
 	keyGenService string // The URL of the key-gen-service
+	keyGen        *httpclient.Client
+	defaultDomain string
+	domains       map[string]bool // The allowlist of short domains
+	stripTracking bool            // Drop tracking parameters from canonical URLs
+	dedupe        bool            // Return existing links for repeated URLs
+	policy        *policy.Engine  // Rules deciding which URLs may be shortened
+	threats       ThreatFeed      // Known malware and phishing links
+	destinations  DestinationValidator
+	lookalikes    atomic.Pointer[lookalikeCache] // Detector for the policy's protected domains
+	signedLinks   bool                           // Whether signed links may be created
+	maxBatchItems int
+	maxJobItems   int
+	jobs          storage.JobStore // Asynchronous jobs; disabled when nil
+	jobStaleAfter time.Duration    // How long a running job may go without an update
+	running       sync.WaitGroup   // Jobs still being processed
+}
+
+// Option configures optional collaborators of a ShortenerService.
+type Option func(*ShortenerService)
+
+// WithCache makes the service evict deleted URLs from c.
+func WithCache(c storage.Cache) Option {
+	return func(s *ShortenerService) {
+		s.cache = c
+	}
+}
+
+// WithDomains sets the short domains links may be created on. Links that do
+// not name a domain are created on defaultDomain.
+func WithDomains(defaultDomain string, others ...string) Option {
+	return func(s *ShortenerService) {
+		s.defaultDomain = normalizeDomain(defaultDomain)
+		s.domains = map[string]bool{s.defaultDomain: true}
+		for _, d := range others {
+			s.domains[normalizeDomain(d)] = true
+		}
+	}
+}
+
+// WithTrackingParamStripping removes utm_*, fbclid and gclid query parameters
+// when canonicalizing URLs, so links that differ only in them compare equal.
+func WithTrackingParamStripping() Option {
+	return func(s *ShortenerService) {
+		s.stripTracking = true
+	}
+}
+
+// WithDedupe makes Shorten return the existing link, rather than minting a new
+// key, when the same owner shortens an equivalent URL on the same domain
+// again. Requests can opt out with ShortenParams.Dedupe.
+func WithDedupe() Option {
+	return func(s *ShortenerService) {
+		s.dedupe = true
+	}
+}
+
+// WithPolicy makes Shorten reject URLs that p does not allow with
+// ErrBlacklistedURL.
+func WithPolicy(p *policy.Engine) Option {
+	return func(s *ShortenerService) {
+		s.policy = p
+	}
+}
+
+// WithThreatFeed makes Shorten reject URLs that f matches with
+// ErrBlacklistedURL, and lets Rescan disable existing links that it matches.
+func WithThreatFeed(f ThreatFeed) Option {
+	return func(s *ShortenerService) {
+		s.threats = f
+	}
+}
+
+// WithDestinationValidator makes Shorten reject URLs that v finds unsafe.
+// URLs pointing at forbidden addresses are rejected with ErrBlacklistedURL,
+// and those with a disallowed scheme or length with ErrInvalidURL.
+func WithDestinationValidator(v DestinationValidator) Option {
+	return func(s *ShortenerService) {
+		s.destinations = v
+	}
+}
+
+// WithSignedLinks lets Shorten create signed links. Without it, requests for
+// them fail with ErrSigningDisabled.
+func WithSignedLinks() Option {
+	return func(s *ShortenerService) {
+		s.signedLinks = true
+	}
 }
 
-func NewShortenerService(s storage.Storage, keyGenServiceURL string) *ShortenerService {
-	return &ShortenerService{
+// WithKeyGenClient sets the client the key-gen-service is called with.
+func WithKeyGenClient(c *httpclient.Client) Option {
+	return func(s *ShortenerService) {
+		s.keyGen = c
+	}
+}
+
+func NewShortenerService(s storage.Storage, keyGenServiceURL string, opts ...Option) *ShortenerService {
+	ss := &ShortenerService{
 		storage:       s,
 		keyGenService: keyGenServiceURL,
+		domains:       map[string]bool{"": true},
+		maxBatchItems: DefaultMaxBatchItems,
+		maxJobItems:   DefaultMaxJobItems,
+		jobStaleAfter: DefaultJobStaleAfter,
 	}
+	for _, opt := range opts {
+		opt(ss)
+	}
+	if ss.keyGen == nil {
+		ss.keyGen = httpclient.New("key-gen-service")
+	}
+	return ss
+}
+
+// KeyGenRequest is the structure for the request to the key-gen-service.
+type KeyGenRequest struct {
+	URL string `json:"url"`
 }
 
 // KeyGenResponse is the structure for the response from the key-gen-service.
@@ -44,56 +259,424 @@ type KeyGenResponse struct {
 	ShortKey string `json:"short_key"`
 }
 
-func (s *ShortenerService) Shorten(ctx context.Context, longURL string) (*domain.URL, error) {
-	// Call the key-gen-service to get a unique key.
-	shortKey, err := s.getUniqueKey(ctx)
+func (s *ShortenerService) Shorten(ctx context.Context, params ShortenParams) (*domain.URL, bool, error) {
+	newURL, existing, err := s.prepare(ctx, params)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get unique key: %w", err)
+		return nil, false, err
+	}
+	if existing != nil {
+		return existing, false, nil
 	}
 
-	// create the domain.URL entity
-	newURL := &domain.URL{
-		ShortKey:  shortKey,
-		LongURL:   longURL,
-		CreatedAt: time.Now(),
-		Redirects: 0,
+	// Call the key-gen-service to get a unique key.
+	shortKey, err := s.getUniqueKey(ctx, newURL.CanonicalURL)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get unique key: %w", err)
 	}
+	newURL.ShortKey = shortKey
 
 	// Pass the domain.URL entity to the storage layer to be persisted.
-	err = s.storage.Save(ctx, newURL)
+	return s.saved(ctx, newURL, s.storage.Save(ctx, newURL))
+}
+
+// prepare validates params and builds the link they describe, without its
+// short key. When dedupe mode finds an existing link for params, it returns
+// that link as existing instead.
+func (s *ShortenerService) prepare(ctx context.Context, params ShortenParams) (newURL, existing *domain.URL, err error) {
+	shortDomain := s.resolveDomain(params.Domain)
+	if !s.domains[shortDomain] {
+		return nil, nil, ErrDomainNotAllowed
+	}
+	if expires := params.SignatureExpiresAt; !expires.IsZero() && (!params.Signed || !expires.After(time.Now())) {
+		return nil, nil, ErrInvalidSignature
+	}
+	if params.Signed && !s.signedLinks {
+		return nil, nil, ErrSigningDisabled
+	}
+
+	canonicalURL, err := Canonicalize(params.LongURL, s.stripTracking)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if s.destinations != nil {
+		if err := s.destinations.Validate(ctx, canonicalURL); err != nil {
+			slog.InfoContext(ctx, "destination: rejected", "url", params.LongURL, "error", err)
+			if errors.Is(err, ssrf.ErrForbiddenAddress) {
+				return nil, nil, ErrBlacklistedURL
+			}
+			return nil, nil, ErrInvalidURL
+		}
+	}
+	if s.policy != nil {
+		if d := s.policy.Evaluate(canonicalURL); !d.Allowed {
+			slog.InfoContext(ctx, "policy: rejected", "url", params.LongURL, "rule", d.Rule)
+			return nil, nil, ErrBlacklistedURL
+		}
+	}
+	if s.threats != nil {
+		if m, ok := s.threats.Match(canonicalURL); ok {
+			slog.InfoContext(ctx, "screening: rejected", "url", params.LongURL, "match", m)
+			return nil, nil, ErrBlacklistedURL
+		}
+	}
+	untrusted, err := s.checkLookalike(ctx, params.LongURL, canonicalURL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var passwordHash string
+	if params.Password != "" {
+		hash, err := HashPassword(params.Password)
+		if err != nil {
+			return nil, nil, err
+		}
+		passwordHash = hash
+	}
+
+	dedupe := s.dedupe
+	if params.Dedupe != nil {
+		dedupe = *params.Dedupe
+	}
+	if passwordHash != "" || params.Signed {
+		// An unprotected link to the same URL must not be handed out in
+		// place of a protected or signed one, nor a protected one with
+		// another password.
+		dedupe = false
+	}
+	var dedupeKey string
+	if dedupe {
+		dedupeKey = DedupeKey(params.Owner, canonicalURL)
+		existing, err := s.findDeduped(ctx, shortDomain, dedupeKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		if existing != nil {
+			return nil, existing, nil
+		}
+	}
+
+	return &domain.URL{
+		Domain:       shortDomain,
+		LongURL:      params.LongURL,
+		CanonicalURL: canonicalURL,
+		Owner:        params.Owner,
+		DedupeKey:    dedupeKey,
+		Untrusted:    untrusted,
+		PasswordHash: passwordHash,
+		Signed:       params.Signed,
+		CreatedAt:    time.Now(),
+		Redirects:    0,
+	}, nil, nil
+}
+
+// saved interprets err, the result of saving newURL, as Shorten reports it.
+func (s *ShortenerService) saved(ctx context.Context, newURL *domain.URL, err error) (*domain.URL, bool, error) {
+	if err == nil {
+		return newURL, true, nil
+	}
+
+	if newURL.DedupeKey != "" && errors.Is(err, storage.ErrDuplicatedKey) {
+		// A concurrent request for the same URL may have saved it first.
+		if existing, _ := s.findDeduped(ctx, newURL.Domain, newURL.DedupeKey); existing != nil {
+			return existing, false, nil
+		}
+	}
+	switch {
+	case errors.Is(err, ErrInvalidURL):
+		return nil, false, ErrInvalidURL
+	case errors.Is(err, ErrBlacklistedURL):
+		return nil, false, ErrBlacklistedURL
+	case errors.Is(err, ErrDuplicatedKey), errors.Is(err, storage.ErrDuplicatedKey):
+		metrics.KeyCollisions.WithLabelValues(metrics.StageStorage).Inc()
+		return nil, false, ErrDuplicatedKey
+	default:
+		slog.ErrorContext(ctx, "unexpected server error", "error", err)
+		return nil, false, ErrServiceError // Return a generic service error to the caller
+	}
+}
+
+// HashPassword returns the bcrypt hash a protected link's password is stored
+// as. It returns ErrInvalidPassword for passwords bcrypt cannot hash, which
+// are those longer than 72 bytes.
+func HashPassword(password string) (string, error) {
+	if len(password) > 72 {
+		return "", ErrInvalidPassword
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		slog.Error("failed to hash password", "error", err)
+		return "", ErrServiceError
+	}
+	return string(hash), nil
+}
+
+// checkLookalike applies the policy's lookalike rules to the host of
+// canonicalURL. It returns ErrBlacklistedURL if the policy rejects lookalikes,
+// and otherwise whether the link should be marked untrusted.
+func (s *ShortenerService) checkLookalike(ctx context.Context, longURL, canonicalURL string) (bool, error) {
+	if s.policy == nil {
+		return false, nil
+	}
+	rules := s.policy.Rules()
+	if rules.Lookalikes == policy.LookalikesOff {
+		return false, nil
+	}
+
+	u, err := url.Parse(canonicalURL)
+	if err != nil {
+		return false, ErrInvalidURL
+	}
+	lookalike, ok := s.lookalikeDetector(rules.ProtectedDomains).Check(u.Hostname())
+	if !ok {
+		return false, nil
+	}
+	if rules.Lookalikes == policy.LookalikesDeny {
+		slog.InfoContext(ctx, "lookalike: rejected", "url", longURL, "lookalike", lookalike)
+		return false, ErrBlacklistedURL
+	}
+	slog.InfoContext(ctx, "lookalike: marked untrusted", "url", longURL, "lookalike", lookalike)
+	return true, nil
+}
+
+// lookalikeCache is a LookalikeDetector and the protected domains it was
+// built for.
+type lookalikeCache struct {
+	domains  []string
+	detector *LookalikeDetector
+}
+
+// lookalikeDetector returns a detector protecting domains, building it only
+// when the policy's protected domains have changed since the last call.
+func (s *ShortenerService) lookalikeDetector(domains []string) *LookalikeDetector {
+	if cached := s.lookalikes.Load(); cached != nil && slices.Equal(cached.domains, domains) {
+		return cached.detector
+	}
+	cached := &lookalikeCache{domains: domains, detector: NewLookalikeDetector(domains...)}
+	s.lookalikes.Store(cached)
+	return cached.detector
+}
+
+// DedupeKey returns the key under which owner's links to canonicalURL are
+// deduplicated. Hashing keeps the indexed value short however long the URL.
+func DedupeKey(owner, canonicalURL string) string {
+	sum := sha256.Sum256([]byte(owner + "\x00" + canonicalURL))
+	return hex.EncodeToString(sum[:])
+}
+
+// findDeduped returns the link saved with dedupeKey on shortDomain, or nil if
+// there is none.
+func (s *ShortenerService) findDeduped(ctx context.Context, shortDomain, dedupeKey string) (*domain.URL, error) {
+	url, err := s.storage.GetByDedupeKey(ctx, shortDomain, dedupeKey)
+	switch {
+	case err == nil:
+		return url, nil
+	case errors.Is(err, storage.ErrNotFound):
+		return nil, nil
+	default:
+		slog.ErrorContext(ctx, "unexpected server error", "error", err)
+		return nil, ErrServiceError
+	}
+}
+
+// GetURL returns the stored URL, including its redirect count, for shortKey
+// on shortDomain. Only an administrator or the link's owner may read it;
+// anyone else gets ErrForbidden. An empty shortDomain selects the default
+// domain.
+func (s *ShortenerService) GetURL(ctx context.Context, shortDomain, shortKey string, actor Actor) (*domain.URL, error) {
+	url, err := s.get(ctx, shortDomain, shortKey)
+	if err != nil {
+		return nil, err
+	}
+	if !actor.mayManage(url) {
+		return nil, ErrForbidden
+	}
+	return url, nil
+}
+
+// get returns the stored URL for shortKey on shortDomain.
+func (s *ShortenerService) get(ctx context.Context, shortDomain, shortKey string) (*domain.URL, error) {
+	url, err := s.storage.Get(ctx, s.resolveDomain(shortDomain), shortKey)
 	if err != nil {
 		switch {
-		case errors.Is(err, ErrInvalidURL):
-			return nil, ErrInvalidURL
-		case errors.Is(err, ErrBlacklistedURL):
-			return nil, ErrBlacklistedURL
-		case errors.Is(err, ErrDuplicatedKey):
-			return nil, ErrDuplicatedKey
+		case errors.Is(err, storage.ErrNotFound):
+			return nil, ErrURLNotFound
 		default:
-			log.Printf("unexpected server error: %v", err)
-			return nil, ErrServiceError // Return a generic service error to the caller
+			slog.ErrorContext(ctx, "unexpected server error", "error", err)
+			return nil, ErrServiceError
 		}
 	}
+	return url, nil
+}
+
+// Delete removes the URL stored under shortKey on shortDomain and evicts it
+// from the cache, so the redirect service stops serving it. Only an
+// administrator or the link's owner may delete it; anyone else gets
+// ErrForbidden. An empty shortDomain selects the default domain. A link
+// that could not be evicted is still deleted, and the failure only logged:
+// the redirect service may serve it until its cached copy expires.
+func (s *ShortenerService) Delete(ctx context.Context, shortDomain, shortKey string, actor Actor) error {
+	url, err := s.get(ctx, shortDomain, shortKey)
+	if err != nil {
+		return err
+	}
+	if !actor.mayManage(url) {
+		return ErrForbidden
+	}
 
-	return newURL, nil
+	if err := s.storage.Delete(ctx, url.Domain, url.ShortKey); err != nil {
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			return ErrURLNotFound
+		default:
+			slog.ErrorContext(ctx, "unexpected server error", "error", err)
+			return ErrServiceError
+		}
+	}
+
+	if s.cache != nil {
+		if err := s.cache.Evict(ctx, url.Domain, url.ShortKey); err != nil {
+			slog.WarnContext(ctx, "failed to evict deleted URL from cache", "error", err)
+		}
+	}
+
+	return nil
+}
+
+// SetUntrusted flags the link stored under shortKey on shortDomain as
+// untrusted, so visitors are warned before being redirected, or clears the
+// flag. Only an administrator or the link's owner may change it; anyone else
+// gets ErrForbidden. The link is evicted from the cache so the redirect
+// service sees the change at once; should that fail, the change is kept and
+// only seen once the cached copy expires. An empty shortDomain selects the
+// default domain.
+func (s *ShortenerService) SetUntrusted(ctx context.Context, shortDomain, shortKey string, untrusted bool, actor Actor) (*domain.URL, error) {
+	url, err := s.get(ctx, shortDomain, shortKey)
+	if err != nil {
+		return nil, err
+	}
+	if !actor.mayManage(url) {
+		return nil, ErrForbidden
+	}
+
+	if err := s.storage.SetUntrusted(ctx, url.Domain, url.ShortKey, untrusted); err != nil {
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			return nil, ErrURLNotFound
+		default:
+			slog.ErrorContext(ctx, "unexpected server error", "error", err)
+			return nil, ErrServiceError
+		}
+	}
+	url.Untrusted = untrusted
+	slog.InfoContext(ctx, "trust: changed", "link", url.ID(), "untrusted", untrusted)
+
+	if s.cache != nil {
+		if err := s.cache.Evict(ctx, url.Domain, url.ShortKey); err != nil {
+			slog.WarnContext(ctx, "failed to evict updated URL from cache", "error", err)
+		}
+	}
+
+	return url, nil
+}
+
+// rescanPageSize is how many links Rescan reads from storage at a time.
+const rescanPageSize = 500
+
+// Rescan checks every stored link against the threat feed and disables the
+// ones that match, evicting them from the cache so they stop redirecting at
+// once. It returns the number of links it disabled.
+func (s *ShortenerService) Rescan(ctx context.Context) (int, error) {
+	if s.threats == nil {
+		return 0, nil
+	}
+
+	disabled := 0
+	afterDomain, afterKey := "", ""
+	for {
+		page, err := s.storage.List(ctx, afterDomain, afterKey, rescanPageSize)
+		if err != nil {
+			slog.ErrorContext(ctx, "unexpected server error", "error", err)
+			return disabled, ErrServiceError
+		}
+
+		for _, url := range page {
+			if url.IsDisabled() {
+				continue
+			}
+			target := url.CanonicalURL
+			if target == "" {
+				target = url.LongURL
+			}
+			m, ok := s.threats.Match(target)
+			if !ok {
+				continue
+			}
+
+			reason := "threat feed " + m.String()
+			if err := s.storage.Disable(ctx, url.Domain, url.ShortKey, reason); err != nil {
+				if errors.Is(err, storage.ErrNotFound) {
+					continue // Deleted since it was listed.
+				}
+				slog.ErrorContext(ctx, "unexpected server error", "error", err)
+				return disabled, ErrServiceError
+			}
+			slog.InfoContext(ctx, "screening: disabled", "link", url.ID(), "url", url.LongURL, "match", m)
+			disabled++
+
+			if s.cache != nil {
+				if err := s.cache.Evict(ctx, url.Domain, url.ShortKey); err != nil {
+					slog.WarnContext(ctx, "failed to evict disabled URL from cache", "error", err)
+				}
+			}
+		}
+
+		if len(page) < rescanPageSize {
+			return disabled, nil
+		}
+		last := page[len(page)-1]
+		afterDomain, afterKey = last.Domain, last.ShortKey
+	}
+}
+
+// resolveDomain normalizes shortDomain, substituting the default domain when
+// it is empty.
+func (s *ShortenerService) resolveDomain(shortDomain string) string {
+	if shortDomain = normalizeDomain(shortDomain); shortDomain == "" {
+		return s.defaultDomain
+	}
+	return shortDomain
+}
+
+// normalizeDomain lowercases a host so that lookups match regardless of the
+// case a client used.
+func normalizeDomain(shortDomain string) string {
+	return strings.ToLower(strings.TrimSpace(shortDomain))
 }
 
 // getUniqueKey makes an HTTP request to the key-gen-service to obtain a unique key.
-func (s *ShortenerService) getUniqueKey(ctx context.Context) (string, error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.keyGenService+"/api/v1/generate-key", nil)
+func (s *ShortenerService) getUniqueKey(ctx context.Context, longURL string) (string, error) {
+	body, err := json.Marshal(KeyGenRequest{URL: longURL})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal request body: %w", err)
+	}
+
+	// A key lost to a retry is simply never used, so the call may be
+	// retried.
+	req, err := http.NewRequestWithContext(httpclient.Idempotent(ctx), http.MethodPost, s.keyGenService+"/api/v1/generate-key", bytes.NewReader(body))
 	if err != nil {
 		return "", fmt.Errorf("failed to create request: %w", err)
 	}
+	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{Timeout: 5 * time.Second}
-	resp, err := client.Do(req)
+	resp, err := s.keyGen.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("failed to call key-gen-service: %w", err)
+		return "", fmt.Errorf("%w: %w", ErrKeyGenUnavailable, err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("key-gen-service returned non-OK status: %d", resp.StatusCode)
+		return "", fmt.Errorf("%w: %w", ErrKeyGenUnavailable, problem.FromResponse(resp))
 	}
 
 	var keyResp KeyGenResponse
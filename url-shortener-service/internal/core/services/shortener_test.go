@@ -1 +1,940 @@
 package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/iton0/duss/shared/domain"
+	"github.com/iton0/duss/shared/httpclient"
+	"github.com/iton0/duss/shared/policy"
+	"github.com/iton0/duss/shared/ssrf"
+	"github.com/iton0/duss/url-shortener-service/internal/infrastructure/storage"
+	"github.com/iton0/duss/url-shortener-service/internal/infrastructure/storage/mock"
+	"github.com/iton0/duss/url-shortener-service/internal/infrastructure/threatfeed"
+)
+
+// MockStorage is a mock implementation of the Storage interface that always fails.
+type MockStorage struct {
+	ReturnErr error
+}
+
+func (m *MockStorage) Save(ctx context.Context, url *domain.URL) error {
+	return m.ReturnErr
+}
+
+func (m *MockStorage) SaveBatch(ctx context.Context, urls []*domain.URL) ([]error, error) {
+	return nil, m.ReturnErr
+}
+
+func (m *MockStorage) Get(ctx context.Context, shortDomain, shortKey string) (*domain.URL, error) {
+	return nil, m.ReturnErr
+}
+
+func (m *MockStorage) GetByDedupeKey(ctx context.Context, shortDomain, dedupeKey string) (*domain.URL, error) {
+	return nil, storage.ErrNotFound
+}
+
+func (m *MockStorage) Delete(ctx context.Context, shortDomain, shortKey string) error {
+	return m.ReturnErr
+}
+
+func (m *MockStorage) List(ctx context.Context, afterDomain, afterKey string, limit int) ([]*domain.URL, error) {
+	return nil, m.ReturnErr
+}
+
+func (m *MockStorage) Disable(ctx context.Context, shortDomain, shortKey, reason string) error {
+	return m.ReturnErr
+}
+
+func (m *MockStorage) SetUntrusted(ctx context.Context, shortDomain, shortKey string, untrusted bool) error {
+	return m.ReturnErr
+}
+
+// MockCache records the keys evicted from it.
+type MockCache struct {
+	Evicted []string
+	// ReturnErr makes every eviction fail.
+	ReturnErr error
+}
+
+func (m *MockCache) Evict(ctx context.Context, shortDomain, shortKey string) error {
+	if m.ReturnErr != nil {
+		return m.ReturnErr
+	}
+	m.Evicted = append(m.Evicted, domain.LinkID(shortDomain, shortKey))
+	return nil
+}
+
+// newKeyGenServer starts a fake key-gen-service that answers with the given status and body.
+func newKeyGenServer(t *testing.T, status int, body string) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/api/v1/generate-key" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestShorten(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Success", func(t *testing.T) {
+		keyGen := newKeyGenServer(t, http.StatusOK, `{"short_key":"abc123"}`)
+		store := mock.NewMockPostgresStorage()
+		shortenerService := NewShortenerService(store, keyGen.URL)
+
+		url, _, err := shortenerService.Shorten(ctx, ShortenParams{LongURL: "https://example.com/long"})
+		if err != nil {
+			t.Fatalf("expected no error, but got %v", err)
+		}
+		if url.ShortKey != "abc123" {
+			t.Errorf("expected short key 'abc123', but got %s", url.ShortKey)
+		}
+
+		saved, err := store.Get(ctx, "", "abc123")
+		if err != nil {
+			t.Fatalf("expected URL to be saved, but got %v", err)
+		}
+		if saved.LongURL != "https://example.com/long" {
+			t.Errorf("expected saved long URL 'https://example.com/long', but got %s", saved.LongURL)
+		}
+	})
+
+	t.Run("Success - Domains", func(t *testing.T) {
+		keyGen := newKeyGenServer(t, http.StatusOK, `{"short_key":"abc123"}`)
+		store := mock.NewMockPostgresStorage()
+		shortenerService := NewShortenerService(store, keyGen.URL, WithDomains("duss.io", "Go.Duss.io"))
+
+		testCases := []struct {
+			name           string
+			domain         string
+			expectedDomain string
+			expectedErr    error
+		}{
+			{"Default Domain", "", "duss.io", nil},
+			{"Allowlisted Domain", "go.duss.io", "go.duss.io", nil},
+			// DUSS.IO is duss.io, where abc123 is already taken.
+			{"Domain Case", "DUSS.IO", "duss.io", ErrDuplicatedKey},
+			{"Unknown Domain", "evil.example", "", ErrDomainNotAllowed},
+		}
+
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				url, _, err := shortenerService.Shorten(ctx, ShortenParams{LongURL: "https://example.com", Domain: tc.domain})
+				if !errors.Is(err, tc.expectedErr) {
+					t.Fatalf("expected error %v, but got %v", tc.expectedErr, err)
+				}
+				if err != nil {
+					return
+				}
+				if url.Domain != tc.expectedDomain {
+					t.Errorf("expected domain %q, but got %q", tc.expectedDomain, url.Domain)
+				}
+				if _, err := store.Get(ctx, tc.expectedDomain, "abc123"); err != nil {
+					t.Errorf("expected URL to be saved on %s, but got %v", tc.expectedDomain, err)
+				}
+			})
+		}
+	})
+
+	t.Run("Success - Canonical Form Stored", func(t *testing.T) {
+		keyGen := newKeyGenServer(t, http.StatusOK, `{"short_key":"abc123"}`)
+		store := mock.NewMockPostgresStorage()
+		shortenerService := NewShortenerService(store, keyGen.URL, WithTrackingParamStripping())
+
+		const longURL = "HTTP://Example.com:80/a/../b?utm_source=news&id=1"
+		if _, _, err := shortenerService.Shorten(ctx, ShortenParams{LongURL: longURL}); err != nil {
+			t.Fatalf("expected no error, but got %v", err)
+		}
+
+		saved, err := store.Get(ctx, "", "abc123")
+		if err != nil {
+			t.Fatalf("expected URL to be saved, but got %v", err)
+		}
+		if saved.LongURL != longURL {
+			t.Errorf("expected the original URL %q to be kept, but got %q", longURL, saved.LongURL)
+		}
+		if saved.CanonicalURL != "http://example.com/b?id=1" {
+			t.Errorf("expected canonical URL 'http://example.com/b?id=1', but got %q", saved.CanonicalURL)
+		}
+	})
+
+	t.Run("Error - Invalid URL", func(t *testing.T) {
+		keyGen := newKeyGenServer(t, http.StatusOK, `{"short_key":"abc123"}`)
+		shortenerService := NewShortenerService(mock.NewMockPostgresStorage(), keyGen.URL)
+
+		_, _, err := shortenerService.Shorten(ctx, ShortenParams{LongURL: "example.com/no-scheme"})
+		if !errors.Is(err, ErrInvalidURL) {
+			t.Fatalf("expected ErrInvalidURL, but got %v", err)
+		}
+	})
+
+	t.Run("Error - Rejected By Policy", func(t *testing.T) {
+		keyGen := newKeyGenServer(t, http.StatusOK, `{"short_key":"abc123"}`)
+		engine, err := policy.New(policy.Rules{
+			DenyDomains:  []string{"evil.example"},
+			DenyPatterns: []string{`\.exe$`},
+		})
+		if err != nil {
+			t.Fatalf("expected no error, but got %v", err)
+		}
+		store := mock.NewMockPostgresStorage()
+		shortenerService := NewShortenerService(store, keyGen.URL, WithPolicy(engine))
+
+		testCases := []struct {
+			longURL     string
+			expectedErr error
+		}{
+			{"https://evil.example/login", ErrBlacklistedURL},
+			// Rules see the canonical form, so case and ports do not evade them.
+			{"HTTPS://WWW.Evil.Example:443/", ErrBlacklistedURL},
+			{"https://files.test/setup.exe", ErrBlacklistedURL},
+			{"https://example.com/", nil},
+		}
+		for _, tc := range testCases {
+			if _, _, err := shortenerService.Shorten(ctx, ShortenParams{LongURL: tc.longURL}); !errors.Is(err, tc.expectedErr) {
+				t.Errorf("Shorten(%q): expected %v, but got %v", tc.longURL, tc.expectedErr, err)
+			}
+		}
+	})
+
+	t.Run("Error - Key Generator Unavailable", func(t *testing.T) {
+		keyGen := newKeyGenServer(t, http.StatusInternalServerError, "")
+		shortenerService := NewShortenerService(mock.NewMockPostgresStorage(), keyGen.URL)
+
+		if _, _, err := shortenerService.Shorten(ctx, ShortenParams{LongURL: "https://example.com"}); err == nil {
+			t.Fatal("expected an error, but got nil")
+		}
+	})
+
+	t.Run("Success - Key Generator Recovers", func(t *testing.T) {
+		var calls atomic.Int64
+		keyGen := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if calls.Add(1) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte(`{"short_key":"abc123"}`))
+		}))
+		t.Cleanup(keyGen.Close)
+		client := httpclient.New("key-gen-service", httpclient.WithRetries(1, time.Millisecond, time.Millisecond))
+		shortenerService := NewShortenerService(mock.NewMockPostgresStorage(), keyGen.URL, WithKeyGenClient(client))
+
+		url, _, err := shortenerService.Shorten(ctx, ShortenParams{LongURL: "https://example.com"})
+		if err != nil {
+			t.Fatalf("expected the call to be retried, but got %v", err)
+		}
+		if url.ShortKey != "abc123" || calls.Load() != 2 {
+			t.Errorf("expected abc123 after 2 calls, but got %q after %d", url.ShortKey, calls.Load())
+		}
+	})
+
+	t.Run("Error - Empty Key", func(t *testing.T) {
+		keyGen := newKeyGenServer(t, http.StatusOK, `{"short_key":""}`)
+		shortenerService := NewShortenerService(mock.NewMockPostgresStorage(), keyGen.URL)
+
+		if _, _, err := shortenerService.Shorten(ctx, ShortenParams{LongURL: "https://example.com"}); err == nil {
+			t.Fatal("expected an error, but got nil")
+		}
+	})
+
+	t.Run("Error - Duplicated Key", func(t *testing.T) {
+		keyGen := newKeyGenServer(t, http.StatusOK, `{"short_key":"taken"}`)
+		shortenerService := NewShortenerService(&MockStorage{ReturnErr: storage.ErrDuplicatedKey}, keyGen.URL)
+
+		_, _, err := shortenerService.Shorten(ctx, ShortenParams{LongURL: "https://example.com"})
+		if !errors.Is(err, ErrDuplicatedKey) {
+			t.Fatalf("expected ErrDuplicatedKey, but got %v", err)
+		}
+	})
+
+	t.Run("Error - Generic Storage Error", func(t *testing.T) {
+		keyGen := newKeyGenServer(t, http.StatusOK, `{"short_key":"abc123"}`)
+		shortenerService := NewShortenerService(&MockStorage{ReturnErr: errors.New("connection failed")}, keyGen.URL)
+
+		_, _, err := shortenerService.Shorten(ctx, ShortenParams{LongURL: "https://example.com"})
+		if !errors.Is(err, ErrServiceError) {
+			t.Fatalf("expected ErrServiceError, but got %v", err)
+		}
+	})
+}
+
+// newSequentialKeyGenServer starts a fake key-gen-service that answers every
+// request with a new key, key-1, key-2 and so on, or with as many new keys
+// as a bulk request asks for.
+func newSequentialKeyGenServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	var n atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/api/v1/generate-keys" {
+			var req KeyGenBatchRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			var resp KeyGenBatchResponse
+			for range req.URLs {
+				resp.ShortKeys = append(resp.ShortKeys, fmt.Sprintf("key-%d", n.Add(1)))
+			}
+			json.NewEncoder(w).Encode(resp)
+			return
+		}
+		fmt.Fprintf(w, `{"short_key":"key-%d"}`, n.Add(1))
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestShortenDedupe(t *testing.T) {
+	ctx := context.Background()
+	noDedupe, dedupe := false, true
+
+	testCases := []struct {
+		name            string
+		opts            []Option
+		first, second   ShortenParams
+		expectedCreated bool
+		expectedSameKey bool
+	}{
+		{
+			name:            "Equivalent URL Returns Existing Link",
+			opts:            []Option{WithDedupe()},
+			first:           ShortenParams{LongURL: "https://example.com/b", Owner: "team-a"},
+			second:          ShortenParams{LongURL: "HTTPS://Example.com:443/a/../b", Owner: "team-a"},
+			expectedCreated: false,
+			expectedSameKey: true,
+		},
+		{
+			name:            "Dedupe Off By Default",
+			first:           ShortenParams{LongURL: "https://example.com/b"},
+			second:          ShortenParams{LongURL: "https://example.com/b"},
+			expectedCreated: true,
+		},
+		{
+			name:            "Request Opts In",
+			first:           ShortenParams{LongURL: "https://example.com/b", Dedupe: &dedupe},
+			second:          ShortenParams{LongURL: "https://example.com/b", Dedupe: &dedupe},
+			expectedCreated: false,
+			expectedSameKey: true,
+		},
+		{
+			name:            "Request Forces New Key",
+			opts:            []Option{WithDedupe()},
+			first:           ShortenParams{LongURL: "https://example.com/b"},
+			second:          ShortenParams{LongURL: "https://example.com/b", Dedupe: &noDedupe},
+			expectedCreated: true,
+		},
+		{
+			name:            "Signed Link Forces New Key",
+			opts:            []Option{WithDedupe(), WithSignedLinks()},
+			first:           ShortenParams{LongURL: "https://example.com/b"},
+			second:          ShortenParams{LongURL: "https://example.com/b", Signed: true},
+			expectedCreated: true,
+		},
+		{
+			name:            "Different Owners",
+			opts:            []Option{WithDedupe()},
+			first:           ShortenParams{LongURL: "https://example.com/b", Owner: "team-a"},
+			second:          ShortenParams{LongURL: "https://example.com/b", Owner: "team-b"},
+			expectedCreated: true,
+		},
+		{
+			name:            "Different Domains",
+			opts:            []Option{WithDedupe(), WithDomains("duss.io", "go.duss.io")},
+			first:           ShortenParams{LongURL: "https://example.com/b"},
+			second:          ShortenParams{LongURL: "https://example.com/b", Domain: "go.duss.io"},
+			expectedCreated: true,
+		},
+		{
+			name:            "Different URLs",
+			opts:            []Option{WithDedupe()},
+			first:           ShortenParams{LongURL: "https://example.com/b"},
+			second:          ShortenParams{LongURL: "https://example.com/c"},
+			expectedCreated: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			keyGen := newSequentialKeyGenServer(t)
+			shortenerService := NewShortenerService(mock.NewMockPostgresStorage(), keyGen.URL, tc.opts...)
+
+			first, created, err := shortenerService.Shorten(ctx, tc.first)
+			if err != nil || !created {
+				t.Fatalf("first Shorten: expected a new link, but got created=%v, err=%v", created, err)
+			}
+
+			second, created, err := shortenerService.Shorten(ctx, tc.second)
+			if err != nil {
+				t.Fatalf("second Shorten: expected no error, but got %v", err)
+			}
+			if created != tc.expectedCreated {
+				t.Errorf("expected created=%v, but got %v", tc.expectedCreated, created)
+			}
+			if sameKey := first.ShortKey == second.ShortKey; sameKey != tc.expectedSameKey {
+				t.Errorf("expected same key=%v, but got %q and %q", tc.expectedSameKey, first.ShortKey, second.ShortKey)
+			}
+		})
+	}
+}
+
+func TestShortenDedupeConcurrent(t *testing.T) {
+	ctx := context.Background()
+	keyGen := newSequentialKeyGenServer(t)
+	shortenerService := NewShortenerService(mock.NewMockPostgresStorage(), keyGen.URL, WithDedupe())
+
+	const concurrency = 16
+	var (
+		wg      sync.WaitGroup
+		keys    [concurrency]string
+		created atomic.Int64
+	)
+	for i := range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			url, isNew, err := shortenerService.Shorten(ctx, ShortenParams{LongURL: "https://example.com/same", Owner: "team-a"})
+			if err != nil {
+				t.Errorf("expected no error, but got %v", err)
+				return
+			}
+			if isNew {
+				created.Add(1)
+			}
+			keys[i] = url.ShortKey
+		}()
+	}
+	wg.Wait()
+
+	if created.Load() != 1 {
+		t.Errorf("expected exactly one link to be created, but got %d", created.Load())
+	}
+	for _, key := range keys {
+		if key != keys[0] {
+			t.Fatalf("expected every request to get the same key, but got %v", keys)
+		}
+	}
+}
+
+// admin is the actor of calls that must not be refused.
+var admin = Actor{Admin: true}
+
+func TestGetURL(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Success - Found", func(t *testing.T) {
+		store := mock.NewMockPostgresStorage()
+		store.Save(ctx, &domain.URL{ShortKey: "abc123", LongURL: "https://example.com"})
+		shortenerService := NewShortenerService(store, "")
+
+		url, err := shortenerService.GetURL(ctx, "", "abc123", admin)
+		if err != nil {
+			t.Fatalf("expected no error, but got %v", err)
+		}
+		if url.LongURL != "https://example.com" {
+			t.Errorf("expected 'https://example.com', but got %s", url.LongURL)
+		}
+	})
+
+	t.Run("Success - Domain", func(t *testing.T) {
+		store := mock.NewMockPostgresStorage()
+		store.Save(ctx, &domain.URL{Domain: "duss.io", ShortKey: "abc123", LongURL: "https://example.com/default"})
+		store.Save(ctx, &domain.URL{Domain: "go.duss.io", ShortKey: "abc123", LongURL: "https://example.com/branded"})
+		shortenerService := NewShortenerService(store, "", WithDomains("duss.io", "go.duss.io"))
+
+		for shortDomain, want := range map[string]string{
+			"":           "https://example.com/default",
+			"duss.io":    "https://example.com/default",
+			"GO.duss.io": "https://example.com/branded",
+		} {
+			url, err := shortenerService.GetURL(ctx, shortDomain, "abc123", admin)
+			if err != nil {
+				t.Fatalf("GetURL(%q): expected no error, but got %v", shortDomain, err)
+			}
+			if url.LongURL != want {
+				t.Errorf("GetURL(%q): expected %s, but got %s", shortDomain, want, url.LongURL)
+			}
+		}
+	})
+
+	t.Run("Actors", func(t *testing.T) {
+		store := mock.NewMockPostgresStorage()
+		store.Save(ctx, &domain.URL{ShortKey: "abc123", LongURL: "https://example.com", Owner: "team-a"})
+		shortenerService := NewShortenerService(store, "")
+
+		for _, tc := range []struct {
+			actor       Actor
+			expectedErr error
+		}{
+			{Actor{Owner: "team-a"}, nil},
+			{admin, nil},
+			{Actor{Owner: "team-b"}, ErrForbidden},
+			{Actor{}, ErrForbidden},
+		} {
+			if _, err := shortenerService.GetURL(ctx, "", "abc123", tc.actor); !errors.Is(err, tc.expectedErr) {
+				t.Errorf("%+v: expected %v, but got %v", tc.actor, tc.expectedErr, err)
+			}
+		}
+	})
+
+	t.Run("Not Found", func(t *testing.T) {
+		shortenerService := NewShortenerService(mock.NewMockPostgresStorage(), "")
+
+		_, err := shortenerService.GetURL(ctx, "", "missing", admin)
+		if !errors.Is(err, ErrURLNotFound) {
+			t.Fatalf("expected ErrURLNotFound, but got %v", err)
+		}
+	})
+
+	t.Run("Error - Generic Storage Error", func(t *testing.T) {
+		shortenerService := NewShortenerService(&MockStorage{ReturnErr: errors.New("connection failed")}, "")
+
+		_, err := shortenerService.GetURL(ctx, "", "abc123", admin)
+		if !errors.Is(err, ErrServiceError) {
+			t.Fatalf("expected ErrServiceError, but got %v", err)
+		}
+	})
+}
+
+func TestDelete(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Success - Deleted And Evicted", func(t *testing.T) {
+		store := mock.NewMockPostgresStorage()
+		store.Save(ctx, &domain.URL{ShortKey: "abc123", LongURL: "https://example.com"})
+		cache := &MockCache{}
+		shortenerService := NewShortenerService(store, "", WithCache(cache))
+
+		if err := shortenerService.Delete(ctx, "", "abc123", admin); err != nil {
+			t.Fatalf("expected no error, but got %v", err)
+		}
+		if _, err := store.Get(ctx, "", "abc123"); !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("expected URL to be deleted, but got %v", err)
+		}
+		if len(cache.Evicted) != 1 || cache.Evicted[0] != domain.LinkID("", "abc123") {
+			t.Errorf("expected abc123 to be evicted, but got %v", cache.Evicted)
+		}
+	})
+
+	t.Run("Success - Eviction Failed", func(t *testing.T) {
+		store := mock.NewMockPostgresStorage()
+		store.Save(ctx, &domain.URL{ShortKey: "abc123", LongURL: "https://example.com"})
+		cache := &MockCache{ReturnErr: errors.New("redis unavailable")}
+		shortenerService := NewShortenerService(store, "", WithCache(cache))
+
+		// The link is gone, so the delete succeeded even though its cached
+		// copy may linger.
+		if err := shortenerService.Delete(ctx, "", "abc123", admin); err != nil {
+			t.Fatalf("expected no error, but got %v", err)
+		}
+		if _, err := store.Get(ctx, "", "abc123"); !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("expected URL to be deleted, but got %v", err)
+		}
+	})
+
+	t.Run("Forbidden", func(t *testing.T) {
+		store := mock.NewMockPostgresStorage()
+		store.Save(ctx, &domain.URL{ShortKey: "abc123", LongURL: "https://example.com", Owner: "team-a"})
+		cache := &MockCache{}
+		shortenerService := NewShortenerService(store, "", WithCache(cache))
+
+		if err := shortenerService.Delete(ctx, "", "abc123", Actor{Owner: "team-b"}); !errors.Is(err, ErrForbidden) {
+			t.Fatalf("expected ErrForbidden, but got %v", err)
+		}
+		if _, err := store.Get(ctx, "", "abc123"); err != nil {
+			t.Errorf("expected the URL to be kept, but got %v", err)
+		}
+		if len(cache.Evicted) != 0 {
+			t.Errorf("expected nothing to be evicted, but got %v", cache.Evicted)
+		}
+	})
+
+	t.Run("Not Found", func(t *testing.T) {
+		cache := &MockCache{}
+		shortenerService := NewShortenerService(mock.NewMockPostgresStorage(), "", WithCache(cache))
+
+		if err := shortenerService.Delete(ctx, "", "missing", admin); !errors.Is(err, ErrURLNotFound) {
+			t.Fatalf("expected ErrURLNotFound, but got %v", err)
+		}
+		if len(cache.Evicted) != 0 {
+			t.Errorf("expected nothing to be evicted, but got %v", cache.Evicted)
+		}
+	})
+}
+
+func TestSetUntrusted(t *testing.T) {
+	ctx := context.Background()
+
+	testCases := []struct {
+		name        string
+		shortKey    string
+		actor       Actor
+		expectedErr error
+	}{
+		{"Owner", "abc123", Actor{Owner: "team-a"}, nil},
+		{"Admin", "abc123", Actor{Admin: true}, nil},
+		{"Other Owner", "abc123", Actor{Owner: "team-b"}, ErrForbidden},
+		{"Anonymous", "abc123", Actor{}, ErrForbidden},
+		{"Anonymous On Unowned Link", "unowned", Actor{}, ErrForbidden},
+		{"Not Found", "missing", Actor{Admin: true}, ErrURLNotFound},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := mock.NewMockPostgresStorage()
+			store.Save(ctx, &domain.URL{ShortKey: "abc123", LongURL: "https://example.com", Owner: "team-a"})
+			store.Save(ctx, &domain.URL{ShortKey: "unowned", LongURL: "https://example.com"})
+			cache := &MockCache{}
+			shortenerService := NewShortenerService(store, "", WithCache(cache))
+
+			url, err := shortenerService.SetUntrusted(ctx, "", tc.shortKey, true, tc.actor)
+			if !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("expected %v, but got %v", tc.expectedErr, err)
+			}
+
+			stored, _ := store.Get(ctx, "", tc.shortKey)
+			if tc.expectedErr != nil {
+				if stored != nil && stored.Untrusted {
+					t.Error("expected the link to be left unchanged")
+				}
+				if len(cache.Evicted) != 0 {
+					t.Errorf("expected nothing to be evicted, but got %v", cache.Evicted)
+				}
+				return
+			}
+			if !url.Untrusted || !stored.Untrusted {
+				t.Errorf("expected the link to be untrusted, but got %v and stored %v", url.Untrusted, stored.Untrusted)
+			}
+			if len(cache.Evicted) != 1 || cache.Evicted[0] != domain.LinkID("", tc.shortKey) {
+				t.Errorf("expected %s to be evicted, but got %v", tc.shortKey, cache.Evicted)
+			}
+		})
+	}
+
+	t.Run("Eviction Failed", func(t *testing.T) {
+		store := mock.NewMockPostgresStorage()
+		store.Save(ctx, &domain.URL{ShortKey: "abc123", LongURL: "https://example.com"})
+		shortenerService := NewShortenerService(store, "", WithCache(&MockCache{ReturnErr: errors.New("redis unavailable")}))
+
+		url, err := shortenerService.SetUntrusted(ctx, "", "abc123", true, admin)
+		if err != nil {
+			t.Fatalf("expected no error, but got %v", err)
+		}
+		if stored, _ := store.Get(ctx, "", "abc123"); !url.Untrusted || !stored.Untrusted {
+			t.Errorf("expected the link to be untrusted, but got %v and stored %v", url.Untrusted, stored.Untrusted)
+		}
+	})
+}
+
+func TestActorOwnerFor(t *testing.T) {
+	testCases := []struct {
+		name          string
+		actor         Actor
+		owner         string
+		expectedOwner string
+		expectedErr   error
+	}{
+		{"Anonymous", Actor{}, "", "", nil},
+		{"Anonymous Naming Owner", Actor{}, "team-a", "", ErrForeignOwner},
+		{"Owner", Actor{Owner: "team-a"}, "", "team-a", nil},
+		{"Owner Naming Itself", Actor{Owner: "team-a"}, "team-a", "team-a", nil},
+		{"Owner Naming Other Owner", Actor{Owner: "team-a"}, "team-b", "", ErrForeignOwner},
+		{"Admin Naming Owner", Actor{Admin: true}, "team-b", "team-b", nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			owner, err := tc.actor.OwnerFor(tc.owner)
+			if !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("expected %v, but got %v", tc.expectedErr, err)
+			}
+			if owner != tc.expectedOwner {
+				t.Errorf("expected owner %q, but got %q", tc.expectedOwner, owner)
+			}
+		})
+	}
+}
+
+// newThreatFeed loads a threat feed listing hosts.
+func newThreatFeed(t *testing.T, hosts ...string) *threatfeed.Feed {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "hosts.txt")
+	if err := os.WriteFile(path, []byte(strings.Join(hosts, "\n")), 0o600); err != nil {
+		t.Fatalf("failed to write threat feed: %v", err)
+	}
+	feed, err := threatfeed.Open(path)
+	if err != nil {
+		t.Fatalf("failed to load threat feed: %v", err)
+	}
+	return feed
+}
+
+func TestShortenScreening(t *testing.T) {
+	ctx := context.Background()
+	keyGen := newKeyGenServer(t, http.StatusOK, `{"short_key":"abc123"}`)
+	shortenerService := NewShortenerService(mock.NewMockPostgresStorage(), keyGen.URL,
+		WithThreatFeed(newThreatFeed(t, "phish.example")))
+
+	testCases := []struct {
+		longURL     string
+		expectedErr error
+	}{
+		{"https://phish.example/login", ErrBlacklistedURL},
+		{"HTTPS://Login.PHISH.example./", ErrBlacklistedURL},
+		{"https://example.com/phish.example", nil},
+	}
+	for _, tc := range testCases {
+		if _, _, err := shortenerService.Shorten(ctx, ShortenParams{LongURL: tc.longURL}); !errors.Is(err, tc.expectedErr) {
+			t.Errorf("Shorten(%q): expected %v, but got %v", tc.longURL, tc.expectedErr, err)
+		}
+	}
+}
+
+func TestShortenLookalikes(t *testing.T) {
+	ctx := context.Background()
+	keyGen := newKeyGenServer(t, http.StatusOK, `{"short_key":"abc123"}`)
+
+	testCases := []struct {
+		name              string
+		action            policy.LookalikeAction
+		longURL           string
+		expectedErr       error
+		expectedUntrusted bool
+	}{
+		{"Marked Untrusted By Default", "", "https://paypa1.com/login", nil, true},
+		{"Marked Untrusted", policy.LookalikesUntrusted, "https://xn--pypal-4ve.com/", nil, true},
+		{"Mixed Scripts Untrusted", policy.LookalikesUntrusted, "https://exаmple.org/", nil, true},
+		{"Denied", policy.LookalikesDeny, "https://paypa1.com/login", ErrBlacklistedURL, false},
+		{"Off", policy.LookalikesOff, "https://paypa1.com/login", nil, false},
+		{"Protected Domain Itself", policy.LookalikesDeny, "https://www.paypal.com/", nil, false},
+		{"Unrelated Domain", policy.LookalikesDeny, "https://example.com/", nil, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			engine, err := policy.New(policy.Rules{ProtectedDomains: []string{"paypal.com"}, Lookalikes: tc.action})
+			if err != nil {
+				t.Fatalf("failed to build policy: %v", err)
+			}
+			shortenerService := NewShortenerService(mock.NewMockPostgresStorage(), keyGen.URL, WithPolicy(engine))
+
+			url, _, err := shortenerService.Shorten(ctx, ShortenParams{LongURL: tc.longURL})
+			if !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("expected error %v, but got %v", tc.expectedErr, err)
+			}
+			if err == nil && url.Untrusted != tc.expectedUntrusted {
+				t.Errorf("expected untrusted=%v, but got %v", tc.expectedUntrusted, url.Untrusted)
+			}
+		})
+	}
+}
+
+func TestLookalikeDetectorCache(t *testing.T) {
+	ctx := context.Background()
+	keyGen := newSequentialKeyGenServer(t)
+	engine, err := policy.New(policy.Rules{ProtectedDomains: []string{"paypal.com"}})
+	if err != nil {
+		t.Fatalf("failed to build policy: %v", err)
+	}
+	shortenerService := NewShortenerService(mock.NewMockPostgresStorage(), keyGen.URL, WithPolicy(engine))
+
+	if _, _, err := shortenerService.Shorten(ctx, ShortenParams{LongURL: "https://example.com/a"}); err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	first := shortenerService.lookalikes.Load()
+	if _, _, err := shortenerService.Shorten(ctx, ShortenParams{LongURL: "https://example.com/b"}); err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	if first == nil || shortenerService.lookalikes.Load() != first {
+		t.Fatal("expected the detector to be reused while the rules are unchanged")
+	}
+
+	// New protected domains take effect on the next link.
+	if err := engine.Update(policy.Rules{ProtectedDomains: []string{"paypal.com", "github.com"}}); err != nil {
+		t.Fatalf("failed to update policy: %v", err)
+	}
+	url, _, err := shortenerService.Shorten(ctx, ShortenParams{LongURL: "https://g1thub.com/login"})
+	if err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	if !url.Untrusted {
+		t.Error("expected a lookalike of the newly protected domain to be untrusted")
+	}
+	if shortenerService.lookalikes.Load() == first {
+		t.Error("expected the detector to be rebuilt for the new rules")
+	}
+}
+
+func TestShortenPassword(t *testing.T) {
+	ctx := context.Background()
+	keyGen := newSequentialKeyGenServer(t)
+	store := mock.NewMockPostgresStorage()
+	shortenerService := NewShortenerService(store, keyGen.URL, WithDedupe())
+
+	open, _, err := shortenerService.Shorten(ctx, ShortenParams{LongURL: "https://example.com/report"})
+	if err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	protected, created, err := shortenerService.Shorten(ctx, ShortenParams{LongURL: "https://example.com/report", Password: "hunter2"})
+	if err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	if !created || protected.ShortKey == open.ShortKey {
+		t.Errorf("expected a new link instead of the unprotected %s, but got %s", open.ShortKey, protected.ShortKey)
+	}
+
+	stored, err := store.Get(ctx, protected.Domain, protected.ShortKey)
+	if err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	if !stored.IsProtected() || stored.PasswordHash == "hunter2" {
+		t.Fatalf("expected a hashed password to be stored, but got %q", stored.PasswordHash)
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(stored.PasswordHash), []byte("hunter2")); err != nil {
+		t.Errorf("expected the stored hash to match the password, but got %v", err)
+	}
+
+	if _, _, err := shortenerService.Shorten(ctx, ShortenParams{LongURL: "https://example.com/report", Password: strings.Repeat("x", 73)}); !errors.Is(err, ErrInvalidPassword) {
+		t.Errorf("expected ErrInvalidPassword, but got %v", err)
+	}
+}
+
+func TestShortenSigned(t *testing.T) {
+	ctx := context.Background()
+	keyGen := newSequentialKeyGenServer(t)
+	future, past := time.Now().Add(time.Hour), time.Now().Add(-time.Hour)
+
+	testCases := []struct {
+		name        string
+		opts        []Option
+		params      ShortenParams
+		expectedErr error
+	}{
+		{"Signed", []Option{WithSignedLinks()}, ShortenParams{LongURL: "https://example.com", Signed: true}, nil},
+		{"Signed With Expiry", []Option{WithSignedLinks()}, ShortenParams{LongURL: "https://example.com", Signed: true, SignatureExpiresAt: future}, nil},
+		{"Expiry In The Past", []Option{WithSignedLinks()}, ShortenParams{LongURL: "https://example.com", Signed: true, SignatureExpiresAt: past}, ErrInvalidSignature},
+		{"Expiry Without Signed", []Option{WithSignedLinks()}, ShortenParams{LongURL: "https://example.com", SignatureExpiresAt: future}, ErrInvalidSignature},
+		{"Signing Not Enabled", nil, ShortenParams{LongURL: "https://example.com", Signed: true}, ErrSigningDisabled},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			shortenerService := NewShortenerService(mock.NewMockPostgresStorage(), keyGen.URL, tc.opts...)
+
+			url, _, err := shortenerService.Shorten(ctx, tc.params)
+			if !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("expected %v, but got %v", tc.expectedErr, err)
+			}
+			if err == nil && !url.Signed {
+				t.Error("expected a signed link")
+			}
+		})
+	}
+}
+
+// fakeResolver resolves hosts from a fixed table and fails for others.
+type fakeResolver map[string]string
+
+func (f fakeResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	addr, ok := f[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return []netip.Addr{netip.MustParseAddr(addr)}, nil
+}
+
+func TestShortenDestinations(t *testing.T) {
+	ctx := context.Background()
+	keyGen := newKeyGenServer(t, http.StatusOK, `{"short_key":"abc123"}`)
+	validator := ssrf.New(ssrf.WithResolver(fakeResolver{
+		"example.com":      "93.184.215.14",
+		"internal.example": "10.0.0.7",
+	}))
+	shortenerService := NewShortenerService(mock.NewMockPostgresStorage(), keyGen.URL, WithDestinationValidator(validator))
+
+	testCases := []struct {
+		longURL     string
+		expectedErr error
+	}{
+		{"https://example.com/", nil},
+		{"http://169.254.169.254/latest/meta-data/", ErrBlacklistedURL},
+		{"http://localhost:5432/", ErrBlacklistedURL},
+		{"https://internal.example/admin", ErrBlacklistedURL},
+		{"ftp://example.com/file", ErrInvalidURL},
+		{"javascript:alert(1)", ErrInvalidURL},
+		{"https://example.com/" + strings.Repeat("a", ssrf.DefaultMaxLength), ErrInvalidURL},
+	}
+	for _, tc := range testCases {
+		if _, _, err := shortenerService.Shorten(ctx, ShortenParams{LongURL: tc.longURL}); !errors.Is(err, tc.expectedErr) {
+			t.Errorf("Shorten(%.40q): expected %v, but got %v", tc.longURL, tc.expectedErr, err)
+		}
+	}
+}
+
+func TestRescan(t *testing.T) {
+	ctx := context.Background()
+
+	// Enough links to span several pages, every tenth of them on a host
+	// that is only listed after they were created.
+	store := mock.NewMockPostgresStorage()
+	const links = 2*rescanPageSize + 7
+	for i := range links {
+		host := "example.com"
+		if i%10 == 0 {
+			host = "phish.example"
+		}
+		longURL := fmt.Sprintf("https://%s/%d", host, i)
+		store.Save(ctx, &domain.URL{Domain: "duss.io", ShortKey: fmt.Sprintf("key-%04d", i), LongURL: longURL, CanonicalURL: longURL})
+	}
+
+	cache := &MockCache{}
+	shortenerService := NewShortenerService(store, "", WithCache(cache), WithThreatFeed(newThreatFeed(t, "phish.example")))
+
+	disabled, err := shortenerService.Rescan(ctx)
+	if err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	if want := (links + 9) / 10; disabled != want || len(cache.Evicted) != want {
+		t.Errorf("expected %d links to be disabled and evicted, but got %d and %d", want, disabled, len(cache.Evicted))
+	}
+
+	url, err := store.Get(ctx, "duss.io", "key-0010")
+	if err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	if !url.IsDisabled() || url.DisabledReason != "threat feed hosts.txt: host phish.example" {
+		t.Errorf("expected key-0010 to be disabled by the feed, but got %v %q", url.DisabledAt, url.DisabledReason)
+	}
+	if url, _ := store.Get(ctx, "duss.io", "key-0011"); url.IsDisabled() {
+		t.Error("expected key-0011 to stay enabled")
+	}
+
+	// Links that are already disabled are not disabled again.
+	if disabled, err := shortenerService.Rescan(ctx); err != nil || disabled != 0 {
+		t.Errorf("expected a second rescan to disable nothing, but got %d, %v", disabled, err)
+	}
+}
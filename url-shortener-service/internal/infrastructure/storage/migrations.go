@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// undefinedTable is the SQLSTATE PostgreSQL reports for a missing table.
+const undefinedTable = "42P01"
+
+// migration upgrades a database created by an earlier release. Every
+// statement is idempotent, so a migration interrupted part of the way
+// through is simply run again on the next start.
+type migration struct {
+	version int
+	up      func(ctx context.Context, db DB, defaultDomain string) error
+}
+
+// migrations bring a database created from an earlier Schema up to the
+// current one, in order. A change to Schema must be appended here as well.
+var migrations = []migration{
+	// Links may expire, and are keyed by their short domain as well as
+	// their key. Links created before then never expire and belong to the
+	// default domain.
+	{version: 1, up: func(ctx context.Context, db DB, defaultDomain string) error {
+		if _, err := db.Exec(ctx, `ALTER TABLE urls ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ`); err != nil {
+			return err
+		}
+		if _, err := db.Exec(ctx, `ALTER TABLE urls ADD COLUMN IF NOT EXISTS domain TEXT NOT NULL DEFAULT ''`); err != nil {
+			return err
+		}
+		if _, err := db.Exec(ctx, `UPDATE urls SET domain = $1 WHERE domain = ''`, defaultDomain); err != nil {
+			return err
+		}
+		return statements(
+			`ALTER TABLE urls ALTER COLUMN domain DROP DEFAULT`,
+			`ALTER TABLE urls DROP CONSTRAINT IF EXISTS urls_pkey`,
+			`ALTER TABLE urls ADD PRIMARY KEY (domain, short_key)`,
+		)(ctx, db, defaultDomain)
+	}},
+	{version: 2, up: statements(
+		`ALTER TABLE urls ADD COLUMN IF NOT EXISTS canonical_url TEXT NOT NULL DEFAULT ''`,
+	)},
+	{version: 3, up: statements(
+		`ALTER TABLE urls ADD COLUMN IF NOT EXISTS owner TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE urls ADD COLUMN IF NOT EXISTS dedupe_key TEXT`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS urls_dedupe_key ON urls (domain, dedupe_key)`,
+	)},
+	{version: 4, up: statements(
+		`ALTER TABLE urls ADD COLUMN IF NOT EXISTS disabled_at TIMESTAMPTZ`,
+		`ALTER TABLE urls ADD COLUMN IF NOT EXISTS disabled_reason TEXT NOT NULL DEFAULT ''`,
+	)},
+	{version: 5, up: statements(
+		`ALTER TABLE urls ADD COLUMN IF NOT EXISTS untrusted BOOLEAN NOT NULL DEFAULT FALSE`,
+	)},
+	{version: 6, up: statements(
+		`ALTER TABLE urls ADD COLUMN IF NOT EXISTS password_hash TEXT NOT NULL DEFAULT ''`,
+	)},
+	{version: 7, up: statements(
+		`ALTER TABLE urls ADD COLUMN IF NOT EXISTS signed BOOLEAN NOT NULL DEFAULT FALSE`,
+	)},
+	{version: 8, up: statements(
+		`CREATE TABLE IF NOT EXISTS shorten_jobs (
+			id         TEXT        PRIMARY KEY,
+			status     TEXT        NOT NULL,
+			total      INTEGER     NOT NULL,
+			processed  INTEGER     NOT NULL DEFAULT 0,
+			failed     INTEGER     NOT NULL DEFAULT 0,
+			results    TEXT        NOT NULL DEFAULT '[]',
+			created_at TIMESTAMPTZ NOT NULL,
+			updated_at TIMESTAMPTZ NOT NULL
+		)`,
+	)},
+	{version: 9, up: statements(
+		`ALTER TABLE shorten_jobs ADD COLUMN IF NOT EXISTS owner TEXT NOT NULL DEFAULT ''`,
+	)},
+}
+
+// statements returns a migration that runs each of sqls in turn.
+func statements(sqls ...string) func(ctx context.Context, db DB, defaultDomain string) error {
+	return func(ctx context.Context, db DB, _ string) error {
+		for _, sql := range sqls {
+			if _, err := db.Exec(ctx, sql); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Migrate brings the database up to the current schema. An empty database
+// gets Schema as a whole. One created by an earlier release is upgraded by
+// the migrations it has not yet had, and its links from before short domains
+// existed are assigned defaultDomain. Applied versions are recorded in the
+// schema_migrations table.
+func (p *PostgresClient) Migrate(ctx context.Context, defaultDomain string) error {
+	_, err := p.pool.Exec(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER     PRIMARY KEY,
+		applied_at TIMESTAMPTZ NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create migrations table: %w", err)
+	}
+
+	var version int
+	if err := p.pool.QueryRow(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	if version == 0 {
+		// Databases from before versioning have a urls table but no
+		// recorded version, and need every migration.
+		_, err := p.pool.Exec(ctx, `SELECT 1 FROM urls LIMIT 1`)
+		var pgErr *pgconn.PgError
+		switch {
+		case errors.As(err, &pgErr) && pgErr.Code == undefinedTable:
+			if _, err := p.pool.Exec(ctx, Schema); err != nil {
+				return fmt.Errorf("failed to apply schema: %w", err)
+			}
+			return p.recordMigration(ctx, migrations[len(migrations)-1].version)
+		case err != nil:
+			return fmt.Errorf("failed to inspect schema: %w", err)
+		}
+	}
+
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+		if err := m.up(ctx, p.pool, defaultDomain); err != nil {
+			return fmt.Errorf("failed to apply migration %d: %w", m.version, err)
+		}
+		if err := p.recordMigration(ctx, m.version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordMigration marks version as applied.
+func (p *PostgresClient) recordMigration(ctx context.Context, version int) error {
+	_, err := p.pool.Exec(ctx,
+		`INSERT INTO schema_migrations (version, applied_at) VALUES ($1, $2) ON CONFLICT DO NOTHING`,
+		version, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to record migration %d: %w", version, err)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/iton0/duss/shared/domain"
+	"github.com/iton0/duss/shared/testutil/pgtest"
+	"github.com/iton0/duss/url-shortener-service/internal/infrastructure/storage"
+)
+
+// emptyDB returns a database without any tables: a schema of its own in the
+// PostgreSQL database POSTGRES_DSN names, or else the SQLite stand-in.
+func emptyDB(t *testing.T) pgtest.DB {
+	t.Helper()
+
+	if os.Getenv("POSTGRES_DSN") != "" {
+		return pgtest.NewPostgres(t)
+	}
+	return pgtest.New(t, "")
+}
+
+// schemaVersion returns the latest migration recorded in db.
+func schemaVersion(t *testing.T, db pgtest.DB) int {
+	t.Helper()
+
+	var version int
+	if err := db.QueryRow(context.Background(), `SELECT MAX(version) FROM schema_migrations`).Scan(&version); err != nil {
+		t.Fatalf("could not read schema version: %v", err)
+	}
+	return version
+}
+
+func TestMigrateEmptyDatabase(t *testing.T) {
+	db := emptyDB(t)
+	client := storage.NewPostgresClientFromDB(db)
+	ctx := context.Background()
+
+	if err := client.Migrate(ctx, "duss.test"); err != nil {
+		t.Fatalf("expected no error, but got: %v", err)
+	}
+	version := schemaVersion(t, db)
+	if version == 0 {
+		t.Fatal("expected a recorded schema version, but got none")
+	}
+
+	// Migrating again leaves the database as it is.
+	if err := client.Migrate(ctx, "duss.test"); err != nil {
+		t.Fatalf("expected no error, but got: %v", err)
+	}
+	if got := schemaVersion(t, db); got != version {
+		t.Errorf("expected schema version %d, but got %d", version, got)
+	}
+
+	url := &domain.URL{Domain: "duss.test", ShortKey: "new", LongURL: "https://example.com", Owner: "team-a", DedupeKey: "hash", Signed: true, CreatedAt: time.Now()}
+	if err := client.Save(ctx, url); err != nil {
+		t.Fatalf("could not save URL: %v", err)
+	}
+	if got, err := client.Get(ctx, url.Domain, url.ShortKey); err != nil || !got.Signed || got.Owner != "team-a" {
+		t.Errorf("expected the saved link, but got %+v, %v", got, err)
+	}
+}
+
+func TestMigrateEarlierSchema(t *testing.T) {
+	testCases := []struct {
+		name   string
+		schema string
+	}{
+		{
+			// The table as the first release created it.
+			name: "Baseline",
+			schema: `CREATE TABLE urls (
+				short_key  TEXT PRIMARY KEY,
+				long_url   TEXT        NOT NULL,
+				created_at TIMESTAMPTZ NOT NULL,
+				redirects  INTEGER     NOT NULL DEFAULT 0
+			);
+			INSERT INTO urls (short_key, long_url, created_at, redirects) VALUES ('old', 'https://example.com/old', CURRENT_TIMESTAMP, 7);`,
+		},
+		{
+			name: "Owners Without Trust",
+			schema: `CREATE TABLE urls (
+				domain        TEXT        NOT NULL,
+				short_key     TEXT        NOT NULL,
+				long_url      TEXT        NOT NULL,
+				canonical_url TEXT        NOT NULL DEFAULT '',
+				owner         TEXT        NOT NULL DEFAULT '',
+				dedupe_key    TEXT,
+				created_at    TIMESTAMPTZ NOT NULL,
+				redirects     INTEGER     NOT NULL DEFAULT 0,
+				PRIMARY KEY (domain, short_key)
+			);
+			CREATE UNIQUE INDEX urls_dedupe_key ON urls (domain, dedupe_key);
+			INSERT INTO urls (domain, short_key, long_url, created_at, redirects) VALUES ('duss.test', 'old', 'https://example.com/old', CURRENT_TIMESTAMP, 7);`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db := emptyDB(t)
+			client := storage.NewPostgresClientFromDB(db)
+			ctx := context.Background()
+
+			if _, err := db.Exec(ctx, tc.schema); err != nil {
+				t.Fatalf("could not create earlier schema: %v", err)
+			}
+			if err := client.Migrate(ctx, "duss.test"); err != nil {
+				t.Fatalf("expected no error, but got: %v", err)
+			}
+
+			old, err := client.Get(ctx, "duss.test", "old")
+			if err != nil {
+				t.Fatalf("expected the existing link on the default domain, but got: %v", err)
+			}
+			if old.LongURL != "https://example.com/old" || old.Redirects != 7 {
+				t.Errorf("expected the existing link unchanged, but got %+v", old)
+			}
+
+			// The key is only unique per domain now.
+			other := &domain.URL{Domain: "go.duss.test", ShortKey: "old", LongURL: "https://example.com", Owner: "team-a", DedupeKey: "hash", PasswordHash: "$2a$10$hash", Signed: true, CreatedAt: time.Now()}
+			if err := client.Save(ctx, other); err != nil {
+				t.Fatalf("expected no error, but got: %v", err)
+			}
+			dup := *other
+			dup.ShortKey = "dup"
+			if err := client.Save(ctx, &dup); !errors.Is(err, storage.ErrDuplicatedKey) {
+				t.Errorf("expected ErrDuplicatedKey, but got %v", err)
+			}
+			if err := client.SetUntrusted(ctx, other.Domain, other.ShortKey, true); err != nil {
+				t.Errorf("expected no error, but got: %v", err)
+			}
+			if err := client.Disable(ctx, "duss.test", "old", "test"); err != nil {
+				t.Errorf("expected no error, but got: %v", err)
+			}
+			now := time.Now()
+			if err := client.CreateJob(ctx, &storage.Job{ID: "job", Status: storage.JobRunning, Total: 1, CreatedAt: now, UpdatedAt: now}); err != nil {
+				t.Errorf("expected no error, but got: %v", err)
+			}
+
+			// A second start has nothing left to migrate.
+			version := schemaVersion(t, db)
+			if err := client.Migrate(ctx, "duss.test"); err != nil {
+				t.Fatalf("expected no error, but got: %v", err)
+			}
+			if got := schemaVersion(t, db); got != version {
+				t.Errorf("expected schema version %d, but got %d", version, got)
+			}
+		})
+	}
+}
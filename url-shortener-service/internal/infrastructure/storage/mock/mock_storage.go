@@ -3,25 +3,38 @@ package mock
 import (
 	"context"
 	"errors"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/iton0/duss/shared/domain"
+	sharedstorage "github.com/iton0/duss/shared/storage"
+	"github.com/iton0/duss/url-shortener-service/internal/infrastructure/storage"
 )
 
-// ErrDuplicatedKey is a sentinel error for when a key already exists,
-// matching the expected error from a real storage implementation.
-var ErrDuplicatedKey = errors.New("URL already taken")
+// Ensure MockPostgresStorage fulfils both the service and the shared storage contracts.
+var (
+	_ storage.Storage     = (*MockPostgresStorage)(nil)
+	_ storage.JobStore    = (*MockPostgresStorage)(nil)
+	_ sharedstorage.Store = (*MockPostgresStorage)(nil)
+)
 
 // MockPostgresStorage is a mock implementation of the Storage interface for the url-shortener-service.
 type MockPostgresStorage struct {
-	// The map stores long URLs, with short keys as keys.
+	mu sync.RWMutex
+	// The map stores URLs keyed by domain.LinkID.
 	data          map[string]*domain.URL
+	jobs          map[string]storage.Job
 	simulateError bool
+	// Batches counts the calls to SaveBatch.
+	Batches int
 }
 
 // NewMockPostgresStorage creates a new MockPostgresStorage instance.
 func NewMockPostgresStorage() *MockPostgresStorage {
 	return &MockPostgresStorage{
 		data: make(map[string]*domain.URL),
+		jobs: make(map[string]storage.Job),
 	}
 }
 
@@ -31,20 +44,210 @@ func (m *MockPostgresStorage) Save(ctx context.Context, url *domain.URL) error {
 		return errors.New("mock storage save error")
 	}
 
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	// Check for a duplicate key before saving.
-	if _, ok := m.data[url.ShortKey]; ok {
-		return ErrDuplicatedKey
+	if _, ok := m.data[url.ID()]; ok {
+		return storage.ErrDuplicatedKey
+	}
+	if url.DedupeKey != "" && m.findDeduped(url.Domain, url.DedupeKey) != nil {
+		return storage.ErrDuplicatedKey
+	}
+
+	saved := *url
+	m.data[url.ID()] = &saved
+	return nil
+}
+
+// SaveBatch simulates saving several URLs in one statement.
+func (m *MockPostgresStorage) SaveBatch(ctx context.Context, urls []*domain.URL) ([]error, error) {
+	if m.simulateError {
+		return nil, errors.New("mock storage save error")
+	}
+	m.mu.Lock()
+	m.Batches++
+	m.mu.Unlock()
+
+	errs := make([]error, len(urls))
+	for i, url := range urls {
+		errs[i] = m.Save(ctx, url)
+	}
+	return errs, nil
+}
+
+// Get simulates retrieving a URL from the "database".
+func (m *MockPostgresStorage) Get(ctx context.Context, shortDomain, shortKey string) (*domain.URL, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	url, ok := m.data[domain.LinkID(shortDomain, shortKey)]
+	if !ok || url.IsExpired(time.Now()) {
+		return nil, storage.ErrNotFound
+	}
+
+	found := *url
+	return &found, nil
+}
+
+// GetByDedupeKey simulates looking up a deduplicated URL.
+func (m *MockPostgresStorage) GetByDedupeKey(ctx context.Context, shortDomain, dedupeKey string) (*domain.URL, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	url := m.findDeduped(shortDomain, dedupeKey)
+	if url == nil || url.IsExpired(time.Now()) {
+		return nil, storage.ErrNotFound
 	}
 
-	m.data[url.ShortKey] = url
+	found := *url
+	return &found, nil
+}
+
+// findDeduped returns the stored URL with dedupeKey on shortDomain, or nil.
+// The caller must hold m.mu.
+func (m *MockPostgresStorage) findDeduped(shortDomain, dedupeKey string) *domain.URL {
+	for _, url := range m.data {
+		if url.Domain == shortDomain && url.DedupeKey == dedupeKey {
+			return url
+		}
+	}
 	return nil
 }
 
-// Get is provided for testing convenience, though it's not part of the primary Storage interface for this service.
-func (m *MockPostgresStorage) Get(ctx context.Context, shortKey string) (*domain.URL, error) {
-	url, ok := m.data[shortKey]
+// Delete simulates removing a URL from the "database".
+func (m *MockPostgresStorage) Delete(ctx context.Context, shortDomain, shortKey string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id := domain.LinkID(shortDomain, shortKey)
+	if _, ok := m.data[id]; !ok {
+		return storage.ErrNotFound
+	}
+
+	delete(m.data, id)
+	return nil
+}
+
+// List simulates paging through the "database" in domain and key order.
+func (m *MockPostgresStorage) List(ctx context.Context, afterDomain, afterKey string, limit int) ([]*domain.URL, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var urls []*domain.URL
+	for _, url := range m.data {
+		if url.Domain > afterDomain || url.Domain == afterDomain && url.ShortKey > afterKey {
+			found := *url
+			urls = append(urls, &found)
+		}
+	}
+	sort.Slice(urls, func(i, j int) bool {
+		if urls[i].Domain != urls[j].Domain {
+			return urls[i].Domain < urls[j].Domain
+		}
+		return urls[i].ShortKey < urls[j].ShortKey
+	})
+	if len(urls) > limit {
+		urls = urls[:limit]
+	}
+	return urls, nil
+}
+
+// Disable simulates disabling a URL in the "database".
+func (m *MockPostgresStorage) Disable(ctx context.Context, shortDomain, shortKey, reason string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	url, ok := m.data[domain.LinkID(shortDomain, shortKey)]
 	if !ok {
-		return nil, errors.New("key not found")
+		return storage.ErrNotFound
 	}
-	return url, nil
+	url.DisabledAt = time.Now()
+	url.DisabledReason = reason
+	return nil
+}
+
+// SetUntrusted simulates flagging a URL as untrusted in the "database".
+func (m *MockPostgresStorage) SetUntrusted(ctx context.Context, shortDomain, shortKey string, untrusted bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	url, ok := m.data[domain.LinkID(shortDomain, shortKey)]
+	if !ok {
+		return storage.ErrNotFound
+	}
+	url.Untrusted = untrusted
+	return nil
+}
+
+// CreateJob simulates storing a new job.
+func (m *MockPostgresStorage) CreateJob(ctx context.Context, job *storage.Job) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.jobs[job.ID] = copyJob(job)
+	return nil
+}
+
+// UpdateJob simulates updating a job.
+func (m *MockPostgresStorage) UpdateJob(ctx context.Context, job *storage.Job) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if stored, ok := m.jobs[job.ID]; !ok || stored.Status != storage.JobRunning {
+		return storage.ErrNotFound
+	}
+	m.jobs[job.ID] = copyJob(job)
+	return nil
+}
+
+// TouchJob simulates renewing a running job's lease.
+func (m *MockPostgresStorage) TouchJob(ctx context.Context, id string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	job, ok := m.jobs[id]
+	if !ok || job.Status != storage.JobRunning {
+		return storage.ErrNotFound
+	}
+	job.UpdatedAt = at
+	m.jobs[id] = job
+	return nil
+}
+
+// FailStaleJobs simulates failing the running jobs last updated before
+// staleBefore.
+func (m *MockPostgresStorage) FailStaleJobs(ctx context.Context, staleBefore time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var n int64
+	for id, job := range m.jobs {
+		if job.Status == storage.JobRunning && job.UpdatedAt.Before(staleBefore) {
+			job.Status = storage.JobFailed
+			m.jobs[id] = job
+			n++
+		}
+	}
+	return n, nil
+}
+
+// GetJob simulates retrieving a job.
+func (m *MockPostgresStorage) GetJob(ctx context.Context, id string) (*storage.Job, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	job, ok := m.jobs[id]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	found := copyJob(&job)
+	return &found, nil
+}
+
+// copyJob returns a copy of job that shares no results with it.
+func copyJob(job *storage.Job) storage.Job {
+	copied := *job
+	copied.Results = append([]storage.JobResult(nil), job.Results...)
+	return copied
 }
@@ -2,27 +2,72 @@ package storage
 
 import (
 	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
+	"time"
 
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/multitracer"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 
 	"github.com/iton0/duss/shared/domain"
+	"github.com/iton0/duss/shared/metrics"
+	sharedstorage "github.com/iton0/duss/shared/storage"
+	"github.com/iton0/duss/shared/tracing"
 )
 
 // Ensure PostgresClient implicitly implements Storage.
 var _ Storage = (*PostgresClient)(nil)
 
+// Ensure PostgresClient implicitly implements JobStore.
+var _ JobStore = (*PostgresClient)(nil)
+
+// Ensure PostgresClient fulfils the shared storage contract.
+var _ sharedstorage.Store = (*PostgresClient)(nil)
+
+// Schema creates the tables used by PostgresClient if they do not exist yet.
+// Migrate applies it to empty databases; a change to it also needs a
+// migration for databases created from an earlier version.
+//
+//go:embed schema.sql
+var Schema string
+
+// DB is the subset of *pgxpool.Pool used by PostgresClient. It allows tests to
+// substitute a hermetic database for a real server.
+type DB interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	Ping(ctx context.Context) error
+	Close()
+}
+
 // PostgresClient is a concrete implementation of the Storage interface using PostgreSQL.
 type PostgresClient struct {
-	pool *pgxpool.Pool
+	pool DB
 }
 
 // NewPostgresClient creates and returns a new PostgresClient.
 func NewPostgresClient(ctx context.Context, dsn string) (*PostgresClient, error) {
+	pool, err := NewPostgresPool(ctx, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PostgresClient{pool: pool}, nil
+}
+
+// NewPostgresPool connects to the database at dsn and verifies the connection.
+func NewPostgresPool(ctx context.Context, dsn string) (*pgxpool.Pool, error) {
 	config, err := pgxpool.ParseConfig(dsn)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse DSN: %w", err)
 	}
+	config.ConnConfig.Tracer = multitracer.New(tracing.QueryTracer{}, metrics.QueryTracer{})
 
 	pool, err := pgxpool.NewWithConfig(ctx, config)
 	if err != nil {
@@ -30,33 +75,324 @@ func NewPostgresClient(ctx context.Context, dsn string) (*PostgresClient, error)
 	}
 
 	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
 		return nil, fmt.Errorf("failed to ping database: %w", err)
 	}
 
-	return &PostgresClient{pool: pool}, nil
+	return pool, nil
+}
+
+// NewPostgresClientFromDB creates a PostgresClient on top of an existing DB.
+func NewPostgresClientFromDB(db DB) *PostgresClient {
+	return &PostgresClient{pool: db}
 }
 
 // Save persists a domain.URL entity to the PostgreSQL database.
+// It returns ErrDuplicatedKey if the short key, or the dedupe key, is already
+// taken on its domain.
 func (p *PostgresClient) Save(ctx context.Context, url *domain.URL) error {
 	query := `
-		INSERT INTO urls (short_key, long_url, created_at, redirects)
-		VALUES ($1, $2, $3, $4)
-		ON CONFLICT (short_key) DO NOTHING
+		INSERT INTO urls (domain, short_key, long_url, canonical_url, owner, dedupe_key, created_at, expires_at, redirects, untrusted, password_hash, signed)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), $7, $8, $9, $10, $11, $12)
+		ON CONFLICT DO NOTHING
 	`
-	_, err := p.pool.Exec(ctx, query, url.ShortKey, url.LongURL, url.CreatedAt, url.Redirects)
+	var expiresAt *time.Time
+	if !url.ExpiresAt.IsZero() {
+		expiresAt = &url.ExpiresAt
+	}
+
+	tag, err := p.pool.Exec(ctx, query, url.Domain, url.ShortKey, url.LongURL, url.CanonicalURL, url.Owner, url.DedupeKey, url.CreatedAt, expiresAt, url.Redirects, url.Untrusted, url.PasswordHash, url.Signed)
 	if err != nil {
 		return fmt.Errorf("failed to save URL: %w", err)
 	}
+	if tag.RowsAffected() == 0 {
+		return ErrDuplicatedKey
+	}
 
 	return nil
 }
 
+// saveBatchRows is how many URLs SaveBatch inserts per statement, which
+// keeps its parameters well under PostgreSQL's limit of 65535.
+const saveBatchRows = 1000
+
+// SaveBatch persists urls with one multi-row INSERT per saveBatchRows URLs.
+// Rows that conflict with a stored URL, or an earlier one of the batch, are
+// skipped and reported as ErrDuplicatedKey.
+func (p *PostgresClient) SaveBatch(ctx context.Context, urls []*domain.URL) ([]error, error) {
+	errs := make([]error, len(urls))
+	for start := 0; start < len(urls); start += saveBatchRows {
+		chunk := urls[start:min(start+saveBatchRows, len(urls))]
+
+		var (
+			values []string
+			args   []any
+		)
+		for _, url := range chunk {
+			var expiresAt *time.Time
+			if !url.ExpiresAt.IsZero() {
+				expiresAt = &url.ExpiresAt
+			}
+			n := len(args)
+			values = append(values, fmt.Sprintf("($%d, $%d, $%d, $%d, $%d, NULLIF($%d, ''), $%d, $%d, $%d, $%d, $%d, $%d)",
+				n+1, n+2, n+3, n+4, n+5, n+6, n+7, n+8, n+9, n+10, n+11, n+12))
+			args = append(args, url.Domain, url.ShortKey, url.LongURL, url.CanonicalURL, url.Owner, url.DedupeKey,
+				url.CreatedAt, expiresAt, url.Redirects, url.Untrusted, url.PasswordHash, url.Signed)
+		}
+		query := `
+			INSERT INTO urls (domain, short_key, long_url, canonical_url, owner, dedupe_key, created_at, expires_at, redirects, untrusted, password_hash, signed)
+			VALUES ` + strings.Join(values, ", ") + `
+			ON CONFLICT DO NOTHING
+			RETURNING domain, short_key`
+
+		saved, err := p.insertedIDs(ctx, query, args)
+		if err != nil {
+			return nil, fmt.Errorf("failed to save URLs: %w", err)
+		}
+		for i, url := range chunk {
+			if !saved[url.ID()] {
+				errs[start+i] = ErrDuplicatedKey
+			}
+			// A later URL with the same key was not the one saved.
+			delete(saved, url.ID())
+		}
+	}
+	return errs, nil
+}
+
+// insertedIDs runs an INSERT returning domain and short_key and collects the
+// IDs of the inserted rows.
+func (p *PostgresClient) insertedIDs(ctx context.Context, query string, args []any) (map[string]bool, error) {
+	rows, err := p.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	saved := map[string]bool{}
+	for rows.Next() {
+		var shortDomain, shortKey string
+		if err := rows.Scan(&shortDomain, &shortKey); err != nil {
+			return nil, err
+		}
+		saved[domain.LinkID(shortDomain, shortKey)] = true
+	}
+	return saved, rows.Err()
+}
+
+// Get retrieves the URL stored under shortKey on shortDomain.
+// It returns ErrNotFound if the key does not exist or has expired.
+func (p *PostgresClient) Get(ctx context.Context, shortDomain, shortKey string) (*domain.URL, error) {
+	return p.getWhere(ctx, "short_key", shortDomain, shortKey)
+}
+
+// GetByDedupeKey retrieves the URL saved with dedupeKey on shortDomain.
+// It returns ErrNotFound if there is none or it has expired.
+func (p *PostgresClient) GetByDedupeKey(ctx context.Context, shortDomain, dedupeKey string) (*domain.URL, error) {
+	return p.getWhere(ctx, "dedupe_key", shortDomain, dedupeKey)
+}
+
+// urlColumns are the columns scanURL reads, in order.
+const urlColumns = `domain, short_key, long_url, canonical_url, owner, COALESCE(dedupe_key, ''),
+		created_at, expires_at, redirects, disabled_at, disabled_reason, untrusted, password_hash, signed`
+
+// scanURL reads a row selected with urlColumns.
+func scanURL(row pgx.Row) (*domain.URL, error) {
+	var (
+		url        domain.URL
+		expiresAt  *time.Time
+		disabledAt *time.Time
+	)
+	err := row.Scan(&url.Domain, &url.ShortKey, &url.LongURL, &url.CanonicalURL, &url.Owner, &url.DedupeKey,
+		&url.CreatedAt, &expiresAt, &url.Redirects, &disabledAt, &url.DisabledReason, &url.Untrusted, &url.PasswordHash, &url.Signed)
+	if err != nil {
+		return nil, err
+	}
+
+	if expiresAt != nil {
+		url.ExpiresAt = *expiresAt
+	}
+	if disabledAt != nil {
+		url.DisabledAt = *disabledAt
+	}
+	return &url, nil
+}
+
+// getWhere retrieves the URL on shortDomain whose column, which must be one
+// of the urls table's unique keys, equals value.
+func (p *PostgresClient) getWhere(ctx context.Context, column, shortDomain, value string) (*domain.URL, error) {
+	query := `SELECT ` + urlColumns + ` FROM urls WHERE domain = $1 AND ` + column + ` = $2`
+
+	url, err := scanURL(p.pool.QueryRow(ctx, query, shortDomain, value))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get URL: %w", err)
+	}
+
+	if url.IsExpired(time.Now()) {
+		return nil, ErrNotFound
+	}
+
+	return url, nil
+}
+
+// List returns up to limit URLs after afterDomain/afterKey in key order.
+func (p *PostgresClient) List(ctx context.Context, afterDomain, afterKey string, limit int) ([]*domain.URL, error) {
+	query := `SELECT ` + urlColumns + ` FROM urls
+		WHERE (domain, short_key) > ($1, $2)
+		ORDER BY domain, short_key
+		LIMIT $3`
+
+	rows, err := p.pool.Query(ctx, query, afterDomain, afterKey, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list URLs: %w", err)
+	}
+	defer rows.Close()
+
+	var urls []*domain.URL
+	for rows.Next() {
+		url, err := scanURL(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list URLs: %w", err)
+		}
+		urls = append(urls, url)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list URLs: %w", err)
+	}
+	return urls, nil
+}
+
+// Disable marks the URL stored under shortKey on shortDomain as disabled.
+// It returns ErrNotFound if the key does not exist.
+func (p *PostgresClient) Disable(ctx context.Context, shortDomain, shortKey, reason string) error {
+	query := `UPDATE urls SET disabled_at = $3, disabled_reason = $4 WHERE domain = $1 AND short_key = $2`
+	tag, err := p.pool.Exec(ctx, query, shortDomain, shortKey, time.Now(), reason)
+	if err != nil {
+		return fmt.Errorf("failed to disable URL: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// SetUntrusted sets the untrusted flag of the URL stored under shortKey on
+// shortDomain. It returns ErrNotFound if the key does not exist.
+func (p *PostgresClient) SetUntrusted(ctx context.Context, shortDomain, shortKey string, untrusted bool) error {
+	query := `UPDATE urls SET untrusted = $3 WHERE domain = $1 AND short_key = $2`
+	tag, err := p.pool.Exec(ctx, query, shortDomain, shortKey, untrusted)
+	if err != nil {
+		return fmt.Errorf("failed to update URL: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Delete removes the URL stored under shortKey on shortDomain.
+// It returns ErrNotFound if the key does not exist.
+func (p *PostgresClient) Delete(ctx context.Context, shortDomain, shortKey string) error {
+	query := `DELETE FROM urls WHERE domain = $1 AND short_key = $2`
+	tag, err := p.pool.Exec(ctx, query, shortDomain, shortKey)
+	if err != nil {
+		return fmt.Errorf("failed to delete URL: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
 // IncrementRedirects increments the redirects count for a given short key.
-func (p *PostgresClient) IncrementRedirects(ctx context.Context, shortKey string) error {
-	query := `UPDATE urls SET redirects = redirects + 1 WHERE short_key = $1`
-	_, err := p.pool.Exec(ctx, query, shortKey)
+func (p *PostgresClient) IncrementRedirects(ctx context.Context, shortDomain, shortKey string) error {
+	query := `UPDATE urls SET redirects = redirects + 1 WHERE domain = $1 AND short_key = $2`
+	_, err := p.pool.Exec(ctx, query, shortDomain, shortKey)
 	if err != nil {
 		return fmt.Errorf("failed to increment redirects: %w", err)
 	}
 	return nil
 }
+
+// CreateJob stores a new job.
+func (p *PostgresClient) CreateJob(ctx context.Context, job *Job) error {
+	results, err := json.Marshal(job.Results)
+	if err != nil {
+		return fmt.Errorf("failed to encode job results: %w", err)
+	}
+	query := `
+		INSERT INTO shorten_jobs (id, status, owner, total, processed, failed, results, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	`
+	if _, err := p.pool.Exec(ctx, query, job.ID, job.Status, job.Owner, job.Total, job.Processed, job.Failed, string(results), job.CreatedAt, job.UpdatedAt); err != nil {
+		return fmt.Errorf("failed to create job: %w", err)
+	}
+	return nil
+}
+
+// UpdateJob saves the status, counts and results of job. It returns
+// ErrNotFound if the job does not exist or is no longer running.
+func (p *PostgresClient) UpdateJob(ctx context.Context, job *Job) error {
+	results, err := json.Marshal(job.Results)
+	if err != nil {
+		return fmt.Errorf("failed to encode job results: %w", err)
+	}
+	query := `
+		UPDATE shorten_jobs SET status = $2, processed = $3, failed = $4, results = $5, updated_at = $6
+		WHERE id = $1 AND status = 'running'
+	`
+	tag, err := p.pool.Exec(ctx, query, job.ID, job.Status, job.Processed, job.Failed, string(results), job.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to update job: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// TouchJob marks the running job with id updated at at. It returns
+// ErrNotFound if the job does not exist or is no longer running.
+func (p *PostgresClient) TouchJob(ctx context.Context, id string, at time.Time) error {
+	query := `UPDATE shorten_jobs SET updated_at = $2 WHERE id = $1 AND status = 'running'`
+	tag, err := p.pool.Exec(ctx, query, id, at)
+	if err != nil {
+		return fmt.Errorf("failed to touch job: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// FailStaleJobs marks running jobs last updated before staleBefore failed.
+func (p *PostgresClient) FailStaleJobs(ctx context.Context, staleBefore time.Time) (int64, error) {
+	query := `UPDATE shorten_jobs SET status = 'failed' WHERE status = 'running' AND updated_at < $1`
+	tag, err := p.pool.Exec(ctx, query, staleBefore)
+	if err != nil {
+		return 0, fmt.Errorf("failed to fail stale jobs: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+// GetJob returns the job with id, or ErrNotFound.
+func (p *PostgresClient) GetJob(ctx context.Context, id string) (*Job, error) {
+	query := `SELECT id, status, owner, total, processed, failed, results, created_at, updated_at FROM shorten_jobs WHERE id = $1`
+
+	var (
+		job     Job
+		results string
+	)
+	err := p.pool.QueryRow(ctx, query, id).Scan(&job.ID, &job.Status, &job.Owner, &job.Total, &job.Processed, &job.Failed, &results, &job.CreatedAt, &job.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get job: %w", err)
+	}
+	if err := json.Unmarshal([]byte(results), &job.Results); err != nil {
+		return nil, fmt.Errorf("failed to decode job results: %w", err)
+	}
+	return &job, nil
+}
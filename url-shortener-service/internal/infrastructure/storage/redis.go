@@ -1 +1,59 @@
 package storage
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/iton0/duss/shared/domain"
+	"github.com/iton0/duss/shared/metrics"
+	"github.com/iton0/duss/shared/tracing"
+)
+
+// Ensure RedisClient implicitly implements Cache.
+var _ Cache = (*RedisClient)(nil)
+
+// RedisClient is a concrete implementation of the Cache interface using Redis.
+// The redirect service populates this cache; the shortener only ever removes
+// entries from it.
+type RedisClient struct {
+	client *redis.Client
+}
+
+// NewRedisClient creates and returns a new RedisClient, or an error if the connection fails.
+func NewRedisClient(ctx context.Context, addr string, password string, db int) (*RedisClient, error) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr:     addr,
+		Password: password,
+		DB:       db,
+	})
+	rdb.AddHook(tracing.RedisHook{})
+	rdb.AddHook(metrics.RedisHook{})
+
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		rdb.Close()
+		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
+	}
+
+	return &RedisClient{client: rdb}, nil
+}
+
+// Evict removes any cached copy of the URL stored under shortKey on
+// shortDomain. Evicting a key that is not cached is not an error.
+func (r *RedisClient) Evict(ctx context.Context, shortDomain, shortKey string) error {
+	if err := r.client.Del(ctx, domain.LinkID(shortDomain, shortKey)).Err(); err != nil {
+		return fmt.Errorf("failed to delete key from Redis: %w", err)
+	}
+	return nil
+}
+
+// Ping checks that Redis is reachable.
+func (r *RedisClient) Ping(ctx context.Context) error {
+	return r.client.Ping(ctx).Err()
+}
+
+// Close closes the underlying Redis connection pool.
+func (r *RedisClient) Close() error {
+	return r.client.Close()
+}
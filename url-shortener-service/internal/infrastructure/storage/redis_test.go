@@ -1 +1,72 @@
 package storage_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/iton0/duss/shared/domain"
+	"github.com/iton0/duss/shared/testutil/redistest"
+	"github.com/iton0/duss/url-shortener-service/internal/infrastructure/storage"
+)
+
+func TestNewRedisClient(t *testing.T) {
+	t.Run("Valid Connection", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+
+		client, err := storage.NewRedisClient(ctx, redistest.Addr(t), "", 0)
+		if err != nil {
+			t.Fatalf("expected no error, but got: %v", err)
+		}
+		client.Close()
+	})
+
+	t.Run("Invalid Connection", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+
+		client, err := storage.NewRedisClient(ctx, "127.0.0.1:1", "", 0)
+		if err == nil {
+			t.Fatal("expected an error, but got nil")
+		}
+		if client != nil {
+			t.Fatal("expected a nil client, but got a value")
+		}
+	})
+}
+
+func TestEvict(t *testing.T) {
+	ctx := context.Background()
+	redisAddr := redistest.Addr(t)
+
+	client, err := storage.NewRedisClient(ctx, redisAddr, "", 0)
+	if err != nil {
+		t.Fatalf("setup failed: could not create Redis client: %v", err)
+	}
+	defer client.Close()
+
+	rdb := redis.NewClient(&redis.Options{Addr: redisAddr})
+	defer rdb.Close()
+
+	if err := rdb.Set(ctx, domain.LinkID("duss.test", "cached"), `{"domain":"duss.test","short_key":"cached"}`, 0).Err(); err != nil {
+		t.Fatalf("could not set key for test: %v", err)
+	}
+
+	t.Run("Cached Key", func(t *testing.T) {
+		if err := client.Evict(ctx, "duss.test", "cached"); err != nil {
+			t.Fatalf("expected no error, but got: %v", err)
+		}
+		if n := rdb.Exists(ctx, domain.LinkID("duss.test", "cached")).Val(); n != 0 {
+			t.Fatal("expected the key to be evicted")
+		}
+	})
+
+	t.Run("Uncached Key", func(t *testing.T) {
+		if err := client.Evict(ctx, "duss.test", "never-cached"); err != nil {
+			t.Fatalf("expected no error, but got: %v", err)
+		}
+	})
+}
@@ -0,0 +1,39 @@
+CREATE TABLE IF NOT EXISTS urls (
+    domain          TEXT        NOT NULL,
+    short_key       TEXT        NOT NULL,
+    long_url        TEXT        NOT NULL,
+    canonical_url   TEXT        NOT NULL DEFAULT '',
+    owner           TEXT        NOT NULL DEFAULT '',
+    dedupe_key      TEXT,
+    created_at      TIMESTAMPTZ NOT NULL,
+    expires_at      TIMESTAMPTZ,
+    redirects       INTEGER     NOT NULL DEFAULT 0,
+    -- A disabled link is kept for its statistics but no longer redirects.
+    disabled_at     TIMESTAMPTZ,
+    disabled_reason TEXT        NOT NULL DEFAULT '',
+    -- Visitors to an untrusted link are warned before being redirected.
+    untrusted       BOOLEAN     NOT NULL DEFAULT FALSE,
+    -- Visitors to a protected link must enter the password hashed here.
+    password_hash   TEXT        NOT NULL DEFAULT '',
+    -- A signed link only redirects through a short URL carrying its signature.
+    signed          BOOLEAN     NOT NULL DEFAULT FALSE,
+    PRIMARY KEY (domain, short_key)
+);
+
+-- Links created in dedupe mode are unique per domain, owner and canonical URL.
+-- Other links leave dedupe_key NULL, which the index does not constrain.
+CREATE UNIQUE INDEX IF NOT EXISTS urls_dedupe_key ON urls (domain, dedupe_key);
+
+-- Asynchronous shorten jobs. Results are stored as a JSON array once the job
+-- is done.
+CREATE TABLE IF NOT EXISTS shorten_jobs (
+    id         TEXT        PRIMARY KEY,
+    status     TEXT        NOT NULL,
+    owner      TEXT        NOT NULL DEFAULT '',
+    total      INTEGER     NOT NULL,
+    processed  INTEGER     NOT NULL DEFAULT 0,
+    failed     INTEGER     NOT NULL DEFAULT 0,
+    results    TEXT        NOT NULL DEFAULT '[]',
+    created_at TIMESTAMPTZ NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL
+);
@@ -2,10 +2,107 @@ package storage
 
 import (
 	"context"
+	"time"
 
 	"github.com/iton0/duss/shared/domain"
+	sharedstorage "github.com/iton0/duss/shared/storage"
+)
+
+var (
+	// ErrNotFound is returned when a short key does not exist or has expired.
+	ErrNotFound = sharedstorage.ErrNotFound
+	// ErrDuplicatedKey is returned when a short key is already stored.
+	ErrDuplicatedKey = sharedstorage.ErrDuplicatedKey
 )
 
 type Storage interface {
+	// Save stores url. It returns ErrDuplicatedKey if its short key, or its
+	// non-empty DedupeKey, is already taken on its domain.
 	Save(ctx context.Context, url *domain.URL) error
+	// SaveBatch stores urls with as few round trips as it can. The error
+	// for each URL is returned at its index: nil if it was saved and
+	// ErrDuplicatedKey if, as for Save, its short or dedupe key is taken,
+	// including by an earlier URL of the batch. The second result reports
+	// a failure of the whole batch, in which case nothing is saved.
+	SaveBatch(ctx context.Context, urls []*domain.URL) ([]error, error)
+	Get(ctx context.Context, shortDomain, shortKey string) (*domain.URL, error)
+	// GetByDedupeKey returns the URL saved with dedupeKey on shortDomain, or
+	// ErrNotFound.
+	GetByDedupeKey(ctx context.Context, shortDomain, dedupeKey string) (*domain.URL, error)
+	Delete(ctx context.Context, shortDomain, shortKey string) error
+	// List returns up to limit URLs, including expired and disabled ones,
+	// ordered by domain and short key and starting after the URL stored
+	// under afterKey on afterDomain. Empty arguments start from the first.
+	List(ctx context.Context, afterDomain, afterKey string, limit int) ([]*domain.URL, error)
+	// Disable marks the URL stored under shortKey on shortDomain as disabled
+	// for reason. It returns ErrNotFound if the key does not exist.
+	Disable(ctx context.Context, shortDomain, shortKey, reason string) error
+	// SetUntrusted sets whether visitors to the URL stored under shortKey on
+	// shortDomain are warned before being redirected. It returns ErrNotFound
+	// if the key does not exist.
+	SetUntrusted(ctx context.Context, shortDomain, shortKey string, untrusted bool) error
+}
+
+// Cache is a read cache of URLs kept by another service, such as the redirect
+// service's Redis cache, that must forget a URL when it is deleted here.
+type Cache interface {
+	Evict(ctx context.Context, shortDomain, shortKey string) error
+}
+
+// Job statuses.
+const (
+	JobRunning = "running"
+	JobDone    = "done"
+	// JobFailed is a job that stopped being processed before it was done,
+	// such as when its replica died.
+	JobFailed = "failed"
+)
+
+// Job is an asynchronous batch of URLs to shorten.
+type Job struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	// Owner is who submitted the job, empty if it was submitted
+	// anonymously.
+	Owner string `json:"owner,omitempty"`
+	// Total is the number of items in the job, of which Processed have been
+	// shortened or failed so far. Failed counts the failures.
+	Total     int `json:"total"`
+	Processed int `json:"processed"`
+	Failed    int `json:"failed"`
+	// Results holds the outcome of every item once the job is done.
+	Results   []JobResult `json:"results,omitempty"`
+	CreatedAt time.Time   `json:"created_at"`
+	UpdatedAt time.Time   `json:"updated_at"`
+}
+
+// JobResult is the outcome of one item of a Job.
+type JobResult struct {
+	Index    int    `json:"index"`
+	Domain   string `json:"domain,omitempty"`
+	ShortKey string `json:"short_key,omitempty"`
+	Created  bool   `json:"created,omitempty"`
+	// Signed links keep the expiry requested for their signature, so their
+	// short URL can be signed when the result is read.
+	Signed             bool      `json:"signed,omitempty"`
+	SignatureExpiresAt time.Time `json:"signature_expires_at,omitzero"`
+	// Error describes why the item failed; it is empty on success.
+	Error string `json:"error,omitempty"`
+}
+
+// JobStore keeps the state of asynchronous jobs where every replica can
+// read it.
+type JobStore interface {
+	CreateJob(ctx context.Context, job *Job) error
+	// UpdateJob saves the status, counts and results of job, which must
+	// still be running; otherwise it returns ErrNotFound.
+	UpdateJob(ctx context.Context, job *Job) error
+	// TouchJob renews the lease of the running job with id, marking it
+	// updated at at. It returns ErrNotFound if the job is not running.
+	TouchJob(ctx context.Context, id string, at time.Time) error
+	// FailStaleJobs marks running jobs last updated before staleBefore
+	// failed and returns how many there were.
+	FailStaleJobs(ctx context.Context, staleBefore time.Time) (int64, error)
+	// GetJob returns the job with id, or ErrNotFound.
+	GetJob(ctx context.Context, id string) (*Job, error)
 }
@@ -0,0 +1,61 @@
+package threatfeed
+
+import (
+	"hash/maphash"
+	"math"
+)
+
+// bloom is a Bloom filter over strings. It answers "definitely absent" for
+// most strings that were never added without touching the exact set behind
+// it, which keeps the many negative lookups cheap.
+type bloom struct {
+	bits   []uint64
+	m      uint64 // number of bits
+	k      uint64 // number of hash functions
+	s1, s2 maphash.Seed
+}
+
+// newBloom sizes a filter for n entries at the false-positive rate p.
+func newBloom(n int, p float64) *bloom {
+	if n < 1 {
+		n = 1
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	m = max(64, (m+63)/64*64)
+	k := uint64(math.Round(float64(m) / float64(n) * math.Ln2))
+	k = max(1, k)
+
+	return &bloom{
+		bits: make([]uint64, m/64),
+		m:    m,
+		k:    k,
+		s1:   maphash.MakeSeed(),
+		s2:   maphash.MakeSeed(),
+	}
+}
+
+// positions derives the filter's k bit positions for s by double hashing.
+func (b *bloom) positions(s string, fn func(bit uint64) bool) bool {
+	h1 := maphash.String(b.s1, s)
+	h2 := maphash.String(b.s2, s) | 1
+	for i := uint64(0); i < b.k; i++ {
+		if !fn((h1 + i*h2) % b.m) {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *bloom) add(s string) {
+	b.positions(s, func(bit uint64) bool {
+		b.bits[bit/64] |= 1 << (bit % 64)
+		return true
+	})
+}
+
+// mayContain reports false if s was certainly never added.
+func (b *bloom) mayContain(s string) bool {
+	return b.positions(s, func(bit uint64) bool {
+		return b.bits[bit/64]&(1<<(bit%64)) != 0
+	})
+}
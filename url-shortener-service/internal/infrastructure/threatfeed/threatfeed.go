@@ -0,0 +1,351 @@
+// Package threatfeed screens URLs against offline dumps of malware and
+// phishing feeds.
+//
+// Two kinds of feed file are understood:
+//
+//   - CSV dumps, recognized by a .csv extension, such as URLhaus's csv_recent
+//     or PhishTank's online-valid export. The URL column is the one a header
+//     names "url", where the header may be a comment as in URLhaus dumps.
+//     Without a header, the first field of each record that looks like a URL
+//     is used. Other lines starting with '#' are comments.
+//   - Plain lists with one host or URL per line, including hosts-file lines
+//     such as "0.0.0.0 evil.example". Text after '#' is a comment.
+//
+// URLs listed in a CSV dump match only themselves, since they are often
+// hosted on otherwise legitimate sites. Hosts from a plain list match the
+// host and all of its subdomains.
+package threatfeed
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// ErrInvalidFeed is returned when a feed file cannot be read.
+var ErrInvalidFeed = errors.New("invalid threat feed")
+
+// falsePositiveRate is the Bloom filters' target false-positive rate. A false
+// positive only costs an exact-set lookup.
+const falsePositiveRate = 0.01
+
+// Match describes the feed entry a URL matched.
+type Match struct {
+	// Feed is the base name of the feed file the entry came from.
+	Feed string
+	// Kind is "host" or "url".
+	Kind string
+	// Entry is the matched host or URL.
+	Entry string
+}
+
+func (m Match) String() string {
+	return fmt.Sprintf("%s: %s %s", m.Feed, m.Kind, m.Entry)
+}
+
+// Feed is an in-memory index of the entries in a set of feed files. It is
+// safe for concurrent use, including while it is being reloaded.
+type Feed struct {
+	paths []string
+	index atomic.Pointer[index]
+}
+
+// Open loads the feed files at paths. With no paths the Feed matches nothing.
+func Open(paths ...string) (*Feed, error) {
+	f := &Feed{paths: paths}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload reads the feed files again, replacing the entries in use once all
+// of them have loaded. If any file fails, the current entries are kept.
+func (f *Feed) Reload() error {
+	hosts := make(map[string]string)
+	urls := make(map[string]string)
+	for _, path := range f.paths {
+		if err := load(path, hosts, urls); err != nil {
+			return err
+		}
+	}
+
+	f.index.Store(&index{hosts: newSet(hosts), urls: newSet(urls)})
+	return nil
+}
+
+// Len returns the number of hosts and URLs loaded.
+func (f *Feed) Len() (hosts, urls int) {
+	idx := f.index.Load()
+	return len(idx.hosts.entries), len(idx.urls.entries)
+}
+
+// Match checks rawURL, and then its host and each parent domain of it,
+// against the feeds.
+func (f *Feed) Match(rawURL string) (Match, bool) {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil || u.Host == "" {
+		return Match{}, false
+	}
+	idx := f.index.Load()
+
+	if key, ok := urlKey(u); ok {
+		if feed, ok := idx.urls.lookup(key); ok {
+			return Match{Feed: feed, Kind: "url", Entry: key}, true
+		}
+	}
+
+	host := normalizeHost(u.Hostname())
+	for h := host; h != ""; {
+		if feed, ok := idx.hosts.lookup(h); ok {
+			return Match{Feed: feed, Kind: "host", Entry: h}, true
+		}
+		if net.ParseIP(h) != nil {
+			break
+		}
+		_, parent, ok := strings.Cut(h, ".")
+		if !ok {
+			break
+		}
+		h = parent
+	}
+	return Match{}, false
+}
+
+// index is an immutable snapshot of the loaded entries.
+type index struct {
+	hosts *set
+	urls  *set
+}
+
+// set is an exact set of entries, mapped to the feed that listed them, behind
+// a Bloom filter.
+type set struct {
+	filter  *bloom
+	entries map[string]string
+}
+
+func newSet(entries map[string]string) *set {
+	s := &set{filter: newBloom(len(entries), falsePositiveRate), entries: entries}
+	for entry := range entries {
+		s.filter.add(entry)
+	}
+	return s
+}
+
+func (s *set) lookup(entry string) (feed string, ok bool) {
+	if !s.filter.mayContain(entry) {
+		return "", false
+	}
+	feed, ok = s.entries[entry]
+	return feed, ok
+}
+
+// load adds the entries of the feed file at path to hosts and urls.
+func load(path string, hosts, urls map[string]string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidFeed, err)
+	}
+	defer file.Close()
+
+	l := loader{feed: filepath.Base(path), hosts: hosts, urls: urls}
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		err = l.readCSV(file)
+	} else {
+		err = l.readList(file)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrInvalidFeed, path, err)
+	}
+
+	slog.Info("threatfeed: loaded", "feed", l.feed, "hosts", l.nHosts, "urls", l.nURLs, "skipped", l.skipped)
+	return nil
+}
+
+// loader collects the entries of one feed file.
+type loader struct {
+	feed                   string
+	hosts, urls            map[string]string
+	nHosts, nURLs, skipped int
+}
+
+func (l *loader) readCSV(r io.Reader) error {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+	cr.TrimLeadingSpace = true
+
+	urlColumn := -1
+	for first := true; ; {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			l.skipped++
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if comment, ok := strings.CutPrefix(record[0], "#"); ok {
+			// A commented-out header, such as URLhaus's, still names the
+			// columns.
+			record[0] = strings.TrimSpace(comment)
+			if i := headerIndex(record, "url"); i >= 0 && urlColumn < 0 {
+				urlColumn = i
+			}
+			continue
+		}
+		if first {
+			first = false
+			if i := headerIndex(record, "url"); i >= 0 {
+				urlColumn = i
+				continue
+			}
+		}
+
+		field := ""
+		if urlColumn >= 0 && urlColumn < len(record) {
+			field = record[urlColumn]
+		} else {
+			for _, f := range record {
+				if strings.Contains(f, "://") {
+					field = f
+					break
+				}
+			}
+		}
+		l.addURL(field)
+	}
+}
+
+func (l *loader) readList(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) > 1 {
+			// A hosts-file line: an address followed by host names.
+			fields = fields[1:]
+		}
+		for _, field := range fields {
+			if strings.Contains(field, "://") {
+				l.addURL(field)
+			} else {
+				l.addHost(field)
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+func (l *loader) addURL(rawURL string) {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		l.skipped++
+		return
+	}
+	key, ok := urlKey(u)
+	if !ok {
+		l.skipped++
+		return
+	}
+	if _, dup := l.urls[key]; !dup {
+		l.urls[key] = l.feed
+		l.nURLs++
+	}
+}
+
+// ignoredHosts are names hosts files map to themselves, not threats.
+var ignoredHosts = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"broadcasthost":         true,
+	"local":                 true,
+	"0.0.0.0":               true,
+}
+
+func (l *loader) addHost(host string) {
+	host = normalizeHost(strings.Trim(host, "[]"))
+	if ignoredHosts[host] {
+		return
+	}
+	if !validHost(host) {
+		l.skipped++
+		return
+	}
+	if _, dup := l.hosts[host]; !dup {
+		l.hosts[host] = l.feed
+		l.nHosts++
+	}
+}
+
+// headerIndex returns the index of the column called name in a CSV header
+// record, or -1 if record is not a header naming it.
+func headerIndex(record []string, name string) int {
+	for i, field := range record {
+		if strings.EqualFold(strings.TrimSpace(field), name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// urlKey returns the form URLs are compared in: scheme and host lowercased,
+// default ports, user info and fragment dropped, and an empty path as "/".
+func urlKey(u *url.URL) (string, bool) {
+	scheme := strings.ToLower(u.Scheme)
+	host := normalizeHost(u.Hostname())
+	if scheme == "" || host == "" || u.Opaque != "" {
+		return "", false
+	}
+	if port := u.Port(); port != "" && !(scheme == "http" && port == "80" || scheme == "https" && port == "443") {
+		host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	key := scheme + "://" + host + path
+	if u.RawQuery != "" {
+		key += "?" + u.RawQuery
+	}
+	return key, true
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+}
+
+// validHost reports whether host looks like a DNS name or IP address.
+func validHost(host string) bool {
+	if host == "" {
+		return false
+	}
+	if net.ParseIP(host) != nil {
+		return true
+	}
+	for i := 0; i < len(host); i++ {
+		c := host[i]
+		if !('a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,140 @@
+package threatfeed
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openFixtures(t *testing.T) *Feed {
+	t.Helper()
+
+	feed, err := Open("testdata/urlhaus.csv", "testdata/phishtank.csv", "testdata/hosts.txt")
+	if err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	return feed
+}
+
+func TestOpen(t *testing.T) {
+	feed := openFixtures(t)
+
+	hosts, urls := feed.Len()
+	if hosts != 5 {
+		t.Errorf("expected 5 hosts, but got %d", hosts)
+	}
+	if urls != 6 {
+		t.Errorf("expected 6 URLs, but got %d", urls)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	feed := openFixtures(t)
+
+	testCases := []struct {
+		name          string
+		url           string
+		expectedMatch string
+	}{
+		{"URLhaus URL", "http://203.0.113.7:8080/bins/mozi.m", "urlhaus.csv: url http://203.0.113.7:8080/bins/mozi.m"},
+		{"URLhaus URL Host Case", "https://drive.example.net/files/Invoice.exe", "urlhaus.csv: url https://drive.example.net/files/Invoice.exe"},
+		{"URLhaus URL Query", "http://compromised.example.org/wp-content/x.php?id=7", "urlhaus.csv: url http://compromised.example.org/wp-content/x.php?id=7"},
+		{"URLhaus Site Not Blocked", "http://compromised.example.org/", ""},
+		{"URLhaus Path Case Kept", "https://drive.example.net/files/invoice.exe", ""},
+		{"PhishTank URL", "https://login.bank-secure.example/verify/", "phishtank.csv: url https://login.bank-secure.example/verify/"},
+		{"PhishTank URL Default Port", "http://paypa1.example:80/signin?session=abc#top", "phishtank.csv: url http://paypa1.example/signin?session=abc"},
+		{"Host", "https://evil.example/anything", "hosts.txt: host evil.example"},
+		{"Subdomain", "https://a.b.evil.example/", "hosts.txt: host evil.example"},
+		{"Lookalike Host", "https://notevil.example/", ""},
+		{"Second Host On Line", "http://cdn.bad.example/x", "hosts.txt: host cdn.bad.example"},
+		{"Parent Not Listed", "http://bad.example/", ""},
+		{"Bare Host", "https://www.phish.test/login", "hosts.txt: host phish.test"},
+		{"IP Host", "http://198.51.100.23/", "hosts.txt: host 198.51.100.23"},
+		{"URL In List", "https://url-in-list.example/payload.bin", "hosts.txt: url https://url-in-list.example/payload.bin"},
+		{"Localhost Ignored", "http://localhost/", ""},
+		{"Clean", "https://example.com/", ""},
+		{"Unparseable", "://nope", ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m, ok := feed.Match(tc.url)
+			if ok != (tc.expectedMatch != "") {
+				t.Fatalf("expected match=%v, but got %v (%v)", tc.expectedMatch != "", ok, m)
+			}
+			if ok && m.String() != tc.expectedMatch {
+				t.Errorf("expected %q, but got %q", tc.expectedMatch, m.String())
+			}
+		})
+	}
+}
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts.txt")
+	if err := os.WriteFile(path, []byte("evil.example\n"), 0o600); err != nil {
+		t.Fatalf("failed to write feed: %v", err)
+	}
+
+	feed, err := Open(path)
+	if err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	if _, ok := feed.Match("https://later.example/"); ok {
+		t.Fatal("expected no match before the feed is updated")
+	}
+
+	if err := os.WriteFile(path, []byte("evil.example\nlater.example\n"), 0o600); err != nil {
+		t.Fatalf("failed to write feed: %v", err)
+	}
+	if err := feed.Reload(); err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	if _, ok := feed.Match("https://later.example/"); !ok {
+		t.Error("expected a match after the feed is reloaded")
+	}
+
+	// A feed that disappears leaves the loaded entries in place.
+	os.Remove(path)
+	if err := feed.Reload(); !errors.Is(err, ErrInvalidFeed) {
+		t.Fatalf("expected ErrInvalidFeed, but got %v", err)
+	}
+	if _, ok := feed.Match("https://later.example/"); !ok {
+		t.Error("expected the previous entries to be kept")
+	}
+}
+
+func TestOpenNoFeeds(t *testing.T) {
+	feed, err := Open()
+	if err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	if _, ok := feed.Match("https://evil.example/"); ok {
+		t.Error("expected an empty feed to match nothing")
+	}
+}
+
+func TestBloom(t *testing.T) {
+	const n = 10000
+	b := newBloom(n, falsePositiveRate)
+	for i := range n {
+		b.add(fmt.Sprintf("host-%d.example", i))
+	}
+
+	for i := range n {
+		if !b.mayContain(fmt.Sprintf("host-%d.example", i)) {
+			t.Fatalf("expected host-%d.example to be present", i)
+		}
+	}
+
+	falsePositives := 0
+	for i := range n {
+		if b.mayContain(fmt.Sprintf("other-%d.example", i)) {
+			falsePositives++
+		}
+	}
+	if rate := float64(falsePositives) / n; rate > 3*falsePositiveRate {
+		t.Errorf("expected a false-positive rate near %v, but got %v", falsePositiveRate, rate)
+	}
+}
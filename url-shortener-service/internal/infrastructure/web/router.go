@@ -1,15 +1,50 @@
 package web
 
 import (
+	"net/http"
+
 	"github.com/gin-gonic/gin"
+
+	"github.com/iton0/duss/shared/health"
+	"github.com/iton0/duss/shared/logging"
+	"github.com/iton0/duss/shared/metrics"
+	"github.com/iton0/duss/shared/openapi"
+	"github.com/iton0/duss/shared/problem"
+	"github.com/iton0/duss/shared/tracing"
 	"github.com/iton0/duss/url-shortener-service/internal/api"
+	"github.com/iton0/duss/url-shortener-service/internal/spec"
 )
 
 // NewRouter creates a new Gin router and registers all routes.
 func NewRouter(shortenerHandler *api.ShortenerHandler) *gin.Engine {
-	router := gin.Default()
+	router := gin.New()
+	router.Use(logging.Middleware(), problem.Recovery(), tracing.Middleware(), metrics.Middleware())
+	// Requests must match the API description; responses that do not are
+	// logged.
+	router.Use(spec.Load().Middleware(openapi.WithResponseValidation()))
+	router.NoRoute(problem.NoRoute)
 
 	router.POST("/api/v1/shorten", shortenerHandler.HandleShortener)
+	router.POST("/api/v1/shorten/batch", shortenerHandler.HandleShortenBatch)
+	router.POST("/api/v1/shorten/jobs", shortenerHandler.HandleSubmitJob)
+	router.GET("/api/v1/shorten/jobs/:id", shortenerHandler.HandleGetJob)
+	router.GET("/api/v1/urls/:shortKey", shortenerHandler.HandleGetURL)
+	router.DELETE("/api/v1/urls/:shortKey", shortenerHandler.HandleDelete)
+	router.PUT("/api/v1/urls/:shortKey/trust", shortenerHandler.HandleSetTrust)
+	router.GET("/metrics", gin.WrapH(metrics.Handler()))
 
 	return router
 }
+
+// RegisterAdmin registers the admin API for the URL policy on router.
+func RegisterAdmin(router *gin.Engine, policyHandler http.Handler) {
+	router.GET("/api/v1/admin/policy", gin.WrapH(policyHandler))
+	router.PUT("/api/v1/admin/policy", gin.WrapH(policyHandler))
+}
+
+// RegisterHealth registers the liveness and readiness endpoints served by
+// checker on router.
+func RegisterHealth(router *gin.Engine, checker *health.Checker) {
+	router.GET("/healthz", gin.WrapH(checker.LiveHandler()))
+	router.GET("/readyz", gin.WrapH(checker.ReadyHandler()))
+}
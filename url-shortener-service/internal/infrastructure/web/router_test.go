@@ -1 +1,243 @@
 package web_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/iton0/duss/shared/health"
+	"github.com/iton0/duss/shared/policy"
+	"github.com/iton0/duss/shared/testutil/openapitest"
+	"github.com/iton0/duss/shared/testutil/pgtest"
+	"github.com/iton0/duss/url-shortener-service/internal/api"
+	"github.com/iton0/duss/url-shortener-service/internal/core/services"
+	"github.com/iton0/duss/url-shortener-service/internal/infrastructure/storage"
+	"github.com/iton0/duss/url-shortener-service/internal/infrastructure/web"
+	"github.com/iton0/duss/url-shortener-service/internal/spec"
+)
+
+func TestRouter(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	keyGen := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"short_key":"abc1234"}`))
+	}))
+	defer keyGen.Close()
+
+	pgStore := storage.NewPostgresClientFromDB(pgtest.New(t, storage.Schema))
+	shortenerService := services.NewShortenerService(pgStore, keyGen.URL, services.WithDomains("localhost:8081", "go.duss.io"))
+	shortenerHandler := api.NewShortenerHandler(shortenerService, "http://localhost:8081", api.WithAdminToken(adminToken))
+
+	router := newRouter(t, shortenerHandler)
+
+	testCases := []struct {
+		name               string
+		method             string
+		path               string
+		body               string
+		authorization      string
+		expectedStatusCode int
+	}{
+		{
+			name:               "Valid POST Request",
+			method:             http.MethodPost,
+			path:               "/api/v1/shorten",
+			body:               `{"url":"https://example.com/long/url"}`,
+			expectedStatusCode: http.StatusCreated,
+		},
+		{
+			name:               "Key Already Taken",
+			method:             http.MethodPost,
+			path:               "/api/v1/shorten",
+			body:               `{"url":"https://example.com/other"}`,
+			expectedStatusCode: http.StatusConflict,
+		},
+		{
+			name:               "Same Key On Another Domain",
+			method:             http.MethodPost,
+			path:               "/api/v1/shorten",
+			body:               `{"url":"https://example.com/other","domain":"go.duss.io"}`,
+			expectedStatusCode: http.StatusCreated,
+		},
+		{
+			name:               "Domain Not Allowed",
+			method:             http.MethodPost,
+			path:               "/api/v1/shorten",
+			body:               `{"url":"https://example.com/other","domain":"evil.example"}`,
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:               "Get On Default Domain",
+			method:             http.MethodGet,
+			path:               "/api/v1/urls/abc1234",
+			authorization:      "Bearer " + adminToken,
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:               "Get Without Token",
+			method:             http.MethodGet,
+			path:               "/api/v1/urls/abc1234",
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name:               "Delete With Wrong Token",
+			method:             http.MethodDelete,
+			path:               "/api/v1/urls/abc1234",
+			authorization:      "Bearer guess",
+			expectedStatusCode: http.StatusForbidden,
+		},
+		{
+			name:               "Get On Branded Domain",
+			method:             http.MethodGet,
+			path:               "/api/v1/urls/abc1234?domain=go.duss.io",
+			authorization:      "Bearer " + adminToken,
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:               "Delete On Branded Domain",
+			method:             http.MethodDelete,
+			path:               "/api/v1/urls/abc1234?domain=go.duss.io",
+			authorization:      "Bearer " + adminToken,
+			expectedStatusCode: http.StatusNoContent,
+		},
+		{
+			name:               "Get After Delete On Branded Domain",
+			method:             http.MethodGet,
+			path:               "/api/v1/urls/abc1234?domain=go.duss.io",
+			authorization:      "Bearer " + adminToken,
+			expectedStatusCode: http.StatusNotFound,
+		},
+		{
+			name:               "Default Domain Unaffected",
+			method:             http.MethodGet,
+			path:               "/api/v1/urls/abc1234",
+			authorization:      "Bearer " + adminToken,
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:               "Set Trust Without Token",
+			method:             http.MethodPut,
+			path:               "/api/v1/urls/abc1234/trust",
+			body:               `{"untrusted":true}`,
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name:               "Set Trust With Wrong Token",
+			method:             http.MethodPut,
+			path:               "/api/v1/urls/abc1234/trust",
+			body:               `{"untrusted":true}`,
+			authorization:      "Bearer guess",
+			expectedStatusCode: http.StatusForbidden,
+		},
+		{
+			name:               "Invalid Body",
+			method:             http.MethodPost,
+			path:               "/api/v1/shorten",
+			body:               `{"url":""}`,
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:               "Batch Request",
+			method:             http.MethodPost,
+			path:               "/api/v1/shorten/batch",
+			body:               `{"items":[{"url":"https://example.com/batch"}]}`,
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:               "Unknown Job",
+			method:             http.MethodGet,
+			path:               "/api/v1/shorten/jobs/0123456789abcdef",
+			expectedStatusCode: http.StatusNotFound,
+		},
+		{
+			name:               "GET on POST Endpoint",
+			method:             http.MethodGet,
+			path:               "/api/v1/shorten",
+			expectedStatusCode: http.StatusNotFound,
+		},
+		{
+			name:               "Get Policy",
+			method:             http.MethodGet,
+			path:               "/api/v1/admin/policy",
+			authorization:      "Bearer " + adminToken,
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:               "Put Policy Without Token",
+			method:             http.MethodPut,
+			path:               "/api/v1/admin/policy",
+			body:               `{"deny_domains":["evil.example"]}`,
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name:               "Liveness",
+			method:             http.MethodGet,
+			path:               "/healthz",
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:               "Readiness",
+			method:             http.MethodGet,
+			path:               "/readyz",
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:               "Metrics",
+			method:             http.MethodGet,
+			path:               "/metrics",
+			expectedStatusCode: http.StatusOK,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			if tc.authorization != "" {
+				req.Header.Set("Authorization", tc.authorization)
+			}
+
+			router.ServeHTTP(w, req)
+
+			if w.Code != tc.expectedStatusCode {
+				t.Errorf("for %s %s, expected status code %d, but got %d", tc.method, tc.path, tc.expectedStatusCode, w.Code)
+			}
+			openapitest.CheckResponse(t, spec.Load(), req, w)
+		})
+	}
+}
+
+// TestRouterMatchesSpec fails when a route is added or removed without
+// updating the API description, or the other way around.
+func TestRouterMatchesSpec(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	shortenerService := services.NewShortenerService(storage.NewPostgresClientFromDB(pgtest.New(t, storage.Schema)), "")
+	router := newRouter(t, api.NewShortenerHandler(shortenerService, "http://localhost:8081"))
+
+	openapitest.CheckRoutes(t, spec.Load(), router.Routes())
+}
+
+// adminToken is the token of the policy admin API of the routers built by
+// newRouter.
+const adminToken = "secret"
+
+// newRouter returns the service's router for handler with every optional
+// route registered.
+func newRouter(t *testing.T, handler *api.ShortenerHandler) *gin.Engine {
+	t.Helper()
+
+	engine, err := policy.New(policy.Rules{})
+	if err != nil {
+		t.Fatalf("failed to create policy engine: %v", err)
+	}
+	router := web.NewRouter(handler)
+	web.RegisterAdmin(router, engine.Handler(adminToken))
+	web.RegisterHealth(router, health.New("url-shortener-service"))
+	return router
+}